@@ -61,7 +61,7 @@ func (x Metric_SourceType) String() string {
 }
 
 func (Metric_SourceType) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{3, 0}
+	return fileDescriptor_4e65aa89943b533e, []int{5, 0}
 }
 
 type Request struct {
@@ -201,6 +201,7 @@ func (m *Response) GetDataString() []string {
 type Status struct {
 	Uuid                 string   `protobuf:"bytes,1,opt,name=uuid,proto3" json:"uuid,omitempty"`
 	Timestamp            int64    `protobuf:"varint,2,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	Command              *Command `protobuf:"bytes,3,opt,name=command,proto3" json:"command,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -245,6 +246,139 @@ func (m *Status) GetTimestamp() int64 {
 	return 0
 }
 
+func (m *Status) GetCommand() *Command {
+	if m != nil {
+		return m.Command
+	}
+	return nil
+}
+
+type Command struct {
+	Id                   string   `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Name                 string   `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Args                 []string `protobuf:"bytes,3,rep,name=args,proto3" json:"args,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Command) Reset()         { *m = Command{} }
+func (m *Command) String() string { return proto.CompactTextString(m) }
+func (*Command) ProtoMessage()    {}
+func (*Command) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4e65aa89943b533e, []int{3}
+}
+
+func (m *Command) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Command.Unmarshal(m, b)
+}
+func (m *Command) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Command.Marshal(b, m, deterministic)
+}
+func (m *Command) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Command.Merge(m, src)
+}
+func (m *Command) XXX_Size() int {
+	return xxx_messageInfo_Command.Size(m)
+}
+func (m *Command) XXX_DiscardUnknown() {
+	xxx_messageInfo_Command.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Command proto.InternalMessageInfo
+
+func (m *Command) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *Command) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *Command) GetArgs() []string {
+	if m != nil {
+		return m.Args
+	}
+	return nil
+}
+
+type CommandResult struct {
+	CommandId            string   `protobuf:"bytes,1,opt,name=command_id,json=commandId,proto3" json:"command_id,omitempty"`
+	Name                 string   `protobuf:"bytes,2,opt,name=name,proto3" json:"name,omitempty"`
+	Success              bool     `protobuf:"varint,3,opt,name=success,proto3" json:"success,omitempty"`
+	Error                string   `protobuf:"bytes,4,opt,name=error,proto3" json:"error,omitempty"`
+	Data                 []byte   `protobuf:"bytes,5,opt,name=data,proto3" json:"data,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CommandResult) Reset()         { *m = CommandResult{} }
+func (m *CommandResult) String() string { return proto.CompactTextString(m) }
+func (*CommandResult) ProtoMessage()    {}
+func (*CommandResult) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4e65aa89943b533e, []int{4}
+}
+
+func (m *CommandResult) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CommandResult.Unmarshal(m, b)
+}
+func (m *CommandResult) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CommandResult.Marshal(b, m, deterministic)
+}
+func (m *CommandResult) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CommandResult.Merge(m, src)
+}
+func (m *CommandResult) XXX_Size() int {
+	return xxx_messageInfo_CommandResult.Size(m)
+}
+func (m *CommandResult) XXX_DiscardUnknown() {
+	xxx_messageInfo_CommandResult.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CommandResult proto.InternalMessageInfo
+
+func (m *CommandResult) GetCommandId() string {
+	if m != nil {
+		return m.CommandId
+	}
+	return ""
+}
+
+func (m *CommandResult) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *CommandResult) GetSuccess() bool {
+	if m != nil {
+		return m.Success
+	}
+	return false
+}
+
+func (m *CommandResult) GetError() string {
+	if m != nil {
+		return m.Error
+	}
+	return ""
+}
+
+func (m *CommandResult) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
 type Metric struct {
 	Value                float64           `protobuf:"fixed64,1,opt,name=value,proto3" json:"value,omitempty"`
 	Ts                   int64             `protobuf:"varint,2,opt,name=ts,proto3" json:"ts,omitempty"`
@@ -266,7 +400,7 @@ func (m *Metric) Reset()         { *m = Metric{} }
 func (m *Metric) String() string { return proto.CompactTextString(m) }
 func (*Metric) ProtoMessage()    {}
 func (*Metric) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{3}
+	return fileDescriptor_4e65aa89943b533e, []int{5}
 }
 
 func (m *Metric) XXX_Unmarshal(b []byte) error {
@@ -375,7 +509,7 @@ func (m *Metrics) Reset()         { *m = Metrics{} }
 func (m *Metrics) String() string { return proto.CompactTextString(m) }
 func (*Metrics) ProtoMessage()    {}
 func (*Metrics) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{4}
+	return fileDescriptor_4e65aa89943b533e, []int{6}
 }
 
 func (m *Metrics) XXX_Unmarshal(b []byte) error {
@@ -417,7 +551,7 @@ func (m *Agent) Reset()         { *m = Agent{} }
 func (m *Agent) String() string { return proto.CompactTextString(m) }
 func (*Agent) ProtoMessage()    {}
 func (*Agent) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{5}
+	return fileDescriptor_4e65aa89943b533e, []int{7}
 }
 
 func (m *Agent) XXX_Unmarshal(b []byte) error {
@@ -488,7 +622,7 @@ func (m *Node) Reset()         { *m = Node{} }
 func (m *Node) String() string { return proto.CompactTextString(m) }
 func (*Node) ProtoMessage()    {}
 func (*Node) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{6}
+	return fileDescriptor_4e65aa89943b533e, []int{8}
 }
 
 func (m *Node) XXX_Unmarshal(b []byte) error {
@@ -606,7 +740,7 @@ func (m *NodeMetrics) Reset()         { *m = NodeMetrics{} }
 func (m *NodeMetrics) String() string { return proto.CompactTextString(m) }
 func (*NodeMetrics) ProtoMessage()    {}
 func (*NodeMetrics) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{7}
+	return fileDescriptor_4e65aa89943b533e, []int{9}
 }
 
 func (m *NodeMetrics) XXX_Unmarshal(b []byte) error {
@@ -665,7 +799,7 @@ func (m *Process) Reset()         { *m = Process{} }
 func (m *Process) String() string { return proto.CompactTextString(m) }
 func (*Process) ProtoMessage()    {}
 func (*Process) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{8}
+	return fileDescriptor_4e65aa89943b533e, []int{10}
 }
 
 func (m *Process) XXX_Unmarshal(b []byte) error {
@@ -748,7 +882,7 @@ func (m *ProcessAll) Reset()         { *m = ProcessAll{} }
 func (m *ProcessAll) String() string { return proto.CompactTextString(m) }
 func (*ProcessAll) ProtoMessage()    {}
 func (*ProcessAll) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{9}
+	return fileDescriptor_4e65aa89943b533e, []int{11}
 }
 
 func (m *ProcessAll) XXX_Unmarshal(b []byte) error {
@@ -806,7 +940,7 @@ func (m *ProcessMetrics) Reset()         { *m = ProcessMetrics{} }
 func (m *ProcessMetrics) String() string { return proto.CompactTextString(m) }
 func (*ProcessMetrics) ProtoMessage()    {}
 func (*ProcessMetrics) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{10}
+	return fileDescriptor_4e65aa89943b533e, []int{12}
 }
 
 func (m *ProcessMetrics) XXX_Unmarshal(b []byte) error {
@@ -884,7 +1018,7 @@ func (m *Container) Reset()         { *m = Container{} }
 func (m *Container) String() string { return proto.CompactTextString(m) }
 func (*Container) ProtoMessage()    {}
 func (*Container) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{11}
+	return fileDescriptor_4e65aa89943b533e, []int{13}
 }
 
 func (m *Container) XXX_Unmarshal(b []byte) error {
@@ -953,7 +1087,7 @@ func (m *ContainerAll) Reset()         { *m = ContainerAll{} }
 func (m *ContainerAll) String() string { return proto.CompactTextString(m) }
 func (*ContainerAll) ProtoMessage()    {}
 func (*ContainerAll) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{12}
+	return fileDescriptor_4e65aa89943b533e, []int{14}
 }
 
 func (m *ContainerAll) XXX_Unmarshal(b []byte) error {
@@ -1009,7 +1143,7 @@ func (m *ContainerMetrics) Reset()         { *m = ContainerMetrics{} }
 func (m *ContainerMetrics) String() string { return proto.CompactTextString(m) }
 func (*ContainerMetrics) ProtoMessage()    {}
 func (*ContainerMetrics) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{13}
+	return fileDescriptor_4e65aa89943b533e, []int{15}
 }
 
 func (m *ContainerMetrics) XXX_Unmarshal(b []byte) error {
@@ -1080,7 +1214,7 @@ func (m *CPU) Reset()         { *m = CPU{} }
 func (m *CPU) String() string { return proto.CompactTextString(m) }
 func (*CPU) ProtoMessage()    {}
 func (*CPU) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{14}
+	return fileDescriptor_4e65aa89943b533e, []int{16}
 }
 
 func (m *CPU) XXX_Unmarshal(b []byte) error {
@@ -1204,7 +1338,7 @@ func (m *K8SObject) Reset()         { *m = K8SObject{} }
 func (m *K8SObject) String() string { return proto.CompactTextString(m) }
 func (*K8SObject) ProtoMessage()    {}
 func (*K8SObject) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{15}
+	return fileDescriptor_4e65aa89943b533e, []int{17}
 }
 
 func (m *K8SObject) XXX_Unmarshal(b []byte) error {
@@ -1302,7 +1436,7 @@ func (m *K8SCluster) Reset()         { *m = K8SCluster{} }
 func (m *K8SCluster) String() string { return proto.CompactTextString(m) }
 func (*K8SCluster) ProtoMessage()    {}
 func (*K8SCluster) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{16}
+	return fileDescriptor_4e65aa89943b533e, []int{18}
 }
 
 func (m *K8SCluster) XXX_Unmarshal(b []byte) error {
@@ -1365,7 +1499,7 @@ func (m *K8SNamespace) Reset()         { *m = K8SNamespace{} }
 func (m *K8SNamespace) String() string { return proto.CompactTextString(m) }
 func (*K8SNamespace) ProtoMessage()    {}
 func (*K8SNamespace) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{17}
+	return fileDescriptor_4e65aa89943b533e, []int{19}
 }
 
 func (m *K8SNamespace) XXX_Unmarshal(b []byte) error {
@@ -1427,7 +1561,7 @@ func (m *K8SPod) Reset()         { *m = K8SPod{} }
 func (m *K8SPod) String() string { return proto.CompactTextString(m) }
 func (*K8SPod) ProtoMessage()    {}
 func (*K8SPod) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{18}
+	return fileDescriptor_4e65aa89943b533e, []int{20}
 }
 
 func (m *K8SPod) XXX_Unmarshal(b []byte) error {
@@ -1481,7 +1615,7 @@ func (m *K8SNodeMetric) Reset()         { *m = K8SNodeMetric{} }
 func (m *K8SNodeMetric) String() string { return proto.CompactTextString(m) }
 func (*K8SNodeMetric) ProtoMessage()    {}
 func (*K8SNodeMetric) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{19}
+	return fileDescriptor_4e65aa89943b533e, []int{21}
 }
 
 func (m *K8SNodeMetric) XXX_Unmarshal(b []byte) error {
@@ -1528,7 +1662,7 @@ func (m *K8SContainerMetric) Reset()         { *m = K8SContainerMetric{} }
 func (m *K8SContainerMetric) String() string { return proto.CompactTextString(m) }
 func (*K8SContainerMetric) ProtoMessage()    {}
 func (*K8SContainerMetric) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{20}
+	return fileDescriptor_4e65aa89943b533e, []int{22}
 }
 
 func (m *K8SContainerMetric) XXX_Unmarshal(b []byte) error {
@@ -1576,7 +1710,7 @@ func (m *K8SPodMetric) Reset()         { *m = K8SPodMetric{} }
 func (m *K8SPodMetric) String() string { return proto.CompactTextString(m) }
 func (*K8SPodMetric) ProtoMessage()    {}
 func (*K8SPodMetric) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{21}
+	return fileDescriptor_4e65aa89943b533e, []int{23}
 }
 
 func (m *K8SPodMetric) XXX_Unmarshal(b []byte) error {
@@ -1632,7 +1766,7 @@ func (m *K8SMetrics) Reset()         { *m = K8SMetrics{} }
 func (m *K8SMetrics) String() string { return proto.CompactTextString(m) }
 func (*K8SMetrics) ProtoMessage()    {}
 func (*K8SMetrics) Descriptor() ([]byte, []int) {
-	return fileDescriptor_4e65aa89943b533e, []int{22}
+	return fileDescriptor_4e65aa89943b533e, []int{24}
 }
 
 func (m *K8SMetrics) XXX_Unmarshal(b []byte) error {
@@ -1681,11 +1815,68 @@ func (m *K8SMetrics) GetK8SPodMetrics() []*K8SPodMetric {
 	return nil
 }
 
+type TailMetrics struct {
+	CommandId            string    `protobuf:"bytes,1,opt,name=command_id,json=commandId,proto3" json:"command_id,omitempty"`
+	TsMs                 int64     `protobuf:"varint,2,opt,name=ts_ms,json=tsMs,proto3" json:"ts_ms,omitempty"`
+	Metrics              []*Metric `protobuf:"bytes,3,rep,name=metrics,proto3" json:"metrics,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
+}
+
+func (m *TailMetrics) Reset()         { *m = TailMetrics{} }
+func (m *TailMetrics) String() string { return proto.CompactTextString(m) }
+func (*TailMetrics) ProtoMessage()    {}
+func (*TailMetrics) Descriptor() ([]byte, []int) {
+	return fileDescriptor_4e65aa89943b533e, []int{25}
+}
+
+func (m *TailMetrics) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_TailMetrics.Unmarshal(m, b)
+}
+func (m *TailMetrics) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_TailMetrics.Marshal(b, m, deterministic)
+}
+func (m *TailMetrics) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_TailMetrics.Merge(m, src)
+}
+func (m *TailMetrics) XXX_Size() int {
+	return xxx_messageInfo_TailMetrics.Size(m)
+}
+func (m *TailMetrics) XXX_DiscardUnknown() {
+	xxx_messageInfo_TailMetrics.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_TailMetrics proto.InternalMessageInfo
+
+func (m *TailMetrics) GetCommandId() string {
+	if m != nil {
+		return m.CommandId
+	}
+	return ""
+}
+
+func (m *TailMetrics) GetTsMs() int64 {
+	if m != nil {
+		return m.TsMs
+	}
+	return 0
+}
+
+func (m *TailMetrics) GetMetrics() []*Metric {
+	if m != nil {
+		return m.Metrics
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterEnum("Metric_SourceType", Metric_SourceType_name, Metric_SourceType_value)
 	proto.RegisterType((*Request)(nil), "Request")
 	proto.RegisterType((*Response)(nil), "Response")
 	proto.RegisterType((*Status)(nil), "Status")
+	proto.RegisterType((*Command)(nil), "Command")
+	proto.RegisterType((*CommandResult)(nil), "CommandResult")
 	proto.RegisterType((*Metric)(nil), "Metric")
 	proto.RegisterType((*Metrics)(nil), "Metrics")
 	proto.RegisterType((*Agent)(nil), "Agent")
@@ -1707,114 +1898,123 @@ func init() {
 	proto.RegisterType((*K8SContainerMetric)(nil), "K8sContainerMetric")
 	proto.RegisterType((*K8SPodMetric)(nil), "K8sPodMetric")
 	proto.RegisterType((*K8SMetrics)(nil), "K8sMetrics")
+	proto.RegisterType((*TailMetrics)(nil), "TailMetrics")
 }
 
 func init() { proto.RegisterFile("nexclipper.proto", fileDescriptor_4e65aa89943b533e) }
 
 var fileDescriptor_4e65aa89943b533e = []byte{
-	// 1621 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x18, 0x4d, 0x73, 0xdb, 0xc6,
-	0xd5, 0x20, 0xf8, 0x85, 0x47, 0x52, 0xa2, 0xd7, 0x8a, 0xcb, 0x28, 0x69, 0xcb, 0xa0, 0x33, 0x09,
-	0xd3, 0x49, 0xd1, 0x8e, 0xa4, 0x7a, 0xd8, 0xdc, 0x3c, 0x8a, 0xda, 0xe1, 0xb8, 0x95, 0x34, 0xcb,
-	0xb8, 0x57, 0x0e, 0x04, 0x6c, 0x24, 0x98, 0x20, 0x16, 0xc1, 0x2e, 0xd5, 0x4a, 0x7f, 0xa0, 0xb7,
-	0x4e, 0xee, 0xbd, 0xf7, 0x96, 0x5b, 0x8f, 0xbd, 0xf5, 0xec, 0xff, 0xd3, 0x63, 0xe6, 0xed, 0x07,
-	0x00, 0x8a, 0x96, 0x2d, 0xfb, 0xc4, 0xf7, 0xb5, 0xef, 0xbd, 0x7d, 0x5f, 0xfb, 0x40, 0x18, 0x66,
-	0xec, 0xef, 0x51, 0x9a, 0xe4, 0x39, 0x2b, 0x82, 0xbc, 0xe0, 0x92, 0xfb, 0x57, 0xd0, 0xa1, 0xec,
-	0xfb, 0x35, 0x13, 0x92, 0xfc, 0x1c, 0x20, 0x0e, 0x65, 0xb8, 0x48, 0x32, 0x79, 0x78, 0x30, 0x72,
-	0xc6, 0xee, 0xa4, 0x45, 0x3d, 0xa4, 0xcc, 0x90, 0x50, 0x67, 0x3f, 0x3b, 0x1a, 0x35, 0xc6, 0xee,
-	0xc4, 0x2d, 0xd9, 0xcf, 0x8e, 0xc8, 0x2f, 0xa1, 0xa7, 0xd8, 0x42, 0x16, 0x49, 0x76, 0x39, 0x72,
-	0xc7, 0xee, 0xc4, 0xa3, 0xea, 0xc4, 0x5c, 0x51, 0xfc, 0x1f, 0x1d, 0xe8, 0x52, 0x26, 0x72, 0x9e,
-	0x09, 0x46, 0x46, 0xd0, 0x11, 0xeb, 0x28, 0x62, 0x42, 0x8c, 0x9c, 0xb1, 0x33, 0xe9, 0x52, 0x8b,
-	0x12, 0x02, 0xcd, 0x88, 0xc7, 0x6c, 0xd4, 0x18, 0x3b, 0x93, 0x01, 0x55, 0x30, 0xd9, 0x83, 0x16,
-	0x2b, 0x0a, 0x5e, 0x8c, 0xdc, 0xb1, 0x33, 0xf1, 0xa8, 0x46, 0xee, 0xf8, 0xdb, 0x7c, 0xbb, 0xbf,
-	0xad, 0x77, 0xf8, 0xdb, 0xde, 0xf2, 0xf7, 0x6b, 0x68, 0xcf, 0x65, 0x28, 0xd7, 0xca, 0xa5, 0xf5,
-	0x3a, 0x89, 0x95, 0xa7, 0x1e, 0x55, 0x30, 0xf9, 0x14, 0x3c, 0x99, 0xac, 0x98, 0x90, 0xe1, 0x2a,
-	0x57, 0xbe, 0xba, 0xb4, 0x22, 0xf8, 0xff, 0x74, 0xa1, 0xfd, 0x17, 0x26, 0x8b, 0x24, 0x42, 0xdf,
-	0xaf, 0xc3, 0x74, 0xcd, 0xd4, 0x69, 0x87, 0x6a, 0x84, 0xec, 0x40, 0x43, 0x0a, 0x73, 0xae, 0x21,
-	0x05, 0xc6, 0x23, 0x4a, 0xd7, 0x42, 0x32, 0x7b, 0x47, 0x8b, 0xa2, 0xf1, 0x0c, 0xe3, 0xd1, 0xd4,
-	0xc6, 0x11, 0x26, 0x87, 0xd0, 0x13, 0x7c, 0x5d, 0x44, 0x6c, 0x21, 0x6f, 0x72, 0x36, 0x6a, 0x8d,
-	0x9d, 0xc9, 0xce, 0x01, 0x09, 0xb4, 0xc5, 0x60, 0xae, 0x58, 0xdf, 0xde, 0xe4, 0x8c, 0x82, 0x28,
-	0x61, 0xf2, 0x14, 0xda, 0x1a, 0x1b, 0xb5, 0x95, 0x2a, 0x83, 0x61, 0x9c, 0x8c, 0xb2, 0x24, 0x93,
-	0xa3, 0xce, 0xd8, 0xc1, 0x30, 0x6a, 0xca, 0x2c, 0x93, 0x64, 0x1f, 0xba, 0x2c, 0x8b, 0x73, 0x8e,
-	0xcc, 0xae, 0x3a, 0x58, 0xe2, 0xca, 0xb7, 0x70, 0xc5, 0x46, 0x9e, 0xf1, 0x2d, 0x5c, 0xa9, 0x5c,
-	0xa5, 0xe1, 0x05, 0x4b, 0x47, 0xa0, 0x73, 0xa5, 0x10, 0x94, 0x54, 0xae, 0xf6, 0xb4, 0x24, 0xc2,
-	0xfe, 0x2b, 0x80, 0xca, 0x55, 0xd2, 0x85, 0xe6, 0xe9, 0xd9, 0xe9, 0xc9, 0xf0, 0x91, 0x86, 0xbe,
-	0x39, 0x19, 0x3a, 0xa4, 0x07, 0x9d, 0x73, 0x7a, 0x76, 0x7c, 0x32, 0x9f, 0x0f, 0x1b, 0x64, 0x00,
-	0xde, 0xf1, 0xd9, 0xe9, 0xb7, 0xcf, 0x67, 0xa7, 0x27, 0x74, 0xe8, 0x92, 0x3e, 0x74, 0x5f, 0x4c,
-	0xe7, 0x0b, 0x25, 0x09, 0x28, 0x89, 0xd8, 0xf9, 0xd9, 0x37, 0xc3, 0x1e, 0x79, 0x0c, 0x03, 0x44,
-	0x2a, 0xe9, 0xbe, 0xff, 0x15, 0x74, 0x74, 0x74, 0x04, 0xf9, 0x0c, 0x3a, 0x2b, 0x0d, 0xaa, 0x22,
-	0xee, 0x1d, 0x74, 0x4c, 0xe0, 0xa8, 0xa5, 0xfb, 0x12, 0x5a, 0xcf, 0x2f, 0x59, 0x26, 0x31, 0x2d,
-	0xd7, 0xac, 0x10, 0x09, 0xcf, 0x4c, 0xf2, 0x2d, 0x8a, 0xf9, 0x5f, 0x85, 0xd1, 0x55, 0x92, 0xb1,
-	0x59, 0xac, 0xf2, 0xe8, 0xd1, 0x8a, 0xf0, 0x96, 0x74, 0x7e, 0x5c, 0x4b, 0x67, 0xef, 0xa0, 0x15,
-	0x9c, 0xf2, 0x98, 0xe9, 0xac, 0xfa, 0xff, 0x6f, 0x40, 0x13, 0x51, 0x0c, 0xd6, 0x15, 0x17, 0xd2,
-	0xd6, 0x1b, 0xc2, 0x58, 0x30, 0x5c, 0x18, 0x43, 0x0d, 0x2e, 0x30, 0x2d, 0x79, 0x1a, 0xca, 0xef,
-	0x78, 0xb1, 0x32, 0x26, 0x4a, 0x9c, 0x7c, 0x01, 0xbb, 0x16, 0x5e, 0x7c, 0x17, 0xae, 0x92, 0xf4,
-	0xc6, 0x54, 0xcf, 0x8e, 0x25, 0xff, 0x51, 0x51, 0xc9, 0x97, 0x30, 0x2c, 0x05, 0xed, 0x3d, 0x5b,
-	0x4a, 0xb2, 0x54, 0xf0, 0x57, 0x73, 0xdf, 0x43, 0xf8, 0xe8, 0x3a, 0x29, 0xe4, 0x3a, 0x4c, 0x93,
-	0xdb, 0x50, 0x26, 0x3c, 0x5b, 0x88, 0x1b, 0x21, 0xd9, 0xca, 0x14, 0xd3, 0xde, 0x26, 0x73, 0xae,
-	0x78, 0xe4, 0xb7, 0xf0, 0xe4, 0xce, 0xa1, 0x82, 0xa7, 0x4c, 0xd5, 0x98, 0x47, 0xc9, 0x26, 0x8b,
-	0xf2, 0x54, 0xd5, 0xe8, 0x3a, 0xc7, 0x36, 0x52, 0xa5, 0xd6, 0xa4, 0x06, 0xc3, 0x88, 0x24, 0xf9,
-	0xf5, 0x91, 0x2d, 0x34, 0x84, 0x0d, 0xed, 0x99, 0xa9, 0x33, 0x05, 0x23, 0x2d, 0xe7, 0x85, 0x54,
-	0x65, 0x36, 0xa0, 0x0a, 0x26, 0x7e, 0x95, 0xef, 0xbe, 0x0a, 0x7a, 0xd7, 0xe4, 0x5b, 0x54, 0x09,
-	0x5f, 0x40, 0x0f, 0x23, 0x6f, 0x4b, 0xa4, 0x96, 0x3e, 0x67, 0xab, 0x1b, 0x55, 0x6a, 0x1a, 0xb5,
-	0xd4, 0xd4, 0x0c, 0xb8, 0xf7, 0x19, 0xf8, 0xd1, 0x81, 0xce, 0x79, 0xc1, 0xd5, 0x84, 0xfb, 0x14,
-	0xbc, 0x88, 0x67, 0x32, 0x4c, 0xb2, 0x52, 0x7f, 0x45, 0x20, 0x43, 0x70, 0xf3, 0x44, 0x97, 0x54,
-	0x8b, 0x22, 0x58, 0x76, 0x99, 0x5b, 0xeb, 0xb2, 0x21, 0xb8, 0xd1, 0x2a, 0x36, 0x69, 0x45, 0x50,
-	0x0d, 0x29, 0xc1, 0x0a, 0x93, 0x3f, 0x05, 0x63, 0x2f, 0x5e, 0x16, 0x7c, 0x9d, 0x9b, 0x24, 0x69,
-	0xa4, 0xee, 0x6f, 0xe7, 0x3e, 0x7f, 0x2f, 0x00, 0x8c, 0xbb, 0xcf, 0xd3, 0xf4, 0x3d, 0xe3, 0xf1,
-	0x39, 0x78, 0xb9, 0x3e, 0xcb, 0x84, 0x7a, 0x07, 0xd0, 0x82, 0xd1, 0x46, 0x2b, 0x96, 0xff, 0x6f,
-	0x07, 0x76, 0x0c, 0xf9, 0xc3, 0x02, 0xbf, 0x11, 0x48, 0xf7, 0x9e, 0x40, 0x36, 0xb7, 0x03, 0xd9,
-	0xaa, 0x05, 0xb2, 0x16, 0x8c, 0xf6, 0x7d, 0xc1, 0xf8, 0xc1, 0x01, 0xef, 0xb8, 0xd4, 0x6b, 0x47,
-	0x99, 0x53, 0x8d, 0x32, 0xf2, 0x19, 0xf4, 0x4b, 0xc3, 0x8b, 0xc4, 0x0e, 0x84, 0x5e, 0x49, 0x9b,
-	0xbd, 0x39, 0x8b, 0x7b, 0xd0, 0x4a, 0x56, 0xe1, 0xa5, 0x1d, 0xee, 0x1a, 0x79, 0x90, 0x4b, 0x57,
-	0xd0, 0x2f, 0x3d, 0x7a, 0xff, 0x0c, 0xfd, 0x1a, 0xa0, 0x74, 0xcd, 0xa6, 0x08, 0x82, 0x52, 0x21,
-	0xad, 0x71, 0xfd, 0x7f, 0x38, 0x30, 0x2c, 0x39, 0x1f, 0x96, 0xa7, 0xbb, 0xd1, 0x71, 0xb7, 0xa3,
-	0x53, 0xbb, 0x73, 0xf3, 0xbe, 0x3b, 0xff, 0xb7, 0x01, 0xee, 0xf1, 0xf9, 0x4b, 0x55, 0xfb, 0xf9,
-	0x5a, 0x19, 0x6e, 0x51, 0x04, 0xc9, 0x27, 0xe0, 0x5d, 0xb3, 0x2c, 0xe6, 0xb5, 0xd8, 0x77, 0x35,
-	0x61, 0x16, 0xe3, 0x4c, 0x31, 0x43, 0x50, 0xdb, 0x35, 0x18, 0x06, 0x7f, 0xc5, 0x63, 0x96, 0xda,
-	0xe0, 0x2b, 0x04, 0xe7, 0xaa, 0x90, 0x2c, 0xcf, 0x71, 0x27, 0x68, 0x29, 0x0b, 0x25, 0x8e, 0x2b,
-	0x43, 0x7e, 0x75, 0x23, 0x92, 0x28, 0x4c, 0xd1, 0x90, 0x6e, 0x2a, 0xb0, 0xa4, 0x59, 0x4c, 0x7e,
-	0x06, 0x9d, 0x88, 0x17, 0x0c, 0x99, 0x7a, 0xc6, 0xb5, 0x11, 0x9d, 0xc5, 0x68, 0x0b, 0x21, 0xa1,
-	0xc6, 0x5a, 0x8b, 0x6a, 0x04, 0x5f, 0x5e, 0x65, 0x74, 0x51, 0x7b, 0x44, 0x3d, 0x45, 0x39, 0x35,
-	0x3d, 0xbe, 0xba, 0xba, 0x55, 0xf3, 0xcd, 0xa1, 0x08, 0xe2, 0x81, 0x28, 0x8c, 0xae, 0xd8, 0x42,
-	0x24, 0xb7, 0xfa, 0x2d, 0x6d, 0x51, 0x4f, 0x51, 0xe6, 0xc9, 0x2d, 0x53, 0x6f, 0x52, 0x12, 0x15,
-	0x5c, 0xed, 0x4f, 0x7d, 0xa3, 0xce, 0x12, 0xfc, 0xd7, 0x0d, 0xf0, 0x5e, 0x4c, 0xc5, 0xd9, 0xc5,
-	0x2b, 0x16, 0x49, 0xbc, 0x4b, 0x98, 0x27, 0xe5, 0xd4, 0xd7, 0x31, 0x80, 0x30, 0x4f, 0xec, 0xc0,
-	0xdf, 0x87, 0xee, 0x8a, 0xc9, 0x10, 0x17, 0x22, 0x93, 0xe3, 0x12, 0xc7, 0x24, 0x8b, 0x9c, 0x45,
-	0x36, 0xc9, 0x08, 0xab, 0xf5, 0x42, 0xad, 0x4b, 0x36, 0xcc, 0xa2, 0x5c, 0x9e, 0x96, 0x49, 0x16,
-	0xdb, 0xa6, 0x43, 0xb8, 0xec, 0x85, 0x76, 0xad, 0x17, 0x02, 0x68, 0xab, 0x55, 0x01, 0x87, 0x12,
-	0xd6, 0xe3, 0xd3, 0xa0, 0x74, 0x36, 0xf8, 0xb3, 0x62, 0x9c, 0x64, 0xb2, 0xb8, 0xa1, 0x46, 0x0a,
-	0x2f, 0xb0, 0x9c, 0x8a, 0x85, 0x2d, 0x43, 0xbd, 0x9a, 0xc0, 0x72, 0x2a, 0x8e, 0x4d, 0x25, 0xfe,
-	0x0a, 0x06, 0x28, 0x80, 0xca, 0x45, 0x1e, 0x46, 0x36, 0xc0, 0xfd, 0xe5, 0x54, 0x9c, 0x5a, 0xda,
-	0xfe, 0x1f, 0xa0, 0x57, 0x53, 0x8e, 0x21, 0x5f, 0xb2, 0x1b, 0x73, 0x5f, 0x04, 0xab, 0xf5, 0x4d,
-	0xdf, 0x55, 0x23, 0x5f, 0x37, 0xa6, 0x8e, 0xff, 0x1f, 0x07, 0xe0, 0x45, 0x65, 0xce, 0x87, 0x36,
-	0x57, 0xde, 0xaa, 0xd3, 0xd8, 0x4f, 0xa5, 0xff, 0xd4, 0x70, 0xd0, 0xa5, 0x10, 0xf7, 0x8a, 0xd2,
-	0x6b, 0xad, 0xb4, 0xaf, 0x88, 0x56, 0xd1, 0x11, 0xec, 0x6c, 0xf8, 0x6d, 0x1b, 0x74, 0x80, 0x0a,
-	0x4b, 0xcf, 0xe9, 0xa0, 0x7e, 0x0f, 0x41, 0xbe, 0x00, 0x4f, 0x9d, 0xe2, 0x31, 0x13, 0x6a, 0x17,
-	0xde, 0xf4, 0xa0, 0x8b, 0xd2, 0xc8, 0xf3, 0xff, 0xe5, 0x40, 0xbf, 0xae, 0xe8, 0x41, 0x8e, 0x8f,
-	0xa1, 0x95, 0x48, 0xb6, 0xb2, 0x1b, 0x53, 0x5d, 0x44, 0x33, 0xc8, 0x04, 0xbc, 0xbf, 0xf1, 0x62,
-	0x99, 0xf2, 0x30, 0xae, 0x26, 0x4a, 0x25, 0x55, 0x31, 0xc9, 0x27, 0xf8, 0x46, 0xc7, 0xd6, 0xc9,
-	0x0e, 0x0a, 0x9d, 0xf3, 0x98, 0x2a, 0xa2, 0xff, 0x0a, 0xda, 0x1a, 0x7f, 0x90, 0x5b, 0x43, 0x70,
-	0xbf, 0x2f, 0xb7, 0x22, 0x04, 0xdf, 0x6b, 0xb2, 0x9d, 0xe1, 0x9a, 0x28, 0xaa, 0x77, 0x1f, 0xc7,
-	0x08, 0xc6, 0x4f, 0xb7, 0xa3, 0xa9, 0x79, 0x24, 0xa8, 0x6e, 0x7c, 0xc0, 0xda, 0xf8, 0x12, 0x08,
-	0x16, 0xc4, 0xe6, 0xb0, 0x7c, 0xc7, 0x73, 0xff, 0x00, 0xb5, 0x3f, 0xe8, 0x8c, 0x9d, 0xf3, 0xb8,
-	0xd2, 0x58, 0x55, 0xb5, 0xd1, 0x58, 0x12, 0xc8, 0xc7, 0xd0, 0xcd, 0x79, 0xac, 0x2f, 0xa1, 0x23,
-	0xd3, 0xc9, 0x79, 0xac, 0xee, 0xf0, 0x27, 0xf8, 0x48, 0xf5, 0x4c, 0x39, 0x8c, 0xab, 0xbd, 0x05,
-	0x4d, 0x3f, 0x09, 0xb6, 0xdd, 0xa7, 0x4f, 0x96, 0x5b, 0x34, 0xe1, 0xff, 0x4f, 0xd7, 0xbe, 0x7d,
-	0x0e, 0xb6, 0xea, 0xda, 0x79, 0x43, 0x5d, 0xdf, 0x69, 0xd8, 0xc6, 0x56, 0xc3, 0x4e, 0x61, 0x68,
-	0x4b, 0xf8, 0x8e, 0x63, 0x3b, 0xc1, 0x46, 0xa2, 0xe8, 0xce, 0xb2, 0x8e, 0x0a, 0xf2, 0x7b, 0xd8,
-	0xc5, 0x93, 0x78, 0xed, 0xea, 0x15, 0x29, 0x7b, 0xa6, 0x0c, 0x9c, 0xea, 0x99, 0x12, 0x13, 0x07,
-	0xaf, 0x5d, 0x7c, 0xd7, 0xd3, 0x94, 0x45, 0x92, 0x17, 0xe4, 0x17, 0xd0, 0x3c, 0xc7, 0x29, 0xdf,
-	0x09, 0xf4, 0x67, 0xdf, 0xbe, 0x05, 0xfc, 0x47, 0x13, 0xe7, 0x77, 0x0e, 0xf1, 0xa1, 0xf7, 0x32,
-	0x8f, 0x43, 0xc9, 0xf4, 0xa7, 0x41, 0x3b, 0x50, 0xbf, 0xfb, 0x5e, 0x60, 0x3f, 0x6a, 0xfd, 0x47,
-	0xe4, 0x4b, 0x18, 0x68, 0x19, 0xbb, 0xeb, 0xf5, 0x82, 0x6a, 0x8d, 0xda, 0x14, 0xfd, 0x0d, 0xec,
-	0x6a, 0xd1, 0x6a, 0xb3, 0x18, 0x04, 0xf5, 0x37, 0x7d, 0x53, 0xfc, 0x73, 0x18, 0x50, 0x86, 0xfb,
-	0xac, 0xbd, 0x73, 0xf9, 0x40, 0x6e, 0xca, 0x05, 0xf0, 0x58, 0xcb, 0xd5, 0xe3, 0xd3, 0x0f, 0x6a,
-	0xd8, 0xa6, 0xfc, 0x11, 0xec, 0x69, 0xf9, 0x3b, 0x9b, 0xd8, 0x6e, 0xb0, 0x49, 0xd8, 0x3c, 0x35,
-	0x85, 0xa7, 0xfa, 0xd4, 0xd6, 0x66, 0xf0, 0x38, 0xb8, 0x4b, 0xda, 0x3c, 0xf9, 0x15, 0x0c, 0xf5,
-	0xb5, 0x6b, 0xa3, 0xb3, 0x17, 0x54, 0xc8, 0x96, 0xb4, 0xb6, 0x53, 0x2b, 0x36, 0x25, 0xfd, 0x26,
-	0xdd, 0x17, 0x6d, 0xf5, 0x97, 0xc6, 0xe1, 0x4f, 0x01, 0x00, 0x00, 0xff, 0xff, 0x3b, 0x5a, 0x81,
-	0x76, 0xe6, 0x10, 0x00, 0x00,
+	// 1750 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x18, 0x4d, 0x73, 0x1c, 0x47,
+	0xd5, 0xb3, 0xb3, 0x5f, 0xf3, 0x76, 0x57, 0x5e, 0xb7, 0x14, 0xb3, 0x51, 0x02, 0x6c, 0x86, 0xaa,
+	0x64, 0x43, 0x85, 0x81, 0x92, 0x85, 0x4b, 0x70, 0x73, 0x29, 0x82, 0xda, 0x32, 0x91, 0x54, 0x2d,
+	0x9b, 0x23, 0x5b, 0xe3, 0x99, 0x8e, 0x34, 0xd6, 0x7c, 0x65, 0xba, 0x57, 0x20, 0xff, 0x00, 0xb8,
+	0x51, 0xb9, 0x73, 0xe7, 0x96, 0x03, 0x55, 0x1c, 0xb9, 0x71, 0xe6, 0xff, 0x70, 0x4c, 0xbd, 0xfe,
+	0x9a, 0x19, 0xad, 0x14, 0xcb, 0x3e, 0xed, 0xfb, 0xea, 0xf7, 0x5e, 0xbf, 0xaf, 0x7e, 0xb3, 0x30,
+	0xcd, 0xd9, 0x5f, 0xa2, 0x34, 0x29, 0x4b, 0x56, 0x05, 0x65, 0x55, 0x88, 0xc2, 0xbf, 0x80, 0x01,
+	0x65, 0xdf, 0xac, 0x19, 0x17, 0xe4, 0xc7, 0x00, 0x71, 0x28, 0xc2, 0x55, 0x92, 0x8b, 0x27, 0x7b,
+	0x33, 0x67, 0xee, 0x2e, 0x7a, 0xd4, 0x43, 0xca, 0x12, 0x09, 0x4d, 0xf6, 0xd3, 0xfd, 0x59, 0x67,
+	0xee, 0x2e, 0x5c, 0xcb, 0x7e, 0xba, 0x4f, 0x7e, 0x0a, 0x23, 0xc9, 0xe6, 0xa2, 0x4a, 0xf2, 0xf3,
+	0x99, 0x3b, 0x77, 0x17, 0x1e, 0x95, 0x27, 0xce, 0x24, 0xc5, 0xff, 0xce, 0x81, 0x21, 0x65, 0xbc,
+	0x2c, 0x72, 0xce, 0xc8, 0x0c, 0x06, 0x7c, 0x1d, 0x45, 0x8c, 0xf3, 0x99, 0x33, 0x77, 0x16, 0x43,
+	0x6a, 0x50, 0x42, 0xa0, 0x1b, 0x15, 0x31, 0x9b, 0x75, 0xe6, 0xce, 0x62, 0x42, 0x25, 0x4c, 0x76,
+	0xa0, 0xc7, 0xaa, 0xaa, 0xa8, 0x66, 0xee, 0xdc, 0x59, 0x78, 0x54, 0x21, 0x37, 0xfc, 0xed, 0xfe,
+	0xb0, 0xbf, 0xbd, 0xb7, 0xf8, 0xdb, 0xdf, 0xf0, 0xf7, 0x4f, 0xd0, 0x3f, 0x13, 0xa1, 0x58, 0x4b,
+	0x97, 0xd6, 0xeb, 0x24, 0x96, 0x9e, 0x7a, 0x54, 0xc2, 0xe4, 0x63, 0xf0, 0x44, 0x92, 0x31, 0x2e,
+	0xc2, 0xac, 0x94, 0xbe, 0xba, 0xb4, 0x26, 0x10, 0x1f, 0x06, 0x51, 0x91, 0x65, 0x61, 0x1e, 0x4b,
+	0x97, 0x47, 0x7b, 0xc3, 0xe0, 0x50, 0xe1, 0xd4, 0x30, 0xfc, 0x67, 0x30, 0xd0, 0x34, 0xb2, 0x05,
+	0x1d, 0xab, 0xbe, 0x93, 0xc4, 0x68, 0x30, 0x0f, 0x33, 0x15, 0x03, 0x8f, 0x4a, 0x18, 0x69, 0x61,
+	0x75, 0xce, 0x75, 0x60, 0x25, 0xec, 0xff, 0xd5, 0x81, 0x89, 0xd1, 0xcb, 0xf8, 0x3a, 0x95, 0x39,
+	0xd4, 0xfa, 0x57, 0x56, 0xa3, 0xa7, 0x29, 0xcb, 0xdb, 0x15, 0x37, 0x52, 0xe1, 0xb6, 0x53, 0x61,
+	0xc3, 0xde, 0x6d, 0x86, 0x9d, 0x40, 0x17, 0xa3, 0x34, 0xeb, 0xcd, 0x9d, 0xc5, 0x98, 0x4a, 0xd8,
+	0xff, 0xbb, 0x0b, 0xfd, 0xaf, 0x98, 0xa8, 0x92, 0x08, 0x0f, 0x5d, 0x85, 0xe9, 0x9a, 0x49, 0xe3,
+	0x0e, 0x55, 0x08, 0xde, 0x50, 0x70, 0x1d, 0xa7, 0x8e, 0xe0, 0x68, 0x34, 0x4a, 0xd7, 0x5c, 0x30,
+	0x93, 0x53, 0x83, 0x4a, 0x17, 0x31, 0xff, 0x5d, 0xed, 0x22, 0xe6, 0xff, 0x09, 0x8c, 0x78, 0xb1,
+	0xae, 0x22, 0xb6, 0x12, 0xd7, 0x25, 0x93, 0x96, 0xb7, 0xf6, 0x48, 0xa0, 0x2c, 0x06, 0x67, 0x92,
+	0xf5, 0xe2, 0xba, 0x64, 0x14, 0xb8, 0x85, 0xc9, 0x63, 0xe8, 0x2b, 0x6c, 0xd6, 0x97, 0xaa, 0x34,
+	0x86, 0x21, 0xd2, 0xca, 0x92, 0x5c, 0xcc, 0x06, 0x73, 0x07, 0xcb, 0x46, 0x51, 0x96, 0xb9, 0x20,
+	0xbb, 0x30, 0x64, 0x79, 0x5c, 0x16, 0xc8, 0x1c, 0xca, 0x83, 0x16, 0xb7, 0xe1, 0xf3, 0x1a, 0xe1,
+	0xdb, 0x81, 0x5e, 0x1a, 0xbe, 0x62, 0xe9, 0x0c, 0x54, 0x90, 0x24, 0x82, 0x92, 0xd2, 0xd5, 0x91,
+	0x92, 0x44, 0xd8, 0x7f, 0x0d, 0x50, 0xbb, 0x4a, 0x86, 0xd0, 0x3d, 0x3e, 0x39, 0x3e, 0x9a, 0x3e,
+	0x50, 0xd0, 0x97, 0x47, 0x53, 0x87, 0x8c, 0x60, 0x70, 0x4a, 0x4f, 0x0e, 0x8f, 0xce, 0xce, 0xa6,
+	0x1d, 0x32, 0x01, 0xef, 0xf0, 0xe4, 0xf8, 0xc5, 0xb3, 0xe5, 0xf1, 0x11, 0x9d, 0xba, 0x64, 0x0c,
+	0xc3, 0xe7, 0x07, 0x67, 0x2b, 0x29, 0x09, 0x28, 0x89, 0xd8, 0xe9, 0xc9, 0x97, 0xd3, 0x11, 0x79,
+	0x04, 0x13, 0x44, 0x6a, 0xe9, 0xb1, 0xff, 0x05, 0x0c, 0x54, 0x74, 0x38, 0xf9, 0x04, 0x06, 0x99,
+	0x02, 0x65, 0xd3, 0x8e, 0xf6, 0x06, 0x3a, 0x70, 0xd4, 0xd0, 0x7d, 0x01, 0xbd, 0x67, 0xe7, 0x2c,
+	0x17, 0x98, 0x96, 0x2b, 0x56, 0xf1, 0xa4, 0xc8, 0x75, 0xed, 0x18, 0x14, 0xeb, 0x3d, 0x0b, 0xa3,
+	0x8b, 0x24, 0x67, 0xcb, 0x58, 0x97, 0x4f, 0x4d, 0xf8, 0x81, 0x74, 0x7e, 0xd8, 0x48, 0xe7, 0x68,
+	0xaf, 0x17, 0x1c, 0x17, 0x31, 0x53, 0x59, 0xf5, 0xff, 0xdf, 0x81, 0x2e, 0xa2, 0x18, 0xac, 0x8b,
+	0x82, 0x0b, 0xd3, 0x5f, 0x08, 0x63, 0xc1, 0x14, 0x5c, 0x1b, 0xea, 0x14, 0x1c, 0xd3, 0x52, 0xa6,
+	0xa1, 0xf8, 0xba, 0xa8, 0x32, 0x6d, 0xc2, 0xe2, 0xe4, 0x33, 0x78, 0x68, 0xe0, 0xd5, 0xd7, 0x61,
+	0x96, 0xa4, 0xd7, 0xba, 0x7a, 0xb6, 0x0c, 0xf9, 0x77, 0x92, 0x4a, 0x3e, 0x87, 0xa9, 0x15, 0x34,
+	0xf7, 0xec, 0x49, 0x49, 0xab, 0xe0, 0x8f, 0xfa, 0xbe, 0x4f, 0xe0, 0x83, 0xab, 0xa4, 0x12, 0xeb,
+	0x30, 0x4d, 0xde, 0x84, 0x22, 0x29, 0xf2, 0x15, 0xbf, 0xe6, 0x82, 0x65, 0xba, 0x98, 0x76, 0xda,
+	0xcc, 0x33, 0xc9, 0x23, 0xbf, 0x84, 0xed, 0x1b, 0x87, 0xaa, 0x22, 0x65, 0xb2, 0xc6, 0x3c, 0x4a,
+	0xda, 0x2c, 0x5a, 0xa4, 0xb2, 0x46, 0xd7, 0x25, 0x8e, 0x0d, 0x59, 0x6a, 0x5d, 0xaa, 0x31, 0x8c,
+	0x48, 0x52, 0x5e, 0xed, 0x9b, 0x42, 0x43, 0x58, 0xd3, 0x9e, 0xea, 0x3a, 0x93, 0x30, 0xd2, 0xca,
+	0xa2, 0x12, 0xb2, 0xcc, 0x26, 0x54, 0xc2, 0x38, 0x7b, 0x4c, 0xbe, 0xc7, 0x7a, 0xf6, 0xe8, 0x52,
+	0xa8, 0x13, 0xbe, 0x82, 0x11, 0x46, 0x5e, 0xd3, 0x9b, 0xe9, 0x73, 0x36, 0xba, 0x51, 0xa6, 0xa6,
+	0xd3, 0x48, 0x4d, 0xc3, 0x80, 0x7b, 0x97, 0x81, 0xef, 0x1c, 0x18, 0x9c, 0x56, 0x85, 0x1c, 0x23,
+	0x1f, 0x83, 0x17, 0x15, 0xb9, 0x08, 0x93, 0xdc, 0xea, 0xaf, 0x09, 0x64, 0x0a, 0x6e, 0x99, 0xa8,
+	0x92, 0xea, 0x51, 0x04, 0x6d, 0x97, 0xb9, 0x8d, 0x2e, 0x9b, 0x82, 0x1b, 0x65, 0xb1, 0x4e, 0x2b,
+	0x82, 0x72, 0x28, 0x73, 0x56, 0xe9, 0xfc, 0x49, 0x18, 0x7b, 0xf1, 0xbc, 0x2a, 0xd6, 0xa5, 0x4e,
+	0x92, 0x42, 0x9a, 0xfe, 0x0e, 0xee, 0xf2, 0xf7, 0x15, 0x80, 0x76, 0xf7, 0x59, 0x9a, 0xbe, 0x63,
+	0x3c, 0x3e, 0x05, 0xaf, 0x54, 0x67, 0x99, 0x1a, 0xcf, 0x68, 0x41, 0x6b, 0xa3, 0x35, 0xcb, 0xff,
+	0xa7, 0x03, 0x5b, 0x9a, 0xfc, 0x7e, 0x81, 0x6f, 0x05, 0xd2, 0xbd, 0x23, 0x90, 0xdd, 0xcd, 0x40,
+	0xf6, 0x1a, 0x81, 0x6c, 0x04, 0xa3, 0x7f, 0x57, 0x30, 0xbe, 0x75, 0xc0, 0x3b, 0xb4, 0x7a, 0xcd,
+	0x28, 0x73, 0xea, 0x51, 0x46, 0x3e, 0x81, 0xb1, 0x35, 0xbc, 0x4a, 0xcc, 0x40, 0x18, 0x59, 0xda,
+	0xf2, 0xf6, 0x2c, 0xee, 0x40, 0x2f, 0xc9, 0xc2, 0x73, 0x33, 0xdc, 0x15, 0x72, 0x2f, 0x97, 0x2e,
+	0x60, 0x6c, 0x3d, 0x7a, 0xf7, 0x0c, 0xfd, 0x1c, 0x5f, 0x45, 0x7d, 0xda, 0xa4, 0x08, 0x02, 0xab,
+	0x90, 0x36, 0xb8, 0xfe, 0xdf, 0x1c, 0x98, 0x5a, 0xce, 0xfb, 0xe5, 0xe9, 0x66, 0x74, 0xdc, 0xcd,
+	0xe8, 0x34, 0xee, 0xdc, 0xbd, 0xeb, 0xce, 0xff, 0xe9, 0x80, 0x7b, 0x78, 0xfa, 0x52, 0xd6, 0x7e,
+	0xb9, 0x96, 0x86, 0x7b, 0x14, 0x41, 0xf2, 0x11, 0x78, 0x57, 0x2c, 0x8f, 0x8b, 0x46, 0xec, 0x87,
+	0x8a, 0xb0, 0x8c, 0x71, 0xa6, 0xe8, 0x21, 0xa8, 0xec, 0x6a, 0x0c, 0x83, 0x9f, 0x15, 0x31, 0x4b,
+	0x4d, 0xf0, 0x25, 0x82, 0x73, 0x95, 0x0b, 0x56, 0x96, 0xb8, 0x03, 0xf5, 0xa4, 0x05, 0x8b, 0xe3,
+	0x8a, 0x54, 0x5e, 0x5c, 0xf3, 0x24, 0x0a, 0x53, 0x34, 0xa4, 0x9a, 0x0a, 0x0c, 0x69, 0x19, 0x93,
+	0x1f, 0xe1, 0x9a, 0x53, 0x31, 0x64, 0xaa, 0x19, 0xd7, 0x47, 0x74, 0x19, 0xa3, 0x2d, 0x84, 0xb8,
+	0x1c, 0x6b, 0x3d, 0xaa, 0x10, 0x7c, 0x79, 0xa5, 0xd1, 0x55, 0xe3, 0x11, 0xf5, 0x24, 0xe5, 0x58,
+	0xf7, 0x78, 0x76, 0xf1, 0x46, 0xce, 0x37, 0x87, 0x22, 0x88, 0x07, 0xa2, 0x30, 0xba, 0x60, 0x2b,
+	0x9e, 0xbc, 0x51, 0x6f, 0x69, 0x8f, 0x7a, 0x92, 0x72, 0x96, 0xbc, 0x61, 0xf2, 0x4d, 0x4a, 0xa2,
+	0xaa, 0x90, 0xfb, 0xe2, 0x58, 0xab, 0x33, 0x04, 0xff, 0x7f, 0x1d, 0xf0, 0x9e, 0x1f, 0xf0, 0x93,
+	0x57, 0xaf, 0x59, 0x24, 0xf0, 0x2e, 0x61, 0x99, 0xd8, 0xa9, 0xaf, 0x62, 0x00, 0x61, 0x99, 0x98,
+	0x81, 0xbf, 0x0b, 0xc3, 0x8c, 0x89, 0x50, 0xae, 0x36, 0x2a, 0xc7, 0x16, 0xc7, 0x24, 0xf3, 0x92,
+	0x45, 0x26, 0xc9, 0x08, 0xcb, 0xf5, 0x42, 0xae, 0x87, 0x26, 0xcc, 0xdc, 0x2e, 0x8b, 0x97, 0x49,
+	0x1e, 0x9b, 0xa6, 0x43, 0xd8, 0xf6, 0x42, 0xbf, 0xd1, 0x0b, 0x01, 0xf4, 0xe5, 0xaa, 0x80, 0x43,
+	0x09, 0xeb, 0xf1, 0x71, 0x60, 0x9d, 0x0d, 0xfe, 0x20, 0x19, 0x47, 0xb9, 0xa8, 0xae, 0xa9, 0x96,
+	0xc2, 0x0b, 0x5c, 0x1e, 0xf0, 0x95, 0x29, 0x43, 0xb5, 0x9a, 0xc0, 0xe5, 0x01, 0x3f, 0x54, 0x14,
+	0xf2, 0x33, 0x98, 0xa0, 0x00, 0x2a, 0xe7, 0x65, 0x18, 0x99, 0x00, 0x8f, 0x2f, 0x0f, 0xf8, 0xb1,
+	0xa1, 0xed, 0xfe, 0x06, 0x46, 0x0d, 0xe5, 0x18, 0xf2, 0x4b, 0x76, 0xad, 0xef, 0x8b, 0x60, 0xbd,
+	0xbe, 0xa9, 0xbb, 0x2a, 0xe4, 0xb7, 0x9d, 0x03, 0xc7, 0xff, 0xb7, 0x03, 0xf0, 0xbc, 0x36, 0xe7,
+	0x43, 0xbf, 0x90, 0xde, 0xca, 0xd3, 0xd8, 0x4f, 0xd6, 0x7f, 0xaa, 0x39, 0xe8, 0x52, 0x88, 0x7b,
+	0x85, 0xf5, 0x5a, 0x29, 0x1d, 0x4b, 0xa2, 0x51, 0xb4, 0x0f, 0x5b, 0x2d, 0xbf, 0x4d, 0x83, 0x4e,
+	0x82, 0xe7, 0x0d, 0xcf, 0xe9, 0xa4, 0x79, 0x0f, 0x4e, 0x3e, 0x03, 0x4f, 0x9e, 0x2a, 0x62, 0xc6,
+	0xe5, 0xee, 0xdf, 0xf6, 0x60, 0x88, 0xd2, 0xc8, 0xf3, 0xff, 0xe1, 0xc0, 0xb8, 0xa9, 0xe8, 0x5e,
+	0x8e, 0xcf, 0xa1, 0x97, 0x08, 0x96, 0x99, 0x8d, 0xa9, 0x29, 0xa2, 0x18, 0x64, 0x01, 0xde, 0x9f,
+	0x8b, 0xea, 0x32, 0x2d, 0xc2, 0xb8, 0x9e, 0x28, 0xb5, 0x54, 0xcd, 0x24, 0x1f, 0xe1, 0x1b, 0x1d,
+	0x1b, 0x27, 0x07, 0x28, 0x74, 0x5a, 0xc4, 0x54, 0x12, 0xfd, 0xd7, 0xd0, 0x57, 0xf8, 0xbd, 0xdc,
+	0x9a, 0x82, 0xfb, 0x8d, 0xdd, 0x8a, 0x10, 0x7c, 0xa7, 0xc9, 0x76, 0x82, 0x6b, 0x22, 0xaf, 0xdf,
+	0x7d, 0x1c, 0x23, 0x18, 0x3f, 0xd5, 0x8e, 0xba, 0xe6, 0x91, 0x20, 0xbb, 0xf1, 0x1e, 0x6b, 0xe3,
+	0x4b, 0x20, 0x58, 0x10, 0xed, 0x61, 0xf9, 0x96, 0xe7, 0xfe, 0x1e, 0x6a, 0xbf, 0x55, 0x19, 0x3b,
+	0x2d, 0xe2, 0x5a, 0x63, 0x5d, 0xd5, 0x5a, 0xa3, 0x25, 0x90, 0x0f, 0x61, 0x58, 0x16, 0xf1, 0xaa,
+	0xf1, 0x5d, 0x33, 0x28, 0x8b, 0x58, 0xde, 0xe1, 0xf7, 0xf0, 0x81, 0xec, 0x19, 0x3b, 0x8c, 0xeb,
+	0xbd, 0x05, 0x4d, 0x6f, 0x07, 0x9b, 0xee, 0xd3, 0xed, 0xcb, 0x0d, 0x1a, 0xf7, 0xff, 0xab, 0x6a,
+	0x5f, 0xa3, 0x9b, 0x75, 0xed, 0xdc, 0x52, 0xd7, 0x37, 0x1a, 0xb6, 0xb3, 0xd1, 0xb0, 0x07, 0x30,
+	0x35, 0x25, 0x7c, 0xc3, 0xb1, 0xad, 0xa0, 0x95, 0x28, 0xba, 0x75, 0xd9, 0x44, 0x39, 0xf9, 0x35,
+	0x3c, 0xc4, 0x93, 0x78, 0xed, 0xfa, 0x15, 0xb1, 0x3d, 0x63, 0x03, 0x27, 0x7b, 0xc6, 0x62, 0xdc,
+	0x8f, 0x61, 0xf4, 0x22, 0x4c, 0x52, 0xa3, 0xe5, 0x2d, 0xdf, 0x8a, 0xdb, 0xd0, 0x13, 0x7c, 0x95,
+	0x99, 0xaf, 0xb6, 0xae, 0xe0, 0x5f, 0xb5, 0x3e, 0x26, 0xdc, 0xdb, 0xd3, 0xb7, 0xf7, 0xaf, 0x2e,
+	0x6e, 0x0f, 0x69, 0xca, 0x22, 0x51, 0x54, 0xe4, 0x27, 0xd0, 0x3d, 0xc5, 0xb7, 0x64, 0x10, 0xa8,
+	0x8f, 0xe9, 0x5d, 0x03, 0xf8, 0x0f, 0x16, 0xce, 0xaf, 0x1c, 0xe2, 0xc3, 0xe8, 0x65, 0x19, 0x87,
+	0x82, 0xa9, 0x0f, 0x90, 0x7e, 0x20, 0x7f, 0x77, 0xbd, 0xc0, 0xfc, 0x55, 0xe0, 0x3f, 0x20, 0x9f,
+	0xc3, 0x44, 0xc9, 0x98, 0x8d, 0x72, 0x14, 0xd4, 0xcb, 0x5a, 0x5b, 0xf4, 0x17, 0xf0, 0x50, 0x89,
+	0xd6, 0xfb, 0xcb, 0x24, 0x68, 0x6e, 0x0e, 0x6d, 0xf1, 0x4f, 0x61, 0x42, 0x19, 0x6e, 0xcd, 0x26,
+	0x26, 0xf6, 0x19, 0x6e, 0xcb, 0x05, 0xf0, 0x48, 0xc9, 0x35, 0xb3, 0x30, 0x0e, 0x1a, 0x58, 0x5b,
+	0x7e, 0x1f, 0x76, 0x94, 0xfc, 0x8d, 0x7d, 0xef, 0x61, 0xd0, 0x26, 0xb4, 0x4f, 0x1d, 0xc0, 0x63,
+	0x75, 0x6a, 0x63, 0xff, 0x78, 0x14, 0xdc, 0x24, 0xb5, 0x4f, 0x7e, 0x01, 0x53, 0x75, 0xed, 0xc6,
+	0x80, 0x1e, 0x05, 0x35, 0xb2, 0x21, 0xad, 0xec, 0x34, 0x4a, 0x7a, 0x14, 0xd4, 0xc8, 0x1d, 0x77,
+	0x6f, 0xd6, 0xce, 0x38, 0x68, 0x60, 0x6d, 0xf9, 0x3d, 0xd8, 0x36, 0xb7, 0x68, 0xfe, 0x33, 0xb1,
+	0x15, 0xb4, 0xf0, 0xd6, 0x99, 0x57, 0x7d, 0xf9, 0x67, 0xd4, 0x93, 0xef, 0x07, 0x00, 0xaa, 0x3c,
+	0x02, 0xd9, 0xa0, 0x12, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -1839,6 +2039,8 @@ type CollectorClient interface {
 	ReportContainerMetrics(ctx context.Context, in *ContainerMetrics, opts ...grpc.CallOption) (*Response, error)
 	UpdateK8SCluster(ctx context.Context, in *K8SCluster, opts ...grpc.CallOption) (*Response, error)
 	ReportK8SMetrics(ctx context.Context, in *K8SMetrics, opts ...grpc.CallOption) (*Response, error)
+	ReportTailMetrics(ctx context.Context, in *TailMetrics, opts ...grpc.CallOption) (*Response, error)
+	ReportCommandResult(ctx context.Context, in *CommandResult, opts ...grpc.CallOption) (*Response, error)
 }
 
 type collectorClient struct {
@@ -1961,6 +2163,24 @@ func (c *collectorClient) ReportK8SMetrics(ctx context.Context, in *K8SMetrics,
 	return out, nil
 }
 
+func (c *collectorClient) ReportTailMetrics(ctx context.Context, in *TailMetrics, opts ...grpc.CallOption) (*Response, error) {
+	out := new(Response)
+	err := c.cc.Invoke(ctx, "/Collector/ReportTailMetrics", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *collectorClient) ReportCommandResult(ctx context.Context, in *CommandResult, opts ...grpc.CallOption) (*Response, error) {
+	out := new(Response)
+	err := c.cc.Invoke(ctx, "/Collector/ReportCommandResult", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // CollectorServer is the server API for Collector service.
 type CollectorServer interface {
 	Ping(Collector_PingServer) error
@@ -1973,6 +2193,8 @@ type CollectorServer interface {
 	ReportContainerMetrics(context.Context, *ContainerMetrics) (*Response, error)
 	UpdateK8SCluster(context.Context, *K8SCluster) (*Response, error)
 	ReportK8SMetrics(context.Context, *K8SMetrics) (*Response, error)
+	ReportTailMetrics(context.Context, *TailMetrics) (*Response, error)
+	ReportCommandResult(context.Context, *CommandResult) (*Response, error)
 }
 
 // UnimplementedCollectorServer can be embedded to have forward compatible implementations.
@@ -2009,6 +2231,12 @@ func (*UnimplementedCollectorServer) UpdateK8SCluster(ctx context.Context, req *
 func (*UnimplementedCollectorServer) ReportK8SMetrics(ctx context.Context, req *K8SMetrics) (*Response, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ReportK8SMetrics not implemented")
 }
+func (*UnimplementedCollectorServer) ReportTailMetrics(ctx context.Context, req *TailMetrics) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReportTailMetrics not implemented")
+}
+func (*UnimplementedCollectorServer) ReportCommandResult(ctx context.Context, req *CommandResult) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReportCommandResult not implemented")
+}
 
 func RegisterCollectorServer(s *grpc.Server, srv CollectorServer) {
 	s.RegisterService(&_Collector_serviceDesc, srv)
@@ -2202,6 +2430,42 @@ func _Collector_ReportK8SMetrics_Handler(srv interface{}, ctx context.Context, d
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Collector_ReportTailMetrics_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TailMetrics)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CollectorServer).ReportTailMetrics(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Collector/ReportTailMetrics",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CollectorServer).ReportTailMetrics(ctx, req.(*TailMetrics))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Collector_ReportCommandResult_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CommandResult)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CollectorServer).ReportCommandResult(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/Collector/ReportCommandResult",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CollectorServer).ReportCommandResult(ctx, req.(*CommandResult))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Collector_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "Collector",
 	HandlerType: (*CollectorServer)(nil),
@@ -2242,6 +2506,14 @@ var _Collector_serviceDesc = grpc.ServiceDesc{
 			MethodName: "ReportK8sMetrics",
 			Handler:    _Collector_ReportK8SMetrics_Handler,
 		},
+		{
+			MethodName: "ReportTailMetrics",
+			Handler:    _Collector_ReportTailMetrics_Handler,
+		},
+		{
+			MethodName: "ReportCommandResult",
+			Handler:    _Collector_ReportCommandResult_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -62,6 +62,16 @@ func main() {
 			EnvVar: "NEXAGENT_KUBERNETES_NAMESPACE",
 			Value:  "nexclipper",
 		},
+		cli.StringFlag{
+			Name:   "k8s.node",
+			Usage:  "Name of the Kubernetes node of the agent, the host name if not set",
+			EnvVar: "NEXAGENT_KUBERNETES_NODE",
+		},
+		cli.StringSliceFlag{
+			Name:   "k8s.resource",
+			Usage:  "Custom resource to watch as group/version/Kind, e.g. argoproj.io/v1alpha1/Rollout (repeatable)",
+			EnvVar: "NEXAGENT_KUBERNETES_RESOURCES",
+		},
 		cli.BoolFlag{
 			Name:   "tls",
 			Usage:  "Use TLS secure communication channel",
@@ -77,6 +87,11 @@ func main() {
 			Usage:  "Path of TLS cert file",
 			EnvVar: "NEXAGENT_TLS_CERT_PATH",
 		},
+		cli.BoolFlag{
+			Name:   "crypto.strict",
+			Usage:  "Restrict TLS to FIPS approved algorithms (always on in fips builds), requires TLS",
+			EnvVar: "NEXAGENT_CRYPTO_STRICT",
+		},
 		cli.IntFlag{
 			Name:   "agent.interval",
 			Usage:  "Metric report interval for agent status and metrics (seconds)",
@@ -89,6 +104,76 @@ func main() {
 			EnvVar: "NEXAGENT_CLUSTER",
 			Value:  "default",
 		},
+		cli.StringFlag{
+			Name:   "agent.enrollment_token",
+			Usage:  "Enrollment token of the cluster, required by clusters with active tokens",
+			EnvVar: "NEXAGENT_ENROLLMENT_TOKEN",
+		},
+		cli.BoolFlag{
+			Name:   "auth_log.disable",
+			Usage:  "Disable the login failure metrics read from the authentication log",
+			EnvVar: "NEXAGENT_AUTH_LOG_DISABLE",
+		},
+		cli.StringSliceFlag{
+			Name:   "auth_log.file",
+			Usage:  "Authentication log file, /var/log/auth.log and /var/log/secure if not set (repeatable)",
+			EnvVar: "NEXAGENT_AUTH_LOG_FILES",
+		},
+		cli.BoolFlag{
+			Name:   "kernel_log.disable",
+			Usage:  "Disable the OOM kill, I/O error and hardware fault events read from /dev/kmsg",
+			EnvVar: "NEXAGENT_KERNEL_LOG_DISABLE",
+		},
+		cli.BoolFlag{
+			Name:   "io_probe.enable",
+			Usage:  "Time small direct writes and reads on the mountpoints of disks",
+			EnvVar: "NEXAGENT_IO_PROBE_ENABLE",
+		},
+		cli.IntFlag{
+			Name:   "io_probe.interval",
+			Usage:  "Seconds between two I/O probes",
+			EnvVar: "NEXAGENT_IO_PROBE_INTERVAL",
+			Value:  300,
+		},
+		cli.StringSliceFlag{
+			Name:   "io_probe.mount",
+			Usage:  "Mountpoint to probe, the writable disk mountpoints if not set (repeatable)",
+			EnvVar: "NEXAGENT_IO_PROBE_MOUNTS",
+		},
+		cli.BoolFlag{
+			Name:   "mesh_probe.enable",
+			Usage:  "Accept and run the latency and bandwidth probes between nodes",
+			EnvVar: "NEXAGENT_MESH_PROBE_ENABLE",
+		},
+		cli.IntFlag{
+			Name:   "mesh_probe.port",
+			Usage:  "Port of the mesh listener",
+			EnvVar: "NEXAGENT_MESH_PROBE_PORT",
+			Value:  18004,
+		},
+		cli.BoolFlag{
+			Name:   "ephemeral.disable",
+			Usage:  "Disable the ephemeral storage metrics read from the kubelet",
+			EnvVar: "NEXAGENT_EPHEMERAL_DISABLE",
+		},
+		cli.Float64Flag{
+			Name:   "ephemeral.eviction_threshold",
+			Usage:  "nodefs.available eviction threshold of the kubelet (percent)",
+			EnvVar: "NEXAGENT_EPHEMERAL_EVICTION_THRESHOLD",
+			Value:  10,
+		},
+		cli.StringFlag{
+			Name:   "log.level",
+			Usage:  "Log level: debug, info, warn or error",
+			EnvVar: "NEXAGENT_LOG_LEVEL",
+			Value:  "info",
+		},
+		cli.StringFlag{
+			Name:   "log.format",
+			Usage:  "Log format: console or json",
+			EnvVar: "NEXAGENT_LOG_FORMAT",
+			Value:  "console",
+		},
 	}
 
 	app.Action = func(c *cli.Context) error {
@@ -115,11 +200,27 @@ func main() {
 			nexAgent.InitWithDefault()
 
 			nexAgent.SetAgentCluster(agentCluster)
+			nexAgent.SetEnrollmentToken(c.String("agent.enrollment_token"))
 			nexAgent.SetServerAddress(serverAddress)
 			nexAgent.SetK8sCluster(k8sCluster)
 			nexAgent.SetK8sNamespace(k8sNamespace)
+			nexAgent.SetK8sNode(c.String("k8s.node"))
 			nexAgent.SetApiPort(apiPort)
 			nexAgent.SetReportInterval(reportInterval)
+			nexAgent.SetTLSConfig(c.Bool("tls"), c.String("tls.cert"))
+			nexAgent.SetStrictCrypto(c.Bool("crypto.strict"))
+			nexAgent.SetAuthLogConfig(c.Bool("auth_log.disable"), c.StringSlice("auth_log.file"))
+			nexAgent.SetKernelLogConfig(c.Bool("kernel_log.disable"))
+			nexAgent.SetIOProbeConfig(c.Bool("io_probe.enable"), c.Int("io_probe.interval"),
+				c.StringSlice("io_probe.mount"))
+			nexAgent.SetMeshProbeConfig(c.Bool("mesh_probe.enable"), c.Int("mesh_probe.port"))
+			nexAgent.SetEphemeralStorageConfig(c.Bool("ephemeral.disable"), c.Float64("ephemeral.eviction_threshold"))
+			nexAgent.SetK8sResourceConfig(c.StringSlice("k8s.resource"))
+			nexAgent.SetLogConfig(c.String("log.level"), c.String("log.format"))
+		}
+
+		if err := nexAgent.InitLogging(); err != nil {
+			return fmt.Errorf("failed to set up logging: %v", err)
 		}
 
 		if err := nexAgent.Start(); err != nil {
@@ -0,0 +1,168 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The API commands print a table by default and the data of the response
+// with --output json, so the output of the latter can be piped to jq in
+// CI jobs. A failed request exits non-zero with the message of the server.
+
+const (
+	outputTable = "table"
+	outputJson  = "json"
+)
+
+var apiFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "server, s",
+		Usage:  "NexServer API URL",
+		EnvVar: "NEXCTL_SERVER",
+		Value:  "http://localhost:18001",
+	},
+	cli.StringFlag{
+		Name:   "token",
+		Usage:  "Bearer token of the API, required when the server enforces authentication",
+		EnvVar: "NEXCTL_TOKEN",
+	},
+	cli.StringFlag{
+		Name:  "output, o",
+		Usage: "Output format, table or json",
+		Value: outputTable,
+	},
+	cli.IntFlag{
+		Name:  "timeout",
+		Usage: "Request timeout (seconds)",
+		Value: 30,
+	},
+}
+
+func withApiFlags(flags ...cli.Flag) []cli.Flag {
+	return append(flags, apiFlags...)
+}
+
+type apiClient struct {
+	server string
+	token  string
+	output string
+	client *http.Client
+}
+
+type apiResponse struct {
+	Status  string          `json:"status"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func newApiClient(c *cli.Context) (*apiClient, error) {
+	output := c.String("output")
+	if output != outputTable && output != outputJson {
+		return nil, fmt.Errorf("invalid output format: %s", output)
+	}
+
+	return &apiClient{
+		server: strings.TrimRight(c.String("server"), "/"),
+		token:  c.String("token"),
+		output: output,
+		client: &http.Client{Timeout: time.Duration(c.Int("timeout")) * time.Second},
+	}, nil
+}
+
+// get requests an API path and decodes the data of the response.
+func (client *apiClient) get(path string, params url.Values, data interface{}) error {
+	target := client.server + "/api/v1" + path
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return err
+	}
+	if client.token != "" {
+		req.Header.Set("Authorization", "Bearer "+client.token)
+	}
+
+	resp, err := client.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var response apiResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("unexpected response %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if resp.StatusCode != 200 || response.Status != "ok" {
+		return fmt.Errorf("server: %s (%d)", response.Message, resp.StatusCode)
+	}
+	if data == nil || len(response.Data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(response.Data, data)
+}
+
+// print writes the rows as a table, or the value as JSON.
+func (client *apiClient) print(value interface{}, header []string, rows [][]string) error {
+	if client.output == outputJson {
+		output, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(output))
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(writer, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+
+	return writer.Flush()
+}
+
+func formatBytes(value float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	idx := 0
+	for value >= 1024 && idx < len(units)-1 {
+		value /= 1024
+		idx++
+	}
+	if idx == 0 {
+		return fmt.Sprintf("%.0f%s", value, units[idx])
+	}
+
+	return fmt.Sprintf("%.1f%s", value, units[idx])
+}
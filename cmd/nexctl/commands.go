@@ -0,0 +1,430 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/urfave/cli"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type nodeItem struct {
+	Id              uint   `json:"id"`
+	Cluster         string `json:"cluster,omitempty"`
+	Host            string `json:"host"`
+	Ip              string `json:"ip"`
+	Os              string `json:"os"`
+	Platform        string `json:"platform"`
+	PlatformVersion string `json:"platform_version"`
+	AgentId         uint   `json:"agent_id"`
+}
+
+type snapshotMetric struct {
+	Node        string    `json:"node"`
+	NodeId      uint      `json:"node_id"`
+	Pod         string    `json:"pod"`
+	Namespace   string    `json:"namespace"`
+	Ts          time.Time `json:"ts"`
+	Value       float64   `json:"value"`
+	MetricName  string    `json:"metric_name"`
+	MetricLabel string    `json:"metric_label"`
+}
+
+func clusterFlag(usage string) cli.Flag {
+	return cli.IntFlag{
+		Name:  "cluster, c",
+		Usage: usage,
+	}
+}
+
+func clusterId(c *cli.Context) (int, error) {
+	id := c.Int("cluster")
+	if id <= 0 {
+		return 0, fmt.Errorf("missing --cluster id")
+	}
+
+	return id, nil
+}
+
+func getClusters(c *cli.Context) error {
+	client, err := newApiClient(c)
+	if err != nil {
+		return err
+	}
+
+	var clusters []struct {
+		Id         uint   `json:"id"`
+		Name       string `json:"name"`
+		Kubernetes bool   `json:"kubernetes"`
+	}
+	if err := client.get("/clusters", nil, &clusters); err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(clusters))
+	for _, cluster := range clusters {
+		rows = append(rows, []string{
+			strconv.Itoa(int(cluster.Id)), cluster.Name, strconv.FormatBool(cluster.Kubernetes),
+		})
+	}
+
+	return client.print(clusters, []string{"ID", "NAME", "KUBERNETES"}, rows)
+}
+
+func getNodes(c *cli.Context) error {
+	client, err := newApiClient(c)
+	if err != nil {
+		return err
+	}
+
+	var nodes []nodeItem
+	if id := c.Int("cluster"); id > 0 {
+		if err := client.get(fmt.Sprintf("/clusters/%d/nodes", id), nil, &nodes); err != nil {
+			return err
+		}
+	} else {
+		// every node, grouped by cluster name
+		var clusters map[string][]nodeItem
+		if err := client.get("/nodes", nil, &clusters); err != nil {
+			return err
+		}
+		for name, items := range clusters {
+			for _, node := range items {
+				node.Cluster = name
+				nodes = append(nodes, node)
+			}
+		}
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].Id < nodes[j].Id })
+	}
+
+	rows := make([][]string, 0, len(nodes))
+	for _, node := range nodes {
+		row := []string{strconv.Itoa(int(node.Id))}
+		if c.Int("cluster") <= 0 {
+			row = append(row, node.Cluster)
+		}
+		row = append(row, node.Host, node.Ip, node.Platform+" "+node.PlatformVersion, strconv.Itoa(int(node.AgentId)))
+		rows = append(rows, row)
+	}
+
+	header := []string{"ID", "HOST", "IP", "PLATFORM", "AGENT"}
+	if c.Int("cluster") <= 0 {
+		header = []string{"ID", "CLUSTER", "HOST", "IP", "PLATFORM", "AGENT"}
+	}
+
+	return client.print(nodes, header, rows)
+}
+
+func getAgents(c *cli.Context) error {
+	client, err := newApiClient(c)
+	if err != nil {
+		return err
+	}
+
+	path := "/agents"
+	if id := c.Int("cluster"); id > 0 {
+		path = fmt.Sprintf("/clusters/%d/agents", id)
+	}
+
+	var agents []map[string]interface{}
+	if err := client.get(path, nil, &agents); err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(agents))
+	for _, agent := range agents {
+		rows = append(rows, []string{
+			fmt.Sprint(agent["id"]), fmt.Sprint(agent["version"]), fmt.Sprint(agent["ip"]), fmt.Sprint(agent["online"]),
+		})
+	}
+
+	return client.print(agents, []string{"ID", "VERSION", "IP", "ONLINE"}, rows)
+}
+
+// snapshot returns the latest values of the metrics per node or pod.
+func snapshot(client *apiClient, path string, metricNames []string) (map[string][]snapshotMetric, error) {
+	params := url.Values{}
+	for _, name := range metricNames {
+		params.Add("metricNames", name)
+	}
+
+	var results map[string][]snapshotMetric
+	if err := client.get(path, params, &results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func sumMetric(metrics []snapshotMetric, name string) float64 {
+	value := 0.0
+	for _, metric := range metrics {
+		if metric.MetricName == name {
+			value += metric.Value
+		}
+	}
+
+	return value
+}
+
+func topNodes(c *cli.Context) error {
+	id, err := clusterId(c)
+	if err != nil {
+		return err
+	}
+	client, err := newApiClient(c)
+	if err != nil {
+		return err
+	}
+
+	results, err := snapshot(client, fmt.Sprintf("/snapshot/%d/nodes", id),
+		[]string{"node_cpu_load_avg_1", "node_cpu_load_avg_5", "node_cpu_load_avg_15", "node_memory_used_percent"})
+	if err != nil {
+		return err
+	}
+
+	type nodeUsage struct {
+		Node          string  `json:"node"`
+		Load1         float64 `json:"load1"`
+		Load5         float64 `json:"load5"`
+		Load15        float64 `json:"load15"`
+		MemoryPercent float64 `json:"memory_percent"`
+	}
+
+	usages := make([]nodeUsage, 0, len(results))
+	for node, metrics := range results {
+		usages = append(usages, nodeUsage{
+			Node:          node,
+			Load1:         sumMetric(metrics, "node_cpu_load_avg_1"),
+			Load5:         sumMetric(metrics, "node_cpu_load_avg_5"),
+			Load15:        sumMetric(metrics, "node_cpu_load_avg_15"),
+			MemoryPercent: sumMetric(metrics, "node_memory_used_percent"),
+		})
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if c.String("sort") == "memory" {
+			return usages[i].MemoryPercent > usages[j].MemoryPercent
+		}
+		return usages[i].Load1 > usages[j].Load1
+	})
+
+	rows := make([][]string, 0, len(usages))
+	for _, usage := range usages {
+		rows = append(rows, []string{
+			usage.Node,
+			fmt.Sprintf("%.2f", usage.Load1),
+			fmt.Sprintf("%.2f", usage.Load5),
+			fmt.Sprintf("%.2f", usage.Load15),
+			fmt.Sprintf("%.1f%%", usage.MemoryPercent),
+		})
+	}
+
+	return client.print(usages, []string{"NODE", "LOAD1", "LOAD5", "LOAD15", "MEMORY"}, rows)
+}
+
+func topPods(c *cli.Context) error {
+	id, err := clusterId(c)
+	if err != nil {
+		return err
+	}
+	client, err := newApiClient(c)
+	if err != nil {
+		return err
+	}
+
+	results, err := snapshot(client, fmt.Sprintf("/snapshot/%d/k8s/pods", id),
+		[]string{"container_cpu_usage_total", "container_memory_rss"})
+	if err != nil {
+		return err
+	}
+
+	type podUsage struct {
+		Namespace string  `json:"namespace"`
+		Pod       string  `json:"pod"`
+		CpuTotal  float64 `json:"cpu_total"`
+		MemoryRss float64 `json:"memory_rss"`
+	}
+
+	namespace := c.String("namespace")
+	usages := make([]podUsage, 0, len(results))
+	for pod, metrics := range results {
+		if len(metrics) == 0 || (namespace != "" && metrics[0].Namespace != namespace) {
+			continue
+		}
+		usages = append(usages, podUsage{
+			Namespace: metrics[0].Namespace,
+			Pod:       pod,
+			CpuTotal:  sumMetric(metrics, "container_cpu_usage_total"),
+			MemoryRss: sumMetric(metrics, "container_memory_rss"),
+		})
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		if c.String("sort") == "cpu" {
+			return usages[i].CpuTotal > usages[j].CpuTotal
+		}
+		return usages[i].MemoryRss > usages[j].MemoryRss
+	})
+
+	rows := make([][]string, 0, len(usages))
+	for _, usage := range usages {
+		rows = append(rows, []string{
+			usage.Namespace, usage.Pod, formatBytes(usage.MemoryRss), fmt.Sprintf("%.0f", usage.CpuTotal),
+		})
+	}
+
+	return client.print(usages, []string{"NAMESPACE", "POD", "MEMORY", "CPU TOTAL"}, rows)
+}
+
+// parseLast accepts a Go duration and a number of days such as 7d.
+func parseLast(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid duration: %s", value)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid duration: %s", value)
+	}
+
+	return duration, nil
+}
+
+func queryMetrics(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return fmt.Errorf("missing metric name")
+	}
+
+	last, err := parseLast(c.String("last"))
+	if err != nil {
+		return err
+	}
+	client, err := newApiClient(c)
+	if err != nil {
+		return err
+	}
+
+	clusterIds := "all"
+	if id := c.Int("cluster"); id > 0 {
+		clusterIds = strconv.Itoa(id)
+	}
+
+	end := time.Now().UTC()
+	params := url.Values{}
+	params.Set("clusterIds", clusterIds)
+	params.Set("target", c.String("target"))
+	params.Add("dateRange", end.Add(-last).Format(time.RFC3339))
+	params.Add("dateRange", end.Format(time.RFC3339))
+	if granularity := c.String("granularity"); granularity != "" {
+		params.Set("granularity", granularity)
+	}
+	for _, name := range c.Args() {
+		params.Add("metricNames", name)
+	}
+
+	var clusters []struct {
+		ClusterId uint   `json:"cluster_id"`
+		Cluster   string `json:"cluster"`
+		Metrics   []struct {
+			Node        string  `json:"node,omitempty"`
+			Value       float64 `json:"value"`
+			Bucket      string  `json:"bucket"`
+			MetricName  string  `json:"metric_name"`
+			MetricLabel string  `json:"metric_label,omitempty"`
+		} `json:"metrics"`
+	}
+	if err := client.get("/metrics", params, &clusters); err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, 64)
+	for _, cluster := range clusters {
+		for _, metric := range cluster.Metrics {
+			rows = append(rows, []string{
+				cluster.Cluster, metric.Node, metric.MetricName, metric.MetricLabel,
+				metric.Bucket, strconv.FormatFloat(metric.Value, 'f', -1, 64),
+			})
+		}
+	}
+
+	return client.print(clusters, []string{"CLUSTER", "NODE", "METRIC", "LABEL", "BUCKET", "VALUE"}, rows)
+}
+
+var apiCommands = []cli.Command{
+	{
+		Name:  "get",
+		Usage: "List clusters, nodes or agents",
+		Subcommands: []cli.Command{
+			{
+				Name:   "clusters",
+				Usage:  "List clusters",
+				Action: getClusters,
+				Flags:  withApiFlags(),
+			},
+			{
+				Name:   "nodes",
+				Usage:  "List nodes",
+				Action: getNodes,
+				Flags:  withApiFlags(clusterFlag("Cluster id, every cluster if not set")),
+			},
+			{
+				Name:   "agents",
+				Usage:  "List agents",
+				Action: getAgents,
+				Flags:  withApiFlags(clusterFlag("Cluster id, every cluster if not set")),
+			},
+		},
+	},
+	{
+		Name:  "top",
+		Usage: "Show the latest resource usage of nodes or pods",
+		Subcommands: []cli.Command{
+			{
+				Name:   "nodes",
+				Usage:  "Load and memory of the nodes of a cluster",
+				Action: topNodes,
+				Flags: withApiFlags(clusterFlag("Cluster id"),
+					cli.StringFlag{Name: "sort", Usage: "Sort by load or memory", Value: "load"}),
+			},
+			{
+				Name:   "pods",
+				Usage:  "Memory and CPU time of the pods of a cluster",
+				Action: topPods,
+				Flags: withApiFlags(clusterFlag("Cluster id"),
+					cli.StringFlag{Name: "namespace, n", Usage: "Only the pods of the namespace"},
+					cli.StringFlag{Name: "sort", Usage: "Sort by memory or cpu", Value: "memory"}),
+			},
+		},
+	},
+	{
+		Name:      "query",
+		Usage:     "Query node metrics over a time range",
+		ArgsUsage: "METRIC_NAME [METRIC_NAME...]",
+		Action:    queryMetrics,
+		Flags: withApiFlags(clusterFlag("Cluster id, every cluster if not set"),
+			cli.StringFlag{Name: "last", Usage: "Range ending now, such as 30m, 1h or 7d", Value: "1h"},
+			cli.StringFlag{Name: "granularity", Usage: "Bucket of minute, hour, day or month, derived from the range if not set"},
+			cli.StringFlag{Name: "target", Usage: "nodes, or summary for per-cluster averages", Value: "nodes"}),
+	},
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/NexClipper/NexClipper/pkg/nexprobe"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	AppName        = "nexctl"
+	AppDescription = "Command line tool for NexClipper Monitoring System"
+	NexCtlVersion  = "0.3.0"
+)
+
+func uploadSnapshot(server string, clusterId int, snapshot *nexprobe.Snapshot) error {
+	body, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/api/v1/clusters/%d/probes", strings.TrimRight(server, "/"), clusterId)
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
+
+func probe(c *cli.Context) error {
+	hosts := c.StringSlice("ssh")
+	if len(hosts) == 0 {
+		return fmt.Errorf("missing --ssh host")
+	}
+
+	config := nexprobe.SSHConfig{
+		User:           c.String("user"),
+		Port:           c.Int("port"),
+		Password:       c.String("password"),
+		KnownHostsFile: c.String("known-hosts"),
+		Insecure:       c.Bool("insecure"),
+		Timeout:        time.Duration(c.Int("timeout")) * time.Second,
+	}
+	if keyPath := c.String("key"); keyPath != "" {
+		key, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			return fmt.Errorf("failed to read private key: %v", err)
+		}
+		config.PrivateKey = key
+	}
+
+	server := c.String("server")
+	snapshots := make([]*nexprobe.Snapshot, 0, len(hosts))
+	failed := 0
+
+	for _, host := range hosts {
+		snapshot, err := nexprobe.ProbeSSH(host, config)
+		if err != nil {
+			log.Printf("failed to probe %s: %v\n", host, err)
+			failed += 1
+			continue
+		}
+
+		if server != "" {
+			if err := uploadSnapshot(server, c.Int("cluster"), snapshot); err != nil {
+				log.Printf("failed to upload snapshot of %s: %v\n", host, err)
+				failed += 1
+				continue
+			}
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	if server == "" {
+		output, err := json.MarshalIndent(snapshots, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(output))
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d hosts failed", failed, len(hosts))
+	}
+
+	return nil
+}
+
+func main() {
+	app := cli.NewApp()
+	app.Version = NexCtlVersion
+	app.Name = AppName
+	app.Description = AppDescription
+	app.Commands = []cli.Command{
+		{
+			Name:   "probe",
+			Usage:  "Collect a one-shot snapshot from hosts without an agent",
+			Action: probe,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "ssh",
+					Usage: "Host to probe over SSH (repeatable)",
+				},
+				cli.StringFlag{
+					Name:   "user, u",
+					Usage:  "SSH user",
+					EnvVar: "USER",
+				},
+				cli.IntFlag{
+					Name:  "port, p",
+					Usage: "SSH port",
+					Value: 22,
+				},
+				cli.StringFlag{
+					Name:  "key, i",
+					Usage: "Path of SSH private key file",
+				},
+				cli.StringFlag{
+					Name:   "password",
+					Usage:  "SSH password",
+					EnvVar: "NEXCTL_SSH_PASSWORD",
+				},
+				cli.StringFlag{
+					Name:  "known-hosts",
+					Usage: "Path of known_hosts file (default ~/.ssh/known_hosts)",
+				},
+				cli.BoolFlag{
+					Name:  "insecure",
+					Usage: "Skip host key verification",
+				},
+				cli.IntFlag{
+					Name:  "timeout",
+					Usage: "SSH connection timeout (seconds)",
+					Value: 10,
+				},
+				cli.StringFlag{
+					Name:   "server, s",
+					Usage:  "NexServer API URL to upload snapshots to (print if empty)",
+					EnvVar: "NEXCTL_SERVER",
+				},
+				cli.IntFlag{
+					Name:  "cluster",
+					Usage: "Cluster id to store snapshots under",
+					Value: 1,
+				},
+			},
+		},
+	}
+	app.Commands = append(app.Commands, apiCommands...)
+
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/NexClipper/NexClipper/pkg/nexproxy"
+	"github.com/urfave/cli"
+	"log"
+	"os"
+)
+
+func main() {
+	app := cli.NewApp()
+	app.Version = nexproxy.NexProxyVersion
+	app.Name = nexproxy.AppName
+	app.Description = nexproxy.AppDescription
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:     "server, s",
+			Usage:    "NexServer address",
+			EnvVar:   "NEXPROXY_SERVER_ADDRESS",
+			Required: false,
+			Value:    "",
+		},
+		cli.StringFlag{
+			Name:   "bind",
+			Usage:  "Bind address for NexAgent connections",
+			EnvVar: "NEXPROXY_BIND_ADDRESS",
+			Value:  "0.0.0.0",
+		},
+		cli.IntFlag{
+			Name:   "agent",
+			Usage:  "Listening port for NexAgent",
+			EnvVar: "NEXPROXY_AGENT_PORT",
+			Value:  18000,
+		},
+		cli.IntFlag{
+			Name:   "buffer.flush_interval",
+			Usage:  "Interval of forwarding buffered reports to the server (seconds)",
+			EnvVar: "NEXPROXY_FLUSH_INTERVAL",
+			Value:  10,
+		},
+		cli.IntFlag{
+			Name:   "buffer.max_reports",
+			Usage:  "Maximum number of reports kept while the server is unreachable",
+			EnvVar: "NEXPROXY_MAX_REPORTS",
+			Value:  10000,
+		},
+		cli.BoolTFlag{
+			Name:   "buffer.compression",
+			Usage:  "Compress traffic to the server with gzip",
+			EnvVar: "NEXPROXY_COMPRESSION",
+		},
+	}
+
+	app.Action = func(c *cli.Context) error {
+		nexProxy := nexproxy.NewNexProxy()
+
+		serverAddress := c.String("server")
+		if serverAddress == "" {
+			return fmt.Errorf("failed to start proxy: missing server address")
+		}
+
+		nexProxy.SetProxyConfig(c.String("bind"), c.Int("agent"), serverAddress)
+		nexProxy.SetBufferConfig(c.Int("buffer.flush_interval"), c.Int("buffer.max_reports"),
+			c.BoolT("buffer.compression"))
+
+		if err := nexProxy.Start(); err != nil {
+			return fmt.Errorf("stopped Proxy: %v\n", err)
+		}
+
+		return nil
+	}
+
+	err := app.Run(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -26,7 +26,7 @@ import (
 
 func initApp() *cli.App {
 	app := cli.NewApp()
-	app.Version = nexserver.NexServerVersion
+	app.Version = fmt.Sprintf("%s (%s)", nexserver.NexServerVersion, nexserver.GitCommit)
 	app.Name = nexserver.AppName
 	app.Description = nexserver.AppDescription
 	app.Flags = []cli.Flag{
@@ -48,12 +48,114 @@ func initApp() *cli.App {
 			EnvVar: "NEXSERVER_AGENT_PORT",
 			Value:  18000,
 		},
+		cli.StringSliceFlag{
+			Name:   "server.trusted_proxies",
+			Usage:  "Addresses of nexproxy relays allowed to forward agent addresses",
+			EnvVar: "NEXSERVER_TRUSTED_PROXIES",
+		},
 		cli.IntFlag{
 			Name:   "api",
 			Usage:  "Listening port for REST API",
 			EnvVar: "NEXSERVER_API_PORT",
 			Value:  18001,
 		},
+		cli.StringFlag{
+			Name:   "api.socket",
+			Usage:  "Unix domain socket path for REST API (disabled if empty)",
+			EnvVar: "NEXSERVER_API_SOCKET",
+			Value:  "",
+		},
+		cli.IntFlag{
+			Name:   "server.shutdown_timeout",
+			Usage:  "Seconds given to the shutdown to drain requests and queued metrics",
+			EnvVar: "NEXSERVER_SHUTDOWN_TIMEOUT",
+			Value:  30,
+		},
+		cli.StringFlag{
+			Name:   "admin.address",
+			Usage:  "Bind address for admin endpoints",
+			EnvVar: "NEXSERVER_ADMIN_BIND_ADDRESS",
+			Value:  "127.0.0.1",
+		},
+		cli.IntFlag{
+			Name:   "admin.port",
+			Usage:  "Listening port for admin endpoints (disabled if 0)",
+			EnvVar: "NEXSERVER_ADMIN_PORT",
+			Value:  18003,
+		},
+		cli.StringFlag{
+			Name:   "admin.token",
+			Usage:  "Bearer token required by admin endpoints",
+			EnvVar: "NEXSERVER_ADMIN_TOKEN",
+			Value:  "",
+		},
+		cli.BoolFlag{
+			Name:   "auth.required",
+			Usage:  "Require a signed-in user on /api/v1",
+			EnvVar: "NEXSERVER_AUTH_REQUIRED",
+		},
+		cli.StringFlag{
+			Name:   "auth.secret",
+			Usage:  "Secret signing the user tokens, generated and kept in the database if empty",
+			EnvVar: "NEXSERVER_AUTH_SECRET",
+		},
+		cli.IntFlag{
+			Name:   "auth.token_hours",
+			Usage:  "Validity of the user tokens in hours",
+			EnvVar: "NEXSERVER_AUTH_TOKEN_HOURS",
+			Value:  12,
+		},
+		cli.StringFlag{
+			Name:   "auth.hook_url",
+			Usage:  "URL of the hook approving or denying the API requests, disabled if empty",
+			EnvVar: "NEXSERVER_AUTH_HOOK_URL",
+		},
+		cli.StringFlag{
+			Name:   "auth.hook_secret",
+			Usage:  "Secret signing the requests to the auth hook",
+			EnvVar: "NEXSERVER_AUTH_HOOK_SECRET",
+		},
+		cli.StringSliceFlag{
+			Name:   "auth.hook_header",
+			Usage:  "Request header forwarded to the auth hook, Authorization if not set (repeatable)",
+			EnvVar: "NEXSERVER_AUTH_HOOK_HEADERS",
+		},
+		cli.IntFlag{
+			Name:   "auth.hook_cache_seconds",
+			Usage:  "Seconds a decision of the auth hook is reused (not cached if negative)",
+			EnvVar: "NEXSERVER_AUTH_HOOK_CACHE_SECONDS",
+			Value:  30,
+		},
+		cli.BoolFlag{
+			Name:   "auth.hook_fail_open",
+			Usage:  "Accept the requests when the auth hook is unreachable",
+			EnvVar: "NEXSERVER_AUTH_HOOK_FAIL_OPEN",
+		},
+		cli.StringFlag{
+			Name:   "oidc.issuer",
+			Usage:  "Issuer URL of the OIDC provider, OIDC sign-in disabled if empty",
+			EnvVar: "NEXSERVER_OIDC_ISSUER",
+		},
+		cli.StringFlag{
+			Name:   "oidc.client_id",
+			Usage:  "OIDC client id",
+			EnvVar: "NEXSERVER_OIDC_CLIENT_ID",
+		},
+		cli.StringFlag{
+			Name:   "oidc.client_secret",
+			Usage:  "OIDC client secret",
+			EnvVar: "NEXSERVER_OIDC_CLIENT_SECRET",
+		},
+		cli.StringFlag{
+			Name:   "oidc.redirect_url",
+			Usage:  "Redirect URL registered with the OIDC provider, ending with /api/v1/auth/oidc/callback",
+			EnvVar: "NEXSERVER_OIDC_REDIRECT_URL",
+		},
+		cli.StringSliceFlag{
+			Name:   "oidc.allowed_domain",
+			Usage:  "Email domain allowed to sign in with OIDC, any if not set (repeatable)",
+			EnvVar: "NEXSERVER_OIDC_ALLOWED_DOMAINS",
+		},
 		cli.BoolFlag{
 			Name:   "tls",
 			Usage:  "Use TLS secure communication channel",
@@ -69,6 +171,88 @@ func initApp() *cli.App {
 			Usage:  "Path of TLS cert file",
 			EnvVar: "NEXSERVER_TLS_CERT_PATH",
 		},
+		cli.BoolFlag{
+			Name:   "crypto.strict",
+			Usage:  "Restrict TLS and SSH to FIPS approved algorithms (always on in fips builds), requires TLS",
+			EnvVar: "NEXSERVER_CRYPTO_STRICT",
+		},
+		cli.StringFlag{
+			Name:   "tracing.endpoint",
+			Usage:  "OTLP/HTTP traces endpoint (e.g. http://localhost:4318/v1/traces), disabled if empty",
+			EnvVar: "NEXSERVER_TRACING_ENDPOINT",
+			Value:  "",
+		},
+		cli.StringFlag{
+			Name:   "tracing.service",
+			Usage:  "Service name reported with traces",
+			EnvVar: "NEXSERVER_TRACING_SERVICE",
+			Value:  "nexserver",
+		},
+		cli.StringFlag{
+			Name:   "siem.type",
+			Usage:  "SIEM for API access and audit logs (syslog or hec), disabled if empty",
+			EnvVar: "NEXSERVER_SIEM_TYPE",
+		},
+		cli.StringFlag{
+			Name:   "siem.url",
+			Usage:  "SIEM endpoint (e.g. tcp://siem:514, https://splunk:8088/services/collector/event)",
+			EnvVar: "NEXSERVER_SIEM_URL",
+		},
+		cli.StringFlag{
+			Name:   "siem.token",
+			Usage:  "Splunk HEC token",
+			EnvVar: "NEXSERVER_SIEM_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "siem.source",
+			Usage:  "Source reported with SIEM events",
+			EnvVar: "NEXSERVER_SIEM_SOURCE",
+			Value:  "nexserver",
+		},
+		cli.StringFlag{
+			Name:   "remote_write.token",
+			Usage:  "Bearer token of the Prometheus remote_write receiver at /api/v1/write, disabled if empty",
+			EnvVar: "NEXSERVER_REMOTE_WRITE_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "retention.file",
+			Usage:  "YAML file of metric retention policies, applied at start",
+			EnvVar: "NEXSERVER_RETENTION_FILE",
+		},
+		cli.StringFlag{
+			Name:   "metric.precision_file",
+			Usage:  "YAML file of the stored precision per metric class, applied at start",
+			EnvVar: "NEXSERVER_METRIC_PRECISION_FILE",
+		},
+		cli.StringFlag{
+			Name:   "image_scan.trivy",
+			Usage:  "Trivy binary used to scan container images",
+			EnvVar: "NEXSERVER_IMAGE_SCAN_TRIVY",
+			Value:  "trivy",
+		},
+		cli.StringFlag{
+			Name:   "image_scan.server",
+			Usage:  "Trivy server address, images are scanned locally if empty",
+			EnvVar: "NEXSERVER_IMAGE_SCAN_SERVER",
+		},
+		cli.IntFlag{
+			Name:   "image_scan.interval",
+			Usage:  "Hours between two scans of an image",
+			EnvVar: "NEXSERVER_IMAGE_SCAN_INTERVAL",
+			Value:  24,
+		},
+		cli.IntFlag{
+			Name:   "mesh_probe.peers",
+			Usage:  "Peer nodes probed by every agent on each mesh probe run",
+			EnvVar: "NEXSERVER_MESH_PROBE_PEERS",
+			Value:  3,
+		},
+		cli.IntFlag{
+			Name:   "mesh_probe.port",
+			Usage:  "Port of the mesh listener of the agents",
+			EnvVar: "NEXSERVER_MESH_PROBE_PORT",
+			Value:  18004,
+		},
 		cli.StringFlag{
 			Name:   "db.host",
 			Usage:  "Database host address",
@@ -105,6 +289,298 @@ func initApp() *cli.App {
 			EnvVar: "NEXSERVER_DB_SSLMODE",
 			Value:  "disable",
 		},
+		cli.IntFlag{
+			Name:   "db.query_timeout",
+			Usage:  "Statement timeout of the queries of API reads (seconds), no timeout if negative",
+			EnvVar: "NEXSERVER_DB_QUERY_TIMEOUT",
+			Value:  60,
+		},
+		cli.BoolFlag{
+			Name:   "metric.naming.enforce",
+			Usage:  "Reject custom metrics violating naming rules",
+			EnvVar: "NEXSERVER_METRIC_NAMING_ENFORCE",
+		},
+		cli.StringSliceFlag{
+			Name:   "metric.naming.reserved",
+			Usage:  "Reserved metric name prefixes for built-in collectors",
+			EnvVar: "NEXSERVER_METRIC_NAMING_RESERVED",
+		},
+		cli.StringFlag{
+			Name:   "ingest.invalid_action",
+			Usage:  "Action for out-of-bound metric values (reject/flag)",
+			EnvVar: "NEXSERVER_INGEST_INVALID_ACTION",
+			Value:  "reject",
+		},
+		cli.Float64Flag{
+			Name:   "ingest.max_abs_value",
+			Usage:  "Largest absolute metric value accepted at ingest",
+			EnvVar: "NEXSERVER_INGEST_MAX_ABS_VALUE",
+			Value:  1e18,
+		},
+		cli.IntFlag{
+			Name:   "ingest.max_series",
+			Usage:  "Series budget of a cluster checked by the custom metric validation, unlimited if 0",
+			EnvVar: "NEXSERVER_INGEST_MAX_SERIES",
+		},
+		cli.Float64Flag{
+			Name:   "api.rate_limit",
+			Usage:  "Requests per second of an address to the API, unlimited if 0",
+			EnvVar: "NEXSERVER_API_RATE_LIMIT",
+		},
+		cli.IntFlag{
+			Name:   "api.rate_burst",
+			Usage:  "Requests an address can make at once above its rate",
+			EnvVar: "NEXSERVER_API_RATE_BURST",
+			Value:  20,
+		},
+		cli.Float64Flag{
+			Name:   "api.key_rate_limit",
+			Usage:  "Requests per second of an API key, unlimited if 0",
+			EnvVar: "NEXSERVER_API_KEY_RATE_LIMIT",
+		},
+		cli.IntFlag{
+			Name:   "api.key_rate_burst",
+			Usage:  "Requests an API key can make at once above its rate",
+			EnvVar: "NEXSERVER_API_KEY_RATE_BURST",
+			Value:  20,
+		},
+		cli.IntFlag{
+			Name:   "gc.retention_days",
+			Usage:  "Keep unreferenced dimension rows created within this many days",
+			EnvVar: "NEXSERVER_GC_RETENTION_DAYS",
+			Value:  30,
+		},
+		cli.IntFlag{
+			Name:   "gc.interval",
+			Usage:  "Interval of dimension garbage collection in minutes (disabled if 0)",
+			EnvVar: "NEXSERVER_GC_INTERVAL",
+			Value:  360,
+		},
+		cli.IntFlag{
+			Name:   "cluster.restore_hours",
+			Usage:  "Hours a deleted cluster can be restored before it is purged",
+			EnvVar: "NEXSERVER_CLUSTER_RESTORE_HOURS",
+			Value:  72,
+		},
+		cli.StringFlag{
+			Name:   "probe.known_hosts_file",
+			Usage:  "Known hosts file checking the hosts probed over SSH, ~/.ssh/known_hosts if empty",
+			EnvVar: "NEXSERVER_PROBE_KNOWN_HOSTS_FILE",
+		},
+		cli.BoolFlag{
+			Name:   "probe.insecure",
+			Usage:  "Skip the host key check of the hosts probed over SSH",
+			EnvVar: "NEXSERVER_PROBE_INSECURE",
+		},
+		cli.BoolFlag{
+			Name:   "cluster.enrollment_required",
+			Usage:  "Refuse new agents without an enrollment token of their cluster",
+			EnvVar: "NEXSERVER_CLUSTER_ENROLLMENT_REQUIRED",
+		},
+		cli.IntFlag{
+			Name:   "webhook.max_retries",
+			Usage:  "Number of retries for a failed webhook delivery",
+			EnvVar: "NEXSERVER_WEBHOOK_MAX_RETRIES",
+			Value:  5,
+		},
+		cli.IntFlag{
+			Name:   "webhook.timeout",
+			Usage:  "Timeout of a webhook delivery in seconds",
+			EnvVar: "NEXSERVER_WEBHOOK_TIMEOUT",
+			Value:  10,
+		},
+		cli.IntFlag{
+			Name:   "ingest.batch_size",
+			Usage:  "Metrics saved by one INSERT, 1 saves every metric on its own",
+			EnvVar: "NEXSERVER_INGEST_BATCH_SIZE",
+			Value:  500,
+		},
+		cli.IntFlag{
+			Name:   "ingest.flush_interval",
+			Usage:  "Milliseconds before a partial batch of metrics is saved",
+			EnvVar: "NEXSERVER_INGEST_FLUSH_INTERVAL",
+			Value:  1000,
+		},
+		cli.IntFlag{
+			Name:   "ingest.queue_size",
+			Usage:  "Metrics waiting to be saved before reports are held back",
+			EnvVar: "NEXSERVER_INGEST_QUEUE_SIZE",
+			Value:  50000,
+		},
+		cli.StringFlag{
+			Name:   "cmdb.type",
+			Usage:  "CMDB exporter type (servicenow or generic)",
+			EnvVar: "NEXSERVER_CMDB_TYPE",
+			Value:  "generic",
+		},
+		cli.StringFlag{
+			Name:   "cmdb.url",
+			Usage:  "CMDB base URL (exporter disabled if empty)",
+			EnvVar: "NEXSERVER_CMDB_URL",
+		},
+		cli.StringFlag{
+			Name:   "cmdb.user",
+			Usage:  "CMDB basic auth user",
+			EnvVar: "NEXSERVER_CMDB_USER",
+		},
+		cli.StringFlag{
+			Name:   "cmdb.password",
+			Usage:  "CMDB basic auth password",
+			EnvVar: "NEXSERVER_CMDB_PASSWORD",
+		},
+		cli.StringFlag{
+			Name:   "cmdb.token",
+			Usage:  "CMDB bearer token (takes precedence over basic auth)",
+			EnvVar: "NEXSERVER_CMDB_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "cmdb.class",
+			Usage:  "ServiceNow CI class name",
+			EnvVar: "NEXSERVER_CMDB_CLASS",
+			Value:  "cmdb_ci_linux_server",
+		},
+		cli.IntFlag{
+			Name:   "cmdb.interval",
+			Usage:  "Interval of CMDB export in minutes (disabled if 0)",
+			EnvVar: "NEXSERVER_CMDB_INTERVAL",
+			Value:  60,
+		},
+		cli.StringSliceFlag{
+			Name:   "cmdb.field_map",
+			Usage:  "Inventory to CMDB field mapping as field=attribute",
+			EnvVar: "NEXSERVER_CMDB_FIELD_MAP",
+		},
+		cli.StringSliceFlag{
+			Name:   "status_page.cluster",
+			Usage:  "Cluster published on the public status page, disabled if none",
+			EnvVar: "NEXSERVER_STATUS_PAGE_CLUSTERS",
+		},
+		cli.StringFlag{
+			Name:   "status_page.title",
+			Usage:  "Title of the status page",
+			EnvVar: "NEXSERVER_STATUS_PAGE_TITLE",
+			Value:  "System Status",
+		},
+		cli.StringFlag{
+			Name:   "status_page.logo_url",
+			Usage:  "Logo shown on the status page",
+			EnvVar: "NEXSERVER_STATUS_PAGE_LOGO_URL",
+		},
+		cli.StringFlag{
+			Name:   "status_page.accent_color",
+			Usage:  "Accent color of the status page",
+			EnvVar: "NEXSERVER_STATUS_PAGE_ACCENT_COLOR",
+			Value:  "#1565c0",
+		},
+		cli.Float64Flag{
+			Name:   "status_page.uptime_target",
+			Usage:  "Uptime objective in percent",
+			EnvVar: "NEXSERVER_STATUS_PAGE_UPTIME_TARGET",
+			Value:  99.9,
+		},
+		cli.IntFlag{
+			Name:   "status_page.window",
+			Usage:  "Uptime window in days",
+			EnvVar: "NEXSERVER_STATUS_PAGE_WINDOW",
+			Value:  30,
+		},
+		cli.StringSliceFlag{
+			Name:   "job.schedule",
+			Usage:  "Schedule of a background job as job=cron expression, \"-\" disables the job",
+			EnvVar: "NEXSERVER_JOB_SCHEDULES",
+		},
+		cli.StringSliceFlag{
+			Name:   "feature",
+			Usage:  "Enable or disable an experimental feature as feature=true|false",
+			EnvVar: "NEXSERVER_FEATURES",
+		},
+		cli.StringFlag{
+			Name:   "i18n.dir",
+			Usage:  "Directory of message catalogs named after their locale (ko.yaml)",
+			EnvVar: "NEXSERVER_I18N_DIR",
+		},
+		cli.StringFlag{
+			Name:   "i18n.locale",
+			Usage:  "Locale of messages when a request or channel does not ask for one",
+			EnvVar: "NEXSERVER_I18N_LOCALE",
+			Value:  "en",
+		},
+		cli.BoolFlag{
+			Name:   "shard.enable",
+			Usage:  "Share agent ingest with other servers using the same database",
+			EnvVar: "NEXSERVER_SHARD_ENABLE",
+		},
+		cli.StringFlag{
+			Name:   "shard.name",
+			Usage:  "Unique member name of this server (hostname if empty)",
+			EnvVar: "NEXSERVER_SHARD_NAME",
+		},
+		cli.StringFlag{
+			Name:   "shard.address",
+			Usage:  "Agent address of this server advertised to other members",
+			EnvVar: "NEXSERVER_SHARD_ADDRESS",
+		},
+		cli.IntFlag{
+			Name:   "shard.vnodes",
+			Usage:  "Number of virtual nodes of this server on the hash ring",
+			EnvVar: "NEXSERVER_SHARD_VNODES",
+			Value:  64,
+		},
+		cli.StringFlag{
+			Name:   "bundle.site",
+			Usage:  "Site name recorded in exported bundles",
+			EnvVar: "NEXSERVER_BUNDLE_SITE",
+		},
+		cli.StringFlag{
+			Name:   "bundle.export_dir",
+			Usage:  "Directory where air-gapped metric bundles are written",
+			EnvVar: "NEXSERVER_BUNDLE_EXPORT_DIR",
+		},
+		cli.StringFlag{
+			Name:   "bundle.import_dir",
+			Usage:  "Directory scanned for metric bundles to import",
+			EnvVar: "NEXSERVER_BUNDLE_IMPORT_DIR",
+		},
+		cli.IntFlag{
+			Name:   "bundle.interval",
+			Usage:  "Interval of bundle export and import in minutes (disabled if 0)",
+			EnvVar: "NEXSERVER_BUNDLE_INTERVAL",
+			Value:  60,
+		},
+		cli.StringFlag{
+			Name:   "bundle.key",
+			Usage:  "Passphrase bundles are encrypted with",
+			EnvVar: "NEXSERVER_BUNDLE_KEY",
+		},
+		cli.StringSliceFlag{
+			Name:   "changepoint.metrics",
+			Usage:  "Metrics checked for level shifts (default: node memory and load)",
+			EnvVar: "NEXSERVER_CHANGEPOINT_METRICS",
+		},
+		cli.IntFlag{
+			Name:   "changepoint.interval",
+			Usage:  "Interval of change-point detection in minutes (disabled if 0)",
+			EnvVar: "NEXSERVER_CHANGEPOINT_INTERVAL",
+			Value:  30,
+		},
+		cli.IntFlag{
+			Name:   "changepoint.window",
+			Usage:  "Hours of history examined for change points",
+			EnvVar: "NEXSERVER_CHANGEPOINT_WINDOW",
+			Value:  24,
+		},
+		cli.Float64Flag{
+			Name:   "changepoint.threshold",
+			Usage:  "Minimum t statistic of a level shift",
+			EnvVar: "NEXSERVER_CHANGEPOINT_THRESHOLD",
+			Value:  6,
+		},
+		cli.Float64Flag{
+			Name:   "changepoint.min_shift",
+			Usage:  "Minimum relative level shift in percent",
+			EnvVar: "NEXSERVER_CHANGEPOINT_MIN_SHIFT",
+			Value:  10,
+		},
 		cli.Float64Flag{
 			Name:   "rule.node_cpu_load1",
 			Usage:  "Basic incident rule for node's cpu load too high",
@@ -123,6 +599,65 @@ func initApp() *cli.App {
 			EnvVar: "NEXSERVER_RULE_NODE_MEMORY_FREE",
 			Value:  90,
 		},
+		cli.Float64Flag{
+			Name:   "rule.node_auth_failures",
+			Usage:  "Basic incident rule for failed logins per minute on a node (brute-force), disabled if 0",
+			EnvVar: "NEXSERVER_RULE_NODE_AUTH_FAILURES",
+			Value:  20,
+		},
+		cli.Float64Flag{
+			Name:   "rule.node_zombie_processes",
+			Usage:  "Basic incident rule for zombie processes on a node, disabled if 0",
+			EnvVar: "NEXSERVER_RULE_NODE_ZOMBIE_PROCESSES",
+			Value:  20,
+		},
+		cli.Float64Flag{
+			Name:   "rule.node_uninterruptible_processes",
+			Usage:  "Basic incident rule for processes in uninterruptible sleep (D state) on a node, disabled if 0",
+			EnvVar: "NEXSERVER_RULE_NODE_UNINTERRUPTIBLE_PROCESSES",
+			Value:  10,
+		},
+		cli.Float64Flag{
+			Name:   "rule.node_deleted_binaries",
+			Usage:  "Basic incident rule for processes running a deleted binary on a node, disabled if 0",
+			EnvVar: "NEXSERVER_RULE_NODE_DELETED_BINARIES",
+			Value:  1,
+		},
+		cli.Float64Flag{
+			Name:   "rule.node_ephemeral_storage",
+			Usage:  "Basic incident rule for the node filesystem on its way to the eviction threshold of the kubelet (percent), disabled if 0",
+			EnvVar: "NEXSERVER_RULE_NODE_EPHEMERAL_STORAGE",
+			Value:  90,
+		},
+		cli.Float64Flag{
+			Name:   "rule.pod_ephemeral_storage",
+			Usage:  "Basic incident rule for the ephemeral storage of a pod against its limits (percent), disabled if 0",
+			EnvVar: "NEXSERVER_RULE_POD_EPHEMERAL_STORAGE",
+			Value:  90,
+		},
+		cli.Float64Flag{
+			Name:   "rule.cronjob_success_hours",
+			Usage:  "Basic incident rule for a CronJob without a successful run for these hours, disabled if 0",
+			EnvVar: "NEXSERVER_RULE_CRONJOB_SUCCESS_HOURS",
+			Value:  24,
+		},
+		cli.StringSliceFlag{
+			Name:   "rule.severity",
+			Usage:  "Severity of a rule as rule=info|warning|critical",
+			EnvVar: "NEXSERVER_RULE_SEVERITY",
+		},
+		cli.StringFlag{
+			Name:   "log.level",
+			Usage:  "Log level: debug, info, warn or error",
+			EnvVar: "NEXSERVER_LOG_LEVEL",
+			Value:  "info",
+		},
+		cli.StringFlag{
+			Name:   "log.format",
+			Usage:  "Log format: console or json",
+			EnvVar: "NEXSERVER_LOG_FORMAT",
+			Value:  "console",
+		},
 	}
 
 	app.Action = func(c *cli.Context) error {
@@ -140,6 +675,31 @@ func initApp() *cli.App {
 			apiPort := c.Int("api")
 
 			nexServer.SetServerConfig(bindAddress, agentPort, apiPort)
+			nexServer.SetApiUnixSocket(c.String("api.socket"))
+			nexServer.SetShutdownTimeout(c.Int("server.shutdown_timeout"))
+			nexServer.SetTrustedProxies(c.StringSlice("server.trusted_proxies"))
+			nexServer.SetAdminServerConfig(c.String("admin.address"), c.Int("admin.port"), c.String("admin.token"))
+			nexServer.SetAuthConfig(c.Bool("auth.required"), c.String("auth.secret"), c.Int("auth.token_hours"))
+			nexServer.SetOIDCConfig(c.String("oidc.issuer"), c.String("oidc.client_id"), c.String("oidc.client_secret"),
+				c.String("oidc.redirect_url"), c.StringSlice("oidc.allowed_domain"))
+			hookHeaders := c.StringSlice("auth.hook_header")
+			if len(hookHeaders) == 0 {
+				hookHeaders = []string{"Authorization"}
+			}
+			nexServer.SetAuthHookConfig(c.String("auth.hook_url"), c.String("auth.hook_secret"), hookHeaders,
+				c.Int("auth.hook_cache_seconds"), c.Bool("auth.hook_fail_open"))
+
+			nexServer.SetTLSConfig(c.Bool("tls"), c.String("tls.cert"), c.String("tls.key"))
+			nexServer.SetStrictCrypto(c.Bool("crypto.strict"))
+			nexServer.SetTracingConfig(c.String("tracing.endpoint"), c.String("tracing.service"))
+			nexServer.SetSiemConfig(c.String("siem.type"), c.String("siem.url"),
+				c.String("siem.token"), c.String("siem.source"))
+			nexServer.SetRemoteWriteConfig(c.String("remote_write.token"))
+			nexServer.SetRetentionConfig(c.String("retention.file"))
+			nexServer.SetPrecisionConfig(c.String("metric.precision_file"))
+			nexServer.SetImageScanConfig(c.String("image_scan.trivy"), c.String("image_scan.server"),
+				c.Int("image_scan.interval"))
+			nexServer.SetMeshProbeConfig(c.Int("mesh_probe.peers"), c.Int("mesh_probe.port"))
 
 			dbHost := c.String("db.host")
 			dbPort := c.Int("db.port")
@@ -149,12 +709,60 @@ func initApp() *cli.App {
 			dbSslMode := c.String("db.sslmode")
 
 			nexServer.SetDatabaseConfig(dbHost, dbPort, dbUser, dbPass, dbName, dbSslMode)
+			nexServer.SetQueryTimeout(c.Int("db.query_timeout"))
+			nexServer.SetLogConfig(c.String("log.level"), c.String("log.format"))
+
+			nexServer.SetMetricNaming(c.Bool("metric.naming.enforce"), c.StringSlice("metric.naming.reserved"))
+
+			nexServer.SetValueValidation(c.String("ingest.invalid_action"), c.Float64("ingest.max_abs_value"))
+			nexServer.SetIngestQuota(c.Int("ingest.max_series"))
+			nexServer.SetRateLimit(c.Float64("api.rate_limit"), c.Int("api.rate_burst"),
+				c.Float64("api.key_rate_limit"), c.Int("api.key_rate_burst"))
+
+			nexServer.SetGCConfig(c.Int("gc.retention_days"), c.Int("gc.interval"))
+			nexServer.SetClusterRestoreHours(c.Int("cluster.restore_hours"))
+			nexServer.SetEnrollmentRequired(c.Bool("cluster.enrollment_required"))
+			nexServer.SetProbeConfig(c.String("probe.known_hosts_file"), c.Bool("probe.insecure"))
+			nexServer.SetWebhookConfig(c.Int("webhook.max_retries"), c.Int("webhook.timeout"))
+			nexServer.SetIngestConfig(c.Int("ingest.batch_size"), c.Int("ingest.flush_interval"),
+				c.Int("ingest.queue_size"))
+			nexServer.SetCMDBConfig(c.String("cmdb.type"), c.String("cmdb.url"),
+				c.String("cmdb.user"), c.String("cmdb.password"), c.String("cmdb.token"),
+				c.String("cmdb.class"), c.Int("cmdb.interval"), c.StringSlice("cmdb.field_map"))
+			if err := nexServer.SetJobSchedules(c.StringSlice("job.schedule")); err != nil {
+				return err
+			}
+			if err := nexServer.SetFeatures(c.StringSlice("feature")); err != nil {
+				return err
+			}
+			nexServer.SetI18nConfig(c.String("i18n.dir"), c.String("i18n.locale"))
+			nexServer.SetShardConfig(c.Bool("shard.enable"), c.String("shard.name"),
+				c.String("shard.address"), c.Int("shard.vnodes"))
+			nexServer.SetBundleConfig(c.String("bundle.site"), c.String("bundle.export_dir"),
+				c.String("bundle.import_dir"), c.Int("bundle.interval"), c.String("bundle.key"))
+			nexServer.SetChangePointConfig(c.StringSlice("changepoint.metrics"),
+				c.Int("changepoint.interval"), c.Int("changepoint.window"),
+				c.Float64("changepoint.threshold"), c.Float64("changepoint.min_shift"))
+			nexServer.SetStatusPageConfig(c.StringSlice("status_page.cluster"), c.String("status_page.title"),
+				c.String("status_page.logo_url"), c.String("status_page.accent_color"),
+				c.Float64("status_page.uptime_target"), c.Int("status_page.window"))
 
 			ruleNodeLoad1 := c.Float64("rule.node_cpu_load1")
 			ruleNodeDiskFree := c.Float64("rule.node_disk_free")
 			ruleNodeMemoryFree := c.Float64("rule.node_memory_free")
+			ruleNodeAuthFailures := c.Float64("rule.node_auth_failures")
+
+			nexServer.SetBasicRule(ruleNodeLoad1, ruleNodeDiskFree, ruleNodeMemoryFree, ruleNodeAuthFailures)
+			nexServer.SetProcessRule(c.Float64("rule.node_zombie_processes"),
+				c.Float64("rule.node_uninterruptible_processes"), c.Float64("rule.node_deleted_binaries"))
+			nexServer.SetEphemeralStorageRule(c.Float64("rule.node_ephemeral_storage"),
+				c.Float64("rule.pod_ephemeral_storage"))
+			nexServer.SetCronJobRule(c.Float64("rule.cronjob_success_hours"))
+			nexServer.SetRuleSeverities(c.StringSlice("rule.severity"))
+		}
 
-			nexServer.SetBasicRule(ruleNodeLoad1, ruleNodeDiskFree, ruleNodeMemoryFree)
+		if err := nexServer.InitLogging(); err != nil {
+			return fmt.Errorf("failed to set up logging: %v", err)
 		}
 
 		_, err := nexServer.ConnectDatabase()
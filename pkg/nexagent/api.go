@@ -20,7 +20,6 @@ import (
 	"fmt"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"log"
 )
 
 func (s *NexAgent) SetupApiHandler() {
@@ -41,10 +40,10 @@ func (s *NexAgent) SetupApiHandler() {
 	}
 
 	go func() {
-		log.Printf("Rest API started at 0.0.0.0:%d\n", s.config.Agent.ApiPort)
+		agentLog.Infof("Rest API started at 0.0.0.0:%d\n", s.config.Agent.ApiPort)
 		err := router.Run(fmt.Sprintf("0.0.0.0:%d", s.config.Agent.ApiPort))
 		if err != nil {
-			log.Printf("failed api handler: %v\n", err)
+			agentLog.Errorf("failed api handler: %v\n", err)
 		}
 	}()
 }
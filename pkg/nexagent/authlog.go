@@ -0,0 +1,233 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"bufio"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The authentication log of the node (auth.log on Debian, secure on Red
+// Hat) is followed from its end and the failed logins are counted per
+// service. Counters are cumulative since the agent started; the failures
+// of the last minute are also reported as a gauge, which the server
+// alerts on as a likely brute-force attempt. A log file shorter than the
+// last read offset has been rotated and is read from its start.
+
+const (
+	authLogEndpoint    = "/node/auth"
+	authFailureWindow  = time.Minute
+	maxAuthLogReadSize = 4 * 1024 * 1024
+)
+
+var defaultAuthLogFiles = []string{"/var/log/auth.log", "/var/log/secure"}
+
+var (
+	sshFailurePattern  = regexp.MustCompile(`sshd\[\d+\]: Failed \S+ for (?:invalid user )?\S+ from (\S+)`)
+	sshInvalidPattern  = regexp.MustCompile(`sshd\[\d+\]: Invalid user \S* ?from (\S+)`)
+	sshAcceptedPattern = regexp.MustCompile(`sshd\[\d+\]: Accepted \S+ for \S+ from (\S+)`)
+	pamFailurePattern  = regexp.MustCompile(`pam_unix\(([a-z0-9_-]+):auth\): authentication failure`)
+)
+
+type AuthLogConfig struct {
+	Disabled bool
+	Files    []string
+}
+
+type AuthLogState struct {
+	sync.Mutex
+
+	offsets  map[string]int64
+	failures map[string]float64
+	success  map[string]float64
+	invalid  float64
+	recent   []time.Time
+	sources  map[string]time.Time
+}
+
+func (s *NexAgent) authLogFiles() []string {
+	if len(s.config.AuthLog.Files) > 0 {
+		return s.config.AuthLog.Files
+	}
+
+	return defaultAuthLogFiles
+}
+
+// readAuthLog returns the lines appended to the file since the last read.
+func (state *AuthLogState) readAuthLog(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	offset, found := state.offsets[path]
+	if !found {
+		// history before the agent started is not counted
+		state.offsets[path] = info.Size()
+		return nil, nil
+	}
+	if info.Size() < offset {
+		offset = 0
+	}
+	if info.Size()-offset > maxAuthLogReadSize {
+		offset = info.Size() - maxAuthLogReadSize
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0, 16)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// a partial line is read again once complete
+			break
+		}
+		offset += int64(len(line))
+		lines = append(lines, line)
+	}
+	state.offsets[path] = offset
+
+	return lines, nil
+}
+
+func (state *AuthLogState) addFailure(service, source string, now time.Time) {
+	state.failures[service]++
+	state.recent = append(state.recent, now)
+	if source != "" {
+		state.sources[source] = now
+	}
+}
+
+func (state *AuthLogState) parse(line string, now time.Time) {
+	if match := sshFailurePattern.FindStringSubmatch(line); match != nil {
+		state.addFailure("sshd", match[1], now)
+	} else if match := sshInvalidPattern.FindStringSubmatch(line); match != nil {
+		state.invalid++
+	} else if match := sshAcceptedPattern.FindStringSubmatch(line); match != nil {
+		state.success["sshd"]++
+	} else if match := pamFailurePattern.FindStringSubmatch(line); match != nil && match[1] != "sshd" {
+		// sshd failures are already counted from their own message
+		state.addFailure(match[1], "", now)
+	}
+}
+
+// expire drops the failures older than the window.
+func (state *AuthLogState) expire(now time.Time) {
+	start := now.Add(-authFailureWindow)
+
+	kept := state.recent[:0]
+	for _, ts := range state.recent {
+		if ts.After(start) {
+			kept = append(kept, ts)
+		}
+	}
+	state.recent = kept
+
+	for source, ts := range state.sources {
+		if !ts.After(start) {
+			delete(state.sources, source)
+		}
+	}
+}
+
+func (s *NexAgent) sendAuthLogMetrics(ts *time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			collectLog.Errorf("sendAuthLogMetrics: %v\n", r)
+			s.watchdog.fail(collectorAuthLog, r)
+		}
+	}()
+
+	state := &s.authLog
+	state.Lock()
+	defer state.Unlock()
+
+	if state.offsets == nil {
+		state.offsets = make(map[string]int64)
+		state.failures = make(map[string]float64)
+		state.success = make(map[string]float64)
+		state.sources = make(map[string]time.Time)
+	}
+
+	readable := 0
+	for _, path := range s.authLogFiles() {
+		lines, err := state.readAuthLog(path)
+		if err != nil {
+			continue
+		}
+		readable++
+
+		for _, line := range lines {
+			state.parse(line, *ts)
+		}
+	}
+	if readable == 0 {
+		return
+	}
+	state.expire(*ts)
+
+	label := fmt.Sprintf("host=%s", s.hostName)
+	values := BasicMetrics{
+		&BasicMetric{Name: "node_auth_failures_per_minute", Label: label, Type: "gauge", Value: float64(len(state.recent))},
+		&BasicMetric{Name: "node_auth_failure_sources", Label: label, Type: "gauge", Value: float64(len(state.sources))},
+		&BasicMetric{Name: "node_auth_invalid_users_total", Label: label, Type: "counter", Value: state.invalid},
+	}
+
+	services := make([]string, 0, len(state.failures)+len(state.success))
+	for service := range state.failures {
+		services = append(services, service)
+	}
+	for service := range state.success {
+		if _, found := state.failures[service]; !found {
+			services = append(services, service)
+		}
+	}
+	sort.Strings(services)
+
+	for _, service := range services {
+		serviceLabel := fmt.Sprintf("host=%s,service=%s", s.hostName, service)
+		values = append(values,
+			&BasicMetric{Name: "node_auth_failures_total", Label: serviceLabel, Type: "counter", Value: state.failures[service]},
+			&BasicMetric{Name: "node_auth_success_total", Label: serviceLabel, Type: "counter", Value: state.success[service]})
+	}
+
+	metrics := &pb.Metrics{
+		Metrics: make([]*pb.Metric, 0, len(values)),
+	}
+	s.appendMetrics(metrics, &values, authLogEndpoint, pb.Metric_NODE, "", 0, ts)
+
+	if _, err := s.collectorClient.ReportMetrics(s.ctx, metrics); err != nil {
+		collectLog.Errorf("AuthLog: failed to report metrics: %v\n", err)
+		s.watchdog.fail(collectorAuthLog, err)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	diagnosticCommandTimeout = 10 * time.Second
+	diagnosticMaxOutput      = 512 * 1024
+	diagnosticDmesgLines     = 200
+)
+
+type diagnosticSection struct {
+	FileName string
+	Commands [][]string
+	Filter   func(string) string
+}
+
+// diagnosticSections lists what is gathered for a diagnostic capture. The
+// first command of a section that succeeds is used.
+var diagnosticSections = []diagnosticSection{
+	{FileName: "top.txt", Commands: [][]string{{"top", "-b", "-n", "1"}}},
+	{FileName: "dmesg.txt", Commands: [][]string{{"dmesg", "-T"}, {"dmesg"}}, Filter: tailLines(diagnosticDmesgLines)},
+	{FileName: "df.txt", Commands: [][]string{{"df", "-h"}}},
+	{FileName: "netstat.txt", Commands: [][]string{{"netstat", "-tunap"}, {"ss", "-tunap"}}},
+	{FileName: "docker_ps.txt", Commands: [][]string{{"docker", "ps", "-a"}}},
+}
+
+func tailLines(count int) func(string) string {
+	return func(output string) string {
+		lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+		if len(lines) > count {
+			lines = lines[len(lines)-count:]
+		}
+
+		return strings.Join(lines, "\n") + "\n"
+	}
+}
+
+func runDiagnosticCommand(args []string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), diagnosticCommandTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+	if len(output) > diagnosticMaxOutput {
+		output = output[len(output)-diagnosticMaxOutput:]
+	}
+
+	return string(output), err
+}
+
+func (s *NexAgent) captureDiagnostics() ([]byte, error) {
+	var buffer bytes.Buffer
+
+	gzipWriter := gzip.NewWriter(&buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	now := time.Now()
+
+	for _, section := range diagnosticSections {
+		var content string
+
+		for _, args := range section.Commands {
+			output, err := runDiagnosticCommand(args)
+			if err != nil {
+				content += fmt.Sprintf("# %s: %v\n%s\n", strings.Join(args, " "), err, output)
+				continue
+			}
+
+			if section.Filter != nil {
+				output = section.Filter(output)
+			}
+			content = fmt.Sprintf("# %s\n%s", strings.Join(args, " "), output)
+			break
+		}
+
+		header := &tar.Header{
+			Name:    section.FileName,
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: now,
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return nil, err
+		}
+		if _, err := tarWriter.Write([]byte(content)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func (s *NexAgent) runDiagnosticCapture(command *pb.Command) {
+	defer func() {
+		if r := recover(); r != nil {
+			commandLog.Errorf("runDiagnosticCapture: %v\n", r)
+		}
+	}()
+
+	result := &pb.CommandResult{
+		CommandId: command.Id,
+		Name:      command.Name,
+		Success:   true,
+	}
+
+	data, err := s.captureDiagnostics()
+	if err != nil {
+		result.Success = false
+		result.Error = err.Error()
+	} else {
+		result.Data = data
+	}
+
+	if _, err := s.collectorClient.ReportCommandResult(s.ctx, result); err != nil {
+		commandLog.Errorf("Diagnostic: failed to upload capture: %v\n", err)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	pb "github.com/NexClipper/NexClipper/api"
+	"strconv"
+	"time"
+)
+
+const maxTailDuration = 5 * time.Minute
+
+func (s *NexAgent) runCommand(command *pb.Command) {
+	commandLog.Infof("Command: %s %v\n", command.Name, command.Args)
+
+	switch command.Name {
+	case "tail":
+		go s.runTail(command)
+	case "tail_stop":
+		if len(command.Args) > 0 {
+			s.stopTail(command.Args[0])
+		}
+	case "diagnostic":
+		go s.runDiagnosticCapture(command)
+	case "pprof":
+		go s.runProfileCapture(command)
+	case "config":
+		go s.runRemoteConfig(command)
+	case "journey":
+		go s.runJourney(command)
+	case "dns":
+		go s.runDNSCheck(command)
+	case "ports":
+		go s.runPortInventory(command)
+	case "mesh_probe":
+		go s.runMeshProbe(command)
+	case "reconnect":
+		s.runReconnect(command)
+	default:
+		commandLog.Warnf("Command: unknown command %s\n", command.Name)
+	}
+}
+
+func (s *NexAgent) stopTail(commandId string) {
+	s.tailLock.Lock()
+	defer s.tailLock.Unlock()
+
+	if stop, found := s.tails[commandId]; found {
+		close(stop)
+		delete(s.tails, commandId)
+	}
+}
+
+func (s *NexAgent) collectNodeMetric(metricName string, ts *time.Time) *pb.Metrics {
+	metrics := &pb.Metrics{
+		Metrics: make([]*pb.Metric, 0, 10),
+	}
+
+	s.addNodeLoadMetric(metrics, ts)
+	s.addNodeCpuMetric(metrics, ts)
+	s.addNodeMemoryMetric(metrics, ts)
+	s.addNodeDiskMetric(metrics, ts)
+	s.addNodeNetMetric(metrics, ts)
+
+	filtered := metrics.Metrics[:0]
+	for _, metric := range metrics.Metrics {
+		if metric.Name == metricName {
+			filtered = append(filtered, metric)
+		}
+	}
+	metrics.Metrics = filtered
+
+	return metrics
+}
+
+func (s *NexAgent) runTail(command *pb.Command) {
+	defer func() {
+		if r := recover(); r != nil {
+			commandLog.Errorf("runTail: %v\n", r)
+		}
+	}()
+
+	if len(command.Args) != 3 {
+		commandLog.Warnf("Tail: invalid arguments: %v\n", command.Args)
+		return
+	}
+
+	metricName := command.Args[0]
+	interval, err := strconv.Atoi(command.Args[1])
+	if err != nil || interval <= 0 {
+		commandLog.Warnf("Tail: invalid interval: %s\n", command.Args[1])
+		return
+	}
+	duration, err := time.ParseDuration(command.Args[2])
+	if err != nil || duration <= 0 || duration > maxTailDuration {
+		commandLog.Warnf("Tail: invalid duration: %s\n", command.Args[2])
+		return
+	}
+
+	stop := make(chan struct{})
+	s.tailLock.Lock()
+	s.tails[command.Id] = stop
+	s.tailLock.Unlock()
+	defer s.stopTail(command.Id)
+
+	ticker := time.NewTicker(time.Duration(interval) * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.After(duration)
+
+	commandLog.Infof("Tail: %s every %dms for %s\n", metricName, interval, duration)
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if s.connected == false {
+				return
+			}
+
+			metrics := s.collectNodeMetric(metricName, &now)
+			_, err := s.collectorClient.ReportTailMetrics(s.ctx, &pb.TailMetrics{
+				CommandId: command.Id,
+				TsMs:      now.UnixNano() / int64(time.Millisecond),
+				Metrics:   metrics.Metrics,
+			})
+			if err != nil {
+				commandLog.Warnf("Tail: stopped: %v\n", err)
+				return
+			}
+		case <-stop:
+			return
+		case <-deadline:
+			return
+		}
+	}
+}
@@ -0,0 +1,232 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/shirou/gopsutil/disk"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// Throughput counters look healthy on a disk that takes a second to answer
+// a single request, so the optional I/O probe times a few small writes
+// and reads on each mountpoint. O_DIRECT bypasses the page cache and
+// O_DSYNC waits for the device. The probe is capped to ioProbeBlocks
+// blocks of ioProbeBlockSize bytes per mountpoint, at most
+// maxIOProbeMounts mountpoints, one run at a time, and mountpoints that
+// are read-only or almost full are skipped. A run still blocked on a hung
+// device delays the next one instead of piling up.
+
+const (
+	ioProbeFile      = ".nexagent-ioprobe"
+	ioProbeEndpoint  = "/node/ioprobe"
+	ioProbeBlockSize = 4096
+	ioProbeBlocks    = 8
+	maxIOProbeMounts = 16
+	minIOProbeFree   = 64 * 1024 * 1024
+
+	defaultIOProbeInterval = 300
+)
+
+type IOProbeConfig struct {
+	Enabled     bool
+	Interval    int
+	Mountpoints []string
+}
+
+type IOProbeState struct {
+	sync.Mutex
+
+	running bool
+	lastRun time.Time
+}
+
+type ioProbeResult struct {
+	writeAvg time.Duration
+	writeMax time.Duration
+	readAvg  time.Duration
+	readMax  time.Duration
+}
+
+// alignedBlock returns a block aligned for O_DIRECT.
+func alignedBlock() []byte {
+	buffer := make([]byte, 2*ioProbeBlockSize)
+	offset := int(uintptr(unsafe.Pointer(&buffer[0])) & (ioProbeBlockSize - 1))
+	if offset != 0 {
+		offset = ioProbeBlockSize - offset
+	}
+
+	return buffer[offset : offset+ioProbeBlockSize]
+}
+
+// timeBlocks runs op on every block of the file and returns the average
+// and the slowest latency.
+func timeBlocks(file *os.File, op func(*os.File, []byte, int64) (int, error)) (time.Duration, time.Duration, error) {
+	block := alignedBlock()
+	for idx := range block {
+		block[idx] = byte(idx)
+	}
+
+	var total, slowest time.Duration
+	for idx := 0; idx < ioProbeBlocks; idx++ {
+		start := time.Now()
+		if _, err := op(file, block, int64(idx*ioProbeBlockSize)); err != nil {
+			return 0, 0, err
+		}
+		elapsed := time.Since(start)
+
+		total += elapsed
+		if elapsed > slowest {
+			slowest = elapsed
+		}
+	}
+
+	return total / ioProbeBlocks, slowest, nil
+}
+
+func probeMountpoint(mountpoint string) (*ioProbeResult, error) {
+	path := filepath.Join(mountpoint, ioProbeFile)
+	defer os.Remove(path)
+
+	writer, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|ioProbeWriteFlags, 0600)
+	if err != nil {
+		return nil, err
+	}
+	writeAvg, writeMax, err := timeBlocks(writer, (*os.File).WriteAt)
+	writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := os.OpenFile(path, os.O_RDONLY|ioProbeReadFlags, 0)
+	if err != nil {
+		return nil, err
+	}
+	readAvg, readMax, err := timeBlocks(reader, (*os.File).ReadAt)
+	reader.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ioProbeResult{writeAvg: writeAvg, writeMax: writeMax, readAvg: readAvg, readMax: readMax}, nil
+}
+
+// ioProbeMountpoints returns the configured mountpoints, or the writable
+// mountpoints of disk devices.
+func (s *NexAgent) ioProbeMountpoints() []string {
+	if len(s.config.IOProbe.Mountpoints) > 0 {
+		return s.config.IOProbe.Mountpoints
+	}
+
+	parts, err := disk.Partitions(false)
+	if err != nil {
+		return nil
+	}
+
+	mountpoints := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if !s.IsDiskDevice(part.Device) {
+			continue
+		}
+		readOnly := false
+		for _, opt := range strings.Split(part.Opts, ",") {
+			readOnly = readOnly || opt == "ro"
+		}
+		if readOnly {
+			continue
+		}
+		mountpoints = append(mountpoints, part.Mountpoint)
+	}
+
+	return mountpoints
+}
+
+func (s *NexAgent) runIOProbe(ts *time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			collectLog.Errorf("runIOProbe: %v\n", r)
+			s.watchdog.fail(collectorIOProbe, r)
+		}
+	}()
+
+	interval := time.Duration(s.config.IOProbe.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultIOProbeInterval * time.Second
+	}
+
+	state := &s.ioProbe
+	state.Lock()
+	if state.running || ts.Sub(state.lastRun) < interval {
+		state.Unlock()
+		return
+	}
+	state.running = true
+	state.lastRun = *ts
+	state.Unlock()
+
+	defer func() {
+		state.Lock()
+		state.running = false
+		state.Unlock()
+	}()
+
+	mountpoints := s.ioProbeMountpoints()
+	if len(mountpoints) > maxIOProbeMounts {
+		mountpoints = mountpoints[:maxIOProbeMounts]
+	}
+
+	values := make(BasicMetrics, 0, 5*len(mountpoints))
+	for _, mountpoint := range mountpoints {
+		label := fmt.Sprintf("host=%s,path=%s", s.hostName, mountpoint)
+
+		usage, err := disk.Usage(mountpoint)
+		if err != nil || usage.Free < minIOProbeFree {
+			continue
+		}
+
+		result, err := probeMountpoint(mountpoint)
+		if err != nil {
+			collectLog.Errorf("IOProbe: failed to probe %s: %v\n", mountpoint, err)
+			s.watchdog.fail(collectorIOProbe, err)
+			values = append(values, &BasicMetric{Name: "node_io_probe_success", Label: label, Type: "gauge", Value: 0})
+			continue
+		}
+
+		values = append(values,
+			&BasicMetric{Name: "node_io_probe_success", Label: label, Type: "gauge", Value: 1},
+			&BasicMetric{Name: "node_io_probe_write_latency_avg", Label: label, Type: "gauge", Value: result.writeAvg.Seconds()},
+			&BasicMetric{Name: "node_io_probe_write_latency_max", Label: label, Type: "gauge", Value: result.writeMax.Seconds()},
+			&BasicMetric{Name: "node_io_probe_read_latency_avg", Label: label, Type: "gauge", Value: result.readAvg.Seconds()},
+			&BasicMetric{Name: "node_io_probe_read_latency_max", Label: label, Type: "gauge", Value: result.readMax.Seconds()})
+	}
+
+	metrics := &pb.Metrics{
+		Metrics: make([]*pb.Metric, 0, len(values)),
+	}
+	s.appendMetrics(metrics, &values, ioProbeEndpoint, pb.Metric_NODE, s.hostName, 0, ts)
+
+	if _, err := s.collectorClient.ReportMetrics(s.ctx, metrics); err != nil {
+		collectLog.Errorf("IOProbe: failed to report metrics: %v\n", err)
+		s.watchdog.fail(collectorIOProbe, err)
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"encoding/json"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/NexClipper/NexClipper/pkg/nexprobe"
+)
+
+const (
+	journeyEndpoint  = "/synthetic/journey"
+	dnsCheckEndpoint = "/synthetic/dns"
+)
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+
+	return 0
+}
+
+func (s *NexAgent) addJourneyMetrics(metrics *pb.Metrics, result *nexprobe.JourneyResult) {
+	values := BasicMetrics{
+		&BasicMetric{
+			Name:  "synthetic_journey_duration_ms",
+			Label: fmt.Sprintf("journey=%s", result.Journey),
+			Type:  "gauge",
+			Value: result.DurationMs,
+		},
+		&BasicMetric{
+			Name:  "synthetic_journey_success",
+			Label: fmt.Sprintf("journey=%s", result.Journey),
+			Type:  "gauge",
+			Value: boolValue(result.Success),
+		},
+	}
+
+	for _, step := range result.Steps {
+		label := fmt.Sprintf("journey=%s,step=%s", result.Journey, step.Name)
+		values = append(values,
+			&BasicMetric{Name: "synthetic_step_duration_ms", Label: label, Type: "gauge", Value: step.DurationMs},
+			&BasicMetric{Name: "synthetic_step_success", Label: label, Type: "gauge", Value: boolValue(step.Success)})
+	}
+
+	s.appendMetrics(metrics, &values, journeyEndpoint, pb.Metric_NODE, "", 0, &result.StartedTs)
+}
+
+func (s *NexAgent) addDNSCheckMetrics(metrics *pb.Metrics, check *nexprobe.DNSCheck, result *nexprobe.JourneyResult) {
+	resolver := check.Resolver
+	if resolver == "" {
+		resolver = "system"
+	}
+	label := fmt.Sprintf("check=%s,record=%s,type=%s,resolver=%s", check.Name, check.Record, check.Type, resolver)
+
+	values := BasicMetrics{
+		&BasicMetric{Name: "synthetic_dns_lookup_ms", Label: label, Type: "gauge", Value: result.DurationMs},
+		&BasicMetric{Name: "synthetic_dns_success", Label: label, Type: "gauge", Value: boolValue(result.Success)},
+	}
+
+	s.appendMetrics(metrics, &values, dnsCheckEndpoint, pb.Metric_NODE, "", 0, &result.StartedTs)
+}
+
+// reportCheck sends the metrics and the result of a synthetic check.
+func (s *NexAgent) reportCheck(result *pb.CommandResult, metrics *pb.Metrics, checkResult *nexprobe.JourneyResult) {
+	if !checkResult.Success {
+		commandLog.Errorf("Synthetic: %s failed: %s\n", checkResult.Journey, checkResult.Error)
+	}
+
+	if _, err := s.collectorClient.ReportMetrics(s.ctx, metrics); err != nil {
+		commandLog.Errorf("Synthetic: failed to report metrics: %v\n", err)
+	}
+
+	data, err := json.Marshal(checkResult)
+	if err != nil {
+		result.Success = false
+		result.Error = err.Error()
+		return
+	}
+	result.Data = data
+}
+
+func (s *NexAgent) runJourney(command *pb.Command) {
+	defer func() {
+		if r := recover(); r != nil {
+			commandLog.Errorf("runJourney: %v\n", r)
+		}
+	}()
+
+	result := &pb.CommandResult{
+		CommandId: command.Id,
+		Name:      command.Name,
+		Success:   true,
+	}
+
+	if len(command.Args) != 1 {
+		result.Success = false
+		result.Error = fmt.Sprintf("invalid arguments: %v", command.Args)
+	} else if journey, err := nexprobe.ParseJourney([]byte(command.Args[0])); err != nil {
+		result.Success = false
+		result.Error = err.Error()
+	} else {
+		journeyResult := nexprobe.RunJourney(journey)
+
+		metrics := &pb.Metrics{
+			Metrics: make([]*pb.Metric, 0, 2+2*len(journeyResult.Steps)),
+		}
+		s.addJourneyMetrics(metrics, journeyResult)
+		s.reportCheck(result, metrics, journeyResult)
+	}
+
+	if _, err := s.collectorClient.ReportCommandResult(s.ctx, result); err != nil {
+		commandLog.Errorf("Journey: failed to report result: %v\n", err)
+	}
+}
+
+func (s *NexAgent) runDNSCheck(command *pb.Command) {
+	defer func() {
+		if r := recover(); r != nil {
+			commandLog.Errorf("runDNSCheck: %v\n", r)
+		}
+	}()
+
+	result := &pb.CommandResult{
+		CommandId: command.Id,
+		Name:      command.Name,
+		Success:   true,
+	}
+
+	if len(command.Args) != 1 {
+		result.Success = false
+		result.Error = fmt.Sprintf("invalid arguments: %v", command.Args)
+	} else if check, err := nexprobe.ParseDNSCheck([]byte(command.Args[0])); err != nil {
+		result.Success = false
+		result.Error = err.Error()
+	} else {
+		checkResult := nexprobe.RunDNSCheck(check)
+
+		metrics := &pb.Metrics{
+			Metrics: make([]*pb.Metric, 0, 2),
+		}
+		s.addDNSCheckMetrics(metrics, check, checkResult)
+		s.reportCheck(result, metrics, checkResult)
+	}
+
+	if _, err := s.collectorClient.ReportCommandResult(s.ctx, result); err != nil {
+		commandLog.Errorf("DNS: failed to report result: %v\n", err)
+	}
+}
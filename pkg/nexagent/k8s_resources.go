@@ -0,0 +1,222 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"encoding/json"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The agent leading the cluster lists the instances of the configured
+// resources, typically custom resources of operators such as Argo
+// Rollouts or KEDA ScaledObjects, given as group/version/Kind ("v1/Kind"
+// for the core group). The phase and the conditions are read from the
+// status the way most operators write it. Every run reports the complete
+// list of each kind, so the server can tell the instances that are gone.
+
+const k8sResourcesInterval = time.Minute
+
+type K8sResourceConfig struct {
+	Resources []string
+}
+
+type K8sResourceState struct {
+	sync.Mutex
+
+	running bool
+	lastRun time.Time
+	// plurals holds the resource names resolved from the kinds
+	plurals map[schema.GroupVersionKind]string
+}
+
+type k8sResourceCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason"`
+	Message            string `json:"message"`
+	LastTransitionTime string `json:"last_transition_time"`
+}
+
+type k8sResourceInstance struct {
+	Namespace  string                 `json:"namespace"`
+	Name       string                 `json:"name"`
+	Phase      string                 `json:"phase"`
+	Conditions []k8sResourceCondition `json:"conditions"`
+}
+
+type k8sResourceReport struct {
+	Group     string                `json:"group"`
+	Version   string                `json:"version"`
+	Kind      string                `json:"kind"`
+	Instances []k8sResourceInstance `json:"instances"`
+}
+
+// parseResourceKind parses a group/version/Kind or version/Kind entry.
+func parseResourceKind(resource string) (schema.GroupVersionKind, error) {
+	parts := strings.Split(strings.TrimSpace(resource), "/")
+	switch len(parts) {
+	case 2:
+		return schema.GroupVersionKind{Version: parts[0], Kind: parts[1]}, nil
+	case 3:
+		return schema.GroupVersionKind{Group: parts[0], Version: parts[1], Kind: parts[2]}, nil
+	}
+
+	return schema.GroupVersionKind{}, fmt.Errorf("invalid resource %q, expected group/version/Kind", resource)
+}
+
+// resourcePlural resolves the resource name of the kind with the discovery
+// of the API server.
+func (s *NexAgent) resourcePlural(state *K8sResourceState, gvk schema.GroupVersionKind) (string, error) {
+	if plural, found := state.plurals[gvk]; found {
+		return plural, nil
+	}
+
+	resources, err := s.k8sClientSet.Discovery().ServerResourcesForGroupVersion(gvk.GroupVersion().String())
+	if err != nil {
+		return "", err
+	}
+	for _, resource := range resources.APIResources {
+		if resource.Kind == gvk.Kind && !strings.Contains(resource.Name, "/") {
+			state.plurals[gvk] = resource.Name
+			return resource.Name, nil
+		}
+	}
+
+	return "", fmt.Errorf("kind %s not served by %s", gvk.Kind, gvk.GroupVersion().String())
+}
+
+func resourceInstance(item *unstructured.Unstructured) k8sResourceInstance {
+	instance := k8sResourceInstance{
+		Namespace:  item.GetNamespace(),
+		Name:       item.GetName(),
+		Conditions: make([]k8sResourceCondition, 0),
+	}
+	instance.Phase, _, _ = unstructured.NestedString(item.Object, "status", "phase")
+
+	conditions, _, _ := unstructured.NestedSlice(item.Object, "status", "conditions")
+	for _, value := range conditions {
+		fields, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		condition := k8sResourceCondition{}
+		condition.Type, _, _ = unstructured.NestedString(fields, "type")
+		condition.Status, _, _ = unstructured.NestedString(fields, "status")
+		condition.Reason, _, _ = unstructured.NestedString(fields, "reason")
+		condition.Message, _, _ = unstructured.NestedString(fields, "message")
+		condition.LastTransitionTime, _, _ = unstructured.NestedString(fields, "lastTransitionTime")
+		if condition.Type == "" {
+			continue
+		}
+		instance.Conditions = append(instance.Conditions, condition)
+	}
+
+	return instance
+}
+
+func (s *NexAgent) reportK8sResources(ts *time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			k8sLog.Errorf("reportK8sResources: %v\n", r)
+			s.watchdog.fail(collectorK8sResources, r)
+		}
+	}()
+
+	state := &s.k8sResources
+	state.Lock()
+	if state.running || ts.Sub(state.lastRun) < k8sResourcesInterval {
+		state.Unlock()
+		return
+	}
+	if state.plurals == nil {
+		state.plurals = make(map[schema.GroupVersionKind]string)
+	}
+	state.running = true
+	state.lastRun = *ts
+	state.Unlock()
+
+	defer func() {
+		state.Lock()
+		state.running = false
+		state.Unlock()
+	}()
+
+	client, err := dynamic.NewForConfig(s.k8sConfig)
+	if err != nil {
+		k8sLog.Errorf("K8sResources: failed to create client: %v\n", err)
+		s.watchdog.fail(collectorK8sResources, err)
+		return
+	}
+
+	reports := make([]k8sResourceReport, 0, len(s.config.K8sResource.Resources))
+	for _, resource := range s.config.K8sResource.Resources {
+		gvk, err := parseResourceKind(resource)
+		if err != nil {
+			k8sLog.Warnf("K8sResources: %v\n", err)
+			continue
+		}
+		plural, err := s.resourcePlural(state, gvk)
+		if err != nil {
+			k8sLog.Errorf("K8sResources: failed to resolve %s: %v\n", resource, err)
+			s.watchdog.fail(collectorK8sResources, err)
+			continue
+		}
+
+		list, err := client.Resource(gvk.GroupVersion().WithResource(plural)).List(metav1.ListOptions{})
+		if err != nil {
+			k8sLog.Errorf("K8sResources: failed to list %s: %v\n", resource, err)
+			s.watchdog.fail(collectorK8sResources, err)
+			continue
+		}
+
+		report := k8sResourceReport{
+			Group:     gvk.Group,
+			Version:   gvk.Version,
+			Kind:      gvk.Kind,
+			Instances: make([]k8sResourceInstance, 0, len(list.Items)),
+		}
+		for idx := range list.Items {
+			report.Instances = append(report.Instances, resourceInstance(&list.Items[idx]))
+		}
+		reports = append(reports, report)
+	}
+
+	if len(reports) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(reports)
+	if err == nil {
+		_, err = s.collectorClient.ReportCommandResult(s.ctx, &pb.CommandResult{
+			Name:    "k8s_resources",
+			Success: true,
+			Data:    data,
+		})
+	}
+	if err != nil {
+		k8sLog.Errorf("K8sResources: failed to report resources: %v\n", err)
+		s.watchdog.fail(collectorK8sResources, err)
+	}
+}
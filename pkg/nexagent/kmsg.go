@@ -0,0 +1,208 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"encoding/json"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The kernel log is read from /dev/kmsg, from its end when the agent
+// starts, and the messages of OOM kills, I/O errors and hardware faults
+// are reported as events. The server has no event stream from agents, so
+// they travel as an unsolicited "kernel_events" command result; counters
+// per kind are reported as metrics. /dev/kmsg is read with a raw
+// non-blocking descriptor since the runtime poller would wait for the
+// next record instead of returning.
+
+const (
+	kmsgPath           = "/dev/kmsg"
+	kernelLogEndpoint  = "/node/kernel"
+	maxKernelRecords   = 1000
+	maxKernelEvents    = 100
+	kernelRecordBuffer = 8192
+
+	KernelOOMKill       = "oom_kill"
+	KernelIOError       = "io_error"
+	KernelHardwareError = "hardware_error"
+)
+
+var (
+	oomMemcgPattern  = regexp.MustCompile(`oom-kill:.*task_memcg=([^,]+)`)
+	oomKilledPattern = regexp.MustCompile(`(?:Killed|Kill) process (\d+) \(([^)]*)\)`)
+	containerPattern = regexp.MustCompile(`^(?:docker-|cri-containerd-|crio-)?([0-9a-f]{64})(?:\.scope)?$`)
+	ioErrorPatterns  = []*regexp.Regexp{
+		regexp.MustCompile(`I/O error, dev ([\w-]+)`),
+		regexp.MustCompile(`Buffer I/O error on dev(?:ice)? ([\w-]+)`),
+		regexp.MustCompile(`(?:EXT[234]-fs|BTRFS) (?:error|critical) \(device ([\w-]+)\)`),
+		regexp.MustCompile(`XFS \(([\w-]+)\): .*(?:I/O error|Corruption)`),
+	}
+	hardwarePattern = regexp.MustCompile(`\[Hardware Error\]|Machine check events logged|EDAC .*\b(?:CE|UE)\b`)
+)
+
+type KernelLogConfig struct {
+	Disabled bool
+}
+
+type KernelEvent struct {
+	Kind      string `json:"kind"`
+	Message   string `json:"message"`
+	Process   string `json:"process,omitempty"`
+	Pid       int    `json:"pid,omitempty"`
+	Container string `json:"container,omitempty"`
+	Device    string `json:"device,omitempty"`
+	Ts        int64  `json:"ts"`
+}
+
+type KernelLogState struct {
+	sync.Mutex
+
+	fd       int
+	opened   bool
+	failed   bool
+	memcg    string
+	counts   map[string]float64
+	buffered []KernelEvent
+}
+
+// containerOfCgroup returns the container id ending a cgroup path such as
+// /kubepods/burstable/pod.../<id> or /system.slice/docker-<id>.scope.
+func containerOfCgroup(cgroup string) string {
+	if match := containerPattern.FindStringSubmatch(path.Base(cgroup)); match != nil {
+		return match[1]
+	}
+
+	return ""
+}
+
+// parse turns a kmsg record, "priority,sequence,usec,flags;message", into
+// an event, remembering the cgroup of an OOM kill for the next record.
+func (state *KernelLogState) parse(record string, now time.Time) *KernelEvent {
+	idx := strings.IndexByte(record, ';')
+	if idx < 0 {
+		return nil
+	}
+	message := record[idx+1:]
+	if end := strings.IndexByte(message, '\n'); end >= 0 {
+		// continuation lines hold key=value device properties
+		message = message[:end]
+	}
+
+	if match := oomMemcgPattern.FindStringSubmatch(message); match != nil {
+		state.memcg = match[1]
+		return nil
+	}
+
+	event := &KernelEvent{Message: message, Ts: now.Unix()}
+	if match := oomKilledPattern.FindStringSubmatch(message); match != nil {
+		event.Kind = KernelOOMKill
+		event.Pid, _ = strconv.Atoi(match[1])
+		event.Process = match[2]
+		event.Container = containerOfCgroup(state.memcg)
+		state.memcg = ""
+		return event
+	}
+	for _, pattern := range ioErrorPatterns {
+		if match := pattern.FindStringSubmatch(message); match != nil {
+			event.Kind = KernelIOError
+			event.Device = match[1]
+			return event
+		}
+	}
+	if hardwarePattern.MatchString(message) {
+		event.Kind = KernelHardwareError
+		return event
+	}
+
+	return nil
+}
+
+func (s *NexAgent) reportKernelEvents(ts *time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			collectLog.Errorf("reportKernelEvents: %v\n", r)
+			s.watchdog.fail(collectorKernelLog, r)
+		}
+	}()
+
+	state := &s.kernelLog
+	state.Lock()
+	defer state.Unlock()
+
+	if state.failed {
+		s.watchdog.fail(collectorKernelLog, "kernel log is unavailable")
+		return
+	}
+	if !state.opened {
+		if err := state.open(); err != nil {
+			collectLog.Errorf("KernelLog: disabled, failed to open %s: %v\n", kmsgPath, err)
+			s.watchdog.fail(collectorKernelLog, err)
+			state.failed = true
+			return
+		}
+	}
+
+	// events failing to be delivered are sent with the next ones
+	state.buffered = append(state.buffered, state.read(*ts)...)
+	if len(state.buffered) > maxKernelEvents {
+		state.buffered = state.buffered[len(state.buffered)-maxKernelEvents:]
+	}
+	if len(state.buffered) > 0 {
+		data, err := json.Marshal(state.buffered)
+		if err == nil {
+			_, err = s.collectorClient.ReportCommandResult(s.ctx, &pb.CommandResult{
+				Name:    "kernel_events",
+				Success: true,
+				Data:    data,
+			})
+		}
+		if err != nil {
+			collectLog.Errorf("KernelLog: failed to report events: %v\n", err)
+			s.watchdog.fail(collectorKernelLog, err)
+		} else {
+			state.buffered = state.buffered[:0]
+		}
+	}
+
+	kinds := []string{KernelHardwareError, KernelIOError, KernelOOMKill}
+	values := make(BasicMetrics, 0, len(kinds))
+	for _, kind := range kinds {
+		values = append(values, &BasicMetric{
+			Name:  "node_kernel_events_total",
+			Label: fmt.Sprintf("host=%s,kind=%s", s.hostName, kind),
+			Type:  "counter",
+			Value: state.counts[kind],
+		})
+	}
+
+	metrics := &pb.Metrics{
+		Metrics: make([]*pb.Metric, 0, len(values)),
+	}
+	s.appendMetrics(metrics, &values, kernelLogEndpoint, pb.Metric_NODE, "", 0, ts)
+
+	if _, err := s.collectorClient.ReportMetrics(s.ctx, metrics); err != nil {
+		collectLog.Errorf("KernelLog: failed to report metrics: %v\n", err)
+		s.watchdog.fail(collectorKernelLog, err)
+	}
+}
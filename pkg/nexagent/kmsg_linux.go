@@ -0,0 +1,67 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"io"
+	"syscall"
+	"time"
+)
+
+func (state *KernelLogState) open() error {
+	fd, err := syscall.Open(kmsgPath, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	// history before the agent started is not reported
+	if _, err := syscall.Seek(fd, 0, io.SeekEnd); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	state.fd = fd
+	state.opened = true
+	state.counts = make(map[string]float64)
+
+	return nil
+}
+
+// read returns the events of the records written since the last read.
+func (state *KernelLogState) read(now time.Time) []KernelEvent {
+	events := make([]KernelEvent, 0, 4)
+	buffer := make([]byte, kernelRecordBuffer)
+
+	for count := 0; count < maxKernelRecords; count++ {
+		n, err := syscall.Read(state.fd, buffer)
+		if err == syscall.EPIPE {
+			// records were overwritten before being read
+			continue
+		}
+		if err != nil || n <= 0 {
+			break
+		}
+
+		if event := state.parse(string(buffer[:n]), now); event != nil {
+			state.counts[event.Kind]++
+			if len(events) < maxKernelEvents {
+				events = append(events, *event)
+			}
+		}
+	}
+
+	return events
+}
@@ -0,0 +1,34 @@
+//go:build !linux
+// +build !linux
+
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"fmt"
+	"time"
+)
+
+// /dev/kmsg only exists on linux, the kernel log collector stays failed.
+func (state *KernelLogState) open() error {
+	return fmt.Errorf("%s is only available on linux", kmsgPath)
+}
+
+func (state *KernelLogState) read(now time.Time) []KernelEvent {
+	return nil
+}
@@ -0,0 +1,39 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import "github.com/NexClipper/NexClipper/pkg/nexlog"
+
+type LogConfig struct {
+	// Level is debug, info, warn or error
+	Level string
+	// Format is console or json
+	Format string
+}
+
+// The loggers of the components of the agent.
+
+var (
+	agentLog   = nexlog.Named("agent")
+	collectLog = nexlog.Named("collect")
+	k8sLog     = nexlog.Named("k8s")
+	commandLog = nexlog.Named("command")
+)
+
+func (s *NexAgent) InitLogging() error {
+	return nexlog.Init(AppName, s.config.Log.Format, s.config.Log.Level)
+}
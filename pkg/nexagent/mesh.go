@@ -0,0 +1,257 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"time"
+)
+
+// Agents started with mesh_probe.enable accept the probes of their peers
+// on the mesh port and probe the peers the server sends with a
+// "mesh_probe" command. A probe connection starts with its mode: 'p'
+// echoes single bytes to time round trips, 'b' discards what it receives
+// and answers with the byte count once the sender closes its side. The
+// bandwidth test sends at most meshBandwidthBytes for meshBandwidthTime
+// so a probe stays light on busy links.
+
+const (
+	meshProbeEndpoint  = "/node/mesh"
+	meshModePing       = 'p'
+	meshModeBandwidth  = 'b'
+	meshPings          = 5
+	meshBandwidthBytes = 16 * 1024 * 1024
+	meshBandwidthTime  = time.Second
+	meshChunkSize      = 64 * 1024
+	meshDialTimeout    = 3 * time.Second
+	meshConnTimeout    = 15 * time.Second
+	maxMeshConns       = 8
+	maxMeshPeers       = 16
+
+	defaultMeshPort = 18004
+)
+
+type MeshProbeConfig struct {
+	Enabled bool
+	Port    int
+}
+
+type meshPeer struct {
+	Host    string `json:"host"`
+	Address string `json:"address"`
+}
+
+func (s *NexAgent) serveMesh() {
+	port := s.config.MeshProbe.Port
+	if port <= 0 {
+		port = defaultMeshPort
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		commandLog.Errorf("Mesh: failed to listen on %d: %v\n", port, err)
+		return
+	}
+	commandLog.Infof("Mesh: listening on %d\n", port)
+
+	slots := make(chan struct{}, maxMeshConns)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			commandLog.Warnf("Mesh: stopped: %v\n", err)
+			return
+		}
+
+		select {
+		case slots <- struct{}{}:
+			go func() {
+				defer func() { <-slots }()
+				handleMeshConn(conn)
+			}()
+		default:
+			conn.Close()
+		}
+	}
+}
+
+func handleMeshConn(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(meshConnTimeout))
+
+	mode := make([]byte, 1)
+	if _, err := io.ReadFull(conn, mode); err != nil {
+		return
+	}
+
+	switch mode[0] {
+	case meshModePing:
+		_, _ = io.Copy(conn, conn)
+	case meshModeBandwidth:
+		received, err := io.Copy(ioutil.Discard, conn)
+		if err != nil {
+			return
+		}
+		count := make([]byte, 8)
+		binary.BigEndian.PutUint64(count, uint64(received))
+		_, _ = conn.Write(count)
+	}
+}
+
+// meshLatency returns the median round trip time to the peer.
+func meshLatency(address string) (time.Duration, error) {
+	conn, err := net.DialTimeout("tcp", address, meshDialTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(meshConnTimeout))
+
+	if _, err := conn.Write([]byte{meshModePing}); err != nil {
+		return 0, err
+	}
+
+	rtts := make([]time.Duration, 0, meshPings)
+	buffer := make([]byte, 1)
+	for count := 0; count < meshPings; count++ {
+		start := time.Now()
+		if _, err := conn.Write(buffer); err != nil {
+			return 0, err
+		}
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			return 0, err
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+
+	return rtts[len(rtts)/2], nil
+}
+
+// meshBandwidth returns the throughput to the peer in megabits per second.
+func meshBandwidth(address string) (float64, error) {
+	conn, err := net.DialTimeout("tcp", address, meshDialTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(meshConnTimeout))
+
+	if _, err := conn.Write([]byte{meshModeBandwidth}); err != nil {
+		return 0, err
+	}
+
+	chunk := make([]byte, meshChunkSize)
+	start := time.Now()
+	sent := 0
+	for sent < meshBandwidthBytes && time.Since(start) < meshBandwidthTime {
+		n, err := conn.Write(chunk)
+		sent += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.CloseWrite()
+	}
+
+	// the peer answers once it received everything
+	count := make([]byte, 8)
+	if _, err := io.ReadFull(conn, count); err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(start).Seconds()
+	if elapsed <= 0 {
+		return 0, fmt.Errorf("no time elapsed")
+	}
+
+	return float64(binary.BigEndian.Uint64(count)) * 8 / elapsed / 1e6, nil
+}
+
+func (s *NexAgent) runMeshProbe(command *pb.Command) {
+	defer func() {
+		if r := recover(); r != nil {
+			commandLog.Errorf("runMeshProbe: %v\n", r)
+		}
+	}()
+
+	result := &pb.CommandResult{
+		CommandId: command.Id,
+		Name:      command.Name,
+		Success:   true,
+	}
+
+	var peers []meshPeer
+	if !s.config.MeshProbe.Enabled {
+		result.Success = false
+		result.Error = "mesh probe is disabled"
+	} else if len(command.Args) != 1 {
+		result.Success = false
+		result.Error = fmt.Sprintf("invalid arguments: %v", command.Args)
+	} else if err := json.Unmarshal([]byte(command.Args[0]), &peers); err != nil {
+		result.Success = false
+		result.Error = err.Error()
+	}
+	if len(peers) > maxMeshPeers {
+		peers = peers[:maxMeshPeers]
+	}
+
+	now := time.Now()
+	values := make(BasicMetrics, 0, 3*len(peers))
+	for _, peer := range peers {
+		label := fmt.Sprintf("host=%s,peer=%s", s.hostName, peer.Host)
+
+		latency, err := meshLatency(peer.Address)
+		if err != nil {
+			commandLog.Warnf("Mesh: %s unreachable: %v\n", peer.Host, err)
+			values = append(values, &BasicMetric{Name: "node_mesh_reachable", Label: label, Type: "gauge", Value: 0})
+			continue
+		}
+		values = append(values,
+			&BasicMetric{Name: "node_mesh_reachable", Label: label, Type: "gauge", Value: 1},
+			&BasicMetric{Name: "node_mesh_latency_ms", Label: label, Type: "gauge",
+				Value: float64(latency) / float64(time.Millisecond)})
+
+		if bandwidth, err := meshBandwidth(peer.Address); err == nil {
+			values = append(values,
+				&BasicMetric{Name: "node_mesh_bandwidth_mbps", Label: label, Type: "gauge", Value: bandwidth})
+		} else {
+			commandLog.Warnf("Mesh: bandwidth to %s: %v\n", peer.Host, err)
+		}
+	}
+
+	if len(values) > 0 {
+		metrics := &pb.Metrics{
+			Metrics: make([]*pb.Metric, 0, len(values)),
+		}
+		s.appendMetrics(metrics, &values, meshProbeEndpoint, pb.Metric_NODE, s.hostName, 0, &now)
+
+		if _, err := s.collectorClient.ReportMetrics(s.ctx, metrics); err != nil {
+			commandLog.Errorf("Mesh: failed to report metrics: %v\n", err)
+		}
+	}
+
+	if _, err := s.collectorClient.ReportCommandResult(s.ctx, result); err != nil {
+		commandLog.Errorf("Mesh: failed to report result: %v\n", err)
+	}
+}
@@ -21,7 +21,6 @@ import (
 	pb "github.com/NexClipper/NexClipper/api"
 	"github.com/shirou/gopsutil/cpu"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"strings"
@@ -35,6 +34,7 @@ type ContainerInfo struct {
 	cpuStat    *cpu.TimesStat
 	memStat    *docker.CgroupMemStat
 	qos        string
+	cgroupPath string
 }
 
 func (s *NexAgent) findPodContainers(qos string, cpuBasePaths []string, memBasePaths []string,
@@ -106,6 +106,7 @@ func (s *NexAgent) findPodContainers(qos string, cpuBasePaths []string, memBaseP
 						containerInfo.memStat = memStat
 					}
 					containerInfo.qos = qos
+					containerInfo.cgroupPath = targetPath
 				}
 			}
 		}
@@ -154,7 +155,8 @@ func (s *NexAgent) addPodContainerInfos(containerInfoMap map[string]*ContainerIn
 func (s *NexAgent) sendDockerMetrics(ts *time.Time) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Error: %v\n", r)
+			collectLog.Errorf("Error: %v\n", r)
+			s.watchdog.fail(collectorContainer, r)
 		}
 	}()
 
@@ -182,6 +184,7 @@ func (s *NexAgent) sendDockerMetrics(ts *time.Time) {
 			dockerStat: &dockerStat,
 			cpuStat:    nil,
 			memStat:    nil,
+			cgroupPath: path.Join(dockerMemoryCgroup, cID),
 		}
 
 		cpuStat, err := docker.CgroupCPUDocker(cID)
@@ -199,11 +202,8 @@ func (s *NexAgent) sendDockerMetrics(ts *time.Time) {
 
 	s.addPodContainerInfos(containerInfoMap)
 
-	for _, containerInfo := range containerInfoMap {
-		containerMetrics := &pb.Metrics{
-			Metrics: make([]*pb.Metric, 0, 8),
-		}
-
+	metricsMap := make(map[string]*BasicMetrics)
+	for cID, containerInfo := range containerInfoMap {
 		dockerStat := containerInfo.dockerStat
 		cpuStat := containerInfo.cpuStat
 		memStat := containerInfo.memStat
@@ -212,7 +212,7 @@ func (s *NexAgent) sendDockerMetrics(ts *time.Time) {
 			continue
 		}
 
-		metrics := &BasicMetrics{
+		metricsMap[cID] = &BasicMetrics{
 			&BasicMetric{
 				Name:  "container_cpu_usage_total",
 				Label: fmt.Sprintf("host=%s,container=%s", s.hostName, dockerStat.Name),
@@ -244,6 +244,15 @@ func (s *NexAgent) sendDockerMetrics(ts *time.Time) {
 				Value: float64(memStat.RSS),
 			},
 		}
+	}
+
+	s.addContainerNetworkMetrics(containerInfoMap, metricsMap)
+
+	for cID, metrics := range metricsMap {
+		dockerStat := containerInfoMap[cID].dockerStat
+		containerMetrics := &pb.Metrics{
+			Metrics: make([]*pb.Metric, 0, len(*metrics)),
+		}
 
 		s.appendMetrics(containerMetrics, metrics, "/container/metrics",
 			pb.Metric_CONTAINER, dockerStat.ContainerID, 0, ts)
@@ -265,9 +274,10 @@ func (s *NexAgent) sendDockerMetrics(ts *time.Time) {
 
 	resp, err := s.collectorClient.UpdateContainer(s.ctx, containersAll)
 	if err != nil {
-		log.Printf("sendDockerMetrics: failed UpdateContainer: %v\n", err)
+		collectLog.Errorf("sendDockerMetrics: failed UpdateContainer: %v\n", err)
+		s.watchdog.fail(collectorContainer, err)
 	}
 	if !resp.Success {
-		log.Printf("sendDockerMetrics: failed UpdateContainer from remote: %v\n", err)
+		collectLog.Errorf("sendDockerMetrics: failed UpdateContainer from remote: %v\n", err)
 	}
 }
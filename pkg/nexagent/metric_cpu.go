@@ -0,0 +1,185 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"bufio"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/shirou/gopsutil/cpu"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The node_cpu_* times are cumulative seconds; the utilization, iowait
+// and steal percentages below are computed between two collections, per
+// core and for the whole node, so they are first reported on the second
+// collection. Steal is the time a virtual CPU waited for the hypervisor,
+// the usual sign of a noisy neighbor. NUMA memory and allocation counters
+// are read from sysfs on hosts with NUMA nodes.
+
+const numaNodePath = "/sys/devices/system/node"
+
+type CpuSampleState struct {
+	sync.Mutex
+
+	last map[string]cpu.TimesStat
+}
+
+// cpuPercents returns the busy, iowait and steal percentages of a CPU
+// between two samples.
+func cpuPercents(prev, cur *cpu.TimesStat) (float64, float64, float64, bool) {
+	total := cur.Total() - prev.Total()
+	if total <= 0 {
+		return 0, 0, 0, false
+	}
+
+	idle := (cur.Idle - prev.Idle) + (cur.Iowait - prev.Iowait)
+	busy := 100 * (total - idle) / total
+	iowait := 100 * (cur.Iowait - prev.Iowait) / total
+	steal := 100 * (cur.Steal - prev.Steal) / total
+
+	return busy, iowait, steal, true
+}
+
+func (s *NexAgent) addNodeCpuCoreMetric(metrics *pb.Metrics, ts *time.Time) *pb.Metrics {
+	coreStats, err := cpu.Times(true)
+	if err != nil {
+		return metrics
+	}
+	totalStats, err := cpu.Times(false)
+	if err != nil {
+		return metrics
+	}
+
+	state := &s.cpuSamples
+	state.Lock()
+	defer state.Unlock()
+
+	if state.last == nil {
+		state.last = make(map[string]cpu.TimesStat)
+	}
+
+	values := make(BasicMetrics, 0, 3*(len(coreStats)+1))
+	for _, stat := range append(coreStats, totalStats...) {
+		prev, found := state.last[stat.CPU]
+		state.last[stat.CPU] = stat
+		if !found {
+			continue
+		}
+
+		busy, iowait, steal, ok := cpuPercents(&prev, &stat)
+		if !ok {
+			continue
+		}
+
+		if stat.CPU == "cpu-total" {
+			label := fmt.Sprintf("host=%s", s.hostName)
+			values = append(values,
+				&BasicMetric{Name: "node_cpu_utilization", Label: label, Type: "gauge", Value: busy},
+				&BasicMetric{Name: "node_cpu_iowait_percent", Label: label, Type: "gauge", Value: iowait},
+				&BasicMetric{Name: "node_cpu_steal_percent", Label: label, Type: "gauge", Value: steal})
+			continue
+		}
+
+		label := fmt.Sprintf("host=%s,cpu=%s", s.hostName, stat.CPU)
+		values = append(values,
+			&BasicMetric{Name: "node_cpu_core_utilization", Label: label, Type: "gauge", Value: busy},
+			&BasicMetric{Name: "node_cpu_core_iowait_percent", Label: label, Type: "gauge", Value: iowait},
+			&BasicMetric{Name: "node_cpu_core_steal_percent", Label: label, Type: "gauge", Value: steal})
+	}
+
+	s.appendMetrics(metrics, &values, "/node/metrics", pb.Metric_NODE, s.hostName, 0, ts)
+
+	return metrics
+}
+
+// readNumaFile parses the "key value" lines of a NUMA node file; meminfo
+// lines are prefixed with "Node <n>" and sized in kB.
+func readNumaFile(path string) (map[string]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 4 && fields[0] == "Node" {
+			fields = fields[2:]
+		}
+		if len(fields) < 2 {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			value *= 1024
+		}
+		values[strings.TrimSuffix(fields[0], ":")] = value
+	}
+
+	return values, scanner.Err()
+}
+
+func (s *NexAgent) addNodeNumaMetric(metrics *pb.Metrics, ts *time.Time) *pb.Metrics {
+	entries, err := ioutil.ReadDir(numaNodePath)
+	if err != nil {
+		return metrics
+	}
+
+	values := make(BasicMetrics, 0, 16)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, "node") {
+			continue
+		}
+		if _, err := strconv.Atoi(strings.TrimPrefix(name, "node")); err != nil {
+			continue
+		}
+		label := fmt.Sprintf("host=%s,numa=%s", s.hostName, name)
+
+		if meminfo, err := readNumaFile(filepath.Join(numaNodePath, name, "meminfo")); err == nil {
+			values = append(values,
+				&BasicMetric{Name: "node_numa_memory_total", Label: label, Type: "gauge", Value: meminfo["MemTotal"]},
+				&BasicMetric{Name: "node_numa_memory_free", Label: label, Type: "gauge", Value: meminfo["MemFree"]},
+				&BasicMetric{Name: "node_numa_memory_used", Label: label, Type: "gauge", Value: meminfo["MemUsed"]})
+		}
+		if numastat, err := readNumaFile(filepath.Join(numaNodePath, name, "numastat")); err == nil {
+			values = append(values,
+				&BasicMetric{Name: "node_numa_hit_total", Label: label, Type: "counter", Value: numastat["numa_hit"]},
+				&BasicMetric{Name: "node_numa_miss_total", Label: label, Type: "counter", Value: numastat["numa_miss"]},
+				&BasicMetric{Name: "node_numa_foreign_total", Label: label, Type: "counter", Value: numastat["numa_foreign"]},
+				&BasicMetric{Name: "node_numa_local_total", Label: label, Type: "counter", Value: numastat["local_node"]},
+				&BasicMetric{Name: "node_numa_other_total", Label: label, Type: "counter", Value: numastat["other_node"]})
+		}
+	}
+
+	s.appendMetrics(metrics, &values, "/node/metrics", pb.Metric_NODE, s.hostName, 0, ts)
+
+	return metrics
+}
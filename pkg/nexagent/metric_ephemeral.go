@@ -0,0 +1,288 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"encoding/json"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/shirou/gopsutil/docker"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The kubelet evicts pods when the node filesystem falls below its
+// nodefs.available threshold, and a pod when its writable layers, logs
+// and emptyDir volumes exceed its ephemeral-storage limits. The usage is
+// read from the stats summary of the kubelet through the API server
+// proxy. The writable layer and the logs are reported on each container;
+// the pod totals on one container of the pod, so the pod query does not
+// count them twice. The *_eviction_percent metrics tell how far the node
+// and the pod are on their way to an eviction, 100 being evicted.
+
+const (
+	ephemeralEndpoint                 = "/k8s/ephemeral"
+	defaultEphemeralEvictionThreshold = 10.0
+)
+
+type EphemeralStorageConfig struct {
+	Disabled bool
+	// EvictionThreshold is the nodefs.available eviction threshold of the
+	// kubelet in percent
+	EvictionThreshold float64
+}
+
+type statsSummary struct {
+	Node struct {
+		Fs fsStats `json:"fs"`
+	} `json:"node"`
+	Pods []struct {
+		PodRef struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+			UID       string `json:"uid"`
+		} `json:"podRef"`
+		Containers []struct {
+			Name   string  `json:"name"`
+			Rootfs fsStats `json:"rootfs"`
+			Logs   fsStats `json:"logs"`
+		} `json:"containers"`
+		Volumes []struct {
+			fsStats
+			Name string `json:"name"`
+		} `json:"volume"`
+		EphemeralStorage fsStats `json:"ephemeral-storage"`
+	} `json:"pods"`
+}
+
+type fsStats struct {
+	AvailableBytes float64 `json:"availableBytes"`
+	CapacityBytes  float64 `json:"capacityBytes"`
+	UsedBytes      float64 `json:"usedBytes"`
+}
+
+func (s *NexAgent) k8sNodeName() string {
+	if s.config.Kubernetes.NodeName != "" {
+		return s.config.Kubernetes.NodeName
+	}
+
+	return s.hostName
+}
+
+// containerDockerId returns the docker id of a "docker://<id>" container id.
+func containerDockerId(containerId string) string {
+	idx := strings.Index(containerId, "://")
+	if idx < 0 {
+		return containerId
+	}
+
+	return containerId[idx+3:]
+}
+
+// evictionPercent returns used as a percentage of limit, 0 without a limit.
+func evictionPercent(used, limit float64) float64 {
+	if limit <= 0 {
+		return 0
+	}
+
+	return used / limit * 100
+}
+
+// podEvictionPercent returns the highest share of an ephemeral storage
+// limit of the pod in use: the pod limits, the container limits and the
+// size limits of its emptyDir volumes.
+func podEvictionPercent(pod *corev1.Pod, podUsed float64, containerUsed, volumeUsed map[string]float64) float64 {
+	percent := 0.0
+	podLimit := 0.0
+	for _, container := range pod.Spec.Containers {
+		limit, found := container.Resources.Limits[corev1.ResourceEphemeralStorage]
+		if !found {
+			continue
+		}
+		podLimit += float64(limit.Value())
+		percent = math.Max(percent, evictionPercent(containerUsed[container.Name], float64(limit.Value())))
+	}
+	percent = math.Max(percent, evictionPercent(podUsed, podLimit))
+
+	for _, volume := range pod.Spec.Volumes {
+		if volume.EmptyDir == nil || volume.EmptyDir.SizeLimit == nil {
+			continue
+		}
+		percent = math.Max(percent, evictionPercent(volumeUsed[volume.Name], float64(volume.EmptyDir.SizeLimit.Value())))
+	}
+
+	return percent
+}
+
+func (s *NexAgent) sendEphemeralStorageMetrics(ts *time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			collectLog.Errorf("sendEphemeralStorageMetrics: %v\n", r)
+			s.watchdog.fail(collectorEphemeralStorage, r)
+		}
+	}()
+
+	if s.k8sClientSet == nil {
+		return
+	}
+
+	nodeName := s.k8sNodeName()
+	data, err := s.k8sClientSet.CoreV1().RESTClient().Get().
+		AbsPath("api/v1/nodes", nodeName, "proxy/stats/summary").DoRaw()
+	if err != nil {
+		collectLog.Errorf("Ephemeral: failed to get stats of %s: %v\n", nodeName, err)
+		s.watchdog.fail(collectorEphemeralStorage, err)
+		return
+	}
+
+	var summary statsSummary
+	if err := json.Unmarshal(data, &summary); err != nil {
+		collectLog.Warnf("Ephemeral: invalid stats summary: %v\n", err)
+		s.watchdog.fail(collectorEphemeralStorage, err)
+		return
+	}
+
+	pods, err := s.k8sClientSet.CoreV1().Pods("").List(metav1.ListOptions{
+		FieldSelector: "spec.nodeName=" + nodeName,
+	})
+	if err != nil {
+		collectLog.Errorf("Ephemeral: failed to list pods of %s: %v\n", nodeName, err)
+		s.watchdog.fail(collectorEphemeralStorage, err)
+		return
+	}
+	podMap := make(map[string]*corev1.Pod)
+	for idx := range pods.Items {
+		podMap[string(pods.Items[idx].UID)] = &pods.Items[idx]
+	}
+
+	// the server knows the containers by their docker name
+	dockerStats, err := docker.GetDockerStat()
+	if err != nil {
+		collectLog.Errorf("Ephemeral: failed to list containers: %v\n", err)
+		s.watchdog.fail(collectorEphemeralStorage, err)
+		return
+	}
+	dockerNames := make(map[string]string)
+	for _, dockerStat := range dockerStats {
+		dockerNames[dockerStat.ContainerID] = dockerStat.Name
+	}
+
+	metrics := &pb.Metrics{
+		Metrics: make([]*pb.Metric, 0, 16),
+	}
+
+	nodeFs := summary.Node.Fs
+	if nodeFs.CapacityBytes > 0 {
+		threshold := s.config.EphemeralStorage.EvictionThreshold
+		if threshold <= 0 {
+			threshold = defaultEphemeralEvictionThreshold
+		}
+		usable := nodeFs.CapacityBytes * (1 - threshold/100)
+		label := fmt.Sprintf("host=%s", s.hostName)
+
+		s.appendMetrics(metrics, &BasicMetrics{
+			&BasicMetric{Name: "node_ephemeral_storage_capacity_bytes", Label: label, Type: "gauge",
+				Value: nodeFs.CapacityBytes},
+			&BasicMetric{Name: "node_ephemeral_storage_available_bytes", Label: label, Type: "gauge",
+				Value: nodeFs.AvailableBytes},
+			&BasicMetric{Name: "node_ephemeral_storage_eviction_percent", Label: label, Type: "gauge",
+				Value: evictionPercent(nodeFs.CapacityBytes-nodeFs.AvailableBytes, usable)},
+		}, ephemeralEndpoint, pb.Metric_NODE, s.hostName, 0, ts)
+	}
+
+	for _, podStats := range summary.Pods {
+		pod, found := podMap[podStats.PodRef.UID]
+		if !found {
+			continue
+		}
+
+		containerNames := make(map[string]string)
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.State.Running == nil || status.ContainerID == "" {
+				continue
+			}
+			if dockerName, found := dockerNames[containerDockerId(status.ContainerID)]; found {
+				containerNames[status.Name] = dockerName
+			}
+		}
+		if len(containerNames) == 0 {
+			continue
+		}
+
+		containerUsed := make(map[string]float64)
+		for _, container := range podStats.Containers {
+			containerUsed[container.Name] = container.Rootfs.UsedBytes + container.Logs.UsedBytes
+
+			dockerName, found := containerNames[container.Name]
+			if !found {
+				continue
+			}
+			label := fmt.Sprintf("host=%s,namespace=%s,pod=%s,container=%s",
+				s.hostName, pod.Namespace, pod.Name, container.Name)
+			s.appendMetrics(metrics, &BasicMetrics{
+				&BasicMetric{Name: "container_rootfs_used_bytes", Label: label, Type: "gauge",
+					Value: container.Rootfs.UsedBytes},
+				&BasicMetric{Name: "container_logs_used_bytes", Label: label, Type: "gauge",
+					Value: container.Logs.UsedBytes},
+			}, ephemeralEndpoint, pb.Metric_CONTAINER, dockerName, 0, ts)
+		}
+
+		// the pod totals go to the first running container by name
+		names := make([]string, 0, len(containerNames))
+		for name := range containerNames {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		dockerName := containerNames[names[0]]
+		label := fmt.Sprintf("host=%s,namespace=%s,pod=%s", s.hostName, pod.Namespace, pod.Name)
+
+		emptyDirs := make(map[string]bool)
+		for _, volume := range pod.Spec.Volumes {
+			if volume.EmptyDir != nil && volume.EmptyDir.Medium != corev1.StorageMediumMemory {
+				emptyDirs[volume.Name] = true
+			}
+		}
+		values := BasicMetrics{
+			&BasicMetric{Name: "pod_ephemeral_storage_used_bytes", Label: label, Type: "gauge",
+				Value: podStats.EphemeralStorage.UsedBytes},
+		}
+		volumeUsed := make(map[string]float64)
+		for _, volume := range podStats.Volumes {
+			if !emptyDirs[volume.Name] {
+				continue
+			}
+			volumeUsed[volume.Name] = volume.UsedBytes
+			values = append(values, &BasicMetric{Name: "pod_emptydir_used_bytes",
+				Label: fmt.Sprintf("%s,volume=%s", label, volume.Name), Type: "gauge", Value: volume.UsedBytes})
+		}
+		values = append(values, &BasicMetric{Name: "pod_ephemeral_storage_eviction_percent", Label: label,
+			Type: "gauge", Value: podEvictionPercent(pod, podStats.EphemeralStorage.UsedBytes, containerUsed, volumeUsed)})
+
+		s.appendMetrics(metrics, &values, ephemeralEndpoint, pb.Metric_CONTAINER, dockerName, 0, ts)
+	}
+
+	if len(metrics.Metrics) == 0 {
+		return
+	}
+	if _, err := s.collectorClient.ReportMetrics(s.ctx, metrics); err != nil {
+		collectLog.Errorf("Ephemeral: failed to report metrics: %v\n", err)
+	}
+}
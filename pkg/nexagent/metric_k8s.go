@@ -26,7 +26,6 @@ import (
 	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/client-go/tools/leaderelection/resourcelock"
 	"k8s.io/client-go/transport"
-	"log"
 	"os"
 	"os/signal"
 	"strings"
@@ -223,7 +222,7 @@ func (s *NexAgent) getK8sNodeMetrics(ts *time.Time) ([]*pb.K8SNodeMetric, error)
 func (s *NexAgent) addK8sNodes(cluster *pb.K8SCluster) []*pb.K8SObject {
 	nodes, err := s.k8sClientSet.CoreV1().Nodes().List(metav1.ListOptions{})
 	if err != nil || nodes == nil || nodes.Items == nil {
-		log.Printf("addK8sNodes: failed to get node resources: %v\n", err)
+		k8sLog.Errorf("addK8sNodes: failed to get node resources: %v\n", err)
 		return nil
 	}
 
@@ -257,7 +256,7 @@ func (s *NexAgent) addK8sNodes(cluster *pb.K8SCluster) []*pb.K8SObject {
 func (s *NexAgent) addK8sNamespaces(cluster *pb.K8SCluster) []*pb.K8SNamespace {
 	namespaces, err := s.k8sClientSet.CoreV1().Namespaces().List(metav1.ListOptions{})
 	if err != nil || namespaces == nil || namespaces.Items == nil {
-		log.Printf("addK8sNamespaces: failed to get namespace resources: %v\n", err)
+		k8sLog.Errorf("addK8sNamespaces: failed to get namespace resources: %v\n", err)
 		return nil
 	}
 
@@ -294,31 +293,31 @@ func (s *NexAgent) addK8sNamespaces(cluster *pb.K8SCluster) []*pb.K8SNamespace {
 func (s *NexAgent) addK8sWorkloads(ns *pb.K8SNamespace) ([]*pb.K8SObject, []*pb.K8SPod) {
 	deployments, err := s.k8sClientSet.AppsV1().Deployments(ns.Object.Name).List(metav1.ListOptions{})
 	if err != nil || deployments == nil || deployments.Items == nil {
-		log.Printf("addK8sWorkloads: failed to get deployment resources: %v\n", err)
+		k8sLog.Errorf("addK8sWorkloads: failed to get deployment resources: %v\n", err)
 		return nil, nil
 	}
 
 	rs, err := s.k8sClientSet.AppsV1().ReplicaSets(ns.Object.Name).List(metav1.ListOptions{})
 	if err != nil || rs == nil || rs.Items == nil {
-		log.Printf("addK8sWorkloads: failed to get replicaset resources: %v\n", err)
+		k8sLog.Errorf("addK8sWorkloads: failed to get replicaset resources: %v\n", err)
 		return nil, nil
 	}
 
 	sfs, err := s.k8sClientSet.AppsV1().StatefulSets(ns.Object.Name).List(metav1.ListOptions{})
 	if err != nil || sfs == nil || sfs.Items == nil {
-		log.Printf("addK8sWorkloads: failed to get statefulset resources: %v\n", err)
+		k8sLog.Errorf("addK8sWorkloads: failed to get statefulset resources: %v\n", err)
 		return nil, nil
 	}
 
 	ds, err := s.k8sClientSet.AppsV1().DaemonSets(ns.Object.Name).List(metav1.ListOptions{})
 	if err != nil || ds == nil || ds.Items == nil {
-		log.Printf("addK8sWorkloads: failed to get daemonset resources: %v\n", err)
+		k8sLog.Errorf("addK8sWorkloads: failed to get daemonset resources: %v\n", err)
 		return nil, nil
 	}
 
 	pods, err := s.k8sClientSet.CoreV1().Pods(ns.Object.Name).List(metav1.ListOptions{})
 	if err != nil || pods == nil || pods.Items == nil {
-		log.Printf("addK8sWorkloads: failed to get pod resources: %v\n", err)
+		k8sLog.Errorf("addK8sWorkloads: failed to get pod resources: %v\n", err)
 		return nil, nil
 	}
 
@@ -444,7 +443,7 @@ func (s *NexAgent) addK8sWorkloads(ns *pb.K8SNamespace) ([]*pb.K8SObject, []*pb.
 						containerType = cIDs[0]
 						containerId = cIDs[1]
 					} else {
-						log.Printf("addK8sWorkloads: unknown container id: %v\n", container.ContainerID)
+						k8sLog.Warnf("addK8sWorkloads: unknown container id: %v\n", container.ContainerID)
 						continue
 					}
 				} else {
@@ -490,9 +489,9 @@ func (s *NexAgent) updateK8sCluster() {
 
 	resp, err := s.collectorClient.UpdateK8SCluster(s.ctx, k8sCluster)
 	if err != nil {
-		log.Printf("updateK8sCluster: failed to update kubernetes information: %v\n", err)
+		k8sLog.Errorf("updateK8sCluster: failed to update kubernetes information: %v\n", err)
 	} else if resp.Code != uint32(codes.OK) {
-		log.Printf("updateK8sCluster: failed to update kubernetes information: %v\n", resp.Error)
+		k8sLog.Errorf("updateK8sCluster: failed to update kubernetes information: %v\n", resp.Error)
 	}
 }
 
@@ -550,7 +549,7 @@ func (s *NexAgent) setupLeaseLock() {
 	go func() {
 		<-ch
 
-		log.Printf("setupLeaseLock: received termination, signalling shutdown")
+		k8sLog.Infof("setupLeaseLock: received termination, signalling shutdown")
 		cancel()
 	}()
 
@@ -561,18 +560,18 @@ func (s *NexAgent) setupLeaseLock() {
 		RetryPeriod:   5 * time.Second,
 		Callbacks: leaderelection.LeaderCallbacks{
 			OnStartedLeading: func(ctx context.Context) {
-				log.Printf("%s: leading\n", s.machineId)
+				k8sLog.Infof("%s: leading\n", s.machineId)
 				s.useK8sMetric = true
 			},
 			OnStoppedLeading: func() {
-				log.Printf("%s: lost\n", s.machineId)
+				k8sLog.Infof("%s: lost\n", s.machineId)
 				s.useK8sMetric = false
 			},
 			OnNewLeader: func(identity string) {
 				if identity == s.machineId {
 					return
 				}
-				log.Printf("setupLeaseLock: new leader elected: %v\n", identity)
+				k8sLog.Infof("setupLeaseLock: new leader elected: %v\n", identity)
 			},
 		},
 		ReleaseOnCancel: true,
@@ -581,8 +580,8 @@ func (s *NexAgent) setupLeaseLock() {
 	coordV1 := s.k8sClientSet.CoordinationV1()
 	_, err := coordV1.Leases(s.config.Kubernetes.Namespace).Get(K8sLeaseLockName, metav1.GetOptions{})
 	if err == nil || !strings.Contains(err.Error(), "the leader of agent is shutting down") {
-		log.Fatalf("%s: expected to get an error when trying to make a client call: %v", s.machineId, err)
+		k8sLog.Fatalf("%s: expected to get an error when trying to make a client call: %v", s.machineId, err)
 	}
 
-	log.Printf("%s: done", s.machineId)
+	k8sLog.Infof("%s: done", s.machineId)
 }
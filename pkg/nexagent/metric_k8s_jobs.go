@@ -0,0 +1,195 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sync"
+	"time"
+)
+
+// The agent leading the cluster follows the Jobs and CronJobs. A Job is
+// counted once when it finishes, as succeeded or failed with its
+// duration, under its CronJob if it has one. For every CronJob the time
+// since its last successful Job is reported; the last success is the
+// latest completion of the Jobs it kept, or its creation while none
+// succeeded, so a CronJob that never succeeds ages like one that stopped
+// succeeding.
+
+const (
+	k8sJobsEndpoint = "/k8s/jobs"
+	k8sJobsInterval = time.Minute
+)
+
+type K8sJobState struct {
+	sync.Mutex
+
+	running bool
+	lastRun time.Time
+	// finished holds the Jobs already counted, with the last time they
+	// were listed
+	finished map[string]time.Time
+}
+
+// jobOwner returns the label of the CronJob owning the job, or of the job.
+func jobOwner(job *batchv1.Job) string {
+	for _, owner := range job.OwnerReferences {
+		if owner.Kind == "CronJob" {
+			return fmt.Sprintf("namespace=%s,cronjob=%s", job.Namespace, owner.Name)
+		}
+	}
+
+	return fmt.Sprintf("namespace=%s,job=%s", job.Namespace, job.Name)
+}
+
+// jobFinished returns whether the job completed or failed, and when.
+func jobFinished(job *batchv1.Job) (bool, bool, time.Time) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return true, true, condition.LastTransitionTime.Time
+		case batchv1.JobFailed:
+			return true, false, condition.LastTransitionTime.Time
+		}
+	}
+
+	return false, false, time.Time{}
+}
+
+func (s *NexAgent) sendK8sJobMetrics(ts *time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			k8sLog.Errorf("sendK8sJobMetrics: %v\n", r)
+			s.watchdog.fail(collectorK8sJobs, r)
+		}
+	}()
+
+	state := &s.k8sJobs
+	state.Lock()
+	if state.running || ts.Sub(state.lastRun) < k8sJobsInterval {
+		state.Unlock()
+		return
+	}
+	if state.finished == nil {
+		state.finished = make(map[string]time.Time)
+	}
+	firstRun := state.lastRun.IsZero()
+	state.running = true
+	state.lastRun = *ts
+	state.Unlock()
+
+	defer func() {
+		state.Lock()
+		state.running = false
+		state.Unlock()
+	}()
+
+	jobs, err := s.k8sClientSet.BatchV1().Jobs("").List(metav1.ListOptions{})
+	if err != nil {
+		k8sLog.Errorf("K8sJobs: failed to list jobs: %v\n", err)
+		s.watchdog.fail(collectorK8sJobs, err)
+		return
+	}
+	cronJobs, err := s.k8sClientSet.BatchV1beta1().CronJobs("").List(metav1.ListOptions{})
+	if err != nil {
+		k8sLog.Errorf("K8sJobs: failed to list cronjobs: %v\n", err)
+		s.watchdog.fail(collectorK8sJobs, err)
+		return
+	}
+
+	values := make(BasicMetrics, 0, 4*len(cronJobs.Items))
+	lastSuccess := make(map[string]time.Time)
+	for idx := range jobs.Items {
+		job := &jobs.Items[idx]
+		finished, succeeded, finishedTs := jobFinished(job)
+		if !finished {
+			continue
+		}
+
+		owner := jobOwner(job)
+		if succeeded && finishedTs.After(lastSuccess[owner]) {
+			lastSuccess[owner] = finishedTs
+		}
+
+		key := string(job.UID)
+		_, counted := state.finished[key]
+		state.finished[key] = *ts
+		// the jobs finished before the agent started are not news
+		if counted || firstRun {
+			continue
+		}
+
+		result := 0.0
+		if succeeded {
+			result = 1
+		}
+		values = append(values,
+			&BasicMetric{Name: "k8s_job_succeeded", Label: owner, Type: "gauge", Value: result},
+			&BasicMetric{Name: "k8s_job_failed", Label: owner, Type: "gauge", Value: 1 - result})
+		if job.Status.StartTime != nil {
+			values = append(values, &BasicMetric{Name: "k8s_job_duration_seconds", Label: owner, Type: "gauge",
+				Value: finishedTs.Sub(job.Status.StartTime.Time).Seconds()})
+		}
+	}
+
+	for key, listedTs := range state.finished {
+		if listedTs.Before(*ts) {
+			delete(state.finished, key)
+		}
+	}
+
+	for _, cronJob := range cronJobs.Items {
+		label := fmt.Sprintf("namespace=%s,cronjob=%s", cronJob.Namespace, cronJob.Name)
+
+		success, found := lastSuccess[label]
+		if !found {
+			success = cronJob.CreationTimestamp.Time
+		}
+		suspended := 0.0
+		if cronJob.Spec.Suspend != nil && *cronJob.Spec.Suspend {
+			suspended = 1
+		}
+
+		values = append(values,
+			&BasicMetric{Name: "k8s_cronjob_since_success_seconds", Label: label, Type: "gauge",
+				Value: ts.Sub(success).Seconds()},
+			&BasicMetric{Name: "k8s_cronjob_active", Label: label, Type: "gauge",
+				Value: float64(len(cronJob.Status.Active))},
+			&BasicMetric{Name: "k8s_cronjob_suspended", Label: label, Type: "gauge", Value: suspended})
+	}
+
+	if len(values) == 0 {
+		return
+	}
+
+	metrics := &pb.Metrics{
+		Metrics: make([]*pb.Metric, 0, len(values)),
+	}
+	s.appendMetrics(metrics, &values, k8sJobsEndpoint, pb.Metric_NODE, s.hostName, 0, ts)
+
+	if _, err := s.collectorClient.ReportMetrics(s.ctx, metrics); err != nil {
+		k8sLog.Errorf("K8sJobs: failed to report metrics: %v\n", err)
+		s.watchdog.fail(collectorK8sJobs, err)
+	}
+}
@@ -0,0 +1,286 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The agent leading the cluster derives how long pods wait for the
+// scheduler, from their creation to their PodScheduled condition, and how
+// long image pulls take, from the Pulled events of the kubelet. Every pod
+// and pull is counted once, in the run after it happened; what happened
+// before the agent started is left out so a restart does not report old
+// pods as a burst. The results are reported per namespace, the pulls also
+// per registry, as the average, the maximum and the count of the run.
+
+const (
+	k8sLatencyEndpoint = "/k8s/latency"
+	k8sLatencyInterval = time.Minute
+	k8sLatencySeenTTL  = 2 * time.Hour
+	defaultRegistry    = "docker.io"
+)
+
+var (
+	// pulledPattern matches `Successfully pulled image "x" in 1.2s`
+	pulledPattern = regexp.MustCompile(`pulled image "([^"]+)" in ([0-9.]+[a-zµ]+)`)
+	imagePattern  = regexp.MustCompile(`image "([^"]+)"`)
+)
+
+type K8sLatencyState struct {
+	sync.Mutex
+
+	running   bool
+	lastRun   time.Time
+	startedAt time.Time
+	// seen holds the pods and events already counted, with the last time
+	// they were listed so they are forgotten k8sLatencySeenTTL after they
+	// are gone
+	seen map[string]time.Time
+}
+
+type latencySample struct {
+	sum   float64
+	max   float64
+	count int
+}
+
+func (l *latencySample) add(value float64) {
+	l.sum += value
+	if value > l.max {
+		l.max = value
+	}
+	l.count++
+}
+
+// imageRegistry returns the registry host of an image reference.
+func imageRegistry(image string) string {
+	idx := strings.IndexByte(image, '/')
+	if idx < 0 {
+		return defaultRegistry
+	}
+
+	host := image[:idx]
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return host
+	}
+
+	return defaultRegistry
+}
+
+// pullDuration returns the image and the pull duration of a Pulled event,
+// ok is false for an image already present on the node.
+func pullDuration(event *corev1.Event, pulling map[string]time.Time) (string, time.Duration, bool) {
+	if strings.Contains(event.Message, "already present") {
+		return "", 0, false
+	}
+	if match := pulledPattern.FindStringSubmatch(event.Message); match != nil {
+		duration, err := time.ParseDuration(match[2])
+		if err == nil {
+			return match[1], duration, true
+		}
+	}
+
+	// older kubelets do not tell the duration, the Pulling event of the
+	// same container started it
+	start, found := pulling[string(event.InvolvedObject.UID)+event.InvolvedObject.FieldPath]
+	if !found {
+		return "", 0, false
+	}
+	match := imagePattern.FindStringSubmatch(event.Message)
+	if match == nil {
+		return "", 0, false
+	}
+
+	return match[1], event.LastTimestamp.Sub(start), true
+}
+
+func (s *NexAgent) sendK8sLatencyMetrics(ts *time.Time) {
+	defer func() {
+		if r := recover(); r != nil {
+			k8sLog.Errorf("sendK8sLatencyMetrics: %v\n", r)
+			s.watchdog.fail(collectorK8sLatency, r)
+		}
+	}()
+
+	state := &s.k8sLatency
+	state.Lock()
+	if state.running || ts.Sub(state.lastRun) < k8sLatencyInterval {
+		state.Unlock()
+		return
+	}
+	if state.seen == nil {
+		state.seen = make(map[string]time.Time)
+		state.startedAt = *ts
+	}
+	state.running = true
+	state.lastRun = *ts
+	state.Unlock()
+
+	defer func() {
+		state.Lock()
+		state.running = false
+		state.Unlock()
+	}()
+
+	scheduling := s.podSchedulingLatency(state, ts)
+	pulls := s.imagePullLatency(state, ts)
+
+	for key, seenTs := range state.seen {
+		if ts.Sub(seenTs) > k8sLatencySeenTTL {
+			delete(state.seen, key)
+		}
+	}
+
+	values := make(BasicMetrics, 0, 3*(len(scheduling)+len(pulls)))
+	appendSample := func(name, label string, sample *latencySample) {
+		values = append(values,
+			&BasicMetric{Name: name + "_avg", Label: label, Type: "gauge", Value: sample.sum / float64(sample.count)},
+			&BasicMetric{Name: name + "_max", Label: label, Type: "gauge", Value: sample.max},
+			&BasicMetric{Name: name + "_count", Label: label, Type: "gauge", Value: float64(sample.count)})
+	}
+
+	keys := make([]string, 0, len(scheduling))
+	for namespace := range scheduling {
+		keys = append(keys, namespace)
+	}
+	sort.Strings(keys)
+	for _, namespace := range keys {
+		appendSample("k8s_pod_scheduling_seconds", fmt.Sprintf("namespace=%s", namespace), scheduling[namespace])
+	}
+
+	keys = keys[:0]
+	for label := range pulls {
+		keys = append(keys, label)
+	}
+	sort.Strings(keys)
+	for _, label := range keys {
+		appendSample("k8s_image_pull_seconds", label, pulls[label])
+	}
+
+	if len(values) == 0 {
+		return
+	}
+
+	metrics := &pb.Metrics{
+		Metrics: make([]*pb.Metric, 0, len(values)),
+	}
+	s.appendMetrics(metrics, &values, k8sLatencyEndpoint, pb.Metric_NODE, s.hostName, 0, ts)
+
+	if _, err := s.collectorClient.ReportMetrics(s.ctx, metrics); err != nil {
+		k8sLog.Errorf("K8sLatency: failed to report metrics: %v\n", err)
+		s.watchdog.fail(collectorK8sLatency, err)
+	}
+}
+
+// podSchedulingLatency returns the scheduling latency of the pods
+// scheduled since the last run, per namespace.
+func (s *NexAgent) podSchedulingLatency(state *K8sLatencyState, ts *time.Time) map[string]*latencySample {
+	pods, err := s.k8sClientSet.CoreV1().Pods("").List(metav1.ListOptions{})
+	if err != nil {
+		k8sLog.Errorf("K8sLatency: failed to list pods: %v\n", err)
+		return nil
+	}
+
+	samples := make(map[string]*latencySample)
+	for idx := range pods.Items {
+		pod := &pods.Items[idx]
+		key := "pod/" + string(pod.UID)
+		if _, found := state.seen[key]; found {
+			state.seen[key] = *ts
+			continue
+		}
+
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type != corev1.PodScheduled || condition.Status != corev1.ConditionTrue {
+				continue
+			}
+
+			state.seen[key] = *ts
+			if condition.LastTransitionTime.Time.Before(state.startedAt) {
+				break
+			}
+
+			sample, found := samples[pod.Namespace]
+			if !found {
+				sample = &latencySample{}
+				samples[pod.Namespace] = sample
+			}
+			sample.add(condition.LastTransitionTime.Sub(pod.CreationTimestamp.Time).Seconds())
+			break
+		}
+	}
+
+	return samples
+}
+
+// imagePullLatency returns the duration of the image pulls finished since
+// the last run, per namespace and registry label.
+func (s *NexAgent) imagePullLatency(state *K8sLatencyState, ts *time.Time) map[string]*latencySample {
+	pulled, err := s.k8sClientSet.CoreV1().Events("").List(metav1.ListOptions{FieldSelector: "reason=Pulled"})
+	if err != nil {
+		k8sLog.Errorf("K8sLatency: failed to list events: %v\n", err)
+		return nil
+	}
+	if len(pulled.Items) == 0 {
+		return nil
+	}
+
+	pulling := make(map[string]time.Time)
+	if events, err := s.k8sClientSet.CoreV1().Events("").List(metav1.ListOptions{FieldSelector: "reason=Pulling"}); err == nil {
+		for _, event := range events.Items {
+			pulling[string(event.InvolvedObject.UID)+event.InvolvedObject.FieldPath] = event.LastTimestamp.Time
+		}
+	}
+
+	samples := make(map[string]*latencySample)
+	for idx := range pulled.Items {
+		event := &pulled.Items[idx]
+		key := fmt.Sprintf("event/%s/%d", event.UID, event.Count)
+		if _, found := state.seen[key]; found {
+			state.seen[key] = *ts
+			continue
+		}
+		state.seen[key] = *ts
+		if event.LastTimestamp.Time.Before(state.startedAt) {
+			continue
+		}
+
+		image, duration, ok := pullDuration(event, pulling)
+		if !ok || duration < 0 {
+			continue
+		}
+
+		label := fmt.Sprintf("namespace=%s,registry=%s", event.InvolvedObject.Namespace, imageRegistry(image))
+		sample, found := samples[label]
+		if !found {
+			sample = &latencySample{}
+			samples[label] = sample
+		}
+		sample.add(duration.Seconds())
+	}
+
+	return samples
+}
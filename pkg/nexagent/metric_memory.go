@@ -0,0 +1,136 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"bufio"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/shirou/gopsutil/mem"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A used-percent alone does not tell a full page cache from a node that
+// thrashes, so the swap traffic and page faults of /proc/vmstat are
+// reported as counters and as per-second rates between two collections,
+// the rates from the second collection on, with the swap and hugepage
+// usage.
+
+const vmstatPath = "/proc/vmstat"
+
+// vmstatCounters are the /proc/vmstat fields reported, swap counts in pages
+var vmstatCounters = map[string]string{
+	"pswpin":     "node_memory_swap_in",
+	"pswpout":    "node_memory_swap_out",
+	"pgfault":    "node_memory_page_faults",
+	"pgmajfault": "node_memory_major_page_faults",
+}
+
+type MemorySampleState struct {
+	sync.Mutex
+
+	last   map[string]float64
+	lastTs time.Time
+}
+
+func readVmstat() (map[string]float64, error) {
+	file, err := os.Open(vmstatPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if _, found := vmstatCounters[fields[0]]; !found {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		values[fields[0]] = value
+	}
+
+	return values, scanner.Err()
+}
+
+func (s *NexAgent) addNodeMemoryPressureMetric(metrics *pb.Metrics, ts *time.Time) *pb.Metrics {
+	label := fmt.Sprintf("host=%s", s.hostName)
+	values := make(BasicMetrics, 0, 16)
+
+	if swap, err := mem.SwapMemory(); err == nil {
+		values = append(values,
+			&BasicMetric{Name: "node_memory_swap_total", Label: label, Type: "gauge", Value: float64(swap.Total)},
+			&BasicMetric{Name: "node_memory_swap_used", Label: label, Type: "gauge", Value: float64(swap.Used)},
+			&BasicMetric{Name: "node_memory_swap_used_percent", Label: label, Type: "gauge", Value: swap.UsedPercent})
+	}
+
+	if s.hostInfo.OS == "linux" {
+		if vMemStat, err := mem.VirtualMemory(); err == nil && vMemStat.HugePagesTotal > 0 {
+			used := vMemStat.HugePagesTotal - vMemStat.HugePagesFree
+			values = append(values,
+				&BasicMetric{Name: "node_memory_hugepages_total", Label: label, Type: "gauge", Value: float64(vMemStat.HugePagesTotal)},
+				&BasicMetric{Name: "node_memory_hugepages_free", Label: label, Type: "gauge", Value: float64(vMemStat.HugePagesFree)},
+				&BasicMetric{Name: "node_memory_hugepages_used_bytes", Label: label, Type: "gauge",
+					Value: float64(used * vMemStat.HugePageSize)})
+		}
+	}
+
+	if vmstat, err := readVmstat(); err == nil {
+		state := &s.memorySamples
+		state.Lock()
+		elapsed := ts.Sub(state.lastTs).Seconds()
+		for field, value := range vmstat {
+			name := vmstatCounters[field]
+			if field == "pswpin" || field == "pswpout" {
+				name += "_bytes"
+				value *= float64(os.Getpagesize())
+				vmstat[field] = value
+			}
+			values = append(values, &BasicMetric{Name: name + "_total", Label: label, Type: "counter", Value: value})
+
+			prev, found := state.last[field]
+			if !found || elapsed <= 0 || value < prev {
+				continue
+			}
+			values = append(values, &BasicMetric{
+				Name:  name + "_per_second",
+				Label: label,
+				Type:  "gauge",
+				Value: (value - prev) / elapsed,
+			})
+		}
+		state.last = vmstat
+		state.lastTs = *ts
+		state.Unlock()
+	}
+
+	s.appendMetrics(metrics, &values, "/node/metrics", pb.Metric_NODE, s.hostName, 0, ts)
+
+	return metrics
+}
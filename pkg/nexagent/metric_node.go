@@ -24,7 +24,6 @@ import (
 	"github.com/shirou/gopsutil/load"
 	"github.com/shirou/gopsutil/mem"
 	"github.com/shirou/gopsutil/net"
-	"log"
 	"strings"
 	"time"
 )
@@ -32,7 +31,7 @@ import (
 func (s *NexAgent) addNodeLoadMetric(metrics *pb.Metrics, ts *time.Time) *pb.Metrics {
 	avgStat, err := load.Avg()
 	if err != nil {
-		log.Printf("addNodeLoadMetric: failed get load average stat: %v\n", err)
+		collectLog.Errorf("addNodeLoadMetric: failed get load average stat: %v\n", err)
 		return nil
 	}
 
@@ -60,7 +59,7 @@ func (s *NexAgent) addNodeLoadMetric(metrics *pb.Metrics, ts *time.Time) *pb.Met
 
 	s.appendMetrics(metrics, &loadMetrics, "/node/metrics", pb.Metric_NODE, s.hostName, 0, ts)
 
-	//log.Printf("Load Avg. load1: %v, load5: %v, load15: %v\n",
+	//collectLog.Infof("Load Avg. load1: %v, load5: %v, load15: %v\n",
 	//	avgStat.Load1, avgStat.Load5, avgStat.Load15)
 
 	return metrics
@@ -99,11 +98,28 @@ func (s *NexAgent) addNodeCpuMetric(metrics *pb.Metrics, ts *time.Time) *pb.Metr
 				Type:  "gauge",
 				Value: cpuStat.Iowait,
 			},
+			&BasicMetric{
+				Name:  "node_cpu_steal",
+				Label: label,
+				Type:  "gauge",
+				Value: cpuStat.Steal,
+			},
 		}
 
 		s.appendMetrics(metrics, &cpuMetrics, "/node/metrics", pb.Metric_NODE, s.hostName, 0, ts)
 	}
 
+	if cores, err := cpu.Counts(true); err == nil {
+		coreMetric := &BasicMetric{
+			Name:  "node_cpu_cores",
+			Label: fmt.Sprintf("host=%s", s.hostName),
+			Type:  "gauge",
+			Value: float64(cores),
+		}
+
+		s.appendMetric(metrics, coreMetric, "/node/metrics", pb.Metric_NODE, s.hostName, 0, ts)
+	}
+
 	return metrics
 }
 
@@ -321,7 +337,8 @@ func (s *NexAgent) IsNetDevice(deviceName string) bool {
 func (s *NexAgent) sendNodeMetrics(ts *time.Time) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("sendNodeMetrics: %v\n", r)
+			collectLog.Errorf("sendNodeMetrics: %v\n", r)
+			s.watchdog.fail(collectorNode, r)
 		}
 	}()
 
@@ -332,11 +349,15 @@ func (s *NexAgent) sendNodeMetrics(ts *time.Time) {
 	s.addNodeLoadMetric(metrics, ts)
 	s.addNodeCpuMetric(metrics, ts)
 	s.addNodeMemoryMetric(metrics, ts)
+	s.addNodeMemoryPressureMetric(metrics, ts)
 	s.addNodeDiskMetric(metrics, ts)
 	s.addNodeNetMetric(metrics, ts)
+	s.addNodeCpuCoreMetric(metrics, ts)
+	s.addNodeNumaMetric(metrics, ts)
 
 	_, err := s.collectorClient.ReportMetrics(s.ctx, metrics)
 	if err != nil {
-		log.Printf("Failed sendMetrics(): %v\n", err)
+		collectLog.Errorf("Failed sendMetrics(): %v\n", err)
+		s.watchdog.fail(collectorNode, err)
 	}
 }
@@ -0,0 +1,158 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The traffic of a container is read from /proc/<pid>/net/dev of a
+// process in its cgroup, which shows the interfaces of its network
+// namespace. The containers of a pod share one namespace, and the pod
+// query sums its containers, so the counters are reported on a single
+// container per namespace, preferably not the sandbox (pause) container
+// which has no Kubernetes container linking it to the pod. Containers on
+// the host network are skipped, their counters are the node interfaces.
+
+const (
+	dockerMemoryCgroup = "/sys/fs/cgroup/memory/docker"
+	sandboxPrefix      = "k8s_POD_"
+)
+
+type netDevStat struct {
+	rxBytes   float64
+	rxDropped float64
+	txBytes   float64
+	txDropped float64
+}
+
+// cgroupPid returns a process of the cgroup.
+func cgroupPid(cgroupPath string) (int, error) {
+	data, err := ioutil.ReadFile(path.Join(cgroupPath, "cgroup.procs"))
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("no process in %s", cgroupPath)
+	}
+
+	return strconv.Atoi(fields[0])
+}
+
+func netNamespace(pid string) (string, error) {
+	return os.Readlink(path.Join("/proc", pid, "ns", "net"))
+}
+
+// readNetDev sums the interfaces of /proc/<pid>/net/dev but the loopback.
+func readNetDev(pid int) (*netDevStat, error) {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/net/dev", pid))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stat := &netDevStat{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		idx := strings.IndexByte(scanner.Text(), ':')
+		if idx < 0 {
+			continue
+		}
+		if strings.TrimSpace(scanner.Text()[:idx]) == "lo" {
+			continue
+		}
+
+		// receive: bytes packets errs drop ..., transmit from the 9th field
+		fields := strings.Fields(scanner.Text()[idx+1:])
+		if len(fields) < 12 {
+			continue
+		}
+		values := make([]float64, 12)
+		for i := range values {
+			values[i], _ = strconv.ParseFloat(fields[i], 64)
+		}
+		stat.rxBytes += values[0]
+		stat.rxDropped += values[3]
+		stat.txBytes += values[8]
+		stat.txDropped += values[11]
+	}
+
+	return stat, scanner.Err()
+}
+
+// addContainerNetworkMetrics adds the network counters to the metrics of
+// one container per network namespace.
+func (s *NexAgent) addContainerNetworkMetrics(containerInfoMap map[string]*ContainerInfo,
+	metricsMap map[string]*BasicMetrics) {
+	hostNamespace, err := netNamespace("1")
+	if err != nil {
+		return
+	}
+
+	containerIds := make([]string, 0, len(containerInfoMap))
+	for cID := range containerInfoMap {
+		containerIds = append(containerIds, cID)
+	}
+	sort.Slice(containerIds, func(i, j int) bool {
+		iSandbox := strings.HasPrefix(containerInfoMap[containerIds[i]].dockerStat.Name, sandboxPrefix)
+		jSandbox := strings.HasPrefix(containerInfoMap[containerIds[j]].dockerStat.Name, sandboxPrefix)
+		if iSandbox != jSandbox {
+			return jSandbox
+		}
+		return containerIds[i] < containerIds[j]
+	})
+
+	namespaces := make(map[string]bool)
+	for _, cID := range containerIds {
+		containerInfo := containerInfoMap[cID]
+		metrics, found := metricsMap[cID]
+		if !found || containerInfo.cgroupPath == "" {
+			continue
+		}
+
+		pid, err := cgroupPid(containerInfo.cgroupPath)
+		if err != nil {
+			continue
+		}
+		namespace, err := netNamespace(strconv.Itoa(pid))
+		if err != nil || namespace == hostNamespace || namespaces[namespace] {
+			continue
+		}
+		namespaces[namespace] = true
+
+		stat, err := readNetDev(pid)
+		if err != nil {
+			continue
+		}
+
+		label := fmt.Sprintf("host=%s,container=%s", s.hostName, containerInfo.dockerStat.Name)
+		*metrics = append(*metrics,
+			&BasicMetric{Name: "container_network_rx_bytes_total", Label: label, Type: "counter", Value: stat.rxBytes},
+			&BasicMetric{Name: "container_network_tx_bytes_total", Label: label, Type: "counter", Value: stat.txBytes},
+			&BasicMetric{Name: "container_network_rx_dropped_total", Label: label, Type: "counter", Value: stat.rxDropped},
+			&BasicMetric{Name: "container_network_tx_dropped_total", Label: label, Type: "counter", Value: stat.txDropped})
+	}
+}
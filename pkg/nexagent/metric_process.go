@@ -20,16 +20,45 @@ import (
 	"fmt"
 	pb "github.com/NexClipper/NexClipper/api"
 	"github.com/shirou/gopsutil/cpu"
-	"log"
 	"strings"
 
 	"github.com/shirou/gopsutil/process"
 	"time"
 )
 
+// ProcessFlags are the failure signatures of a process: a binary deleted
+// or replaced on disk while running (a restart was missed after an
+// upgrade), a zombie never reaped by its parent, and the uninterruptible
+// sleep (D state) of a process stuck on I/O.
+type ProcessFlags struct {
+	DeletedBinary   bool
+	Zombie          bool
+	Uninterruptible bool
+}
+
+func (flags *ProcessFlags) any() bool {
+	return flags.DeletedBinary || flags.Zombie || flags.Uninterruptible
+}
+
+func processFlags(ps *process.Process) ProcessFlags {
+	var flags ProcessFlags
+
+	if status, err := ps.Status(); err == nil {
+		flags.Zombie = status == "Z"
+		flags.Uninterruptible = status == "D"
+	}
+	if !flags.Zombie {
+		if exe, err := ps.Exe(); err == nil {
+			flags.DeletedBinary = strings.HasSuffix(exe, " (deleted)")
+		}
+	}
+
+	return flags
+}
+
 func (s *NexAgent) isScrapeProcess(
 	ps *process.Process, mem *process.MemoryInfoStat,
-	cpuPercent float64, memPercent float32, cpuTimes *cpu.TimesStat) bool {
+	cpuPercent float64, memPercent float32, cpuTimes *cpu.TimesStat, flagged bool) bool {
 
 	name, err := ps.Name()
 	if err != nil {
@@ -47,15 +76,18 @@ func (s *NexAgent) isScrapeProcess(
 		}
 	}
 
-	if cpuPercent < 0.1 {
-		return false
-	}
-	if memPercent < 0.1 {
-		return false
-	}
+	// flagged processes are reported whatever their load
+	if !flagged {
+		if cpuPercent < 0.1 {
+			return false
+		}
+		if memPercent < 0.1 {
+			return false
+		}
 
-	if mem.RSS == 0 || mem.VMS == 0 {
-		return false
+		if mem.RSS == 0 || mem.VMS == 0 {
+			return false
+		}
 	}
 
 	s.processInfoMap[ps.Pid] = &ProcessInfo{
@@ -93,23 +125,33 @@ func (s *NexAgent) calculateProcessLoad(ps *process.Process, now *time.Time) (fl
 func (s *NexAgent) sendProcessMetrics(ts *time.Time) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("sendProcessMetrics: %v\n", r)
+			collectLog.Errorf("sendProcessMetrics: %v\n", r)
+			s.watchdog.fail(collectorProcess, r)
 		}
 	}()
 	s.clearProcessUpdateFlag()
 
 	psInfoAll, err := process.Processes()
 	if err != nil {
-		log.Printf("Failed to get process information: %v\n", err)
+		collectLog.Errorf("Failed to get process information: %v\n", err)
+		s.watchdog.fail(collectorProcess, err)
 		return
 	}
 
+	var zombies, uninterruptible, deletedBinaries float64
+
 	processes := make([]*pb.Process, 0, len(psInfoAll))
 	for _, psInfo := range psInfoAll {
 		name, err := psInfo.Name()
 		if err != nil {
 			continue
 		}
+
+		flags := processFlags(psInfo)
+		zombies += boolValue(flags.Zombie)
+		uninterruptible += boolValue(flags.Uninterruptible)
+		deletedBinaries += boolValue(flags.DeletedBinary)
+
 		memInfo, err := psInfo.MemoryInfo()
 		if err != nil {
 			continue
@@ -128,7 +170,7 @@ func (s *NexAgent) sendProcessMetrics(ts *time.Time) {
 			continue
 		}
 
-		if !s.isScrapeProcess(psInfo, memInfo, cpuPercent, memPercent, cpuTimes) {
+		if !s.isScrapeProcess(psInfo, memInfo, cpuPercent, memPercent, cpuTimes, flags.any()) {
 			continue
 		}
 
@@ -208,6 +250,24 @@ func (s *NexAgent) sendProcessMetrics(ts *time.Time) {
 				Type:  "gauge",
 				Value: float64(memInfo.Swap),
 			},
+			&BasicMetric{
+				Name:  "process_deleted_binary",
+				Label: label,
+				Type:  "gauge",
+				Value: boolValue(flags.DeletedBinary),
+			},
+			&BasicMetric{
+				Name:  "process_zombie",
+				Label: label,
+				Type:  "gauge",
+				Value: boolValue(flags.Zombie),
+			},
+			&BasicMetric{
+				Name:  "process_uninterruptible",
+				Label: label,
+				Type:  "gauge",
+				Value: boolValue(flags.Uninterruptible),
+			},
 		}
 
 		var netMetrics *BasicMetrics
@@ -241,7 +301,7 @@ func (s *NexAgent) sendProcessMetrics(ts *time.Time) {
 				},
 			}
 		} else {
-			log.Printf("failed to get io counter metric: %v\n", err)
+			collectLog.Errorf("failed to get io counter metric: %v\n", err)
 		}
 
 		s.appendMetrics(processMetrics, metrics,
@@ -258,6 +318,20 @@ func (s *NexAgent) sendProcessMetrics(ts *time.Time) {
 		})
 	}
 
+	nodeLabel := fmt.Sprintf("host=%s", s.hostName)
+	nodeMetrics := &pb.Metrics{
+		Metrics: make([]*pb.Metric, 0, 3),
+	}
+	s.appendMetrics(nodeMetrics, &BasicMetrics{
+		&BasicMetric{Name: "node_processes_zombie", Label: nodeLabel, Type: "gauge", Value: zombies},
+		&BasicMetric{Name: "node_processes_uninterruptible", Label: nodeLabel, Type: "gauge", Value: uninterruptible},
+		&BasicMetric{Name: "node_processes_deleted_binary", Label: nodeLabel, Type: "gauge", Value: deletedBinaries},
+	}, "/node/processes", pb.Metric_NODE, "", 0, ts)
+	if _, err := s.collectorClient.ReportMetrics(s.ctx, nodeMetrics); err != nil {
+		collectLog.Errorf("sendProcessMetrics: failed to report process states: %v\n", err)
+		s.watchdog.fail(collectorProcess, err)
+	}
+
 	processAll := &pb.ProcessAll{
 		Cluster:   s.config.Agent.Cluster,
 		Host:      s.hostName,
@@ -268,9 +342,10 @@ func (s *NexAgent) sendProcessMetrics(ts *time.Time) {
 
 	resp, err := s.collectorClient.UpdateProcess(s.ctx, processAll)
 	if err != nil {
-		log.Printf("sendProcessMetrics: failed to send: %v\n", err)
+		collectLog.Errorf("sendProcessMetrics: failed to send: %v\n", err)
+		s.watchdog.fail(collectorProcess, err)
 	}
 	if !resp.Success {
-		log.Printf("sendProcessMetrics: response: %v\n", err)
+		collectLog.Warnf("sendProcessMetrics: response: %v\n", err)
 	}
 }
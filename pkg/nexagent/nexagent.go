@@ -20,12 +20,14 @@ import (
 	"context"
 	"fmt"
 	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/NexClipper/NexClipper/pkg/nexcrypto"
 	"github.com/denisbrodbeck/machineid"
 	"github.com/shirou/gopsutil/cpu"
 	"github.com/shirou/gopsutil/host"
 	_ "github.com/shirou/gopsutil/net"
 	"github.com/shirou/gopsutil/process"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
 	"io"
@@ -35,10 +37,11 @@ import (
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/client-go/util/homedir"
-	"log"
 	"os"
 	"path/filepath"
 	"sigs.k8s.io/yaml"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -63,15 +66,21 @@ type NexAgent struct {
 	ctx  context.Context
 	conn *grpc.ClientConn
 
+	redirectAddress string
+
 	uuid      string
 	nodeId    string
 	machineId string
+	secret    string
 
 	collectorClient pb.CollectorClient
 
 	reportInterval       time.Duration
 	updateStatusInterval time.Duration
 
+	disableProcessMetrics   bool
+	disableContainerMetrics bool
+
 	useK8sMetric bool
 	k8sClientSet *kubernetes.Clientset
 
@@ -80,13 +89,30 @@ type NexAgent struct {
 
 	k8sConfig *rest.Config
 	hostInfo  *host.InfoStat
+
+	tails    map[string]chan struct{}
+	tailLock sync.Mutex
+
+	authLog       AuthLogState
+	kernelLog     KernelLogState
+	cpuSamples    CpuSampleState
+	memorySamples MemorySampleState
+	ioProbe       IOProbeState
+	k8sLatency    K8sLatencyState
+	k8sJobs       K8sJobState
+	k8sResources  K8sResourceState
+	watchdog      Watchdog
+
+	// protocol is the version negotiated with the server
+	protocol int
 }
 
 type AgentConfig struct {
-	Cluster        string
-	ServerAddress  string
-	ReportInterval int
-	ApiPort        int
+	Cluster         string
+	EnrollmentToken string
+	ServerAddress   string
+	ReportInterval  int
+	ApiPort         int
 }
 
 type TLSConfig struct {
@@ -95,15 +121,39 @@ type TLSConfig struct {
 	KeyFile  string
 }
 
+type CryptoConfig struct {
+	Strict bool
+}
+
 type KubernetesConfig struct {
 	ClusterName string
 	Namespace   string
+	NodeName    string
+}
+
+type ProfilingEndpoint struct {
+	Name    string
+	Address string
+}
+
+type ProfilingConfig struct {
+	Endpoints []ProfilingEndpoint
 }
 
 type Config struct {
 	Agent      AgentConfig
 	TLS        TLSConfig
+	Crypto     CryptoConfig
 	Kubernetes KubernetesConfig
+	Profiling  ProfilingConfig
+	AuthLog    AuthLogConfig
+	KernelLog  KernelLogConfig
+	IOProbe    IOProbeConfig
+	MeshProbe  MeshProbeConfig
+
+	EphemeralStorage EphemeralStorageConfig
+	K8sResource      K8sResourceConfig
+	Log              LogConfig
 }
 
 type ProcessInfo struct {
@@ -122,14 +172,39 @@ type BasicMetric struct {
 
 type BasicMetrics []*BasicMetric
 
+// transportOption verifies the server with the configured CA bundle when
+// TLS is enabled.
+func (s *NexAgent) transportOption() (grpc.DialOption, error) {
+	if !s.config.TLS.Use {
+		if nexcrypto.Strict() {
+			return nil, fmt.Errorf("strict crypto mode requires TLS")
+		}
+		return grpc.WithInsecure(), nil
+	}
+
+	config, err := nexcrypto.ClientTLSConfig(s.config.TLS.CertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return grpc.WithTransportCredentials(credentials.NewTLS(config)), nil
+}
+
 func (s *NexAgent) connectServer() (*grpc.ClientConn, error) {
+	transport, err := s.transportOption()
+	if err != nil {
+		return nil, err
+	}
+
 	conn, err := grpc.Dial(
-		s.config.Agent.ServerAddress,
-		grpc.WithInsecure(),
+		s.serverAddress(),
+		transport,
 		grpc.WithBlock(),
 		grpc.WithTimeout(10*time.Second),
 		grpc.WithKeepaliveParams(kacp))
 	if err != nil {
+		// fall back to the configured server on the next attempt
+		s.redirectAddress = ""
 		return nil, err
 	}
 
@@ -139,7 +214,10 @@ func (s *NexAgent) connectServer() (*grpc.ClientConn, error) {
 }
 
 func (s *NexAgent) saveContext(agentUuid string) {
-	md := metadata.Pairs("UUID", agentUuid)
+	md := metadata.Pairs("UUID", agentUuid, agentProtocolKey, strconv.Itoa(ProtocolVersion))
+	if s.secret != "" {
+		md.Set(agentSecretKey, s.secret)
+	}
 	ctx := metadata.NewOutgoingContext(context.Background(), md)
 
 	s.ctx = ctx
@@ -152,7 +230,7 @@ func (s *NexAgent) resetContext() {
 func (s *NexAgent) updateAgent() {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("updateAgent: %v\n", r)
+			agentLog.Errorf("updateAgent: %v\n", r)
 		}
 	}()
 
@@ -162,14 +240,14 @@ func (s *NexAgent) updateAgent() {
 
 	hostInfo, err := host.Info()
 	if err != nil {
-		log.Fatalf("Failed to get host information: %v", err)
+		agentLog.Fatalf("Failed to get host information: %v", err)
 	}
 	s.hostName = hostInfo.Hostname
 	s.hostInfo = hostInfo
 
 	ip, err := netutil.ChooseHostInterface()
 	if err != nil {
-		log.Fatalf("Failed to get IP address: %v", err)
+		agentLog.Fatalf("Failed to get IP address: %v", err)
 	}
 
 	system, role, _ := host.Virtualization()
@@ -194,10 +272,27 @@ func (s *NexAgent) updateAgent() {
 		MachineId: s.machineId,
 	}
 
-	ctx := context.Background()
-	resp, err := s.collectorClient.UpdateAgent(ctx, agentInfo)
+	var header, trailer metadata.MD
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), agentProtocolKey, strconv.Itoa(ProtocolVersion))
+	if s.config.Agent.EnrollmentToken != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, agentEnrollmentKey, s.config.Agent.EnrollmentToken)
+	}
+	if s.secret != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, agentSecretKey, s.secret)
+	}
+	resp, err := s.collectorClient.UpdateAgent(ctx, agentInfo, grpc.Header(&header), grpc.Trailer(&trailer))
 	if err != nil {
-		log.Printf("Failed updateAgent: %v\n", err)
+		if s.redirectFromTrailer(trailer) {
+			return
+		}
+		agentLog.Errorf("Failed updateAgent: %v\n", err)
+		return
+	}
+	s.negotiatedProtocol(header)
+	// the secret is issued when the agent enrolls with a token
+	if values := header.Get(agentSecretKey); len(values) > 0 {
+		s.secret = values[0]
 	}
 
 	if resp.Success {
@@ -206,7 +301,7 @@ func (s *NexAgent) updateAgent() {
 
 		s.saveContext(s.uuid)
 	} else {
-		log.Printf("updateAgent: failed to update: %v\n", resp.DataString[0])
+		agentLog.Errorf("updateAgent: failed to update: %v\n", resp.DataString[0])
 	}
 }
 
@@ -283,7 +378,7 @@ func (s *NexAgent) appendMetric(
 func (s *NexAgent) sendMetrics(ts *time.Time) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("sendMetrics: %v\n", r)
+			agentLog.Errorf("sendMetrics: %v\n", r)
 		}
 	}()
 
@@ -291,8 +386,10 @@ func (s *NexAgent) sendMetrics(ts *time.Time) {
 		return
 	}
 
-	go s.sendNodeMetrics(ts)
-	go s.sendDockerMetrics(ts)
+	go s.runCollector(collectorNode, ts, s.sendNodeMetrics)
+	if !s.disableContainerMetrics {
+		go s.runCollector(collectorContainer, ts, s.sendDockerMetrics)
+	}
 	//go func() {
 	//	if s.useK8sMetric {
 	//		if err := s.sendK8sMetrics(ts); err != nil {
@@ -300,20 +397,44 @@ func (s *NexAgent) sendMetrics(ts *time.Time) {
 	//		}
 	//	}
 	//}()
-	s.sendProcessMetrics(ts)
+	if !s.config.AuthLog.Disabled {
+		go s.runCollector(collectorAuthLog, ts, s.sendAuthLogMetrics)
+	}
+	if !s.config.KernelLog.Disabled && s.supportsProtocol(2) {
+		go s.runCollector(collectorKernelLog, ts, s.reportKernelEvents)
+	}
+	if s.config.IOProbe.Enabled {
+		go s.runCollector(collectorIOProbe, ts, s.runIOProbe)
+	}
+	if !s.config.EphemeralStorage.Disabled {
+		go s.runCollector(collectorEphemeralStorage, ts, s.sendEphemeralStorageMetrics)
+	}
+	if s.useK8sMetric {
+		go s.runCollector(collectorK8sLatency, ts, s.sendK8sLatencyMetrics)
+		go s.runCollector(collectorK8sJobs, ts, s.sendK8sJobMetrics)
+		if len(s.config.K8sResource.Resources) > 0 && s.supportsProtocol(2) {
+			go s.runCollector(collectorK8sResources, ts, s.reportK8sResources)
+		}
+	}
+	if !s.disableProcessMetrics {
+		s.runCollector(collectorProcess, ts, s.sendProcessMetrics)
+	}
+	if s.supportsProtocol(3) {
+		go s.reportCollectorHealth(ts)
+	}
 }
 
 func (s *NexAgent) runPing(client pb.CollectorClient) {
 	stream, err := client.Ping(s.ctx)
 	if err != nil {
-		log.Printf("Ping: %v\n", err)
+		agentLog.Warnf("Ping: %v\n", err)
 	}
 
 	waitc := make(chan struct{})
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
-				log.Printf("ping: %v\n", r)
+				agentLog.Errorf("ping: %v\n", r)
 				s.connected = false
 			}
 		}()
@@ -330,7 +451,7 @@ func (s *NexAgent) runPing(client pb.CollectorClient) {
 
 			err := stream.Send(status)
 			if err != nil {
-				log.Printf("Ping: failed to send ping: %v\n", err)
+				agentLog.Errorf("Ping: failed to send ping: %v\n", err)
 				s.connected = false
 				close(waitc)
 				return
@@ -341,7 +462,7 @@ func (s *NexAgent) runPing(client pb.CollectorClient) {
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
-				log.Printf("Ping: failed to receive ping: %v\n", r)
+				agentLog.Errorf("Ping: failed to receive ping: %v\n", r)
 				s.connected = false
 			}
 		}()
@@ -353,12 +474,15 @@ func (s *NexAgent) runPing(client pb.CollectorClient) {
 
 			in, err := stream.Recv()
 			if err == io.EOF {
-				log.Printf("Ping EOF: %v\n", err)
+				agentLog.Infof("Ping EOF: %v\n", err)
 				s.connected = false
 				break
 			}
 			if in != nil {
-				log.Printf("Ping received: %v\n", in.Timestamp)
+				agentLog.Debugf("Ping received: %v\n", in.Timestamp)
+				if in.Command != nil {
+					s.runCommand(in.Command)
+				}
 			}
 		}
 	}()
@@ -366,31 +490,37 @@ func (s *NexAgent) runPing(client pb.CollectorClient) {
 	<-waitc
 
 	if err = stream.CloseSend(); err != nil {
-		log.Printf("Failed close stream: %v\n", err)
+		agentLog.Errorf("Failed close stream: %v\n", err)
 	}
 }
 
 func (s *NexAgent) Start() error {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Start: %v\n", r)
+			agentLog.Errorf("Start: %v\n", r)
 			time.Sleep(15 * time.Second)
 			s.resetContext()
 		}
 	}()
 
+	nexcrypto.SetStrict(s.config.Crypto.Strict)
+	agentLog.Infof("Crypto mode %s\n", nexcrypto.Mode())
+
 	s.SetupApiHandler()
+	if s.config.MeshProbe.Enabled {
+		go s.serveMesh()
+	}
 
 	for {
 		s.resetContext()
 		conn, err := s.connectServer()
 		if err != nil {
-			log.Printf("Failed connect to server: %v\n", err)
+			agentLog.Errorf("Failed connect to server: %v\n", err)
 			time.Sleep(15 * time.Second)
 
 			continue
 		}
-		log.Println("Server connected")
+		agentLog.Infof("Server connected")
 
 		s.connected = true
 		s.collectorClient = pb.NewCollectorClient(conn)
@@ -410,12 +540,24 @@ func (s *NexAgent) Start() error {
 
 		go s.runPing(s.collectorClient)
 		go func() {
-			for now := range time.Tick(time.Second * s.reportInterval) {
+			interval := s.reportInterval
+			ticker := time.NewTicker(time.Second * interval)
+			defer func() { ticker.Stop() }()
+
+			for {
+				now := <-ticker.C
 				if s.connected == false {
 					break
 				}
 				s.sendMetrics(&now)
 				s.lastCheckTS = now
+
+				// the interval may be changed by the server configuration
+				if s.reportInterval != interval {
+					interval = s.reportInterval
+					ticker.Stop()
+					ticker = time.NewTicker(time.Second * interval)
+				}
 			}
 		}()
 
@@ -477,10 +619,10 @@ func (s *NexAgent) initK8s() bool {
 	var config *rest.Config
 	var err error
 
-	log.Printf("Trying to get Kubernetes configuration in cluster")
+	agentLog.Infof("Trying to get Kubernetes configuration in cluster")
 	config, err = rest.InClusterConfig()
 	if err != nil {
-		log.Printf("Trying to use KUBERCONFIG environment variable")
+		agentLog.Infof("Trying to use KUBERCONFIG environment variable")
 		kubePath := os.Getenv("KUBECONFIG")
 		if kubePath == "" {
 			home := homedir.HomeDir()
@@ -497,9 +639,9 @@ func (s *NexAgent) initK8s() bool {
 			s.useK8sMetric = false
 			return false
 		}
-		log.Printf("Kubernetes API Server: %s\n", config.Host)
+		agentLog.Infof("Kubernetes API Server: %s\n", config.Host)
 	} else {
-		log.Printf("Use in cluster configuration")
+		agentLog.Infof("Use in cluster configuration")
 	}
 
 	clientSet, err := kubernetes.NewForConfig(config)
@@ -525,6 +667,10 @@ func (s *NexAgent) SetK8sCluster(k8sCluster string) {
 	s.config.Kubernetes.ClusterName = k8sCluster
 }
 
+func (s *NexAgent) SetK8sNode(k8sNode string) {
+	s.config.Kubernetes.NodeName = k8sNode
+}
+
 func (s *NexAgent) SetServerAddress(serverAddress string) {
 	s.config.Agent.ServerAddress = serverAddress
 }
@@ -533,10 +679,57 @@ func (s *NexAgent) SetAgentCluster(agentCluster string) {
 	s.config.Agent.Cluster = agentCluster
 }
 
+func (s *NexAgent) SetEnrollmentToken(token string) {
+	s.config.Agent.EnrollmentToken = token
+}
+
 func (s *NexAgent) SetApiPort(restApiPort int) {
 	s.config.Agent.ApiPort = restApiPort
 }
 
+func (s *NexAgent) SetTLSConfig(use bool, certFile string) {
+	s.config.TLS.Use = use
+	s.config.TLS.CertFile = certFile
+}
+
+func (s *NexAgent) SetStrictCrypto(strict bool) {
+	s.config.Crypto.Strict = strict
+}
+
+func (s *NexAgent) SetAuthLogConfig(disabled bool, files []string) {
+	s.config.AuthLog.Disabled = disabled
+	s.config.AuthLog.Files = files
+}
+
+func (s *NexAgent) SetKernelLogConfig(disabled bool) {
+	s.config.KernelLog.Disabled = disabled
+}
+
+func (s *NexAgent) SetIOProbeConfig(enabled bool, interval int, mountpoints []string) {
+	s.config.IOProbe.Enabled = enabled
+	s.config.IOProbe.Interval = interval
+	s.config.IOProbe.Mountpoints = mountpoints
+}
+
+func (s *NexAgent) SetMeshProbeConfig(enabled bool, port int) {
+	s.config.MeshProbe.Enabled = enabled
+	s.config.MeshProbe.Port = port
+}
+
+func (s *NexAgent) SetEphemeralStorageConfig(disabled bool, evictionThreshold float64) {
+	s.config.EphemeralStorage.Disabled = disabled
+	s.config.EphemeralStorage.EvictionThreshold = evictionThreshold
+}
+
+func (s *NexAgent) SetK8sResourceConfig(resources []string) {
+	s.config.K8sResource.Resources = resources
+}
+
+func (s *NexAgent) SetLogConfig(level, format string) {
+	s.config.Log.Level = level
+	s.config.Log.Format = format
+}
+
 func (s *NexAgent) SetReportInterval(reportInterval int) {
 	s.config.Agent.ReportInterval = reportInterval
 	s.reportInterval = time.Duration(s.config.Agent.ReportInterval)
@@ -545,12 +738,13 @@ func (s *NexAgent) SetReportInterval(reportInterval int) {
 func NewNexAgent() *NexAgent {
 	machineId, err := machineid.ProtectedID(AppName)
 	if err != nil {
-		log.Fatalf("Failed to start application: %s\n", err)
+		agentLog.Fatalf("Failed to start application: %s\n", err)
 	}
 
 	return &NexAgent{
 		machineId:      machineId,
 		processInfoMap: make(map[int32]*ProcessInfo),
+		tails:          make(map[string]chan struct{}),
 		config:         &Config{},
 	}
 }
@@ -0,0 +1,137 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"encoding/json"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/shirou/gopsutil/net"
+	"github.com/shirou/gopsutil/process"
+	"sort"
+	"syscall"
+)
+
+// UDP sockets have no listening state: sockets bound in the ephemeral
+// range are most likely clients waiting for a reply and are skipped.
+const minEphemeralPort = 32768
+
+type ListeningSocket struct {
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Port     uint32 `json:"port"`
+	Pid      int32  `json:"pid"`
+	Process  string `json:"process"`
+}
+
+func socketProtocol(conn *net.ConnectionStat) string {
+	protocol := "tcp"
+	if conn.Type == syscall.SOCK_DGRAM {
+		protocol = "udp"
+	}
+	if conn.Family == syscall.AF_INET6 {
+		protocol += "6"
+	}
+
+	return protocol
+}
+
+func collectListeningSockets() ([]ListeningSocket, error) {
+	conns, err := net.Connections("inet")
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[int32]string)
+	seen := make(map[string]bool)
+	sockets := make([]ListeningSocket, 0, 32)
+	for idx := range conns {
+		conn := &conns[idx]
+
+		if conn.Type == syscall.SOCK_DGRAM {
+			if conn.Raddr.Port != 0 || conn.Laddr.Port >= minEphemeralPort {
+				continue
+			}
+		} else if conn.Status != "LISTEN" {
+			continue
+		}
+
+		socket := ListeningSocket{
+			Protocol: socketProtocol(conn),
+			Address:  conn.Laddr.IP,
+			Port:     conn.Laddr.Port,
+			Pid:      conn.Pid,
+		}
+		key := fmt.Sprintf("%s/%s/%d", socket.Protocol, socket.Address, socket.Port)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		if conn.Pid > 0 {
+			name, found := names[conn.Pid]
+			if !found {
+				if ps, err := process.NewProcess(conn.Pid); err == nil {
+					name, _ = ps.Name()
+				}
+				names[conn.Pid] = name
+			}
+			socket.Process = name
+		}
+
+		sockets = append(sockets, socket)
+	}
+
+	sort.Slice(sockets, func(i, j int) bool {
+		if sockets[i].Port != sockets[j].Port {
+			return sockets[i].Port < sockets[j].Port
+		}
+		if sockets[i].Protocol != sockets[j].Protocol {
+			return sockets[i].Protocol < sockets[j].Protocol
+		}
+		return sockets[i].Address < sockets[j].Address
+	})
+
+	return sockets, nil
+}
+
+func (s *NexAgent) runPortInventory(command *pb.Command) {
+	defer func() {
+		if r := recover(); r != nil {
+			commandLog.Errorf("runPortInventory: %v\n", r)
+		}
+	}()
+
+	result := &pb.CommandResult{
+		CommandId: command.Id,
+		Name:      command.Name,
+		Success:   true,
+	}
+
+	sockets, err := collectListeningSockets()
+	if err == nil {
+		result.Data, err = json.Marshal(sockets)
+	}
+	if err != nil {
+		result.Success = false
+		result.Error = err.Error()
+	}
+
+	if _, err := s.collectorClient.ReportCommandResult(s.ctx, result); err != nil {
+		commandLog.Errorf("Ports: failed to report result: %v\n", err)
+	}
+}
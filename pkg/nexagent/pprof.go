@@ -0,0 +1,139 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	profileMaxSeconds = 60
+	profileMaxSize    = 32 * 1024 * 1024
+)
+
+// durationProfiles are sampled over the requested number of seconds; the
+// other profiles are snapshots.
+var durationProfiles = map[string]bool{
+	"profile": true,
+	"trace":   true,
+}
+
+var snapshotProfiles = map[string]bool{
+	"heap":         true,
+	"allocs":       true,
+	"goroutine":    true,
+	"block":        true,
+	"mutex":        true,
+	"threadcreate": true,
+}
+
+func (s *NexAgent) findProfilingEndpoint(name string) *ProfilingEndpoint {
+	for idx := range s.config.Profiling.Endpoints {
+		if s.config.Profiling.Endpoints[idx].Name == name {
+			return &s.config.Profiling.Endpoints[idx]
+		}
+	}
+
+	return nil
+}
+
+func (s *NexAgent) fetchProfile(endpointName, profile string, seconds int) ([]byte, error) {
+	endpoint := s.findProfilingEndpoint(endpointName)
+	if endpoint == nil {
+		return nil, fmt.Errorf("unknown profiling endpoint: %s", endpointName)
+	}
+
+	if !durationProfiles[profile] && !snapshotProfiles[profile] {
+		return nil, fmt.Errorf("unknown profile: %s", profile)
+	}
+	if seconds <= 0 || seconds > profileMaxSeconds {
+		return nil, fmt.Errorf("invalid seconds: %d", seconds)
+	}
+
+	url := fmt.Sprintf("%s/debug/pprof/%s", strings.TrimRight(endpoint.Address, "/"), profile)
+	if durationProfiles[profile] {
+		url = fmt.Sprintf("%s?seconds=%d", url, seconds)
+	}
+
+	client := &http.Client{Timeout: time.Duration(seconds)*time.Second + 30*time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, profileMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > profileMaxSize {
+		return nil, fmt.Errorf("profile exceeds %d bytes", profileMaxSize)
+	}
+
+	return data, nil
+}
+
+func (s *NexAgent) runProfileCapture(command *pb.Command) {
+	defer func() {
+		if r := recover(); r != nil {
+			commandLog.Errorf("runProfileCapture: %v\n", r)
+		}
+	}()
+
+	result := &pb.CommandResult{
+		CommandId: command.Id,
+		Name:      command.Name,
+		Success:   true,
+	}
+
+	var data []byte
+	var err error
+
+	if len(command.Args) != 3 {
+		err = fmt.Errorf("invalid arguments: %v", command.Args)
+	} else {
+		var seconds int
+
+		seconds, err = strconv.Atoi(command.Args[2])
+		if err == nil {
+			commandLog.Infof("Profile: %s %s for %ds\n", command.Args[0], command.Args[1], seconds)
+			data, err = s.fetchProfile(command.Args[0], command.Args[1], seconds)
+		}
+	}
+
+	if err != nil {
+		result.Success = false
+		result.Error = err.Error()
+	} else {
+		result.Data = data
+	}
+
+	if _, err := s.collectorClient.ReportCommandResult(s.ctx, result); err != nil {
+		commandLog.Errorf("Profile: failed to upload profile: %v\n", err)
+	}
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"google.golang.org/grpc/metadata"
+	"strconv"
+)
+
+// The agent announces its protocol version on every call and speaks the
+// version the server answers to UpdateAgent. A server older than the
+// negotiation answers nothing and speaks protocol 1, so the reports it
+// does not know are not sent to it.
+
+const (
+	ProtocolVersion = 3
+
+	agentProtocolKey       = "x-nexclipper-protocol"
+	agentProtocolStatusKey = "x-nexclipper-protocol-status"
+	agentEnrollmentKey     = "x-nexclipper-enrollment-token"
+	agentSecretKey         = "x-nexclipper-agent-secret"
+)
+
+func (s *NexAgent) negotiatedProtocol(header metadata.MD) {
+	protocol := 1
+	if values := header.Get(agentProtocolKey); len(values) > 0 {
+		if version, err := strconv.Atoi(values[0]); err == nil && version > 0 {
+			protocol = version
+		}
+	}
+	if protocol > ProtocolVersion {
+		protocol = ProtocolVersion
+	}
+
+	if protocol != s.protocol {
+		agentLog.Infof("Protocol: speaking protocol %d\n", protocol)
+	}
+	if values := header.Get(agentProtocolStatusKey); len(values) > 0 && values[0] == "deprecated" {
+		agentLog.Warnf("Protocol: protocol %d is deprecated by the server, upgrade the agent\n", protocol)
+	}
+
+	s.protocol = protocol
+}
+
+// supportsProtocol returns true if the negotiated protocol is version or
+// later.
+func (s *NexAgent) supportsProtocol(version int) bool {
+	return s.protocol >= version
+}
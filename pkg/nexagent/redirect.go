@@ -0,0 +1,73 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	pb "github.com/NexClipper/NexClipper/api"
+	"google.golang.org/grpc/metadata"
+)
+
+// A server in shard mode redirects agents it does not own, either when
+// they register or when members join or leave. The configured server
+// address stays the fallback once the redirected server goes away.
+
+const redirectKey = "x-nexserver-redirect"
+
+func (s *NexAgent) serverAddress() string {
+	if s.redirectAddress != "" {
+		return s.redirectAddress
+	}
+
+	return s.config.Agent.ServerAddress
+}
+
+func (s *NexAgent) redirectServer(address string) {
+	if address == "" || address == s.serverAddress() {
+		return
+	}
+
+	agentLog.Infof("Redirected to server %s\n", address)
+
+	s.redirectAddress = address
+	s.connected = false
+
+	if s.conn != nil {
+		if err := s.conn.Close(); err != nil {
+			agentLog.Errorf("Failed close connection: %v\n", err)
+		}
+	}
+}
+
+func (s *NexAgent) redirectFromTrailer(trailer metadata.MD) bool {
+	values := trailer.Get(redirectKey)
+	if len(values) == 0 {
+		return false
+	}
+
+	s.redirectServer(values[0])
+
+	return true
+}
+
+func (s *NexAgent) runReconnect(command *pb.Command) {
+	if len(command.Args) != 1 {
+		agentLog.Warnf("Reconnect: invalid arguments: %v\n", command.Args)
+		return
+	}
+
+	s.redirectServer(command.Args[0])
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// applyRemoteConfig applies the merged collector configuration sent by the
+// server as key=value arguments. Keys missing from the command fall back to
+// the local configuration. Invalid arguments are skipped and reported.
+func (s *NexAgent) applyRemoteConfig(args []string) []string {
+	invalid := make([]string, 0)
+
+	reportInterval := time.Duration(s.config.Agent.ReportInterval)
+	if reportInterval <= 0 {
+		reportInterval = 5
+	}
+	processMetrics := true
+	containerMetrics := true
+
+	for _, arg := range args {
+		pair := strings.SplitN(arg, "=", 2)
+		if len(pair) != 2 {
+			invalid = append(invalid, arg)
+			continue
+		}
+
+		switch pair[0] {
+		case "report_interval":
+			seconds, err := strconv.Atoi(pair[1])
+			if err != nil || seconds <= 0 {
+				invalid = append(invalid, arg)
+				continue
+			}
+			reportInterval = time.Duration(seconds)
+		case "process_metrics":
+			value, err := strconv.ParseBool(pair[1])
+			if err != nil {
+				invalid = append(invalid, arg)
+				continue
+			}
+			processMetrics = value
+		case "container_metrics":
+			value, err := strconv.ParseBool(pair[1])
+			if err != nil {
+				invalid = append(invalid, arg)
+				continue
+			}
+			containerMetrics = value
+		default:
+			invalid = append(invalid, arg)
+		}
+	}
+
+	s.reportInterval = reportInterval
+	s.disableProcessMetrics = !processMetrics
+	s.disableContainerMetrics = !containerMetrics
+
+	agentLog.Infof("Config: report interval %ds, process metrics %v, container metrics %v\n",
+		reportInterval, processMetrics, containerMetrics)
+
+	return invalid
+}
+
+func (s *NexAgent) runRemoteConfig(command *pb.Command) {
+	defer func() {
+		if r := recover(); r != nil {
+			agentLog.Errorf("runRemoteConfig: %v\n", r)
+		}
+	}()
+
+	result := &pb.CommandResult{
+		CommandId: command.Id,
+		Name:      command.Name,
+		Success:   true,
+	}
+
+	if invalid := s.applyRemoteConfig(command.Args); len(invalid) > 0 {
+		agentLog.Warnf("Config: invalid arguments: %v\n", invalid)
+		result.Success = false
+		result.Error = fmt.Sprintf("invalid arguments: %s", strings.Join(invalid, " "))
+	}
+
+	if _, err := s.collectorClient.ReportCommandResult(s.ctx, result); err != nil {
+		agentLog.Errorf("Config: failed to report result: %v\n", err)
+	}
+}
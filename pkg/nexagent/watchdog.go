@@ -0,0 +1,186 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexagent
+
+import (
+	"encoding/json"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The watchdog follows each collector run: a run logging a failure extends
+// the error streak of its collector and a clean run ends it. A collector
+// still running after collectorStuckAfter is stuck, the following runs are
+// skipped until it returns instead of piling up behind it. The state of
+// the collectors is reported to the server every collectorHealthInterval,
+// which tells the agents with failing collectors apart.
+
+const (
+	collectorStuckAfter     = 2 * time.Minute
+	collectorHealthInterval = 30 * time.Second
+
+	collectorNode             = "node"
+	collectorContainer        = "container"
+	collectorProcess          = "process"
+	collectorAuthLog          = "auth_log"
+	collectorKernelLog        = "kernel_log"
+	collectorIOProbe          = "io_probe"
+	collectorEphemeralStorage = "ephemeral_storage"
+	collectorK8sLatency       = "k8s_latency"
+	collectorK8sJobs          = "k8s_jobs"
+	collectorK8sResources     = "k8s_resources"
+)
+
+type CollectorStatus struct {
+	Name          string     `json:"name"`
+	Running       bool       `json:"running"`
+	Stuck         bool       `json:"stuck"`
+	ErrorStreak   int        `json:"error_streak"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastRunTs     time.Time  `json:"last_run_ts"`
+	LastSuccessTs *time.Time `json:"last_success_ts,omitempty"`
+}
+
+type collectorState struct {
+	running     bool
+	failed      bool
+	started     time.Time
+	lastSuccess *time.Time
+	errorStreak int
+	lastError   string
+}
+
+type Watchdog struct {
+	sync.Mutex
+
+	collectors map[string]*collectorState
+	reported   time.Time
+}
+
+// start marks the collector running, false if the previous run has not
+// returned.
+func (w *Watchdog) start(name string, now time.Time) bool {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.collectors == nil {
+		w.collectors = make(map[string]*collectorState)
+	}
+	state, found := w.collectors[name]
+	if !found {
+		state = &collectorState{}
+		w.collectors[name] = state
+	}
+	if state.running {
+		return false
+	}
+
+	state.running = true
+	state.failed = false
+	state.started = now
+
+	return true
+}
+
+func (w *Watchdog) finish(name string, now time.Time) {
+	w.Lock()
+	defer w.Unlock()
+
+	state, found := w.collectors[name]
+	if !found {
+		return
+	}
+	state.running = false
+	if state.failed {
+		state.errorStreak += 1
+		return
+	}
+	state.errorStreak = 0
+	state.lastSuccess = &now
+}
+
+// fail records a failure of the current run of the collector.
+func (w *Watchdog) fail(name string, reason interface{}) {
+	w.Lock()
+	defer w.Unlock()
+
+	if state, found := w.collectors[name]; found {
+		state.failed = true
+		state.lastError = fmt.Sprint(reason)
+	}
+}
+
+func (w *Watchdog) status(now time.Time) []CollectorStatus {
+	w.Lock()
+	defer w.Unlock()
+
+	statuses := make([]CollectorStatus, 0, len(w.collectors))
+	for name, state := range w.collectors {
+		statuses = append(statuses, CollectorStatus{
+			Name:          name,
+			Running:       state.running,
+			Stuck:         state.running && now.Sub(state.started) > collectorStuckAfter,
+			ErrorStreak:   state.errorStreak,
+			LastError:     state.lastError,
+			LastRunTs:     state.started,
+			LastSuccessTs: state.lastSuccess,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	return statuses
+}
+
+// runCollector runs a collector under the watchdog.
+func (s *NexAgent) runCollector(name string, ts *time.Time, collect func(ts *time.Time)) {
+	if !s.watchdog.start(name, time.Now()) {
+		collectLog.Warnf("Watchdog: %s is still running, skipped\n", name)
+		return
+	}
+	defer func() {
+		s.watchdog.finish(name, time.Now())
+	}()
+
+	collect(ts)
+}
+
+func (s *NexAgent) reportCollectorHealth(ts *time.Time) {
+	s.watchdog.Lock()
+	if ts.Sub(s.watchdog.reported) < collectorHealthInterval {
+		s.watchdog.Unlock()
+		return
+	}
+	s.watchdog.reported = *ts
+	s.watchdog.Unlock()
+
+	data, err := json.Marshal(s.watchdog.status(time.Now()))
+	if err == nil {
+		_, err = s.collectorClient.ReportCommandResult(s.ctx, &pb.CommandResult{
+			Name:    "collector_health",
+			Success: true,
+			Data:    data,
+		})
+	}
+	if err != nil {
+		collectLog.Errorf("Watchdog: failed to report collector health: %v\n", err)
+	}
+}
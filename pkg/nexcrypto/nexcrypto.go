@@ -0,0 +1,130 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package nexcrypto holds the TLS and SSH algorithm policy shared by the
+// binaries. In strict mode only FIPS 140-2 approved algorithms are
+// negotiated: TLS 1.2 with ECDHE and AES-GCM over the NIST curves, and SSH
+// with ECDH over the NIST curves, AES, HMAC-SHA2 and ECDSA host keys. Strict
+// mode is enabled by configuration, or always on in binaries built with the
+// "fips" tag.
+package nexcrypto
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// builtStrict is set by the fips build.
+var builtStrict = false
+
+var strict int32
+
+func SetStrict(enabled bool) {
+	value := int32(0)
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&strict, value)
+}
+
+func Strict() bool {
+	return builtStrict || atomic.LoadInt32(&strict) == 1
+}
+
+func Mode() string {
+	if builtStrict {
+		return "strict (fips build)"
+	}
+	if Strict() {
+		return "strict"
+	}
+
+	return "default"
+}
+
+var approvedCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+}
+
+var approvedCurves = []tls.CurveID{tls.CurveP256, tls.CurveP384, tls.CurveP521}
+
+func baseTLSConfig() *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if Strict() {
+		// TLS 1.3 suites are not configurable, cap the version instead
+		config.MaxVersion = tls.VersionTLS12
+		config.CipherSuites = approvedCipherSuites
+		config.CurvePreferences = approvedCurves
+		config.PreferServerCipherSuites = true
+	}
+
+	return config
+}
+
+// ServerTLSConfig loads the certificate and key for a listener.
+func ServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	config := baseTLSConfig()
+	config.Certificates = []tls.Certificate{cert}
+
+	return config, nil
+}
+
+// ClientTLSConfig verifies servers with the CA bundle, or with the system
+// roots when caFile is empty.
+func ClientTLSConfig(caFile string) (*tls.Config, error) {
+	config := baseTLSConfig()
+	if caFile == "" {
+		return config, nil
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	config.RootCAs = pool
+
+	return config, nil
+}
+
+// RestrictSSH limits the algorithms of an SSH client in strict mode.
+func RestrictSSH(config *ssh.ClientConfig) {
+	if !Strict() {
+		return
+	}
+
+	config.KeyExchanges = []string{"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521"}
+	config.Ciphers = []string{"aes128-gcm@openssh.com", "aes128-ctr", "aes192-ctr", "aes256-ctr"}
+	config.MACs = []string{"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256"}
+	config.HostKeyAlgorithms = []string{ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521}
+}
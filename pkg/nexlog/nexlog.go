@@ -0,0 +1,204 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package nexlog is the leveled logging shared by the binaries. Every
+// subsystem logs through a Logger named after its component, which adds a
+// component field to its lines. The level is shared by all the loggers and
+// can be changed at runtime. The standard log package is redirected at the
+// info level, for the libraries and the lines not yet moved to a
+// component.
+package nexlog
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	FormatConsole = "console"
+	FormatJson    = "json"
+)
+
+var (
+	level = zap.NewAtomicLevelAt(zap.InfoLevel)
+
+	rootLock sync.Mutex
+	root     = newRoot(FormatConsole, nil)
+	app      string
+	format   = FormatConsole
+	outputs  []zapcore.WriteSyncer
+	// generation changes with the root, so the loggers rebuild theirs
+	generation int32
+
+	restoreStdLog func()
+)
+
+func newRoot(format string, outputs []zapcore.WriteSyncer) *zap.Logger {
+	config := zapcore.EncoderConfig{
+		TimeKey:        "ts",
+		LevelKey:       "level",
+		NameKey:        "logger",
+		MessageKey:     "msg",
+		StacktraceKey:  "stacktrace",
+		LineEnding:     zapcore.DefaultLineEnding,
+		EncodeLevel:    zapcore.CapitalLevelEncoder,
+		EncodeTime:     zapcore.ISO8601TimeEncoder,
+		EncodeDuration: zapcore.StringDurationEncoder,
+	}
+
+	var encoder zapcore.Encoder
+	if format == FormatJson {
+		config.EncodeLevel = zapcore.LowercaseLevelEncoder
+		encoder = zapcore.NewJSONEncoder(config)
+	} else {
+		encoder = zapcore.NewConsoleEncoder(config)
+	}
+
+	writer := zapcore.Lock(os.Stderr)
+	if len(outputs) > 0 {
+		writer = zapcore.NewMultiWriteSyncer(append([]zapcore.WriteSyncer{writer}, outputs...)...)
+	}
+
+	return zap.New(zapcore.NewCore(encoder, writer, level))
+}
+
+// rebuild replaces the root logger, rootLock held.
+func rebuild() {
+	root = newRoot(format, outputs)
+	if app != "" {
+		root = root.With(zap.String("app", app))
+	}
+	atomic.AddInt32(&generation, 1)
+
+	if restoreStdLog != nil {
+		restoreStdLog()
+	}
+	restoreStdLog = zap.RedirectStdLog(root)
+}
+
+// Init sets the format and the level of the logs of the application.
+func Init(appName, formatName, levelName string) error {
+	if formatName == "" {
+		formatName = FormatConsole
+	}
+	if formatName != FormatConsole && formatName != FormatJson {
+		return fmt.Errorf("invalid log format %q, expected console or json", formatName)
+	}
+	if err := SetLevel(levelName); err != nil {
+		return err
+	}
+
+	rootLock.Lock()
+	defer rootLock.Unlock()
+
+	app = appName
+	format = formatName
+	rebuild()
+
+	return nil
+}
+
+// AddOutput writes the logs to w as well as to stderr.
+func AddOutput(w io.Writer) {
+	rootLock.Lock()
+	defer rootLock.Unlock()
+
+	outputs = append(outputs, zapcore.AddSync(w))
+	rebuild()
+}
+
+// SetLevel changes the level of every logger.
+func SetLevel(levelName string) error {
+	if levelName == "" {
+		return nil
+	}
+
+	var value zapcore.Level
+	if err := value.UnmarshalText([]byte(strings.ToLower(levelName))); err != nil {
+		return fmt.Errorf("invalid log level %q", levelName)
+	}
+	level.SetLevel(value)
+
+	return nil
+}
+
+// Level returns the name of the current level.
+func Level() string {
+	return level.Level().String()
+}
+
+type Logger struct {
+	component string
+
+	lock       sync.Mutex
+	generation int32
+	sugar      *zap.SugaredLogger
+}
+
+// Named returns the logger of the component.
+func Named(component string) *Logger {
+	return &Logger{component: component, generation: -1}
+}
+
+func (l *Logger) get() *zap.SugaredLogger {
+	current := atomic.LoadInt32(&generation)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.sugar == nil || l.generation != current {
+		rootLock.Lock()
+		l.sugar = root.With(zap.String("component", l.component)).Sugar()
+		rootLock.Unlock()
+		l.generation = current
+	}
+
+	return l.sugar
+}
+
+// With returns the logger with the fields added to its lines.
+func (l *Logger) With(keysAndValues ...interface{}) *zap.SugaredLogger {
+	return l.get().With(keysAndValues...)
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.get().Debugf(strings.TrimSuffix(format, "\n"), args...)
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.get().Infof(strings.TrimSuffix(format, "\n"), args...)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.get().Warnf(strings.TrimSuffix(format, "\n"), args...)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.get().Errorf(strings.TrimSuffix(format, "\n"), args...)
+}
+
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.get().Fatalf(strings.TrimSuffix(format, "\n"), args...)
+}
+
+func (l *Logger) Infow(msg string, keysAndValues ...interface{}) {
+	l.get().Infow(msg, keysAndValues...)
+}
@@ -0,0 +1,220 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexprobe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A DNS check resolves one record, through a given resolver or the system
+// one, and compares the answers with the expected ones. Every expected
+// answer must be present; other answers are allowed so round-robin records
+// can be checked. The result is reported like a single step journey whose
+// body lists the answers received.
+
+const (
+	defaultDNSTimeout = 5 * time.Second
+	dnsStepName       = "resolve"
+)
+
+var dnsRecordTypes = []string{"A", "AAAA", "CNAME", "MX", "NS", "TXT"}
+
+type DNSCheck struct {
+	Name           string   `json:"name"`
+	Resolver       string   `json:"resolver,omitempty"`
+	Record         string   `json:"record"`
+	Type           string   `json:"type,omitempty"`
+	Expect         []string `json:"expect,omitempty"`
+	MaxLatencyMs   float64  `json:"max_latency_ms,omitempty"`
+	TimeoutSeconds int      `json:"timeout,omitempty"`
+}
+
+// ParseDNSCheck reads a DNS check from YAML or JSON and validates it.
+func ParseDNSCheck(data []byte) (*DNSCheck, error) {
+	var check DNSCheck
+	if err := yaml.UnmarshalStrict(data, &check); err != nil {
+		return nil, fmt.Errorf("invalid dns check: %v", err)
+	}
+
+	if check.Name == "" {
+		return nil, fmt.Errorf("dns check name is required")
+	}
+	if check.Record == "" {
+		return nil, fmt.Errorf("record is required")
+	}
+
+	if check.Type == "" {
+		check.Type = "A"
+	}
+	check.Type = strings.ToUpper(check.Type)
+	valid := false
+	for _, recordType := range dnsRecordTypes {
+		if check.Type == recordType {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, fmt.Errorf("type must be one of %s", strings.Join(dnsRecordTypes, ", "))
+	}
+
+	if check.Resolver != "" {
+		if _, _, err := net.SplitHostPort(check.Resolver); err != nil {
+			check.Resolver = net.JoinHostPort(check.Resolver, "53")
+		}
+	}
+	if check.TimeoutSeconds < 0 || check.MaxLatencyMs < 0 {
+		return nil, fmt.Errorf("timeout and max_latency_ms must not be negative")
+	}
+
+	return &check, nil
+}
+
+func normalizeAnswer(answer string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(answer), "."))
+}
+
+func (check *DNSCheck) resolver() *net.Resolver {
+	if check.Resolver == "" {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, check.Resolver)
+		},
+	}
+}
+
+func (check *DNSCheck) lookup(ctx context.Context) ([]string, error) {
+	resolver := check.resolver()
+	answers := make([]string, 0, 4)
+
+	switch check.Type {
+	case "A", "AAAA":
+		addresses, err := resolver.LookupIPAddr(ctx, check.Record)
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range addresses {
+			if (address.IP.To4() != nil) == (check.Type == "A") {
+				answers = append(answers, address.IP.String())
+			}
+		}
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(ctx, check.Record)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, cname)
+	case "MX":
+		records, err := resolver.LookupMX(ctx, check.Record)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			answers = append(answers, record.Host)
+		}
+	case "NS":
+		records, err := resolver.LookupNS(ctx, check.Record)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			answers = append(answers, record.Host)
+		}
+	case "TXT":
+		records, err := resolver.LookupTXT(ctx, check.Record)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, records...)
+	}
+
+	for idx := range answers {
+		answers[idx] = normalizeAnswer(answers[idx])
+	}
+	sort.Strings(answers)
+
+	return answers, nil
+}
+
+func (check *DNSCheck) verify(answers []string, durationMs float64) error {
+	if len(answers) == 0 {
+		return fmt.Errorf("no %s record", check.Type)
+	}
+
+	found := make(map[string]bool)
+	for _, answer := range answers {
+		found[answer] = true
+	}
+	for _, expected := range check.Expect {
+		if !found[normalizeAnswer(expected)] {
+			return fmt.Errorf("answer %s is missing", expected)
+		}
+	}
+
+	if check.MaxLatencyMs > 0 && durationMs > check.MaxLatencyMs {
+		return fmt.Errorf("resolved in %.1fms, more than %.1fms", durationMs, check.MaxLatencyMs)
+	}
+
+	return nil
+}
+
+// RunDNSCheck resolves the record and verifies the answers.
+func RunDNSCheck(check *DNSCheck) *JourneyResult {
+	timeout := defaultDNSTimeout
+	if check.TimeoutSeconds > 0 {
+		timeout = time.Duration(check.TimeoutSeconds) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result := &JourneyResult{
+		Journey:   check.Name,
+		StartedTs: time.Now(),
+		Success:   true,
+	}
+
+	answers, err := check.lookup(ctx)
+	result.DurationMs = float64(time.Since(result.StartedTs)) / float64(time.Millisecond)
+	if err == nil {
+		err = check.verify(answers, result.DurationMs)
+	}
+
+	step := JourneyStepResult{Name: dnsStepName, DurationMs: result.DurationMs, Success: true}
+	if err != nil {
+		step.Success = false
+		step.Error = err.Error()
+
+		result.Success = false
+		result.Error = fmt.Sprintf("%s %s: %v", check.Type, check.Record, err)
+		result.FailedStep = dnsStepName
+		result.Body = strings.Join(answers, "\n")
+		result.ContentType = "text/plain; charset=utf-8"
+	}
+	result.Steps = []JourneyStepResult{step}
+
+	return result
+}
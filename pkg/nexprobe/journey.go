@@ -0,0 +1,290 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexprobe
+
+import (
+	"fmt"
+	"github.com/NexClipper/NexClipper/pkg/nexcrypto"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"time"
+)
+
+// A journey is a scripted sequence of HTTP requests sharing cookies, such
+// as logging in, fetching a page and asserting its content. Values can be
+// extracted from a response with a regular expression and used in later
+// steps as ${name}. The journey stops at the first failed step, and the
+// body of the failed response is kept for troubleshooting.
+
+const (
+	defaultJourneyStepTimeout = 10 * time.Second
+	maxJourneySteps           = 20
+	maxJourneyBody            = 64 * 1024
+)
+
+var journeyVariable = regexp.MustCompile(`\$\{([a-zA-Z0-9_]+)\}`)
+
+type JourneyExpect struct {
+	Status      int      `json:"status,omitempty"`
+	Contains    []string `json:"contains,omitempty"`
+	NotContains []string `json:"not_contains,omitempty"`
+}
+
+type JourneyStep struct {
+	Name           string            `json:"name"`
+	Method         string            `json:"method,omitempty"`
+	Url            string            `json:"url"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Body           string            `json:"body,omitempty"`
+	TimeoutSeconds int               `json:"timeout,omitempty"`
+	Expect         JourneyExpect     `json:"expect,omitempty"`
+	Extract        map[string]string `json:"extract,omitempty"`
+
+	extract map[string]*regexp.Regexp
+}
+
+type Journey struct {
+	Name  string        `json:"name"`
+	Steps []JourneyStep `json:"steps"`
+}
+
+type JourneyStepResult struct {
+	Name       string  `json:"name"`
+	Status     int     `json:"status"`
+	DurationMs float64 `json:"duration_ms"`
+	Success    bool    `json:"success"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type JourneyResult struct {
+	Journey     string              `json:"journey"`
+	StartedTs   time.Time           `json:"started_ts"`
+	DurationMs  float64             `json:"duration_ms"`
+	Success     bool                `json:"success"`
+	Error       string              `json:"error,omitempty"`
+	FailedStep  string              `json:"failed_step,omitempty"`
+	Steps       []JourneyStepResult `json:"steps"`
+	Body        string              `json:"body,omitempty"`
+	ContentType string              `json:"content_type,omitempty"`
+}
+
+// ParseJourney reads a journey from YAML or JSON and validates it.
+func ParseJourney(data []byte) (*Journey, error) {
+	var journey Journey
+	if err := yaml.UnmarshalStrict(data, &journey); err != nil {
+		return nil, fmt.Errorf("invalid journey: %v", err)
+	}
+
+	if journey.Name == "" {
+		return nil, fmt.Errorf("journey name is required")
+	}
+	if len(journey.Steps) == 0 || len(journey.Steps) > maxJourneySteps {
+		return nil, fmt.Errorf("journey must have 1 to %d steps", maxJourneySteps)
+	}
+
+	for idx := range journey.Steps {
+		step := &journey.Steps[idx]
+		if step.Name == "" {
+			step.Name = fmt.Sprintf("step%d", idx+1)
+		}
+		if step.Method == "" {
+			step.Method = "GET"
+		}
+		step.Method = strings.ToUpper(step.Method)
+
+		// the url is checked again after substitution
+		target, err := url.Parse(journeyVariable.ReplaceAllString(step.Url, "x"))
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("step %s: url must be an absolute http(s) url", step.Name)
+		}
+		if step.TimeoutSeconds < 0 {
+			return nil, fmt.Errorf("step %s: timeout must not be negative", step.Name)
+		}
+
+		step.extract = make(map[string]*regexp.Regexp)
+		for name, expr := range step.Extract {
+			pattern, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("step %s: invalid extract %s: %v", step.Name, name, err)
+			}
+			if pattern.NumSubexp() != 1 {
+				return nil, fmt.Errorf("step %s: extract %s must have one group", step.Name, name)
+			}
+			step.extract[name] = pattern
+		}
+	}
+
+	return &journey, nil
+}
+
+func substitute(value string, variables map[string]string) string {
+	return journeyVariable.ReplaceAllStringFunc(value, func(match string) string {
+		name := journeyVariable.FindStringSubmatch(match)[1]
+		if value, found := variables[name]; found {
+			return value
+		}
+
+		return match
+	})
+}
+
+func newJourneyClient() (*http.Client, error) {
+	tlsConfig, err := nexcrypto.ClientTLSConfig("")
+	if err != nil {
+		return nil, err
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Jar:       jar,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+	}, nil
+}
+
+// runStep returns the status and the (truncated) body of the response.
+func runStep(client *http.Client, step *JourneyStep, variables map[string]string) (int, string, string, error) {
+	timeout := defaultJourneyStepTimeout
+	if step.TimeoutSeconds > 0 {
+		timeout = time.Duration(step.TimeoutSeconds) * time.Second
+	}
+	client.Timeout = timeout
+
+	var body io.Reader
+	if step.Body != "" {
+		body = strings.NewReader(substitute(step.Body, variables))
+	}
+
+	req, err := http.NewRequest(step.Method, substitute(step.Url, variables), body)
+	if err != nil {
+		return 0, "", "", err
+	}
+	req.Header.Set("User-Agent", "NexClipper-Synthetic/1.0")
+	for name, value := range step.Headers {
+		req.Header.Set(name, substitute(value, variables))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxJourneyBody))
+	if err != nil {
+		return resp.StatusCode, "", "", err
+	}
+
+	return resp.StatusCode, string(data), resp.Header.Get("Content-Type"), nil
+}
+
+func checkStep(step *JourneyStep, status int, body string) error {
+	if step.Expect.Status != 0 {
+		if status != step.Expect.Status {
+			return fmt.Errorf("expected status %d, got %d", step.Expect.Status, status)
+		}
+	} else if status >= 400 {
+		return fmt.Errorf("unexpected status %d", status)
+	}
+
+	for _, text := range step.Expect.Contains {
+		if !strings.Contains(body, text) {
+			return fmt.Errorf("response does not contain %q", text)
+		}
+	}
+	for _, text := range step.Expect.NotContains {
+		if strings.Contains(body, text) {
+			return fmt.Errorf("response contains %q", text)
+		}
+	}
+
+	return nil
+}
+
+// RunJourney runs the steps of the journey in order.
+func RunJourney(journey *Journey) *JourneyResult {
+	result := &JourneyResult{
+		Journey:   journey.Name,
+		StartedTs: time.Now(),
+		Success:   true,
+		Steps:     make([]JourneyStepResult, 0, len(journey.Steps)),
+	}
+	defer func() {
+		result.DurationMs = float64(time.Since(result.StartedTs)) / float64(time.Millisecond)
+	}()
+
+	client, err := newJourneyClient()
+	if err != nil {
+		result.Success = false
+		result.Error = err.Error()
+		return result
+	}
+
+	variables := make(map[string]string)
+	for idx := range journey.Steps {
+		step := &journey.Steps[idx]
+
+		start := time.Now()
+		status, body, contentType, err := runStep(client, step, variables)
+		stepResult := JourneyStepResult{
+			Name:       step.Name,
+			Status:     status,
+			DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+			Success:    true,
+		}
+
+		if err == nil {
+			err = checkStep(step, status, body)
+		}
+		if err == nil {
+			for name, pattern := range step.extract {
+				match := pattern.FindStringSubmatch(body)
+				if match == nil {
+					err = fmt.Errorf("nothing to extract for %s", name)
+					break
+				}
+				variables[name] = match[1]
+			}
+		}
+
+		if err != nil {
+			stepResult.Success = false
+			stepResult.Error = err.Error()
+			result.Steps = append(result.Steps, stepResult)
+
+			result.Success = false
+			result.Error = fmt.Sprintf("%s: %v", step.Name, err)
+			result.FailedStep = step.Name
+			result.Body = body
+			result.ContentType = contentType
+			return result
+		}
+
+		result.Steps = append(result.Steps, stepResult)
+	}
+
+	return result
+}
@@ -0,0 +1,305 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package nexprobe checks hosts and services from the outside: one-shot
+// snapshots of hosts without an agent, and scripted HTTP journeys.
+package nexprobe
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/NexClipper/NexClipper/pkg/nexcrypto"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SourceSSH = "ssh"
+
+type SSHConfig struct {
+	User           string
+	Port           int
+	Password       string
+	PrivateKey     []byte
+	KnownHostsFile string
+	Insecure       bool
+	Timeout        time.Duration
+}
+
+type Disk struct {
+	Filesystem string `json:"filesystem"`
+	MountPoint string `json:"mount_point"`
+	TotalKb    uint64 `json:"total_kb"`
+	UsedKb     uint64 `json:"used_kb"`
+	FreeKb     uint64 `json:"free_kb"`
+}
+
+type Snapshot struct {
+	Host            string    `json:"host"`
+	Source          string    `json:"source"`
+	Hostname        string    `json:"hostname"`
+	Os              string    `json:"os"`
+	Kernel          string    `json:"kernel"`
+	Arch            string    `json:"arch"`
+	Platform        string    `json:"platform"`
+	PlatformVersion string    `json:"platform_version"`
+	UptimeSeconds   float64   `json:"uptime_seconds"`
+	Load1           float64   `json:"load1"`
+	Load5           float64   `json:"load5"`
+	Load15          float64   `json:"load15"`
+	CpuCount        int       `json:"cpu_count"`
+	MemTotalKb      uint64    `json:"mem_total_kb"`
+	MemAvailableKb  uint64    `json:"mem_available_kb"`
+	SwapTotalKb     uint64    `json:"swap_total_kb"`
+	SwapFreeKb      uint64    `json:"swap_free_kb"`
+	Disks           []Disk    `json:"disks"`
+	CollectedTs     time.Time `json:"collected_ts"`
+	Duration        string    `json:"duration"`
+}
+
+// probeScript prints each section behind a marker line so the whole
+// snapshot is collected with a single SSH session.
+const probeScript = `export LC_ALL=C
+echo '@@hostname'; hostname
+echo '@@uname'; uname -srm
+echo '@@os-release'; cat /etc/os-release 2>/dev/null
+echo '@@uptime'; cat /proc/uptime 2>/dev/null
+echo '@@loadavg'; cat /proc/loadavg 2>/dev/null
+echo '@@nproc'; nproc 2>/dev/null || grep -c ^processor /proc/cpuinfo
+echo '@@meminfo'; cat /proc/meminfo 2>/dev/null
+echo '@@df'; df -P -k -x tmpfs -x devtmpfs -x overlay -x squashfs 2>/dev/null
+`
+
+func hostKeyCallback(config SSHConfig) (ssh.HostKeyCallback, error) {
+	if config.Insecure {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	knownHostsFile := config.KnownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	return knownhosts.New(knownHostsFile)
+}
+
+func clientConfig(config SSHConfig) (*ssh.ClientConfig, error) {
+	var auths []ssh.AuthMethod
+
+	if len(config.PrivateKey) > 0 {
+		signer, err := ssh.ParsePrivateKey(config.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key: %v", err)
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+	if config.Password != "" {
+		auths = append(auths, ssh.Password(config.Password))
+	}
+	if len(auths) == 0 {
+		return nil, fmt.Errorf("missing private key or password")
+	}
+
+	callback, err := hostKeyCallback(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts: %v", err)
+	}
+
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	sshConfig := &ssh.ClientConfig{
+		User:            config.User,
+		Auth:            auths,
+		HostKeyCallback: callback,
+		Timeout:         timeout,
+	}
+	nexcrypto.RestrictSSH(sshConfig)
+
+	return sshConfig, nil
+}
+
+// ProbeSSH connects to the host and collects a snapshot of its state.
+func ProbeSSH(host string, config SSHConfig) (*Snapshot, error) {
+	startTs := time.Now()
+
+	sshConfig, err := clientConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	port := config.Port
+	if port == 0 {
+		port = 22
+	}
+
+	client, err := ssh.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)), sshConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	output, err := session.Output(probeScript)
+	if err != nil && len(output) == 0 {
+		return nil, fmt.Errorf("failed to run probe: %v", err)
+	}
+
+	snapshot := ParseSnapshot(string(output))
+	snapshot.Host = host
+	snapshot.Source = SourceSSH
+	snapshot.CollectedTs = startTs
+	snapshot.Duration = time.Since(startTs).String()
+
+	return snapshot, nil
+}
+
+func splitSections(output string) map[string][]string {
+	sections := make(map[string][]string)
+
+	var current string
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "@@") {
+			current = strings.TrimPrefix(line, "@@")
+			continue
+		}
+		if current != "" {
+			sections[current] = append(sections[current], line)
+		}
+	}
+
+	return sections
+}
+
+func parseKb(value string) uint64 {
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return 0
+	}
+
+	kb, _ := strconv.ParseUint(fields[0], 10, 64)
+	return kb
+}
+
+// ParseSnapshot parses the output of the probe script.
+func ParseSnapshot(output string) *Snapshot {
+	snapshot := &Snapshot{Disks: make([]Disk, 0, 4)}
+	sections := splitSections(output)
+
+	if lines := sections["hostname"]; len(lines) > 0 {
+		snapshot.Hostname = strings.TrimSpace(lines[0])
+	}
+
+	if lines := sections["uname"]; len(lines) > 0 {
+		fields := strings.Fields(lines[0])
+		if len(fields) >= 3 {
+			snapshot.Os = strings.ToLower(fields[0])
+			snapshot.Kernel = fields[1]
+			snapshot.Arch = fields[2]
+		}
+	}
+
+	for _, line := range sections["os-release"] {
+		pair := strings.SplitN(line, "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+
+		value := strings.Trim(pair[1], `"`)
+		switch pair[0] {
+		case "ID":
+			snapshot.Platform = value
+		case "VERSION_ID":
+			snapshot.PlatformVersion = value
+		}
+	}
+
+	if lines := sections["uptime"]; len(lines) > 0 {
+		fields := strings.Fields(lines[0])
+		if len(fields) > 0 {
+			snapshot.UptimeSeconds, _ = strconv.ParseFloat(fields[0], 64)
+		}
+	}
+
+	if lines := sections["loadavg"]; len(lines) > 0 {
+		fields := strings.Fields(lines[0])
+		if len(fields) >= 3 {
+			snapshot.Load1, _ = strconv.ParseFloat(fields[0], 64)
+			snapshot.Load5, _ = strconv.ParseFloat(fields[1], 64)
+			snapshot.Load15, _ = strconv.ParseFloat(fields[2], 64)
+		}
+	}
+
+	if lines := sections["nproc"]; len(lines) > 0 {
+		snapshot.CpuCount, _ = strconv.Atoi(strings.TrimSpace(lines[0]))
+	}
+
+	for _, line := range sections["meminfo"] {
+		pair := strings.SplitN(line, ":", 2)
+		if len(pair) != 2 {
+			continue
+		}
+
+		switch pair[0] {
+		case "MemTotal":
+			snapshot.MemTotalKb = parseKb(pair[1])
+		case "MemAvailable":
+			snapshot.MemAvailableKb = parseKb(pair[1])
+		case "SwapTotal":
+			snapshot.SwapTotalKb = parseKb(pair[1])
+		case "SwapFree":
+			snapshot.SwapFreeKb = parseKb(pair[1])
+		}
+	}
+
+	for idx, line := range sections["df"] {
+		// skip the header line
+		if idx == 0 {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+
+		disk := Disk{Filesystem: fields[0], MountPoint: fields[5]}
+		disk.TotalKb, _ = strconv.ParseUint(fields[1], 10, 64)
+		disk.UsedKb, _ = strconv.ParseUint(fields[2], 10, 64)
+		disk.FreeKb, _ = strconv.ParseUint(fields[3], 10, 64)
+		snapshot.Disks = append(snapshot.Disks, disk)
+	}
+
+	return snapshot
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexproxy
+
+import (
+	"context"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"log"
+	"sync"
+	"time"
+)
+
+type bufferedReport struct {
+	agentUuid    string
+	forwardedFor string
+
+	metrics    *pb.Metrics
+	k8sMetrics *pb.K8SMetrics
+}
+
+// ReportBuffer keeps metric reports until the next flush. Reports of the
+// same agent are merged so that one request per agent is sent per flush.
+// When the server is unreachable the reports stay queued; once MaxReports
+// is exceeded the oldest ones are dropped.
+type ReportBuffer struct {
+	sync.Mutex
+
+	maxReports int
+	reports    []*bufferedReport
+	dropped    uint64
+}
+
+func NewReportBuffer(maxReports int) *ReportBuffer {
+	return &ReportBuffer{
+		maxReports: maxReports,
+		reports:    make([]*bufferedReport, 0, 64),
+	}
+}
+
+func (b *ReportBuffer) addMetrics(agentUuid, forwardedFor string, in *pb.Metrics) {
+	b.Lock()
+	defer b.Unlock()
+
+	// only the tail is merged so the report order is preserved
+	if n := len(b.reports); n > 0 {
+		last := b.reports[n-1]
+		if last.agentUuid == agentUuid && last.metrics != nil {
+			last.metrics.Metrics = append(last.metrics.Metrics, in.Metrics...)
+			return
+		}
+	}
+
+	b.push(&bufferedReport{agentUuid: agentUuid, forwardedFor: forwardedFor, metrics: in})
+}
+
+func (b *ReportBuffer) addK8sMetrics(agentUuid, forwardedFor string, in *pb.K8SMetrics) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.push(&bufferedReport{agentUuid: agentUuid, forwardedFor: forwardedFor, k8sMetrics: in})
+}
+
+func (b *ReportBuffer) push(report *bufferedReport) {
+	b.reports = append(b.reports, report)
+
+	if b.maxReports > 0 && len(b.reports) > b.maxReports {
+		overflow := len(b.reports) - b.maxReports
+		b.reports = b.reports[overflow:]
+		b.dropped += uint64(overflow)
+		log.Printf("Buffer: full, dropped %d oldest reports (%d in total)\n", overflow, b.dropped)
+	}
+}
+
+func (b *ReportBuffer) take() []*bufferedReport {
+	b.Lock()
+	defer b.Unlock()
+
+	reports := b.reports
+	b.reports = make([]*bufferedReport, 0, 64)
+
+	return reports
+}
+
+// requeue puts unsent reports back in front of the ones received meanwhile.
+func (b *ReportBuffer) requeue(reports []*bufferedReport) {
+	b.Lock()
+	defer b.Unlock()
+
+	pending := b.reports
+	b.reports = make([]*bufferedReport, 0, len(reports)+len(pending))
+	for _, report := range append(reports, pending...) {
+		b.push(report)
+	}
+}
+
+func (b *ReportBuffer) flush(ctx context.Context, client pb.CollectorClient) {
+	reports := b.take()
+	if len(reports) == 0 {
+		return
+	}
+
+	for idx, report := range reports {
+		err := sendReport(ctx, client, report)
+		if err == nil {
+			continue
+		}
+
+		switch status.Code(err) {
+		case codes.Unavailable, codes.DeadlineExceeded:
+			log.Printf("Buffer: server unreachable, %d reports kept: %v\n", len(reports)-idx, err)
+			b.requeue(reports[idx:])
+			return
+		default:
+			// rejected by the server, retrying would not help
+			log.Printf("Buffer: report of agent %s rejected: %v\n", report.agentUuid, err)
+		}
+	}
+}
+
+func sendReport(ctx context.Context, client pb.CollectorClient, report *bufferedReport) error {
+	md := metadata.Pairs("UUID", report.agentUuid)
+	if report.forwardedFor != "" {
+		md.Set(forwardedForKey, report.forwardedFor)
+	}
+	ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(ctx, md), 30*time.Second)
+	defer cancel()
+
+	var err error
+	switch {
+	case report.metrics != nil:
+		_, err = client.ReportMetrics(ctx, report.metrics)
+	case report.k8sMetrics != nil:
+		_, err = client.ReportK8SMetrics(ctx, report.k8sMetrics)
+	default:
+		err = fmt.Errorf("empty report")
+	}
+
+	return err
+}
@@ -0,0 +1,197 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexproxy
+
+import (
+	"context"
+	pb "github.com/NexClipper/NexClipper/api"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io"
+	"net"
+)
+
+// forwardedForKey carries the address of the agent so the server does not
+// record the proxy as the public address of every agent behind it.
+const forwardedForKey = "x-forwarded-for"
+
+func forwardedFor(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		// keep the original address when proxies are chained
+		if values := md.Get(forwardedForKey); len(values) > 0 {
+			return values[0]
+		}
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+
+	return host
+}
+
+func agentUuid(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	values := md.Get("UUID")
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+// outgoingContext passes the agent metadata on to the server.
+func outgoingContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+
+	if address := forwardedFor(ctx); address != "" {
+		md.Set(forwardedForKey, address)
+	}
+
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+func accepted() *pb.Response {
+	return &pb.Response{
+		Success: true,
+		Code:    0,
+		Error:   "",
+	}
+}
+
+func (s *NexProxy) Ping(stream pb.Collector_PingServer) error {
+	ctx, cancel := context.WithCancel(outgoingContext(stream.Context()))
+	defer cancel()
+
+	upstream, err := s.client.Ping(ctx)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "server unreachable: %v", err)
+	}
+
+	errs := make(chan error, 2)
+
+	go func() {
+		for {
+			in, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := upstream.Send(in); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			in, err := upstream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			if err := stream.Send(in); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	if err := <-errs; err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+func (s *NexProxy) UpdateAgent(ctx context.Context, in *pb.Agent) (*pb.Response, error) {
+	return s.client.UpdateAgent(outgoingContext(ctx), in)
+}
+
+func (s *NexProxy) UpdateProcess(ctx context.Context, in *pb.ProcessAll) (*pb.Response, error) {
+	return s.client.UpdateProcess(outgoingContext(ctx), in)
+}
+
+func (s *NexProxy) UpdateContainer(ctx context.Context, in *pb.ContainerAll) (*pb.Response, error) {
+	return s.client.UpdateContainer(outgoingContext(ctx), in)
+}
+
+func (s *NexProxy) UpdateK8SCluster(ctx context.Context, in *pb.K8SCluster) (*pb.Response, error) {
+	return s.client.UpdateK8SCluster(outgoingContext(ctx), in)
+}
+
+func (s *NexProxy) ReportMetrics(ctx context.Context, in *pb.Metrics) (*pb.Response, error) {
+	uuid := agentUuid(ctx)
+	if uuid == "" {
+		return nil, status.Error(codes.PermissionDenied, "invalid agent")
+	}
+
+	s.buffer.addMetrics(uuid, forwardedFor(ctx), in)
+
+	return accepted(), nil
+}
+
+func (s *NexProxy) ReportK8SMetrics(ctx context.Context, in *pb.K8SMetrics) (*pb.Response, error) {
+	uuid := agentUuid(ctx)
+	if uuid == "" {
+		return nil, status.Error(codes.PermissionDenied, "invalid agent")
+	}
+
+	s.buffer.addK8sMetrics(uuid, forwardedFor(ctx), in)
+
+	return accepted(), nil
+}
+
+func (s *NexProxy) ReportNodeMetrics(ctx context.Context, in *pb.NodeMetrics) (*pb.Response, error) {
+	return s.client.ReportNodeMetrics(outgoingContext(ctx), in)
+}
+
+func (s *NexProxy) ReportProcessMetrics(ctx context.Context, in *pb.ProcessMetrics) (*pb.Response, error) {
+	return s.client.ReportProcessMetrics(outgoingContext(ctx), in)
+}
+
+func (s *NexProxy) ReportContainerMetrics(ctx context.Context, in *pb.ContainerMetrics) (*pb.Response, error) {
+	return s.client.ReportContainerMetrics(outgoingContext(ctx), in)
+}
+
+// Tail metrics and command results are interactive, they are never delayed.
+
+func (s *NexProxy) ReportTailMetrics(ctx context.Context, in *pb.TailMetrics) (*pb.Response, error) {
+	return s.client.ReportTailMetrics(outgoingContext(ctx), in)
+}
+
+func (s *NexProxy) ReportCommandResult(ctx context.Context, in *pb.CommandResult) (*pb.Response, error) {
+	return s.client.ReportCommandResult(outgoingContext(ctx), in)
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexproxy
+
+import (
+	"context"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/keepalive"
+	"log"
+	"net"
+	"time"
+)
+
+// NexProxy runs at a remote site. Agents connect to it as if it were the
+// server; it keeps a single connection to the central server, batches the
+// metric reports of all agents and buffers them while the server is
+// unreachable.
+
+const (
+	AppName         = "NexProxy"
+	AppDescription  = "NexProxy for NexClipper Monitoring System"
+	NexProxyVersion = "0.3.0"
+)
+
+var kaep = keepalive.EnforcementPolicy{
+	MinTime:             5 * time.Second,
+	PermitWithoutStream: true,
+}
+
+var kasp = keepalive.ServerParameters{
+	MaxConnectionIdle: 15 * time.Second,
+	Time:              5 * time.Second,
+	Timeout:           1 * time.Second,
+}
+
+var kacp = keepalive.ClientParameters{
+	Time:                10 * time.Second,
+	Timeout:             time.Second,
+	PermitWithoutStream: true,
+}
+
+type ProxyConfig struct {
+	BindAddress     string
+	AgentListenPort int
+	ServerAddress   string
+}
+
+type BufferConfig struct {
+	FlushInterval int
+	MaxReports    int
+	Compression   bool
+}
+
+type Config struct {
+	Proxy  ProxyConfig
+	Buffer BufferConfig
+}
+
+type NexProxy struct {
+	config *Config
+
+	conn   *grpc.ClientConn
+	client pb.CollectorClient
+
+	buffer *ReportBuffer
+}
+
+func NewNexProxy() *NexProxy {
+	return &NexProxy{
+		config: &Config{
+			Proxy: ProxyConfig{
+				BindAddress:     "0.0.0.0",
+				AgentListenPort: 18000,
+			},
+			Buffer: BufferConfig{
+				FlushInterval: 10,
+				MaxReports:    10000,
+				Compression:   true,
+			},
+		},
+	}
+}
+
+func (s *NexProxy) connectServer() error {
+	options := []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithKeepaliveParams(kacp),
+	}
+	if s.config.Buffer.Compression {
+		options = append(options, grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)))
+	}
+
+	// not blocking: the connection is re-established in the background,
+	// reports are buffered in the meantime
+	conn, err := grpc.Dial(s.config.Proxy.ServerAddress, options...)
+	if err != nil {
+		return err
+	}
+
+	s.conn = conn
+	s.client = pb.NewCollectorClient(conn)
+
+	return nil
+}
+
+func (s *NexProxy) flushInterval() time.Duration {
+	if s.config.Buffer.FlushInterval > 0 {
+		return time.Duration(s.config.Buffer.FlushInterval) * time.Second
+	}
+
+	return 10 * time.Second
+}
+
+func (s *NexProxy) InitFlusher() {
+	for range time.Tick(s.flushInterval()) {
+		s.buffer.flush(context.Background(), s.client)
+	}
+}
+
+func (s *NexProxy) Start() error {
+	if s.config.Proxy.ServerAddress == "" {
+		return fmt.Errorf("missing server address")
+	}
+
+	if err := s.connectServer(); err != nil {
+		return err
+	}
+	defer s.conn.Close()
+
+	s.buffer = NewReportBuffer(s.config.Buffer.MaxReports)
+
+	listenPort := fmt.Sprintf("%s:%d",
+		s.config.Proxy.BindAddress, s.config.Proxy.AgentListenPort)
+	listen, err := net.Listen("tcp", listenPort)
+	if err != nil {
+		return err
+	}
+	log.Println("Proxy: listen at", listenPort)
+
+	srv := grpc.NewServer(
+		grpc.KeepaliveEnforcementPolicy(kaep),
+		grpc.KeepaliveParams(kasp))
+
+	pb.RegisterCollectorServer(srv, s)
+
+	go s.InitFlusher()
+
+	if err := srv.Serve(listen); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *NexProxy) SetProxyConfig(bindAddress string, agentPort int, serverAddress string) {
+	s.config.Proxy.BindAddress = bindAddress
+	s.config.Proxy.AgentListenPort = agentPort
+	s.config.Proxy.ServerAddress = serverAddress
+}
+
+func (s *NexProxy) SetBufferConfig(flushInterval, maxReports int, compression bool) {
+	s.config.Buffer.FlushInterval = flushInterval
+	s.config.Buffer.MaxReports = maxReports
+	s.config.Buffer.Compression = compression
+}
@@ -0,0 +1,134 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+// Every API request gets an id, taken from the X-Request-Id header of a
+// proxy in front of the server or generated, which is returned in the
+// same header and added to the log lines of the handler and to the access
+// log, one line per request. The time spent in queries is summed over the
+// queries the handler ran through requestDB.
+
+const (
+	requestIdHeader = "X-Request-Id"
+	requestIdKey    = "request_id"
+	requestStatsKey = "request_stats"
+)
+
+var requestIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type requestStats struct {
+	// queryTime is the time spent in queries, in nanoseconds
+	queryTime int64
+}
+
+func (r *requestStats) addQueryTime(queryTime time.Duration) {
+	atomic.AddInt64(&r.queryTime, int64(queryTime))
+}
+
+func newRequestId() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// requestId returns the id of the request, empty outside of a request.
+func requestId(c *gin.Context) string {
+	return c.GetString(requestIdKey)
+}
+
+// requestLog returns the api logger with the request id of the request.
+func requestLog(c *gin.Context) *zap.SugaredLogger {
+	if id := requestId(c); id != "" {
+		return apiLog.With(requestIdKey, id)
+	}
+
+	return apiLog.With()
+}
+
+// withRequestStats makes QueryRowsWithTime account the queries of db to
+// the request.
+func withRequestStats(c *gin.Context, db *gorm.DB) *gorm.DB {
+	value, found := c.Get(requestStatsKey)
+	if !found {
+		return db
+	}
+
+	return db.Set(requestStatsKey, value)
+}
+
+func addQueryTime(db *gorm.DB, queryTime time.Duration) {
+	if value, found := db.Get(requestStatsKey); found {
+		if stats, ok := value.(*requestStats); ok {
+			stats.addQueryTime(queryTime)
+		}
+	}
+}
+
+// AccessLogMiddleware assigns the request id and writes the access log.
+func (s *NexServer) AccessLogMiddleware(router string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.GetHeader(requestIdHeader)
+		if !requestIdPattern.MatchString(id) {
+			id = newRequestId()
+		}
+		c.Set(requestIdKey, id)
+		c.Header(requestIdHeader, id)
+
+		stats := &requestStats{}
+		c.Set(requestStatsKey, stats)
+
+		c.Next()
+
+		bytes := c.Writer.Size()
+		if bytes < 0 {
+			bytes = 0
+		}
+		fields := []interface{}{
+			requestIdKey, id,
+			"router", router,
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"client_ip", s.requestClientIp(c),
+			"user_agent", c.Request.UserAgent(),
+			"bytes", bytes,
+			"latency_ms", float64(time.Since(start)) / float64(time.Millisecond),
+			"db_query_time_ms", float64(atomic.LoadInt64(&stats.queryTime)) / float64(time.Millisecond),
+		}
+		if errors := c.Errors.ByType(gin.ErrorTypePrivate).String(); errors != "" {
+			fields = append(fields, "error", errors)
+		}
+		accessLog.Infow("request", fields...)
+	}
+}
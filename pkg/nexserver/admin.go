@@ -0,0 +1,126 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http/pprof"
+	"strings"
+)
+
+// SetupAdminHandler serves sensitive endpoints on a separate listener,
+// which is bound to localhost by default.
+func (s *NexServer) SetupAdminHandler() {
+	if s.config.Server.AdminPort == 0 {
+		apiLog.Infof("Admin: admin endpoints disabled")
+		return
+	}
+
+	router := gin.New()
+	router.Use(s.AccessLogMiddleware("admin"), gin.Recovery(), s.SiemMiddleware("admin"), s.AdminAuth)
+
+	admin := router.Group("/api/v1/admin")
+	{
+		admin.GET("/status", s.ApiStatus)
+		admin.GET("/runtime", s.ApiAdminRuntime)
+		admin.GET("/goroutines", s.ApiAdminGoroutines)
+		admin.GET("/diagnostics", s.ApiAdminDiagnostics)
+		admin.GET("/grpc_stats", s.ApiAdminGrpcStats)
+		admin.GET("/ingest/validation", s.ApiAdminIngestValidation)
+		admin.GET("/gc", s.ApiAdminGCStatus)
+		admin.POST("/gc", s.ApiAdminGCRun)
+		admin.GET("/cmdb", s.ApiAdminCMDBStatus)
+		admin.POST("/cmdb", s.ApiAdminCMDBRun)
+		admin.GET("/bundles", s.ApiAdminBundleStatus)
+		admin.GET("/shards", s.ApiAdminShards)
+		admin.GET("/jobs", s.ApiAdminJobs)
+		admin.GET("/jobs/:job/runs", s.ApiAdminJobRuns)
+		admin.POST("/jobs/:job/run", s.ApiAdminRunJob)
+		admin.POST("/jobs/:job/skip", s.ApiAdminSkipJob)
+		admin.GET("/log_level", s.ApiAdminLogLevel)
+		admin.PUT("/log_level", s.ApiAdminSetLogLevel)
+		admin.GET("/features", s.ApiAdminFeatures)
+		admin.PUT("/features/:feature", s.ApiAdminSetFeature)
+		admin.DELETE("/features/:feature", s.ApiAdminResetFeature)
+		admin.POST("/bundles/export", s.ApiAdminBundleExport)
+		admin.POST("/bundles/import", s.ApiAdminBundleImport)
+		admin.POST("/embed_tokens", s.ApiAdminCreateEmbedToken)
+		admin.POST("/embed_tokens/rotate", s.ApiAdminRotateEmbedKey)
+		admin.GET("/users", s.ApiAdminUsers)
+		admin.POST("/users", s.ApiAdminCreateUser)
+		admin.PUT("/users/:userId", s.ApiAdminUpdateUser)
+		admin.DELETE("/users/:userId", s.ApiAdminDeleteUser)
+		admin.GET("/api_keys", s.ApiAdminApiKeys)
+		admin.POST("/api_keys", s.ApiAdminCreateApiKey)
+		admin.PUT("/api_keys/:keyId", s.ApiAdminUpdateApiKey)
+		admin.DELETE("/api_keys/:keyId", s.ApiAdminDeleteApiKey)
+		admin.GET("/usage", s.ApiAdminUsage)
+		admin.GET("/rate_limits", s.ApiAdminRateLimits)
+		admin.GET("/gaps", s.ApiAdminGaps)
+		admin.POST("/agents/expire", s.ApiAdminExpireAgents)
+		admin.GET("/schema", s.ApiAdminSchema)
+		admin.POST("/clusters/:clusterId/probes/ssh", s.ApiProbeSSH)
+	}
+	router.GET("/metrics", s.ApiAdminPrometheus)
+
+	debug := router.Group("/debug/pprof")
+	{
+		debug.GET("/", gin.WrapF(pprof.Index))
+		debug.GET("/cmdline", gin.WrapF(pprof.Cmdline))
+		debug.GET("/profile", gin.WrapF(pprof.Profile))
+		debug.GET("/symbol", gin.WrapF(pprof.Symbol))
+		debug.POST("/symbol", gin.WrapF(pprof.Symbol))
+		debug.GET("/trace", gin.WrapF(pprof.Trace))
+	}
+	for _, profile := range []string{"allocs", "block", "goroutine", "heap", "mutex", "threadcreate"} {
+		debug.GET("/"+profile, gin.WrapH(pprof.Handler(profile)))
+	}
+
+	bindAddress := s.config.Server.AdminBindAddress
+	if bindAddress == "" {
+		bindAddress = "127.0.0.1"
+	}
+
+	go func() {
+		err := s.serveHttp(router, fmt.Sprintf("%s:%d", bindAddress, s.config.Server.AdminPort))
+		if err != nil {
+			apiLog.Errorf("failed admin handler: %v\n", err)
+		}
+	}()
+}
+
+// AdminAuth rejects requests without the configured admin bearer token.
+// Admin endpoints are refused entirely when no token is configured.
+func (s *NexServer) AdminAuth(c *gin.Context) {
+	adminToken := s.config.Server.AdminToken
+	if adminToken == "" {
+		s.ApiResponseJson(c, 403, "bad", "admin token is not configured")
+		c.Abort()
+		return
+	}
+
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		s.ApiResponseJson(c, 401, "bad", "unauthorized")
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
@@ -0,0 +1,450 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm/dialects/postgres"
+	"sort"
+)
+
+// Collector settings are layered: the global configuration is overridden by
+// the agent's group, which is overridden by the agent itself. The merged
+// result is pushed to the agent as a "config" command.
+
+const (
+	agentConfigSetting = "agent_config"
+
+	AgentConfigLayerGlobal = "global"
+	AgentConfigLayerGroup  = "group"
+	AgentConfigLayerAgent  = "agent"
+)
+
+type agentConfigKey struct {
+	Kind     string
+	Min, Max float64
+}
+
+var agentConfigKeys = map[string]agentConfigKey{
+	"report_interval":   {Kind: "int", Min: 1, Max: 3600},
+	"process_metrics":   {Kind: "bool"},
+	"container_metrics": {Kind: "bool"},
+}
+
+type AgentConfigValues map[string]interface{}
+
+func (values AgentConfigValues) validate() error {
+	for key, value := range values {
+		spec, found := agentConfigKeys[key]
+		if !found {
+			return fmt.Errorf("unknown config key: %s", key)
+		}
+
+		switch spec.Kind {
+		case "bool":
+			if _, ok := value.(bool); !ok {
+				return fmt.Errorf("%s must be a boolean", key)
+			}
+		case "int":
+			number, ok := value.(float64)
+			if !ok || number != float64(int64(number)) || number < spec.Min || number > spec.Max {
+				return fmt.Errorf("%s must be an integer between %v and %v", key, spec.Min, spec.Max)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (values AgentConfigValues) jsonb() postgres.Jsonb {
+	raw, _ := json.Marshal(values)
+
+	return postgres.Jsonb{RawMessage: raw}
+}
+
+func agentConfigValues(raw postgres.Jsonb) AgentConfigValues {
+	values := make(AgentConfigValues)
+
+	if len(raw.RawMessage) > 0 {
+		if err := json.Unmarshal(raw.RawMessage, &values); err != nil {
+			ingestLog.Warnf("AgentConfig: invalid stored configuration: %v\n", err)
+		}
+	}
+
+	return values
+}
+
+func (s *NexServer) globalAgentConfig() AgentConfigValues {
+	var setting Setting
+
+	values := make(AgentConfigValues)
+	if result := s.db.Where("name=?", agentConfigSetting).First(&setting); result.Error != nil {
+		return values
+	}
+	if err := json.Unmarshal([]byte(setting.Value), &values); err != nil {
+		ingestLog.Warnf("AgentConfig: invalid global configuration: %v\n", err)
+	}
+
+	return values
+}
+
+// effectiveAgentConfig merges the layers of the agent and reports which
+// layer each value came from.
+func (s *NexServer) effectiveAgentConfig(agentId uint) (AgentConfigValues, map[string]string) {
+	values := make(AgentConfigValues)
+	sources := make(map[string]string)
+
+	merge := func(layer AgentConfigValues, source string) {
+		for key, value := range layer {
+			values[key] = value
+			sources[key] = source
+		}
+	}
+
+	var agentConfig AgentConfig
+	if result := s.db.Where("agent_id=?", agentId).First(&agentConfig); result.Error != nil {
+		merge(s.globalAgentConfig(), AgentConfigLayerGlobal)
+		return values, sources
+	}
+
+	// canaries see the pending configuration of a rollout in place of the layer
+	global := s.globalAgentConfig()
+	if rollout := s.canaryRollout(&agentConfig, 0); rollout != nil {
+		global = agentConfigValues(rollout.Config)
+	}
+	merge(global, AgentConfigLayerGlobal)
+
+	if agentConfig.AgentGroupID != 0 {
+		var group AgentGroup
+		if result := s.db.Where("id=?", agentConfig.AgentGroupID).First(&group); result.Error == nil {
+			groupConfig := agentConfigValues(group.Config)
+			if rollout := s.canaryRollout(&agentConfig, group.ID); rollout != nil {
+				groupConfig = agentConfigValues(rollout.Config)
+			}
+			merge(groupConfig, AgentConfigLayerGroup)
+		}
+	}
+	merge(agentConfigValues(agentConfig.Config), AgentConfigLayerAgent)
+
+	return values, sources
+}
+
+func (s *NexServer) pushAgentConfig(agent *Agent) {
+	values, _ := s.effectiveAgentConfig(agent.ID)
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	args := make([]string, 0, len(keys))
+	for _, key := range keys {
+		args = append(args, fmt.Sprintf("%s=%v", key, values[key]))
+	}
+
+	if err := s.commands.send(agent.Uuid, newAgentCommand("config", args...)); err != nil {
+		ingestLog.Errorf("AgentConfig: failed to push configuration to %s: %v\n", agent.Uuid, err)
+	}
+}
+
+// pushAgentConfigs re-sends the configuration to the connected agents
+// accepted by the filter, or to every connected agent without one.
+func (s *NexServer) pushAgentConfigs(filter func(agentId uint) bool) {
+	s.RLock()
+	agents := make([]*Agent, 0, len(s.agentMap))
+	for _, agent := range s.agentMap {
+		if filter == nil || filter(agent.ID) {
+			agents = append(agents, agent)
+		}
+	}
+	s.RUnlock()
+
+	for _, agent := range agents {
+		s.pushAgentConfig(agent)
+	}
+}
+
+func (s *NexServer) groupAgentIds(groupId uint) map[uint]bool {
+	var configs []AgentConfig
+
+	agentIds := make(map[uint]bool)
+	if result := s.db.Where("agent_group_id=?", groupId).Find(&configs); result.Error != nil {
+		return agentIds
+	}
+	for _, config := range configs {
+		agentIds[config.AgentID] = true
+	}
+
+	return agentIds
+}
+
+func (s *NexServer) ApiGlobalAgentConfig(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    s.globalAgentConfig(),
+	})
+}
+
+func (s *NexServer) ApiUpdateGlobalAgentConfig(c *gin.Context) {
+	var values AgentConfigValues
+	if err := c.ShouldBindJSON(&values); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+	if err := values.validate(); err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	raw, _ := json.Marshal(values)
+
+	var setting Setting
+	result := s.requestDB(c).Where(Setting{Name: agentConfigSetting}).
+		Assign(Setting{Value: string(raw)}).FirstOrCreate(&setting)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to save configuration: %v", result.Error)
+		return
+	}
+
+	go s.pushAgentConfigs(nil)
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+type AgentGroupItem struct {
+	Id          uint              `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Config      AgentConfigValues `json:"config"`
+	Agents      int               `json:"agents"`
+}
+
+func (s *NexServer) ApiAgentGroupList(c *gin.Context) {
+	var groups []AgentGroup
+
+	if result := s.requestDB(c).Order("id").Find(&groups); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	items := make([]AgentGroupItem, 0, len(groups))
+	for _, group := range groups {
+		items = append(items, AgentGroupItem{
+			Id:          group.ID,
+			Name:        group.Name,
+			Description: group.Description,
+			Config:      agentConfigValues(group.Config),
+			Agents:      len(s.groupAgentIds(group.ID)),
+		})
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+type agentGroupRequest struct {
+	Name        string            `json:"name" binding:"required"`
+	Description string            `json:"description"`
+	Config      AgentConfigValues `json:"config"`
+}
+
+func (s *NexServer) ApiCreateAgentGroup(c *gin.Context) {
+	var req agentGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+	if err := req.Config.validate(); err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	var existing AgentGroup
+	if result := s.requestDB(c).Where("name=?", req.Name).First(&existing); result.Error == nil {
+		s.ApiResponseJsonf(c, 409, "bad", "agent group %s already exists", req.Name)
+		return
+	}
+
+	group := AgentGroup{
+		Name:        req.Name,
+		Description: req.Description,
+		Config:      req.Config.jsonb(),
+	}
+	if result := s.requestDB(c).Create(&group); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create agent group: %v", result.Error)
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    gin.H{"id": group.ID},
+	})
+}
+
+func (s *NexServer) ApiUpdateAgentGroup(c *gin.Context) {
+	groupId, ok := s.idParam(c, "groupId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid agent group id")
+		return
+	}
+
+	var group AgentGroup
+	if result := s.requestDB(c).Where("id=?", groupId).First(&group); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid agent group id")
+		return
+	}
+
+	var req agentGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+	if err := req.Config.validate(); err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	result := s.requestDB(c).Model(&group).Updates(map[string]interface{}{
+		"name":        req.Name,
+		"description": req.Description,
+		"config":      req.Config.jsonb(),
+	})
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to update agent group: %v", result.Error)
+		return
+	}
+
+	agentIds := s.groupAgentIds(group.ID)
+	go s.pushAgentConfigs(func(agentId uint) bool { return agentIds[agentId] })
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+func (s *NexServer) ApiDeleteAgentGroup(c *gin.Context) {
+	groupId, ok := s.idParam(c, "groupId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid agent group id")
+		return
+	}
+
+	result := s.requestDB(c).Where("id=?", groupId).Delete(&AgentGroup{})
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to delete agent group: %v", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		s.ApiResponseJson(c, 404, "bad", "invalid agent group id")
+		return
+	}
+
+	agentIds := s.groupAgentIds(groupId)
+	s.requestDB(c).Model(&AgentConfig{}).Where("agent_group_id=?", groupId).Update("agent_group_id", 0)
+	go s.pushAgentConfigs(func(agentId uint) bool { return agentIds[agentId] })
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+func (s *NexServer) ApiAgentConfig(c *gin.Context) {
+	agentId, ok := s.idParam(c, "agentId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid agent id")
+		return
+	}
+
+	var agent Agent
+	if result := s.requestDB(c).Where("id=?", agentId).First(&agent); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid agent id")
+		return
+	}
+
+	var agentConfig AgentConfig
+	s.requestDB(c).Where("agent_id=?", agent.ID).First(&agentConfig)
+	effective, sources := s.effectiveAgentConfig(agent.ID)
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"group_id":  agentConfig.AgentGroupID,
+			"canary":    agentConfig.Canary,
+			"config":    agentConfigValues(agentConfig.Config),
+			"effective": effective,
+			"sources":   sources,
+		},
+	})
+}
+
+func (s *NexServer) ApiUpdateAgentConfig(c *gin.Context) {
+	agentId, ok := s.idParam(c, "agentId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid agent id")
+		return
+	}
+
+	var agent Agent
+	if result := s.requestDB(c).Where("id=?", agentId).First(&agent); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid agent id")
+		return
+	}
+
+	type AgentConfigRequest struct {
+		GroupId uint              `json:"group_id"`
+		Canary  bool              `json:"canary"`
+		Config  AgentConfigValues `json:"config"`
+	}
+	var req AgentConfigRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+	if err := req.Config.validate(); err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	if req.GroupId != 0 {
+		var group AgentGroup
+		if result := s.requestDB(c).Where("id=?", req.GroupId).First(&group); result.Error != nil {
+			s.ApiResponseJson(c, 400, "bad", "invalid agent group id")
+			return
+		}
+	}
+
+	var agentConfig AgentConfig
+	result := s.requestDB(c).Where(AgentConfig{AgentID: agent.ID}).
+		Assign(map[string]interface{}{
+			"agent_group_id": req.GroupId,
+			"canary":         req.Canary,
+			"config":         req.Config.jsonb(),
+		}).FirstOrCreate(&agentConfig)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to save configuration: %v", result.Error)
+		return
+	}
+
+	go s.pushAgentConfigs(func(agentId uint) bool { return agentId == agent.ID })
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
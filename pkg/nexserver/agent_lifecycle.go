@@ -0,0 +1,202 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"time"
+)
+
+// A disabled agent is dropped from the connected agents and refused when
+// it registers again, so none of its data is accepted until it is enabled.
+// Deregistering removes the agent itself; its node and metrics stay as
+// history and the machine registers as a new agent if it comes back.
+
+const (
+	EventAgentDeregistered = "agent.deregistered"
+	EventAgentDisabled     = "agent.disabled"
+)
+
+func (s *NexServer) agentParam(c *gin.Context) *Agent {
+	agentId, ok := s.idParam(c, "agentId", false)
+	if !ok {
+		s.ApiResponseJson(c, 400, "bad", "invalid agent id")
+		return nil
+	}
+
+	var agent Agent
+	if result := s.requestDB(c).Where("id=?", agentId).First(&agent); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "agent not found")
+		return nil
+	}
+
+	return &agent
+}
+
+func (s *NexServer) DisableAgent(agent *Agent, disabled bool) error {
+	if disabled {
+		s.disconnectAgent(agent.Uuid)
+	}
+
+	result := s.db.Model(&Agent{}).Where("id=?", agent.ID).Update("disabled", disabled)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if disabled {
+		s.emitEvent(EventAgentDisabled, agent.ClusterID, map[string]interface{}{
+			"agent_uuid": agent.Uuid,
+		})
+	}
+	s.purgeAll()
+	clusterLog.Infof("Agent: agent %d disabled=%v\n", agent.ID, disabled)
+
+	return nil
+}
+
+func (s *NexServer) DeregisterAgent(agent *Agent) error {
+	s.disconnectAgent(agent.Uuid)
+
+	tx := s.db.Begin()
+	for _, statement := range []string{
+		"UPDATE nodes SET agent_id=0 WHERE agent_id=?",
+		"DELETE FROM agent_configs WHERE agent_id=?",
+		"DELETE FROM agent_collectors WHERE agent_id=?",
+		"DELETE FROM agents WHERE id=?",
+	} {
+		if result := tx.Exec(statement, agent.ID); result.Error != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to deregister agent %d: %v", agent.ID, result.Error)
+		}
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return result.Error
+	}
+
+	s.purgeAll()
+	s.emitEvent(EventAgentDeregistered, agent.ClusterID, map[string]interface{}{
+		"agent_uuid": agent.Uuid,
+	})
+	clusterLog.Infof("Agent: agent %d (%s) deregistered\n", agent.ID, agent.Uuid)
+
+	return nil
+}
+
+func (s *NexServer) ApiDeregisterAgent(c *gin.Context) {
+	agent := s.agentParam(c)
+	if agent == nil {
+		return
+	}
+
+	if err := s.DeregisterAgent(agent); err != nil {
+		s.ApiResponseJson(c, 500, "bad", err.Error())
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+func (s *NexServer) ApiDisableAgent(c *gin.Context) {
+	agent := s.agentParam(c)
+	if agent == nil {
+		return
+	}
+
+	if err := s.DisableAgent(agent, true); err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to disable agent: %v", err)
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+func (s *NexServer) ApiEnableAgent(c *gin.Context) {
+	agent := s.agentParam(c)
+	if agent == nil {
+		return
+	}
+
+	if err := s.DisableAgent(agent, false); err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to enable agent: %v", err)
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+// ApiAdminExpireAgents deregisters the agents offline for longer than
+// offline_hours.
+func (s *NexServer) ApiAdminExpireAgents(c *gin.Context) {
+	type ExpireRequest struct {
+		OfflineHours int  `json:"offline_hours" binding:"required"`
+		DryRun       bool `json:"dry_run"`
+	}
+	var req ExpireRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+	if req.OfflineHours < 1 {
+		s.ApiResponseJson(c, 400, "bad", "offline_hours must be at least 1")
+		return
+	}
+
+	var agents []Agent
+	expiredTs := time.Now().Add(-time.Duration(req.OfflineHours) * time.Hour)
+	result := s.requestDB(c).Where("online=false AND last_contact < ?", expiredTs).Order("id").Find(&agents)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	type ExpiredAgentItem struct {
+		Id         uint      `json:"id"`
+		Uuid       string    `json:"uuid"`
+		ClusterId  uint      `json:"cluster_id"`
+		LastSeenTs time.Time `json:"last_seen_ts"`
+		Error      string    `json:"error,omitempty"`
+	}
+	items := make([]ExpiredAgentItem, 0, len(agents))
+	for idx := range agents {
+		agent := &agents[idx]
+		item := ExpiredAgentItem{
+			Id:         agent.ID,
+			Uuid:       agent.Uuid,
+			ClusterId:  agent.ClusterID,
+			LastSeenTs: agent.LastContact,
+		}
+		if !req.DryRun {
+			// agents reconnecting since the query are left alone
+			if s.findAgent(agent.Uuid) != nil {
+				item.Error = "agent reconnected"
+			} else if err := s.DeregisterAgent(agent); err != nil {
+				item.Error = err.Error()
+			}
+		}
+		items = append(items, item)
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"dry_run": req.DryRun,
+			"agents":  items,
+		},
+	})
+}
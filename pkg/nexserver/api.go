@@ -21,15 +21,19 @@ import (
 	"fmt"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"log"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 func (s *NexServer) SetupApiHandler() {
 	gin.SetMode("release")
-	router := gin.Default()
+	router := gin.New()
+	router.Use(s.AccessLogMiddleware("api"), gin.Recovery())
+	router.Use(s.CompressionMiddleware)
 
 	config := cors.DefaultConfig()
 	config.AllowOrigins = []string{"*"}
@@ -38,23 +42,177 @@ func (s *NexServer) SetupApiHandler() {
 	config.AllowCredentials = true
 
 	router.Use(cors.New(config))
+	router.Use(s.TraceMiddleware)
+	router.Use(s.QueryTimeoutMiddleware)
+	router.Use(s.SiemMiddleware("api"))
+	router.Use(s.AuthMiddleware)
+	router.Use(s.RateLimitMiddleware)
+	router.Use(s.ApiUsageMiddleware)
+
+	router.GET("/embed/:token", s.ApiEmbed(router))
+	router.GET("/status", s.ApiStatusPage)
+	router.GET("/status.json", s.ApiStatusPageJson)
+	router.GET(federateMetricsPath, s.ApiFederate)
 
 	v1 := router.Group("/api/v1")
 	{
 		v1.GET("/health", s.ApiHealth)
+		v1.GET("/version", s.ApiVersion)
+		v1.GET("/federate", s.ApiFederate)
+		v1.GET("/spec", s.ApiSpec(router))
+		v1.GET("/spec/ui", s.ApiSpecUI)
+		v1.POST("/auth/login", s.ApiLogin)
+		v1.POST("/auth/logout", s.ApiLogout)
+		v1.GET("/auth/me", s.ApiAuthMe)
+		v1.GET("/auth/oidc/login", s.ApiOIDCLogin)
+		v1.GET("/auth/oidc/callback", s.ApiOIDCCallback)
+		v1.POST("/write", s.ApiRemoteWrite)
+		v1.POST("/custom_metrics/validate", s.ApiValidateCustomMetrics)
 		v1.GET("/clusters", s.ApiClusterList)
 		v1.GET("/agents", s.ApiAgentListAll)
+		v1.GET("/agent_protocols", s.ApiAgentProtocols)
+		v1.GET("/agent_config", s.ApiGlobalAgentConfig)
+		v1.PUT("/agent_config", s.requireAdmin, s.ApiUpdateGlobalAgentConfig)
 		v1.GET("/nodes", s.ApiNodeListAll)
 		v1.GET("/metric_names", s.ApiMetricNameList)
+		v1.GET("/metric_names/validate", s.ApiValidateMetricName)
+		v1.POST("/variables", s.ApiVariables)
+		v1.GET("/graphql", s.ApiGraphql)
+		v1.POST("/graphql", s.ApiGraphql)
 		v1.GET("/status", s.ApiStatus)
+		v1.POST("/topology", s.requireAdmin, s.ApiImportTopology)
 	}
 
 	clusters := v1.Group("/clusters")
 	{
 		clusters.GET("/:clusterId/agents", s.ApiAgentList)
 		clusters.GET("/:clusterId/nodes", s.ApiNodeList)
+		clusters.POST("/:clusterId/nodes", s.requireAdmin, s.ApiCreateNode)
+		clusters.PUT("/:clusterId/nodes/:nodeId", s.requireAdmin, s.ApiRenameNode)
+		clusters.GET("/:clusterId/containers/orphaned", s.ApiOrphanedContainers)
+		clusters.PUT("/:clusterId/metric_prefix", s.requireAdmin, s.ApiSetClusterMetricPrefix)
+		clusters.PUT("/:clusterId", s.requireAdmin, s.ApiRenameCluster)
+		clusters.DELETE("/:clusterId", s.requireAdmin, s.ApiDeleteCluster)
+		clusters.POST("/:clusterId/restore", s.requireAdmin, s.ApiRestoreCluster)
+		clusters.POST("/:clusterId/merge", s.requireAdmin, s.ApiMergeCluster)
+		clusters.GET("/:clusterId/task", s.ApiClusterTask)
+		clusters.GET("/:clusterId/rollups", s.ApiMetricRollups)
+		clusters.GET("/:clusterId/enrollment_tokens", s.ApiEnrollmentTokenList)
+		clusters.POST("/:clusterId/enrollment_tokens", s.requireAdmin, s.ApiCreateEnrollmentToken)
+		clusters.POST("/:clusterId/enrollment_tokens/:tokenId/rotate", s.requireAdmin, s.ApiRotateEnrollmentToken)
+		clusters.DELETE("/:clusterId/enrollment_tokens/:tokenId", s.requireAdmin, s.ApiRevokeEnrollmentToken)
+		clusters.GET("/:clusterId/topology", s.ApiExportTopology)
+		clusters.GET("/:clusterId/topology/mesh", s.requireFeature(FeatureMeshProbe), s.ApiMeshMatrix)
+		clusters.GET("/:clusterId/probes", s.ApiProbeList)
+		clusters.POST("/:clusterId/probes", s.requireAdmin, s.ApiUploadProbe)
+		clusters.POST("/:clusterId/nodes/:nodeId/diagnostics", s.requireAdmin, s.ApiCreateDiagnosticCapture)
+		clusters.GET("/:clusterId/diagnostics", s.ApiDiagnosticCaptureList)
+		clusters.GET("/:clusterId/diagnostics/:captureId", s.ApiDownloadDiagnosticCapture)
+		clusters.POST("/:clusterId/nodes/:nodeId/profiles", s.requireAdmin, s.ApiCreateProfileCapture)
+		clusters.GET("/:clusterId/profiles", s.ApiProfileCaptureList)
+		clusters.GET("/:clusterId/profiles/:captureId", s.ApiDownloadProfileCapture)
+		clusters.GET("/:clusterId/kernel_events", s.ApiKernelEventList)
+	}
+	k8s := v1.Group("/k8s")
+	{
+		k8s.POST("/:k8sClusterId/nodes", s.requireAdmin, s.ApiCreateK8sNode)
+		k8s.PUT("/:k8sClusterId/nodes/:k8sNodeId", s.requireAdmin, s.ApiRenameK8sNode)
+		k8s.POST("/:k8sClusterId/pods/:podId/containers", s.requireAdmin, s.ApiMapContainerToPod)
+	}
+	subscriptions := v1.Group("/subscriptions")
+	{
+		subscriptions.GET("", s.ApiSubscriptionList)
+		subscriptions.POST("", s.requireAdmin, s.ApiCreateSubscription)
+		subscriptions.PUT("/:subscriptionId", s.requireAdmin, s.ApiUpdateSubscription)
+		subscriptions.DELETE("/:subscriptionId", s.requireAdmin, s.ApiDeleteSubscription)
+		subscriptions.POST("/:subscriptionId/test", s.requireAdmin, s.ApiTestSubscription)
+	}
+	channels := v1.Group("/notification_channels")
+	{
+		channels.GET("", s.ApiSubscriptionList)
+		channels.POST("", s.requireAdmin, s.ApiCreateSubscription)
+		channels.PUT("/:subscriptionId", s.requireAdmin, s.ApiUpdateSubscription)
+		channels.DELETE("/:subscriptionId", s.requireAdmin, s.ApiDeleteSubscription)
+		channels.POST("/:subscriptionId/test", s.requireAdmin, s.ApiTestSubscription)
+	}
+	agents := v1.Group("/agents")
+	{
+		agents.GET("/:agentId/config", s.ApiAgentConfig)
+		agents.GET("/:agentId/collectors", s.ApiAgentCollectors)
+		agents.PUT("/:agentId/config", s.requireAdmin, s.ApiUpdateAgentConfig)
+		agents.DELETE("/:agentId", s.requireAdmin, s.ApiDeregisterAgent)
+		agents.POST("/:agentId/disable", s.requireAdmin, s.ApiDisableAgent)
+		agents.POST("/:agentId/enable", s.requireAdmin, s.ApiEnableAgent)
+	}
+	agentGroups := v1.Group("/agent_groups")
+	{
+		agentGroups.GET("", s.ApiAgentGroupList)
+		agentGroups.POST("", s.requireAdmin, s.ApiCreateAgentGroup)
+		agentGroups.PUT("/:groupId", s.requireAdmin, s.ApiUpdateAgentGroup)
+		agentGroups.DELETE("/:groupId", s.requireAdmin, s.ApiDeleteAgentGroup)
+	}
+	rollouts := v1.Group("/agent_rollouts")
+	{
+		rollouts.GET("", s.ApiAgentRolloutList)
+		rollouts.POST("", s.requireAdmin, s.ApiCreateAgentRollout)
+		rollouts.POST("/:rolloutId/promote", s.requireAdmin, s.ApiPromoteAgentRollout)
+		rollouts.POST("/:rolloutId/halt", s.requireAdmin, s.ApiHaltAgentRollout)
+	}
+	rules := v1.Group("/rules")
+	{
+		rules.GET("", s.ApiAlertRuleList)
+		rules.POST("", s.requireAdmin, s.ApiCreateAlertRule)
+		rules.PUT("/:ruleId", s.requireAdmin, s.ApiUpdateAlertRule)
+		rules.DELETE("/:ruleId", s.requireAdmin, s.ApiDeleteAlertRule)
+	}
+	synthetics := v1.Group("/synthetics")
+	{
+		synthetics.GET("", s.ApiSyntheticJourneyList)
+		synthetics.POST("", s.requireAdmin, s.ApiCreateSyntheticJourney)
+		synthetics.PUT("/:journeyId", s.requireAdmin, s.ApiUpdateSyntheticJourney)
+		synthetics.DELETE("/:journeyId", s.requireAdmin, s.ApiDeleteSyntheticJourney)
+		synthetics.POST("/:journeyId/run", s.requireAdmin, s.ApiRunSyntheticJourney)
+		synthetics.GET("/:journeyId/runs", s.ApiSyntheticRunList)
+		synthetics.GET("/:journeyId/runs/:runId/body", s.ApiSyntheticRunBody)
+	}
+	retention := v1.Group("/retention")
+	{
+		retention.GET("", s.ApiRetentionList)
+		retention.PUT("/default", s.requireAdmin, s.ApiSetDefaultRetention)
+		retention.DELETE("/default", s.requireAdmin, s.ApiDeleteDefaultRetention)
+		retention.PUT("/clusters/:clusterId", s.requireAdmin, s.ApiSetClusterRetention)
+		retention.DELETE("/clusters/:clusterId", s.requireAdmin, s.ApiDeleteClusterRetention)
+	}
+	teams := v1.Group("/teams")
+	{
+		teams.GET("", s.ApiTeamList)
+		teams.POST("", s.requireAdmin, s.ApiCreateTeam)
+		teams.DELETE("/:teamId", s.requireAdmin, s.ApiDeleteTeam)
+		teams.POST("/:teamId/routes", s.requireAdmin, s.ApiCreateTeamRoute)
+		teams.DELETE("/:teamId/routes/:routeId", s.requireAdmin, s.ApiDeleteTeamRoute)
 	}
-	snapshot := v1.Group("/snapshot")
+	cost := v1.Group("/cost", s.requireFeature(FeatureCostReporting))
+	{
+		cost.GET("/budgets", s.ApiCostBudgetList)
+		cost.POST("/budgets", s.requireAdmin, s.ApiCreateCostBudget)
+		cost.DELETE("/budgets/:budgetId", s.requireAdmin, s.ApiDeleteCostBudget)
+	}
+	security := v1.Group("/security", s.requireFeature(FeatureImageScan))
+	{
+		security.GET("/images", s.ApiImageScanList)
+		security.GET("/images/:imageId", s.ApiImageScan)
+		security.POST("/images/:imageId/scan", s.requireAdmin, s.ApiRescanImage)
+	}
+	oncall := v1.Group("/oncall")
+	{
+		oncall.GET("", s.ApiOnCallScheduleList)
+		oncall.POST("", s.requireAdmin, s.ApiCreateOnCallSchedule)
+		oncall.DELETE("/:scheduleId", s.requireAdmin, s.ApiDeleteOnCallSchedule)
+		oncall.GET("/:scheduleId/current", s.ApiCurrentOnCall)
+		oncall.POST("/:scheduleId/overrides", s.requireAdmin, s.ApiCreateOnCallOverride)
+		oncall.DELETE("/:scheduleId/overrides/:overrideId", s.requireAdmin, s.ApiDeleteOnCallOverride)
+	}
+	snapshot := v1.Group("/snapshot", s.SnapshotCacheMiddleware)
 	{
 		snapshot.GET("/:clusterId/nodes", s.ApiSnapshotNodes)
 		snapshot.GET("/:clusterId/nodes/:nodeId", s.ApiSnapshotNodes)
@@ -62,25 +220,44 @@ func (s *NexServer) SetupApiHandler() {
 		snapshot.GET("/:clusterId/nodes/:nodeId/processes/:processId", s.ApiSnapshotProcesses)
 		snapshot.GET("/:clusterId/nodes/:nodeId/containers", s.ApiSnapshotContainers)
 		snapshot.GET("/:clusterId/nodes/:nodeId/containers/:containerId", s.ApiSnapshotContainers)
+		snapshot.GET("/:clusterId/nodes/:nodeId/ports", s.ApiSnapshotPorts)
+		snapshot.POST("/:clusterId/nodes/:nodeId/ports/accept", s.requireAdmin, s.ApiAcceptPorts)
 		snapshot.GET("/:clusterId/k8s/pods", s.ApiSnapshotPods)
+		snapshot.GET("/:clusterId/k8s/cronjobs", s.ApiSnapshotCronJobs)
+		snapshot.GET("/:clusterId/k8s/resources", s.ApiSnapshotK8sResources)
 		snapshot.GET("/:clusterId/k8s/namespaces/:namespaceId/pods", s.ApiSnapshotPods)
 		snapshot.GET("/:clusterId/k8s/namespaces/:namespaceId/pods/:podId", s.ApiSnapshotPods)
 	}
-	metrics := v1.Group("/metrics")
+	metrics := v1.Group("/metrics", s.CacheControlMiddleware)
 	{
+		metrics.GET("", s.ApiMetricsMultiCluster)
 		metrics.GET("/:clusterId/nodes", s.ApiMetricsNodes)
 		metrics.GET("/:clusterId/nodes/:nodeId", s.ApiMetricsNodes)
 		metrics.GET("/:clusterId/nodes/:nodeId/processes", s.ApiMetricsProcesses)
 		metrics.GET("/:clusterId/nodes/:nodeId/processes/:processId", s.ApiMetricsProcesses)
 		metrics.GET("/:clusterId/nodes/:nodeId/containers", s.ApiMetricsContainers)
 		metrics.GET("/:clusterId/nodes/:nodeId/containers/:containerId", s.ApiMetricsContainers)
+		metrics.GET("/:clusterId/nodes/:nodeId/tail", s.ApiTailNodeMetric)
 		metrics.GET("/:clusterId/k8s/pods", s.ApiMetricsPods)
 		metrics.GET("/:clusterId/k8s/namespaces/:namespaceId/pods", s.ApiMetricsPods)
 		metrics.GET("/:clusterId/k8s/namespaces/:namespaceId/pods/:podId", s.ApiMetricsPods)
 		metrics.GET("/:clusterId/summary", s.ApiMetricsClusterSummary)
+		metrics.GET("/:clusterId/counter_resets", s.ApiCounterResets)
+		metrics.GET("/:clusterId/heatmap", s.ApiMetricsHeatmap)
+		metrics.GET("/:clusterId/change_points", s.requireFeature(FeatureChangePoints), s.ApiChangePoints)
+	}
+	export := v1.Group("/export")
+	{
+		export.GET("/:clusterId/metrics.csv", s.ApiExportMetricsCsv)
+	}
+	series := v1.Group("/series")
+	{
+		series.GET("/:clusterId", s.ApiSeriesList)
+		series.GET("/:clusterId/cardinality", s.ApiSeriesCardinality)
 	}
-	summary := v1.Group("/summary")
+	summary := v1.Group("/summary", s.SnapshotCacheMiddleware)
 	{
+		summary.GET("/global", s.ApiSummaryGlobal)
 		summary.GET("/clusters", s.ApiSummaryClusters)
 		summary.GET("/clusters/:clusterId", s.ApiSummaryClusters)
 		summary.GET("/clusters/:clusterId/nodes", s.ApiSummaryNodes)
@@ -88,21 +265,53 @@ func (s *NexServer) SetupApiHandler() {
 	}
 	incident := v1.Group("/incidents")
 	{
-		incident.GET("/basic", s.ApiIncidentBasic)
+		// /incidents/basic is served by the id route, see ApiIncidentRoute
+		incident.GET("/:incidentId", s.ApiIncidentRoute)
+		incident.GET("/:incidentId/context", s.ApiIncidentContext)
+		incident.GET("/:incidentId/export", s.ApiIncidentExport)
 	}
 
 	go func() {
-		err := router.Run(fmt.Sprintf("%s:%d", s.config.Server.BindAddress, s.config.Server.ApiPort))
+		err := s.serveHttp(router, fmt.Sprintf("%s:%d", s.config.Server.BindAddress, s.config.Server.ApiPort))
 		if err != nil {
-			log.Printf("failed api handler: %v\n", err)
+			apiLog.Errorf("failed api handler: %v\n", err)
 		}
 	}()
+
+	if s.config.Server.ApiUnixSocket != "" {
+		go func() {
+			err := s.serveUnix(router, s.config.Server.ApiUnixSocket)
+			if err != nil {
+				apiLog.Errorf("failed api handler on unix socket: %v\n", err)
+			}
+		}()
+	}
+
+	s.SetupAdminHandler()
 }
 
 func (s *NexServer) ApiResponseJson(c *gin.Context, code int, status, message string) {
+	if code == 500 && strings.Contains(message, "statement timeout") {
+		s.apiQueryTimeout(c)
+		return
+	}
+
 	c.JSON(code, gin.H{
 		"status":  status,
-		"message": message,
+		"message": s.translate(s.requestLocale(c), message),
+	})
+}
+
+// ApiResponseJsonf translates the format before formatting the message.
+func (s *NexServer) ApiResponseJsonf(c *gin.Context, code int, status, format string, args ...interface{}) {
+	if code == 500 && queryTimedOut(args...) {
+		s.apiQueryTimeout(c)
+		return
+	}
+
+	c.JSON(code, gin.H{
+		"status":  status,
+		"message": s.translate(s.requestLocale(c), format, args...),
 	})
 }
 
@@ -110,6 +319,22 @@ func (s *NexServer) Param(c *gin.Context, key string) string {
 	return s.RemoveSpecialChar(c.Param(key))
 }
 
+// idParam returns the numeric id in the path parameter key. An absent
+// parameter is valid and yields 0 when optional is set.
+func (s *NexServer) idParam(c *gin.Context, key string, optional bool) (uint, bool) {
+	value := c.Param(key)
+	if value == "" {
+		return 0, optional
+	}
+
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || id == 0 {
+		return 0, false
+	}
+
+	return uint(id), true
+}
+
 func (s *NexServer) RemoveSpecialChar(key string) string {
 	chars := []string{"'", "\""}
 
@@ -120,6 +345,16 @@ func (s *NexServer) RemoveSpecialChar(key string) string {
 	return key
 }
 
+func stringInSlice(value string, list []string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (s *NexServer) ApiStatus(c *gin.Context) {
 	uptime := time.Since(s.serverStartTs)
 	uptimeSeconds := uptime.Seconds()
@@ -133,6 +368,9 @@ func (s *NexServer) ApiStatus(c *gin.Context) {
 			"uptime":            uptime.String(),
 			"metricsPerSeconds": fmt.Sprintf("%.2f", metricsPerSeconds),
 			"totalMetrics":      fmt.Sprintf("%d", s.metricSaveCounter),
+			"rejectedNames":     fmt.Sprintf("%d", atomic.LoadUint64(&s.rejectedMetricNames)),
+			"queuedMetrics":     fmt.Sprintf("%d", len(s.metricWriter.queue)),
+			"failedMetrics":     fmt.Sprintf("%d", atomic.LoadUint64(&s.metricWriter.failed)),
 		},
 	})
 }
@@ -142,6 +380,93 @@ type Query struct {
 	MetricNames []string `json:"metricNames"`
 	DateRange   []string `json:"dateRange"`
 	Granularity string   `json:"granularity"`
+	Aggregation string   `json:"aggregation"`
+
+	// Functions maps counter metric names to rate or delta
+	Functions map[string]string `json:"functions"`
+
+	// GroupBy aggregates the series of a metric by these label keys, or
+	// across all labels with "none"
+	GroupBy []string `json:"groupBy"`
+
+	// Math combines two metrics with +, -, * or /, such as "a/b"
+	Math string `json:"math"`
+}
+
+const groupByNone = "none"
+
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// queryAggregations are the functions a range query may apply per bucket,
+// avg when none is given.
+var queryAggregations = map[string]string{
+	"avg":  "avg(value)",
+	"min":  "min(value)",
+	"max":  "max(value)",
+	"sum":  "sum(value)",
+	"p50":  "percentile_cont(0.5) WITHIN GROUP (ORDER BY value)::numeric",
+	"p95":  "percentile_cont(0.95) WITHIN GROUP (ORDER BY value)::numeric",
+	"p99":  "percentile_cont(0.99) WITHIN GROUP (ORDER BY value)::numeric",
+	"last": "(array_agg(value ORDER BY ts DESC))[1]",
+}
+
+// aggregationExpr returns the SQL of the aggregation, which is validated
+// by ParseQuery and so can go into the statement text.
+func (query *Query) aggregationExpr() string {
+	if expr, found := queryAggregations[query.Aggregation]; found {
+		return expr
+	}
+
+	return queryAggregations["avg"]
+}
+
+func isValidAggregation(aggregation string) bool {
+	if aggregation == "" {
+		return true
+	}
+	_, found := queryAggregations[aggregation]
+
+	return found
+}
+
+func (query *Query) isValidGroupBy() bool {
+	for _, key := range query.GroupBy {
+		if !labelKeyPattern.MatchString(key) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// labelExpr returns the label of a series after grouping: the label, the
+// "key=value" pairs of the GroupBy keys it has, or an empty label. The
+// keys are validated by ParseQuery and so can go into the statement text.
+func (query *Query) labelExpr() string {
+	if len(query.GroupBy) == 0 {
+		return "metric_labels.label"
+	}
+	if stringInSlice(groupByNone, query.GroupBy) {
+		return "''"
+	}
+
+	pairs := make([]string, 0, len(query.GroupBy))
+	for _, key := range query.GroupBy {
+		pairs = append(pairs, fmt.Sprintf(
+			"'%s=' || substring(',' || metric_labels.label from ',%s=([^,]*)')", key, key))
+	}
+
+	return "concat_ws(',', " + strings.Join(pairs, ", ") + ")"
+}
+
+func (query *Query) isValidFunctions() bool {
+	for _, function := range query.Functions {
+		if !isValidCounterFunction(function) {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (s *NexServer) ParseQuery(c *gin.Context) *Query {
@@ -150,9 +475,15 @@ func (s *NexServer) ParseQuery(c *gin.Context) *Query {
 	queryParam := c.DefaultQuery("query", "")
 	if queryParam != "" {
 		err := json.Unmarshal([]byte(queryParam), &query)
-		if err != nil {
+		if err != nil || !isValidAggregation(query.Aggregation) || !query.isValidFunctions() ||
+			!query.isValidGroupBy() || !query.isValidMath() {
 			return nil
 		}
+		dateRange, ok := resolveDateRange(query.DateRange, query.Timezone, time.Now())
+		if !ok {
+			return nil
+		}
+		query.DateRange = dateRange
 
 		return &query
 	}
@@ -161,6 +492,25 @@ func (s *NexServer) ParseQuery(c *gin.Context) *Query {
 	query.Granularity = s.RemoveSpecialChar(c.DefaultQuery("granularity", ""))
 	query.DateRange = c.QueryArray("dateRange")
 	query.MetricNames = c.QueryArray("metricNames")
+	query.Aggregation = c.DefaultQuery("aggregation", "")
+	if !isValidAggregation(query.Aggregation) {
+		return nil
+	}
+	query.Functions = make(map[string]string)
+	for name, function := range c.QueryMap("functions") {
+		query.Functions[s.RemoveSpecialChar(name)] = function
+	}
+	if !query.isValidFunctions() {
+		return nil
+	}
+	query.GroupBy = c.QueryArray("groupBy")
+	if !query.isValidGroupBy() {
+		return nil
+	}
+	query.Math = c.DefaultQuery("math", "")
+	if !query.isValidMath() {
+		return nil
+	}
 
 	for idx, dateRange := range query.DateRange {
 		query.DateRange[idx] = s.RemoveSpecialChar(dateRange)
@@ -171,9 +521,14 @@ func (s *NexServer) ParseQuery(c *gin.Context) *Query {
 
 	_, err := time.LoadLocation(query.Timezone)
 	if err != nil {
-		log.Printf("invalid timezone: %s: %v\n", query.Timezone, err)
+		requestLog(c).Warnf("invalid timezone: %s: %v\n", query.Timezone, err)
+		return nil
+	}
+	dateRange, ok := resolveDateRange(query.DateRange, query.Timezone, time.Now())
+	if !ok {
 		return nil
 	}
+	query.DateRange = dateRange
 
 	return &query
 }
@@ -188,14 +543,26 @@ func (s *NexServer) ApiHealth(c *gin.Context) {
 }
 
 func (s *NexServer) ApiMetricNameList(c *gin.Context) {
-	query := s.db.Raw(`
+	page, err := s.parsePage(c)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	query, total, err := s.pagedRaw(c, NewSqlQuery(`
 SELECT metric_names.id, metric_names.name, metric_names.help, metric_types.name as metric_type
 FROM metric_names, metric_types
-WHERE metric_names.type_id=metric_types.id`)
+WHERE metric_names.type_id=metric_types.id
+ORDER BY metric_names.id`), page)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+
 	rows, err, queryTime := s.QueryRowsWithTime(query)
 	if err != nil {
-		s.ApiResponseJson(c, 500, "bad",
-			fmt.Sprintf("failed to get metric names: %v\n", err))
+		s.ApiResponseJsonf(c, 500, "bad",
+			"failed to get metric names: %v", err)
 		return
 	}
 
@@ -212,29 +579,24 @@ WHERE metric_names.type_id=metric_types.id`)
 
 		err := rows.Scan(&metricNameItem.Id, &metricNameItem.Name, &metricNameItem.Help, &metricNameItem.Type)
 		if err != nil {
-			log.Printf("failed to get record from metrics_names: %v", err)
+			requestLog(c).Errorf("failed to get record from metrics_names: %v", err)
 			continue
 		}
 
 		metricNames = append(metricNames, metricNameItem)
 	}
 
-	c.JSON(200, gin.H{
-		"status":        "ok",
-		"message":       "",
-		"data":          metricNames,
-		"db_query_time": queryTime.String(),
-	})
+	s.pageResponse(c, metricNames, page, len(metricNames), total, gin.H{"db_query_time": queryTime.String()})
 }
 
 func (s *NexServer) ApiSummaryClusters(c *gin.Context) {
-	targetClusterId := s.Param(c, "clusterId")
-	clusterQuery := ""
-	if targetClusterId != "" {
-		clusterQuery = fmt.Sprintf(" AND m2.cluster_id=%s", targetClusterId)
+	targetClusterId, ok := s.idParam(c, "clusterId", true)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
 	}
 
-	q := fmt.Sprintf(`
+	q := NewSqlQuery(`
 SELECT m1.cluster_id, clusters.name, metric_names.name, ROUND(SUM(m1.value))
 FROM metric_names, metric_labels, nodes, clusters, metrics m1
 JOIN (
@@ -242,7 +604,9 @@ JOIN (
     FROM metrics m2
     WHERE m2.ts >= NOW() - interval '60 seconds'
       AND m2.process_id=0
-      AND m2.container_id=0 %s
+      AND m2.container_id=0`).
+		AppendIf(targetClusterId != 0, " AND m2.cluster_id=?", targetClusterId).
+		Append(`
     GROUP BY m2.node_id) newest
 ON newest.node_id=m1.node_id AND newest.ts=m1.ts
 WHERE m1.name_id=metric_names.id
@@ -251,12 +615,12 @@ WHERE m1.name_id=metric_names.id
   AND m1.process_id=0
   AND m1.container_id=0
   AND m1.cluster_id=clusters.id
-GROUP BY m1.cluster_id, clusters.name, metric_names.name`, clusterQuery)
+GROUP BY m1.cluster_id, clusters.name, metric_names.name`)
 
-	rows, err := s.db.Raw(q).Rows()
+	rows, err := q.Rows(s.requestDB(c))
 	if err != nil {
-		log.Printf("failed to get data: %v", err)
-		s.ApiResponseJson(c, 500, "bad", fmt.Sprintf("failed to get data: %v", err))
+		requestLog(c).Errorf("failed to get data: %v", err)
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
 		return
 	}
 
@@ -268,7 +632,7 @@ GROUP BY m1.cluster_id, clusters.name, metric_names.name`, clusterQuery)
 	for rows.Next() {
 		err := rows.Scan(&clusterId, &clusterName, &metricName, &value)
 		if err != nil {
-			log.Printf("failed to get data: %v", err)
+			requestLog(c).Errorf("failed to get data: %v", err)
 			continue
 		}
 
@@ -281,21 +645,31 @@ GROUP BY m1.cluster_id, clusters.name, metric_names.name`, clusterQuery)
 		clusterMetrics[metricName] = value
 	}
 
+	health := make(map[uint]float64)
+	scores := s.clusterHealthScores()
+	for clusterId := range items {
+		health[clusterId] = 100
+		if score, found := scores[clusterId]; found {
+			health[clusterId] = score
+		}
+	}
+
 	c.JSON(200, gin.H{
 		"status":  "ok",
 		"message": "",
 		"data":    items,
+		"health":  health,
 	})
 }
 
 func (s *NexServer) ApiSummaryNodes(c *gin.Context) {
-	targetClusterId := s.Param(c, "clusterId")
-	if targetClusterId == "" {
+	targetClusterId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
 		s.ApiResponseJson(c, 404, "bad", "missing parameters")
 		return
 	}
 
-	q := fmt.Sprintf(`
+	q := NewSqlQuery(`
 SELECT m1.node_id, nodes.host, metric_names.name, ROUND(SUM(m1.value), 2)
 FROM metric_names, metric_labels, nodes, metrics m1
 JOIN (
@@ -304,7 +678,7 @@ JOIN (
     WHERE m2.ts >= NOW() - interval '60 seconds'
       AND m2.process_id=0
       AND m2.container_id=0
-      AND m2.cluster_id=%s
+      AND m2.cluster_id=?
     GROUP BY m2.node_id) newest
 ON newest.node_id=m1.node_id AND newest.ts=m1.ts
 WHERE m1.name_id=metric_names.id
@@ -314,10 +688,10 @@ WHERE m1.name_id=metric_names.id
   AND m1.container_id=0
 GROUP BY m1.node_id, nodes.host, metric_names.name`, targetClusterId)
 
-	rows, err := s.db.Raw(q).Rows()
+	rows, err := q.Rows(s.requestDB(c))
 	if err != nil {
-		log.Printf("failed to get data: %v", err)
-		s.ApiResponseJson(c, 500, "bad", fmt.Sprintf("failed to get data: %v", err))
+		requestLog(c).Errorf("failed to get data: %v", err)
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
 		return
 	}
 
@@ -329,7 +703,7 @@ GROUP BY m1.node_id, nodes.host, metric_names.name`, targetClusterId)
 	for rows.Next() {
 		err := rows.Scan(&hostId, &host, &metricName, &value)
 		if err != nil {
-			log.Printf("failed to get data: %v", err)
+			requestLog(c).Errorf("failed to get data: %v", err)
 			continue
 		}
 
@@ -350,14 +724,32 @@ GROUP BY m1.node_id, nodes.host, metric_names.name`, targetClusterId)
 }
 
 func (s *NexServer) ApiClusterList(c *gin.Context) {
-	query := s.db.Raw(`
+	if c.DefaultQuery("deleted", "") == "true" {
+		s.ApiDeletedClusterList(c)
+		return
+	}
+
+	page, err := s.parsePage(c)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	query, total, err := s.pagedRaw(c, NewSqlQuery(`
 SELECT clusters.id as cluster_id, clusters.name, 
        coalesce(k8s_clusters.id::integer, 0) as k8s_agent_cluster_id
 FROM clusters
-LEFT JOIN k8s_clusters ON clusters.id=k8s_clusters.agent_cluster_id`)
+LEFT JOIN k8s_clusters ON clusters.id=k8s_clusters.agent_cluster_id
+WHERE clusters.deleted_at IS NULL
+ORDER BY clusters.id`), page)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+
 	rows, err, queryTime := s.QueryRowsWithTime(query)
 	if err != nil {
-		s.ApiResponseJson(c, 500, "bad", fmt.Sprintf("failed to get data: %v", err))
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
 		return
 	}
 
@@ -374,7 +766,7 @@ LEFT JOIN k8s_clusters ON clusters.id=k8s_clusters.agent_cluster_id`)
 
 		err := rows.Scan(&clusterItem.Id, &clusterItem.Name, &k8sAgentClusterId)
 		if err != nil {
-			log.Printf("failed to get data: %v", err)
+			requestLog(c).Errorf("failed to get data: %v", err)
 			continue
 		}
 
@@ -387,84 +779,110 @@ LEFT JOIN k8s_clusters ON clusters.id=k8s_clusters.agent_cluster_id`)
 		items = append(items, clusterItem)
 	}
 
-	c.JSON(200, gin.H{
-		"status":        "ok",
-		"message":       "",
-		"data":          items,
-		"db_query_time": queryTime.String(),
-	})
+	s.pageResponse(c, items, page, len(items), total, gin.H{"db_query_time": queryTime.String()})
 }
 
 func (s *NexServer) ApiAgentList(c *gin.Context) {
-	cId := s.Param(c, "clusterId")
-	if cId == "" {
+	cId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
 		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
 		return
 	}
 
+	page, err := s.parsePage(c)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
 	var agents []Agent
 
 	queryStart := time.Now()
-	result := s.db.Where("cluster_id=?", cId).Find(&agents)
+	query, total, err := s.pagedModel(s.requestDB(c).Model(&Agent{}).Where("cluster_id=?", cId), page)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+	result := query.Order("id").Find(&agents)
 	queryTime := time.Since(queryStart)
 	if result.Error != nil {
-		s.ApiResponseJson(c, 500, "bad",
-			fmt.Sprintf("failed to get data: %v", result.Error))
+		s.ApiResponseJsonf(c, 500, "bad",
+			"failed to get data: %v", result.Error)
 		return
 	}
 
 	type AgentItem struct {
-		Id      uint   `json:"id"`
-		Version string `json:"version"`
-		Ip      string `json:"ip"`
-		Online  bool   `json:"online"`
+		Id         uint      `json:"id"`
+		Version    string    `json:"version"`
+		Ip         string    `json:"ip"`
+		Online     bool      `json:"online"`
+		Disabled   bool      `json:"disabled"`
+		LastSeenTs time.Time `json:"last_seen_ts"`
 	}
 	items := make([]AgentItem, 0, 16)
 
 	for _, agent := range agents {
 		items = append(items, AgentItem{
-			Id:      agent.ID,
-			Version: agent.Version,
-			Ip:      agent.Ipv4,
-			Online:  agent.Online,
+			Id:         agent.ID,
+			Version:    agent.Version,
+			Ip:         agent.Ipv4,
+			Online:     agent.Online,
+			Disabled:   agent.Disabled,
+			LastSeenTs: agent.LastContact,
 		})
 	}
 
-	c.JSON(200, gin.H{
-		"status":        "ok",
-		"message":       "",
-		"data":          items,
-		"db_query_time": queryTime.String(),
-	})
+	s.pageResponse(c, items, page, len(items), total, gin.H{"db_query_time": queryTime.String()})
 }
 
 func (s *NexServer) ApiAgentListAll(c *gin.Context) {
-	query := s.db.Table("agents").
-		Select("agents.id, agents.version, agents.ipv4, agents.online, clusters.name").
-		Joins("left join clusters on agents.cluster_id=clusters.id")
+	page, err := s.parsePage(c)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	query, total, err := s.pagedModel(s.requestDB(c).Table("agents"), page)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+
+	query = query.Select("agents.id, agents.version, agents.protocol, agents.ipv4, agents.online, agents.degraded, " +
+		"agents.disabled, agents.last_contact, clusters.name").
+		Joins("left join clusters on agents.cluster_id=clusters.id").
+		Order("agents.id")
 	rows, err, queryTime := s.QueryRowsWithTime(query)
 	if err != nil {
-		s.ApiResponseJson(c, 500, "bad",
-			fmt.Sprintf("failed to get data: %v", err))
+		s.ApiResponseJsonf(c, 500, "bad",
+			"failed to get data: %v", err)
 		return
 	}
 
 	type AgentItem struct {
-		Id      uint   `json:"id"`
-		Version string `json:"version"`
-		Ip      string `json:"ip"`
-		Online  bool   `json:"online"`
+		Id         uint      `json:"id"`
+		Version    string    `json:"version"`
+		Protocol   int       `json:"protocol"`
+		Deprecated bool      `json:"deprecated"`
+		Ip         string    `json:"ip"`
+		Online     bool      `json:"online"`
+		Degraded   bool      `json:"degraded"`
+		Disabled   bool      `json:"disabled"`
+		LastSeenTs time.Time `json:"last_seen_ts"`
 	}
 	clusterMap := make(map[string][]*AgentItem)
+	count := 0
 
 	var clusterName string
 	for rows.Next() {
 		var agentItem AgentItem
 
-		err := rows.Scan(&agentItem.Id, &agentItem.Version, &agentItem.Ip, &agentItem.Online, &clusterName)
+		err := rows.Scan(&agentItem.Id, &agentItem.Version, &agentItem.Protocol, &agentItem.Ip, &agentItem.Online,
+			&agentItem.Degraded, &agentItem.Disabled, &agentItem.LastSeenTs, &clusterName)
 		if err != nil {
 			continue
 		}
+		agentItem.Deprecated = protocolStatus(agentItem.Protocol) == ProtocolDeprecated
 		_, found := clusterMap[clusterName]
 		if !found {
 			clusterMap[clusterName] = make([]*AgentItem, 0)
@@ -473,31 +891,38 @@ func (s *NexServer) ApiAgentListAll(c *gin.Context) {
 		items := clusterMap[clusterName]
 		items = append(items, &agentItem)
 		clusterMap[clusterName] = items
+		count++
 	}
 
-	c.JSON(200, gin.H{
-		"status":        "ok",
-		"message":       "",
-		"data":          clusterMap,
-		"db_query_time": queryTime.String(),
-	})
+	s.pageResponse(c, clusterMap, page, count, total, gin.H{"db_query_time": queryTime.String()})
 }
 
 func (s *NexServer) ApiNodeList(c *gin.Context) {
-	cId := s.Param(c, "clusterId")
-	if cId == "" {
+	cId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
 		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
 		return
 	}
 
+	page, err := s.parsePage(c)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
 	var nodes []Node
 
 	queryStart := time.Now()
-	result := s.db.Where("cluster_id=?", cId).Find(&nodes)
+	query, total, err := s.pagedModel(s.requestDB(c).Model(&Node{}).Where("cluster_id=?", cId), page)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+	result := query.Order("id").Find(&nodes)
 	queryTime := time.Since(queryStart)
 	if result.Error != nil {
-		s.ApiResponseJson(c, 500, "bad",
-			fmt.Sprintf("failed to get data: %v", result.Error))
+		s.ApiResponseJsonf(c, 500, "bad",
+			"failed to get data: %v", result.Error)
 		return
 	}
 
@@ -526,23 +951,30 @@ func (s *NexServer) ApiNodeList(c *gin.Context) {
 		})
 	}
 
-	c.JSON(200, gin.H{
-		"status":        "ok",
-		"message":       "",
-		"data":          items,
-		"db_query_time": queryTime.String(),
-	})
+	s.pageResponse(c, items, page, len(items), total, gin.H{"db_query_time": queryTime.String()})
 }
 
 func (s *NexServer) ApiNodeListAll(c *gin.Context) {
-	query := s.db.Table("nodes").
-		Select("nodes.id, nodes.host, nodes.ipv4, nodes.os, " +
-			"nodes.platform, nodes.platform_family, nodes.platform_version, nodes.agent_id, clusters.name").
-		Joins("left join clusters on nodes.cluster_id=clusters.id")
+	page, err := s.parsePage(c)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	query, total, err := s.pagedModel(s.requestDB(c).Table("nodes"), page)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+
+	query = query.Select("nodes.id, nodes.host, nodes.ipv4, nodes.os, " +
+		"nodes.platform, nodes.platform_family, nodes.platform_version, nodes.agent_id, clusters.name").
+		Joins("left join clusters on nodes.cluster_id=clusters.id").
+		Order("nodes.id")
 	rows, err, queryTime := s.QueryRowsWithTime(query)
 	if err != nil {
-		s.ApiResponseJson(c, 500, "bad",
-			fmt.Sprintf("failed to get data: %v", err))
+		s.ApiResponseJsonf(c, 500, "bad",
+			"failed to get data: %v", err)
 		return
 	}
 
@@ -557,6 +989,7 @@ func (s *NexServer) ApiNodeListAll(c *gin.Context) {
 		AgentId         uint   `json:"agent_id"`
 	}
 	clusterMap := make(map[string][]*NodeItem)
+	count := 0
 
 	var clusterName string
 	for rows.Next() {
@@ -575,41 +1008,39 @@ func (s *NexServer) ApiNodeListAll(c *gin.Context) {
 		items := clusterMap[clusterName]
 		items = append(items, &nodeItem)
 		clusterMap[clusterName] = items
+		count++
 	}
 
-	c.JSON(200, gin.H{
-		"status":        "ok",
-		"message":       "",
-		"data":          clusterMap,
-		"db_query_time": queryTime.String(),
-	})
+	s.pageResponse(c, clusterMap, page, count, total, gin.H{"db_query_time": queryTime.String()})
 }
 
 func (s *NexServer) ApiSnapshotNodes(c *gin.Context) {
-	cId := s.Param(c, "clusterId")
-	if cId == "" {
+	if _, ok := s.idParam(c, "clusterId", false); !ok {
 		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
 		return
 	}
 
-	nodeId := s.Param(c, "nodeId")
-	nodeQuery := ""
-	if nodeId != "" {
-		nodeQuery = fmt.Sprintf("AND m2.node_id=%s", nodeId)
+	nodeId, ok := s.idParam(c, "nodeId", true)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid node id")
+		return
 	}
 
 	query := s.ParseQuery(c)
+	if s.mathUnsupported(c, query) {
+		return
+	}
+	if query == nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
 	metricNameIds := s.findMetricIdByNames(query.MetricNames)
-	metricNameQuery := ""
 	if len(query.MetricNames) != len(metricNameIds) {
 		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
 		return
 	}
-	if len(metricNameIds) > 0 {
-		metricNameQuery = fmt.Sprintf(" AND m2.name_id IN (%s)", strings.Join(metricNameIds, ","))
-	}
 
-	q := fmt.Sprintf(`
+	q := NewSqlQuery(`
 SELECT nodes.host as node, nodes.id, m1.ts, ROUND(m1.value, 2), metric_names.name, metric_labels.label
 FROM metric_names, metric_labels, nodes, metrics m1
 JOIN (
@@ -617,16 +1048,19 @@ JOIN (
     FROM metrics m2
     WHERE m2.process_id=0 
         AND m2.container_id=0
-		AND m2.ts >= NOW() - interval '60 seconds' %s %s
+		AND m2.ts >= NOW() - interval '60 seconds'`).
+		AppendIf(nodeId != 0, " AND m2.node_id=?", nodeId).
+		AppendIf(len(metricNameIds) > 0, " AND m2.name_id IN (?)", metricNameIds).
+		Append(`
     GROUP BY m2.node_id, m2.name_id) newest
 ON newest.node_id=m1.node_id AND newest.name_id=m1.name_id AND newest.ts=m1.ts
 WHERE m1.name_id=metric_names.id 
 	AND m1.node_id=nodes.id 
-	AND m1.label_id=metric_labels.id`, nodeQuery, metricNameQuery)
+	AND m1.label_id=metric_labels.id`)
 
-	rows, err, queryTime := s.QueryRowsWithTime(s.db.Raw(q))
+	rows, err, queryTime := s.QueryRowsWithTime(q.Raw(s.requestDB(c)))
 	if err != nil {
-		s.ApiResponseJson(c, 500, "bad", fmt.Sprintf("failed to get data: %v", err))
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
 		return
 	}
 
@@ -667,89 +1101,116 @@ WHERE m1.name_id=metric_names.id
 	})
 }
 
-func (s *NexServer) findMetricIdByNames(names []string) []string {
+func (s *NexServer) findMetricIdByNames(names []string) []uint {
+	results := make([]uint, 0, 4)
 	if len(names) == 0 {
-		return []string{}
+		return results
 	}
 
-	quotedNames := make([]string, 0, len(names))
-	for _, name := range names {
-		quotedNames = append(quotedNames, fmt.Sprintf("'%s'", name))
-	}
-	namesQuery := strings.Join(quotedNames, ",")
-	q := fmt.Sprintf("SELECT id FROM metric_names WHERE name IN (%s)", namesQuery)
-
-	rows, err := s.db.Raw(q).Rows()
+	results, err := s.getMetricNameIds(names)
 	if err != nil {
-		log.Printf("failed to get metric names: %v", err)
-		return []string{}
-	}
-
-	results := make([]string, 0, 4)
-	var id string
-
-	for rows.Next() {
-		err := rows.Scan(&id)
-		if err != nil {
-			log.Printf("failed to get metric names id: %v", err)
-			continue
-		}
-
-		results = append(results, id)
+		apiLog.Errorf("failed to get metric names: %v", err)
+		return []uint{}
 	}
 
 	return results
 }
 
 func (s *NexServer) ApiMetricsNodes(c *gin.Context) {
-	nodeId := s.Param(c, "nodeId")
-	nodeQuery := ""
-	if nodeId != "" {
-		nodeQuery = fmt.Sprintf("AND metrics.node_id=%s", nodeId)
-	}
-
-	cId := s.Param(c, "clusterId")
+	cId, clusterOk := s.idParam(c, "clusterId", false)
+	nodeId, nodeOk := s.idParam(c, "nodeId", true)
 	query := s.ParseQuery(c)
-	if s.IsValidParams(cId, query, true, true) == false {
+	operation := query.metricMath()
+	if !clusterOk || !nodeOk || s.IsValidParams(c.Param("clusterId"), query, true, true) == false {
 		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
 		return
 	}
 
 	metricNameIds := s.findMetricIdByNames(query.MetricNames)
-	metricNameQuery := ""
 	if len(query.MetricNames) != len(metricNameIds) {
 		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
 		return
 	}
-	if len(metricNameIds) > 0 {
-		metricNameQuery = fmt.Sprintf(" AND metrics.name_id IN (%s)", strings.Join(metricNameIds, ","))
+
+	counters, err := s.selectCounters(cId, query, metricNameIds)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	page, err := s.parsePage(c)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	resolution := c.DefaultQuery("resolution", "")
+	if resolution != "" && resolution != resolutionSparkline {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid resolution: %s", resolution)
+		return
 	}
 
 	truncateQuery := s.calculateGranularity(query.DateRange, query.Timezone, query.Granularity)
+	if resolution == resolutionSparkline {
+		// the series are thinned whole
+		truncateQuery = sparklineBucket(query.DateRange)
+		page = nil
+	}
+	if truncateQuery == nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
 
-	metricQuery := fmt.Sprintf(`
-SELECT nodes.host as node, nodes.id as node_id, ROUND(value, 2), bucket,
-       metric_names.name, metric_labels.label FROM
-    (SELECT metrics.node_id as node_id, avg(value) as value,
-            metrics.name_id, metrics.label_id, %s
-    FROM metrics
-    WHERE ts >= '%s' AND ts < '%s' AND metrics.cluster_id=%s 
+	// the operands are rounded once combined
+	valueColumn := "ROUND(value, 2)"
+	if operation != nil {
+		valueColumn = "value"
+	}
+	metricQuery := NewSqlQuery(`
+SELECT nodes.host as node, nodes.id as node_id, `+valueColumn+`, bucket,
+       metric_names.name, group_label, samples, series FROM
+    (SELECT metrics.node_id as node_id, count(*) as samples,
+            count(DISTINCT metrics.label_id) as series, `).
+		AppendQuery(counters.valueExpr(query)).
+		Append(` as value,
+            metrics.name_id, `+query.labelExpr()+` as group_label, `).
+		AppendQuery(truncateQuery).
+		Append(`
+    FROM `).
+		AppendQuery(counters.source()).
+		Append(`
+    JOIN metric_labels ON metric_labels.id=metrics.label_id
+    WHERE ts >= ? AND ts < ? AND metrics.cluster_id=?
       AND metrics.process_id=0
-      AND metrics.container_id=0 %s %s
-    GROUP BY bucket, metrics.node_id, metrics.name_id, metrics.label_id)
-        as metrics_bucket, nodes, metric_names, metric_labels
+      AND metrics.container_id=0`, query.DateRange[0], query.DateRange[1], cId).
+		AppendIf(nodeId != 0, " AND metrics.node_id=?", nodeId).
+		AppendIf(len(metricNameIds) > 0, " AND metrics.name_id IN (?)", metricNameIds).
+		Append(`
+    GROUP BY bucket, metrics.node_id, metrics.name_id, group_label)
+        as metrics_bucket, nodes, metric_names
 WHERE
     metrics_bucket.node_id=nodes.id AND
-    metrics_bucket.name_id=metric_names.id AND
-    metrics_bucket.label_id=metric_labels.id
-ORDER BY bucket`, truncateQuery, query.DateRange[0], query.DateRange[1],
-		cId, nodeQuery, metricNameQuery)
+    metrics_bucket.name_id=metric_names.id
+ORDER BY bucket, nodes.id, metric_names.name, group_label`)
+	if operation != nil {
+		metricQuery = operation.wrap(metricQuery)
+	}
 
-	rows, err, queryTime := s.QueryRowsWithTime(s.db.Raw(metricQuery))
+	pagedQuery, total, err := s.pagedRaw(c, metricQuery, page)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
 
+	rows, err, queryTime := s.QueryRowsWithTime(pagedQuery)
 	if err != nil {
-		log.Printf("failed to get metric data: %v", err)
-		s.ApiResponseJson(c, 500, "bad", fmt.Sprintf("unexpected error: %v", err))
+		requestLog(c).Errorf("failed to get metric data: %v", err)
+		s.ApiResponseJsonf(c, 500, "bad", "unexpected error: %v", err)
+		return
+	}
+	if resolution == resolutionSparkline {
+		defer rows.Close()
+		s.writeSparklines(c, rows, queryTime)
 		return
 	}
 
@@ -760,40 +1221,64 @@ ORDER BY bucket`, truncateQuery, query.DateRange[0], query.DateRange[1],
 		Bucket      string  `json:"bucket"`
 		MetricName  string  `json:"metric_name"`
 		MetricLabel string  `json:"metric_label"`
+		Samples     int64   `json:"samples"`
+		Expected    int64   `json:"expected"`
 	}
-	results := make([]MetricItem, 0, 16)
+	defer rows.Close()
+	results := s.newRowWriter(c, page, total, queryTime)
+	completeness := s.newCompleteness(query)
 
 	for rows.Next() {
 		var item MetricItem
+		var series int64
 
-		err := rows.Scan(&item.Node, &item.NodeId, &item.Value, &item.Bucket, &item.MetricName, &item.MetricLabel)
+		err := rows.Scan(&item.Node, &item.NodeId, &item.Value, &item.Bucket, &item.MetricName, &item.MetricLabel,
+			&item.Samples, &series)
 		if err != nil {
-			log.Printf("failed to get record: %v", err)
+			requestLog(c).Errorf("failed to get record: %v", err)
 			continue
 		}
+		item.Expected = completeness.expected(item.NodeId, item.Bucket, series)
 
-		results = append(results, item)
+		if !results.add(item) {
+			break
+		}
 	}
 
-	c.JSON(200, gin.H{
-		"status":        "ok",
-		"message":       "",
-		"data":          results,
-		"count":         len(results),
-		"db_query_time": queryTime.String(),
-	})
+	results.finish()
 }
 
+// ApiExportMetricsCsv serves the node metrics of ApiMetricsNodes as a CSV
+// download, of one node with nodeId.
+func (s *NexServer) ApiExportMetricsCsv(c *gin.Context) {
+	clusterId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	fileName := fmt.Sprintf("cluster-%d-metrics.csv", clusterId)
+	if nodeId := c.DefaultQuery("nodeId", ""); nodeId != "" {
+		c.Params = append(c.Params, gin.Param{Key: "nodeId", Value: nodeId})
+		fileName = fmt.Sprintf("cluster-%d-node-%s-metrics.csv", clusterId, s.RemoveSpecialChar(nodeId))
+	}
+	c.Set(csvExportKey, fileName)
+
+	s.ApiMetricsNodes(c)
+}
+
+// CheckRequiredParams returns the id params of the path, false if one is
+// missing or not an id.
 func (s *NexServer) CheckRequiredParams(c *gin.Context, params []string) (map[string]string, bool) {
 	required := make(map[string]string)
 
 	for _, param := range params {
-		value := s.Param(c, param)
-		if value == "" {
+		id, ok := s.idParam(c, param, false)
+		if !ok {
 			return nil, false
 		}
 
-		required[param] = value
+		required[param] = strconv.FormatUint(uint64(id), 10)
 	}
 
 	return required, true
@@ -819,51 +1304,64 @@ func (s *NexServer) IsValidParams(clusterId string, query *Query, existDateRange
 	return true
 }
 
+// processFlagMetrics maps the failure signatures reported per process to
+// the flags of the process snapshot.
+var processFlagMetrics = map[string]string{
+	"process_deleted_binary":  "deleted_binary",
+	"process_zombie":          "zombie",
+	"process_uninterruptible": "uninterruptible",
+}
+
 func (s *NexServer) ApiSnapshotProcesses(c *gin.Context) {
-	params, ok := s.CheckRequiredParams(c, []string{"clusterId", "nodeId"})
-	if !ok {
+	clusterId, clusterOk := s.idParam(c, "clusterId", false)
+	nodeId, nodeOk := s.idParam(c, "nodeId", false)
+	if !clusterOk || !nodeOk {
 		s.ApiResponseJson(c, 404, "bad", "missing parameters")
 		return
 	}
-	clusterId := params["clusterId"]
-	nodeId := params["nodeId"]
 
-	processId := s.Param(c, "processId")
-	processQuery := ""
-	if processId != "" {
-		processQuery = fmt.Sprintf("AND m2.process_id=%s", processId)
+	processId, ok := s.idParam(c, "processId", true)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid process id")
+		return
 	}
 
 	query := s.ParseQuery(c)
+	if s.mathUnsupported(c, query) {
+		return
+	}
+	if query == nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
 	metricNameIds := s.findMetricIdByNames(query.MetricNames)
-	metricNameQuery := ""
 	if len(query.MetricNames) != len(metricNameIds) {
 		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
 		return
 	}
-	if len(metricNameIds) > 0 {
-		metricNameQuery = fmt.Sprintf(" AND m2.name_id IN (%s)", strings.Join(metricNameIds, ","))
-	}
 
-	q := fmt.Sprintf(`
+	q := NewSqlQuery(`
 SELECT m1.process_id, processes.name as process_name, m1.ts, ROUND(m1.value), metric_names.name, metric_labels.label
 FROM metric_names, metric_labels, processes, metrics m1
 JOIN (
     SELECT m2.process_id, MAX(ts) ts, name_id
     FROM metrics m2
     WHERE m2.ts >= NOW() - interval '60 seconds'
-      AND m2.cluster_id=%s
-      AND m2.node_id=%s %s %s
+      AND m2.cluster_id=?
+      AND m2.node_id=?`, clusterId, nodeId).
+		AppendIf(processId != 0, " AND m2.process_id=?", processId).
+		AppendIf(len(metricNameIds) > 0, " AND m2.name_id IN (?)", metricNameIds).
+		Append(`
       AND m2.container_id=0
     GROUP BY m2.process_id, m2.name_id) newest
 ON newest.process_id=m1.process_id AND newest.ts=m1.ts AND newest.name_id=m1.name_id
 WHERE m1.name_id=metric_names.id
   AND m1.label_id=metric_labels.id
-  AND m1.process_id=processes.id`, clusterId, nodeId, processQuery, metricNameQuery)
+  AND m1.process_id=processes.id`)
 
-	rows, err, queryTime := s.QueryRowsWithTime(s.db.Raw(q))
+	rows, err, queryTime := s.QueryRowsWithTime(q.Raw(s.requestDB(c)))
 	if err != nil {
-		s.ApiResponseJson(c, 500, "bad", fmt.Sprintf("failed to get data: %v", err))
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
 		return
 	}
 
@@ -877,6 +1375,7 @@ WHERE m1.name_id=metric_names.id
 	}
 
 	results := make(map[string][]ProcessMetric)
+	flags := make(map[string][]string)
 
 	for rows.Next() {
 		var processMetric ProcessMetric
@@ -895,43 +1394,50 @@ WHERE m1.name_id=metric_names.id
 
 		processMetrics = append(processMetrics, processMetric)
 		results[processMetric.Process] = processMetrics
+
+		if flag, found := processFlagMetrics[processMetric.MetricName]; found && processMetric.Value > 0 {
+			flags[processMetric.Process] = append(flags[processMetric.Process], flag)
+		}
 	}
 
 	c.JSON(200, gin.H{
 		"status":        "ok",
 		"message":       "",
 		"data":          results,
+		"flags":         flags,
 		"db_query_time": queryTime.String(),
 	})
 }
 
 func (s *NexServer) ApiSnapshotContainers(c *gin.Context) {
-	params, ok := s.CheckRequiredParams(c, []string{"clusterId", "nodeId"})
-	if !ok {
+	clusterId, clusterOk := s.idParam(c, "clusterId", false)
+	nodeId, nodeOk := s.idParam(c, "nodeId", false)
+	if !clusterOk || !nodeOk {
 		s.ApiResponseJson(c, 404, "bad", "missing parameters")
 		return
 	}
-	clusterId := params["clusterId"]
-	nodeId := params["nodeId"]
 
-	containerId := s.Param(c, "containerId")
-	containerQuery := ""
-	if containerId != "" {
-		containerQuery = fmt.Sprintf("AND m2.container_id=%s", containerId)
+	containerId, ok := s.idParam(c, "containerId", true)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid container id")
+		return
 	}
 
 	query := s.ParseQuery(c)
+	if s.mathUnsupported(c, query) {
+		return
+	}
+	if query == nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
 	metricNameIds := s.findMetricIdByNames(query.MetricNames)
-	metricNameQuery := ""
 	if len(query.MetricNames) != len(metricNameIds) {
 		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
 		return
 	}
-	if len(metricNameIds) > 0 {
-		metricNameQuery = fmt.Sprintf(" AND m2.name_id IN (%s)", strings.Join(metricNameIds, ","))
-	}
 
-	q := fmt.Sprintf(`
+	q := NewSqlQuery(`
 SELECT m1.container_id, containers.name as container_name, m1.ts, ROUND(m1.value), 
 	metric_names.name, metric_labels.label
 FROM metric_names, metric_labels, containers, metrics m1
@@ -939,18 +1445,21 @@ JOIN (
     SELECT m2.container_id, name_id, MAX(ts) ts
     FROM metrics m2
     WHERE m2.ts >= NOW() - interval '60 seconds'
-      AND m2.cluster_id=%s
-      AND m2.node_id=%s %s %s
+      AND m2.cluster_id=?
+      AND m2.node_id=?`, clusterId, nodeId).
+		AppendIf(containerId != 0, " AND m2.container_id=?", containerId).
+		AppendIf(len(metricNameIds) > 0, " AND m2.name_id IN (?)", metricNameIds).
+		Append(`
       AND m2.process_id=0
     GROUP BY m2.container_id, m2.name_id) newest
 ON newest.container_id=m1.container_id AND newest.ts=m1.ts AND newest.name_id=m1.name_id
 WHERE m1.name_id=metric_names.id
   AND m1.label_id=metric_labels.id
-  AND m1.container_id=containers.id`, clusterId, nodeId, containerQuery, metricNameQuery)
+  AND m1.container_id=containers.id`)
 
-	rows, err, queryTime := s.QueryRowsWithTime(s.db.Raw(q))
+	rows, err, queryTime := s.QueryRowsWithTime(q.Raw(s.requestDB(c)))
 	if err != nil {
-		s.ApiResponseJson(c, 500, "bad", fmt.Sprintf("failed to get data: %v", err))
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
 		return
 	}
 
@@ -993,37 +1502,34 @@ WHERE m1.name_id=metric_names.id
 }
 
 func (s *NexServer) ApiSnapshotPods(c *gin.Context) {
-	params, ok := s.CheckRequiredParams(c, []string{"clusterId"})
+	clusterId, ok := s.idParam(c, "clusterId", false)
 	if !ok {
 		s.ApiResponseJson(c, 404, "bad", "missing parameters")
 		return
 	}
-	clusterId := params["clusterId"]
-
-	namespaceId := s.Param(c, "namespaceId")
-	namespaceQuery := ""
-	if namespaceId != "" {
-		namespaceQuery = fmt.Sprintf(" AND k8s_namespaces.id=%s", namespaceId)
-	}
 
-	podId := s.Param(c, "podId")
-	podQuery := ""
-	if podId != "" {
-		podQuery = fmt.Sprintf("   AND k8s_pods.id=%s", podId)
+	namespaceId, namespaceOk := s.idParam(c, "namespaceId", true)
+	podId, podOk := s.idParam(c, "podId", true)
+	if !namespaceOk || !podOk {
+		s.ApiResponseJson(c, 404, "bad", "invalid parameters")
+		return
 	}
 
 	query := s.ParseQuery(c)
+	if s.mathUnsupported(c, query) {
+		return
+	}
+	if query == nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
 	metricNameIds := s.findMetricIdByNames(query.MetricNames)
-	metricNameQuery := ""
 	if len(query.MetricNames) != len(metricNameIds) {
 		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
 		return
 	}
-	if len(metricNameIds) > 0 {
-		metricNameQuery = fmt.Sprintf(" AND m2.name_id IN (%s)", strings.Join(metricNameIds, ","))
-	}
 
-	q := fmt.Sprintf(`
+	q := NewSqlQuery(`
 SELECT k8s_pods.name as pod, k8s_namespaces.name as namespace, m1.ts, ROUND(SUM(m1.value)) as value,
 	metric_names.name as metric_name
 FROM metric_names, containers, k8s_pods, k8s_containers, k8s_namespaces, metrics as m1
@@ -1031,21 +1537,26 @@ JOIN (
     SELECT m2.container_id, name_id, MAX(ts) ts
     FROM metrics m2
     WHERE m2.ts >= NOW() - interval '60 seconds'
-      AND m2.cluster_id=%s
+      AND m2.cluster_id=?
       AND m2.container_id != 0
-      AND m2.process_id=0 %s
+      AND m2.process_id=0`, clusterId).
+		AppendIf(len(metricNameIds) > 0, " AND m2.name_id IN (?)", metricNameIds).
+		Append(`
     GROUP BY m2.container_id, m2.name_id) newest
 ON newest.container_id=m1.container_id AND newest.ts=m1.ts AND newest.name_id=m1.name_id
 WHERE m1.name_id=metric_names.id
   AND m1.container_id=containers.id
   AND containers.container_id=k8s_containers.container_id
   AND k8s_containers.k8s_pod_id=k8s_pods.id
-  AND k8s_pods.k8s_namespace_id=k8s_namespaces.id %s %s
-GROUP BY pod, namespace, m1.ts, metric_name`, clusterId, metricNameQuery, namespaceQuery, podQuery)
+  AND k8s_pods.k8s_namespace_id=k8s_namespaces.id`).
+		AppendIf(namespaceId != 0, " AND k8s_namespaces.id=?", namespaceId).
+		AppendIf(podId != 0, " AND k8s_pods.id=?", podId).
+		Append(`
+GROUP BY pod, namespace, m1.ts, metric_name`)
 
-	rows, err, queryTime := s.QueryRowsWithTime(s.db.Raw(q))
+	rows, err, queryTime := s.QueryRowsWithTime(q.Raw(s.requestDB(c)))
 	if err != nil {
-		s.ApiResponseJson(c, 500, "bad", fmt.Sprintf("failed to get data: %v", err))
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
 		return
 	}
 
@@ -1085,59 +1596,79 @@ GROUP BY pod, namespace, m1.ts, metric_name`, clusterId, metricNameQuery, namesp
 }
 
 func (s *NexServer) ApiMetricsProcesses(c *gin.Context) {
-	nodeId := s.Param(c, "nodeId")
-	nodeQuery := ""
-	if nodeId != "" {
-		nodeQuery = fmt.Sprintf(" AND metrics.node_id=%s", nodeId)
-	}
-
-	processId := s.Param(c, "processId")
-	processQuery := ""
-	if processId != "" {
-		processQuery = fmt.Sprintf(" AND metrics.process_id=%s", processId)
-	}
-
-	cId := s.Param(c, "clusterId")
+	cId, clusterOk := s.idParam(c, "clusterId", false)
+	nodeId, nodeOk := s.idParam(c, "nodeId", true)
+	processId, processOk := s.idParam(c, "processId", true)
 	query := s.ParseQuery(c)
-	if s.IsValidParams(cId, query, true, true) == false {
+	if s.mathUnsupported(c, query) {
+		return
+	}
+	if !clusterOk || !nodeOk || !processOk || s.IsValidParams(c.Param("clusterId"), query, true, true) == false {
 		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
 		return
 	}
 
 	metricNameIds := s.findMetricIdByNames(query.MetricNames)
-	metricNameQuery := ""
 	if len(query.MetricNames) != len(metricNameIds) {
 		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
 		return
 	}
-	if len(metricNameIds) > 0 {
-		metricNameQuery = fmt.Sprintf(" AND metrics.name_id IN (%s)", strings.Join(metricNameIds, ","))
+
+	counters, err := s.selectCounters(cId, query, metricNameIds)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	page, err := s.parsePage(c)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
 	}
 
 	truncateQuery := s.calculateGranularity(query.DateRange, query.Timezone, query.Granularity)
+	if truncateQuery == nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
 
-	q := fmt.Sprintf(`
-SELECT processes.name as process, processes.id, ROUND(value, 2), bucket,
-       metric_names.name, metric_labels.label FROM
-    (SELECT metrics.process_id as process_id, avg(value) as value,
-            metrics.name_id, metrics.label_id, %s
-    FROM metrics
-    WHERE ts >= '%s' AND ts < '%s'
-      AND metrics.cluster_id=%s %s %s %s
-    GROUP BY bucket, metrics.process_id, metrics.name_id, metrics.label_id)
-        as metrics_bucket, metric_names, metric_labels, processes
+	q := NewSqlQuery(`
+SELECT processes.name as process, processes.id, processes.node_id, ROUND(value, 2), bucket,
+       metric_names.name, group_label, samples, series FROM
+    (SELECT metrics.process_id as process_id, count(*) as samples,
+            count(DISTINCT metrics.label_id) as series, `).
+		AppendQuery(counters.valueExpr(query)).
+		Append(` as value,
+            metrics.name_id, `+query.labelExpr()+` as group_label, `).
+		AppendQuery(truncateQuery).
+		Append(`
+    FROM `).
+		AppendQuery(counters.source()).
+		Append(`
+    JOIN metric_labels ON metric_labels.id=metrics.label_id
+    WHERE ts >= ? AND ts < ?
+      AND metrics.cluster_id=?`, query.DateRange[0], query.DateRange[1], cId).
+		AppendIf(nodeId != 0, " AND metrics.node_id=?", nodeId).
+		AppendIf(processId != 0, " AND metrics.process_id=?", processId).
+		AppendIf(len(metricNameIds) > 0, " AND metrics.name_id IN (?)", metricNameIds).
+		Append(`
+    GROUP BY bucket, metrics.process_id, metrics.name_id, group_label)
+        as metrics_bucket, metric_names, processes
 WHERE
     metrics_bucket.process_id=processes.id AND
-      metrics_bucket.name_id=metric_names.id AND
-      metrics_bucket.label_id=metric_labels.id
-ORDER BY bucket`, truncateQuery, query.DateRange[0], query.DateRange[1],
-		cId, nodeQuery, processQuery, metricNameQuery)
+      metrics_bucket.name_id=metric_names.id
+ORDER BY bucket, processes.id, metric_names.name, group_label`)
 
-	rows, err, queryTime := s.QueryRowsWithTime(s.db.Raw(q))
+	pagedQuery, total, err := s.pagedRaw(c, q, page)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
 
+	rows, err, queryTime := s.QueryRowsWithTime(pagedQuery)
 	if err != nil {
-		log.Printf("failed to get metric data: %v", err)
-		s.ApiResponseJson(c, 500, "bad", fmt.Sprintf("unexpected error: %v", err))
+		requestLog(c).Errorf("failed to get metric data: %v", err)
+		s.ApiResponseJsonf(c, 500, "bad", "unexpected error: %v", err)
 		return
 	}
 
@@ -1148,83 +1679,108 @@ ORDER BY bucket`, truncateQuery, query.DateRange[0], query.DateRange[1],
 		Bucket      string  `json:"bucket"`
 		MetricName  string  `json:"metric_name"`
 		MetricLabel string  `json:"metric_label"`
+		Samples     int64   `json:"samples"`
+		Expected    int64   `json:"expected"`
 	}
-	results := make([]MetricItem, 0, 16)
+	defer rows.Close()
+	results := s.newRowWriter(c, page, total, queryTime)
+	completeness := s.newCompleteness(query)
 
 	for rows.Next() {
 		var item MetricItem
+		var processNodeId uint
+		var series int64
 
-		err := rows.Scan(&item.Process, &item.ProcessId, &item.Value, &item.Bucket, &item.MetricName, &item.MetricLabel)
+		err := rows.Scan(&item.Process, &item.ProcessId, &processNodeId, &item.Value, &item.Bucket, &item.MetricName,
+			&item.MetricLabel, &item.Samples, &series)
 		if err != nil {
-			log.Printf("failed to get record: %v", err)
+			requestLog(c).Errorf("failed to get record: %v", err)
 			continue
 		}
+		item.Expected = completeness.expected(processNodeId, item.Bucket, series)
 
-		results = append(results, item)
+		if !results.add(item) {
+			break
+		}
 	}
 
-	c.JSON(200, gin.H{
-		"status":        "ok",
-		"message":       "",
-		"data":          results,
-		"count":         len(results),
-		"db_query_time": queryTime.String(),
-	})
+	results.finish()
 }
 
 func (s *NexServer) ApiMetricsContainers(c *gin.Context) {
-	nodeId := s.Param(c, "nodeId")
-	nodeQuery := ""
-	if nodeId != "" {
-		nodeQuery = fmt.Sprintf(" AND metrics.node_id=%s", nodeId)
-	}
-
-	containerId := s.Param(c, "containerId")
-	containerQuery := ""
-	if containerId != "" {
-		containerQuery = fmt.Sprintf(" AND metrics.container_id=%s", containerId)
-	}
-
-	cId := s.Param(c, "clusterId")
+	cId, clusterOk := s.idParam(c, "clusterId", false)
+	nodeId, nodeOk := s.idParam(c, "nodeId", true)
+	containerId, containerOk := s.idParam(c, "containerId", true)
 	query := s.ParseQuery(c)
-	if s.IsValidParams(cId, query, true, true) == false {
+	if s.mathUnsupported(c, query) {
+		return
+	}
+	if !clusterOk || !nodeOk || !containerOk || s.IsValidParams(c.Param("clusterId"), query, true, true) == false {
 		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
 		return
 	}
 
 	metricNameIds := s.findMetricIdByNames(query.MetricNames)
-	metricNameQuery := ""
 	if len(query.MetricNames) != len(metricNameIds) {
 		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
 		return
 	}
-	if len(metricNameIds) > 0 {
-		metricNameQuery = fmt.Sprintf(" AND metrics.name_id IN (%s)", strings.Join(metricNameIds, ","))
+
+	counters, err := s.selectCounters(cId, query, metricNameIds)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	page, err := s.parsePage(c)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
 	}
 
 	truncateQuery := s.calculateGranularity(query.DateRange, query.Timezone, query.Granularity)
+	if truncateQuery == nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
 
-	q := fmt.Sprintf(`
-SELECT containers.name as container, containers.id, ROUND(value, 2), bucket,
-       metric_names.name, metric_labels.label FROM
-    (SELECT metrics.container_id as container_id, avg(value) as value,
-            metrics.name_id, metrics.label_id, %s
-    FROM metrics
-    WHERE ts >= '%s' AND ts < '%s'
-      AND metrics.cluster_id=%s %s %s %s
-    GROUP BY bucket, metrics.container_id, metrics.name_id, metrics.label_id)
-        as metrics_bucket, metric_names, metric_labels, containers
+	q := NewSqlQuery(`
+SELECT containers.name as container, containers.id, containers.node_id, ROUND(value, 2), bucket,
+       metric_names.name, group_label, samples, series FROM
+    (SELECT metrics.container_id as container_id, count(*) as samples,
+            count(DISTINCT metrics.label_id) as series, `).
+		AppendQuery(counters.valueExpr(query)).
+		Append(` as value,
+            metrics.name_id, `+query.labelExpr()+` as group_label, `).
+		AppendQuery(truncateQuery).
+		Append(`
+    FROM `).
+		AppendQuery(counters.source()).
+		Append(`
+    JOIN metric_labels ON metric_labels.id=metrics.label_id
+    WHERE ts >= ? AND ts < ?
+      AND metrics.cluster_id=?`, query.DateRange[0], query.DateRange[1], cId).
+		AppendIf(nodeId != 0, " AND metrics.node_id=?", nodeId).
+		AppendIf(containerId != 0, " AND metrics.container_id=?", containerId).
+		AppendIf(len(metricNameIds) > 0, " AND metrics.name_id IN (?)", metricNameIds).
+		Append(`
+    GROUP BY bucket, metrics.container_id, metrics.name_id, group_label)
+        as metrics_bucket, metric_names, containers
 WHERE
     metrics_bucket.container_id=containers.id AND
-      metrics_bucket.name_id=metric_names.id AND
-      metrics_bucket.label_id=metric_labels.id
-ORDER BY bucket`, truncateQuery, query.DateRange[0], query.DateRange[1],
-		cId, nodeQuery, containerQuery, metricNameQuery)
+      metrics_bucket.name_id=metric_names.id
+ORDER BY bucket, containers.id, metric_names.name, group_label`)
+
+	pagedQuery, total, err := s.pagedRaw(c, q, page)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
 
-	rows, err, queryTime := s.QueryRowsWithTime(s.db.Raw(q))
+	rows, err, queryTime := s.QueryRowsWithTime(pagedQuery)
 	if err != nil {
-		log.Printf("failed to get metric data: %v", err)
-		s.ApiResponseJson(c, 500, "bad", fmt.Sprintf("unexpected error: %v", err))
+		requestLog(c).Errorf("failed to get metric data: %v", err)
+		s.ApiResponseJsonf(c, 500, "bad", "unexpected error: %v", err)
 		return
 	}
 
@@ -1235,125 +1791,162 @@ ORDER BY bucket`, truncateQuery, query.DateRange[0], query.DateRange[1],
 		Bucket      string  `json:"bucket"`
 		MetricName  string  `json:"metric_name"`
 		MetricLabel string  `json:"metric_label"`
+		Samples     int64   `json:"samples"`
+		Expected    int64   `json:"expected"`
 	}
-	results := make([]MetricItem, 0, 16)
+	defer rows.Close()
+	results := s.newRowWriter(c, page, total, queryTime)
+	completeness := s.newCompleteness(query)
 
 	for rows.Next() {
 		var item MetricItem
+		var containerNodeId uint
+		var series int64
 
-		err := rows.Scan(&item.Container, &item.ContainerId,
-			&item.Value, &item.Bucket, &item.MetricName, &item.MetricLabel)
+		err := rows.Scan(&item.Container, &item.ContainerId, &containerNodeId,
+			&item.Value, &item.Bucket, &item.MetricName, &item.MetricLabel, &item.Samples, &series)
 		if err != nil {
-			log.Printf("failed to get record: %v", err)
+			requestLog(c).Errorf("failed to get record: %v", err)
 			continue
 		}
+		item.Expected = completeness.expected(containerNodeId, item.Bucket, series)
 
-		results = append(results, item)
+		if !results.add(item) {
+			break
+		}
 	}
 
-	c.JSON(200, gin.H{
-		"status":        "ok",
-		"message":       "",
-		"data":          results,
-		"count":         len(results),
-		"db_query_time": queryTime.String(),
-	})
+	results.finish()
 }
 
 func (s *NexServer) ApiMetricsPods(c *gin.Context) {
-	namespaceId := s.Param(c, "namespaceId")
-	namespaceQuery := ""
-	if namespaceId != "" {
-		namespaceQuery = fmt.Sprintf(" AND k8s_namespaces.id=%s", namespaceId)
-	}
-
-	podId := s.Param(c, "podId")
-	podQuery := ""
-	if podId != "" {
-		podQuery = fmt.Sprintf(" AND k8s_pods.id=%s", podId)
-	}
-
-	cId := s.Param(c, "clusterId")
+	cId, clusterOk := s.idParam(c, "clusterId", false)
+	namespaceId, namespaceOk := s.idParam(c, "namespaceId", true)
+	podId, podOk := s.idParam(c, "podId", true)
 	query := s.ParseQuery(c)
-	if s.IsValidParams(cId, query, true, true) == false {
+	if s.mathUnsupported(c, query) {
+		return
+	}
+	if !clusterOk || !namespaceOk || !podOk || s.IsValidParams(c.Param("clusterId"), query, true, true) == false {
 		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
 		return
 	}
 
 	metricNameIds := s.findMetricIdByNames(query.MetricNames)
-	metricNameQuery := ""
 	if len(query.MetricNames) != len(metricNameIds) {
 		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
 		return
 	}
-	if len(metricNameIds) > 0 {
-		metricNameQuery = fmt.Sprintf(" AND metrics.name_id IN (%s)", strings.Join(metricNameIds, ","))
+
+	counters, err := s.selectCounters(cId, query, metricNameIds)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	page, err := s.parsePage(c)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
 	}
 
 	truncateQuery := s.calculateGranularity(query.DateRange, query.Timezone, query.Granularity)
+	if truncateQuery == nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
 
-	q := fmt.Sprintf(`
+	// the series of a pod are summed over their labels unless grouped
+	labelExpr := "''"
+	if len(query.GroupBy) > 0 {
+		labelExpr = query.labelExpr()
+	}
+	q := NewSqlQuery(`
 SELECT k8s_pods.name as pod, k8s_namespaces.name as namespace,
-       ROUND(SUM(value), 2) as value, bucket, metric_names.name
+       ROUND(SUM(value), 2) as value, bucket, metric_names.name, group_label,
+       MIN(containers.node_id), SUM(samples), count(*)
 FROM
-    (SELECT metrics.container_id as container_id, avg(value) as value,
-            metrics.name_id, metrics.label_id, %s
-    FROM metrics
-    WHERE ts >= '%s' AND ts < '%s'
-      AND metrics.cluster_id=%s %s
-    GROUP BY bucket, metrics.container_id, metrics.name_id, metrics.label_id)
+    (SELECT metrics.container_id as container_id, count(*) as samples, `).
+		AppendQuery(counters.valueExpr(query)).
+		Append(` as value,
+            metrics.name_id, metrics.label_id, `+labelExpr+` as group_label, `).
+		AppendQuery(truncateQuery).
+		Append(`
+    FROM `).
+		AppendQuery(counters.source()).
+		Append(`
+    JOIN metric_labels ON metric_labels.id=metrics.label_id
+    WHERE ts >= ? AND ts < ?
+      AND metrics.cluster_id=?`, query.DateRange[0], query.DateRange[1], cId).
+		AppendIf(len(metricNameIds) > 0, " AND metrics.name_id IN (?)", metricNameIds).
+		Append(`
+    GROUP BY bucket, metrics.container_id, metrics.name_id, metrics.label_id, group_label)
         as metrics_bucket, metric_names, containers, k8s_pods, k8s_containers, k8s_namespaces
 WHERE
     metrics_bucket.container_id=containers.id
     AND metrics_bucket.name_id=metric_names.id
     AND containers.container_id=k8s_containers.container_id
     AND k8s_containers.k8s_pod_id=k8s_pods.id
-    AND k8s_pods.k8s_namespace_id=k8s_namespaces.id %s %s
-GROUP BY bucket, pod, namespace, metric_names.name
-ORDER BY bucket`, truncateQuery, query.DateRange[0], query.DateRange[1],
-		cId, metricNameQuery, namespaceQuery, podQuery)
-
-	rows, err, queryTime := s.QueryRowsWithTime(s.db.Raw(q))
+    AND k8s_pods.k8s_namespace_id=k8s_namespaces.id`).
+		AppendIf(namespaceId != 0, " AND k8s_namespaces.id=?", namespaceId).
+		AppendIf(podId != 0, " AND k8s_pods.id=?", podId).
+		Append(`
+GROUP BY bucket, pod, namespace, metric_names.name, group_label
+ORDER BY bucket, namespace, pod, metric_names.name, group_label`)
+
+	pagedQuery, total, err := s.pagedRaw(c, q, page)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
 
+	rows, err, queryTime := s.QueryRowsWithTime(pagedQuery)
 	if err != nil {
-		log.Printf("failed to get metric data: %v", err)
-		s.ApiResponseJson(c, 500, "bad", fmt.Sprintf("unexpected error: %v", err))
+		requestLog(c).Errorf("failed to get metric data: %v", err)
+		s.ApiResponseJsonf(c, 500, "bad", "unexpected error: %v", err)
 		return
 	}
 
 	type MetricItem struct {
-		Pod        string  `json:"pod"`
-		Namespace  string  `json:"namespace"`
-		Value      float64 `json:"value"`
-		Bucket     string  `json:"bucket"`
-		MetricName string  `json:"metric_name"`
+		Pod         string  `json:"pod"`
+		Namespace   string  `json:"namespace"`
+		Value       float64 `json:"value"`
+		Bucket      string  `json:"bucket"`
+		MetricName  string  `json:"metric_name"`
+		MetricLabel string  `json:"metric_label"`
+		Samples     int64   `json:"samples"`
+		Expected    int64   `json:"expected"`
 	}
-	results := make([]MetricItem, 0, 16)
+	defer rows.Close()
+	results := s.newRowWriter(c, page, total, queryTime)
+	completeness := s.newCompleteness(query)
 
 	for rows.Next() {
 		var item MetricItem
+		var podNodeId uint
+		var series int64
 
-		err := rows.Scan(&item.Pod, &item.Namespace, &item.Value, &item.Bucket, &item.MetricName)
+		err := rows.Scan(&item.Pod, &item.Namespace, &item.Value, &item.Bucket, &item.MetricName, &item.MetricLabel,
+			&podNodeId, &item.Samples, &series)
 		if err != nil {
-			log.Printf("failed to get record: %v", err)
+			requestLog(c).Errorf("failed to get record: %v", err)
 			continue
 		}
+		item.Expected = completeness.expected(podNodeId, item.Bucket, series)
 
-		results = append(results, item)
+		if !results.add(item) {
+			break
+		}
 	}
 
-	c.JSON(200, gin.H{
-		"status":        "ok",
-		"message":       "",
-		"data":          results,
-		"count":         len(results),
-		"db_query_time": queryTime.String(),
-	})
+	results.finish()
 }
 
-func (s *NexServer) calculateGranularity(dateRanges []string, timezone, granularity string) string {
+// calculateGranularity returns the expression of the bucket column, or nil
+// if the date range cannot be parsed.
+func (s *NexServer) calculateGranularity(dateRanges []string, timezone, granularity string) *SqlQuery {
 	if dateRanges == nil || len(dateRanges) != 2 {
-		return ""
+		return nil
 	}
 
 	bucket := ""
@@ -1364,23 +1957,21 @@ func (s *NexServer) calculateGranularity(dateRanges []string, timezone, granular
 		}
 	}
 	if bucket != "" {
-		truncateQuery := fmt.Sprintf(`DATE_TRUNC('%s', ts AT TIME ZONE '%s') as bucket`, bucket, timezone)
-
-		return truncateQuery
+		return NewSqlQuery(`DATE_TRUNC(?, ts AT TIME ZONE ?) as bucket`, bucket, timezone)
 	}
 
 	start, err := time.Parse(time.RFC3339, dateRanges[0])
 	if err != nil {
 		start, err = time.Parse("2006-01-02 15:04:05", dateRanges[0])
 		if err != nil {
-			return ""
+			return nil
 		}
 	}
 	end, err := time.Parse(time.RFC3339, dateRanges[1])
 	if err != nil {
 		end, err = time.Parse("2006-01-02 15:04:05", dateRanges[1])
 		if err != nil {
-			return ""
+			return nil
 		}
 	}
 
@@ -1389,35 +1980,45 @@ func (s *NexServer) calculateGranularity(dateRanges []string, timezone, granular
 	if interval == 0 {
 		interval = 1
 	}
-	truncateQuery := ""
-
 	if interval < 60 {
-		truncateQuery = fmt.Sprintf(`
+		return NewSqlQuery(`
 			DATE_TRUNC('hour', ts) +
-			DATE_PART('minute', ts)::int / %d * INTERVAL '%d minute' as bucket`,
+			DATE_PART('minute', ts)::int / ?::int * make_interval(mins => ?) as bucket`,
 			interval, interval)
 	} else if interval < 1440 {
 		interval /= 60
-		truncateQuery = fmt.Sprintf(`
+		return NewSqlQuery(`
 			DATE_TRUNC('day', ts) +
-			DATE_PART('hour', ts)::int / %d * INTERVAL '%d hour' as bucket`,
-			interval, interval)
-	} else {
-		interval /= 1440
-		truncateQuery = fmt.Sprintf(`
-			DATE_TRUNC('month', ts) +
-			DATE_PART('day', ts)::int / %d * INTERVAL '%d day' as bucket`,
+			DATE_PART('hour', ts)::int / ?::int * make_interval(hours => ?) as bucket`,
 			interval, interval)
 	}
 
-	return truncateQuery
+	interval /= 1440
+	return NewSqlQuery(`
+		DATE_TRUNC('month', ts) +
+		DATE_PART('day', ts)::int / ?::int * make_interval(days => ?) as bucket`,
+		interval, interval)
 }
 
 func (s *NexServer) ApiIncidentBasic(c *gin.Context) {
 	incidents := make([]*IncidentItem, 0, 16)
 
+	severities := c.QueryArray("severity")
+	for _, severity := range severities {
+		if !isValidSeverity(severity) {
+			s.ApiResponseJsonf(c, 404, "bad", "invalid severity: %s", severity)
+			return
+		}
+	}
+
 	for eventName := range s.incidentMap {
-		incidents = append(incidents, s.incidentMap[eventName]...)
+		for _, incident := range s.incidentMap[eventName] {
+			if len(severities) > 0 && !stringInSlice(incident.Severity, severities) {
+				continue
+			}
+
+			incidents = append(incidents, incident)
+		}
 	}
 
 	sort.Slice(incidents, func(i, j int) bool {
@@ -1432,44 +2033,72 @@ func (s *NexServer) ApiIncidentBasic(c *gin.Context) {
 }
 
 func (s *NexServer) ApiMetricsClusterSummary(c *gin.Context) {
-	cId := s.Param(c, "clusterId")
+	cId, clusterOk := s.idParam(c, "clusterId", false)
 	query := s.ParseQuery(c)
-	if s.IsValidParams(cId, query, true, true) == false {
+	if s.mathUnsupported(c, query) {
+		return
+	}
+	if !clusterOk || s.IsValidParams(c.Param("clusterId"), query, true, true) == false {
 		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
 		return
 	}
 
 	metricNameIds := s.findMetricIdByNames(query.MetricNames)
-	metricNameQuery := ""
 	if len(query.MetricNames) != len(metricNameIds) {
 		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
 		return
 	}
-	if len(metricNameIds) > 0 {
-		metricNameQuery = fmt.Sprintf(" AND metrics.name_id IN (%s)", strings.Join(metricNameIds, ","))
+
+	counters, err := s.selectCounters(cId, query, metricNameIds)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	page, err := s.parsePage(c)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
 	}
 
 	truncateQuery := s.calculateGranularity(query.DateRange, query.Timezone, query.Granularity)
+	if truncateQuery == nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
 
-	metricQuery := fmt.Sprintf(`
+	metricQuery := NewSqlQuery(`
 SELECT ROUND(value, 2) as value, bucket, metric_names.name 
 FROM
-    (SELECT avg(value) as value, metrics.name_id, %s
-    FROM metrics
-    WHERE ts >= '%s' AND ts < '%s' AND metrics.cluster_id=%s 
+    (SELECT `).
+		AppendQuery(counters.valueExpr(query)).
+		Append(` as value, metrics.name_id, `).
+		AppendQuery(truncateQuery).
+		Append(`
+    FROM `).
+		AppendQuery(counters.source()).
+		Append(`
+    WHERE ts >= ? AND ts < ? AND metrics.cluster_id=?
       AND metrics.process_id=0
-      AND metrics.container_id=0 %s
+      AND metrics.container_id=0`, query.DateRange[0], query.DateRange[1], cId).
+		AppendIf(len(metricNameIds) > 0, " AND metrics.name_id IN (?)", metricNameIds).
+		Append(`
     GROUP BY bucket, metrics.name_id)
         as metrics_bucket, metric_names
 WHERE
     metrics_bucket.name_id=metric_names.id
-ORDER BY bucket`, truncateQuery, query.DateRange[0], query.DateRange[1], cId, metricNameQuery)
+ORDER BY bucket, metric_names.name`)
 
-	rows, err, queryTime := s.QueryRowsWithTime(s.db.Raw(metricQuery))
+	pagedQuery, total, err := s.pagedRaw(c, metricQuery, page)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
 
+	rows, err, queryTime := s.QueryRowsWithTime(pagedQuery)
 	if err != nil {
-		log.Printf("failed to get metric data: %v", err)
-		s.ApiResponseJson(c, 500, "bad", fmt.Sprintf("unexpected error: %v", err))
+		requestLog(c).Errorf("failed to get metric data: %v", err)
+		s.ApiResponseJsonf(c, 500, "bad", "unexpected error: %v", err)
 		return
 	}
 
@@ -1478,25 +2107,22 @@ ORDER BY bucket`, truncateQuery, query.DateRange[0], query.DateRange[1], cId, me
 		Bucket     string  `json:"bucket"`
 		MetricName string  `json:"metric_name"`
 	}
-	results := make([]MetricItem, 0, 16)
+	defer rows.Close()
+	results := s.newRowWriter(c, page, total, queryTime)
 
 	for rows.Next() {
 		var item MetricItem
 
 		err := rows.Scan(&item.Value, &item.Bucket, &item.MetricName)
 		if err != nil {
-			log.Printf("failed to get record: %v", err)
+			requestLog(c).Errorf("failed to get record: %v", err)
 			continue
 		}
 
-		results = append(results, item)
+		if !results.add(item) {
+			break
+		}
 	}
 
-	c.JSON(200, gin.H{
-		"status":        "ok",
-		"message":       "",
-		"data":          results,
-		"count":         len(results),
-		"db_query_time": queryTime.String(),
-	})
+	results.finish()
 }
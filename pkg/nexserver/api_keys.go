@@ -0,0 +1,539 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An API key acts on behalf of its user and is sent in the X-Api-Key
+// header or as a bearer token; only its hash is stored. The calls, the
+// bytes served and the query time of the requests made with a key are
+// counted per day, each replica adding its counts to the database every
+// minute. The daily limits of a key are soft: a key over its limit keeps
+// working, its responses carry a warning header and the channels
+// subscribed to api_key.quota_exceeded are told once a day.
+
+const (
+	apiKeyHeader         = "X-Api-Key"
+	apiKeyTokenPrefix    = "nxk_"
+	quotaWarningHeader   = "X-Quota-Warning"
+	apiUsageFlush        = time.Minute
+	apiKeyLastUsedUpdate = time.Minute
+	apiUsageDayFormat    = "2006-01-02"
+	defaultUsageDays     = 30
+
+	EventApiKeyQuotaExceeded = "api_key.quota_exceeded"
+)
+
+type apiUsageKey struct {
+	keyId uint
+	day   string
+}
+
+type apiUsageCounter struct {
+	calls       int64
+	bytes       int64
+	queryTimeMs float64
+}
+
+type ApiUsage struct {
+	sync.Mutex
+
+	pending map[apiUsageKey]*apiUsageCounter
+	// over holds the day each key went over its limits
+	over map[uint]string
+}
+
+func isApiKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyTokenPrefix)
+}
+
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(sum[:])
+}
+
+func newApiKey() (string, error) {
+	value := make([]byte, 24)
+	if _, err := rand.Read(value); err != nil {
+		return "", err
+	}
+
+	return apiKeyTokenPrefix + hex.EncodeToString(value), nil
+}
+
+func (s *NexServer) verifyApiKey(token string) (*Principal, error) {
+	var key ApiKey
+	if result := s.db.Where("key_hash=?", hashApiKey(token)).First(&key); result.Error != nil {
+		return nil, fmt.Errorf("unknown api key")
+	}
+	if key.Disabled {
+		return nil, fmt.Errorf("api key is disabled")
+	}
+
+	var user User
+	if result := s.db.Where("id=?", key.UserID).First(&user); result.Error != nil {
+		return nil, fmt.Errorf("unknown user")
+	}
+	if user.Disabled {
+		return nil, fmt.Errorf("user is disabled")
+	}
+
+	if now := time.Now(); key.LastUsedTs == nil || now.Sub(*key.LastUsedTs) > apiKeyLastUsedUpdate {
+		s.db.Model(&key).Update("last_used_ts", &now)
+	}
+
+	return &Principal{
+		UserId:   user.ID,
+		Username: user.Username,
+		Provider: user.Provider,
+		Admin:    user.Admin,
+		ApiKeyId: key.ID,
+	}, nil
+}
+
+func (u *ApiUsage) add(keyId uint, day string, bytes int64, queryTimeMs float64) {
+	u.Lock()
+	defer u.Unlock()
+
+	if u.pending == nil {
+		u.pending = make(map[apiUsageKey]*apiUsageCounter)
+	}
+	counter, found := u.pending[apiUsageKey{keyId, day}]
+	if !found {
+		counter = &apiUsageCounter{}
+		u.pending[apiUsageKey{keyId, day}] = counter
+	}
+	counter.calls += 1
+	counter.bytes += bytes
+	counter.queryTimeMs += queryTimeMs
+}
+
+func (u *ApiUsage) take() map[apiUsageKey]*apiUsageCounter {
+	u.Lock()
+	defer u.Unlock()
+
+	pending := u.pending
+	u.pending = nil
+
+	return pending
+}
+
+func (u *ApiUsage) isOver(keyId uint, day string) bool {
+	u.Lock()
+	defer u.Unlock()
+
+	return u.over[keyId] == day
+}
+
+func (u *ApiUsage) setOver(keyId uint, day string) {
+	u.Lock()
+	defer u.Unlock()
+
+	if u.over == nil {
+		u.over = make(map[uint]string)
+	}
+	u.over[keyId] = day
+}
+
+// ApiUsageMiddleware counts the requests made with an API key.
+func (s *NexServer) ApiUsageMiddleware(c *gin.Context) {
+	principal := s.requestPrincipal(c)
+	if principal == nil || principal.ApiKeyId == 0 {
+		c.Next()
+		return
+	}
+
+	day := time.Now().UTC().Format(apiUsageDayFormat)
+	if s.apiUsage.isOver(principal.ApiKeyId, day) {
+		c.Header(quotaWarningHeader, "daily quota of the api key exceeded")
+	}
+
+	c.Next()
+
+	bytes := int64(c.Writer.Size())
+	if bytes < 0 {
+		bytes = 0
+	}
+	var queryTimeMs float64
+	if value, found := c.Get(requestStatsKey); found {
+		if stats, ok := value.(*requestStats); ok {
+			queryTimeMs = float64(atomic.LoadInt64(&stats.queryTime)) / float64(time.Millisecond)
+		}
+	}
+	s.apiUsage.add(principal.ApiKeyId, day, bytes, queryTimeMs)
+}
+
+// flushApiUsage adds the pending counts to the daily usage and checks the
+// limits of the keys.
+func (s *NexServer) flushApiUsage() {
+	for usageKey, counter := range s.apiUsage.take() {
+		var usage ApiKeyUsage
+		err := s.db.Raw(`
+INSERT INTO api_key_usages (api_key_id, day, calls, bytes, query_time_ms, warned)
+VALUES (?, ?, ?, ?, ?, false)
+ON CONFLICT (api_key_id, day) DO UPDATE SET
+	calls = api_key_usages.calls + EXCLUDED.calls,
+	bytes = api_key_usages.bytes + EXCLUDED.bytes,
+	query_time_ms = api_key_usages.query_time_ms + EXCLUDED.query_time_ms
+RETURNING calls, bytes, warned`,
+			usageKey.keyId, usageKey.day, counter.calls, counter.bytes, counter.queryTimeMs).
+			Row().Scan(&usage.Calls, &usage.Bytes, &usage.Warned)
+		if err != nil {
+			apiLog.Errorf("ApiUsage: failed to save usage of key %d: %v\n", usageKey.keyId, err)
+			continue
+		}
+
+		var key ApiKey
+		if result := s.db.Where("id=?", usageKey.keyId).First(&key); result.Error != nil {
+			continue
+		}
+		if !key.overQuota(usage.Calls, usage.Bytes) {
+			continue
+		}
+		s.apiUsage.setOver(key.ID, usageKey.day)
+		if usage.Warned {
+			continue
+		}
+
+		// the replica marking the day warned sends the notification
+		result := s.db.Model(&ApiKeyUsage{}).
+			Where("api_key_id=? AND day=? AND warned=?", key.ID, usageKey.day, false).
+			Update("warned", true)
+		if result.Error != nil || result.RowsAffected == 0 {
+			continue
+		}
+
+		apiLog.Warnf("ApiUsage: api key %s (%d) is over its daily quota: %d calls, %d bytes\n",
+			key.Name, key.ID, usage.Calls, usage.Bytes)
+		s.emitEvent(EventApiKeyQuotaExceeded, 0, gin.H{
+			"api_key_id":  key.ID,
+			"name":        key.Name,
+			"day":         usageKey.day,
+			"calls":       usage.Calls,
+			"bytes":       usage.Bytes,
+			"daily_calls": key.DailyCalls,
+			"daily_bytes": key.DailyBytes,
+		})
+	}
+}
+
+func (s *NexServer) InitApiUsage() {
+	ticker := time.NewTicker(apiUsageFlush)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.flushApiUsage()
+	}
+}
+
+func (key *ApiKey) overQuota(calls, bytes int64) bool {
+	return (key.DailyCalls > 0 && calls > key.DailyCalls) ||
+		(key.DailyBytes > 0 && bytes > key.DailyBytes)
+}
+
+type ApiKeyItem struct {
+	Id         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	UserId     uint       `json:"user_id"`
+	DailyCalls int64      `json:"daily_calls"`
+	DailyBytes int64      `json:"daily_bytes"`
+	Disabled   bool       `json:"disabled"`
+	LastUsedTs *time.Time `json:"last_used_ts"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func newApiKeyItem(key *ApiKey) ApiKeyItem {
+	return ApiKeyItem{
+		Id:         key.ID,
+		Name:       key.Name,
+		Prefix:     key.Prefix,
+		UserId:     key.UserID,
+		DailyCalls: key.DailyCalls,
+		DailyBytes: key.DailyBytes,
+		Disabled:   key.Disabled,
+		LastUsedTs: key.LastUsedTs,
+		CreatedAt:  key.CreatedAt,
+	}
+}
+
+func (s *NexServer) ApiAdminApiKeys(c *gin.Context) {
+	var keys []ApiKey
+
+	if result := s.requestDB(c).Order("id").Find(&keys); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	items := make([]ApiKeyItem, 0, len(keys))
+	for idx := range keys {
+		items = append(items, newApiKeyItem(&keys[idx]))
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+func (s *NexServer) ApiAdminCreateApiKey(c *gin.Context) {
+	type CreateApiKeyRequest struct {
+		Name       string `json:"name" binding:"required"`
+		UserId     uint   `json:"user_id" binding:"required"`
+		DailyCalls int64  `json:"daily_calls"`
+		DailyBytes int64  `json:"daily_bytes"`
+	}
+	var req CreateApiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+	if req.DailyCalls < 0 || req.DailyBytes < 0 {
+		s.ApiResponseJson(c, 400, "bad", "daily limits must not be negative")
+		return
+	}
+
+	var user User
+	if result := s.requestDB(c).Where("id=?", req.UserId).First(&user); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "user not found")
+		return
+	}
+
+	token, err := newApiKey()
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to generate key: %v", err)
+		return
+	}
+
+	key := ApiKey{
+		Name:       req.Name,
+		Prefix:     token[:len(apiKeyTokenPrefix)+6],
+		KeyHash:    hashApiKey(token),
+		UserID:     user.ID,
+		DailyCalls: req.DailyCalls,
+		DailyBytes: req.DailyBytes,
+	}
+	if result := s.requestDB(c).Create(&key); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create api key: %v", result.Error)
+		return
+	}
+
+	// the key is only shown once
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"key":     token,
+			"api_key": newApiKeyItem(&key),
+		},
+	})
+}
+
+func (s *NexServer) ApiAdminUpdateApiKey(c *gin.Context) {
+	keyId, ok := s.idParam(c, "keyId", false)
+	if !ok {
+		s.ApiResponseJson(c, 400, "bad", "invalid api key id")
+		return
+	}
+
+	type UpdateApiKeyRequest struct {
+		Name       *string `json:"name"`
+		DailyCalls *int64  `json:"daily_calls"`
+		DailyBytes *int64  `json:"daily_bytes"`
+		Disabled   *bool   `json:"disabled"`
+	}
+	var req UpdateApiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	var key ApiKey
+	if result := s.requestDB(c).Where("id=?", keyId).First(&key); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "api key not found")
+		return
+	}
+
+	if req.Name != nil {
+		key.Name = *req.Name
+	}
+	if req.DailyCalls != nil {
+		key.DailyCalls = *req.DailyCalls
+	}
+	if req.DailyBytes != nil {
+		key.DailyBytes = *req.DailyBytes
+	}
+	if req.Disabled != nil {
+		key.Disabled = *req.Disabled
+	}
+	if key.DailyCalls < 0 || key.DailyBytes < 0 {
+		s.ApiResponseJson(c, 400, "bad", "daily limits must not be negative")
+		return
+	}
+
+	if result := s.requestDB(c).Save(&key); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to update api key: %v", result.Error)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    newApiKeyItem(&key),
+	})
+}
+
+func (s *NexServer) ApiAdminDeleteApiKey(c *gin.Context) {
+	keyId, ok := s.idParam(c, "keyId", false)
+	if !ok {
+		s.ApiResponseJson(c, 400, "bad", "invalid api key id")
+		return
+	}
+
+	// the usage is kept for the chargeback of past periods
+	result := s.requestDB(c).Where("id=?", keyId).Delete(&ApiKey{})
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to delete api key: %v", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		s.ApiResponseJson(c, 404, "bad", "api key not found")
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+// ApiAdminUsage reports the usage of the API keys over a range of days,
+// the last 30 by default.
+func (s *NexServer) ApiAdminUsage(c *gin.Context) {
+	now := time.Now().UTC()
+	from := now.AddDate(0, 0, -defaultUsageDays+1).Format(apiUsageDayFormat)
+	to := now.Format(apiUsageDayFormat)
+	for _, param := range []struct {
+		name  string
+		value *string
+	}{{"from", &from}, {"to", &to}} {
+		value := c.Query(param.name)
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse(apiUsageDayFormat, value); err != nil {
+			s.ApiResponseJsonf(c, 400, "bad", "invalid %s, expected YYYY-MM-DD", param.name)
+			return
+		}
+		*param.value = value
+	}
+
+	var keys []ApiKey
+	if result := s.requestDB(c).Unscoped().Order("id").Find(&keys); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	db := s.requestDB(c).Where("day >= ? AND day <= ?", from, to)
+	if value := c.Query("key_id"); value != "" {
+		keyId, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			s.ApiResponseJson(c, 400, "bad", "invalid key_id")
+			return
+		}
+		db = db.Where("api_key_id=?", keyId)
+	}
+	var usages []ApiKeyUsage
+	if result := db.Order("api_key_id, day").Find(&usages); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	type UsageDay struct {
+		Day         string  `json:"day"`
+		Calls       int64   `json:"calls"`
+		Bytes       int64   `json:"bytes"`
+		QueryTimeMs float64 `json:"query_time_ms"`
+		OverQuota   bool    `json:"over_quota"`
+	}
+	type UsageItem struct {
+		ApiKeyItem
+		Deleted     bool       `json:"deleted"`
+		Calls       int64      `json:"calls"`
+		Bytes       int64      `json:"bytes"`
+		QueryTimeMs float64    `json:"query_time_ms"`
+		DaysOver    int        `json:"days_over_quota"`
+		Days        []UsageDay `json:"days"`
+	}
+
+	keyMap := make(map[uint]*ApiKey)
+	for idx := range keys {
+		keyMap[keys[idx].ID] = &keys[idx]
+	}
+
+	items := make([]*UsageItem, 0)
+	itemMap := make(map[uint]*UsageItem)
+	for _, usage := range usages {
+		key, found := keyMap[usage.ApiKeyID]
+		if !found {
+			continue
+		}
+		item, found := itemMap[usage.ApiKeyID]
+		if !found {
+			item = &UsageItem{
+				ApiKeyItem: newApiKeyItem(key),
+				Deleted:    key.DeletedAt != nil,
+				Days:       make([]UsageDay, 0),
+			}
+			itemMap[usage.ApiKeyID] = item
+			items = append(items, item)
+		}
+
+		overQuota := key.overQuota(usage.Calls, usage.Bytes)
+		item.Calls += usage.Calls
+		item.Bytes += usage.Bytes
+		item.QueryTimeMs += usage.QueryTimeMs
+		if overQuota {
+			item.DaysOver += 1
+		}
+		item.Days = append(item.Days, UsageDay{
+			Day:         usage.Day.Format(apiUsageDayFormat),
+			Calls:       usage.Calls,
+			Bytes:       usage.Bytes,
+			QueryTimeMs: usage.QueryTimeMs,
+			OverQuota:   overQuota,
+		})
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"from":    from,
+		"to":      to,
+		"data":    items,
+	})
+}
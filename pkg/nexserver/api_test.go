@@ -0,0 +1,123 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var injectionPayloads = []string{
+	"1'",
+	"1;",
+	"1' OR '1'='1",
+	"1; DROP TABLE agents; --",
+	"1 OR 1=1",
+}
+
+func newInjectionRouter(s *NexServer) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/clusters/:clusterId/agents", s.ApiAgentList)
+	router.GET("/clusters/:clusterId/nodes", s.ApiNodeList)
+	router.GET("/agents/:agentId/config", s.ApiAgentConfig)
+	router.DELETE("/subscriptions/:subscriptionId", s.ApiDeleteSubscription)
+	router.GET("/metrics/:clusterId/nodes", s.ApiMetricsNodes)
+	router.GET("/metrics/:clusterId/nodes/:nodeId", s.ApiMetricsNodes)
+
+	return router
+}
+
+func TestApiRejectsInjectedIds(t *testing.T) {
+	paths := []string{
+		"/clusters/%s/agents",
+		"/clusters/%s/nodes",
+		"/agents/%s/config",
+		"/subscriptions/%s",
+		"/metrics/%s/nodes?metricNames=cpu&dateRange=2019-01-01&dateRange=2019-01-02",
+		"/metrics/1/nodes/%s?metricNames=cpu&dateRange=2019-01-01&dateRange=2019-01-02",
+	}
+
+	for _, path := range paths {
+		for _, payload := range injectionPayloads {
+			s, recorder := newRecordingServer(t)
+			router := newInjectionRouter(s)
+
+			method := http.MethodGet
+			if strings.HasPrefix(path, "/subscriptions") {
+				method = http.MethodDelete
+			}
+			target := strings.Replace(path, "%s", url.PathEscape(payload), 1)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+
+			if w.Code != http.StatusNotFound {
+				t.Errorf("%s %s: status = %d, want 404", method, target, w.Code)
+			}
+			if len(recorder.statements) != 0 {
+				t.Errorf("%s %s: sent %v", method, target, recorder.statements)
+			}
+		}
+	}
+}
+
+func TestApiBindsInjectedNames(t *testing.T) {
+	names := []string{
+		"cpu;DROP TABLE metrics;--",
+		"cpu'; DROP TABLE metrics; --",
+		"cpu' OR '1'='1",
+	}
+
+	for _, name := range names {
+		s, recorder := newRecordingServer(t)
+		router := newInjectionRouter(s)
+
+		query := url.Values{}
+		query.Set("metricNames", name)
+		query.Add("dateRange", "2019-01-01")
+		query.Add("dateRange", "2019-01-02")
+		target := "/metrics/1/nodes?" + query.Encode()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: status = %d, want 404", target, w.Code)
+		}
+		if len(recorder.statements) == 0 {
+			t.Fatalf("%s: metric names were not looked up", target)
+		}
+		for _, statement := range recorder.statements {
+			if strings.Contains(statement, "DROP TABLE") || strings.Contains(statement, "'1'='1") {
+				t.Errorf("%s: name formatted into %s", target, statement)
+			}
+		}
+		bound := false
+		for _, arg := range recorder.args {
+			if value, ok := arg.(string); ok && value == s.RemoveSpecialChar(name) {
+				bound = true
+			}
+		}
+		if !bound {
+			t.Errorf("%s: name was not bound as an argument: %v", target, recorder.args)
+		}
+	}
+}
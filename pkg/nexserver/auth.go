@@ -0,0 +1,613 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Users sign in with a local password or through an OIDC provider and
+// receive a JWT (HS256), sent back as a bearer token or in a cookie by
+// the dashboard. Scripts and integrations use API keys instead.
+// AuthMiddleware attaches the principal of a valid token to the gin
+// context; when auth is required, /api/v1 refuses anonymous requests
+// except the ones authenticated otherwise (health, remote_write, embed
+// tokens) and the sign-in endpoints. Only admins reach the routes
+// changing state. Tokens are not stored: a disabled or deleted user is
+// refused on the next request, and changing the signing secret signs
+// everybody out.
+
+const (
+	authKeySetting        = "auth.key"
+	authCookieName        = "nexclipper_token"
+	authIssuer            = "nexclipper"
+	principalKey          = "principal"
+	defaultAuthTokenHours = 12
+
+	UserProviderLocal = "local"
+	UserProviderOIDC  = "oidc"
+)
+
+// authExemptPaths do not require a principal
+var authExemptPaths = []string{"/api/v1/health", "/api/v1/write", "/api/v1/auth/", "/api/v1/spec", "/api/v1/spec/"}
+
+// dummyPasswordHash is compared when the user does not exist, so both
+// cases take the same time
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("nexclipper"), bcrypt.DefaultCost)
+
+type AuthConfig struct {
+	Required   bool
+	Secret     string `secret:"true"`
+	TokenHours int
+	OIDC       OIDCConfig
+	Hook       AuthHookConfig
+}
+
+type AuthState struct {
+	sync.RWMutex
+
+	key       []byte
+	provider  *oidcProvider
+	hook      AuthHook
+	decisions map[string]authHookEntry
+}
+
+type Principal struct {
+	UserId   uint   `json:"user_id"`
+	Username string `json:"username"`
+	Provider string `json:"provider"`
+	Admin    bool   `json:"admin"`
+	ApiKeyId uint   `json:"api_key_id,omitempty"`
+}
+
+type authClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Name      string `json:"name"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+func (s *NexServer) authKey() ([]byte, error) {
+	if s.config.Auth.Secret != "" {
+		return []byte(s.config.Auth.Secret), nil
+	}
+
+	s.auth.RLock()
+	key := s.auth.key
+	s.auth.RUnlock()
+	if key != nil {
+		return key, nil
+	}
+
+	value, err := newEmbedKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var setting Setting
+	result := s.db.Where(Setting{Name: authKeySetting}).Attrs(Setting{Value: value}).FirstOrCreate(&setting)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	key = []byte(setting.Value)
+
+	s.auth.Lock()
+	s.auth.key = key
+	s.auth.Unlock()
+
+	return key, nil
+}
+
+func (s *NexServer) authTokenTTL() time.Duration {
+	hours := s.config.Auth.TokenHours
+	if hours <= 0 {
+		hours = defaultAuthTokenHours
+	}
+
+	return time.Duration(hours) * time.Hour
+}
+
+func (s *NexServer) issueAuthToken(user *User) (string, time.Time, error) {
+	key, err := s.authKey()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	expiresTs := now.Add(s.authTokenTTL())
+	claims, err := json.Marshal(authClaims{
+		Issuer:    authIssuer,
+		Subject:   strconv.FormatUint(uint64(user.ID), 10),
+		Name:      user.Username,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresTs.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), expiresTs, nil
+}
+
+// decodeJWT splits a JWT and decodes its header and claims, leaving the
+// signature to the caller.
+func decodeJWT(token string, header, claims interface{}) (string, []byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", nil, fmt.Errorf("malformed token")
+	}
+
+	for idx, target := range []interface{}{header, claims} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[idx])
+		if err != nil {
+			return "", nil, fmt.Errorf("malformed token")
+		}
+		if err := json.Unmarshal(data, target); err != nil {
+			return "", nil, fmt.Errorf("malformed token")
+		}
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, fmt.Errorf("malformed token")
+	}
+
+	return parts[0] + "." + parts[1], signature, nil
+}
+
+func (s *NexServer) verifyAuthToken(token string) (*Principal, error) {
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	var claims authClaims
+
+	signed, signature, err := decodeJWT(token, &header, &claims)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("unsupported algorithm")
+	}
+
+	key, err := s.authKey()
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	if claims.Issuer != authIssuer {
+		return nil, fmt.Errorf("invalid issuer")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("token expired")
+	}
+
+	userId, err := strconv.ParseUint(claims.Subject, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subject")
+	}
+
+	var user User
+	if result := s.db.Where("id=?", userId).First(&user); result.Error != nil {
+		return nil, fmt.Errorf("unknown user")
+	}
+	if user.Disabled {
+		return nil, fmt.Errorf("user is disabled")
+	}
+
+	return &Principal{
+		UserId:   user.ID,
+		Username: user.Username,
+		Provider: user.Provider,
+		Admin:    user.Admin,
+	}, nil
+}
+
+func requestAuthToken(c *gin.Context) string {
+	if key := c.GetHeader(apiKeyHeader); key != "" {
+		return key
+	}
+	if header := c.GetHeader("Authorization"); strings.HasPrefix(header, "Bearer ") {
+		return strings.TrimPrefix(header, "Bearer ")
+	}
+	if cookie, err := c.Cookie(authCookieName); err == nil {
+		return cookie
+	}
+
+	return ""
+}
+
+func isAuthExempt(path string) bool {
+	if path == federateMetricsPath {
+		return false
+	}
+	if !strings.HasPrefix(path, "/api/v1/") {
+		return true
+	}
+	for _, exempt := range authExemptPaths {
+		if path == exempt || (strings.HasSuffix(exempt, "/") && strings.HasPrefix(path, exempt)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AuthMiddleware attaches the principal of the request token, if any.
+func (s *NexServer) AuthMiddleware(c *gin.Context) {
+	exempt := isAuthExempt(c.Request.URL.Path) || isEmbedRequest(c.Request)
+	hook := s.authHook()
+
+	if token := requestAuthToken(c); token != "" {
+		verify := s.verifyAuthToken
+		if isApiKey(token) {
+			verify = s.verifyApiKey
+		}
+		principal, err := verify(token)
+		if err == nil {
+			c.Set(principalKey, principal)
+		} else if !exempt && hook == nil {
+			s.ApiResponseJsonf(c, 401, "bad", "invalid token: %v", err)
+			c.Abort()
+			return
+		}
+	}
+
+	// the hook may know the credentials of a token invalid here
+	if hook != nil && !exempt && !s.applyAuthHook(c, hook) {
+		c.Abort()
+		return
+	}
+
+	if s.config.Auth.Required && !exempt && s.requestPrincipal(c) == nil {
+		s.ApiResponseJson(c, 401, "bad", "unauthorized")
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
+
+// requireAdmin refuses the requests of principals without the admin role.
+// Anonymous requests only pass when auth is not required and no hook is
+// set, the server is then open to everybody anyway; a hook allowing a
+// request without an identity does not make it admin.
+func (s *NexServer) requireAdmin(c *gin.Context) {
+	principal := s.requestPrincipal(c)
+	if principal == nil && (s.config.Auth.Required || s.authHook() != nil) {
+		s.ApiResponseJson(c, 401, "bad", "unauthorized")
+		c.Abort()
+		return
+	}
+	if principal != nil && !principal.Admin {
+		s.ApiResponseJson(c, 403, "bad", "admin role required")
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
+
+// requestPrincipal returns the authenticated principal, nil if anonymous.
+func (s *NexServer) requestPrincipal(c *gin.Context) *Principal {
+	value, found := c.Get(principalKey)
+	if !found {
+		return nil
+	}
+
+	return value.(*Principal)
+}
+
+func (s *NexServer) setAuthCookie(c *gin.Context, token string, expiresTs time.Time) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     authCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresTs,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// signIn issues the token of the user and records the login.
+func (s *NexServer) signIn(c *gin.Context, user *User) (string, time.Time, error) {
+	token, expiresTs, err := s.issueAuthToken(user)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	s.requestDB(c).Model(user).Update("last_login_ts", &now)
+	s.setAuthCookie(c, token, expiresTs)
+
+	return token, expiresTs, nil
+}
+
+func hashPassword(password string) (string, error) {
+	if len(password) < 8 {
+		return "", fmt.Errorf("password must have at least 8 characters")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (s *NexServer) ApiLogin(c *gin.Context) {
+	type LoginRequest struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	var user User
+	result := s.requestDB(c).Where("username=? AND provider=?", req.Username, UserProviderLocal).First(&user)
+
+	hash := dummyPasswordHash
+	if result.Error == nil {
+		hash = []byte(user.PasswordHash)
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(req.Password))
+	if result.Error != nil || err != nil || user.Disabled {
+		s.ApiResponseJson(c, 401, "bad", "invalid username or password")
+		return
+	}
+
+	token, expiresTs, err := s.signIn(c, &user)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to issue token: %v", err)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"token":      token,
+			"expires_ts": expiresTs,
+			"user":       newUserItem(&user),
+		},
+	})
+}
+
+func (s *NexServer) ApiLogout(c *gin.Context) {
+	s.setAuthCookie(c, "", time.Unix(0, 0))
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+func (s *NexServer) ApiAuthMe(c *gin.Context) {
+	principal := s.requestPrincipal(c)
+	if principal == nil {
+		s.ApiResponseJson(c, 401, "bad", "unauthorized")
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    principal,
+	})
+}
+
+type UserItem struct {
+	Id          uint       `json:"id"`
+	Username    string     `json:"username"`
+	Email       string     `json:"email"`
+	DisplayName string     `json:"display_name"`
+	Provider    string     `json:"provider"`
+	Admin       bool       `json:"admin"`
+	Disabled    bool       `json:"disabled"`
+	LastLoginTs *time.Time `json:"last_login_ts"`
+	CreatedTs   time.Time  `json:"created_ts"`
+}
+
+func newUserItem(user *User) UserItem {
+	return UserItem{
+		Id:          user.ID,
+		Username:    user.Username,
+		Email:       user.Email,
+		DisplayName: user.DisplayName,
+		Provider:    user.Provider,
+		Admin:       user.Admin,
+		Disabled:    user.Disabled,
+		LastLoginTs: user.LastLoginTs,
+		CreatedTs:   user.CreatedAt,
+	}
+}
+
+func (s *NexServer) ApiAdminUsers(c *gin.Context) {
+	var users []User
+
+	if result := s.requestDB(c).Order("username").Find(&users); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	items := make([]UserItem, 0, len(users))
+	for idx := range users {
+		items = append(items, newUserItem(&users[idx]))
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+func (s *NexServer) ApiAdminCreateUser(c *gin.Context) {
+	type CreateUserRequest struct {
+		Username    string `json:"username" binding:"required"`
+		Password    string `json:"password" binding:"required"`
+		Email       string `json:"email"`
+		DisplayName string `json:"display_name"`
+		Admin       bool   `json:"admin"`
+	}
+	var req CreateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	var count int
+	s.requestDB(c).Model(&User{}).Where("username=?", req.Username).Count(&count)
+	if count > 0 {
+		s.ApiResponseJson(c, 409, "bad", "username already exists")
+		return
+	}
+
+	user := User{
+		Username:     req.Username,
+		Email:        req.Email,
+		DisplayName:  req.DisplayName,
+		PasswordHash: hash,
+		Provider:     UserProviderLocal,
+		Admin:        req.Admin,
+	}
+	if result := s.requestDB(c).Create(&user); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create user: %v", result.Error)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    newUserItem(&user),
+	})
+}
+
+func (s *NexServer) ApiAdminUpdateUser(c *gin.Context) {
+	userId, ok := s.idParam(c, "userId", false)
+	if !ok {
+		s.ApiResponseJson(c, 400, "bad", "invalid user id")
+		return
+	}
+
+	type UpdateUserRequest struct {
+		Password    *string `json:"password"`
+		Email       *string `json:"email"`
+		DisplayName *string `json:"display_name"`
+		Admin       *bool   `json:"admin"`
+		Disabled    *bool   `json:"disabled"`
+	}
+	var req UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	var user User
+	if result := s.requestDB(c).Where("id=?", userId).First(&user); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "user not found")
+		return
+	}
+
+	if req.Password != nil {
+		if user.Provider != UserProviderLocal {
+			s.ApiResponseJson(c, 400, "bad", "only local users have a password")
+			return
+		}
+		hash, err := hashPassword(*req.Password)
+		if err != nil {
+			s.ApiResponseJson(c, 400, "bad", err.Error())
+			return
+		}
+		user.PasswordHash = hash
+	}
+	if req.Email != nil {
+		user.Email = *req.Email
+	}
+	if req.DisplayName != nil {
+		user.DisplayName = *req.DisplayName
+	}
+	if req.Admin != nil {
+		user.Admin = *req.Admin
+	}
+	if req.Disabled != nil {
+		user.Disabled = *req.Disabled
+	}
+
+	if result := s.requestDB(c).Save(&user); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to update user: %v", result.Error)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    newUserItem(&user),
+	})
+}
+
+func (s *NexServer) ApiAdminDeleteUser(c *gin.Context) {
+	userId, ok := s.idParam(c, "userId", false)
+	if !ok {
+		s.ApiResponseJson(c, 400, "bad", "invalid user id")
+		return
+	}
+
+	// the username and the subject are unique, keep them reusable
+	result := s.requestDB(c).Unscoped().Where("id=?", userId).Delete(&User{})
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to delete user: %v", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		s.ApiResponseJson(c, 404, "bad", "user not found")
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
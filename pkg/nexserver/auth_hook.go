@@ -0,0 +1,370 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// An auth hook sees every request to /api/v1 that is not exempt, after
+// the token of the request was verified, and approves or denies it. The
+// hook may also answer with an identity of its own for the credentials it
+// understands (a corporate SSO header, a token of another system): the
+// identity is mapped to a user of the hook provider, created on first use
+// and made admin or not on every decision; only admins reach the routes
+// changing state. The hook is an HTTP endpoint
+// receiving the request as JSON, signed like the webhooks, or any AuthHook
+// set by a program embedding the server. Decisions are cached for a short
+// while per request line, user and forwarded headers; an unreachable hook
+// refuses the requests unless auth.hook_fail_open is set.
+
+const (
+	UserProviderHook = "hook"
+
+	authHookTimeout         = 5 * time.Second
+	authHookSignatureHeader = "X-NexClipper-Signature"
+	defaultAuthHookCache    = 30
+	maxAuthHookDecisions    = 10000
+	maxAuthHookResponse     = 64 * 1024
+)
+
+type AuthHookConfig struct {
+	Url          string
+	Secret       string `secret:"true"`
+	Headers      []string
+	CacheSeconds int
+	FailOpen     bool
+}
+
+type AuthHookRequest struct {
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Query      string            `json:"query"`
+	RemoteAddr string            `json:"remote_addr"`
+	Headers    map[string]string `json:"headers"`
+	Principal  *Principal        `json:"principal"`
+}
+
+type AuthHookIdentity struct {
+	Subject     string `json:"subject"`
+	Username    string `json:"username"`
+	Email       string `json:"email"`
+	DisplayName string `json:"display_name"`
+	Admin       bool   `json:"admin"`
+}
+
+type AuthHookDecision struct {
+	Allow    bool              `json:"allow"`
+	Reason   string            `json:"reason"`
+	Identity *AuthHookIdentity `json:"identity"`
+}
+
+// AuthHook decides on the requests to the API.
+type AuthHook interface {
+	Authorize(ctx context.Context, req *AuthHookRequest) (*AuthHookDecision, error)
+}
+
+type authHookEntry struct {
+	decision  *AuthHookDecision
+	expiresTs time.Time
+}
+
+type webhookAuthHook struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func (hook *webhookAuthHook) Authorize(ctx context.Context, req *AuthHookRequest) (*AuthHookDecision, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, hook.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq = httpReq.WithContext(ctx)
+	httpReq.Header.Set("Content-Type", "application/json")
+	if hook.secret != "" {
+		httpReq.Header.Set(authHookSignatureHeader, webhookSignature(hook.secret, body))
+	}
+
+	resp, err := hook.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxAuthHookResponse))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, respBody)
+	}
+
+	var decision AuthHookDecision
+	if err := json.Unmarshal(respBody, &decision); err != nil {
+		return nil, fmt.Errorf("invalid decision: %v", err)
+	}
+
+	return &decision, nil
+}
+
+func (s *NexServer) authHook() AuthHook {
+	s.auth.RLock()
+	defer s.auth.RUnlock()
+
+	return s.auth.hook
+}
+
+func (s *NexServer) authHookCacheTTL() time.Duration {
+	seconds := s.config.Auth.Hook.CacheSeconds
+	if seconds < 0 {
+		return 0
+	}
+	if seconds == 0 {
+		seconds = defaultAuthHookCache
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+func (s *NexServer) newAuthHookRequest(c *gin.Context) *AuthHookRequest {
+	req := &AuthHookRequest{
+		Method:     c.Request.Method,
+		Path:       c.Request.URL.Path,
+		Query:      c.Request.URL.RawQuery,
+		RemoteAddr: s.requestClientIp(c),
+		Headers:    make(map[string]string),
+		Principal:  s.requestPrincipal(c),
+	}
+	for _, name := range s.config.Auth.Hook.Headers {
+		if value := c.GetHeader(name); value != "" {
+			req.Headers[name] = value
+		}
+	}
+
+	return req
+}
+
+func authHookCacheKey(req *AuthHookRequest) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s?%s\n", req.Method, req.Path, req.Query)
+	if req.Principal != nil {
+		fmt.Fprintf(hash, "user:%d\n", req.Principal.UserId)
+	}
+	names := make([]string, 0, len(req.Headers))
+	for name := range req.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s:%s\n", strings.ToLower(name), req.Headers[name])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (s *NexServer) cachedAuthDecision(key string) *AuthHookDecision {
+	s.auth.RLock()
+	defer s.auth.RUnlock()
+
+	entry, found := s.auth.decisions[key]
+	if !found || time.Now().After(entry.expiresTs) {
+		return nil
+	}
+
+	return entry.decision
+}
+
+func (s *NexServer) cacheAuthDecision(key string, decision *AuthHookDecision) {
+	ttl := s.authHookCacheTTL()
+	if ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	s.auth.Lock()
+	defer s.auth.Unlock()
+
+	if len(s.auth.decisions) >= maxAuthHookDecisions {
+		for cached, entry := range s.auth.decisions {
+			if now.After(entry.expiresTs) {
+				delete(s.auth.decisions, cached)
+			}
+		}
+		if len(s.auth.decisions) >= maxAuthHookDecisions {
+			s.auth.decisions = make(map[string]authHookEntry)
+		}
+	}
+	s.auth.decisions[key] = authHookEntry{decision: decision, expiresTs: now.Add(ttl)}
+}
+
+// findHookUser returns the user of the identity, created on first use.
+func (s *NexServer) findHookUser(c *gin.Context, identity *AuthHookIdentity) (*User, error) {
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("identity without subject")
+	}
+
+	var user User
+	result := s.requestDB(c).Where("provider=? AND subject=?", UserProviderHook, identity.Subject).First(&user)
+	if result.Error == nil {
+		if user.Disabled {
+			return nil, fmt.Errorf("user is disabled")
+		}
+		if user.Email != identity.Email || user.DisplayName != identity.DisplayName || user.Admin != identity.Admin {
+			user.Email = identity.Email
+			user.DisplayName = identity.DisplayName
+			user.Admin = identity.Admin
+			s.requestDB(c).Model(&user).Updates(map[string]interface{}{
+				"email": identity.Email, "display_name": identity.DisplayName, "admin": identity.Admin})
+		}
+		return &user, nil
+	}
+
+	username := identity.Username
+	if username == "" {
+		username = identity.Email
+	}
+	if username == "" {
+		username = identity.Subject
+	}
+
+	var count int
+	s.requestDB(c).Model(&User{}).Where("username=?", username).Count(&count)
+	if count > 0 {
+		return nil, fmt.Errorf("username %s already exists", username)
+	}
+
+	user = User{
+		Username:    username,
+		Email:       identity.Email,
+		DisplayName: identity.DisplayName,
+		Provider:    UserProviderHook,
+		Subject:     identity.Subject,
+		Admin:       identity.Admin,
+	}
+	if result := s.requestDB(c).Create(&user); result.Error != nil {
+		return nil, result.Error
+	}
+	requestLog(c).Infof("Auth hook: user %s created\n", username)
+
+	return &user, nil
+}
+
+// applyAuthHook asks the hook about the request, replacing its principal
+// with the identity the hook answered. It returns false once the request
+// was refused.
+func (s *NexServer) applyAuthHook(c *gin.Context, hook AuthHook) bool {
+	req := s.newAuthHookRequest(c)
+	key := authHookCacheKey(req)
+
+	decision := s.cachedAuthDecision(key)
+	if decision == nil {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), authHookTimeout)
+		defer cancel()
+
+		var err error
+		decision, err = hook.Authorize(ctx, req)
+		if err != nil {
+			requestLog(c).Errorf("Auth hook: %v", err)
+			if s.config.Auth.Hook.FailOpen {
+				return true
+			}
+			s.ApiResponseJson(c, 503, "bad", "authentication hook unavailable")
+			return false
+		}
+		s.cacheAuthDecision(key, decision)
+	}
+
+	if !decision.Allow {
+		reason := decision.Reason
+		if reason == "" {
+			reason = "denied by authentication hook"
+		}
+		code := 401
+		if req.Principal != nil || decision.Identity != nil {
+			code = 403
+		}
+		s.ApiResponseJson(c, code, "bad", reason)
+		return false
+	}
+
+	if decision.Identity != nil {
+		user, err := s.findHookUser(c, decision.Identity)
+		if err != nil {
+			s.ApiResponseJsonf(c, 401, "bad", "invalid identity: %v", err)
+			return false
+		}
+		c.Set(principalKey, &Principal{
+			UserId:   user.ID,
+			Username: user.Username,
+			Provider: user.Provider,
+			Admin:    user.Admin,
+		})
+	}
+
+	return true
+}
+
+// SetAuthHook replaces the auth hook, none if nil.
+func (s *NexServer) SetAuthHook(hook AuthHook) {
+	s.auth.Lock()
+	s.auth.hook = hook
+	s.auth.decisions = make(map[string]authHookEntry)
+	s.auth.Unlock()
+}
+
+func (s *NexServer) SetAuthHookConfig(url, secret string, headers []string, cacheSeconds int, failOpen bool) {
+	canonical := make([]string, 0, len(headers))
+	for _, header := range headers {
+		canonical = append(canonical, http.CanonicalHeaderKey(strings.TrimSpace(header)))
+	}
+
+	s.config.Auth.Hook = AuthHookConfig{
+		Url:          url,
+		Secret:       secret,
+		Headers:      canonical,
+		CacheSeconds: cacheSeconds,
+		FailOpen:     failOpen,
+	}
+	if url == "" {
+		return
+	}
+
+	s.SetAuthHook(&webhookAuthHook{
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: authHookTimeout},
+	})
+	serverLog.Infof("Auth hook: requests are authorized by %s\n", url)
+}
@@ -0,0 +1,583 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bundles carry metrics out of air-gapped sites. The site server writes a
+// bundle of the metrics received since the previous one to ExportDir; the
+// central server imports bundles dropped into ImportDir or uploaded through
+// the admin API. Bundles are gzipped JSON sealed with AES-256-GCM under a
+// key derived with scrypt from the shared passphrase and the random salt
+// following the magic of the bundle.
+
+const (
+	bundleVersion        = 2
+	bundleMagic          = "NXB2"
+	bundleLegacyMagic    = "NXB1"
+	bundleSaltSize       = 16
+	bundleCursorSetting  = "bundle_export_ts"
+	bundleExtension      = ".bundle"
+	bundleImportedSuffix = ".imported"
+	bundleFailedSuffix   = ".failed"
+	bundleMaxSize        = 512 * 1024 * 1024
+)
+
+type BundleConfig struct {
+	Site            string
+	ExportDir       string
+	ImportDir       string
+	IntervalMinutes int
+	Key             string `secret:"true"`
+}
+
+type BundleMetric struct {
+	Ts        int64   `json:"ts"`
+	Value     float64 `json:"value"`
+	Cluster   string  `json:"cluster"`
+	Host      string  `json:"host"`
+	Container string  `json:"container,omitempty"`
+	Process   string  `json:"process,omitempty"`
+	Pid       int32   `json:"pid,omitempty"`
+	Endpoint  string  `json:"endpoint"`
+	Type      string  `json:"type"`
+	Name      string  `json:"name"`
+	Label     string  `json:"label"`
+}
+
+type Bundle struct {
+	Version    int            `json:"version"`
+	Site       string         `json:"site"`
+	From       time.Time      `json:"from"`
+	To         time.Time      `json:"to"`
+	ExportedTs time.Time      `json:"exported_ts"`
+	Metrics    []BundleMetric `json:"metrics"`
+}
+
+type BundleResult struct {
+	StartedTs time.Time `json:"started_ts"`
+	File      string    `json:"file"`
+	Metrics   int       `json:"metrics"`
+	Error     string    `json:"error"`
+}
+
+type BundleExporter struct {
+	sync.Mutex
+
+	lastExport *BundleResult
+	lastImport *BundleResult
+}
+
+func bundleKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+func bundleCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := bundleKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func sealBundle(bundle *Bundle, passphrase string) ([]byte, error) {
+	var plain bytes.Buffer
+
+	gzipWriter := gzip.NewWriter(&plain)
+	if err := json.NewEncoder(gzipWriter).Encode(bundle); err != nil {
+		return nil, err
+	}
+	if err := gzipWriter.Close(); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, bundleSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	gcm, err := bundleCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(bundleMagic), salt...)
+	sealed := append(append([]byte{}, header...), nonce...)
+	return gcm.Seal(sealed, nonce, plain.Bytes(), header), nil
+}
+
+func openBundle(data []byte, passphrase string) (*Bundle, error) {
+	if bytes.HasPrefix(data, []byte(bundleLegacyMagic)) {
+		return nil, fmt.Errorf("unsupported bundle version 1, export it again")
+	}
+	if !bytes.HasPrefix(data, []byte(bundleMagic)) {
+		return nil, fmt.Errorf("not a bundle")
+	}
+	if len(data) < len(bundleMagic)+bundleSaltSize {
+		return nil, fmt.Errorf("truncated bundle")
+	}
+	header := data[:len(bundleMagic)+bundleSaltSize]
+	data = data[len(header):]
+
+	gcm, err := bundleCipher(passphrase, header[len(bundleMagic):])
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("truncated bundle")
+	}
+
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt bundle: wrong key or corrupted file")
+	}
+
+	gzipReader, err := gzip.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+
+	var bundle Bundle
+	if err := json.NewDecoder(gzipReader).Decode(&bundle); err != nil {
+		return nil, err
+	}
+	if bundle.Version != bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", bundle.Version)
+	}
+
+	return &bundle, nil
+}
+
+func (s *NexServer) bundleCursor() time.Time {
+	var setting Setting
+
+	if result := s.db.Where("name=?", bundleCursorSetting).First(&setting); result.Error == nil {
+		if cursor, err := time.Parse(time.RFC3339Nano, setting.Value); err == nil {
+			return cursor
+		}
+	}
+
+	return time.Now().Add(-time.Duration(s.config.Bundle.IntervalMinutes) * time.Minute)
+}
+
+func (s *NexServer) collectBundle(from, to time.Time) (*Bundle, error) {
+	rows, err := s.db.Raw(`
+SELECT metrics.ts, metrics.value, clusters.name, nodes.host,
+       coalesce(containers.name, ''), coalesce(processes.name, ''), coalesce(processes.p_id, 0),
+       metric_endpoints.path, metric_types.name, metric_names.name, metric_labels.label
+FROM metrics
+JOIN clusters ON metrics.cluster_id=clusters.id
+JOIN nodes ON metrics.node_id=nodes.id
+JOIN metric_endpoints ON metrics.endpoint_id=metric_endpoints.id
+JOIN metric_types ON metrics.type_id=metric_types.id
+JOIN metric_names ON metrics.name_id=metric_names.id
+JOIN metric_labels ON metrics.label_id=metric_labels.id
+LEFT JOIN containers ON metrics.container_id=containers.id
+LEFT JOIN processes ON metrics.process_id=processes.id
+WHERE metrics.ts > ? AND metrics.ts <= ?
+ORDER BY metrics.ts`, from, to).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bundle := &Bundle{
+		Version:    bundleVersion,
+		Site:       s.config.Bundle.Site,
+		From:       from,
+		To:         to,
+		ExportedTs: time.Now(),
+		Metrics:    make([]BundleMetric, 0, 1024),
+	}
+
+	for rows.Next() {
+		var metric BundleMetric
+		var ts time.Time
+
+		err := rows.Scan(&ts, &metric.Value, &metric.Cluster, &metric.Host,
+			&metric.Container, &metric.Process, &metric.Pid,
+			&metric.Endpoint, &metric.Type, &metric.Name, &metric.Label)
+		if err != nil {
+			schedulerLog.Errorf("failed to get record: %v", err)
+			continue
+		}
+
+		metric.Ts = ts.UnixNano() / int64(time.Millisecond)
+		bundle.Metrics = append(bundle.Metrics, metric)
+	}
+
+	return bundle, nil
+}
+
+// RunBundleExport writes the metrics received since the previous export.
+// The cursor only advances once the bundle is safely on disk.
+func (s *NexServer) RunBundleExport() *BundleResult {
+	result := &BundleResult{StartedTs: time.Now()}
+
+	from := s.bundleCursor()
+	// samples of the last minute may still be in flight
+	to := time.Now().Add(-time.Minute)
+
+	err := func() error {
+		bundle, err := s.collectBundle(from, to)
+		if err != nil {
+			return err
+		}
+
+		data, err := sealBundle(bundle, s.config.Bundle.Key)
+		if err != nil {
+			return err
+		}
+
+		site := s.config.Bundle.Site
+		if site == "" {
+			site = "site"
+		}
+		name := fmt.Sprintf("nexclipper-%s-%s%s", site, to.UTC().Format("20060102-150405"), bundleExtension)
+		path := filepath.Join(s.config.Bundle.ExportDir, name)
+
+		// written under a temporary name so importers never see partial files
+		if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return err
+		}
+
+		var setting Setting
+		dbResult := s.db.Where(Setting{Name: bundleCursorSetting}).
+			Assign(Setting{Value: to.Format(time.RFC3339Nano)}).FirstOrCreate(&setting)
+		if dbResult.Error != nil {
+			return dbResult.Error
+		}
+
+		result.File = name
+		result.Metrics = len(bundle.Metrics)
+
+		return nil
+	}()
+	if err != nil {
+		result.Error = err.Error()
+		schedulerLog.Errorf("Bundle: export failed: %v\n", err)
+	} else {
+		schedulerLog.Infof("Bundle: exported %d metrics to %s\n", result.Metrics, result.File)
+	}
+
+	s.bundles.Lock()
+	s.bundles.lastExport = result
+	s.bundles.Unlock()
+
+	return result
+}
+
+func (s *NexServer) bundleClusterName(site, cluster string) string {
+	if site == "" {
+		return cluster
+	}
+
+	return fmt.Sprintf("%s/%s", site, cluster)
+}
+
+func (s *NexServer) bundleNode(host string, clusterId uint) (*Node, error) {
+	if node := s.getNode(host, clusterId); node != nil {
+		return node, nil
+	}
+
+	nodeUuid, _ := uuid.NewUUID()
+	node := Node{
+		Host:      host,
+		Uuid:      nodeUuid.String(),
+		ClusterID: clusterId,
+		Manual:    true,
+	}
+	if result := s.db.Create(&node); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &node, nil
+}
+
+// importBundle stores the metrics of a bundle. Clusters are prefixed with
+// the site name so they never merge with local clusters of the same name.
+func (s *NexServer) importBundle(data []byte) (*Bundle, error) {
+	checksum := sha256.Sum256(data)
+	digest := hex.EncodeToString(checksum[:])
+
+	var existing BundleImport
+	if result := s.db.Where("checksum=?", digest).First(&existing); result.Error == nil {
+		return nil, fmt.Errorf("bundle was already imported at %s", existing.CreatedAt.Format(time.RFC3339))
+	}
+
+	bundle, err := openBundle(data, s.config.Bundle.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := make(map[string]*Cluster)
+	nodes := make(map[string]*Node)
+
+	for _, item := range bundle.Metrics {
+		clusterName := s.bundleClusterName(bundle.Site, item.Cluster)
+		cluster, found := clusters[clusterName]
+		if !found {
+			cluster = s.findCluster(clusterName)
+			clusters[clusterName] = cluster
+		}
+
+		nodeKey := fmt.Sprintf("%d/%s", cluster.ID, item.Host)
+		node, found := nodes[nodeKey]
+		if !found {
+			if node, err = s.bundleNode(item.Host, cluster.ID); err != nil {
+				return nil, err
+			}
+			nodes[nodeKey] = node
+		}
+
+		metricType := s.getMetricType(item.Type)
+		metric := Metric{
+			Ts:         time.Unix(0, item.Ts*int64(time.Millisecond)),
+			Value:      item.Value,
+			EndpointID: s.getMetricEndpoint(item.Endpoint).ID,
+			TypeID:     metricType.ID,
+			NameID:     s.getMetricName(item.Name, metricType).ID,
+			LabelID:    s.getMetricLabel(item.Label).ID,
+			ClusterID:  cluster.ID,
+			NodeID:     node.ID,
+		}
+
+		if item.Container != "" {
+			container := s.getContainer(item.Container, node.ID, cluster.ID)
+			if container == nil {
+				container = &Container{Name: item.Container, NodeID: node.ID, ClusterID: cluster.ID}
+				s.db.Create(container)
+			}
+			metric.ContainerID = container.ID
+		}
+		if item.Process != "" {
+			process := s.getProcess(item.Process, item.Pid, node.ID, cluster.ID)
+			if process == nil {
+				process = &Process{Name: item.Process, PID: item.Pid, NodeID: node.ID, ClusterID: cluster.ID}
+				s.db.Create(process)
+			}
+			metric.ProcessID = process.ID
+		}
+
+		if result := s.db.Create(&metric); result.Error != nil {
+			return nil, result.Error
+		}
+	}
+
+	record := BundleImport{
+		Checksum: digest,
+		Site:     bundle.Site,
+		FromTs:   bundle.From,
+		ToTs:     bundle.To,
+		Metrics:  len(bundle.Metrics),
+	}
+	if result := s.db.Create(&record); result.Error != nil {
+		schedulerLog.Errorf("Bundle: failed to record import: %v\n", result.Error)
+	}
+
+	return bundle, nil
+}
+
+func (s *NexServer) recordBundleImport(name string, bundle *Bundle, err error) *BundleResult {
+	result := &BundleResult{StartedTs: time.Now(), File: name}
+	if err != nil {
+		result.Error = err.Error()
+		schedulerLog.Errorf("Bundle: failed to import %s: %v\n", name, err)
+	} else {
+		result.Metrics = len(bundle.Metrics)
+		schedulerLog.Infof("Bundle: imported %d metrics of site %s from %s\n", result.Metrics, bundle.Site, name)
+	}
+
+	s.bundles.Lock()
+	s.bundles.lastImport = result
+	s.bundles.Unlock()
+
+	return result
+}
+
+// importBundleDir imports every bundle in ImportDir and renames it so it is
+// not picked up again.
+func (s *NexServer) importBundleDir() {
+	paths, err := filepath.Glob(filepath.Join(s.config.Bundle.ImportDir, "*"+bundleExtension))
+	if err != nil {
+		schedulerLog.Warnf("Bundle: %v\n", err)
+		return
+	}
+
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		var bundle *Bundle
+		if err == nil {
+			bundle, err = s.importBundle(data)
+		}
+		s.recordBundleImport(filepath.Base(path), bundle, err)
+
+		suffix := bundleImportedSuffix
+		if err != nil {
+			suffix = bundleFailedSuffix
+		}
+		if err := os.Rename(path, path+suffix); err != nil {
+			schedulerLog.Errorf("Bundle: failed to rename %s: %v\n", path, err)
+		}
+	}
+}
+
+func (s *NexServer) bundleSchedule() string {
+	config := s.config.Bundle
+	if config.ExportDir == "" && config.ImportDir == "" {
+		return ""
+	}
+	if config.Key == "" {
+		schedulerLog.Warnf("Bundle: missing bundle key, air-gapped bundles disabled")
+		return ""
+	}
+
+	return everyMinutes(config.IntervalMinutes)
+}
+
+func (s *NexServer) runBundleJob() error {
+	if s.config.Bundle.ExportDir != "" {
+		if result := s.RunBundleExport(); result.Error != "" {
+			return fmt.Errorf(result.Error)
+		}
+	}
+	if s.config.Bundle.ImportDir != "" {
+		s.importBundleDir()
+	}
+
+	return nil
+}
+
+func (s *NexServer) ApiAdminBundleStatus(c *gin.Context) {
+	s.bundles.Lock()
+	lastExport := s.bundles.lastExport
+	lastImport := s.bundles.lastImport
+	s.bundles.Unlock()
+
+	var imports []BundleImport
+	s.requestDB(c).Order("id DESC").Limit(20).Find(&imports)
+
+	type ImportItem struct {
+		Site       string    `json:"site"`
+		From       time.Time `json:"from"`
+		To         time.Time `json:"to"`
+		Metrics    int       `json:"metrics"`
+		ImportedTs time.Time `json:"imported_ts"`
+	}
+	items := make([]ImportItem, 0, len(imports))
+	for _, record := range imports {
+		items = append(items, ImportItem{
+			Site:       record.Site,
+			From:       record.FromTs,
+			To:         record.ToTs,
+			Metrics:    record.Metrics,
+			ImportedTs: record.CreatedAt,
+		})
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"site":        s.config.Bundle.Site,
+			"export":      s.config.Bundle.ExportDir != "",
+			"import":      s.config.Bundle.ImportDir != "",
+			"last_export": lastExport,
+			"last_import": lastImport,
+			"imports":     items,
+		},
+	})
+}
+
+func (s *NexServer) ApiAdminBundleExport(c *gin.Context) {
+	if s.config.Bundle.ExportDir == "" || s.config.Bundle.Key == "" {
+		s.ApiResponseJson(c, 409, "bad", "bundle export is not configured")
+		return
+	}
+
+	result := s.RunBundleExport()
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": result.Error,
+		"data":    result,
+	})
+}
+
+func (s *NexServer) ApiAdminBundleImport(c *gin.Context) {
+	if s.config.Bundle.Key == "" {
+		s.ApiResponseJson(c, 409, "bad", "bundle key is not configured")
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, bundleMaxSize+1))
+	if err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "failed to read bundle: %v", err)
+		return
+	}
+	if len(data) > bundleMaxSize {
+		s.ApiResponseJson(c, 413, "bad", "bundle is too large")
+		return
+	}
+
+	name := strings.TrimSpace(c.DefaultQuery("name", "upload"))
+	bundle, err := s.importBundle(data)
+	result := s.recordBundleImport(name, bundle, err)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    result,
+	})
+}
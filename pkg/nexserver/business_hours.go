@@ -0,0 +1,133 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ActiveWindow is a recurring weekly window such as 09:00-18:00 on
+// weekdays. A window whose end is before its start spans midnight.
+type ActiveWindow struct {
+	Days     map[time.Weekday]bool
+	StartMin int
+	EndMin   int
+	Location *time.Location
+}
+
+func parseClock(value string) (int, error) {
+	clock, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %s", value)
+	}
+
+	return clock.Hour()*60 + clock.Minute(), nil
+}
+
+// parseActiveWindow parses hours as "HH:MM-HH:MM" and days as a comma
+// separated list of weekdays. Empty hours mean always active.
+func parseActiveWindow(hours, days, timezone string) (*ActiveWindow, error) {
+	if hours == "" {
+		return nil, nil
+	}
+
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %s", timezone)
+	}
+
+	bounds := strings.SplitN(hours, "-", 2)
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("invalid active hours %s", hours)
+	}
+
+	window := &ActiveWindow{Days: make(map[time.Weekday]bool), Location: location}
+	if window.StartMin, err = parseClock(bounds[0]); err != nil {
+		return nil, err
+	}
+	if window.EndMin, err = parseClock(bounds[1]); err != nil {
+		return nil, err
+	}
+
+	if days == "" {
+		days = "mon,tue,wed,thu,fri,sat,sun"
+	}
+	for _, day := range strings.Split(days, ",") {
+		weekday, found := weekdays[strings.ToLower(strings.TrimSpace(day))]
+		if !found {
+			return nil, fmt.Errorf("invalid day %s", day)
+		}
+		window.Days[weekday] = true
+	}
+
+	return window, nil
+}
+
+func (w *ActiveWindow) Contains(ts time.Time) bool {
+	local := ts.In(w.Location)
+	minute := local.Hour()*60 + local.Minute()
+
+	if w.StartMin <= w.EndMin {
+		return w.Days[local.Weekday()] && minute >= w.StartMin && minute < w.EndMin
+	}
+
+	// overnight window: the part after midnight belongs to the previous day
+	if minute >= w.StartMin {
+		return w.Days[local.Weekday()]
+	}
+	if minute < w.EndMin {
+		return w.Days[local.AddDate(0, 0, -1).Weekday()]
+	}
+
+	return false
+}
+
+func severityAtLeast(severity, minimum string) bool {
+	priority, found := severityPriority[severity]
+	if !found {
+		return false
+	}
+
+	return priority <= severityPriority[minimum]
+}
+
+// pagesNow reports whether an incident of the given severity is delivered
+// immediately. Outside active hours only severities at or above the
+// channel's off-hours severity page.
+func (s *Subscription) pagesNow(severity string, ts time.Time) bool {
+	window, err := parseActiveWindow(s.ActiveHours, s.ActiveDays, s.Timezone)
+	if err != nil || window == nil || window.Contains(ts) {
+		return true
+	}
+
+	minimum := s.OffHoursSeverity
+	if minimum == "" {
+		minimum = SeverityCritical
+	}
+
+	return severityAtLeast(severity, minimum)
+}
@@ -66,6 +66,7 @@ func (s *NexServer) getMetricName(name string, metricType *MetricType) *MetricNa
 	if !found {
 		metricName := s.findMetricName(name, metricType)
 		s.cache.Set(fmt.Sprintf("MN_%d_%s", metricType.ID, name), *metricName, 1)
+		s.cache.Set(fmt.Sprintf("MNID_%s", name), metricName.ID, 1)
 
 		return metricName
 	}
@@ -87,6 +88,75 @@ func (s *NexServer) getMetricLabel(label string) *MetricLabel {
 	return &metricLabel
 }
 
+func (s *NexServer) getMetricLabelById(id uint) *MetricLabel {
+	key := fmt.Sprintf("MLBYID_%d", id)
+
+	value, found := s.cache.Get(key)
+	if !found {
+		metricLabel := s.findMetricLabelById(id)
+		if metricLabel == nil {
+			return nil
+		}
+
+		s.cache.Set(key, *metricLabel, 1)
+		return metricLabel
+	}
+
+	metricLabel := value.(MetricLabel)
+
+	return &metricLabel
+}
+
+// getMetricNameIds returns the ids of the known metric names, reading the
+// names missing from the cache at once. Unknown names are not cached, so
+// a name is found as soon as it is inserted.
+func (s *NexServer) getMetricNameIds(names []string) ([]uint, error) {
+	ids := make([]uint, 0, len(names))
+	missing := make([]string, 0, len(names))
+	for _, name := range names {
+		value, found := s.cache.Get(fmt.Sprintf("MNID_%s", name))
+		if !found {
+			missing = append(missing, name)
+			continue
+		}
+		ids = append(ids, value.(uint))
+	}
+	if len(missing) == 0 {
+		return ids, nil
+	}
+
+	var metricNames []MetricName
+	result := s.db.Select("id, name").Where("name IN (?)", missing).Find(&metricNames)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	for _, metricName := range metricNames {
+		s.cache.Set(fmt.Sprintf("MNID_%s", metricName.Name), metricName.ID, 1)
+		ids = append(ids, metricName.ID)
+	}
+
+	return ids, nil
+}
+
+func (s *NexServer) getClusterById(clusterId uint) *Cluster {
+	key := fmt.Sprintf("CLUSTERBYID_%d", clusterId)
+
+	value, found := s.cache.Get(key)
+	if !found {
+		cluster := s.findClusterById(clusterId)
+		if cluster == nil {
+			return nil
+		}
+
+		s.cache.Set(key, *cluster, 1)
+		return cluster
+	}
+
+	cluster := value.(Cluster)
+
+	return &cluster
+}
+
 func (s *NexServer) getNode(hostName string, clusterId uint) *Node {
 	key := fmt.Sprintf("NODE_%d_%s", clusterId, hostName)
 
@@ -144,8 +214,12 @@ func (s *NexServer) getNodeByAgent(agent *Agent) *Node {
 	return &node
 }
 
+func containerKey(containerName string, nodeId, clusterId uint) string {
+	return fmt.Sprintf("CONT_%d_%d_%s", clusterId, nodeId, containerName)
+}
+
 func (s *NexServer) getContainer(containerName string, nodeId, clusterId uint) *Container {
-	key := fmt.Sprintf("CONT_%d_%d_%s", clusterId, nodeId, containerName)
+	key := containerKey(containerName, nodeId, clusterId)
 
 	value, found := s.cache.Get(key)
 	if !found {
@@ -162,8 +236,12 @@ func (s *NexServer) getContainer(containerName string, nodeId, clusterId uint) *
 	return &container
 }
 
+func processKey(processName string, pid int32, nodeId, clusterId uint) string {
+	return fmt.Sprintf("PROC_%d_%d_%d_%s", clusterId, nodeId, pid, processName)
+}
+
 func (s *NexServer) getProcess(processName string, pid int32, nodeId, clusterId uint) *Process {
-	key := fmt.Sprintf("PROC_%d_%d_%d_%s", clusterId, nodeId, pid, processName)
+	key := processKey(processName, pid, nodeId, clusterId)
 
 	value, found := s.cache.Get(key)
 	if !found {
@@ -180,6 +258,16 @@ func (s *NexServer) getProcess(processName string, pid int32, nodeId, clusterId
 	return &process
 }
 
+// cacheContainer keeps an inserted container, replacing a stale entry.
+func (s *NexServer) cacheContainer(container *Container) {
+	s.cache.Set(containerKey(container.Name, container.NodeID, container.ClusterID), *container, 1)
+}
+
+// cacheProcess keeps an inserted process, replacing a stale entry.
+func (s *NexServer) cacheProcess(process *Process) {
+	s.cache.Set(processKey(process.Name, process.PID, process.NodeID, process.ClusterID), *process, 1)
+}
+
 func (s *NexServer) getRemoteAgent(machineId string) *Agent {
 	key := fmt.Sprintf("AGENT_%s", machineId)
 
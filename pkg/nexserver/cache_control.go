@@ -0,0 +1,216 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Metric responses tell the caches how long they stay fresh: a twelfth of
+// their bucket, so a range bucketed by the hour is cached for five
+// minutes, up to maxCacheAge. A range ended more than a bucket ago only
+// changes with late samples and is cached for maxPastCacheAge. Responses
+// carry an ETag over their body, without the query time which differs on
+// every run, and answer If-None-Match with 304. Responses to authenticated
+// requests are private to the browser.
+//
+// The snapshots and summaries hold the latest samples, which change once
+// per report interval of the agents, and are cached for snapshotCacheAge.
+
+const (
+	maxCacheAge     = 15 * time.Minute
+	maxPastCacheAge = time.Hour
+	cacheAgeDivisor = 12
+
+	// snapshotCacheAge is the default report interval of the agents
+	snapshotCacheAge = 5 * time.Second
+)
+
+var queryTimePattern = regexp.MustCompile(`"db_query_time":"[^"]*"`)
+
+var namedBuckets = map[string]time.Duration{
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"month":  30 * 24 * time.Hour,
+	"year":   365 * 24 * time.Hour,
+}
+
+// parseRangeTime parses a bound of a date range the way calculateGranularity does.
+func parseRangeTime(value string) (time.Time, error) {
+	ts, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		ts, err = time.Parse("2006-01-02 15:04:05", value)
+	}
+
+	return ts, err
+}
+
+// queryBucket returns the bucket size calculateGranularity picks for the
+// query, 0 if the query has no bucket.
+func queryBucket(query *Query, start, end time.Time) time.Duration {
+	if bucket, found := namedBuckets[query.Granularity]; found {
+		return bucket
+	}
+
+	interval := int64(end.Sub(start).Minutes() / 60.0)
+	if interval == 0 {
+		interval = 1
+	}
+	if interval < 60 {
+		return time.Duration(interval) * time.Minute
+	}
+	if interval < 1440 {
+		return time.Duration(interval/60) * time.Hour
+	}
+
+	return time.Duration(interval/1440) * 24 * time.Hour
+}
+
+// cacheMaxAge returns how long the response to the query stays fresh.
+func cacheMaxAge(query *Query, now time.Time) time.Duration {
+	if query == nil || len(query.DateRange) != 2 {
+		return 0
+	}
+	start, err := parseRangeTime(query.DateRange[0])
+	if err != nil {
+		return 0
+	}
+	end, err := parseRangeTime(query.DateRange[1])
+	if err != nil || !end.After(start) {
+		return 0
+	}
+
+	bucket := queryBucket(query, start, end)
+	if now.Sub(end) > bucket {
+		return maxPastCacheAge
+	}
+
+	maxAge := bucket / cacheAgeDivisor
+	if maxAge > maxCacheAge {
+		maxAge = maxCacheAge
+	}
+
+	return maxAge.Truncate(time.Second)
+}
+
+// bufferedWriter holds the body until the ETag is known.
+type bufferedWriter struct {
+	gin.ResponseWriter
+
+	body bytes.Buffer
+}
+
+func (w *bufferedWriter) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+func (w *bufferedWriter) WriteString(data string) (int, error) {
+	return w.body.WriteString(data)
+}
+
+// Flush is deferred until the body is complete, the headers are not known
+// before.
+func (w *bufferedWriter) Flush() {
+}
+
+func responseETag(body []byte) string {
+	sum := sha256.Sum256(queryTimePattern.ReplaceAll(body, nil))
+
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+func etagMatches(header, etag string) bool {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimPrefix(strings.TrimSpace(value), "W/")
+		if value == etag || value == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CacheControlMiddleware adds the cache headers to the metric responses
+// and answers the conditional requests.
+func (s *NexServer) CacheControlMiddleware(c *gin.Context) {
+	// tails stream their samples
+	if strings.HasSuffix(c.Request.URL.Path, "/tail") {
+		c.Next()
+		return
+	}
+
+	s.serveCached(c, func() time.Duration {
+		return cacheMaxAge(s.ParseQuery(c), time.Now())
+	})
+}
+
+// SnapshotCacheMiddleware adds the cache headers to the snapshot and
+// summary responses and answers the conditional requests.
+func (s *NexServer) SnapshotCacheMiddleware(c *gin.Context) {
+	s.serveCached(c, func() time.Duration {
+		return snapshotCacheAge
+	})
+}
+
+// serveCached holds the response to add its ETag and a Cache-Control
+// header with the max age, and answers 304 when it is not modified.
+func (s *NexServer) serveCached(c *gin.Context, maxAge func() time.Duration) {
+	if c.Request.Method != "GET" {
+		c.Next()
+		return
+	}
+
+	writer := &bufferedWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	c.Next()
+	c.Writer = writer.ResponseWriter
+
+	if writer.Status() != 200 {
+		_, _ = writer.ResponseWriter.Write(writer.body.Bytes())
+		return
+	}
+
+	scope := "public"
+	if s.requestPrincipal(c) != nil {
+		scope = "private"
+	}
+	header := writer.Header()
+	if maxAge := maxAge(); maxAge > 0 {
+		header.Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", scope, int(maxAge.Seconds())))
+	} else {
+		header.Set("Cache-Control", scope+", no-cache")
+	}
+	header.Add("Vary", "Authorization, Cookie, X-Api-Key")
+
+	etag := responseETag(writer.body.Bytes())
+	header.Set("ETag", etag)
+	if match := c.GetHeader("If-None-Match"); match != "" && etagMatches(match, etag) {
+		writer.ResponseWriter.WriteHeader(304)
+		writer.ResponseWriter.WriteHeaderNow()
+		return
+	}
+
+	_, _ = writer.ResponseWriter.Write(writer.body.Bytes())
+}
@@ -0,0 +1,248 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"context"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strconv"
+	"time"
+)
+
+const (
+	CaptureStatusPending   = "pending"
+	CaptureStatusCompleted = "completed"
+	CaptureStatusFailed    = "failed"
+
+	diagnosticCaptureTimeout = 5 * time.Minute
+)
+
+type DiagnosticCaptureItem struct {
+	Id          uint       `json:"id"`
+	NodeId      uint       `json:"node_id"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error"`
+	Size        int        `json:"size"`
+	CreatedTs   time.Time  `json:"created_ts"`
+	CompletedTs *time.Time `json:"completed_ts"`
+}
+
+func newDiagnosticCaptureItem(capture *DiagnosticCapture) DiagnosticCaptureItem {
+	item := DiagnosticCaptureItem{
+		Id:          capture.ID,
+		NodeId:      capture.NodeID,
+		Status:      capture.Status,
+		Error:       capture.Error,
+		Size:        capture.Size,
+		CreatedTs:   capture.CreatedAt,
+		CompletedTs: capture.CompletedTs,
+	}
+
+	if item.Status == CaptureStatusPending && time.Since(capture.CreatedAt) > diagnosticCaptureTimeout {
+		item.Status = CaptureStatusFailed
+		item.Error = "agent did not respond"
+	}
+
+	return item
+}
+
+func (s *NexServer) ReportCommandResult(ctx context.Context, in *pb.CommandResult) (*pb.Response, error) {
+	agent := s.findAgentFromContext(ctx)
+	if agent == nil {
+		ingestLog.Warnf("ReportCommandResult: invalid agent")
+		return nil, status.Error(codes.PermissionDenied, "invalid agent")
+	}
+
+	switch in.Name {
+	case "diagnostic":
+		return s.saveDiagnosticCapture(agent, in)
+	case "pprof":
+		return s.saveProfileCapture(agent, in)
+	case "config":
+		return s.checkConfigResult(agent, in)
+	case "journey", "dns":
+		return s.saveJourneyRun(agent, in)
+	case "ports":
+		return s.savePortInventory(agent, in)
+	case "kernel_events":
+		return s.saveKernelEvents(agent, in)
+	case "mesh_probe":
+		return s.checkMeshProbeResult(agent, in)
+	case "k8s_resources":
+		return s.saveK8sResources(agent, in)
+	case "collector_health":
+		return s.saveCollectorHealth(agent, in)
+	default:
+		return nil, status.Error(codes.Unimplemented, fmt.Sprintf("unknown command: %s", in.Name))
+	}
+}
+
+func (s *NexServer) saveDiagnosticCapture(agent *Agent, in *pb.CommandResult) (*pb.Response, error) {
+	var capture DiagnosticCapture
+
+	result := s.db.Where("command_id=? AND agent_id=?", in.CommandId, agent.ID).First(&capture)
+	if result.Error != nil {
+		return nil, status.Error(codes.NotFound, "unknown diagnostic capture")
+	}
+
+	now := time.Now()
+	capture.CompletedTs = &now
+	if in.Success {
+		capture.Status = CaptureStatusCompleted
+		capture.Data = in.Data
+		capture.Size = len(in.Data)
+	} else {
+		capture.Status = CaptureStatusFailed
+		capture.Error = in.Error
+	}
+
+	if result := s.db.Save(&capture); result.Error != nil {
+		ingestLog.Errorf("Diagnostic: failed to save capture %d: %v\n", capture.ID, result.Error)
+		return nil, status.Error(codes.Internal, "failed to save diagnostic capture")
+	}
+
+	return s.response(true, 0, ""), nil
+}
+
+func (s *NexServer) ApiCreateDiagnosticCapture(c *gin.Context) {
+	params, ok := s.CheckRequiredParams(c, []string{"clusterId", "nodeId"})
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid parameters")
+		return
+	}
+
+	clusterId, err := strconv.ParseUint(params["clusterId"], 10, 32)
+	if err != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+	nodeId, err := strconv.ParseUint(params["nodeId"], 10, 32)
+	if err != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid node id")
+		return
+	}
+
+	node := s.findNodeById(uint(nodeId), uint(clusterId))
+	if node == nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid node id")
+		return
+	}
+
+	agent := s.findAgentByNode(node)
+	if agent == nil {
+		s.ApiResponseJson(c, 404, "bad", "agent is not connected")
+		return
+	}
+
+	command := newAgentCommand("diagnostic")
+	capture := DiagnosticCapture{
+		CommandID: command.Id,
+		Status:    CaptureStatusPending,
+		ClusterID: node.ClusterID,
+		NodeID:    node.ID,
+		AgentID:   agent.ID,
+	}
+
+	if result := s.db.Create(&capture); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create capture: %v", result.Error)
+		return
+	}
+
+	if err := s.commands.send(agent.Uuid, command); err != nil {
+		s.db.Model(&capture).Updates(DiagnosticCapture{Status: CaptureStatusFailed, Error: err.Error()})
+		s.ApiResponseJson(c, 500, "bad", err.Error())
+		return
+	}
+
+	c.JSON(202, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    newDiagnosticCaptureItem(&capture),
+	})
+}
+
+func (s *NexServer) ApiDiagnosticCaptureList(c *gin.Context) {
+	cId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	var captures []DiagnosticCapture
+
+	queryStart := time.Now()
+	result := s.requestDB(c).
+		Select("id, created_at, status, error, size, completed_ts, cluster_id, node_id").
+		Where("cluster_id=?", cId).
+		Order("created_at DESC").
+		Find(&captures)
+	queryTime := time.Since(queryStart)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	items := make([]DiagnosticCaptureItem, 0, len(captures))
+	for idx := range captures {
+		items = append(items, newDiagnosticCaptureItem(&captures[idx]))
+	}
+
+	c.JSON(200, gin.H{
+		"status":        "ok",
+		"message":       "",
+		"data":          items,
+		"db_query_time": queryTime.String(),
+	})
+}
+
+func (s *NexServer) ApiDownloadDiagnosticCapture(c *gin.Context) {
+	cId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+	captureId, ok := s.idParam(c, "captureId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid capture id")
+		return
+	}
+
+	var capture DiagnosticCapture
+
+	result := s.requestDB(c).
+		Where("id=? AND cluster_id=?", captureId, cId).
+		First(&capture)
+	if result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid capture id")
+		return
+	}
+
+	if capture.Status != CaptureStatusCompleted {
+		item := newDiagnosticCaptureItem(&capture)
+		s.ApiResponseJsonf(c, 404, "bad", "capture is %s", item.Status)
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(
+		"attachment; filename=\"diagnostic-%d-%s.tar.gz\"",
+		capture.NodeID, capture.CreatedAt.Format("20060102-150405")))
+	c.Data(200, "application/gzip", capture.Data)
+}
@@ -0,0 +1,306 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"math"
+	"strings"
+	"time"
+)
+
+type ChangePointConfig struct {
+	MetricNames     []string
+	IntervalMinutes int
+	WindowHours     int
+	Threshold       float64
+	MinShiftPercent float64
+}
+
+const (
+	changePointBucketMinutes = 10
+	changePointMinSegment    = 6
+)
+
+var defaultChangePointMetrics = []string{"node_memory_used_percent", "node_cpu_load_avg_1"}
+
+type levelShift struct {
+	Index  int
+	Score  float64
+	Before float64
+	After  float64
+}
+
+func meanAndVariance(values []float64) (float64, float64) {
+	var sum, sumSq float64
+	for _, value := range values {
+		sum += value
+		sumSq += value * value
+	}
+
+	n := float64(len(values))
+	mean := sum / n
+	variance := sumSq/n - mean*mean
+	if variance < 0 {
+		variance = 0
+	}
+
+	return mean, variance
+}
+
+// detectLevelShift finds the split that maximizes Welch's t statistic
+// between the two segments. Each segment has at least minSegment points.
+func detectLevelShift(values []float64, minSegment int) *levelShift {
+	if len(values) < 2*minSegment {
+		return nil
+	}
+
+	var best *levelShift
+	for idx := minSegment; idx <= len(values)-minSegment; idx++ {
+		before, beforeVar := meanAndVariance(values[:idx])
+		after, afterVar := meanAndVariance(values[idx:])
+
+		stdErr := math.Sqrt(beforeVar/float64(idx) + afterVar/float64(len(values)-idx))
+		if stdErr == 0 {
+			// flat segments: any difference is a shift, none is not
+			if before == after {
+				continue
+			}
+			stdErr = math.SmallestNonzeroFloat64
+		}
+
+		score := math.Abs(after-before) / stdErr
+		if best == nil || score > best.Score {
+			best = &levelShift{Index: idx, Score: score, Before: before, After: after}
+		}
+	}
+
+	return best
+}
+
+func (s *NexServer) changePointMetrics() []string {
+	if len(s.config.ChangePoint.MetricNames) > 0 {
+		return s.config.ChangePoint.MetricNames
+	}
+
+	return defaultChangePointMetrics
+}
+
+func (s *NexServer) detectChangePoints(metricName string) (int, error) {
+	var name MetricName
+	if result := s.db.Where("name=?", metricName).First(&name); result.Error != nil {
+		return 0, nil
+	}
+
+	windowHours := s.config.ChangePoint.WindowHours
+	if windowHours <= 0 {
+		windowHours = 24
+	}
+
+	rows, err := s.db.Raw(`
+SELECT metrics.cluster_id, metrics.node_id,
+       DATE_TRUNC('hour', ts) + DATE_PART('minute', ts)::int / ?::int * make_interval(mins => ?) as bucket,
+       avg(value)
+FROM metrics
+WHERE ts >= NOW() - make_interval(hours => ?) AND metrics.name_id=?
+  AND metrics.process_id=0 AND metrics.container_id=0
+GROUP BY metrics.cluster_id, metrics.node_id, bucket
+ORDER BY metrics.cluster_id, metrics.node_id, bucket`, changePointBucketMinutes, changePointBucketMinutes, windowHours, name.ID).Rows()
+	if err != nil {
+		return 0, err
+	}
+
+	type seriesKey struct {
+		ClusterId uint
+		NodeId    uint
+	}
+	values := make(map[seriesKey][]float64)
+	buckets := make(map[seriesKey][]time.Time)
+
+	for rows.Next() {
+		var key seriesKey
+		var bucket time.Time
+		var value float64
+
+		if err := rows.Scan(&key.ClusterId, &key.NodeId, &bucket, &value); err != nil {
+			incidentLog.Errorf("failed to get record: %v", err)
+			continue
+		}
+
+		values[key] = append(values[key], value)
+		buckets[key] = append(buckets[key], bucket)
+	}
+	rows.Close()
+
+	threshold := s.config.ChangePoint.Threshold
+	if threshold <= 0 {
+		threshold = 6
+	}
+
+	detected := 0
+	for key, series := range values {
+		shift := detectLevelShift(series, changePointMinSegment)
+		if shift == nil || shift.Score < threshold {
+			continue
+		}
+
+		base := math.Max(math.Abs(shift.Before), 1e-9)
+		shiftPercent := (shift.After - shift.Before) / base * 100
+		if math.Abs(shiftPercent) < s.config.ChangePoint.MinShiftPercent {
+			continue
+		}
+
+		ts := buckets[key][shift.Index]
+		if s.recordChangePoint(key.ClusterId, key.NodeId, &name, ts, shift, shiftPercent) {
+			detected += 1
+		}
+	}
+
+	return detected, nil
+}
+
+// recordChangePoint stores the shift unless one was already recorded for
+// the series within an hour of ts, since consecutive runs overlap.
+func (s *NexServer) recordChangePoint(clusterId, nodeId uint, name *MetricName, ts time.Time,
+	shift *levelShift, shiftPercent float64) bool {
+	var existing ChangePoint
+	result := s.db.Where("cluster_id=? AND node_id=? AND name_id=? AND ts > ? AND ts < ?",
+		clusterId, nodeId, name.ID, ts.Add(-time.Hour), ts.Add(time.Hour)).First(&existing)
+	if result.Error == nil {
+		return false
+	}
+
+	changePoint := ChangePoint{
+		Ts:           ts,
+		Before:       shift.Before,
+		After:        shift.After,
+		Score:        shift.Score,
+		ShiftPercent: shiftPercent,
+		NameID:       name.ID,
+		ClusterID:    clusterId,
+		NodeID:       nodeId,
+	}
+	if result := s.db.Create(&changePoint); result.Error != nil {
+		incidentLog.Errorf("ChangePoint: failed to record change point: %v\n", result.Error)
+		return false
+	}
+
+	target := ""
+	if node := s.getNodeById(nodeId, clusterId); node != nil {
+		target = node.Host
+	}
+
+	s.AddIncident("change_point", &IncidentItem{
+		ClusterId:  clusterId,
+		NodeId:     nodeId,
+		TargetType: "NODE",
+		Target:     target,
+		Value:      shift.After,
+		Condition:  shift.Before,
+		EventName:  name.Name,
+		ReportedTs: ts,
+		DetectedTs: time.Now(),
+	})
+
+	incidentLog.Infof("ChangePoint: %s @ %s shifted %.2f -> %.2f at %s\n",
+		name.Name, target, shift.Before, shift.After, ts.Format(time.RFC3339))
+
+	return true
+}
+
+func (s *NexServer) runChangePointJob() error {
+	failed := make([]string, 0)
+	for _, metricName := range s.changePointMetrics() {
+		if _, err := s.detectChangePoints(metricName); err != nil {
+			incidentLog.Errorf("ChangePoint: failed to check %s: %v\n", metricName, err)
+			failed = append(failed, metricName)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to check %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+func (s *NexServer) ApiChangePoints(c *gin.Context) {
+	cId, clusterOk := s.idParam(c, "clusterId", false)
+	query := s.ParseQuery(c)
+	if s.mathUnsupported(c, query) {
+		return
+	}
+	if !clusterOk || s.IsValidParams(c.Param("clusterId"), query, true, false) == false {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
+
+	db := s.requestDB(c).Table("change_points").
+		Select("change_points.ts, change_points.before, change_points.after, change_points.score, "+
+			"change_points.shift_percent, metric_names.name, change_points.node_id, nodes.host").
+		Joins("JOIN metric_names ON change_points.name_id=metric_names.id").
+		Joins("JOIN nodes ON change_points.node_id=nodes.id").
+		Where("change_points.cluster_id=? AND change_points.ts >= ? AND change_points.ts < ?",
+			cId, query.DateRange[0], query.DateRange[1])
+
+	if len(query.MetricNames) > 0 {
+		db = db.Where("metric_names.name IN (?)", query.MetricNames)
+	}
+	if nodeId := c.DefaultQuery("nodeId", ""); nodeId != "" {
+		db = db.Where("change_points.node_id=?", nodeId)
+	}
+
+	rows, err, queryTime := s.QueryRowsWithTime(db.Order("change_points.ts"))
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	type ChangePointItem struct {
+		Ts           time.Time `json:"ts"`
+		Before       float64   `json:"before"`
+		After        float64   `json:"after"`
+		Score        float64   `json:"score"`
+		ShiftPercent float64   `json:"shift_percent"`
+		MetricName   string    `json:"metric_name"`
+		NodeId       uint      `json:"node_id"`
+		Node         string    `json:"node"`
+	}
+	results := make([]ChangePointItem, 0, 16)
+
+	for rows.Next() {
+		var item ChangePointItem
+
+		err := rows.Scan(&item.Ts, &item.Before, &item.After, &item.Score, &item.ShiftPercent,
+			&item.MetricName, &item.NodeId, &item.Node)
+		if err != nil {
+			requestLog(c).Errorf("failed to get record: %v", err)
+			continue
+		}
+
+		results = append(results, item)
+	}
+
+	c.JSON(200, gin.H{
+		"status":        "ok",
+		"message":       "",
+		"data":          results,
+		"count":         len(results),
+		"db_query_time": queryTime.String(),
+	})
+}
@@ -0,0 +1,642 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Soft-deleted clusters are hidden from lists and refuse ingestion until
+// they are either restored or purged once the restore window has passed.
+
+// clusterTable holds rows of a cluster in column, cluster_id if empty.
+// The purge deletes the rows of dependents before the rows of the table,
+// each dependent statement receiving the cluster id. The merge moves the
+// rows, their dependents along with them, except for the tables keeping
+// a single row per cluster, where the target keeps its own.
+type clusterTable struct {
+	name       string
+	column     string
+	perCluster bool
+	dependents []string
+}
+
+// clusterTables are the tables with rows of a cluster, in purge order.
+var clusterTables = []clusterTable{
+	{name: "metrics"},
+	{name: "metric_rollups"},
+	{name: "events"},
+	{name: "counter_resets"},
+	{name: "change_points"},
+	{name: "incident_records"},
+	{name: "processes"},
+	{name: "containers"},
+	{name: "nodes"},
+	{name: "agents", dependents: []string{
+		"DELETE FROM agent_configs WHERE agent_id IN (SELECT id FROM agents WHERE cluster_id=?)",
+		"DELETE FROM agent_collectors WHERE agent_id IN (SELECT id FROM agents WHERE cluster_id=?)",
+	}},
+	{name: "k8s_clusters", column: "agent_cluster_id", dependents: []string{
+		"DELETE FROM k8s_metrics WHERE k8s_cluster_id IN (SELECT id FROM k8s_clusters WHERE agent_cluster_id=?)",
+		"DELETE FROM k8s_containers WHERE k8s_cluster_id IN (SELECT id FROM k8s_clusters WHERE agent_cluster_id=?)",
+		"DELETE FROM k8s_pods WHERE k8s_cluster_id IN (SELECT id FROM k8s_clusters WHERE agent_cluster_id=?)",
+		"DELETE FROM k8s_deployments WHERE k8s_cluster_id IN (SELECT id FROM k8s_clusters WHERE agent_cluster_id=?)",
+		"DELETE FROM k8s_stateful_sets WHERE k8s_cluster_id IN (SELECT id FROM k8s_clusters WHERE agent_cluster_id=?)",
+		"DELETE FROM k8s_daemon_sets WHERE k8s_cluster_id IN (SELECT id FROM k8s_clusters WHERE agent_cluster_id=?)",
+		"DELETE FROM k8s_replica_sets WHERE k8s_cluster_id IN (SELECT id FROM k8s_clusters WHERE agent_cluster_id=?)",
+		"DELETE FROM k8s_namespaces WHERE k8s_cluster_id IN (SELECT id FROM k8s_clusters WHERE agent_cluster_id=?)",
+		"DELETE FROM k8s_events WHERE cluster_id IN (SELECT id FROM k8s_clusters WHERE agent_cluster_id=?)",
+		"DELETE FROM k8s_labels WHERE k8s_object_id IN (SELECT k8s_objects.id FROM k8s_objects JOIN k8s_clusters ON k8s_objects.k8s_cluster_id=k8s_clusters.id WHERE k8s_clusters.agent_cluster_id=?)",
+		"DELETE FROM k8s_object_tags WHERE k8s_object_id IN (SELECT k8s_objects.id FROM k8s_objects JOIN k8s_clusters ON k8s_objects.k8s_cluster_id=k8s_clusters.id WHERE k8s_clusters.agent_cluster_id=?)",
+		"DELETE FROM k8s_nodes WHERE k8s_cluster_id IN (SELECT id FROM k8s_clusters WHERE agent_cluster_id=?)",
+		"DELETE FROM k8s_objects WHERE k8s_cluster_id IN (SELECT id FROM k8s_clusters WHERE agent_cluster_id=?)",
+	}},
+	{name: "k8s_resources"},
+	{name: "probe_snapshots"},
+	{name: "diagnostic_captures"},
+	{name: "profile_captures"},
+	{name: "team_routes"},
+	{name: "subscriptions"},
+	{name: "cost_budgets"},
+	{name: "alert_rules"},
+	{name: "synthetic_runs"},
+	{name: "synthetic_journeys"},
+	{name: "retention_policies", perCluster: true},
+	{name: "listening_sockets"},
+	{name: "cluster_aliases"},
+	{name: "enrollment_tokens"},
+}
+
+func (t *clusterTable) clusterColumn() string {
+	if t.column == "" {
+		return "cluster_id"
+	}
+
+	return t.column
+}
+
+// clusterPurgeStatements are applied in order when a cluster is purged.
+// Each statement receives the cluster id as its only argument.
+var clusterPurgeStatements = func() []string {
+	statements := make([]string, 0, 2*len(clusterTables))
+	for idx := range clusterTables {
+		table := &clusterTables[idx]
+		statements = append(statements, table.dependents...)
+		statements = append(statements, fmt.Sprintf("DELETE FROM %s WHERE %s=?", table.name, table.clusterColumn()))
+	}
+
+	return append(statements, "DELETE FROM clusters WHERE id=?")
+}()
+
+func (s *NexServer) clusterRestoreWindow() time.Duration {
+	if s.config.Cluster.RestoreHours > 0 {
+		return time.Duration(s.config.Cluster.RestoreHours) * time.Hour
+	}
+
+	return 72 * time.Hour
+}
+
+func (s *NexServer) isClusterDeleted(cluster *Cluster) bool {
+	return cluster != nil && cluster.DeletedAt != nil
+}
+
+// disconnectClusterAgents ends the ping streams of the connected agents
+// of a cluster, their rows must not be removed while they are streaming.
+func (s *NexServer) disconnectClusterAgents(clusterId uint) {
+	s.RLock()
+	agentUuids := make([]string, 0)
+	for _, agent := range s.agentMap {
+		if agent.ClusterID == clusterId {
+			agentUuids = append(agentUuids, agent.Uuid)
+		}
+	}
+	s.RUnlock()
+
+	for _, agentUuid := range agentUuids {
+		s.disconnectAgent(agentUuid)
+	}
+}
+
+func (s *NexServer) SoftDeleteCluster(clusterId uint) error {
+	result := s.db.Where("id=?", clusterId).Delete(&Cluster{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("cluster %d not found", clusterId)
+	}
+
+	s.disconnectClusterAgents(clusterId)
+	s.purgeAll()
+	s.emitEvent(EventClusterDeleted, clusterId, nil)
+	clusterLog.Infof("Cluster: cluster %d deleted, restorable for %s\n", clusterId, s.clusterRestoreWindow())
+
+	return nil
+}
+
+func (s *NexServer) RestoreCluster(clusterId uint) error {
+	result := s.db.Unscoped().Model(&Cluster{}).
+		Where("id=? AND deleted_at IS NOT NULL", clusterId).
+		Update("deleted_at", nil)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return fmt.Errorf("deleted cluster %d not found", clusterId)
+	}
+
+	s.purgeAll()
+	s.emitEvent(EventClusterRestored, clusterId, nil)
+	clusterLog.Infof("Cluster: cluster %d restored\n", clusterId)
+
+	return nil
+}
+
+func (s *NexServer) PurgeCluster(clusterId uint) error {
+	s.disconnectClusterAgents(clusterId)
+
+	tx := s.db.Begin()
+	for _, statement := range clusterPurgeStatements {
+		if result := tx.Exec(statement, clusterId); result.Error != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to purge cluster %d: %v", clusterId, result.Error)
+		}
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return result.Error
+	}
+
+	s.purgeAll()
+	clusterLog.Infof("Cluster: cluster %d purged\n", clusterId)
+
+	return nil
+}
+
+func (s *NexServer) purgeExpiredClusters() error {
+	var clusters []Cluster
+
+	expiredTs := time.Now().Add(-s.clusterRestoreWindow())
+	result := s.db.Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", expiredTs).Find(&clusters)
+	if result.Error != nil {
+		return fmt.Errorf("failed to find expired clusters: %v", result.Error)
+	}
+
+	failed := 0
+	for _, cluster := range clusters {
+		if err := s.PurgeCluster(cluster.ID); err != nil {
+			clusterLog.Errorf("Cluster: %v\n", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to purge %d of %d clusters", failed, len(clusters))
+	}
+
+	return nil
+}
+
+func (s *NexServer) ApiDeleteCluster(c *gin.Context) {
+	clusterId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	if c.DefaultQuery("purge", "") == "true" {
+		var cluster Cluster
+		result := s.requestDB(c).Unscoped().Where("id=? AND deleted_at IS NOT NULL", clusterId).First(&cluster)
+		if result.Error != nil {
+			s.ApiResponseJson(c, 409, "bad", "cluster must be deleted before it can be purged")
+			return
+		}
+		task, err := s.startClusterTask(ClusterTaskPurge, func() error {
+			startedTs := time.Now()
+			err := s.PurgeCluster(clusterId)
+			status, errMsg := JobRunOk, ""
+			if err != nil {
+				status, errMsg = JobRunFailed, err.Error()
+			}
+			s.recordJobRun(JobClusterPurger, JobTriggerManual, status, errMsg, startedTs)
+
+			return err
+		}, clusterId)
+		if err != nil {
+			s.ApiResponseJson(c, 409, "bad", err.Error())
+			return
+		}
+
+		c.JSON(202, gin.H{
+			"status":  "ok",
+			"message": "",
+			"data":    task,
+		})
+		return
+	}
+
+	if err := s.SoftDeleteCluster(clusterId); err != nil {
+		s.ApiResponseJson(c, 404, "bad", err.Error())
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"purge_after": time.Now().Add(s.clusterRestoreWindow()),
+		},
+	})
+}
+
+func (s *NexServer) ApiRestoreCluster(c *gin.Context) {
+	clusterId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	if err := s.RestoreCluster(clusterId); err != nil {
+		s.ApiResponseJson(c, 404, "bad", err.Error())
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+func (s *NexServer) ApiDeletedClusterList(c *gin.Context) {
+	var clusters []Cluster
+
+	result := s.requestDB(c).Unscoped().Where("deleted_at IS NOT NULL").Find(&clusters)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	type DeletedClusterItem struct {
+		Id         uint      `json:"id"`
+		Name       string    `json:"name"`
+		DeletedTs  time.Time `json:"deleted_ts"`
+		PurgeAfter time.Time `json:"purge_after"`
+	}
+	items := make([]DeletedClusterItem, 0, len(clusters))
+
+	for _, cluster := range clusters {
+		items = append(items, DeletedClusterItem{
+			Id:         cluster.ID,
+			Name:       cluster.Name,
+			DeletedTs:  *cluster.DeletedAt,
+			PurgeAfter: cluster.DeletedAt.Add(s.clusterRestoreWindow()),
+		})
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+// Agents name the cluster they report to, so a cluster keeps its previous
+// names as aliases when it is renamed or merged into another one. Merges
+// and purges touch every row of a cluster and run in the background, one
+// at a time per cluster.
+
+const (
+	ClusterTaskPurge = "purge"
+	ClusterTaskMerge = "merge"
+)
+
+// clusterMergeStatements move the rows of a merged cluster. Each statement
+// receives the target and the merged cluster id.
+var clusterMergeStatements = func() []string {
+	statements := make([]string, 0, len(clusterTables))
+	for idx := range clusterTables {
+		table := &clusterTables[idx]
+		if table.perCluster {
+			continue
+		}
+		column := table.clusterColumn()
+		statements = append(statements, fmt.Sprintf("UPDATE %s SET %s=? WHERE %s=?", table.name, column, column))
+	}
+
+	return statements
+}()
+
+// clusterMergeDeletes drop the rows the merged cluster cannot move to the
+// target. Each statement receives the merged cluster id.
+var clusterMergeDeletes = func() []string {
+	statements := make([]string, 0)
+	for idx := range clusterTables {
+		table := &clusterTables[idx]
+		if table.perCluster {
+			statements = append(statements, fmt.Sprintf("DELETE FROM %s WHERE %s=?", table.name, table.clusterColumn()))
+		}
+	}
+
+	return append(statements, "DELETE FROM clusters WHERE id=?")
+}()
+
+type ClusterTask struct {
+	Kind       string     `json:"kind"`
+	StartedTs  time.Time  `json:"started_ts"`
+	FinishedTs *time.Time `json:"finished_ts"`
+	Error      string     `json:"error"`
+}
+
+type ClusterTasks struct {
+	sync.Mutex
+
+	tasks map[uint]*ClusterTask
+}
+
+// startClusterTask runs the task in the background unless one of the
+// clusters has a task running.
+func (s *NexServer) startClusterTask(kind string, run func() error, clusterIds ...uint) (*ClusterTask, error) {
+	s.clusterTasks.Lock()
+	defer s.clusterTasks.Unlock()
+
+	if s.clusterTasks.tasks == nil {
+		s.clusterTasks.tasks = make(map[uint]*ClusterTask)
+	}
+	for _, clusterId := range clusterIds {
+		if task, found := s.clusterTasks.tasks[clusterId]; found && task.FinishedTs == nil {
+			return nil, fmt.Errorf("cluster %d has a %s running", clusterId, task.Kind)
+		}
+	}
+
+	task := &ClusterTask{Kind: kind, StartedTs: time.Now()}
+	for _, clusterId := range clusterIds {
+		s.clusterTasks.tasks[clusterId] = task
+	}
+
+	go func() {
+		err := run()
+
+		s.clusterTasks.Lock()
+		finishedTs := time.Now()
+		task.FinishedTs = &finishedTs
+		if err != nil {
+			task.Error = err.Error()
+		}
+		s.clusterTasks.Unlock()
+
+		if err != nil {
+			clusterLog.Errorf("Cluster: %s failed: %v\n", kind, err)
+		}
+	}()
+
+	return task, nil
+}
+
+func (s *NexServer) findClusterTask(clusterId uint) *ClusterTask {
+	s.clusterTasks.Lock()
+	defer s.clusterTasks.Unlock()
+
+	task, found := s.clusterTasks.tasks[clusterId]
+	if !found {
+		return nil
+	}
+	copied := *task
+
+	return &copied
+}
+
+// clusterNameOwner returns the cluster using the name, by its name or an
+// alias, 0 if the name is free.
+func (s *NexServer) clusterNameOwner(name string) uint {
+	var cluster Cluster
+	if result := s.db.Unscoped().Where("name=?", name).First(&cluster); result.Error == nil {
+		return cluster.ID
+	}
+
+	var alias ClusterAlias
+	if result := s.db.Where("name=?", name).First(&alias); result.Error == nil {
+		return alias.ClusterID
+	}
+
+	return 0
+}
+
+func (s *NexServer) RenameCluster(cluster *Cluster, name string) error {
+	oldName := cluster.Name
+
+	tx := s.db.Begin()
+	if result := tx.Model(cluster).Update("name", name); result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	// taking back a previous name drops its alias
+	if result := tx.Where("name=?", name).Delete(&ClusterAlias{}); result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if result := tx.Create(&ClusterAlias{Name: oldName, ClusterID: cluster.ID}); result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return result.Error
+	}
+
+	s.purgeAll()
+	s.emitEvent(EventClusterRenamed, cluster.ID, map[string]interface{}{
+		"name":          name,
+		"previous_name": oldName,
+	})
+	clusterLog.Infof("Cluster: cluster %d renamed from %s to %s\n", cluster.ID, oldName, name)
+
+	return nil
+}
+
+// mergeConflicts returns the hosts both clusters have a node of.
+func (s *NexServer) mergeConflicts(sourceId, targetId uint) ([]string, error) {
+	hosts := make([]string, 0)
+	result := s.db.Model(&Node{}).
+		Where("cluster_id=? AND host IN (SELECT host FROM nodes WHERE cluster_id=? AND deleted_at IS NULL)", sourceId, targetId).
+		Pluck("host", &hosts)
+
+	return hosts, result.Error
+}
+
+func (s *NexServer) MergeCluster(source *Cluster, targetId uint) error {
+	tx := s.db.Begin()
+	for _, statement := range clusterMergeStatements {
+		if result := tx.Exec(statement, targetId, source.ID); result.Error != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to merge cluster %d: %v", source.ID, result.Error)
+		}
+	}
+	for _, statement := range clusterMergeDeletes {
+		if result := tx.Exec(statement, source.ID); result.Error != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to merge cluster %d: %v", source.ID, result.Error)
+		}
+	}
+	if result := tx.Create(&ClusterAlias{Name: source.Name, ClusterID: targetId}); result.Error != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed to merge cluster %d: %v", source.ID, result.Error)
+	}
+
+	// connected agents are saved from memory, they must not keep the old cluster
+	s.Lock()
+	if result := tx.Commit(); result.Error != nil {
+		s.Unlock()
+		return result.Error
+	}
+	for _, agent := range s.agentMap {
+		if agent.ClusterID == source.ID {
+			agent.ClusterID = targetId
+		}
+	}
+	s.Unlock()
+
+	s.purgeAll()
+	s.emitEvent(EventClusterMerged, targetId, map[string]interface{}{
+		"merged_cluster_id": source.ID,
+		"merged_cluster":    source.Name,
+	})
+	clusterLog.Infof("Cluster: cluster %d (%s) merged into %d\n", source.ID, source.Name, targetId)
+
+	return nil
+}
+
+func (s *NexServer) ApiRenameCluster(c *gin.Context) {
+	clusterId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	type RenameRequest struct {
+		Name string `json:"name" binding:"required"`
+	}
+	var req RenameRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 128 {
+		s.ApiResponseJson(c, 400, "bad", "invalid cluster name")
+		return
+	}
+
+	var cluster Cluster
+	if result := s.requestDB(c).Where("id=?", clusterId).First(&cluster); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+	if cluster.Name == req.Name {
+		s.ApiResponseJson(c, 200, "ok", "")
+		return
+	}
+	if owner := s.clusterNameOwner(req.Name); owner != 0 && owner != cluster.ID {
+		s.ApiResponseJson(c, 409, "bad", "cluster name already in use")
+		return
+	}
+
+	if err := s.RenameCluster(&cluster, req.Name); err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to rename cluster: %v", err)
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+// ApiMergeCluster merges the cluster of the request into clusterId.
+func (s *NexServer) ApiMergeCluster(c *gin.Context) {
+	targetId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	type MergeRequest struct {
+		ClusterId uint `json:"cluster_id" binding:"required"`
+	}
+	var req MergeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+	if req.ClusterId == targetId {
+		s.ApiResponseJson(c, 400, "bad", "a cluster cannot be merged into itself")
+		return
+	}
+
+	var target, source Cluster
+	if result := s.requestDB(c).Where("id=?", targetId).First(&target); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+	if result := s.requestDB(c).Where("id=?", req.ClusterId).First(&source); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster_id")
+		return
+	}
+
+	conflicts, err := s.mergeConflicts(source.ID, target.ID)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+	if len(conflicts) > 0 {
+		c.JSON(409, gin.H{
+			"status":  "bad",
+			"message": "both clusters have nodes with the same host",
+			"data":    conflicts,
+		})
+		return
+	}
+
+	task, err := s.startClusterTask(ClusterTaskMerge, func() error {
+		return s.MergeCluster(&source, target.ID)
+	}, source.ID, target.ID)
+	if err != nil {
+		s.ApiResponseJson(c, 409, "bad", err.Error())
+		return
+	}
+
+	c.JSON(202, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    task,
+	})
+}
+
+// ApiClusterTask reports the last purge or merge of the cluster.
+func (s *NexServer) ApiClusterTask(c *gin.Context) {
+	clusterId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	task := s.findClusterTask(clusterId)
+	if task == nil {
+		s.ApiResponseJson(c, 404, "bad", "no task for the cluster")
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    task,
+	})
+}
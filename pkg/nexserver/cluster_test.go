@@ -0,0 +1,77 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPurgeClusterDisconnectsAgents(t *testing.T) {
+	s, recorder := newRecordingServer(t)
+
+	connected := &Agent{Uuid: "connected", ClusterID: 1}
+	connected.ID = 1
+	other := &Agent{Uuid: "other", ClusterID: 2}
+	other.ID = 2
+	s.agentMap[connected.Uuid] = connected
+	s.agentMap[other.Uuid] = other
+	queue := s.commands.register(connected.Uuid, currentAgentProtocol)
+	s.commands.register(other.Uuid, currentAgentProtocol)
+
+	streaming := false
+	recorder.onExec = func(query string) {
+		if strings.HasPrefix(query, "DELETE FROM agents") || strings.HasPrefix(query, "DELETE FROM nodes") {
+			streaming = streaming || s.findAgent(connected.Uuid) != nil
+		}
+	}
+
+	if err := s.PurgeCluster(1); err != nil {
+		t.Fatalf("PurgeCluster: %v", err)
+	}
+
+	if streaming {
+		t.Errorf("agent still connected when its rows were deleted")
+	}
+	select {
+	case _, ok := <-queue:
+		if ok {
+			t.Errorf("command queue of the purged agent received a command")
+		}
+	default:
+		t.Errorf("command queue of the purged agent is still open")
+	}
+	if s.findAgent(connected.Uuid) != nil {
+		t.Errorf("purged agent is still connected")
+	}
+	if s.findAgent(other.Uuid) == nil {
+		t.Errorf("agent of another cluster was disconnected")
+	}
+	if err := s.commands.send(other.Uuid, newAgentCommand("ports")); err != nil {
+		t.Errorf("agent of another cluster lost its command queue: %v", err)
+	}
+
+	purged := false
+	for _, statement := range recorder.statements {
+		if strings.HasPrefix(statement, "DELETE FROM clusters") {
+			purged = true
+		}
+	}
+	if !purged {
+		t.Errorf("cluster row was not deleted")
+	}
+}
@@ -0,0 +1,323 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CMDBTypeServiceNow = "servicenow"
+	CMDBTypeGeneric    = "generic"
+)
+
+// CMDBConfig configures the inventory exporter. FieldMap maps inventory
+// fields (host, ipv4, os, ...) to CMDB attribute names; unmapped fields are
+// not exported.
+type CMDBConfig struct {
+	Type            string
+	Url             string
+	User            string
+	Password        string `secret:"true"`
+	Token           string `secret:"true"`
+	ClassName       string
+	IntervalMinutes int
+	FieldMap        map[string]string
+}
+
+// defaultServiceNowFieldMap targets the cmdb_ci_server class family.
+var defaultServiceNowFieldMap = map[string]string{
+	"uuid":             "correlation_id",
+	"host":             "name",
+	"ipv4":             "ip_address",
+	"os":               "os",
+	"platform_version": "os_version",
+	"cluster":          "u_nexclipper_cluster",
+}
+
+type CMDBResult struct {
+	StartedTs time.Time `json:"started_ts"`
+	Duration  string    `json:"duration"`
+	Exported  int       `json:"exported"`
+	Error     string    `json:"error"`
+}
+
+type CMDBExporter struct {
+	sync.Mutex
+
+	running bool
+	last    *CMDBResult
+}
+
+func (s *NexServer) cmdbInventory() ([]map[string]interface{}, error) {
+	query := s.db.Raw(`
+SELECT nodes.uuid, nodes.host, nodes.ipv4, nodes.ipv6, nodes.public_ipv4, nodes.public_ipv6,
+       nodes.os, nodes.platform, nodes.platform_family, nodes.platform_version,
+       clusters.name, coalesce(agents.version, ''), coalesce(agents.online, false),
+       agents.last_contact
+FROM nodes
+JOIN clusters ON nodes.cluster_id=clusters.id AND clusters.deleted_at IS NULL
+LEFT JOIN agents ON nodes.agent_id=agents.id
+WHERE nodes.deleted_at IS NULL
+ORDER BY nodes.id`)
+	rows, err := query.Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]map[string]interface{}, 0, 64)
+	for rows.Next() {
+		var nodeUuid, host, ipv4, ipv6, publicIpv4, publicIpv6 string
+		var os, platform, platformFamily, platformVersion string
+		var cluster, agentVersion string
+		var online bool
+		var lastContact *time.Time
+
+		err := rows.Scan(&nodeUuid, &host, &ipv4, &ipv6, &publicIpv4, &publicIpv6,
+			&os, &platform, &platformFamily, &platformVersion,
+			&cluster, &agentVersion, &online, &lastContact)
+		if err != nil {
+			ingestLog.Errorf("failed to get record: %v", err)
+			continue
+		}
+
+		items = append(items, map[string]interface{}{
+			"uuid":             nodeUuid,
+			"host":             host,
+			"ipv4":             ipv4,
+			"ipv6":             ipv6,
+			"public_ipv4":      publicIpv4,
+			"public_ipv6":      publicIpv6,
+			"os":               os,
+			"platform":         platform,
+			"platform_family":  platformFamily,
+			"platform_version": platformVersion,
+			"cluster":          cluster,
+			"agent_version":    agentVersion,
+			"online":           online,
+			"last_contact":     lastContact,
+		})
+	}
+
+	return items, nil
+}
+
+func (s *NexServer) cmdbFieldMap() map[string]string {
+	if len(s.config.CMDB.FieldMap) > 0 {
+		return s.config.CMDB.FieldMap
+	}
+	if s.config.CMDB.Type == CMDBTypeServiceNow {
+		return defaultServiceNowFieldMap
+	}
+
+	return nil
+}
+
+// mapCMDBRecord renames inventory fields according to the field map. A nil
+// field map exports the record unchanged.
+func mapCMDBRecord(record map[string]interface{}, fieldMap map[string]string) map[string]interface{} {
+	if fieldMap == nil {
+		return record
+	}
+
+	mapped := make(map[string]interface{}, len(fieldMap))
+	for src, dst := range fieldMap {
+		if value, found := record[src]; found {
+			mapped[dst] = value
+		}
+	}
+
+	return mapped
+}
+
+func (s *NexServer) cmdbRequest(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if s.config.CMDB.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.config.CMDB.Token)
+	} else if s.config.CMDB.User != "" {
+		req.SetBasicAuth(s.config.CMDB.User, s.config.CMDB.Password)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
+
+// exportServiceNow upserts each node with the Identification and
+// Reconciliation API so repeated exports update the same CI.
+func (s *NexServer) exportServiceNow(records []map[string]interface{}) error {
+	className := s.config.CMDB.ClassName
+	if className == "" {
+		className = "cmdb_ci_linux_server"
+	}
+
+	url := strings.TrimRight(s.config.CMDB.Url, "/") +
+		"/api/now/identifyreconcile?sysparm_data_source=NexClipper"
+
+	for _, record := range records {
+		payload := map[string]interface{}{
+			"items": []map[string]interface{}{
+				{"className": className, "values": record},
+			},
+		}
+		if err := s.cmdbRequest(url, payload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *NexServer) exportGeneric(records []map[string]interface{}) error {
+	return s.cmdbRequest(s.config.CMDB.Url, map[string]interface{}{
+		"source": "nexclipper",
+		"ts":     time.Now(),
+		"items":  records,
+	})
+}
+
+// RunCMDBExport pushes the current node inventory to the configured CMDB.
+func (s *NexServer) RunCMDBExport() (*CMDBResult, error) {
+	if s.config.CMDB.Url == "" {
+		return nil, fmt.Errorf("cmdb exporter is not configured")
+	}
+
+	s.cmdb.Lock()
+	if s.cmdb.running {
+		s.cmdb.Unlock()
+		return nil, fmt.Errorf("cmdb export is already running")
+	}
+	s.cmdb.running = true
+	s.cmdb.Unlock()
+
+	result := &CMDBResult{StartedTs: time.Now()}
+
+	inventory, err := s.cmdbInventory()
+	if err == nil {
+		fieldMap := s.cmdbFieldMap()
+		records := make([]map[string]interface{}, 0, len(inventory))
+		for _, item := range inventory {
+			records = append(records, mapCMDBRecord(item, fieldMap))
+		}
+
+		switch s.config.CMDB.Type {
+		case CMDBTypeServiceNow:
+			err = s.exportServiceNow(records)
+		default:
+			err = s.exportGeneric(records)
+		}
+		if err == nil {
+			result.Exported = len(records)
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+		ingestLog.Errorf("CMDB: export failed: %v\n", err)
+	}
+	result.Duration = time.Since(result.StartedTs).String()
+
+	ingestLog.Infof("CMDB: exported %d nodes in %s\n", result.Exported, result.Duration)
+
+	s.cmdb.Lock()
+	s.cmdb.running = false
+	s.cmdb.last = result
+	s.cmdb.Unlock()
+
+	return result, nil
+}
+
+func (s *NexServer) cmdbSchedule() string {
+	if s.config.CMDB.Url == "" {
+		return ""
+	}
+
+	return everyMinutes(s.config.CMDB.IntervalMinutes)
+}
+
+func (s *NexServer) runCMDBJob() error {
+	result, err := s.RunCMDBExport()
+	if err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return fmt.Errorf(result.Error)
+	}
+
+	return nil
+}
+
+func (s *NexServer) ApiAdminCMDBStatus(c *gin.Context) {
+	s.cmdb.Lock()
+	last := s.cmdb.last
+	running := s.cmdb.running
+	s.cmdb.Unlock()
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"type":      s.config.CMDB.Type,
+			"enabled":   s.config.CMDB.Url != "",
+			"field_map": s.cmdbFieldMap(),
+			"running":   running,
+			"last_run":  last,
+		},
+	})
+}
+
+func (s *NexServer) ApiAdminCMDBRun(c *gin.Context) {
+	result, err := s.RunCMDBExport()
+	if err != nil {
+		s.ApiResponseJson(c, 409, "bad", err.Error())
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": result.Error,
+		"data":    result,
+	})
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/json"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// Agents of protocol 3 report the health of their collectors. An online
+// agent is degraded while one of its collectors is stuck or has failed
+// degradedErrorStreak runs in a row: its metrics keep coming but some are
+// missing. Becoming degraded fires the agent_degraded incident and the
+// agent.degraded event, recovering clears the incident and sends
+// agent.recovered.
+
+const (
+	degradedErrorStreak = 3
+
+	EventAgentDegraded  = "agent.degraded"
+	EventAgentRecovered = "agent.recovered"
+)
+
+type collectorReport struct {
+	Name          string     `json:"name"`
+	Running       bool       `json:"running"`
+	Stuck         bool       `json:"stuck"`
+	ErrorStreak   int        `json:"error_streak"`
+	LastError     string     `json:"last_error"`
+	LastRunTs     time.Time  `json:"last_run_ts"`
+	LastSuccessTs *time.Time `json:"last_success_ts"`
+}
+
+func (report *collectorReport) failing() bool {
+	return report.Stuck || report.ErrorStreak >= degradedErrorStreak
+}
+
+func (s *NexServer) saveCollectorHealth(agent *Agent, in *pb.CommandResult) (*pb.Response, error) {
+	var reports []collectorReport
+	if err := json.Unmarshal(in.Data, &reports); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid collector health")
+	}
+
+	now := time.Now()
+	failing := make([]string, 0)
+	for _, report := range reports {
+		if report.Name == "" {
+			continue
+		}
+		if report.failing() {
+			failing = append(failing, report.Name)
+		}
+
+		var collector AgentCollector
+		result := s.db.Where(AgentCollector{AgentID: agent.ID, Name: report.Name}).
+			Assign(map[string]interface{}{
+				"running":         report.Running,
+				"stuck":           report.Stuck,
+				"error_streak":    report.ErrorStreak,
+				"last_error":      report.LastError,
+				"last_run_ts":     report.LastRunTs,
+				"last_success_ts": report.LastSuccessTs,
+				"reported_ts":     now,
+			}).FirstOrCreate(&collector)
+		if result.Error != nil {
+			ingestLog.Errorf("CollectorHealth: failed to save %s of agent %s: %v\n",
+				report.Name, agent.Uuid, result.Error)
+			return nil, status.Error(codes.Internal, "failed to save collector health")
+		}
+	}
+
+	degraded := len(failing) > 0
+	// the replica changing the state reports the change
+	result := s.db.Model(&Agent{}).Where("id=? AND degraded<>?", agent.ID, degraded).Update("degraded", degraded)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return &pb.Response{Success: true}, nil
+	}
+
+	node := s.findNodeByAgent(agent)
+	if node == nil {
+		return &pb.Response{Success: true}, nil
+	}
+	if degraded {
+		clusterLog.Warnf("Agent: %s is degraded, failing collectors: %v\n", node.Host, failing)
+		s.FireAgentDegraded(agent.ClusterID, node.ID, node.Host)
+		s.emitEvent(EventAgentDegraded, agent.ClusterID, map[string]interface{}{
+			"agent_uuid": agent.Uuid,
+			"node_id":    node.ID,
+			"host":       node.Host,
+			"collectors": failing,
+		})
+	} else {
+		clusterLog.Infof("Agent: %s recovered\n", node.Host)
+		s.ClearAgentDegraded(agent.ClusterID, node.ID, node.Host)
+		s.emitEvent(EventAgentRecovered, agent.ClusterID, map[string]interface{}{
+			"agent_uuid": agent.Uuid,
+			"node_id":    node.ID,
+			"host":       node.Host,
+		})
+	}
+
+	return &pb.Response{Success: true}, nil
+}
+
+func (s *NexServer) ApiAgentCollectors(c *gin.Context) {
+	agentId, ok := s.idParam(c, "agentId", false)
+	if !ok {
+		s.ApiResponseJson(c, 400, "bad", "invalid agent id")
+		return
+	}
+
+	var agent Agent
+	if result := s.requestDB(c).Where("id=?", agentId).First(&agent); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "agent not found")
+		return
+	}
+
+	var collectors []AgentCollector
+	if result := s.requestDB(c).Where("agent_id=?", agent.ID).Order("name").Find(&collectors); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	type CollectorItem struct {
+		Name          string     `json:"name"`
+		Healthy       bool       `json:"healthy"`
+		Running       bool       `json:"running"`
+		Stuck         bool       `json:"stuck"`
+		ErrorStreak   int        `json:"error_streak"`
+		LastError     string     `json:"last_error"`
+		LastRunTs     time.Time  `json:"last_run_ts"`
+		LastSuccessTs *time.Time `json:"last_success_ts"`
+		ReportedTs    time.Time  `json:"reported_ts"`
+	}
+	items := make([]CollectorItem, 0, len(collectors))
+	for _, collector := range collectors {
+		items = append(items, CollectorItem{
+			Name:          collector.Name,
+			Healthy:       !collector.Stuck && collector.ErrorStreak < degradedErrorStreak,
+			Running:       collector.Running,
+			Stuck:         collector.Stuck,
+			ErrorStreak:   collector.ErrorStreak,
+			LastError:     collector.LastError,
+			LastRunTs:     collector.LastRunTs,
+			LastSuccessTs: collector.LastSuccessTs,
+			ReportedTs:    collector.ReportedTs,
+		})
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"agent_id":   agent.ID,
+			"degraded":   agent.Degraded,
+			"collectors": items,
+		},
+	})
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/google/uuid"
+	"sync"
+)
+
+// AgentCommands keeps the command queue of every agent holding an open
+// ping stream, with the protocol the agent speaks. Commands are delivered
+// to the agent with the next status. Closing the queue ends the stream.
+type AgentCommands struct {
+	sync.RWMutex
+
+	queues    map[string]chan *pb.Command
+	protocols map[string]int
+}
+
+func NewAgentCommands() *AgentCommands {
+	return &AgentCommands{
+		queues:    make(map[string]chan *pb.Command),
+		protocols: make(map[string]int),
+	}
+}
+
+func (a *AgentCommands) register(agentUuid string, protocol int) chan *pb.Command {
+	a.Lock()
+	defer a.Unlock()
+
+	queue := make(chan *pb.Command, 16)
+	a.queues[agentUuid] = queue
+	a.protocols[agentUuid] = protocol
+
+	return queue
+}
+
+func (a *AgentCommands) unregister(agentUuid string, queue chan *pb.Command) {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.queues[agentUuid] == queue {
+		delete(a.queues, agentUuid)
+		delete(a.protocols, agentUuid)
+	}
+}
+
+// disconnect closes the queue of an agent, its ping stream ends with the
+// next status.
+func (a *AgentCommands) disconnect(agentUuid string) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	queue, found := a.queues[agentUuid]
+	if !found {
+		return false
+	}
+
+	close(queue)
+	delete(a.queues, agentUuid)
+	delete(a.protocols, agentUuid)
+
+	return true
+}
+
+func (a *AgentCommands) send(agentUuid string, command *pb.Command) error {
+	a.RLock()
+	defer a.RUnlock()
+
+	queue, found := a.queues[agentUuid]
+	if !found {
+		return fmt.Errorf("agent %s is not connected", agentUuid)
+	}
+	if err := commandSupported(command.Name, a.protocols[agentUuid]); err != nil {
+		return fmt.Errorf("agent %s: %v", agentUuid, err)
+	}
+
+	select {
+	case queue <- command:
+		return nil
+	default:
+		return fmt.Errorf("command queue of agent %s is full", agentUuid)
+	}
+}
+
+func newAgentCommand(name string, args ...string) *pb.Command {
+	commandId, _ := uuid.NewUUID()
+
+	return &pb.Command{
+		Id:   commandId.String(),
+		Name: name,
+		Args: args,
+	}
+}
+
+func (s *NexServer) findAgentByNode(node *Node) *Agent {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, agent := range s.agentMap {
+		if agent.ID == node.AgentID {
+			return agent
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"compress/gzip"
+	"github.com/gin-gonic/gin"
+	"strings"
+	"sync"
+)
+
+// Responses are gzipped for the clients accepting it. The compression
+// starts with the first byte of the body, so the responses without body,
+// such as 304, and the ones whose headers were sent before their body are
+// left alone, as well as the bodies already compressed. The streamed
+// responses are flushed through the compressor.
+
+var compressedContentTypes = []string{"application/gzip", "application/zip", "image/"}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		writer, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return writer
+	},
+}
+
+type gzipResponseWriter struct {
+	gin.ResponseWriter
+
+	gzip        *gzip.Writer
+	passthrough bool
+}
+
+func (w *gzipResponseWriter) compresses() bool {
+	if w.gzip != nil {
+		return true
+	}
+	if w.passthrough {
+		return false
+	}
+
+	header := w.Header()
+	contentType := header.Get("Content-Type")
+	for _, compressed := range compressedContentTypes {
+		if strings.HasPrefix(contentType, compressed) {
+			w.passthrough = true
+		}
+	}
+	if w.Written() || header.Get("Content-Encoding") != "" {
+		w.passthrough = true
+	}
+	if w.passthrough {
+		return false
+	}
+
+	header.Set("Content-Encoding", "gzip")
+	header.Add("Vary", "Accept-Encoding")
+	header.Del("Content-Length")
+	w.gzip = gzipWriters.Get().(*gzip.Writer)
+	w.gzip.Reset(w.ResponseWriter)
+
+	return true
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !w.compresses() {
+		return w.ResponseWriter.Write(data)
+	}
+
+	return w.gzip.Write(data)
+}
+
+func (w *gzipResponseWriter) WriteString(data string) (int, error) {
+	return w.Write([]byte(data))
+}
+
+func (w *gzipResponseWriter) Flush() {
+	if w.gzip != nil {
+		_ = w.gzip.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *gzipResponseWriter) close() {
+	if w.gzip == nil {
+		return
+	}
+
+	_ = w.gzip.Close()
+	gzipWriters.Put(w.gzip)
+	w.gzip = nil
+}
+
+func acceptsGzip(c *gin.Context) bool {
+	for _, encoding := range strings.Split(c.GetHeader("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(encoding, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CompressionMiddleware gzips the responses.
+func (s *NexServer) CompressionMiddleware(c *gin.Context) {
+	if c.Request.Method == "HEAD" || !acceptsGzip(c) || c.GetHeader("Upgrade") != "" {
+		c.Next()
+		return
+	}
+
+	writer := &gzipResponseWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	defer func() {
+		writer.close()
+		c.Writer = writer.ResponseWriter
+	}()
+
+	c.Next()
+}
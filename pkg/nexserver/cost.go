@@ -0,0 +1,386 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The cost of a namespace is priced from the pod usage reported by the
+// agents: the hourly average of every container is summed into core-hours
+// and GB-hours and multiplied by the prices of the budget. Budgets belong
+// to a team, which stands for the organization paying for the namespace,
+// and alert the team's channels once a month when the projection for the
+// month crosses the threshold.
+
+const (
+	EventCostBudgetExceeded = "cost.budget_exceeded"
+
+	defaultCostThresholdPercent = 100
+)
+
+type currencyFormat struct {
+	Symbol string
+	Digits int
+}
+
+var currencyFormats = map[string]currencyFormat{
+	"USD": {"$", 2},
+	"EUR": {"€", 2},
+	"GBP": {"£", 2},
+	"JPY": {"¥", 0},
+	"KRW": {"₩", 0},
+	"CNY": {"¥", 2},
+	"INR": {"₹", 2},
+}
+
+// formatMoney formats the amount with thousands separators and the minor
+// units of the currency. Currencies without a known symbol get their code
+// as a suffix.
+func formatMoney(amount float64, currency string) string {
+	currency = strings.ToUpper(currency)
+	format, found := currencyFormats[currency]
+	if !found {
+		format = currencyFormat{Digits: 2}
+	}
+
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	text := strconv.FormatFloat(amount, 'f', format.Digits, 64)
+	integer, fraction := text, ""
+	if idx := strings.Index(text, "."); idx >= 0 {
+		integer, fraction = text[:idx], text[idx:]
+	}
+
+	var grouped strings.Builder
+	for idx, digit := range integer {
+		if idx > 0 && (len(integer)-idx)%3 == 0 {
+			grouped.WriteByte(',')
+		}
+		grouped.WriteRune(digit)
+	}
+
+	if !found {
+		return fmt.Sprintf("%s%s%s %s", sign, grouped.String(), fraction, currency)
+	}
+
+	return sign + format.Symbol + grouped.String() + fraction
+}
+
+func isValidCurrency(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+	for _, letter := range currency {
+		if letter < 'A' || letter > 'Z' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (budget *CostBudget) threshold() float64 {
+	if budget.ThresholdPercent > 0 {
+		return budget.Amount * budget.ThresholdPercent / 100
+	}
+
+	return budget.Amount * defaultCostThresholdPercent / 100
+}
+
+func monthRange(now time.Time) (time.Time, time.Time) {
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	return from, from.AddDate(0, 1, 0)
+}
+
+// namespaceUsage returns the sum of the hourly container averages of the
+// metric over [from, to).
+func (s *NexServer) namespaceUsage(budget *CostBudget, metricName string, from, to time.Time) (float64, error) {
+	var name MetricName
+	if result := s.db.Where("name=?", metricName).First(&name); result.Error != nil {
+		return 0, nil
+	}
+
+	var usage float64
+	row := s.db.Raw(`
+SELECT COALESCE(SUM(hourly.value), 0)
+FROM (
+  SELECT DATE_TRUNC('hour', k8s_metrics.ts) as bucket, k8s_metrics.k8s_container_id,
+         avg(k8s_metrics.value) as value
+  FROM k8s_metrics
+  JOIN k8s_namespaces ON k8s_namespaces.id=k8s_metrics.k8s_namespace_id
+  JOIN k8s_clusters ON k8s_clusters.id=k8s_namespaces.k8s_cluster_id
+  WHERE k8s_metrics.ts >= ? AND k8s_metrics.ts < ? AND k8s_metrics.name_id=?
+    AND k8s_namespaces.name=? AND k8s_clusters.agent_cluster_id=?
+  GROUP BY bucket, k8s_metrics.k8s_container_id
+) hourly`, from, to, name.ID, budget.Namespace, budget.ClusterID).Row()
+	if err := row.Scan(&usage); err != nil {
+		return 0, err
+	}
+
+	return usage, nil
+}
+
+type CostProjection struct {
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	Spent     float64   `json:"spent"`
+	Projected float64   `json:"projected"`
+}
+
+// projectCost prices the month to date and extrapolates it linearly to the
+// end of the month.
+func (s *NexServer) projectCost(budget *CostBudget, now time.Time) (*CostProjection, error) {
+	from, to := monthRange(now)
+
+	// millicore-hours and byte-hours
+	cpu, err := s.namespaceUsage(budget, "k8s_pod_cpu_usage", from, now)
+	if err != nil {
+		return nil, err
+	}
+	memory, err := s.namespaceUsage(budget, "k8s_pod_memory_usage", from, now)
+	if err != nil {
+		return nil, err
+	}
+
+	spent := cpu/1000*budget.CpuCoreHourPrice + memory/(1<<30)*budget.MemoryGbHourPrice
+
+	projection := &CostProjection{From: from, To: to, Spent: spent, Projected: spent}
+	if elapsed := now.Sub(from); elapsed >= time.Hour {
+		projection.Projected = spent * float64(to.Sub(from)) / float64(elapsed)
+	}
+
+	return projection, nil
+}
+
+func (s *NexServer) checkCostBudgets() error {
+	var budgets []CostBudget
+	if result := s.db.Find(&budgets); result.Error != nil {
+		return fmt.Errorf("failed to get budgets: %v", result.Error)
+	}
+
+	now := time.Now().UTC()
+	month := now.Format("2006-01")
+
+	for idx := range budgets {
+		budget := &budgets[idx]
+		if budget.AlertedMonth == month || budget.Amount <= 0 {
+			continue
+		}
+
+		projection, err := s.projectCost(budget, now)
+		if err != nil {
+			schedulerLog.Warnf("Cost: budget %d: %v\n", budget.ID, err)
+			continue
+		}
+		if projection.Projected < budget.threshold() {
+			continue
+		}
+
+		s.notifyCostBudget(budget, projection)
+
+		s.db.Model(budget).Update("alerted_month", month)
+	}
+
+	return nil
+}
+
+// notifyCostBudget sends the alert to the channels of the budget's team,
+// or to the global channels when the team has none.
+func (s *NexServer) notifyCostBudget(budget *CostBudget, projection *CostProjection) {
+	if s.webhooks == nil {
+		return
+	}
+
+	var subscriptions []Subscription
+	result := s.db.Where("disabled=?", false).Find(&subscriptions)
+	if result.Error != nil {
+		schedulerLog.Errorf("Cost: failed to get subscriptions: %v\n", result.Error)
+		return
+	}
+
+	routed := make([]Subscription, 0, len(subscriptions))
+	for _, subscription := range subscriptions {
+		if subscription.TeamID == budget.TeamID && subscription.matches(EventCostBudgetExceeded, budget.ClusterID) {
+			routed = append(routed, subscription)
+		}
+	}
+	if len(routed) == 0 {
+		for _, subscription := range subscriptions {
+			if subscription.TeamID == 0 && subscription.matches(EventCostBudgetExceeded, budget.ClusterID) {
+				routed = append(routed, subscription)
+			}
+		}
+	}
+
+	item := newCostBudgetItem(budget, projection)
+	for _, subscription := range routed {
+		event := newWebhookEvent(EventCostBudgetExceeded, budget.ClusterID, item)
+		event.Message = s.translate(s.matchLocale(subscription.Locale),
+			"Namespace %[1]s is projected to exceed %[2]s this month (%[3]s)",
+			budget.Namespace, formatMoney(budget.Amount, budget.Currency),
+			formatMoney(projection.Projected, budget.Currency))
+		s.enqueueWebhook(subscription, event)
+	}
+}
+
+type CostBudgetItem struct {
+	Id                uint            `json:"id"`
+	TeamId            uint            `json:"team_id"`
+	ClusterId         uint            `json:"cluster_id"`
+	Namespace         string          `json:"namespace"`
+	Currency          string          `json:"currency"`
+	CpuCoreHourPrice  float64         `json:"cpu_core_hour_price"`
+	MemoryGbHourPrice float64         `json:"memory_gb_hour_price"`
+	Amount            float64         `json:"amount"`
+	ThresholdPercent  float64         `json:"threshold_percent"`
+	Projection        *CostProjection `json:"projection,omitempty"`
+}
+
+func newCostBudgetItem(budget *CostBudget, projection *CostProjection) CostBudgetItem {
+	thresholdPercent := budget.ThresholdPercent
+	if thresholdPercent <= 0 {
+		thresholdPercent = defaultCostThresholdPercent
+	}
+
+	return CostBudgetItem{
+		Id:                budget.ID,
+		TeamId:            budget.TeamID,
+		ClusterId:         budget.ClusterID,
+		Namespace:         budget.Namespace,
+		Currency:          budget.Currency,
+		CpuCoreHourPrice:  budget.CpuCoreHourPrice,
+		MemoryGbHourPrice: budget.MemoryGbHourPrice,
+		Amount:            budget.Amount,
+		ThresholdPercent:  thresholdPercent,
+		Projection:        projection,
+	}
+}
+
+func (s *NexServer) ApiCostBudgetList(c *gin.Context) {
+	var budgets []CostBudget
+
+	db := s.requestDB(c).Order("id")
+	if teamId := c.Query("team_id"); teamId != "" {
+		db = db.Where("team_id=?", teamId)
+	}
+	if result := db.Find(&budgets); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	now := time.Now().UTC()
+	items := make([]CostBudgetItem, 0, len(budgets))
+	for idx := range budgets {
+		projection, err := s.projectCost(&budgets[idx], now)
+		if err != nil {
+			s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+			return
+		}
+		items = append(items, newCostBudgetItem(&budgets[idx], projection))
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+func (s *NexServer) ApiCreateCostBudget(c *gin.Context) {
+	type BudgetRequest struct {
+		TeamId            uint    `json:"team_id" binding:"required"`
+		ClusterId         uint    `json:"cluster_id" binding:"required"`
+		Namespace         string  `json:"namespace" binding:"required"`
+		Currency          string  `json:"currency" binding:"required"`
+		CpuCoreHourPrice  float64 `json:"cpu_core_hour_price"`
+		MemoryGbHourPrice float64 `json:"memory_gb_hour_price"`
+		Amount            float64 `json:"amount" binding:"required"`
+		ThresholdPercent  float64 `json:"threshold_percent"`
+	}
+	var req BudgetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	req.Currency = strings.ToUpper(req.Currency)
+	if !isValidCurrency(req.Currency) {
+		s.ApiResponseJsonf(c, 400, "bad", "unknown currency: %s", req.Currency)
+		return
+	}
+	if req.Amount <= 0 || req.CpuCoreHourPrice < 0 || req.MemoryGbHourPrice < 0 || req.ThresholdPercent < 0 {
+		s.ApiResponseJson(c, 400, "bad", "amounts must be positive")
+		return
+	}
+
+	var team Team
+	if result := s.requestDB(c).Where("id=?", req.TeamId).First(&team); result.Error != nil {
+		s.ApiResponseJson(c, 400, "bad", "invalid team id")
+		return
+	}
+
+	budget := CostBudget{
+		TeamID:            team.ID,
+		ClusterID:         req.ClusterId,
+		Namespace:         req.Namespace,
+		Currency:          req.Currency,
+		CpuCoreHourPrice:  req.CpuCoreHourPrice,
+		MemoryGbHourPrice: req.MemoryGbHourPrice,
+		Amount:            req.Amount,
+		ThresholdPercent:  req.ThresholdPercent,
+	}
+	if result := s.requestDB(c).Create(&budget); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create budget: %v", result.Error)
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    newCostBudgetItem(&budget, nil),
+	})
+}
+
+func (s *NexServer) ApiDeleteCostBudget(c *gin.Context) {
+	budgetId, ok := s.idParam(c, "budgetId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid budget id")
+		return
+	}
+
+	result := s.requestDB(c).Where("id=?", budgetId).Delete(&CostBudget{})
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to delete budget: %v", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		s.ApiResponseJson(c, 404, "bad", "invalid budget id")
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
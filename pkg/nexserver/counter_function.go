@@ -0,0 +1,139 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+)
+
+// Averaging the cumulative value of a counter only shows that it grows, so
+// a range query may ask for the rate or the delta of its counter metrics
+// instead, e.g. functions[node_network_rx_bytes]=rate. Both are computed
+// from the increase between consecutive samples of a series, where a
+// sample lower than its predecessor means the counter was reset and
+// counts from zero. delta is the increase in the bucket and rate the
+// increase per second; the first sample of the range has no predecessor
+// and only starts the measure.
+
+const (
+	counterRate  = "rate"
+	counterDelta = "delta"
+)
+
+func isValidCounterFunction(function string) bool {
+	return function == counterRate || function == counterDelta
+}
+
+type counterSelection struct {
+	clusterId uint
+	dateRange []string
+	nameIds   []uint
+	rate      []uint
+	delta     []uint
+}
+
+// selectCounters resolves the functions of the query, which apply to
+// metrics of the counter type only.
+func (s *NexServer) selectCounters(clusterId uint, query *Query, nameIds []uint) (*counterSelection, error) {
+	selection := &counterSelection{
+		clusterId: clusterId,
+		dateRange: query.DateRange,
+		nameIds:   nameIds,
+	}
+	if len(query.Functions) == 0 {
+		return selection, nil
+	}
+
+	names := make([]string, 0, len(query.Functions))
+	for name := range query.Functions {
+		names = append(names, name)
+	}
+
+	rows, err := s.db.Raw(`
+SELECT metric_names.id, metric_names.name, metric_types.name
+FROM metric_names, metric_types
+WHERE metric_names.type_id=metric_types.id AND metric_names.name IN (?)`, names).Rows()
+	if err != nil {
+		ingestLog.Errorf("failed to get metric types: %v", err)
+		return nil, fmt.Errorf("failed to get metric types")
+	}
+	defer rows.Close()
+
+	found := 0
+	for rows.Next() {
+		var id uint
+		var name, metricType string
+		if err := rows.Scan(&id, &name, &metricType); err != nil {
+			continue
+		}
+		if metricType != "counter" {
+			return nil, fmt.Errorf("%s is not a counter", name)
+		}
+
+		found++
+		if query.Functions[name] == counterRate {
+			selection.rate = append(selection.rate, id)
+		} else {
+			selection.delta = append(selection.delta, id)
+		}
+	}
+	if found != len(names) {
+		return nil, fmt.Errorf("unknown metric in functions")
+	}
+
+	return selection, nil
+}
+
+func (sel *counterSelection) empty() bool {
+	return len(sel.rate) == 0 && len(sel.delta) == 0
+}
+
+// valueExpr returns the value of a bucket: the counter function of the
+// metric or the aggregation of the query.
+func (sel *counterSelection) valueExpr(query *Query) *SqlQuery {
+	if sel.empty() {
+		return NewSqlQuery(query.aggregationExpr())
+	}
+
+	return NewSqlQuery("CASE").
+		AppendIf(len(sel.rate) > 0,
+			" WHEN metrics.name_id IN (?) THEN sum(increase) / NULLIF(sum(elapsed), 0)", sel.rate).
+		AppendIf(len(sel.delta) > 0,
+			" WHEN metrics.name_id IN (?) THEN sum(increase)", sel.delta).
+		Append(" ELSE " + query.aggregationExpr() + " END")
+}
+
+// source returns the relation to read the samples from, the metrics table
+// with the increase and elapsed seconds since the previous sample of the
+// series when a counter function is selected.
+func (sel *counterSelection) source() *SqlQuery {
+	if sel.empty() {
+		return NewSqlQuery("metrics")
+	}
+
+	return NewSqlQuery(`
+        (SELECT metrics.*,
+                CASE WHEN value < lag(value) OVER series THEN value
+                     ELSE value - lag(value) OVER series END as increase,
+                EXTRACT(EPOCH FROM ts - lag(ts) OVER series)::numeric as elapsed
+         FROM metrics
+         WHERE ts >= ? AND ts < ? AND metrics.cluster_id=?`, sel.dateRange[0], sel.dateRange[1], sel.clusterId).
+		AppendIf(len(sel.nameIds) > 0, " AND metrics.name_id IN (?)", sel.nameIds).
+		Append(`
+         WINDOW series AS (PARTITION BY node_id, process_id, container_id, name_id, label_id ORDER BY ts))
+        as metrics`)
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"github.com/gin-gonic/gin"
+	"sync"
+	"time"
+)
+
+// Series not seen for counterIdleTtl are forgotten, so the tracker does not
+// grow with every process and container that ever reported; a reset over
+// such a gap goes unnoticed.
+const (
+	counterPrune   = 10 * time.Minute
+	counterIdleTtl = time.Hour
+)
+
+type SeriesKey struct {
+	ClusterID   uint
+	NodeID      uint
+	ProcessID   uint
+	ContainerID uint
+	NameID      uint
+	LabelID     uint
+}
+
+func seriesKeyOf(metric *Metric) SeriesKey {
+	return SeriesKey{
+		ClusterID:   metric.ClusterID,
+		NodeID:      metric.NodeID,
+		ProcessID:   metric.ProcessID,
+		ContainerID: metric.ContainerID,
+		NameID:      metric.NameID,
+		LabelID:     metric.LabelID,
+	}
+}
+
+type counterSample struct {
+	ts    time.Time
+	value float64
+	seen  time.Time
+}
+
+// CounterTracker remembers the last sample of every counter series so that
+// a decreasing value (agent or process restart) is recognized as a reset.
+type CounterTracker struct {
+	sync.Mutex
+
+	last map[SeriesKey]counterSample
+}
+
+func NewCounterTracker() *CounterTracker {
+	return &CounterTracker{
+		last: make(map[SeriesKey]counterSample),
+	}
+}
+
+// Observe records a sample and returns the previous value if the sample
+// is a reset of the series.
+func (t *CounterTracker) Observe(key SeriesKey, ts time.Time, value float64) (float64, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	previous, found := t.last[key]
+	if found && ts.Before(previous.ts) {
+		// out of order sample, keep the newest one as reference
+		return 0, false
+	}
+
+	t.last[key] = counterSample{ts: ts, value: value, seen: time.Now()}
+
+	if found && value < previous.value {
+		return previous.value, true
+	}
+
+	return 0, false
+}
+
+func (t *CounterTracker) prune(now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+
+	for key, sample := range t.last {
+		if now.Sub(sample.seen) > counterIdleTtl {
+			delete(t.last, key)
+		}
+	}
+}
+
+func (s *NexServer) InitCounterTracker() {
+	ticker := time.NewTicker(counterPrune)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.counterTracker.prune(now)
+	}
+}
+
+func (s *NexServer) checkCounterReset(metric *Metric, metricType *MetricType) {
+	if metricType.Name != "counter" {
+		return
+	}
+
+	previous, reset := s.counterTracker.Observe(seriesKeyOf(metric), metric.Ts, metric.Value)
+	if !reset {
+		return
+	}
+
+	counterReset := CounterReset{
+		Ts:            metric.Ts,
+		PreviousValue: previous,
+		Value:         metric.Value,
+		NameID:        metric.NameID,
+		LabelID:       metric.LabelID,
+		ClusterID:     metric.ClusterID,
+		NodeID:        metric.NodeID,
+		ProcessID:     metric.ProcessID,
+		ContainerID:   metric.ContainerID,
+	}
+
+	result := s.db.Create(&counterReset)
+	if result.Error != nil {
+		apiLog.Errorf("failed to record counter reset: %v\n", result.Error)
+	}
+}
+
+func (s *NexServer) ApiCounterResets(c *gin.Context) {
+	cId, clusterOk := s.idParam(c, "clusterId", false)
+	query := s.ParseQuery(c)
+	if s.mathUnsupported(c, query) {
+		return
+	}
+	if !clusterOk || s.IsValidParams(c.Param("clusterId"), query, true, false) == false {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
+
+	db := s.requestDB(c).Table("counter_resets").
+		Select("counter_resets.ts, counter_resets.previous_value, counter_resets.value, "+
+			"metric_names.name, metric_labels.label, counter_resets.node_id, "+
+			"counter_resets.process_id, counter_resets.container_id").
+		Joins("JOIN metric_names ON counter_resets.name_id=metric_names.id").
+		Joins("JOIN metric_labels ON counter_resets.label_id=metric_labels.id").
+		Where("counter_resets.cluster_id=? AND counter_resets.ts >= ? AND counter_resets.ts < ?",
+			cId, query.DateRange[0], query.DateRange[1])
+
+	if len(query.MetricNames) > 0 {
+		db = db.Where("metric_names.name IN (?)", query.MetricNames)
+	}
+	filters := map[string]string{
+		"nodeId":      "counter_resets.node_id=?",
+		"processId":   "counter_resets.process_id=?",
+		"containerId": "counter_resets.container_id=?",
+	}
+	for param, condition := range filters {
+		if value := c.DefaultQuery(param, ""); value != "" {
+			db = db.Where(condition, value)
+		}
+	}
+
+	rows, err, queryTime := s.QueryRowsWithTime(db.Order("counter_resets.ts"))
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	type CounterResetItem struct {
+		Ts            time.Time `json:"ts"`
+		PreviousValue float64   `json:"previous_value"`
+		Value         float64   `json:"value"`
+		MetricName    string    `json:"metric_name"`
+		MetricLabel   string    `json:"metric_label"`
+		NodeId        uint      `json:"node_id"`
+		ProcessId     uint      `json:"process_id"`
+		ContainerId   uint      `json:"container_id"`
+	}
+	results := make([]CounterResetItem, 0, 16)
+
+	for rows.Next() {
+		var item CounterResetItem
+
+		err := rows.Scan(&item.Ts, &item.PreviousValue, &item.Value, &item.MetricName, &item.MetricLabel,
+			&item.NodeId, &item.ProcessId, &item.ContainerId)
+		if err != nil {
+			requestLog(c).Errorf("failed to get record: %v", err)
+			continue
+		}
+
+		results = append(results, item)
+	}
+
+	c.JSON(200, gin.H{
+		"status":        "ok",
+		"message":       "",
+		"data":          results,
+		"count":         len(results),
+		"db_query_time": queryTime.String(),
+	})
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// A date range can be given as one relative expression instead of its two
+// bounds, and the server resolves it against its clock in the timezone of
+// the query:
+//
+//	last_15m, last_24h, last_7d, last_2w   up to now
+//	today, yesterday                        from midnight
+//	this_week                               from Monday midnight
+//	this_month                              from the first of the month
+//
+// The bounds are then given to the handlers in RFC 3339, with the offset
+// of the timezone.
+
+var lastRangePattern = regexp.MustCompile(`^last_([0-9]+)([mhdw])$`)
+
+var lastRangeUnits = map[string]time.Duration{
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+// maxLastRange bounds the relative ranges to what the retention may hold.
+const maxLastRange = 5 * 365 * 24 * time.Hour
+
+func startOfDay(ts time.Time) time.Time {
+	year, month, day := ts.Date()
+
+	return time.Date(year, month, day, 0, 0, 0, 0, ts.Location())
+}
+
+// relativeRange returns the bounds of a relative expression at now.
+func relativeRange(expr string, now time.Time) (time.Time, time.Time, bool) {
+	if matches := lastRangePattern.FindStringSubmatch(expr); matches != nil {
+		count, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil || count <= 0 || count > int64(maxLastRange/lastRangeUnits[matches[2]]) {
+			return now, now, false
+		}
+
+		return now.Add(-time.Duration(count) * lastRangeUnits[matches[2]]), now, true
+	}
+
+	today := startOfDay(now)
+	switch expr {
+	case "today":
+		return today, now, true
+	case "yesterday":
+		return today.AddDate(0, 0, -1), today, true
+	case "this_week":
+		weekday := (int(today.Weekday()) + 6) % 7
+		return today.AddDate(0, 0, -weekday), now, true
+	case "this_month":
+		return today.AddDate(0, 0, 1-today.Day()), now, true
+	}
+
+	return now, now, false
+}
+
+// resolveDateRange replaces a relative expression given as the only bound
+// of a date range with its bounds in the timezone.
+func resolveDateRange(dateRange []string, timezone string, now time.Time) ([]string, bool) {
+	if len(dateRange) != 1 {
+		return dateRange, true
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, false
+	}
+
+	start, end, ok := relativeRange(dateRange[0], now.In(location))
+	if !ok {
+		return nil, false
+	}
+
+	return []string{start.Format(time.RFC3339), end.Format(time.RFC3339)}, true
+}
@@ -20,11 +20,34 @@ import (
 	"database/sql"
 	"fmt"
 	"github.com/jinzhu/gorm"
-	"log"
 	"sync"
 	"time"
 )
 
+// schemaModels are the models of the database schema, in migration order.
+var schemaModels = []interface{}{
+	&Cluster{}, &Agent{}, &Node{},
+	&Container{}, &Process{},
+	&MetricEndpoint{}, &MetricName{}, &MetricLabel{}, &MetricType{},
+	&Metric{}, &K8sMetric{},
+	&Event{}, &K8sEvent{}, &K8sLabel{},
+	&K8sCluster{}, &K8sNamespace{}, &K8sNode{},
+	&K8sObject{}, &K8sDeployment{}, &K8sStatefulSet{}, &K8sDaemonSet{},
+	&K8sReplicaSet{}, &K8sPod{}, &K8sContainer{}, &K8sObjectTag{},
+	&Setting{}, &K8sConnector{}, &IncidentBasicRule{}, &AlertRule{},
+	&CounterReset{}, &ChangePoint{}, &Subscription{}, &ProbeSnapshot{},
+	&OnCallSchedule{}, &OnCallOverride{}, &IncidentRecord{},
+	&DiagnosticCapture{}, &ProfileCapture{}, &Team{}, &TeamRoute{},
+	&CostBudget{}, &AgentGroup{}, &AgentConfig{}, &AgentRollout{},
+	&BundleImport{}, &ServerMember{},
+	&JobRun{}, &SyntheticJourney{}, &SyntheticRun{},
+	&RetentionPolicy{}, &User{}, &ListeningSocket{},
+	&ImageScan{}, &ImageVulnerability{}, &K8sResource{},
+	&ApiKey{}, &ApiKeyUsage{},
+	&AgentCollector{}, &ClusterAlias{}, &MetricRollup{},
+	&EnrollmentToken{},
+}
+
 func Migrate(host string, port int, user string, password string, dbname string, sslmode string) error {
 	dbConnStr := fmt.Sprintf(
 		"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
@@ -38,20 +61,11 @@ func Migrate(host string, port int, user string, password string, dbname string,
 	defer func() {
 		err := db.Close()
 		if err != nil {
-			log.Printf("Failed database closing: %v\n", err)
+			serverLog.Errorf("Failed database closing: %v\n", err)
 		}
 	}()
 
-	db.AutoMigrate(
-		&Cluster{}, &Agent{}, &Node{},
-		&Container{}, &Process{},
-		&MetricEndpoint{}, &MetricName{}, &MetricLabel{}, &MetricType{},
-		&Metric{}, &K8sMetric{},
-		&Event{}, &K8sEvent{}, &K8sLabel{},
-		&K8sCluster{}, &K8sNamespace{}, &K8sNode{},
-		&K8sObject{}, &K8sDeployment{}, &K8sStatefulSet{}, &K8sDaemonSet{},
-		&K8sReplicaSet{}, &K8sPod{}, &K8sContainer{}, &K8sObjectTag{},
-		&Setting{}, &K8sConnector{}, &IncidentBasicRule{})
+	db.AutoMigrate(schemaModels...)
 	db.Exec("select create_hypertable('metrics', 'ts', chunk_time_interval => interval '1 day');")
 	db.Exec("select create_hypertable('events', 'ts', chunk_time_interval => interval '1 day');")
 	db.Exec("select create_hypertable('k8s_metrics', 'ts', chunk_time_interval => interval '1 day');")
@@ -113,7 +127,10 @@ func (s *NexServer) findCluster(clusterName string) *Cluster {
 
 	s.dbLock["CLUSTER"].Lock()
 
-	result := s.db.Where("name=?", clusterName).First(&cluster)
+	result := s.db.Unscoped().Where("name=?", clusterName).First(&cluster)
+	if result.Error != nil {
+		result = s.db.Unscoped().Where("id IN (SELECT cluster_id FROM cluster_aliases WHERE name=?)", clusterName).First(&cluster)
+	}
 	if result.Error != nil {
 		cluster = Cluster{
 			Name: clusterName,
@@ -126,6 +143,17 @@ func (s *NexServer) findCluster(clusterName string) *Cluster {
 	return &cluster
 }
 
+func (s *NexServer) findClusterById(clusterId uint) *Cluster {
+	var cluster Cluster
+
+	result := s.db.Unscoped().Where("id=?", clusterId).First(&cluster)
+	if result.Error != nil {
+		return nil
+	}
+
+	return &cluster
+}
+
 func (s *NexServer) findMetricEndpoint(endpoint string) *MetricEndpoint {
 	var metricEndpoint MetricEndpoint
 
@@ -199,6 +227,17 @@ func (s *NexServer) findMetricLabel(label string) *MetricLabel {
 	return &metricLabel
 }
 
+func (s *NexServer) findMetricLabelById(id uint) *MetricLabel {
+	var metricLabel MetricLabel
+
+	result := s.db.Where("id=?", id).First(&metricLabel)
+	if result.Error != nil {
+		return nil
+	}
+
+	return &metricLabel
+}
+
 func (s *NexServer) findNode(hostName string, clusterId uint) *Node {
 	var node Node
 
@@ -248,9 +287,14 @@ func (s *NexServer) findProcess(processName string, pid int32, nodeId, clusterID
 }
 
 func (s *NexServer) QueryRowsWithTime(q *gorm.DB) (*sql.Rows, error, time.Duration) {
+	if q.Error != nil {
+		return nil, q.Error, 0
+	}
+
 	queryStart := time.Now()
 	rows, err := q.Rows()
 	queryTime := time.Since(queryStart)
+	addQueryTime(q, queryTime)
 
 	return rows, err, queryTime
 }
@@ -25,19 +25,31 @@ import (
 type Cluster struct {
 	gorm.Model
 
-	Name        string `gorm:"size:128"`
-	Description string
-	Disabled    bool
+	Name         string `gorm:"size:128"`
+	Description  string
+	Disabled     bool
+	MetricPrefix string `gorm:"size:64"`
 
 	Agents []Agent
 	Nodes  []Node
 }
 
+// ClusterAlias is a previous name of a cluster, so that agents still
+// reporting it after a rename or a merge end up in the cluster.
+type ClusterAlias struct {
+	ID        uint   `gorm:"primary_key"`
+	Name      string `gorm:"size:128;unique_index"`
+	ClusterID uint   `gorm:"index"`
+	CreatedAt time.Time
+}
+
 type Agent struct {
 	gorm.Model
 
 	Online     bool
+	Degraded   bool
 	Version    string `gorm:"size:32"`
+	Protocol   int
 	Ipv4       string `gorm:"size:16"`
 	Ipv6       string `gorm:"size:40"`
 	PublicIpv4 string `gorm:"size:16"`
@@ -51,6 +63,11 @@ type Agent struct {
 
 	ClusterID uint `gorm:"index"`
 	Node      Node
+
+	// EnrollmentTokenID is the token the agent enrolled with, the agent
+	// authenticates with the secret issued on enrollment.
+	EnrollmentTokenID uint   `gorm:"index"`
+	SecretHash        string `gorm:"size:64"`
 }
 
 type Node struct {
@@ -69,6 +86,7 @@ type Node struct {
 	Uuid            string `gorm:"size:36;unique_index"`
 	Description     string
 	Disabled        bool
+	Manual          bool
 
 	AgentID   uint `gorm:"index"`
 	ClusterID uint `gorm:"index"`
@@ -157,6 +175,33 @@ type Metric struct {
 	ContainerID uint `gorm:"index"`
 }
 
+type CounterReset struct {
+	Ts            time.Time `gorm:"index"`
+	PreviousValue float64
+	Value         float64
+
+	NameID  uint `gorm:"index"`
+	LabelID uint
+
+	ClusterID   uint `gorm:"index"`
+	NodeID      uint
+	ProcessID   uint
+	ContainerID uint
+}
+
+type ChangePoint struct {
+	Ts           time.Time `gorm:"index"`
+	Before       float64
+	After        float64
+	Score        float64
+	ShiftPercent float64
+
+	NameID uint `gorm:"index"`
+
+	ClusterID uint `gorm:"index"`
+	NodeID    uint
+}
+
 type K8sMetric struct {
 	Ts    time.Time
 	Value float64
@@ -216,6 +261,64 @@ type Setting struct {
 	Value string
 }
 
+type AgentGroup struct {
+	gorm.Model
+
+	Name        string `gorm:"size:64;unique_index"`
+	Description string
+	Config      postgres.Jsonb
+}
+
+type AgentConfig struct {
+	gorm.Model
+
+	AgentID      uint `gorm:"unique_index"`
+	AgentGroupID uint `gorm:"index"`
+	Canary       bool
+	Config       postgres.Jsonb
+}
+
+type AgentRollout struct {
+	gorm.Model
+
+	AgentGroupID uint `gorm:"index"`
+	Config       postgres.Jsonb
+	Status       string `gorm:"size:16;index"`
+	Reason       string
+	SoakMinutes  int
+	CanaryAgents string
+	FinishedTs   *time.Time
+}
+
+type JobRun struct {
+	gorm.Model
+
+	Job        string `gorm:"size:64;index"`
+	Trigger    string `gorm:"size:16"`
+	Status     string `gorm:"size:16"`
+	Error      string
+	StartedTs  time.Time
+	FinishedTs time.Time
+}
+
+type ServerMember struct {
+	gorm.Model
+
+	Name        string `gorm:"size:128;unique_index"`
+	Address     string `gorm:"size:256"`
+	HeartbeatTs time.Time
+}
+
+type BundleImport struct {
+	gorm.Model
+
+	Checksum string `gorm:"size:64;unique_index"`
+	Site     string `gorm:"size:128"`
+	FromTs   time.Time
+	ToTs     time.Time
+	Metrics  int
+}
+
 type K8sConnector struct {
 	gorm.Model
 
@@ -251,7 +354,8 @@ type K8sObject struct {
 type K8sNode struct {
 	gorm.Model
 
-	Name string `gorm:"size:128"`
+	Name   string `gorm:"size:128"`
+	Manual bool
 
 	K8sClusterID uint
 	K8sObjectID  uint
@@ -325,6 +429,7 @@ type K8sContainer struct {
 	Image         string `gorm:"size:256"`
 	ContainerType string `gorm:"size64"`
 	ContainerId   string `gorm:"size:256"`
+	Manual        bool
 
 	K8sClusterID   uint
 	K8sNamespaceID uint
@@ -346,10 +451,360 @@ type K8sObjectTag struct {
 	K8sLabelID  uint
 }
 
+type ProbeSnapshot struct {
+	gorm.Model
+
+	Host   string `gorm:"size:128;index"`
+	Source string `gorm:"size:16"`
+	Data   postgres.Jsonb
+	Error  string
+
+	ClusterID uint `gorm:"index"`
+}
+
+type DiagnosticCapture struct {
+	gorm.Model
+
+	CommandID   string `gorm:"size:36;unique_index"`
+	Status      string `gorm:"size:16"`
+	Error       string
+	Data        []byte
+	Size        int
+	CompletedTs *time.Time
+
+	ClusterID uint `gorm:"index"`
+	NodeID    uint
+	AgentID   uint
+}
+
+type ProfileCapture struct {
+	gorm.Model
+
+	CommandID   string `gorm:"size:36;unique_index"`
+	Endpoint    string `gorm:"size:64"`
+	Profile     string `gorm:"size:16"`
+	Seconds     int
+	Status      string `gorm:"size:16"`
+	Error       string
+	Data        []byte
+	Size        int
+	CompletedTs *time.Time
+
+	ClusterID uint `gorm:"index"`
+	NodeID    uint
+	AgentID   uint
+}
+
+type Subscription struct {
+	gorm.Model
+
+	Type      string `gorm:"size:16"`
+	Url       string `gorm:"size:512"`
+	Secret    string `gorm:"size:128"`
+	Events    string
+	ClusterID uint
+	Disabled  bool
+
+	Digest           bool
+	DigestMinutes    int
+	DigestSeverities string `gorm:"size:64"`
+
+	OnCallScheduleID uint
+	TeamID           uint
+
+	ActiveHours      string `gorm:"size:16"`
+	ActiveDays       string `gorm:"size:32"`
+	Timezone         string `gorm:"size:64"`
+	OffHoursSeverity string `gorm:"size:16"`
+
+	Locale string `gorm:"size:16"`
+
+	LastDeliveryTs *time.Time
+	LastError      string
+}
+
+type Team struct {
+	gorm.Model
+
+	Name string `gorm:"size:128;unique_index"`
+}
+
+type TeamRoute struct {
+	gorm.Model
+
+	TeamID    uint `gorm:"index"`
+	ClusterID uint
+	Namespace string `gorm:"size:128"`
+	Label     string `gorm:"size:256"`
+}
+
+type CostBudget struct {
+	gorm.Model
+
+	TeamID    uint `gorm:"index"`
+	ClusterID uint
+	Namespace string `gorm:"size:128"`
+
+	Currency          string `gorm:"size:3"`
+	CpuCoreHourPrice  float64
+	MemoryGbHourPrice float64
+	Amount            float64
+	ThresholdPercent  float64
+
+	AlertedMonth string `gorm:"size:7"`
+}
+
+type OnCallSchedule struct {
+	gorm.Model
+
+	Name          string `gorm:"size:128"`
+	Timezone      string `gorm:"size:64"`
+	RotationHours int
+	StartTs       time.Time
+	Members       postgres.Jsonb
+}
+
+type OnCallOverride struct {
+	gorm.Model
+
+	Member  string `gorm:"size:128"`
+	StartTs time.Time
+	EndTs   time.Time
+
+	OnCallScheduleID uint `gorm:"index"`
+}
+
+type IncidentRecord struct {
+	gorm.Model
+
+	EventName  string `gorm:"size:64;index"`
+	Severity   string `gorm:"size:16"`
+	TargetType string `gorm:"size:32"`
+	Target     string `gorm:"size:256"`
+	Value      float64
+	Condition  float64
+	ReportedTs time.Time
+	DetectedTs time.Time `gorm:"index"`
+
+	ClusterID   uint `gorm:"index"`
+	NodeID      uint
+	ProcessID   uint
+	ContainerID uint
+	PodID       uint
+
+	Context  postgres.Jsonb
+	Timeline postgres.Jsonb
+}
+
 type IncidentBasicRule struct {
 	gorm.Model
 
 	Name        string
 	Description string
 	Query       string
+	Severity    string `gorm:"size:16"`
+}
+
+type AlertRule struct {
+	gorm.Model
+
+	Name            string `gorm:"size:128;unique_index"`
+	MetricName      string `gorm:"size:256"`
+	ClusterID       uint
+	NodeID          uint
+	Operator        string `gorm:"size:2"`
+	Threshold       float64
+	DurationSeconds int
+	Severity        string `gorm:"size:16"`
+	Disabled        bool
+}
+
+type SyntheticJourney struct {
+	gorm.Model
+
+	Name            string `gorm:"size:128;unique_index"`
+	Type            string `gorm:"size:16"`
+	Script          string
+	IntervalSeconds int
+	Severity        string `gorm:"size:16"`
+	Disabled        bool
+	LastDispatchTs  *time.Time
+
+	ClusterID uint `gorm:"index"`
+	NodeID    uint
+}
+
+type SyntheticRun struct {
+	gorm.Model
+
+	CommandID   string `gorm:"size:36;unique_index"`
+	Status      string `gorm:"size:16"`
+	Success     bool
+	Error       string
+	FailedStep  string `gorm:"size:128"`
+	DurationMs  float64
+	Steps       postgres.Jsonb
+	Body        string
+	ContentType string `gorm:"size:128"`
+	CompletedTs *time.Time
+
+	JourneyID uint `gorm:"index"`
+	ClusterID uint
+	NodeID    uint
+	AgentID   uint
+}
+
+// RetentionPolicy of a cluster, ClusterID 0 is the default policy.
+type RetentionPolicy struct {
+	gorm.Model
+
+	ClusterID      uint `gorm:"unique_index"`
+	RawDays        int
+	DownsampleDays int
+	EncodedDays    int
+}
+
+// MetricRollup packs the hourly rows of a series for a day, see encodeRollup.
+type MetricRollup struct {
+	ID          uint      `gorm:"primary_key"`
+	Day         time.Time `gorm:"index"`
+	ClusterID   uint      `gorm:"index"`
+	NodeID      uint
+	ProcessID   uint
+	ContainerID uint
+	EndpointID  uint
+	TypeID      uint
+	NameID      uint `gorm:"index"`
+	LabelID     uint
+	Samples     int
+	Digits      int
+	Data        []byte
+}
+
+type User struct {
+	gorm.Model
+
+	Username     string `gorm:"size:128;unique_index"`
+	Email        string `gorm:"size:255"`
+	DisplayName  string `gorm:"size:255"`
+	PasswordHash string `gorm:"size:128"`
+	Provider     string `gorm:"size:16"`
+	Subject      string `gorm:"size:255;index"`
+	Admin        bool
+	Disabled     bool
+	LastLoginTs  *time.Time
+}
+
+type ListeningSocket struct {
+	gorm.Model
+
+	Protocol    string `gorm:"size:8"`
+	Address     string `gorm:"size:64"`
+	Port        int
+	Pid         int
+	Process     string `gorm:"size:128"`
+	Open        bool
+	Expected    bool
+	FirstSeenTs time.Time
+	LastSeenTs  time.Time
+
+	ClusterID uint `gorm:"index"`
+	NodeID    uint `gorm:"index"`
+}
+
+type K8sResource struct {
+	gorm.Model
+
+	Group       string `gorm:"size:128"`
+	Version     string `gorm:"size:32"`
+	Kind        string `gorm:"size:128"`
+	Namespace   string `gorm:"size:256"`
+	Name        string `gorm:"size:256"`
+	Phase       string `gorm:"size:64"`
+	Conditions  string `gorm:"type:text"`
+	Ready       bool
+	Present     bool
+	FirstSeenTs time.Time
+	LastSeenTs  time.Time
+
+	ClusterID uint `gorm:"index"`
+}
+
+type ImageScan struct {
+	gorm.Model
+
+	Image     string `gorm:"size:256;unique_index"`
+	Status    string `gorm:"size:16"`
+	Error     string `gorm:"size:1024"`
+	Critical  int
+	High      int
+	Medium    int
+	Low       int
+	Unknown   int
+	ScannedTs *time.Time `gorm:"index"`
+}
+
+type ImageVulnerability struct {
+	gorm.Model
+
+	VulnerabilityID  string `gorm:"size:64"`
+	PkgName          string `gorm:"size:256"`
+	InstalledVersion string `gorm:"size:128"`
+	FixedVersion     string `gorm:"size:256"`
+	Severity         string `gorm:"size:16"`
+	Title            string `gorm:"size:512"`
+	Target           string `gorm:"size:256"`
+
+	ImageScanID uint `gorm:"index"`
+}
+
+type ApiKey struct {
+	gorm.Model
+
+	Name       string `gorm:"size:64"`
+	Prefix     string `gorm:"size:16"`
+	KeyHash    string `gorm:"size:64;unique_index"`
+	UserID     uint   `gorm:"index"`
+	DailyCalls int64
+	DailyBytes int64
+	Disabled   bool
+	LastUsedTs *time.Time
+}
+
+// EnrollmentToken admits new agents to its cluster; only its hash is stored.
+type EnrollmentToken struct {
+	gorm.Model
+
+	ClusterID  uint   `gorm:"index"`
+	Name       string `gorm:"size:64"`
+	Prefix     string `gorm:"size:16"`
+	TokenHash  string `gorm:"size:64;unique_index"`
+	Uses       int64
+	ExpiresAt  *time.Time
+	RevokedAt  *time.Time
+	LastUsedTs *time.Time
+}
+
+// AgentCollector is the last reported health of a collector of an agent.
+type AgentCollector struct {
+	ID            uint   `gorm:"primary_key"`
+	AgentID       uint   `gorm:"unique_index:idx_agent_collector"`
+	Name          string `gorm:"size:64;unique_index:idx_agent_collector"`
+	Running       bool
+	Stuck         bool
+	ErrorStreak   int
+	LastError     string
+	LastRunTs     time.Time
+	LastSuccessTs *time.Time
+	ReportedTs    time.Time
+}
+
+type ApiKeyUsage struct {
+	ID          uint      `gorm:"primary_key"`
+	ApiKeyID    uint      `gorm:"unique_index:idx_api_key_usage_day"`
+	Day         time.Time `gorm:"type:date;unique_index:idx_api_key_usage_day"`
+	Calls       int64
+	Bytes       int64
+	QueryTimeMs float64
+	Warned      bool
 }
@@ -0,0 +1,128 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/dgraph-io/ristretto"
+	"github.com/jinzhu/gorm"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+var recordingDrivers int64
+
+// recordingDriver accepts every statement, records it with its arguments
+// and answers the queries with no rows.
+type recordingDriver struct {
+	sync.Mutex
+
+	statements []string
+	args       []driver.Value
+	onExec     func(query string)
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) {
+	return &recordingConn{driver: d}, nil
+}
+
+func (d *recordingDriver) record(query string, args []driver.Value) {
+	d.Lock()
+	d.statements = append(d.statements, query)
+	d.args = append(d.args, args...)
+	onExec := d.onExec
+	d.Unlock()
+
+	if onExec != nil {
+		onExec(query)
+	}
+}
+
+type recordingConn struct {
+	driver *recordingDriver
+}
+
+func (c *recordingConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingStmt{driver: c.driver, query: query}, nil
+}
+
+func (c *recordingConn) Close() error              { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *recordingConn) Commit() error             { return nil }
+func (c *recordingConn) Rollback() error           { return nil }
+
+type recordingStmt struct {
+	driver *recordingDriver
+	query  string
+}
+
+func (s *recordingStmt) Close() error  { return nil }
+func (s *recordingStmt) NumInput() int { return -1 }
+
+func (s *recordingStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.driver.record(s.query, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *recordingStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.driver.record(s.query, args)
+	return emptyRows{}, nil
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string              { return nil }
+func (emptyRows) Close() error                   { return nil }
+func (emptyRows) Next(dest []driver.Value) error { return io.EOF }
+
+func newRecordingServer(t *testing.T) (*NexServer, *recordingDriver) {
+	recorder := &recordingDriver{}
+	driverName := fmt.Sprintf("recording-%d", atomic.AddInt64(&recordingDrivers, 1))
+	sql.Register(driverName, recorder)
+
+	sqlDB, err := sql.Open(driverName, "")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	db, err := gorm.Open("postgres", sqlDB)
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	cache, err := ristretto.NewCache(&ristretto.Config{
+		NumCounters: 1000,
+		MaxCost:     1000,
+		BufferItems: 64,
+	})
+	if err != nil {
+		t.Fatalf("failed to initialize cache: %v", err)
+	}
+
+	s := &NexServer{
+		config:    &Config{},
+		db:        db,
+		cache:     cache,
+		agentMap:  make(map[string]*Agent),
+		commands:  NewAgentCommands(),
+		grpcStats: NewGrpcStats(),
+	}
+
+	return s, recorder
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"reflect"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redactedSecret replaces the secrets of the configuration in diagnostics.
+const redactedSecret = "********"
+
+// LogBuffer keeps the most recent log lines in memory so that they can be
+// attached to a diagnostics bundle.
+type LogBuffer struct {
+	sync.Mutex
+
+	lines   []string
+	maxSize int
+}
+
+func NewLogBuffer(maxSize int) *LogBuffer {
+	return &LogBuffer{
+		lines:   make([]string, 0, maxSize),
+		maxSize: maxSize,
+	}
+}
+
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		b.lines = append(b.lines, line)
+	}
+	if len(b.lines) > b.maxSize {
+		b.lines = b.lines[len(b.lines)-b.maxSize:]
+	}
+
+	return len(p), nil
+}
+
+func (b *LogBuffer) Lines() []string {
+	b.Lock()
+	defer b.Unlock()
+
+	lines := make([]string, len(b.lines))
+	copy(lines, b.lines)
+
+	return lines
+}
+
+func (s *NexServer) runtimeStats() gin.H {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	var gcStats debug.GCStats
+	debug.ReadGCStats(&gcStats)
+
+	return gin.H{
+		"goroutines":      runtime.NumGoroutine(),
+		"cpus":            runtime.NumCPU(),
+		"heap_alloc":      memStats.HeapAlloc,
+		"heap_sys":        memStats.HeapSys,
+		"heap_objects":    memStats.HeapObjects,
+		"total_alloc":     memStats.TotalAlloc,
+		"sys":             memStats.Sys,
+		"num_gc":          gcStats.NumGC,
+		"last_gc":         gcStats.LastGC,
+		"pause_total":     gcStats.PauseTotal.String(),
+		"next_gc":         memStats.NextGC,
+		"gc_cpu_fraction": memStats.GCCPUFraction,
+	}
+}
+
+// redactSecrets masks the string fields tagged secret:"true" of the
+// structs in value, which must be settable.
+func redactSecrets(value reflect.Value) {
+	if value.Kind() != reflect.Struct {
+		return
+	}
+
+	for idx := 0; idx < value.NumField(); idx++ {
+		field := value.Field(idx)
+		if !field.CanSet() {
+			continue
+		}
+		if value.Type().Field(idx).Tag.Get("secret") == "true" && field.Kind() == reflect.String {
+			if field.String() != "" {
+				field.SetString(redactedSecret)
+			}
+			continue
+		}
+		redactSecrets(field)
+	}
+}
+
+// redactedConfig returns a copy of the server configuration without secrets.
+func (s *NexServer) redactedConfig() Config {
+	config := *s.config
+	redactSecrets(reflect.ValueOf(&config).Elem())
+
+	return config
+}
+
+func (s *NexServer) ApiAdminRuntime(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    s.runtimeStats(),
+	})
+}
+
+func (s *NexServer) ApiAdminGoroutines(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Status(200)
+
+	err := pprof.Lookup("goroutine").WriteTo(c.Writer, 2)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to dump goroutines: %v", err)
+	}
+}
+
+func (s *NexServer) ApiAdminDiagnostics(c *gin.Context) {
+	now := time.Now()
+
+	dbStatus := "ok"
+	if err := s.db.DB().Ping(); err != nil {
+		dbStatus = err.Error()
+	}
+
+	s.RLock()
+	agents := len(s.agentMap)
+	s.RUnlock()
+
+	c.Header("Content-Disposition",
+		fmt.Sprintf("attachment; filename=nexserver-diagnostics-%d.json", now.Unix()))
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"generated": now,
+			"versions": gin.H{
+				"nexserver": NexServerVersion,
+				"go":        runtime.Version(),
+				"os":        runtime.GOOS,
+				"arch":      runtime.GOARCH,
+			},
+			"uptime":      time.Since(s.serverStartTs).String(),
+			"config":      s.redactedConfig(),
+			"database":    dbStatus,
+			"runtime":     s.runtimeStats(),
+			"agents":      agents,
+			"recent_logs": s.logBuffer.Lines(),
+		},
+	})
+}
@@ -0,0 +1,274 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Embed tokens grant read access to a single query, so a chart can be
+// embedded in a wiki or a status page by exposing /embed only. A token is
+// the scope (path, query and expiry) signed with HMAC-SHA256; the request
+// is served as if the scoped query had been requested, and the query of
+// the embedding request is ignored. The signing key is kept in the
+// settings table and shared by the replicas; rotating it revokes every
+// token issued before.
+
+const (
+	embedKeySetting      = "embed.key"
+	embedKeyRefresh      = 30 * time.Second
+	defaultEmbedTTLHours = 24 * 30
+	maxEmbedTTLHours     = 24 * 365
+	embedPathPrefix      = "/embed/"
+)
+
+// only read-only data endpoints can be embedded
+var embedPathPrefixes = []string{"/api/v1/metrics/", "/api/v1/snapshot/", "/api/v1/summary/"}
+
+type EmbedScope struct {
+	Path      string `json:"p"`
+	Query     string `json:"q,omitempty"`
+	ExpiresTs int64  `json:"exp"`
+}
+
+// embedContextKey marks requests served through an embed token
+type embedContextKey struct{}
+
+type EmbedKey struct {
+	sync.RWMutex
+
+	key      []byte
+	loadedTs time.Time
+}
+
+func newEmbedKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
+
+func (s *NexServer) embedKey() ([]byte, error) {
+	s.embed.RLock()
+	key, loadedTs := s.embed.key, s.embed.loadedTs
+	s.embed.RUnlock()
+	if key != nil && time.Since(loadedTs) < embedKeyRefresh {
+		return key, nil
+	}
+
+	value, err := newEmbedKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var setting Setting
+	result := s.db.Where(Setting{Name: embedKeySetting}).Attrs(Setting{Value: value}).FirstOrCreate(&setting)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	key = []byte(setting.Value)
+
+	s.embed.Lock()
+	s.embed.key = key
+	s.embed.loadedTs = time.Now()
+	s.embed.Unlock()
+
+	return key, nil
+}
+
+func isEmbedRequest(req *http.Request) bool {
+	return req.Context().Value(embedContextKey{}) != nil
+}
+
+func isEmbeddablePath(path string) bool {
+	if strings.Contains(path, "..") {
+		return false
+	}
+	for _, prefix := range embedPathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *NexServer) signEmbedScope(scope *EmbedScope) (string, error) {
+	key, err := s.embedKey()
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(scope)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (s *NexServer) verifyEmbedToken(token string) (*EmbedScope, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	key, err := s.embedKey()
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	var scope EmbedScope
+	if err := json.Unmarshal(payload, &scope); err != nil {
+		return nil, fmt.Errorf("malformed token")
+	}
+	if time.Now().Unix() >= scope.ExpiresTs {
+		return nil, fmt.Errorf("token expired")
+	}
+	if !isEmbeddablePath(scope.Path) {
+		return nil, fmt.Errorf("scope is not embeddable")
+	}
+
+	return &scope, nil
+}
+
+// ApiEmbed serves the scope of the token through the router.
+func (s *NexServer) ApiEmbed(router *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope, err := s.verifyEmbedToken(c.Param("token"))
+		if err != nil {
+			s.ApiResponseJsonf(c, 403, "bad", "invalid embed token: %v", err)
+			return
+		}
+
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), embedContextKey{}, scope))
+		c.Request.URL.Path = scope.Path
+		c.Request.URL.RawPath = ""
+		c.Request.URL.RawQuery = scope.Query
+		router.HandleContext(c)
+
+		// the handlers of the scoped route have run, stop this chain
+		c.Abort()
+	}
+}
+
+func (s *NexServer) ApiAdminCreateEmbedToken(c *gin.Context) {
+	type EmbedTokenRequest struct {
+		Path     string `json:"path" binding:"required"`
+		TTLHours int    `json:"ttl_hours"`
+	}
+	var req EmbedTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	target, err := url.Parse(req.Path)
+	if err != nil || target.IsAbs() || !isEmbeddablePath(target.Path) {
+		s.ApiResponseJsonf(c, 400, "bad", "path must start with one of %s", strings.Join(embedPathPrefixes, ", "))
+		return
+	}
+
+	if req.TTLHours == 0 {
+		req.TTLHours = defaultEmbedTTLHours
+	}
+	if req.TTLHours < 0 || req.TTLHours > maxEmbedTTLHours {
+		s.ApiResponseJsonf(c, 400, "bad", "ttl_hours must be between 1 and %d", maxEmbedTTLHours)
+		return
+	}
+
+	expiresTs := time.Now().Add(time.Duration(req.TTLHours) * time.Hour)
+	scope := &EmbedScope{Path: target.Path, Query: target.RawQuery, ExpiresTs: expiresTs.Unix()}
+
+	token, err := s.signEmbedScope(scope)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to sign token: %v", err)
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"token":      token,
+			"url":        embedPathPrefix + token,
+			"path":       scope.Path,
+			"query":      scope.Query,
+			"expires_ts": expiresTs,
+		},
+	})
+}
+
+// ApiAdminRotateEmbedKey replaces the signing key, which revokes every
+// issued token.
+func (s *NexServer) ApiAdminRotateEmbedKey(c *gin.Context) {
+	value, err := newEmbedKey()
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to rotate key: %v", err)
+		return
+	}
+
+	var setting Setting
+	result := s.requestDB(c).Where(Setting{Name: embedKeySetting}).
+		Assign(Setting{Value: value}).FirstOrCreate(&setting)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to rotate key: %v", result.Error)
+		return
+	}
+
+	s.embed.Lock()
+	s.embed.key = nil
+	s.embed.Unlock()
+	apiLog.Infof("Embed: signing key rotated")
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
@@ -0,0 +1,454 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"time"
+)
+
+// A new agent sends the enrollment token of its cluster in the metadata of
+// UpdateAgent. Once a cluster has an active token, agents registering to
+// it without one are refused; with cluster.enrollment_required every new
+// agent needs one. An agent enrolling with a token is issued a secret in
+// the response header, which it sends on every later call; an agent
+// restarted without its secret enrolls again. Revoking a token clears the
+// secrets of the agents enrolled with it, so a leaked token cannot keep
+// agents connected. Rotation keeps the previous token valid for a grace
+// period while the deployments pick up the new one.
+
+const (
+	agentEnrollmentKey      = "x-nexclipper-enrollment-token"
+	agentSecretKey          = "x-nexclipper-agent-secret"
+	enrollmentTokenPrefix   = "nxe_"
+	defaultEnrollGraceHours = 24
+)
+
+func newEnrollmentToken() (string, error) {
+	value := make([]byte, 24)
+	if _, err := rand.Read(value); err != nil {
+		return "", err
+	}
+
+	return enrollmentTokenPrefix + hex.EncodeToString(value), nil
+}
+
+func newAgentSecret() (string, error) {
+	value := make([]byte, 32)
+	if _, err := rand.Read(value); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(value), nil
+}
+
+func metadataValue(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+func enrollmentTokenFromContext(ctx context.Context) string {
+	return metadataValue(ctx, agentEnrollmentKey)
+}
+
+// validAgentSecret returns true if the call carries the secret of the
+// agent, or the agent was not issued one.
+func validAgentSecret(ctx context.Context, agent *Agent) bool {
+	if agent.SecretHash == "" {
+		return true
+	}
+	secret := metadataValue(ctx, agentSecretKey)
+	if secret == "" {
+		return false
+	}
+
+	return hmac.Equal([]byte(hashApiKey(secret)), []byte(agent.SecretHash))
+}
+
+func activeEnrollmentTokens(db *gorm.DB, now time.Time) *gorm.DB {
+	return db.Where("revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", now)
+}
+
+func (t *EnrollmentToken) active(now time.Time) bool {
+	return t.RevokedAt == nil && (t.ExpiresAt == nil || t.ExpiresAt.After(now))
+}
+
+// authenticateAgent checks the credential of an agent registering. A known
+// agent holding a secret sends it back, or enrolls again with a token;
+// any other agent enrolls. The token of the enrollment is returned, nil if
+// the agent enrolled without one or authenticated with its secret.
+func (s *NexServer) authenticateAgent(ctx context.Context, clusterName string, agent *Agent) (*EnrollmentToken, error) {
+	if agent != nil && agent.SecretHash != "" {
+		if validAgentSecret(ctx, agent) {
+			return nil, nil
+		}
+		if enrollmentTokenFromContext(ctx) == "" {
+			return nil, fmt.Errorf("agent secret or enrollment token required")
+		}
+	}
+
+	return s.enrollAgent(ctx, clusterName)
+}
+
+// enrollAgent checks the enrollment token an agent of the cluster sent.
+func (s *NexServer) enrollAgent(ctx context.Context, clusterName string) (*EnrollmentToken, error) {
+	now := time.Now()
+	clusterId := s.clusterNameOwner(clusterName)
+
+	token := enrollmentTokenFromContext(ctx)
+	if token == "" {
+		if s.config.Cluster.EnrollmentRequired {
+			return nil, fmt.Errorf("enrollment token required")
+		}
+		if clusterId == 0 {
+			return nil, nil
+		}
+
+		var count int
+		activeEnrollmentTokens(s.db.Model(&EnrollmentToken{}), now).Where("cluster_id=?", clusterId).Count(&count)
+		if count > 0 {
+			return nil, fmt.Errorf("enrollment token required")
+		}
+
+		return nil, nil
+	}
+
+	var enrollment EnrollmentToken
+	if result := s.db.Where("token_hash=?", hashApiKey(token)).First(&enrollment); result.Error != nil {
+		return nil, fmt.Errorf("unknown enrollment token")
+	}
+	if !enrollment.active(now) {
+		return nil, fmt.Errorf("enrollment token is revoked or expired")
+	}
+	if clusterId != enrollment.ClusterID {
+		return nil, fmt.Errorf("enrollment token is not valid for cluster %s", clusterName)
+	}
+
+	s.db.Model(&enrollment).Updates(map[string]interface{}{
+		"uses":         gorm.Expr("uses + 1"),
+		"last_used_ts": &now,
+	})
+
+	return &enrollment, nil
+}
+
+// issueAgentSecret stores a new secret of an agent enrolled with the
+// token and sends it in the response header.
+func (s *NexServer) issueAgentSecret(ctx context.Context, agent *Agent, enrollment *EnrollmentToken) error {
+	secret, err := newAgentSecret()
+	if err != nil {
+		return err
+	}
+
+	secretHash := hashApiKey(secret)
+	result := s.db.Model(&Agent{}).Where("id=?", agent.ID).Updates(map[string]interface{}{
+		"enrollment_token_id": enrollment.ID,
+		"secret_hash":         secretHash,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	s.cache.Del(fmt.Sprintf("AGENT_%s", agent.MachineID))
+
+	agent.EnrollmentTokenID = enrollment.ID
+	agent.SecretHash = secretHash
+	if connected := s.findAgent(agent.Uuid); connected != nil {
+		s.Lock()
+		connected.EnrollmentTokenID = enrollment.ID
+		connected.SecretHash = secretHash
+		s.Unlock()
+	}
+
+	return grpc.SetHeader(ctx, metadata.Pairs(agentSecretKey, secret))
+}
+
+// revokeEnrolledAgents clears the secrets of the agents enrolled with the
+// token and disconnects them, they have to enroll again with a valid token.
+func (s *NexServer) revokeEnrolledAgents(db *gorm.DB, tokenId uint) error {
+	var agents []Agent
+	if result := db.Where("enrollment_token_id=?", tokenId).Find(&agents); result.Error != nil {
+		return result.Error
+	}
+
+	result := db.Model(&Agent{}).Where("enrollment_token_id=?", tokenId).Update("secret_hash", "")
+	if result.Error != nil {
+		return result.Error
+	}
+	for idx := range agents {
+		s.disconnectAgent(agents[idx].Uuid)
+	}
+	s.purgeAll()
+
+	return nil
+}
+
+type EnrollmentTokenItem struct {
+	Id         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Uses       int64      `json:"uses"`
+	Active     bool       `json:"active"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	LastUsedTs *time.Time `json:"last_used_ts"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func newEnrollmentTokenItem(token *EnrollmentToken) EnrollmentTokenItem {
+	return EnrollmentTokenItem{
+		Id:         token.ID,
+		Name:       token.Name,
+		Prefix:     token.Prefix,
+		Uses:       token.Uses,
+		Active:     token.active(time.Now()),
+		ExpiresAt:  token.ExpiresAt,
+		RevokedAt:  token.RevokedAt,
+		LastUsedTs: token.LastUsedTs,
+		CreatedAt:  token.CreatedAt,
+	}
+}
+
+// issueEnrollmentToken stores a new token of the cluster, returning it with
+// its secret.
+func (s *NexServer) issueEnrollmentToken(db *gorm.DB, clusterId uint, name string, expiresHours int) (string, *EnrollmentToken, error) {
+	secret, err := newEnrollmentToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	token := &EnrollmentToken{
+		ClusterID: clusterId,
+		Name:      name,
+		Prefix:    secret[:len(enrollmentTokenPrefix)+6],
+		TokenHash: hashApiKey(secret),
+	}
+	if expiresHours > 0 {
+		expiresAt := time.Now().Add(time.Duration(expiresHours) * time.Hour)
+		token.ExpiresAt = &expiresAt
+	}
+	if result := db.Create(token); result.Error != nil {
+		return "", nil, result.Error
+	}
+
+	return secret, token, nil
+}
+
+func (s *NexServer) enrollmentTokenParam(c *gin.Context) *EnrollmentToken {
+	clusterId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return nil
+	}
+	tokenId, ok := s.idParam(c, "tokenId", false)
+	if !ok {
+		s.ApiResponseJson(c, 400, "bad", "invalid enrollment token id")
+		return nil
+	}
+
+	var token EnrollmentToken
+	if result := s.requestDB(c).Where("id=? AND cluster_id=?", tokenId, clusterId).First(&token); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "enrollment token not found")
+		return nil
+	}
+
+	return &token
+}
+
+func (s *NexServer) ApiEnrollmentTokenList(c *gin.Context) {
+	clusterId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	var tokens []EnrollmentToken
+	if result := s.requestDB(c).Where("cluster_id=?", clusterId).Order("id").Find(&tokens); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	items := make([]EnrollmentTokenItem, 0, len(tokens))
+	for idx := range tokens {
+		items = append(items, newEnrollmentTokenItem(&tokens[idx]))
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+func (s *NexServer) ApiCreateEnrollmentToken(c *gin.Context) {
+	clusterId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	type CreateEnrollmentTokenRequest struct {
+		Name         string `json:"name" binding:"required"`
+		ExpiresHours int    `json:"expires_hours"`
+	}
+	var req CreateEnrollmentTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+	if req.ExpiresHours < 0 {
+		s.ApiResponseJson(c, 400, "bad", "expires_hours must not be negative")
+		return
+	}
+
+	var cluster Cluster
+	if result := s.requestDB(c).Where("id=?", clusterId).First(&cluster); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	secret, token, err := s.issueEnrollmentToken(s.requestDB(c), cluster.ID, req.Name, req.ExpiresHours)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create enrollment token: %v", err)
+		return
+	}
+	clusterLog.Infof("Enrollment: token %d issued for cluster %d\n", token.ID, cluster.ID)
+
+	// the token is only shown once
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"token":            secret,
+			"enrollment_token": newEnrollmentTokenItem(token),
+		},
+	})
+}
+
+// ApiRotateEnrollmentToken issues a token replacing the token of the
+// request, which stays valid for grace_hours (24 by default, 0 revokes it
+// at once).
+func (s *NexServer) ApiRotateEnrollmentToken(c *gin.Context) {
+	previous := s.enrollmentTokenParam(c)
+	if previous == nil {
+		return
+	}
+
+	type RotateEnrollmentTokenRequest struct {
+		GraceHours   *int `json:"grace_hours"`
+		ExpiresHours int  `json:"expires_hours"`
+	}
+	var req RotateEnrollmentTokenRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+			return
+		}
+	}
+	graceHours := defaultEnrollGraceHours
+	if req.GraceHours != nil {
+		graceHours = *req.GraceHours
+	}
+	if graceHours < 0 || req.ExpiresHours < 0 {
+		s.ApiResponseJson(c, 400, "bad", "grace_hours and expires_hours must not be negative")
+		return
+	}
+
+	now := time.Now()
+	if !previous.active(now) {
+		s.ApiResponseJson(c, 409, "bad", "enrollment token is revoked or expired")
+		return
+	}
+
+	tx := s.requestDB(c).Begin()
+	secret, token, err := s.issueEnrollmentToken(tx, previous.ClusterID, previous.Name, req.ExpiresHours)
+	if err != nil {
+		tx.Rollback()
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create enrollment token: %v", err)
+		return
+	}
+
+	var result *gorm.DB
+	if graceHours == 0 {
+		result = tx.Model(previous).Update("revoked_at", &now)
+		if result.Error == nil {
+			if err := s.revokeEnrolledAgents(tx, previous.ID); err != nil {
+				result.Error = err
+			}
+		}
+	} else if expiresAt := now.Add(time.Duration(graceHours) * time.Hour); previous.ExpiresAt == nil || expiresAt.Before(*previous.ExpiresAt) {
+		result = tx.Model(previous).Update("expires_at", &expiresAt)
+	}
+	if result != nil && result.Error != nil {
+		tx.Rollback()
+		s.ApiResponseJsonf(c, 500, "bad", "failed to rotate enrollment token: %v", result.Error)
+		return
+	}
+	if result := tx.Commit(); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to rotate enrollment token: %v", result.Error)
+		return
+	}
+	clusterLog.Infof("Enrollment: token %d of cluster %d rotated to %d\n", previous.ID, previous.ClusterID, token.ID)
+
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"token":            secret,
+			"enrollment_token": newEnrollmentTokenItem(token),
+			"previous":         newEnrollmentTokenItem(previous),
+		},
+	})
+}
+
+func (s *NexServer) ApiRevokeEnrollmentToken(c *gin.Context) {
+	token := s.enrollmentTokenParam(c)
+	if token == nil {
+		return
+	}
+
+	if token.RevokedAt == nil {
+		now := time.Now()
+		if result := s.requestDB(c).Model(token).Update("revoked_at", &now); result.Error != nil {
+			s.ApiResponseJsonf(c, 500, "bad", "failed to revoke enrollment token: %v", result.Error)
+			return
+		}
+		clusterLog.Infof("Enrollment: token %d of cluster %d revoked\n", token.ID, token.ClusterID)
+	}
+	// retried on every revoke, until the agents are cleared
+	if err := s.revokeEnrolledAgents(s.requestDB(c), token.ID); err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to revoke enrolled agents: %v", err)
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Experimental subsystems are declared as features with a default state so
+// they can ship dark. The configuration overrides the default for the
+// deployment, and the admin API overrides both at runtime. Runtime
+// overrides are kept in the settings table, so every replica picks them up
+// within featureRefreshInterval.
+
+const (
+	FeatureChangePoints  = "change_points"
+	FeatureCostReporting = "cost_reporting"
+	FeatureImageScan     = "image_scan"
+	FeatureMeshProbe     = "mesh_probe"
+
+	featureSettingPrefix   = "feature."
+	featureRefreshInterval = 30 * time.Second
+)
+
+type Feature struct {
+	Name        string
+	Description string
+	Default     bool
+}
+
+var features = []Feature{
+	{FeatureChangePoints, "Level shift detection on node metrics", true},
+	{FeatureCostReporting, "Namespace cost projections and budget alerts", false},
+	{FeatureImageScan, "Vulnerability scans of container images with Trivy", false},
+	{FeatureMeshProbe, "Latency and bandwidth probes between the nodes of a cluster", false},
+}
+
+type FeatureFlags struct {
+	sync.RWMutex
+
+	overrides map[string]bool
+	loadedTs  time.Time
+}
+
+func findFeature(name string) *Feature {
+	for idx := range features {
+		if features[idx].Name == name {
+			return &features[idx]
+		}
+	}
+
+	return nil
+}
+
+func (s *NexServer) loadFeatureOverrides() {
+	var settings []Setting
+	result := s.db.Where("name LIKE ?", featureSettingPrefix+"%").Find(&settings)
+	if result.Error != nil {
+		apiLog.Errorf("Feature: failed to load overrides: %v\n", result.Error)
+		return
+	}
+
+	overrides := make(map[string]bool)
+	for _, setting := range settings {
+		enabled, err := strconv.ParseBool(setting.Value)
+		if err != nil {
+			continue
+		}
+		overrides[strings.TrimPrefix(setting.Name, featureSettingPrefix)] = enabled
+	}
+
+	s.features.Lock()
+	s.features.overrides = overrides
+	s.features.loadedTs = time.Now()
+	s.features.Unlock()
+}
+
+// featureState returns whether the feature is enabled and where the state
+// comes from: "default", "config" or "runtime".
+func (s *NexServer) featureState(feature *Feature) (bool, string) {
+	s.features.RLock()
+	stale := time.Since(s.features.loadedTs) >= featureRefreshInterval
+	s.features.RUnlock()
+	if stale {
+		s.loadFeatureOverrides()
+	}
+
+	s.features.RLock()
+	enabled, found := s.features.overrides[feature.Name]
+	s.features.RUnlock()
+	if found {
+		return enabled, "runtime"
+	}
+
+	if enabled, found := s.config.Features[feature.Name]; found {
+		return enabled, "config"
+	}
+
+	return feature.Default, "default"
+}
+
+func (s *NexServer) featureEnabled(name string) bool {
+	feature := findFeature(name)
+	if feature == nil {
+		return false
+	}
+
+	enabled, _ := s.featureState(feature)
+
+	return enabled
+}
+
+// requireFeature hides the routes of a disabled feature.
+func (s *NexServer) requireFeature(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.featureEnabled(name) {
+			s.ApiResponseJsonf(c, 404, "bad", "feature %s is disabled", name)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+func (s *NexServer) ApiAdminFeatures(c *gin.Context) {
+	type FeatureItem struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Default     bool   `json:"default"`
+		Enabled     bool   `json:"enabled"`
+		Source      string `json:"source"`
+	}
+
+	items := make([]FeatureItem, 0, len(features))
+	for idx := range features {
+		feature := &features[idx]
+		enabled, source := s.featureState(feature)
+
+		items = append(items, FeatureItem{
+			Name:        feature.Name,
+			Description: feature.Description,
+			Default:     feature.Default,
+			Enabled:     enabled,
+			Source:      source,
+		})
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+func (s *NexServer) ApiAdminSetFeature(c *gin.Context) {
+	feature := findFeature(s.Param(c, "feature"))
+	if feature == nil {
+		s.ApiResponseJson(c, 404, "bad", "feature not found")
+		return
+	}
+
+	type FeatureRequest struct {
+		Enabled *bool `json:"enabled" binding:"required"`
+	}
+	var req FeatureRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	var setting Setting
+	result := s.requestDB(c).Where(Setting{Name: featureSettingPrefix + feature.Name}).
+		Assign(Setting{Value: strconv.FormatBool(*req.Enabled)}).FirstOrCreate(&setting)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to save feature: %v", result.Error)
+		return
+	}
+
+	s.loadFeatureOverrides()
+	requestLog(c).Infof("Feature: %s set to %t\n", feature.Name, *req.Enabled)
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+// ApiAdminResetFeature drops the runtime override of a feature.
+func (s *NexServer) ApiAdminResetFeature(c *gin.Context) {
+	feature := findFeature(s.Param(c, "feature"))
+	if feature == nil {
+		s.ApiResponseJson(c, 404, "bad", "feature not found")
+		return
+	}
+
+	result := s.requestDB(c).Unscoped().Where("name=?", featureSettingPrefix+feature.Name).Delete(&Setting{})
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to reset feature: %v", result.Error)
+		return
+	}
+
+	s.loadFeatureOverrides()
+	requestLog(c).Infof("Feature: %s reset\n", feature.Name)
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
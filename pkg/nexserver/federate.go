@@ -0,0 +1,252 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// /api/v1/federate, also served at /metrics for the default metrics path
+// of Prometheus, exposes the latest sample of every node, container and
+// pod series in Prometheus text format, so NexServer can be scraped as a
+// federation source; scrapers authenticate with an API key as bearer
+// token when auth is required. Samples keep their collection timestamp,
+// and series without a sample within federateStaleness are left out.
+
+const (
+	federateStaleness   = 5 * time.Minute
+	federateMetricsPath = "/metrics"
+)
+
+var invalidPromChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+func promName(name string) string {
+	name = invalidPromChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+
+	return name
+}
+
+type federateSample struct {
+	Name   string
+	Type   string
+	Labels [][2]string
+	Value  float64
+	Ts     time.Time
+}
+
+// federateLabels merges the labels reported with the metric into the
+// identifying ones, which take precedence.
+func federateLabels(reported string, labels ...[2]string) [][2]string {
+	merged := make([][2]string, 0, len(labels)+4)
+	seen := make(map[string]bool)
+
+	for _, label := range labels {
+		if label[1] == "" {
+			continue
+		}
+		merged = append(merged, label)
+		seen[label[0]] = true
+	}
+
+	for _, pair := range strings.Split(reported, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+
+		key := promName(parts[0])
+		// the agents report the node as host
+		if seen[key] || key == "host" || strings.HasPrefix(key, "__") {
+			continue
+		}
+		merged = append(merged, [2]string{key, parts[1]})
+		seen[key] = true
+	}
+
+	sort.Slice(merged, func(i, j int) bool { return merged[i][0] < merged[j][0] })
+
+	return merged
+}
+
+func (s *NexServer) federateNodeSamples(clusterId uint, names []string, since time.Time) ([]federateSample, error) {
+	q := NewSqlQuery(`
+SELECT DISTINCT ON (metrics.name_id, metrics.cluster_id, metrics.node_id, metrics.container_id, metrics.label_id)
+       metric_names.name, metric_types.name, clusters.name, nodes.host,
+       coalesce(containers.name, ''), coalesce(metric_labels.label, ''), metrics.value, metrics.ts
+FROM metrics
+JOIN metric_names ON metric_names.id=metrics.name_id
+JOIN metric_types ON metric_types.id=metrics.type_id
+JOIN clusters ON clusters.id=metrics.cluster_id
+JOIN nodes ON nodes.id=metrics.node_id
+LEFT JOIN containers ON containers.id=metrics.container_id
+LEFT JOIN metric_labels ON metric_labels.id=metrics.label_id
+WHERE metrics.ts >= ? AND metrics.process_id=0`, since)
+	q.AppendIf(clusterId != 0, " AND metrics.cluster_id=?", clusterId)
+	q.AppendIf(len(names) > 0, " AND metric_names.name IN (?)", names)
+	q.Append(`
+ORDER BY metrics.name_id, metrics.cluster_id, metrics.node_id, metrics.container_id, metrics.label_id,
+         metrics.ts DESC`)
+
+	rows, err := q.Rows(s.db)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := make([]federateSample, 0, 256)
+	for rows.Next() {
+		var sample federateSample
+		var cluster, node, container, label string
+
+		err := rows.Scan(&sample.Name, &sample.Type, &cluster, &node, &container, &label, &sample.Value, &sample.Ts)
+		if err != nil {
+			apiLog.Errorf("failed to get record: %v", err)
+			continue
+		}
+
+		sample.Labels = federateLabels(label,
+			[2]string{"cluster", cluster}, [2]string{"node", node}, [2]string{"container", container})
+		samples = append(samples, sample)
+	}
+
+	return samples, nil
+}
+
+func (s *NexServer) federatePodSamples(clusterId uint, names []string, since time.Time) ([]federateSample, error) {
+	q := NewSqlQuery(`
+SELECT DISTINCT ON (k8s_metrics.name_id, k8s_metrics.k8s_container_id, k8s_metrics.label_id)
+       metric_names.name, metric_types.name, k8s_clusters.name, coalesce(k8s_nodes.name, ''),
+       k8s_namespaces.name, k8s_pods.name, k8s_containers.name, coalesce(metric_labels.label, ''),
+       k8s_metrics.value, k8s_metrics.ts
+FROM k8s_metrics
+JOIN metric_names ON metric_names.id=k8s_metrics.name_id
+JOIN metric_types ON metric_types.id=k8s_metrics.type_id
+JOIN k8s_clusters ON k8s_clusters.id=k8s_metrics.k8s_cluster_id
+JOIN k8s_namespaces ON k8s_namespaces.id=k8s_metrics.k8s_namespace_id
+JOIN k8s_pods ON k8s_pods.id=k8s_metrics.k8s_pod_id
+JOIN k8s_containers ON k8s_containers.id=k8s_metrics.k8s_container_id
+LEFT JOIN k8s_nodes ON k8s_nodes.id=k8s_metrics.k8s_node_id
+LEFT JOIN metric_labels ON metric_labels.id=k8s_metrics.label_id
+WHERE k8s_metrics.ts >= ?`, since)
+	q.AppendIf(clusterId != 0, " AND k8s_clusters.agent_cluster_id=?", clusterId)
+	q.AppendIf(len(names) > 0, " AND metric_names.name IN (?)", names)
+	q.Append(`
+ORDER BY k8s_metrics.name_id, k8s_metrics.k8s_container_id, k8s_metrics.label_id, k8s_metrics.ts DESC`)
+
+	rows, err := q.Rows(s.db)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := make([]federateSample, 0, 256)
+	for rows.Next() {
+		var sample federateSample
+		var cluster, node, namespace, pod, container, label string
+
+		err := rows.Scan(&sample.Name, &sample.Type, &cluster, &node, &namespace, &pod, &container, &label,
+			&sample.Value, &sample.Ts)
+		if err != nil {
+			apiLog.Errorf("failed to get record: %v", err)
+			continue
+		}
+
+		sample.Labels = federateLabels(label,
+			[2]string{"cluster", cluster}, [2]string{"node", node}, [2]string{"namespace", namespace},
+			[2]string{"pod", pod}, [2]string{"container", container})
+		samples = append(samples, sample)
+	}
+
+	return samples, nil
+}
+
+func writeFederateSamples(builder *strings.Builder, samples []federateSample) {
+	families := make(map[string][]federateSample)
+	types := make(map[string]string)
+	for _, sample := range samples {
+		name := promName(sample.Name)
+		families[name] = append(families[name], sample)
+		if _, found := types[name]; !found {
+			types[name] = sample.Type
+		}
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		promType := types[name]
+		if promType != "gauge" && promType != "counter" {
+			promType = "untyped"
+		}
+		builder.WriteString(fmt.Sprintf("# TYPE %s %s\n", name, promType))
+
+		for _, sample := range families[name] {
+			pairs := make([]string, 0, len(sample.Labels))
+			for _, label := range sample.Labels {
+				pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", label[0], escapeLabelValue(label[1])))
+			}
+
+			builder.WriteString(fmt.Sprintf("%s{%s} %g %d\n", name, strings.Join(pairs, ","),
+				sample.Value, sample.Ts.UnixNano()/int64(time.Millisecond)))
+		}
+	}
+}
+
+// ApiFederate serves the latest samples, optionally narrowed with
+// cluster_id and repeated name parameters.
+func (s *NexServer) ApiFederate(c *gin.Context) {
+	var clusterId uint
+	if value := c.Query("cluster_id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			s.ApiResponseJson(c, 400, "bad", "invalid cluster id")
+			return
+		}
+		clusterId = uint(id)
+	}
+	names := c.QueryArray("name")
+	since := time.Now().Add(-federateStaleness)
+
+	samples, err := s.federateNodeSamples(clusterId, names, since)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+	podSamples, err := s.federatePodSamples(clusterId, names, since)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+
+	var builder strings.Builder
+	writeFederateSamples(&builder, append(samples, podSamples...))
+
+	c.Data(200, "text/plain; version=0.0.4; charset=utf-8", []byte(builder.String()))
+}
@@ -0,0 +1,340 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"time"
+)
+
+// A bucket of zeros and a bucket the agent never reported look alike once
+// aggregated. The node, process, container and pod metrics carry the
+// sample count of each bucket next to the count the report interval of the
+// agent of their node promises, and the admin gaps report lists the
+// periods a node went without reporting at all.
+
+const (
+	defaultReportInterval = 5 * time.Second
+
+	defaultGapHours = 24
+	maxGapHours     = 7 * 24
+	defaultMinGap   = 60
+)
+
+// agentReportInterval returns the interval the agent is configured to
+// report at.
+func (s *NexServer) agentReportInterval(agentId uint) time.Duration {
+	values, _ := s.effectiveAgentConfig(agentId)
+	switch value := values["report_interval"].(type) {
+	case float64:
+		if value >= 1 {
+			return time.Duration(value) * time.Second
+		}
+	case int:
+		if value >= 1 {
+			return time.Duration(value) * time.Second
+		}
+	}
+
+	return defaultReportInterval
+}
+
+// completeness computes the expected sample counts of the buckets of a
+// query, looking up the report interval once per node.
+type completeness struct {
+	s         *NexServer
+	start     time.Time
+	end       time.Time
+	named     string
+	bucket    time.Duration
+	location  *time.Location
+	intervals map[uint]time.Duration
+}
+
+func (s *NexServer) newCompleteness(query *Query) *completeness {
+	if query == nil || len(query.DateRange) != 2 {
+		return nil
+	}
+	start, err := parseRangeTime(query.DateRange[0])
+	if err != nil {
+		return nil
+	}
+	end, err := parseRangeTime(query.DateRange[1])
+	if err != nil {
+		return nil
+	}
+	if now := time.Now(); end.After(now) {
+		end = now
+	}
+
+	location, err := time.LoadLocation(query.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	named := ""
+	if _, found := namedBuckets[query.Granularity]; found {
+		named = query.Granularity
+	}
+
+	return &completeness{
+		s:         s,
+		start:     start,
+		end:       end,
+		named:     named,
+		bucket:    queryBucket(query, start, end),
+		location:  location,
+		intervals: make(map[uint]time.Duration),
+	}
+}
+
+func (cp *completeness) interval(nodeId uint) time.Duration {
+	if interval, found := cp.intervals[nodeId]; found {
+		return interval
+	}
+
+	var interval time.Duration
+	var node Node
+	if result := cp.s.db.Select("id, agent_id").Where("id=?", nodeId).First(&node); result.Error == nil && node.AgentID != 0 {
+		interval = cp.s.agentReportInterval(node.AgentID)
+	}
+	cp.intervals[nodeId] = interval
+
+	return interval
+}
+
+// bounds returns the span of the bucket, clipped to the queried range.
+func (cp *completeness) bounds(bucket string) (time.Time, time.Time, bool) {
+	start, err := time.Parse(time.RFC3339Nano, bucket)
+	if err != nil {
+		return start, start, false
+	}
+
+	var end time.Time
+	switch cp.named {
+	case "":
+		end = start.Add(cp.bucket)
+	case "month":
+		// named buckets are truncated in the time zone of the query
+		start = time.Date(start.Year(), start.Month(), start.Day(), start.Hour(), start.Minute(), start.Second(), 0, cp.location)
+		end = start.AddDate(0, 1, 0)
+	case "year":
+		start = time.Date(start.Year(), start.Month(), start.Day(), start.Hour(), start.Minute(), start.Second(), 0, cp.location)
+		end = start.AddDate(1, 0, 0)
+	default:
+		start = time.Date(start.Year(), start.Month(), start.Day(), start.Hour(), start.Minute(), start.Second(), 0, cp.location)
+		end = start.Add(cp.bucket)
+	}
+
+	if start.Before(cp.start) {
+		start = cp.start
+	}
+	if end.After(cp.end) {
+		end = cp.end
+	}
+
+	return start, end, end.After(start)
+}
+
+// expected returns the number of samples the series of a node should have
+// in the bucket, 0 if it is unknown.
+func (cp *completeness) expected(nodeId uint, bucket string, series int64) int64 {
+	if cp == nil {
+		return 0
+	}
+	interval := cp.interval(nodeId)
+	if interval == 0 {
+		return 0
+	}
+	start, end, ok := cp.bounds(bucket)
+	if !ok {
+		return 0
+	}
+
+	return int64(end.Sub(start)/interval) * series
+}
+
+func (s *NexServer) ApiAdminGaps(c *gin.Context) {
+	hours, err := strconv.Atoi(c.DefaultQuery("hours", strconv.Itoa(defaultGapHours)))
+	if err != nil || hours < 1 || hours > maxGapHours {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid hours, expected 1 to %d", maxGapHours)
+		return
+	}
+	minGap, err := strconv.Atoi(c.DefaultQuery("min_gap", strconv.Itoa(defaultMinGap)))
+	if err != nil || minGap < 1 {
+		s.ApiResponseJson(c, 400, "bad", "invalid min_gap")
+		return
+	}
+	var clusterId uint64
+	if value := c.Query("cluster_id"); value != "" {
+		clusterId, err = strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			s.ApiResponseJson(c, 400, "bad", "invalid cluster_id")
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	from := now.Add(-time.Duration(hours) * time.Hour)
+	threshold := time.Duration(minGap) * time.Second
+
+	db := s.requestDB(c).Where("disabled=false")
+	if clusterId != 0 {
+		db = db.Where("cluster_id=?", clusterId)
+	}
+	var nodes []Node
+	if result := db.Order("id").Find(&nodes); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	type Gap struct {
+		Start    time.Time `json:"start"`
+		End      time.Time `json:"end"`
+		Duration float64   `json:"duration"`
+		Open     bool      `json:"open"`
+	}
+	type GapItem struct {
+		NodeId         uint      `json:"node_id"`
+		Node           string    `json:"node"`
+		ClusterId      uint      `json:"cluster_id"`
+		ReportInterval float64   `json:"report_interval"`
+		Samples        int64     `json:"samples"`
+		Expected       int64     `json:"expected"`
+		LastSampleTs   time.Time `json:"last_sample_ts"`
+		Gaps           []Gap     `json:"gaps"`
+	}
+
+	items := make([]*GapItem, 0, len(nodes))
+	itemMap := make(map[uint]*GapItem)
+	windowStart := make(map[uint]time.Time)
+	for _, node := range nodes {
+		item := &GapItem{
+			NodeId:    node.ID,
+			Node:      node.Host,
+			ClusterId: node.ClusterID,
+			Gaps:      make([]Gap, 0),
+		}
+		start := from
+		if node.CreatedAt.After(start) {
+			start = node.CreatedAt.UTC()
+		}
+		if node.AgentID != 0 {
+			interval := s.agentReportInterval(node.AgentID)
+			item.ReportInterval = interval.Seconds()
+			item.Expected = int64(now.Sub(start) / interval)
+		}
+		items = append(items, item)
+		itemMap[node.ID] = item
+		windowStart[node.ID] = start
+	}
+
+	addGap := func(item *GapItem, start, end time.Time, open bool) {
+		if end.Sub(start) <= threshold {
+			return
+		}
+		item.Gaps = append(item.Gaps, Gap{
+			Start:    start,
+			End:      end,
+			Duration: end.Sub(start).Seconds(),
+			Open:     open,
+		})
+	}
+
+	// the node metrics of a report share its timestamp
+	reports := NewSqlQuery(`
+SELECT node_id, count(*), min(ts), max(ts) FROM
+    (SELECT DISTINCT node_id, ts FROM metrics
+    WHERE ts >= ? AND ts < ? AND process_id=0 AND container_id=0`, from, now).
+		AppendIf(clusterId != 0, " AND cluster_id=?", clusterId).
+		Append(`) as samples
+GROUP BY node_id`)
+	rows, err := reports.Rows(s.requestDB(c))
+	if err != nil {
+		requestLog(c).Errorf("failed to get reports: %v", err)
+		s.ApiResponseJsonf(c, 500, "bad", "unexpected error: %v", err)
+		return
+	}
+	firstTs := make(map[uint]time.Time)
+	for rows.Next() {
+		var nodeId uint
+		var samples int64
+		var first, last time.Time
+		if err := rows.Scan(&nodeId, &samples, &first, &last); err != nil {
+			requestLog(c).Errorf("failed to get record: %v", err)
+			continue
+		}
+		if item, found := itemMap[nodeId]; found {
+			item.Samples = samples
+			item.LastSampleTs = last.UTC()
+			firstTs[nodeId] = first.UTC()
+		}
+	}
+	rows.Close()
+
+	gaps := NewSqlQuery(`
+SELECT node_id, gap_start, gap_end FROM
+    (SELECT node_id, lag(ts) OVER (PARTITION BY node_id ORDER BY ts) as gap_start, ts as gap_end
+    FROM (SELECT DISTINCT node_id, ts FROM metrics
+        WHERE ts >= ? AND ts < ? AND process_id=0 AND container_id=0`, from, now).
+		AppendIf(clusterId != 0, " AND cluster_id=?", clusterId).
+		Append(`) as samples) as intervals
+WHERE gap_end - gap_start > ? * INTERVAL '1 second'
+ORDER BY node_id, gap_start`, minGap)
+	rows, err = gaps.Rows(s.requestDB(c))
+	if err != nil {
+		requestLog(c).Errorf("failed to get gaps: %v", err)
+		s.ApiResponseJsonf(c, 500, "bad", "unexpected error: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	for _, item := range items {
+		if first, found := firstTs[item.NodeId]; found {
+			addGap(item, windowStart[item.NodeId], first, false)
+		}
+	}
+	for rows.Next() {
+		var nodeId uint
+		var start, end time.Time
+		if err := rows.Scan(&nodeId, &start, &end); err != nil {
+			requestLog(c).Errorf("failed to get record: %v", err)
+			continue
+		}
+		if item, found := itemMap[nodeId]; found {
+			addGap(item, start.UTC(), end.UTC(), false)
+		}
+	}
+	for _, item := range items {
+		if item.Samples == 0 {
+			addGap(item, windowStart[item.NodeId], now, true)
+		} else {
+			addGap(item, item.LastSampleTs, now, true)
+		}
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"from":    from,
+			"to":      now,
+			"min_gap": minGap,
+			"nodes":   items,
+		},
+	})
+}
@@ -0,0 +1,265 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"strings"
+	"sync"
+	"time"
+)
+
+type GCConfig struct {
+	RetentionDays   int
+	IntervalMinutes int
+}
+
+type GCResult struct {
+	StartedTs  time.Time        `json:"started_ts"`
+	Duration   string           `json:"duration"`
+	Reclaimed  map[string]int64 `json:"reclaimed"`
+	Error      string           `json:"error"`
+	Retention  int              `json:"retention_days"`
+	TotalCount int64            `json:"total"`
+}
+
+// Dimension rows are only deleted once no table references them any more,
+// whatever the age of the references: metrics are kept indefinitely and
+// the rollups outlive the raw samples. Rows created within the retention
+// days are kept so that freshly registered entities survive until their
+// first samples arrive. Every replica caches dimension ids, so the time of
+// the last collection is kept in the settings table and each replica
+// clears its cache within gcCacheRefresh of a collection.
+
+const (
+	gcCollectedSetting = "gc.collected_ts"
+	gcCacheRefresh     = 30 * time.Second
+)
+
+type GarbageCollector struct {
+	sync.Mutex
+
+	running     bool
+	last        *GCResult
+	collectedTs string
+}
+
+type gcReference struct {
+	table  string
+	column string
+}
+
+type gcTable struct {
+	name       string
+	references []gcReference
+	condition  string
+}
+
+var gcTables = []gcTable{
+	{
+		name: "metric_labels",
+		references: []gcReference{
+			{"metrics", "label_id"},
+			{"metric_rollups", "label_id"},
+			{"counter_resets", "label_id"},
+			{"k8s_metrics", "label_id"},
+			{"events", "label_id"},
+			{"k8s_events", "label_id"},
+		},
+	},
+	{
+		name: "processes",
+		references: []gcReference{
+			{"metrics", "process_id"},
+			{"metric_rollups", "process_id"},
+			{"counter_resets", "process_id"},
+			{"events", "process_id"},
+			{"incident_records", "process_id"},
+		},
+	},
+	{
+		name: "containers",
+		references: []gcReference{
+			{"metrics", "container_id"},
+			{"metric_rollups", "container_id"},
+			{"counter_resets", "container_id"},
+			{"events", "container_id"},
+			{"incident_records", "container_id"},
+			{"processes", "container_id"},
+		},
+		condition: `NOT EXISTS (SELECT 1 FROM k8s_containers
+      WHERE k8s_containers.container_id=containers.container_id AND k8s_containers.manual=true)`,
+	},
+}
+
+func (table *gcTable) statement() string {
+	var statement strings.Builder
+	fmt.Fprintf(&statement, "DELETE FROM %[1]s\nWHERE %[1]s.created_at < NOW() - make_interval(days => ?)", table.name)
+	for _, reference := range table.references {
+		fmt.Fprintf(&statement, "\n  AND NOT EXISTS (SELECT 1 FROM %[1]s WHERE %[1]s.%[2]s=%[3]s.id)",
+			reference.table, reference.column, table.name)
+	}
+	if table.condition != "" {
+		fmt.Fprintf(&statement, "\n  AND %s", table.condition)
+	}
+
+	return statement.String()
+}
+
+func (s *NexServer) gcRetentionDays() int {
+	if s.config.GC.RetentionDays > 0 {
+		return s.config.GC.RetentionDays
+	}
+
+	return 30
+}
+
+// RunGarbageCollection removes unreferenced dimension rows once and
+// returns the number of rows reclaimed per table.
+func (s *NexServer) RunGarbageCollection() (*GCResult, error) {
+	s.gc.Lock()
+	if s.gc.running {
+		s.gc.Unlock()
+		return nil, fmt.Errorf("garbage collection is already running")
+	}
+	s.gc.running = true
+	s.gc.Unlock()
+
+	retentionDays := s.gcRetentionDays()
+	result := &GCResult{
+		StartedTs: time.Now(),
+		Reclaimed: make(map[string]int64),
+		Retention: retentionDays,
+	}
+
+	for _, table := range gcTables {
+		query := s.db.Exec(table.statement(), retentionDays)
+		if query.Error != nil {
+			result.Error = fmt.Sprintf("%s: %v", table.name, query.Error)
+			schedulerLog.Errorf("GC: failed to collect %s: %v\n", table.name, query.Error)
+			break
+		}
+
+		result.Reclaimed[table.name] = query.RowsAffected
+		result.TotalCount += query.RowsAffected
+	}
+	result.Duration = time.Since(result.StartedTs).String()
+
+	if result.TotalCount > 0 {
+		// cached dimension rows may point at deleted records
+		s.purgeAll()
+		s.publishGarbageCollection(result.StartedTs)
+	}
+
+	schedulerLog.Infof("GC: reclaimed %d rows in %s: %v\n", result.TotalCount, result.Duration, result.Reclaimed)
+
+	s.gc.Lock()
+	s.gc.running = false
+	s.gc.last = result
+	s.gc.Unlock()
+
+	return result, nil
+}
+
+// publishGarbageCollection tells the other replicas to clear their cache.
+func (s *NexServer) publishGarbageCollection(ts time.Time) {
+	value := ts.Format(time.RFC3339Nano)
+
+	var setting Setting
+	result := s.db.Where(Setting{Name: gcCollectedSetting}).
+		Assign(Setting{Value: value}).FirstOrCreate(&setting)
+	if result.Error != nil {
+		schedulerLog.Errorf("GC: failed to publish the collection: %v\n", result.Error)
+		return
+	}
+
+	s.gc.Lock()
+	s.gc.collectedTs = value
+	s.gc.Unlock()
+}
+
+// checkGarbageCollection clears the cache once another replica collected.
+func (s *NexServer) checkGarbageCollection() {
+	var setting Setting
+	if result := s.db.Where("name=?", gcCollectedSetting).First(&setting); result.Error != nil {
+		return
+	}
+
+	s.gc.Lock()
+	previous := s.gc.collectedTs
+	s.gc.collectedTs = setting.Value
+	s.gc.Unlock()
+
+	if previous != "" && previous != setting.Value {
+		schedulerLog.Infof("GC: dimension rows were collected at %s, clearing the cache\n", setting.Value)
+		s.purgeAll()
+	}
+}
+
+func (s *NexServer) InitGCWatcher() {
+	s.checkGarbageCollection()
+
+	ticker := time.NewTicker(gcCacheRefresh)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.checkGarbageCollection()
+	}
+}
+
+func (s *NexServer) runGarbageCollectionJob() error {
+	result, err := s.RunGarbageCollection()
+	if err != nil {
+		return err
+	}
+	if result.Error != "" {
+		return fmt.Errorf(result.Error)
+	}
+
+	return nil
+}
+
+func (s *NexServer) ApiAdminGCStatus(c *gin.Context) {
+	s.gc.Lock()
+	last := s.gc.last
+	running := s.gc.running
+	s.gc.Unlock()
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"running":  running,
+			"last_run": last,
+		},
+	})
+}
+
+func (s *NexServer) ApiAdminGCRun(c *gin.Context) {
+	result, err := s.RunGarbageCollection()
+	if err != nil {
+		s.ApiResponseJson(c, 409, "bad", err.Error())
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": result.Error,
+		"data":    result,
+	})
+}
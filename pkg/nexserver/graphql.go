@@ -0,0 +1,588 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"strings"
+)
+
+// /api/v1/graphql answers the GraphQL queries over the schema of
+// graphql_schema.go. The server implements the part of the language the
+// UI needs: one query operation with its variables, aliases and
+// arguments, and __typename. Fragments, directives, mutations and the
+// introspection are not supported. The fields of the response keep the
+// order of the query, and a field failing to resolve is null with its
+// error in errors, the way the specification wants.
+
+const (
+	gqlMaxDepth  = 10
+	gqlMaxLength = 64 * 1024
+)
+
+type gqlField struct {
+	alias      string
+	name       string
+	args       map[string]interface{}
+	selections []*gqlField
+}
+
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// gqlObject is a response object keeping the order of its fields.
+type gqlObject struct {
+	keys   []string
+	values []interface{}
+}
+
+func (o *gqlObject) set(key string, value interface{}) {
+	o.keys = append(o.keys, key)
+	o.values = append(o.values, value)
+}
+
+func (o *gqlObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.WriteByte('{')
+	for idx, key := range o.keys {
+		if idx > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		buf.Write(name)
+		buf.WriteByte(':')
+		value, err := json.Marshal(o.values[idx])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+const (
+	gqlTokenName = iota
+	gqlTokenPunct
+	gqlTokenString
+	gqlTokenNumber
+	gqlTokenEOF
+)
+
+type gqlToken struct {
+	kind  int
+	value string
+}
+
+func isGqlNameChar(ch byte, first bool) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z') || (!first && ch >= '0' && ch <= '9')
+}
+
+func lexGraphql(source string) ([]gqlToken, error) {
+	tokens := make([]gqlToken, 0, 64)
+
+	for pos := 0; pos < len(source); {
+		ch := source[pos]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == ',':
+			pos++
+		case ch == '#':
+			for pos < len(source) && source[pos] != '\n' {
+				pos++
+			}
+		case strings.HasPrefix(source[pos:], "..."):
+			return nil, fmt.Errorf("fragments are not supported")
+		case strings.IndexByte("!$():=@[]{}", ch) >= 0:
+			tokens = append(tokens, gqlToken{gqlTokenPunct, string(ch)})
+			pos++
+		case ch == '"':
+			end := pos + 1
+			for end < len(source) && source[end] != '"' {
+				if source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			value, err := strconv.Unquote(source[pos : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string %s", source[pos:end+1])
+			}
+			tokens = append(tokens, gqlToken{gqlTokenString, value})
+			pos = end + 1
+		case ch == '-' || (ch >= '0' && ch <= '9'):
+			end := pos + 1
+			for end < len(source) && strings.IndexByte("0123456789.eE+-", source[end]) >= 0 {
+				end++
+			}
+			tokens = append(tokens, gqlToken{gqlTokenNumber, source[pos:end]})
+			pos = end
+		case isGqlNameChar(ch, true):
+			end := pos + 1
+			for end < len(source) && isGqlNameChar(source[end], false) {
+				end++
+			}
+			tokens = append(tokens, gqlToken{gqlTokenName, source[pos:end]})
+			pos = end
+		default:
+			return nil, fmt.Errorf("unexpected character %q", ch)
+		}
+	}
+
+	return append(tokens, gqlToken{kind: gqlTokenEOF}), nil
+}
+
+type gqlParser struct {
+	tokens    []gqlToken
+	pos       int
+	variables map[string]interface{}
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.tokens[p.pos]
+}
+
+func (p *gqlParser) next() gqlToken {
+	token := p.tokens[p.pos]
+	if token.kind != gqlTokenEOF {
+		p.pos++
+	}
+
+	return token
+}
+
+func (p *gqlParser) isPunct(value string) bool {
+	token := p.peek()
+
+	return token.kind == gqlTokenPunct && token.value == value
+}
+
+func (p *gqlParser) expect(value string) error {
+	if !p.isPunct(value) {
+		return fmt.Errorf("expected %s, found %s", value, p.describe())
+	}
+	p.next()
+
+	return nil
+}
+
+func (p *gqlParser) describe() string {
+	if token := p.peek(); token.kind != gqlTokenEOF {
+		return strconv.Quote(token.value)
+	}
+
+	return "end of query"
+}
+
+func (p *gqlParser) name() (string, error) {
+	token := p.peek()
+	if token.kind != gqlTokenName {
+		return "", fmt.Errorf("expected a name, found %s", p.describe())
+	}
+	p.next()
+
+	return token.value, nil
+}
+
+// parseGraphql parses the query operation of the document with its
+// variables.
+func parseGraphql(source string, variables map[string]interface{}) ([]*gqlField, error) {
+	tokens, err := lexGraphql(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens, variables: variables}
+	if p.variables == nil {
+		p.variables = make(map[string]interface{})
+	}
+
+	if token := p.peek(); token.kind == gqlTokenName {
+		switch token.value {
+		case "query":
+			p.next()
+		case "mutation", "subscription", "fragment":
+			return nil, fmt.Errorf("%s is not supported", token.value)
+		default:
+			return nil, fmt.Errorf("unexpected %s", p.describe())
+		}
+		if p.peek().kind == gqlTokenName {
+			p.next()
+		}
+		if p.isPunct("(") {
+			if err := p.variableDefinitions(); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	selections, err := p.selectionSet(1)
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != gqlTokenEOF {
+		return nil, fmt.Errorf("only one query is supported per request")
+	}
+
+	return selections, nil
+}
+
+// variableDefinitions skips the types of the variables, the values are
+// checked by the resolvers, and keeps their defaults.
+func (p *gqlParser) variableDefinitions() error {
+	p.next()
+	for !p.isPunct(")") {
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		for p.isPunct("[") || p.isPunct("]") || p.isPunct("!") || p.peek().kind == gqlTokenName {
+			p.next()
+		}
+		if p.isPunct("=") {
+			p.next()
+			value, err := p.value()
+			if err != nil {
+				return err
+			}
+			if _, found := p.variables[name]; !found {
+				p.variables[name] = value
+			}
+		}
+	}
+	p.next()
+
+	return nil
+}
+
+func (p *gqlParser) selectionSet(depth int) ([]*gqlField, error) {
+	if depth > gqlMaxDepth {
+		return nil, fmt.Errorf("query is nested deeper than %d levels", gqlMaxDepth)
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	selections := make([]*gqlField, 0, 8)
+	for !p.isPunct("}") {
+		field, err := p.field(depth)
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, field)
+	}
+	p.next()
+	if len(selections) == 0 {
+		return nil, fmt.Errorf("empty selection")
+	}
+
+	return selections, nil
+}
+
+func (p *gqlParser) field(depth int) (*gqlField, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	field := &gqlField{alias: name, name: name, args: make(map[string]interface{})}
+	if p.isPunct(":") {
+		p.next()
+		if field.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.isPunct("(") {
+		p.next()
+		for !p.isPunct(")") {
+			arg, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if field.args[arg], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		p.next()
+	}
+	if p.isPunct("@") {
+		return nil, fmt.Errorf("directives are not supported")
+	}
+	if p.isPunct("{") {
+		if field.selections, err = p.selectionSet(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+
+	return field, nil
+}
+
+func (p *gqlParser) value() (interface{}, error) {
+	token := p.next()
+	switch token.kind {
+	case gqlTokenString:
+		return token.value, nil
+	case gqlTokenNumber:
+		if number, err := strconv.ParseInt(token.value, 10, 64); err == nil {
+			return float64(number), nil
+		}
+		number, err := strconv.ParseFloat(token.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", token.value)
+		}
+		return number, nil
+	case gqlTokenName:
+		switch token.value {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		// enum values are given as their name
+		return token.value, nil
+	case gqlTokenPunct:
+		switch token.value {
+		case "$":
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			value, found := p.variables[name]
+			if !found {
+				return nil, fmt.Errorf("variable $%s is not given", name)
+			}
+			return value, nil
+		case "[":
+			list := make([]interface{}, 0)
+			for !p.isPunct("]") {
+				if p.peek().kind == gqlTokenEOF {
+					return nil, fmt.Errorf("unterminated list")
+				}
+				item, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, item)
+			}
+			p.next()
+			return list, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected %s", strconv.Quote(token.value))
+}
+
+// gqlArgs are the arguments of a field, the numbers of JSON and of the
+// query are float64.
+type gqlArgs map[string]interface{}
+
+func (args gqlArgs) uint(name string) (uint, bool, error) {
+	value, found := args[name]
+	if !found || value == nil {
+		return 0, false, nil
+	}
+	number, ok := value.(float64)
+	if !ok || number < 0 || number != float64(uint(number)) {
+		return 0, false, fmt.Errorf("argument %s must be an id", name)
+	}
+
+	return uint(number), true, nil
+}
+
+func (args gqlArgs) string(name, defaultValue string) (string, error) {
+	value, found := args[name]
+	if !found || value == nil {
+		return defaultValue, nil
+	}
+	text, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("argument %s must be a string", name)
+	}
+
+	return text, nil
+}
+
+func (args gqlArgs) strings(name string) ([]string, error) {
+	value, found := args[name]
+	if !found || value == nil {
+		return nil, nil
+	}
+	if text, ok := value.(string); ok {
+		return []string{text}, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("argument %s must be a list of strings", name)
+	}
+
+	result := make([]string, 0, len(list))
+	for _, item := range list {
+		text, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("argument %s must be a list of strings", name)
+		}
+		result = append(result, text)
+	}
+
+	return result, nil
+}
+
+type gqlResolver func(r *gqlRequest, parent interface{}, args gqlArgs) (interface{}, error)
+
+type gqlFieldDef struct {
+	// typ is the object type of the result, empty for the scalars
+	typ     string
+	resolve gqlResolver
+}
+
+type gqlType struct {
+	scalars func(value interface{}) map[string]interface{}
+	fields  map[string]gqlFieldDef
+}
+
+type gqlRequest struct {
+	s      *NexServer
+	c      *gin.Context
+	errors []gqlError
+
+	metricQueries int
+}
+
+func (r *gqlRequest) fail(path []interface{}, err error) {
+	r.errors = append(r.errors, gqlError{Message: err.Error(), Path: append([]interface{}{}, path...)})
+}
+
+// execute resolves the selections on a value of the type.
+func (r *gqlRequest) execute(typeName string, value interface{}, selections []*gqlField, path []interface{}) *gqlObject {
+	typ := gqlSchema[typeName]
+	var scalars map[string]interface{}
+	if typ.scalars != nil {
+		scalars = typ.scalars(value)
+	}
+
+	result := &gqlObject{}
+	for _, field := range selections {
+		fieldPath := append(path, field.alias)
+		if field.name == "__typename" {
+			result.set(field.alias, typeName)
+			continue
+		}
+
+		def, isObject := typ.fields[field.name]
+		scalar, isScalar := scalars[field.name]
+		switch {
+		case isScalar:
+			if field.selections != nil {
+				r.fail(fieldPath, fmt.Errorf("field %s of %s has no fields", field.name, typeName))
+			}
+			result.set(field.alias, scalar)
+		case isObject:
+			if field.selections == nil {
+				r.fail(fieldPath, fmt.Errorf("field %s of %s needs a selection", field.name, typeName))
+				result.set(field.alias, nil)
+				continue
+			}
+			resolved, err := def.resolve(r, value, gqlArgs(field.args))
+			if err != nil {
+				r.fail(fieldPath, err)
+				result.set(field.alias, nil)
+				continue
+			}
+			result.set(field.alias, r.complete(def.typ, resolved, field.selections, fieldPath))
+		default:
+			r.fail(fieldPath, fmt.Errorf("cannot query field %s on type %s", field.name, typeName))
+			result.set(field.alias, nil)
+		}
+	}
+
+	return result
+}
+
+func (r *gqlRequest) complete(typeName string, value interface{}, selections []*gqlField, path []interface{}) interface{} {
+	switch resolved := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		items := make([]interface{}, 0, len(resolved))
+		for idx, item := range resolved {
+			items = append(items, r.execute(typeName, item, selections, append(path, idx)))
+		}
+		return items
+	}
+
+	return r.execute(typeName, value, selections, path)
+}
+
+func (s *NexServer) ApiGraphql(c *gin.Context) {
+	type GraphqlRequest struct {
+		Query         string                 `json:"query"`
+		Variables     map[string]interface{} `json:"variables"`
+		OperationName string                 `json:"operationName"`
+	}
+	var req GraphqlRequest
+	if c.Request.Method == "GET" {
+		req.Query = c.Query("query")
+		if variables := c.Query("variables"); variables != "" {
+			if err := json.Unmarshal([]byte(variables), &req.Variables); err != nil {
+				c.JSON(400, gin.H{"errors": []gqlError{{Message: "invalid variables"}}})
+				return
+			}
+		}
+	} else if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"errors": []gqlError{{Message: fmt.Sprintf("invalid request: %v", err)}}})
+		return
+	}
+	if req.Query == "" || len(req.Query) > gqlMaxLength {
+		c.JSON(400, gin.H{"errors": []gqlError{{Message: "missing or too long query"}}})
+		return
+	}
+
+	selections, err := parseGraphql(req.Query, req.Variables)
+	if err != nil {
+		c.JSON(400, gin.H{"errors": []gqlError{{Message: err.Error()}}})
+		return
+	}
+
+	r := &gqlRequest{s: s, c: c}
+	data := r.execute("Query", nil, selections, nil)
+	if len(r.errors) > 0 {
+		c.JSON(200, gin.H{"data": data, "errors": r.errors})
+		return
+	}
+
+	c.JSON(200, gin.H{"data": data})
+}
@@ -0,0 +1,443 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"time"
+)
+
+// The schema of /api/v1/graphql:
+//
+//	type Query {
+//	  clusters: [Cluster]
+//	  cluster(id: ID!): Cluster
+//	}
+//	type Cluster {
+//	  id name description disabled
+//	  nodes(id: ID): [Node]
+//	  pods(namespace: String): [Pod]
+//	}
+//	type Node {
+//	  id host ipv4 ipv6 os platform platformVersion description disabled
+//	  containers(id: ID): [Container]
+//	  metrics(...): [Sample]
+//	}
+//	type Container {
+//	  id containerId name image type
+//	  node: Node
+//	  pod: Pod
+//	  metrics(...): [Sample]
+//	}
+//	type Pod {
+//	  id name namespace qos
+//	  containers: [Container]
+//	  metrics(...): [Sample]
+//	}
+//	type Sample { name label bucket value }
+//
+// metrics takes the parameters of the range queries: names, range (two
+// bounds or a relative range, last_1h by default), granularity,
+// aggregation, timezone and groupBy. The samples of a pod are summed over
+// its containers. Each metrics field is a query of its own, so a request
+// runs at most gqlMaxMetricQueries of them.
+
+const (
+	gqlMaxMetricQueries = 100
+	gqlDefaultRange     = "last_1h"
+)
+
+type gqlPod struct {
+	K8sPod
+
+	Namespace string
+	ClusterID uint
+}
+
+type gqlSample struct {
+	Name   string
+	Label  string
+	Bucket time.Time
+	Value  float64
+}
+
+var gqlSchema map[string]gqlType
+
+func init() {
+	gqlSchema = map[string]gqlType{
+		"Query": {
+			fields: map[string]gqlFieldDef{
+				"clusters": {"Cluster", gqlClusters},
+				"cluster":  {"Cluster", gqlCluster},
+			},
+		},
+		"Cluster": {
+			scalars: func(value interface{}) map[string]interface{} {
+				cluster := value.(*Cluster)
+				return map[string]interface{}{
+					"id":          cluster.ID,
+					"name":        cluster.Name,
+					"description": cluster.Description,
+					"disabled":    cluster.Disabled,
+				}
+			},
+			fields: map[string]gqlFieldDef{
+				"nodes": {"Node", gqlClusterNodes},
+				"pods":  {"Pod", gqlClusterPods},
+			},
+		},
+		"Node": {
+			scalars: func(value interface{}) map[string]interface{} {
+				node := value.(*Node)
+				return map[string]interface{}{
+					"id":              node.ID,
+					"host":            node.Host,
+					"ipv4":            node.Ipv4,
+					"ipv6":            node.Ipv6,
+					"os":              node.Os,
+					"platform":        node.Platform,
+					"platformVersion": node.PlatformVersion,
+					"description":     node.Description,
+					"disabled":        node.Disabled,
+				}
+			},
+			fields: map[string]gqlFieldDef{
+				"containers": {"Container", gqlNodeContainers},
+				"metrics":    {"Sample", gqlNodeMetrics},
+			},
+		},
+		"Container": {
+			scalars: func(value interface{}) map[string]interface{} {
+				container := value.(*Container)
+				return map[string]interface{}{
+					"id":          container.ID,
+					"containerId": container.ContainerID,
+					"name":        container.Name,
+					"image":       container.Image,
+					"type":        container.Type,
+				}
+			},
+			fields: map[string]gqlFieldDef{
+				"node":    {"Node", gqlContainerNode},
+				"pod":     {"Pod", gqlContainerPod},
+				"metrics": {"Sample", gqlContainerMetrics},
+			},
+		},
+		"Pod": {
+			scalars: func(value interface{}) map[string]interface{} {
+				pod := value.(*gqlPod)
+				return map[string]interface{}{
+					"id":        pod.ID,
+					"name":      pod.Name,
+					"namespace": pod.Namespace,
+					"qos":       pod.Qos,
+				}
+			},
+			fields: map[string]gqlFieldDef{
+				"containers": {"Container", gqlPodContainers},
+				"metrics":    {"Sample", gqlPodMetrics},
+			},
+		},
+		"Sample": {
+			scalars: func(value interface{}) map[string]interface{} {
+				sample := value.(*gqlSample)
+				return map[string]interface{}{
+					"name":   sample.Name,
+					"label":  sample.Label,
+					"bucket": sample.Bucket,
+					"value":  sample.Value,
+				}
+			},
+		},
+	}
+}
+
+func gqlClusters(r *gqlRequest, parent interface{}, args gqlArgs) (interface{}, error) {
+	var clusters []Cluster
+	if result := r.s.requestDB(r.c).Order("id").Find(&clusters); result.Error != nil {
+		return nil, result.Error
+	}
+
+	items := make([]interface{}, 0, len(clusters))
+	for idx := range clusters {
+		items = append(items, &clusters[idx])
+	}
+
+	return items, nil
+}
+
+func gqlCluster(r *gqlRequest, parent interface{}, args gqlArgs) (interface{}, error) {
+	id, found, err := args.uint("id")
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("argument id is required")
+	}
+
+	var cluster Cluster
+	if result := r.s.requestDB(r.c).Where("id=?", id).First(&cluster); result.Error != nil {
+		if result.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+
+	return &cluster, nil
+}
+
+func gqlClusterNodes(r *gqlRequest, parent interface{}, args gqlArgs) (interface{}, error) {
+	id, found, err := args.uint("id")
+	if err != nil {
+		return nil, err
+	}
+
+	db := r.s.requestDB(r.c).Where("cluster_id=?", parent.(*Cluster).ID)
+	if found {
+		db = db.Where("id=?", id)
+	}
+	var nodes []Node
+	if result := db.Order("host").Find(&nodes); result.Error != nil {
+		return nil, result.Error
+	}
+
+	items := make([]interface{}, 0, len(nodes))
+	for idx := range nodes {
+		items = append(items, &nodes[idx])
+	}
+
+	return items, nil
+}
+
+func (r *gqlRequest) pods(clusterId uint, where string, args ...interface{}) ([]interface{}, error) {
+	rows, err := r.s.requestDB(r.c).Table("k8s_pods").
+		Select("k8s_pods.id, k8s_pods.name, k8s_pods.qos, k8s_namespaces.name").
+		Joins("JOIN k8s_namespaces ON k8s_pods.k8s_namespace_id=k8s_namespaces.id").
+		Joins("JOIN k8s_clusters ON k8s_pods.k8s_cluster_id=k8s_clusters.id").
+		Where("k8s_clusters.agent_cluster_id=? AND k8s_pods.deleted_at IS NULL", clusterId).
+		Where(where, args...).
+		Order("k8s_namespaces.name, k8s_pods.name").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]interface{}, 0)
+	for rows.Next() {
+		pod := &gqlPod{ClusterID: clusterId}
+		if err := rows.Scan(&pod.ID, &pod.Name, &pod.Qos, &pod.Namespace); err != nil {
+			continue
+		}
+		items = append(items, pod)
+	}
+
+	return items, nil
+}
+
+func gqlClusterPods(r *gqlRequest, parent interface{}, args gqlArgs) (interface{}, error) {
+	namespace, err := args.string("namespace", "")
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		return r.pods(parent.(*Cluster).ID, "TRUE")
+	}
+
+	return r.pods(parent.(*Cluster).ID, "k8s_namespaces.name=?", namespace)
+}
+
+func (r *gqlRequest) containers(db func() ([]Container, error)) (interface{}, error) {
+	containers, err := db()
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]interface{}, 0, len(containers))
+	for idx := range containers {
+		items = append(items, &containers[idx])
+	}
+
+	return items, nil
+}
+
+func gqlNodeContainers(r *gqlRequest, parent interface{}, args gqlArgs) (interface{}, error) {
+	id, found, err := args.uint("id")
+	if err != nil {
+		return nil, err
+	}
+
+	return r.containers(func() ([]Container, error) {
+		db := r.s.requestDB(r.c).Where("node_id=?", parent.(*Node).ID)
+		if found {
+			db = db.Where("id=?", id)
+		}
+		var containers []Container
+		return containers, db.Order("name").Find(&containers).Error
+	})
+}
+
+func gqlPodContainers(r *gqlRequest, parent interface{}, args gqlArgs) (interface{}, error) {
+	pod := parent.(*gqlPod)
+
+	return r.containers(func() ([]Container, error) {
+		var containers []Container
+		return containers, r.s.requestDB(r.c).
+			Joins("JOIN k8s_containers ON containers.container_id=k8s_containers.container_id").
+			Where("k8s_containers.k8s_pod_id=? AND containers.cluster_id=?", pod.ID, pod.ClusterID).
+			Where("k8s_containers.deleted_at IS NULL").
+			Order("containers.name").Find(&containers).Error
+	})
+}
+
+func gqlContainerNode(r *gqlRequest, parent interface{}, args gqlArgs) (interface{}, error) {
+	var node Node
+	if result := r.s.requestDB(r.c).Where("id=?", parent.(*Container).NodeID).First(&node); result.Error != nil {
+		if result.RecordNotFound() {
+			return nil, nil
+		}
+		return nil, result.Error
+	}
+
+	return &node, nil
+}
+
+func gqlContainerPod(r *gqlRequest, parent interface{}, args gqlArgs) (interface{}, error) {
+	container := parent.(*Container)
+	pods, err := r.pods(container.ClusterID, `k8s_pods.id IN (SELECT k8s_pod_id FROM k8s_containers
+WHERE k8s_containers.container_id=? AND k8s_containers.deleted_at IS NULL)`, container.ContainerID)
+	if err != nil || len(pods) == 0 {
+		return nil, err
+	}
+
+	return pods[0], nil
+}
+
+// metrics reads the samples of the series of the cluster matched by the
+// filter, summed over their containers.
+func (r *gqlRequest) metrics(clusterId uint, filter *SqlQuery, args gqlArgs) (interface{}, error) {
+	r.metricQueries += 1
+	if r.metricQueries > gqlMaxMetricQueries {
+		return nil, fmt.Errorf("at most %d metrics fields are resolved per request", gqlMaxMetricQueries)
+	}
+
+	query := &Query{}
+	var err error
+	if query.MetricNames, err = args.strings("names"); err != nil {
+		return nil, err
+	}
+	if len(query.MetricNames) == 0 {
+		return nil, fmt.Errorf("argument names is required")
+	}
+	if query.DateRange, err = args.strings("range"); err != nil {
+		return nil, err
+	}
+	if len(query.DateRange) == 0 {
+		query.DateRange = []string{gqlDefaultRange}
+	}
+	if query.Granularity, err = args.string("granularity", ""); err != nil {
+		return nil, err
+	}
+	if query.Aggregation, err = args.string("aggregation", ""); err != nil {
+		return nil, err
+	}
+	if query.Timezone, err = args.string("timezone", "UTC"); err != nil {
+		return nil, err
+	}
+	if query.GroupBy, err = args.strings("groupBy"); err != nil {
+		return nil, err
+	}
+	if !isValidAggregation(query.Aggregation) || !query.isValidGroupBy() {
+		return nil, fmt.Errorf("invalid aggregation or groupBy")
+	}
+	dateRange, ok := resolveDateRange(query.DateRange, query.Timezone, time.Now())
+	if !ok {
+		return nil, fmt.Errorf("invalid range or timezone")
+	}
+	query.DateRange = dateRange
+
+	truncateQuery := r.s.calculateGranularity(query.DateRange, query.Timezone, query.Granularity)
+	if truncateQuery == nil {
+		return nil, fmt.Errorf("invalid range")
+	}
+	metricNameIds := r.s.findMetricIdByNames(query.MetricNames)
+	if len(metricNameIds) != len(query.MetricNames) {
+		return nil, fmt.Errorf("unknown metric in names")
+	}
+	counters, err := r.s.selectCounters(clusterId, query, metricNameIds)
+	if err != nil {
+		return nil, err
+	}
+
+	metricQuery := NewSqlQuery(`
+SELECT metric_names.name, group_label, bucket, ROUND(SUM(value), 2) FROM
+    (SELECT metrics.name_id, `).
+		AppendQuery(counters.valueExpr(query)).
+		Append(` as value, `+query.labelExpr()+` as group_label, `).
+		AppendQuery(truncateQuery).
+		Append(`
+    FROM `).
+		AppendQuery(counters.source()).
+		Append(`
+    JOIN metric_labels ON metric_labels.id=metrics.label_id
+    WHERE ts >= ? AND ts < ? AND metrics.cluster_id=? AND metrics.name_id IN (?) AND `,
+			query.DateRange[0], query.DateRange[1], clusterId, metricNameIds).
+		AppendQuery(filter).
+		Append(`
+    GROUP BY bucket, metrics.container_id, metrics.name_id, group_label) as metrics_bucket
+JOIN metric_names ON metrics_bucket.name_id=metric_names.id
+GROUP BY bucket, metric_names.name, group_label
+ORDER BY bucket, metric_names.name, group_label`)
+
+	rows, err := metricQuery.Rows(r.s.requestDB(r.c))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := make([]interface{}, 0)
+	for rows.Next() {
+		sample := &gqlSample{}
+		if err := rows.Scan(&sample.Name, &sample.Label, &sample.Bucket, &sample.Value); err != nil {
+			continue
+		}
+		items = append(items, sample)
+	}
+
+	return items, nil
+}
+
+func gqlNodeMetrics(r *gqlRequest, parent interface{}, args gqlArgs) (interface{}, error) {
+	node := parent.(*Node)
+
+	return r.metrics(node.ClusterID, NewSqlQuery(
+		"metrics.node_id=? AND metrics.process_id=0 AND metrics.container_id=0", node.ID), args)
+}
+
+func gqlContainerMetrics(r *gqlRequest, parent interface{}, args gqlArgs) (interface{}, error) {
+	container := parent.(*Container)
+
+	return r.metrics(container.ClusterID, NewSqlQuery("metrics.container_id=?", container.ID), args)
+}
+
+func gqlPodMetrics(r *gqlRequest, parent interface{}, args gqlArgs) (interface{}, error) {
+	pod := parent.(*gqlPod)
+
+	return r.metrics(pod.ClusterID, NewSqlQuery(`metrics.container_id IN
+        (SELECT containers.id FROM containers
+         JOIN k8s_containers ON containers.container_id=k8s_containers.container_id
+         WHERE k8s_containers.k8s_pod_id=? AND containers.cluster_id=?)`, pod.ID, pod.ClusterID), args)
+}
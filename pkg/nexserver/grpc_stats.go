@@ -0,0 +1,297 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var grpcDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// grpcUnknownAgent is the agent of the requests from callers that are not
+// registered agents, so made-up UUIDs cannot grow the stats.
+const grpcUnknownAgent = "unknown"
+
+type GrpcStatKey struct {
+	Method string
+	Agent  string
+}
+
+type GrpcStat struct {
+	Requests     uint64
+	Errors       uint64
+	DurationSum  float64
+	DurationMax  float64
+	BucketCounts []uint64
+}
+
+// GrpcStats keeps request rate, error rate and duration per gRPC method
+// and per registered agent.
+type GrpcStats struct {
+	sync.RWMutex
+
+	startTs time.Time
+	stats   map[GrpcStatKey]*GrpcStat
+}
+
+func NewGrpcStats() *GrpcStats {
+	return &GrpcStats{
+		startTs: time.Now(),
+		stats:   make(map[GrpcStatKey]*GrpcStat),
+	}
+}
+
+func (g *GrpcStats) Observe(method, agent string, duration time.Duration, err error) {
+	g.Lock()
+	defer g.Unlock()
+
+	key := GrpcStatKey{Method: method, Agent: agent}
+	stat, found := g.stats[key]
+	if !found {
+		stat = &GrpcStat{BucketCounts: make([]uint64, len(grpcDurationBuckets))}
+		g.stats[key] = stat
+	}
+
+	seconds := duration.Seconds()
+
+	stat.Requests += 1
+	if err != nil {
+		stat.Errors += 1
+	}
+	stat.DurationSum += seconds
+	if seconds > stat.DurationMax {
+		stat.DurationMax = seconds
+	}
+	for idx, bound := range grpcDurationBuckets {
+		if seconds <= bound {
+			stat.BucketCounts[idx] += 1
+		}
+	}
+}
+
+// Forget drops the stats of a removed agent.
+func (g *GrpcStats) Forget(agent string) {
+	g.Lock()
+	defer g.Unlock()
+
+	for key := range g.stats {
+		if key.Agent == agent {
+			delete(g.stats, key)
+		}
+	}
+}
+
+func (g *GrpcStats) Snapshot() map[GrpcStatKey]GrpcStat {
+	g.RLock()
+	defer g.RUnlock()
+
+	snapshot := make(map[GrpcStatKey]GrpcStat, len(g.stats))
+	for key, stat := range g.stats {
+		copied := *stat
+		copied.BucketCounts = append([]uint64(nil), stat.BucketCounts...)
+		snapshot[key] = copied
+	}
+
+	return snapshot
+}
+
+func (g *GrpcStats) sortedKeys(snapshot map[GrpcStatKey]GrpcStat) []GrpcStatKey {
+	keys := make([]GrpcStatKey, 0, len(snapshot))
+	for key := range snapshot {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Method != keys[j].Method {
+			return keys[i].Method < keys[j].Method
+		}
+		return keys[i].Agent < keys[j].Agent
+	})
+
+	return keys
+}
+
+func agentUuidFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	agentUuid := md.Get("UUID")
+	if len(agentUuid) == 0 {
+		return ""
+	}
+
+	return agentUuid[0]
+}
+
+// grpcStatAgent returns the agent the stats of the request are kept for.
+func (s *NexServer) grpcStatAgent(ctx context.Context) string {
+	agent := s.findAgent(agentUuidFromContext(ctx))
+	if agent == nil {
+		return grpcUnknownAgent
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if !validAgentSecret(ctx, agent) {
+		return grpcUnknownAgent
+	}
+
+	return agent.Uuid
+}
+
+func (s *NexServer) UnaryInterceptor(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+
+	resp, err := s.TraceUnaryInterceptor(ctx, req, info, handler)
+	s.grpcStats.Observe(info.FullMethod, s.grpcStatAgent(ctx), time.Since(start), err)
+
+	return resp, err
+}
+
+func (s *NexServer) StreamInterceptor(srv interface{}, ss grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+
+	err := s.TraceStreamInterceptor(srv, ss, info, handler)
+	s.grpcStats.Observe(info.FullMethod, s.grpcStatAgent(ss.Context()), time.Since(start), err)
+
+	return err
+}
+
+func escapeLabelValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+// writeGrpcPrometheus renders the gRPC RED metrics in Prometheus text format.
+func (s *NexServer) writeGrpcPrometheus(builder *strings.Builder) {
+	snapshot := s.grpcStats.Snapshot()
+	keys := s.grpcStats.sortedKeys(snapshot)
+
+	builder.WriteString("# HELP nexserver_grpc_requests_total Number of gRPC requests handled.\n")
+	builder.WriteString("# TYPE nexserver_grpc_requests_total counter\n")
+	for _, key := range keys {
+		builder.WriteString(fmt.Sprintf("nexserver_grpc_requests_total{method=\"%s\",agent=\"%s\"} %d\n",
+			escapeLabelValue(key.Method), escapeLabelValue(key.Agent), snapshot[key].Requests))
+	}
+
+	builder.WriteString("# HELP nexserver_grpc_errors_total Number of gRPC requests that returned an error.\n")
+	builder.WriteString("# TYPE nexserver_grpc_errors_total counter\n")
+	for _, key := range keys {
+		builder.WriteString(fmt.Sprintf("nexserver_grpc_errors_total{method=\"%s\",agent=\"%s\"} %d\n",
+			escapeLabelValue(key.Method), escapeLabelValue(key.Agent), snapshot[key].Errors))
+	}
+
+	builder.WriteString("# HELP nexserver_grpc_duration_seconds Duration of gRPC requests.\n")
+	builder.WriteString("# TYPE nexserver_grpc_duration_seconds histogram\n")
+	for _, key := range keys {
+		stat := snapshot[key]
+		labels := fmt.Sprintf("method=\"%s\",agent=\"%s\"",
+			escapeLabelValue(key.Method), escapeLabelValue(key.Agent))
+
+		for idx, bound := range grpcDurationBuckets {
+			builder.WriteString(fmt.Sprintf("nexserver_grpc_duration_seconds_bucket{%s,le=\"%g\"} %d\n",
+				labels, bound, stat.BucketCounts[idx]))
+		}
+		builder.WriteString(fmt.Sprintf("nexserver_grpc_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n",
+			labels, stat.Requests))
+		builder.WriteString(fmt.Sprintf("nexserver_grpc_duration_seconds_sum{%s} %g\n", labels, stat.DurationSum))
+		builder.WriteString(fmt.Sprintf("nexserver_grpc_duration_seconds_count{%s} %d\n", labels, stat.Requests))
+	}
+}
+
+func (s *NexServer) ApiAdminPrometheus(c *gin.Context) {
+	var builder strings.Builder
+
+	s.writeGrpcPrometheus(&builder)
+	s.writeValidationPrometheus(&builder)
+
+	c.Data(200, "text/plain; version=0.0.4; charset=utf-8", []byte(builder.String()))
+}
+
+func (s *NexServer) ApiAdminGrpcStats(c *gin.Context) {
+	type GrpcStatItem struct {
+		Method          string  `json:"method"`
+		Agent           string  `json:"agent"`
+		Requests        uint64  `json:"requests"`
+		Errors          uint64  `json:"errors"`
+		RequestsPerSec  float64 `json:"requests_per_second"`
+		ErrorRate       float64 `json:"error_rate"`
+		AvgDurationMs   float64 `json:"avg_duration_ms"`
+		MaxDurationMs   float64 `json:"max_duration_ms"`
+		TotalDurationMs float64 `json:"total_duration_ms"`
+	}
+
+	agentFilter := c.DefaultQuery("agent", "")
+	methodFilter := c.DefaultQuery("method", "")
+
+	uptime := time.Since(s.grpcStats.startTs).Seconds()
+	snapshot := s.grpcStats.Snapshot()
+	items := make([]GrpcStatItem, 0, len(snapshot))
+
+	for _, key := range s.grpcStats.sortedKeys(snapshot) {
+		if agentFilter != "" && key.Agent != agentFilter {
+			continue
+		}
+		if methodFilter != "" && !strings.HasSuffix(key.Method, methodFilter) {
+			continue
+		}
+
+		stat := snapshot[key]
+		item := GrpcStatItem{
+			Method:          key.Method,
+			Agent:           key.Agent,
+			Requests:        stat.Requests,
+			Errors:          stat.Errors,
+			MaxDurationMs:   stat.DurationMax * 1000,
+			TotalDurationMs: stat.DurationSum * 1000,
+		}
+		if uptime > 0 {
+			item.RequestsPerSec = float64(stat.Requests) / uptime
+		}
+		if stat.Requests > 0 {
+			item.ErrorRate = float64(stat.Errors) / float64(stat.Requests)
+			item.AvgDurationMs = stat.DurationSum * 1000 / float64(stat.Requests)
+		}
+
+		items = append(items, item)
+	}
+
+	// heaviest agents first, which is what operators look for
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].TotalDurationMs > items[j].TotalDurationMs
+	})
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
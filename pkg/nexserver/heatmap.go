@@ -0,0 +1,165 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"github.com/gin-gonic/gin"
+	"strconv"
+)
+
+const (
+	defaultHeatmapBins = 10
+	maxHeatmapBins     = 100
+)
+
+// heatmapSeries returns the per-entity samples of one metric in each time
+// bucket. Nodes use node-level samples, pods sum their containers.
+func heatmapSeries(target string, truncateQuery *SqlQuery, from, to string, clusterId, metricNameId uint) *SqlQuery {
+	if target == "pods" {
+		return NewSqlQuery(`
+SELECT bucket, k8s_containers.k8s_pod_id as entity, SUM(value) as value
+FROM
+    (SELECT metrics.container_id as container_id, avg(value) as value, `).
+			AppendQuery(truncateQuery).
+			Append(`
+    FROM metrics
+    WHERE ts >= ? AND ts < ?
+      AND metrics.cluster_id=? AND metrics.name_id=?
+    GROUP BY bucket, metrics.container_id, metrics.label_id)
+        as metrics_bucket, containers, k8s_containers
+WHERE
+    metrics_bucket.container_id=containers.id
+    AND containers.container_id=k8s_containers.container_id
+GROUP BY bucket, k8s_containers.k8s_pod_id`, from, to, clusterId, metricNameId)
+	}
+
+	return NewSqlQuery(`
+SELECT `).
+		AppendQuery(truncateQuery).
+		Append(`, metrics.node_id as entity, avg(value) as value
+FROM metrics
+WHERE ts >= ? AND ts < ? AND metrics.cluster_id=?
+  AND metrics.process_id=0 AND metrics.container_id=0
+  AND metrics.name_id=?
+GROUP BY bucket, metrics.node_id`, from, to, clusterId, metricNameId)
+}
+
+func (s *NexServer) ApiMetricsHeatmap(c *gin.Context) {
+	cId, ok := s.idParam(c, "clusterId", false)
+	query := s.ParseQuery(c)
+	if s.mathUnsupported(c, query) {
+		return
+	}
+	if !ok || s.IsValidParams(c.Param("clusterId"), query, true, true) == false || len(query.MetricNames) != 1 {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
+
+	target := c.DefaultQuery("target", "nodes")
+	if target != "nodes" && target != "pods" {
+		s.ApiResponseJson(c, 404, "bad", "invalid target")
+		return
+	}
+
+	bins, err := strconv.Atoi(c.DefaultQuery("bins", strconv.Itoa(defaultHeatmapBins)))
+	if err != nil || bins < 1 || bins > maxHeatmapBins {
+		s.ApiResponseJsonf(c, 404, "bad", "bins must be between 1 and %d", maxHeatmapBins)
+		return
+	}
+
+	metricNameIds := s.findMetricIdByNames(query.MetricNames)
+	if len(metricNameIds) != 1 {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
+
+	truncateQuery := s.calculateGranularity(query.DateRange, query.Timezone, query.Granularity)
+	if truncateQuery == nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
+	series := heatmapSeries(target, truncateQuery, query.DateRange[0], query.DateRange[1], cId, metricNameIds[0])
+
+	// bins span the min/max of the whole range so that columns are comparable
+	heatmapQuery := NewSqlQuery(`
+WITH series AS (`).
+		AppendQuery(series).
+		Append(`),
+bounds AS (SELECT min(value) as lo, max(value) as hi FROM series)
+SELECT bucket, bounds.lo, bounds.hi,
+       CASE WHEN bounds.hi = bounds.lo THEN 1
+            ELSE LEAST(width_bucket(value, bounds.lo, bounds.hi, ?), ?) END as bin,
+       count(*)
+FROM series, bounds
+GROUP BY bucket, bounds.lo, bounds.hi, bin
+ORDER BY bucket, bin`, bins, bins)
+
+	rows, err, queryTime := s.QueryRowsWithTime(heatmapQuery.Raw(s.requestDB(c)))
+	if err != nil {
+		requestLog(c).Errorf("failed to get heatmap data: %v", err)
+		s.ApiResponseJsonf(c, 500, "bad", "unexpected error: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	type HeatmapBucket struct {
+		Bucket string `json:"bucket"`
+		Counts []int  `json:"counts"`
+		Total  int    `json:"total"`
+	}
+	buckets := make([]HeatmapBucket, 0, 64)
+
+	var lo, hi float64
+	for rows.Next() {
+		var bucket string
+		var bin, count int
+
+		if err := rows.Scan(&bucket, &lo, &hi, &bin, &count); err != nil {
+			requestLog(c).Errorf("failed to get record: %v", err)
+			continue
+		}
+
+		if len(buckets) == 0 || buckets[len(buckets)-1].Bucket != bucket {
+			buckets = append(buckets, HeatmapBucket{Bucket: bucket, Counts: make([]int, bins)})
+		}
+
+		current := &buckets[len(buckets)-1]
+		if bin >= 1 && bin <= bins {
+			current.Counts[bin-1] += count
+		}
+		current.Total += count
+	}
+
+	edges := make([]float64, bins+1)
+	for idx := range edges {
+		edges[idx] = lo + (hi-lo)*float64(idx)/float64(bins)
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"metric_name": query.MetricNames[0],
+			"target":      target,
+			"min":         lo,
+			"max":         hi,
+			"bin_edges":   edges,
+			"buckets":     buckets,
+		},
+		"db_query_time": queryTime.String(),
+	})
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"path/filepath"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Messages are looked up by their English text, like gettext, so the code
+// keeps readable strings and a missing translation falls back to English.
+// A catalog is a YAML file named after its locale (ko.yaml, pt-BR.yaml)
+// that maps the English text, or format, to its translation. Formats with
+// several arguments use explicit indexes (%[1]s) so translations can
+// reorder them.
+
+const defaultLocale = "en"
+
+type I18nConfig struct {
+	Dir           string
+	DefaultLocale string
+}
+
+type MessageCatalogs struct {
+	sync.RWMutex
+
+	catalogs map[string]map[string]string
+}
+
+func (s *NexServer) loadCatalogs() error {
+	catalogs := make(map[string]map[string]string)
+
+	if s.config.I18n.Dir != "" {
+		files, err := filepath.Glob(filepath.Join(s.config.I18n.Dir, "*.yaml"))
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			raw, err := ioutil.ReadFile(file)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", file, err)
+			}
+
+			messages := make(map[string]string)
+			if err := yaml.Unmarshal(raw, &messages); err != nil {
+				return fmt.Errorf("failed to parse %s: %v", file, err)
+			}
+
+			locale := strings.TrimSuffix(filepath.Base(file), ".yaml")
+			catalogs[strings.ToLower(locale)] = messages
+			serverLog.Infof("I18n: loaded %d messages for %s\n", len(messages), locale)
+		}
+	}
+
+	s.messages.Lock()
+	s.messages.catalogs = catalogs
+	s.messages.Unlock()
+
+	return nil
+}
+
+func (s *NexServer) defaultLocale() string {
+	if s.config.I18n.DefaultLocale != "" {
+		return s.config.I18n.DefaultLocale
+	}
+
+	return defaultLocale
+}
+
+// matchLocale returns the first of the wanted locales with a catalog,
+// trying the language without its region as well.
+func (s *NexServer) matchLocale(wanted ...string) string {
+	s.messages.RLock()
+	defer s.messages.RUnlock()
+
+	for _, locale := range wanted {
+		locale = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+		if locale == "" {
+			continue
+		}
+		if locale == defaultLocale || strings.HasPrefix(locale, defaultLocale+"-") {
+			return defaultLocale
+		}
+		if _, found := s.messages.catalogs[locale]; found {
+			return locale
+		}
+		if idx := strings.Index(locale, "-"); idx > 0 {
+			if _, found := s.messages.catalogs[locale[:idx]]; found {
+				return locale[:idx]
+			}
+		}
+	}
+
+	return s.defaultLocale()
+}
+
+// acceptLanguages returns the tags of an Accept-Language header by
+// descending quality.
+func acceptLanguages(header string) []string {
+	type tag struct {
+		name    string
+		quality float64
+	}
+
+	tags := make([]tag, 0, 4)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		if fields[0] == "" || fields[0] == "*" {
+			continue
+		}
+
+		quality := 1.0
+		for _, field := range fields[1:] {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "q=") {
+				if value, err := strconv.ParseFloat(field[2:], 64); err == nil {
+					quality = value
+				}
+			}
+		}
+		tags = append(tags, tag{name: fields[0], quality: quality})
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].quality > tags[j].quality })
+
+	names := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		names = append(names, tag.name)
+	}
+
+	return names
+}
+
+// requestLocale prefers the "lang" query parameter over Accept-Language.
+func (s *NexServer) requestLocale(c *gin.Context) string {
+	wanted := make([]string, 0, 4)
+	if lang := c.Query("lang"); lang != "" {
+		wanted = append(wanted, lang)
+	}
+	wanted = append(wanted, acceptLanguages(c.GetHeader("Accept-Language"))...)
+
+	return s.matchLocale(wanted...)
+}
+
+// translate returns the message in the locale, formatted with args if
+// there are any.
+func (s *NexServer) translate(locale, message string, args ...interface{}) string {
+	s.messages.RLock()
+	if translated, found := s.messages.catalogs[locale][message]; found && translated != "" {
+		message = translated
+	}
+	s.messages.RUnlock()
+
+	if len(args) == 0 {
+		return message
+	}
+
+	return fmt.Sprintf(message, args...)
+}
+
+var incidentDescriptions = map[string]string{
+	"agent_disconnected":             "Agent on %[1]s disconnected",
+	"agent_connected":                "Agent on %[1]s reconnected",
+	"agent_degraded":                 "Agent on %[1]s is degraded, some of its collectors are failing",
+	"node_cpu_load_avg_1":            "1-minute load of %[1]s is %.2[2]f, at or above %.2[3]f",
+	"node_disk_free":                 "Free disk of %[1]s is %.2[2]f, below %.2[3]f",
+	"node_memory_free":               "Free memory of %[1]s is %.2[2]f%%, below %.2[3]f%%",
+	"node_auth_failures":             "%.0[2]f failed logins on %[1]s in the last minute, at or above %.0[3]f",
+	"node_zombie_processes":          "%.0[2]f zombie processes on %[1]s, at or above %.0[3]f",
+	"node_uninterruptible_processes": "%.0[2]f processes of %[1]s blocked in uninterruptible sleep, at or above %.0[3]f",
+	"node_deleted_binaries":          "%.0[2]f processes of %[1]s run a deleted binary and need a restart",
+	"node_ephemeral_storage":         "Filesystem of %[1]s is %.0[2]f%% on its way to the eviction threshold, at or above %.0[3]f%%",
+	"pod_ephemeral_storage":          "Ephemeral storage of %[1]s is at %.0[2]f%% of its limit, at or above %.0[3]f%%",
+	"cronjob_not_succeeded":          "CronJob %[1]s has not succeeded for %.0[2]f seconds, at or above %.0[3]f",
+	k8sResourceNotReady:              "%[1]s is not ready",
+	kernelOOMKill:                    "%[1]s was killed by the kernel out of memory, %.0[2]f times",
+	kernelIOError:                    "%.0[2]f kernel I/O errors on %[1]s",
+	kernelHardwareError:              "%.0[2]f hardware errors reported by the kernel of %[1]s",
+}
+
+func (s *NexServer) incidentDescription(locale, eventName, target string, value, condition float64) string {
+	format, found := incidentDescriptions[eventName]
+	if !found {
+		return s.translate(locale, "%[4]s on %[1]s: %.2[2]f (threshold %.2[3]f)",
+			target, value, condition, eventName)
+	}
+
+	return s.translate(locale, format, target, value, condition)
+}
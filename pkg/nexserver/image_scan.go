@@ -0,0 +1,455 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// The images of the containers reported by agents and of the Kubernetes
+// pods are scanned with the Trivy CLI, which either scans locally or, with
+// a server configured, asks a Trivy server (client/server mode) so the
+// vulnerability database is kept in one place. Each job run scans the
+// images never scanned first, then the ones older than the rescan
+// interval, at most imageScanBatch of them. The findings of an image are
+// replaced on every scan.
+
+const (
+	defaultImageScan      = "@every 10m"
+	defaultImageScanHours = 24
+	imageScanBatch        = 5
+	imageScanTimeout      = 10 * time.Minute
+
+	ImageScanCompleted = "completed"
+	ImageScanFailed    = "failed"
+)
+
+var vulnerabilitySeverities = []string{"CRITICAL", "HIGH", "MEDIUM", "LOW", "UNKNOWN"}
+
+type ImageScanConfig struct {
+	Trivy         string
+	Server        string
+	IntervalHours int
+}
+
+type trivyVulnerability struct {
+	VulnerabilityID  string `json:"VulnerabilityID"`
+	PkgName          string `json:"PkgName"`
+	InstalledVersion string `json:"InstalledVersion"`
+	FixedVersion     string `json:"FixedVersion"`
+	Severity         string `json:"Severity"`
+	Title            string `json:"Title"`
+}
+
+type trivyResult struct {
+	Target          string               `json:"Target"`
+	Vulnerabilities []trivyVulnerability `json:"Vulnerabilities"`
+}
+
+// parseTrivyReport reads the JSON report of Trivy, a list of results
+// before 0.20 and an object holding them since.
+func parseTrivyReport(data []byte) ([]trivyResult, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var results []trivyResult
+		err := json.Unmarshal(data, &results)
+		return results, err
+	}
+
+	var report struct {
+		Results []trivyResult `json:"Results"`
+	}
+	err := json.Unmarshal(data, &report)
+
+	return report.Results, err
+}
+
+func (s *NexServer) runTrivy(image string) ([]trivyResult, error) {
+	binary := s.config.ImageScan.Trivy
+	if binary == "" {
+		binary = "trivy"
+	}
+
+	args := []string{"image", "--quiet", "--format", "json", "--no-progress"}
+	if s.config.ImageScan.Server != "" {
+		args = append(args, "--server", s.config.ImageScan.Server)
+	}
+	args = append(args, image)
+
+	ctx, cancel := context.WithTimeout(context.Background(), imageScanTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if len(message) > 512 {
+			message = message[len(message)-512:]
+		}
+		return nil, fmt.Errorf("%v: %s", err, message)
+	}
+
+	results, err := parseTrivyReport(stdout.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("invalid trivy report: %v", err)
+	}
+
+	return results, nil
+}
+
+func (s *NexServer) scanImage(scan *ImageScan) error {
+	results, err := s.runTrivy(scan.Image)
+
+	now := time.Now()
+	scan.ScannedTs = &now
+	if err != nil {
+		scan.Status = ImageScanFailed
+		scan.Error = err.Error()
+		s.db.Save(scan)
+		return err
+	}
+
+	tx := s.db.Begin()
+	if result := tx.Unscoped().Where("image_scan_id=?", scan.ID).Delete(&ImageVulnerability{}); result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+
+	counts := make(map[string]int)
+	for _, target := range results {
+		for _, found := range target.Vulnerabilities {
+			severity := strings.ToUpper(found.Severity)
+			if !stringInSlice(severity, vulnerabilitySeverities) {
+				severity = "UNKNOWN"
+			}
+			counts[severity]++
+
+			title := found.Title
+			if len(title) > 512 {
+				title = title[:509] + "..."
+			}
+
+			vulnerability := ImageVulnerability{
+				VulnerabilityID:  found.VulnerabilityID,
+				PkgName:          found.PkgName,
+				InstalledVersion: found.InstalledVersion,
+				FixedVersion:     found.FixedVersion,
+				Severity:         severity,
+				Title:            title,
+				Target:           target.Target,
+				ImageScanID:      scan.ID,
+			}
+			if result := tx.Create(&vulnerability); result.Error != nil {
+				tx.Rollback()
+				return result.Error
+			}
+		}
+	}
+
+	scan.Status = ImageScanCompleted
+	scan.Error = ""
+	scan.Critical = counts["CRITICAL"]
+	scan.High = counts["HIGH"]
+	scan.Medium = counts["MEDIUM"]
+	scan.Low = counts["LOW"]
+	scan.Unknown = counts["UNKNOWN"]
+	if result := tx.Save(scan); result.Error != nil {
+		tx.Rollback()
+		return result.Error
+	}
+
+	return tx.Commit().Error
+}
+
+// discoverImages records the images in use which are not known yet.
+func (s *NexServer) discoverImages() error {
+	rows, err := s.db.Raw(`
+SELECT DISTINCT image FROM containers WHERE deleted_at IS NULL AND image<>''
+UNION
+SELECT DISTINCT image FROM k8s_containers WHERE deleted_at IS NULL AND image<>''`).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	images := make([]string, 0, 64)
+	for rows.Next() {
+		var image string
+		if err := rows.Scan(&image); err != nil {
+			return err
+		}
+		images = append(images, image)
+	}
+
+	for _, image := range images {
+		var scan ImageScan
+		s.db.Where(ImageScan{Image: image}).FirstOrCreate(&scan)
+	}
+
+	return nil
+}
+
+func (s *NexServer) runImageScans() error {
+	if err := s.discoverImages(); err != nil {
+		return fmt.Errorf("failed to discover images: %v", err)
+	}
+
+	hours := s.config.ImageScan.IntervalHours
+	if hours <= 0 {
+		hours = defaultImageScanHours
+	}
+	staleTs := time.Now().Add(-time.Duration(hours) * time.Hour)
+
+	var scans []ImageScan
+	result := s.db.Where("scanned_ts IS NULL OR scanned_ts < ?", staleTs).
+		Order("scanned_ts NULLS FIRST").Limit(imageScanBatch).Find(&scans)
+	if result.Error != nil {
+		return fmt.Errorf("failed to get images: %v", result.Error)
+	}
+
+	failed := 0
+	for idx := range scans {
+		if err := s.scanImage(&scans[idx]); err != nil {
+			ingestLog.Errorf("ImageScan: %s: %v\n", scans[idx].Image, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to scan %d of %d images", failed, len(scans))
+	}
+
+	return nil
+}
+
+type ImageWorkload struct {
+	ClusterId uint   `json:"cluster_id"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Node      string `json:"node,omitempty"`
+	Container string `json:"container"`
+}
+
+type ImageScanItem struct {
+	Id        uint            `json:"id"`
+	Image     string          `json:"image"`
+	Status    string          `json:"status"`
+	Error     string          `json:"error,omitempty"`
+	Counts    map[string]int  `json:"counts"`
+	ScannedTs *time.Time      `json:"scanned_ts"`
+	Workloads []ImageWorkload `json:"workloads"`
+}
+
+func newImageScanItem(scan *ImageScan) ImageScanItem {
+	return ImageScanItem{
+		Id:     scan.ID,
+		Image:  scan.Image,
+		Status: scan.Status,
+		Error:  scan.Error,
+		Counts: map[string]int{
+			"critical": scan.Critical,
+			"high":     scan.High,
+			"medium":   scan.Medium,
+			"low":      scan.Low,
+			"unknown":  scan.Unknown,
+		},
+		ScannedTs: scan.ScannedTs,
+		Workloads: make([]ImageWorkload, 0),
+	}
+}
+
+// imageWorkloads returns the containers and pods running each image.
+func (s *NexServer) imageWorkloads(c *gin.Context, images []string) (map[string][]ImageWorkload, error) {
+	workloads := make(map[string][]ImageWorkload)
+	if len(images) == 0 {
+		return workloads, nil
+	}
+
+	rows, err := s.requestDB(c).Raw(`
+SELECT containers.image, containers.cluster_id, 'container', '', '', nodes.host, containers.name
+FROM containers
+JOIN nodes ON nodes.id=containers.node_id
+WHERE containers.deleted_at IS NULL AND containers.image IN (?)
+UNION ALL
+SELECT k8s_containers.image, k8s_clusters.agent_cluster_id, 'pod', k8s_namespaces.name, k8s_pods.name, '', k8s_containers.name
+FROM k8s_containers
+JOIN k8s_pods ON k8s_pods.id=k8s_containers.k8s_pod_id
+JOIN k8s_namespaces ON k8s_namespaces.id=k8s_containers.k8s_namespace_id
+JOIN k8s_clusters ON k8s_clusters.id=k8s_containers.k8s_cluster_id
+WHERE k8s_containers.deleted_at IS NULL AND k8s_containers.image IN (?)`, images, images).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var image string
+		var workload ImageWorkload
+		err := rows.Scan(&image, &workload.ClusterId, &workload.Kind, &workload.Namespace,
+			&workload.Pod, &workload.Node, &workload.Container)
+		if err != nil {
+			return nil, err
+		}
+		workloads[image] = append(workloads[image], workload)
+	}
+
+	return workloads, nil
+}
+
+func (s *NexServer) ApiImageScanList(c *gin.Context) {
+	db := s.requestDB(c)
+	if severity := strings.ToLower(c.Query("severity")); severity != "" {
+		switch severity {
+		case "critical":
+			db = db.Where("critical>0")
+		case "high":
+			db = db.Where("critical+high>0")
+		case "medium":
+			db = db.Where("critical+high+medium>0")
+		default:
+			s.ApiResponseJson(c, 400, "bad", "severity must be critical, high or medium")
+			return
+		}
+	}
+
+	var scans []ImageScan
+	if result := db.Order("critical DESC, high DESC, image").Find(&scans); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	images := make([]string, 0, len(scans))
+	for _, scan := range scans {
+		images = append(images, scan.Image)
+	}
+	workloads, err := s.imageWorkloads(c, images)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get workloads: %v", err)
+		return
+	}
+
+	items := make([]ImageScanItem, 0, len(scans))
+	for idx := range scans {
+		item := newImageScanItem(&scans[idx])
+		if found, ok := workloads[item.Image]; ok {
+			item.Workloads = found
+		}
+		items = append(items, item)
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+func (s *NexServer) ApiImageScan(c *gin.Context) {
+	imageId, ok := s.idParam(c, "imageId", false)
+	if !ok {
+		s.ApiResponseJson(c, 400, "bad", "invalid image id")
+		return
+	}
+
+	var scan ImageScan
+	if result := s.requestDB(c).Where("id=?", imageId).First(&scan); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "image not found")
+		return
+	}
+
+	var vulnerabilities []ImageVulnerability
+	result := s.requestDB(c).Where("image_scan_id=?", scan.ID).
+		Order(`CASE severity WHEN 'CRITICAL' THEN 0 WHEN 'HIGH' THEN 1 WHEN 'MEDIUM' THEN 2 WHEN 'LOW' THEN 3 ELSE 4 END, vulnerability_id`).
+		Find(&vulnerabilities)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	workloads, err := s.imageWorkloads(c, []string{scan.Image})
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get workloads: %v", err)
+		return
+	}
+
+	type VulnerabilityItem struct {
+		Id               string `json:"id"`
+		Severity         string `json:"severity"`
+		Package          string `json:"package"`
+		InstalledVersion string `json:"installed_version"`
+		FixedVersion     string `json:"fixed_version"`
+		Title            string `json:"title"`
+		Target           string `json:"target"`
+	}
+
+	items := make([]VulnerabilityItem, 0, len(vulnerabilities))
+	for _, vulnerability := range vulnerabilities {
+		items = append(items, VulnerabilityItem{
+			Id:               vulnerability.VulnerabilityID,
+			Severity:         strings.ToLower(vulnerability.Severity),
+			Package:          vulnerability.PkgName,
+			InstalledVersion: vulnerability.InstalledVersion,
+			FixedVersion:     vulnerability.FixedVersion,
+			Title:            vulnerability.Title,
+			Target:           vulnerability.Target,
+		})
+	}
+
+	item := newImageScanItem(&scan)
+	if found, ok := workloads[scan.Image]; ok {
+		item.Workloads = found
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"image":           item,
+			"vulnerabilities": items,
+		},
+	})
+}
+
+// ApiRescanImage queues the image first for the next scan.
+func (s *NexServer) ApiRescanImage(c *gin.Context) {
+	imageId, ok := s.idParam(c, "imageId", false)
+	if !ok {
+		s.ApiResponseJson(c, 400, "bad", "invalid image id")
+		return
+	}
+
+	result := s.requestDB(c).Model(&ImageScan{}).Where("id=?", imageId).Update("scanned_ts", nil)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to queue scan: %v", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		s.ApiResponseJson(c, 404, "bad", "image not found")
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
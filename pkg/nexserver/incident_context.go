@@ -0,0 +1,319 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm/dialects/postgres"
+	"time"
+)
+
+// Context is collected once, right after an incident is detected, so that
+// it reflects the state of the node at that time.
+
+const (
+	incidentContextWindow = 5 * time.Minute
+	incidentEventWindow   = 15 * time.Minute
+	incidentTopN          = 5
+)
+
+type TimelineEntry struct {
+	Ts     time.Time `json:"ts"`
+	Event  string    `json:"event"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+type ContextUsage struct {
+	Id    uint    `json:"id"`
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+}
+
+type ContextEvent struct {
+	Ts    time.Time `json:"ts"`
+	Name  string    `json:"name"`
+	Value string    `json:"value"`
+	Label string    `json:"label"`
+}
+
+type IncidentContextData struct {
+	CollectedTs   time.Time          `json:"collected_ts"`
+	TopProcesses  []ContextUsage     `json:"top_processes"`
+	TopContainers []ContextUsage     `json:"top_containers"`
+	K8sEvents     []ContextEvent     `json:"k8s_events"`
+	NodeMetrics   map[string]float64 `json:"node_metrics"`
+}
+
+func (s *NexServer) recordIncident(eventName string, item *IncidentItem) {
+	record := IncidentRecord{
+		EventName:   eventName,
+		Severity:    item.Severity,
+		TargetType:  item.TargetType,
+		Target:      item.Target,
+		Value:       item.Value,
+		Condition:   item.Condition,
+		ReportedTs:  item.ReportedTs,
+		DetectedTs:  item.DetectedTs,
+		ClusterID:   item.ClusterId,
+		NodeID:      item.NodeId,
+		ProcessID:   item.ProcessId,
+		ContainerID: item.ContainerId,
+		PodID:       item.PodId,
+		Context:     postgres.Jsonb{RawMessage: json.RawMessage("{}")},
+		Timeline:    postgres.Jsonb{RawMessage: json.RawMessage("[]")},
+	}
+	if result := s.db.Create(&record); result.Error != nil {
+		incidentLog.Errorf("Incident: failed to record incident: %v\n", result.Error)
+		return
+	}
+
+	item.Id = record.ID
+	s.addIncidentTimeline(item.Id, "detected", fmt.Sprintf("%s on %s", eventName, item.Target))
+}
+
+func (s *NexServer) addIncidentTimeline(incidentId uint, event, detail string) {
+	if incidentId == 0 {
+		return
+	}
+
+	entry, _ := json.Marshal([]TimelineEntry{{Ts: time.Now(), Event: event, Detail: detail}})
+	result := s.db.Exec("UPDATE incident_records SET timeline = coalesce(timeline, '[]'::jsonb) || ?::jsonb WHERE id=?",
+		string(entry), incidentId)
+	if result.Error != nil {
+		incidentLog.Errorf("Incident: failed to update timeline of %d: %v\n", incidentId, result.Error)
+	}
+}
+
+func (s *NexServer) topUsage(query string, args ...interface{}) []ContextUsage {
+	items := make([]ContextUsage, 0, incidentTopN)
+
+	rows, err := s.db.Raw(query, args...).Rows()
+	if err != nil {
+		incidentLog.Errorf("Incident: failed to collect context: %v\n", err)
+		return items
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item ContextUsage
+		if err := rows.Scan(&item.Id, &item.Name, &item.Value); err != nil {
+			continue
+		}
+		items = append(items, item)
+	}
+
+	return items
+}
+
+func (s *NexServer) collectIncidentContext(item *IncidentItem) *IncidentContextData {
+	from := item.DetectedTs.Add(-incidentContextWindow)
+	to := item.DetectedTs
+
+	data := &IncidentContextData{
+		CollectedTs: time.Now(),
+		NodeMetrics: make(map[string]float64),
+	}
+
+	data.TopProcesses = s.topUsage(`
+SELECT processes.id, processes.name, ROUND(avg(metrics.value)::numeric, 2)::float
+FROM metrics
+JOIN metric_names ON metrics.name_id=metric_names.id
+JOIN processes ON metrics.process_id=processes.id
+WHERE metric_names.name='process_cpu_percent' AND metrics.cluster_id=? AND metrics.node_id=?
+  AND metrics.ts >= ? AND metrics.ts <= ?
+GROUP BY processes.id, processes.name
+ORDER BY 3 DESC
+LIMIT ?`, item.ClusterId, item.NodeId, from, to, incidentTopN)
+
+	data.TopContainers = s.topUsage(`
+SELECT containers.id, containers.name, ROUND(avg(metrics.value)::numeric, 2)::float
+FROM metrics
+JOIN metric_names ON metrics.name_id=metric_names.id
+JOIN containers ON metrics.container_id=containers.id
+WHERE metric_names.name='container_memory_rss' AND metrics.cluster_id=? AND metrics.node_id=?
+  AND metrics.ts >= ? AND metrics.ts <= ?
+GROUP BY containers.id, containers.name
+ORDER BY 3 DESC
+LIMIT ?`, item.ClusterId, item.NodeId, from, to, incidentTopN)
+
+	data.K8sEvents = make([]ContextEvent, 0, 16)
+	rows, err := s.db.Raw(`
+SELECT k8s_events.ts, metric_names.name, k8s_events.value, metric_labels.label
+FROM k8s_events
+JOIN k8s_clusters ON k8s_events.cluster_id=k8s_clusters.id
+JOIN metric_names ON k8s_events.name_id=metric_names.id
+JOIN metric_labels ON k8s_events.label_id=metric_labels.id
+WHERE k8s_clusters.agent_cluster_id=? AND k8s_events.ts >= ? AND k8s_events.ts <= ?
+ORDER BY k8s_events.ts DESC
+LIMIT 20`, item.ClusterId, item.DetectedTs.Add(-incidentEventWindow), to).Rows()
+	if err == nil {
+		for rows.Next() {
+			var event ContextEvent
+			if err := rows.Scan(&event.Ts, &event.Name, &event.Value, &event.Label); err != nil {
+				continue
+			}
+			data.K8sEvents = append(data.K8sEvents, event)
+		}
+		rows.Close()
+	}
+
+	rows, err = s.db.Raw(`
+SELECT metric_names.name, avg(metrics.value)
+FROM metrics
+JOIN metric_names ON metrics.name_id=metric_names.id
+WHERE metrics.cluster_id=? AND metrics.node_id=? AND metrics.process_id=0 AND metrics.container_id=0
+  AND metrics.ts >= ? AND metrics.ts <= ?
+GROUP BY metric_names.name`, item.ClusterId, item.NodeId, from, to).Rows()
+	if err == nil {
+		for rows.Next() {
+			var name string
+			var value float64
+			if err := rows.Scan(&name, &value); err != nil {
+				continue
+			}
+			data.NodeMetrics[name] = value
+		}
+		rows.Close()
+	}
+
+	return data
+}
+
+func (s *NexServer) attachIncidentContext(item *IncidentItem) {
+	if item.Id == 0 {
+		return
+	}
+
+	data := s.collectIncidentContext(item)
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+
+	result := s.db.Model(&IncidentRecord{}).Where("id=?", item.Id).
+		Update("context", postgres.Jsonb{RawMessage: raw})
+	if result.Error != nil {
+		incidentLog.Errorf("Incident: failed to save context of %d: %v\n", item.Id, result.Error)
+		return
+	}
+
+	s.addIncidentTimeline(item.Id, "context_collected",
+		fmt.Sprintf("%d processes, %d containers, %d k8s events",
+			len(data.TopProcesses), len(data.TopContainers), len(data.K8sEvents)))
+}
+
+type IncidentRecordItem struct {
+	Id          uint      `json:"id"`
+	EventName   string    `json:"event_name"`
+	Severity    string    `json:"severity"`
+	TargetType  string    `json:"target_type"`
+	Target      string    `json:"target"`
+	Value       float64   `json:"value"`
+	Condition   float64   `json:"condition"`
+	ReportedTs  time.Time `json:"reported_ts"`
+	DetectedTs  time.Time `json:"detected_ts"`
+	ClusterId   uint      `json:"cluster_id"`
+	NodeId      uint      `json:"node_id"`
+	ProcessId   uint      `json:"process_id"`
+	ContainerId uint      `json:"container_id"`
+	PodId       uint      `json:"pod_id"`
+	Description string    `json:"description,omitempty"`
+}
+
+func newIncidentRecordItem(record *IncidentRecord) IncidentRecordItem {
+	return IncidentRecordItem{
+		Id:          record.ID,
+		EventName:   record.EventName,
+		Severity:    record.Severity,
+		TargetType:  record.TargetType,
+		Target:      record.Target,
+		Value:       record.Value,
+		Condition:   record.Condition,
+		ReportedTs:  record.ReportedTs,
+		DetectedTs:  record.DetectedTs,
+		ClusterId:   record.ClusterID,
+		NodeId:      record.NodeID,
+		ProcessId:   record.ProcessID,
+		ContainerId: record.ContainerID,
+		PodId:       record.PodID,
+	}
+}
+
+// incidentRecordItem describes the incident in the locale.
+func (s *NexServer) incidentRecordItem(record *IncidentRecord, locale string) IncidentRecordItem {
+	item := newIncidentRecordItem(record)
+	item.Description = s.incidentDescription(locale, record.EventName, record.Target, record.Value, record.Condition)
+
+	return item
+}
+
+// ApiIncidentRoute serves /incidents/basic next to the recorded incidents,
+// the router not taking a static route beside the id wildcard.
+func (s *NexServer) ApiIncidentRoute(c *gin.Context) {
+	if c.Param("incidentId") == "basic" {
+		s.ApiIncidentBasic(c)
+		return
+	}
+
+	s.ApiIncident(c)
+}
+
+func (s *NexServer) ApiIncident(c *gin.Context) {
+	incidentId, ok := s.idParam(c, "incidentId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid incident id")
+		return
+	}
+
+	var record IncidentRecord
+	if result := s.requestDB(c).Where("id=?", incidentId).First(&record); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid incident id")
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    s.incidentRecordItem(&record, s.requestLocale(c)),
+	})
+}
+
+func (s *NexServer) ApiIncidentContext(c *gin.Context) {
+	incidentId, ok := s.idParam(c, "incidentId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid incident id")
+		return
+	}
+
+	var record IncidentRecord
+	if result := s.requestDB(c).Where("id=?", incidentId).First(&record); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid incident id")
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"incident": s.incidentRecordItem(&record, s.requestLocale(c)),
+			"context":  record.Context.RawMessage,
+			"timeline": record.Timeline.RawMessage,
+		},
+	})
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultPostmortemWindow = 30 * time.Minute
+
+type SeriesPoint struct {
+	Ts    time.Time `json:"ts"`
+	Value float64   `json:"value"`
+}
+
+type Annotation struct {
+	Ts     time.Time `json:"ts"`
+	Kind   string    `json:"kind"`
+	Metric string    `json:"metric"`
+	Detail string    `json:"detail"`
+}
+
+type Postmortem struct {
+	Incident    IncidentRecordItem       `json:"incident"`
+	WindowFrom  time.Time                `json:"window_from"`
+	WindowTo    time.Time                `json:"window_to"`
+	Context     *IncidentContextData     `json:"context"`
+	Timeline    []TimelineEntry          `json:"timeline"`
+	Series      map[string][]SeriesPoint `json:"series"`
+	Annotations []Annotation             `json:"annotations"`
+	ExportedTs  time.Time                `json:"exported_ts"`
+}
+
+func (s *NexServer) postmortemSeries(record *IncidentRecord, from, to time.Time) map[string][]SeriesPoint {
+	series := make(map[string][]SeriesPoint)
+
+	rows, err := s.db.Raw(`
+SELECT metric_names.name, DATE_TRUNC('minute', metrics.ts) as bucket, avg(metrics.value)
+FROM metrics
+JOIN metric_names ON metrics.name_id=metric_names.id
+WHERE metrics.cluster_id=? AND metrics.node_id=? AND metrics.process_id=? AND metrics.container_id=?
+  AND metrics.ts >= ? AND metrics.ts < ?
+GROUP BY metric_names.name, bucket
+ORDER BY metric_names.name, bucket`,
+		record.ClusterID, record.NodeID, record.ProcessID, record.ContainerID, from, to).Rows()
+	if err != nil {
+		incidentLog.Errorf("Incident: failed to get series: %v\n", err)
+		return series
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var point SeriesPoint
+		if err := rows.Scan(&name, &point.Ts, &point.Value); err != nil {
+			continue
+		}
+		series[name] = append(series[name], point)
+	}
+
+	return series
+}
+
+func (s *NexServer) postmortemAnnotations(record *IncidentRecord, from, to time.Time) []Annotation {
+	annotations := make([]Annotation, 0, 16)
+
+	rows, err := s.db.Raw(`
+SELECT change_points.ts, metric_names.name, change_points.before, change_points.after
+FROM change_points
+JOIN metric_names ON change_points.name_id=metric_names.id
+WHERE change_points.cluster_id=? AND change_points.node_id=? AND change_points.ts >= ? AND change_points.ts < ?`,
+		record.ClusterID, record.NodeID, from, to).Rows()
+	if err == nil {
+		for rows.Next() {
+			var annotation Annotation
+			var before, after float64
+			if err := rows.Scan(&annotation.Ts, &annotation.Metric, &before, &after); err != nil {
+				continue
+			}
+			annotation.Kind = "change_point"
+			annotation.Detail = fmt.Sprintf("level shift %.2f -> %.2f", before, after)
+			annotations = append(annotations, annotation)
+		}
+		rows.Close()
+	}
+
+	rows, err = s.db.Raw(`
+SELECT counter_resets.ts, metric_names.name, counter_resets.previous_value, counter_resets.value
+FROM counter_resets
+JOIN metric_names ON counter_resets.name_id=metric_names.id
+WHERE counter_resets.cluster_id=? AND counter_resets.node_id=? AND counter_resets.ts >= ? AND counter_resets.ts < ?`,
+		record.ClusterID, record.NodeID, from, to).Rows()
+	if err == nil {
+		for rows.Next() {
+			var annotation Annotation
+			var previous, value float64
+			if err := rows.Scan(&annotation.Ts, &annotation.Metric, &previous, &value); err != nil {
+				continue
+			}
+			annotation.Kind = "counter_reset"
+			annotation.Detail = fmt.Sprintf("counter reset %.0f -> %.0f", previous, value)
+			annotations = append(annotations, annotation)
+		}
+		rows.Close()
+	}
+
+	sort.Slice(annotations, func(i, j int) bool {
+		return annotations[i].Ts.Before(annotations[j].Ts)
+	})
+
+	return annotations
+}
+
+func (s *NexServer) buildPostmortem(record *IncidentRecord, locale string, before, after time.Duration) *Postmortem {
+	postmortem := &Postmortem{
+		Incident:   s.incidentRecordItem(record, locale),
+		WindowFrom: record.DetectedTs.Add(-before),
+		WindowTo:   record.DetectedTs.Add(after),
+		Timeline:   make([]TimelineEntry, 0),
+		ExportedTs: time.Now(),
+	}
+
+	_ = json.Unmarshal(record.Timeline.RawMessage, &postmortem.Timeline)
+	// extend the window to cover the whole incident if it was cleared later
+	for _, entry := range postmortem.Timeline {
+		if entry.Event == "cleared" && entry.Ts.After(postmortem.WindowTo) {
+			postmortem.WindowTo = entry.Ts.Add(after)
+		}
+	}
+
+	var context IncidentContextData
+	if err := json.Unmarshal(record.Context.RawMessage, &context); err == nil && !context.CollectedTs.IsZero() {
+		postmortem.Context = &context
+	}
+
+	postmortem.Series = s.postmortemSeries(record, postmortem.WindowFrom, postmortem.WindowTo)
+	postmortem.Annotations = s.postmortemAnnotations(record, postmortem.WindowFrom, postmortem.WindowTo)
+
+	return postmortem
+}
+
+func (p *Postmortem) Markdown() string {
+	var builder strings.Builder
+	incident := p.Incident
+
+	builder.WriteString(fmt.Sprintf("# Incident %d: %s on %s\n\n", incident.Id, incident.EventName, incident.Target))
+	if incident.Description != "" {
+		builder.WriteString(incident.Description + "\n\n")
+	}
+	builder.WriteString("| Field | Value |\n|---|---|\n")
+	builder.WriteString(fmt.Sprintf("| Severity | %s |\n", incident.Severity))
+	builder.WriteString(fmt.Sprintf("| Target | %s %s |\n", incident.TargetType, incident.Target))
+	builder.WriteString(fmt.Sprintf("| Value | %.2f (condition %.2f) |\n", incident.Value, incident.Condition))
+	builder.WriteString(fmt.Sprintf("| Detected | %s |\n", incident.DetectedTs.Format(time.RFC3339)))
+	builder.WriteString(fmt.Sprintf("| Window | %s - %s |\n\n",
+		p.WindowFrom.Format(time.RFC3339), p.WindowTo.Format(time.RFC3339)))
+
+	builder.WriteString("## Timeline\n\n")
+	events := make([]Annotation, 0, len(p.Timeline)+len(p.Annotations))
+	for _, entry := range p.Timeline {
+		events = append(events, Annotation{Ts: entry.Ts, Kind: entry.Event, Detail: entry.Detail})
+	}
+	events = append(events, p.Annotations...)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Ts.Before(events[j].Ts)
+	})
+	for _, event := range events {
+		line := fmt.Sprintf("- %s **%s**", event.Ts.Format(time.RFC3339), event.Kind)
+		if event.Metric != "" {
+			line += " " + event.Metric
+		}
+		if event.Detail != "" {
+			line += ": " + event.Detail
+		}
+		builder.WriteString(line + "\n")
+	}
+	builder.WriteString("\n")
+
+	if p.Context != nil {
+		builder.WriteString("## Context at detection\n\n")
+		builder.WriteString("### Top processes (cpu %)\n\n")
+		for _, usage := range p.Context.TopProcesses {
+			builder.WriteString(fmt.Sprintf("- %s: %.2f\n", usage.Name, usage.Value))
+		}
+		builder.WriteString("\n### Top containers (memory rss)\n\n")
+		for _, usage := range p.Context.TopContainers {
+			builder.WriteString(fmt.Sprintf("- %s: %.0f\n", usage.Name, usage.Value))
+		}
+		if len(p.Context.K8sEvents) > 0 {
+			builder.WriteString("\n### Kubernetes events\n\n")
+			for _, event := range p.Context.K8sEvents {
+				builder.WriteString(fmt.Sprintf("- %s %s: %s\n", event.Ts.Format(time.RFC3339), event.Name, event.Value))
+			}
+		}
+		builder.WriteString("\n")
+	}
+
+	if len(p.Series) > 0 {
+		builder.WriteString("## Metrics in window\n\n")
+		builder.WriteString("| Metric | Min | Avg | Max |\n|---|---|---|---|\n")
+
+		names := make([]string, 0, len(p.Series))
+		for name := range p.Series {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			points := p.Series[name]
+			min, max, sum := math.Inf(1), math.Inf(-1), 0.0
+			for _, point := range points {
+				min = math.Min(min, point.Value)
+				max = math.Max(max, point.Value)
+				sum += point.Value
+			}
+			builder.WriteString(fmt.Sprintf("| %s | %.2f | %.2f | %.2f |\n",
+				name, min, sum/float64(len(points)), max))
+		}
+	}
+
+	return builder.String()
+}
+
+func (s *NexServer) ApiIncidentExport(c *gin.Context) {
+	incidentId, ok := s.idParam(c, "incidentId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid incident id")
+		return
+	}
+
+	var record IncidentRecord
+	if result := s.requestDB(c).Where("id=?", incidentId).First(&record); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid incident id")
+		return
+	}
+
+	before, err := time.ParseDuration(c.DefaultQuery("before", defaultPostmortemWindow.String()))
+	if err != nil || before < 0 {
+		s.ApiResponseJson(c, 404, "bad", "invalid before duration")
+		return
+	}
+	after, err := time.ParseDuration(c.DefaultQuery("after", defaultPostmortemWindow.String()))
+	if err != nil || after < 0 {
+		s.ApiResponseJson(c, 404, "bad", "invalid after duration")
+		return
+	}
+
+	postmortem := s.buildPostmortem(&record, s.requestLocale(c), before, after)
+
+	switch c.DefaultQuery("format", "json") {
+	case "markdown":
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"incident-%d.md\"", record.ID))
+		c.Data(200, "text/markdown; charset=utf-8", []byte(postmortem.Markdown()))
+	case "json":
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"incident-%d.json\"", record.ID))
+		c.JSON(200, postmortem)
+	default:
+		s.ApiResponseJson(c, 404, "bad", "format must be json or markdown")
+	}
+}
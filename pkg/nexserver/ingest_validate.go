@@ -0,0 +1,309 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"math"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Teams writing an exporter can check their series before pointing
+// Prometheus at /api/v1/write. The series are given as JSON with the labels
+// and samples of the remote_write protocol and go through the same rules as
+// the ingest: the shape, the naming rules, the value bounds, the new series
+// they would add to the cluster and its series budget. Nothing is written,
+// neither the metrics nor their clusters, nodes, names or labels.
+
+const (
+	validateMaxSeries     = 10000
+	validateMaxLabelSize  = 256
+	validateMaxFutureSkew = 10 * time.Minute
+)
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+type IngestQuotaConfig struct {
+	MaxSeries int
+}
+
+type validateSample struct {
+	Value     float64 `json:"value"`
+	Timestamp int64   `json:"timestamp"`
+}
+
+type validateSeries struct {
+	Labels  map[string]string `json:"labels"`
+	Samples []validateSample  `json:"samples"`
+}
+
+type validateRequest struct {
+	Cluster string           `json:"cluster"`
+	Series  []validateSeries `json:"series"`
+}
+
+type validateIssue struct {
+	Series  int    `json:"series"`
+	Metric  string `json:"metric"`
+	Message string `json:"message"`
+}
+
+type validateMetricCardinality struct {
+	MetricName     string `json:"metric_name"`
+	NewSeries      int    `json:"new_series"`
+	ExistingSeries int    `json:"existing_series"`
+}
+
+type validateResult struct {
+	errors   []validateIssue
+	warnings []validateIssue
+}
+
+func (r *validateResult) errorf(series int, metric, format string, args ...interface{}) {
+	r.errors = append(r.errors, validateIssue{series, metric, fmt.Sprintf(format, args...)})
+}
+
+func (r *validateResult) warnf(series int, metric, format string, args ...interface{}) {
+	r.warnings = append(r.warnings, validateIssue{series, metric, fmt.Sprintf(format, args...)})
+}
+
+// knownSeries returns the name/host/label keys of the series of the names
+// stored for the cluster within the last day.
+func (s *NexServer) knownSeries(c *gin.Context, clusterId uint, names []string) (map[string]bool, error) {
+	known := make(map[string]bool)
+	if clusterId == 0 || len(names) == 0 {
+		return known, nil
+	}
+
+	start, end := s.seriesTimeRange(nil)
+	rows, err := s.requestDB(c).Table("metrics").
+		Select("DISTINCT metric_names.name, nodes.host, metric_labels.label").
+		Joins("JOIN metric_names ON metrics.name_id=metric_names.id").
+		Joins("JOIN metric_labels ON metrics.label_id=metric_labels.id").
+		Joins("JOIN nodes ON metrics.node_id=nodes.id").
+		Where("metrics.cluster_id=? AND metrics.ts >= ? AND metrics.ts < ?", clusterId, start, end).
+		Where("metric_names.name IN (?)", names).
+		Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, host, label string
+		if err := rows.Scan(&name, &host, &label); err != nil {
+			continue
+		}
+		known[name+"|"+host+"|"+label] = true
+	}
+
+	return known, nil
+}
+
+// clusterSeriesCount returns the number of series of the cluster within
+// the last day.
+func (s *NexServer) clusterSeriesCount(c *gin.Context, clusterId uint) (int, error) {
+	if clusterId == 0 {
+		return 0, nil
+	}
+
+	start, end := s.seriesTimeRange(nil)
+	var count int
+	err := s.requestDB(c).Table("metrics").
+		Select("COUNT(DISTINCT (metrics.name_id, metrics.label_id, metrics.node_id, "+
+			"metrics.process_id, metrics.container_id))").
+		Where("metrics.cluster_id=? AND metrics.ts >= ? AND metrics.ts < ?", clusterId, start, end).
+		Row().Scan(&count)
+
+	return count, err
+}
+
+func (s *NexServer) ApiValidateCustomMetrics(c *gin.Context) {
+	var req validateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+	if len(req.Series) > validateMaxSeries {
+		s.ApiResponseJsonf(c, 413, "bad", "too many series, at most %d are validated at once", validateMaxSeries)
+		return
+	}
+	if req.Cluster == "" {
+		req.Cluster = remoteWriteDefaultCluster
+	}
+
+	result := &validateResult{
+		errors:   make([]validateIssue, 0),
+		warnings: make([]validateIssue, 0),
+	}
+
+	var cluster Cluster
+	clusterFound := s.requestDB(c).Unscoped().Where("name=?", req.Cluster).First(&cluster).Error == nil
+	if clusterFound && s.isClusterDeleted(&cluster) {
+		result.errorf(-1, "", "cluster %s is deleted, its series are skipped", req.Cluster)
+	}
+	if !clusterFound {
+		result.warnf(-1, "", "cluster %s does not exist and would be created", req.Cluster)
+	}
+
+	now := time.Now()
+	sampleCount := 0
+	acceptedCount := 0
+	payloadSeries := make(map[string]string)
+
+	for idx, reqSeries := range req.Series {
+		labels := make([]*promLabel, 0, len(reqSeries.Labels))
+		for name, value := range reqSeries.Labels {
+			labels = append(labels, &promLabel{Name: name, Value: value})
+		}
+		series := newRemoteWriteSeries(labels, req.Cluster)
+		if series.Cluster != req.Cluster {
+			result.errorf(idx, series.Name, "cluster label %s differs from %s, validate one cluster at a time",
+				series.Cluster, req.Cluster)
+			continue
+		}
+		sampleCount += len(reqSeries.Samples)
+
+		if series.Name == "" {
+			result.errorf(idx, "", "missing __name__ label")
+			continue
+		}
+		if series.Host == "" {
+			result.errorf(idx, series.Name, "missing instance label, the series would be skipped")
+			continue
+		}
+		invalidLabel := false
+		for name := range reqSeries.Labels {
+			if !labelNameRegexp.MatchString(name) {
+				result.errorf(idx, series.Name, "label name %q contains invalid characters", name)
+				invalidLabel = true
+			}
+		}
+		if invalidLabel {
+			continue
+		}
+		if len(series.Label) > validateMaxLabelSize {
+			result.errorf(idx, series.Name, "labels are longer than %d characters", validateMaxLabelSize)
+			continue
+		}
+
+		name, err := s.resolveMetricName(series.Name, remoteWriteEndpoint, cluster.ID)
+		if err != nil {
+			result.errorf(idx, series.Name, "%v", err)
+			continue
+		}
+		if name != series.Name {
+			result.warnf(idx, series.Name, "stored as %s", name)
+		}
+		if len(reqSeries.Samples) == 0 {
+			result.warnf(idx, name, "no samples")
+		}
+
+		for _, sample := range reqSeries.Samples {
+			if math.IsNaN(sample.Value) {
+				result.warnf(idx, name, "NaN samples are staleness markers and are not stored")
+				continue
+			}
+			if sample.Timestamp <= 0 {
+				result.errorf(idx, name, "invalid timestamp %d, expected milliseconds since the epoch", sample.Timestamp)
+				continue
+			}
+			if ts := time.Unix(0, sample.Timestamp*int64(time.Millisecond)); ts.Sub(now) > validateMaxFutureSkew {
+				result.warnf(idx, name, "timestamp %s is in the future", ts.UTC().Format(time.RFC3339))
+			}
+			if err := s.valueValidator.check(name, sample.Value); err != nil {
+				if s.valueValidator.config.Action == ValidationActionReject || math.IsInf(sample.Value, 0) {
+					result.errorf(idx, name, "rejected: %v", err)
+					continue
+				}
+				result.warnf(idx, name, "flagged: %v", err)
+			}
+			acceptedCount += 1
+		}
+
+		payloadSeries[name+"|"+series.Host+"|"+series.Label] = name
+	}
+
+	names := make([]string, 0)
+	byMetric := make(map[string]*validateMetricCardinality)
+	for _, name := range payloadSeries {
+		if _, found := byMetric[name]; !found {
+			byMetric[name] = &validateMetricCardinality{MetricName: name}
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	known, err := s.knownSeries(c, cluster.ID, names)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+
+	newSeries := 0
+	for key, name := range payloadSeries {
+		if known[key] {
+			byMetric[name].ExistingSeries += 1
+			continue
+		}
+		byMetric[name].NewSeries += 1
+		newSeries += 1
+	}
+	cardinality := make([]validateMetricCardinality, 0, len(names))
+	for _, name := range names {
+		cardinality = append(cardinality, *byMetric[name])
+	}
+
+	quota := gin.H{"max_series": s.config.IngestQuota.MaxSeries}
+	if maxSeries := s.config.IngestQuota.MaxSeries; maxSeries > 0 {
+		current, err := s.clusterSeriesCount(c, cluster.ID)
+		if err != nil {
+			s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+			return
+		}
+		quota["current_series"] = current
+		quota["projected_series"] = current + newSeries
+		quota["exceeded"] = current+newSeries > maxSeries
+		if current+newSeries > maxSeries {
+			result.errorf(-1, "", "%d new series exceed the series budget of the cluster, %d of %d used",
+				newSeries, current, maxSeries)
+		}
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"valid":            len(result.errors) == 0,
+			"cluster":          req.Cluster,
+			"series":           len(req.Series),
+			"samples":          sampleCount,
+			"accepted_samples": acceptedCount,
+			"errors":           result.errors,
+			"warnings":         result.warnings,
+			"cardinality": gin.H{
+				"new_series":      newSeries,
+				"existing_series": len(payloadSeries) - newSeries,
+				"metrics":         cardinality,
+			},
+			"quota": quota,
+		},
+	})
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"github.com/gin-gonic/gin"
+	"sort"
+	"time"
+)
+
+// The agent leading a Kubernetes cluster reports its CronJobs as metrics
+// labeled namespace=...,cronjob=...; the snapshot lists the latest of
+// them per CronJob, with the Jobs it ran over the window.
+
+const (
+	cronJobWindow       = 24 * time.Hour
+	cronJobSinceSuccess = "k8s_cronjob_since_success_seconds"
+	cronJobActive       = "k8s_cronjob_active"
+	cronJobSuspended    = "k8s_cronjob_suspended"
+	jobSucceeded        = "k8s_job_succeeded"
+	jobFailed           = "k8s_job_failed"
+	jobDuration         = "k8s_job_duration_seconds"
+)
+
+type CronJobItem struct {
+	Namespace     string     `json:"namespace"`
+	Name          string     `json:"name"`
+	LastSuccessTs *time.Time `json:"last_success_ts"`
+	Active        int        `json:"active"`
+	Suspended     bool       `json:"suspended"`
+	Succeeded     int        `json:"succeeded"`
+	Failed        int        `json:"failed"`
+	AvgDuration   *float64   `json:"avg_duration_seconds"`
+	Overdue       bool       `json:"overdue"`
+	Ts            time.Time  `json:"ts"`
+}
+
+func (s *NexServer) ApiSnapshotCronJobs(c *gin.Context) {
+	clusterId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	since := time.Now().Add(-cronJobWindow)
+	query := NewSqlQuery(`
+(SELECT DISTINCT ON (metrics.name_id, metrics.label_id)
+        metric_names.name, metric_labels.label, metrics.value, metrics.ts
+ FROM metrics
+ JOIN metric_names ON metric_names.id=metrics.name_id
+ JOIN metric_labels ON metric_labels.id=metrics.label_id
+ WHERE metrics.cluster_id=? AND metrics.ts >= ? AND metric_names.name IN (?)
+ ORDER BY metrics.name_id, metrics.label_id, metrics.ts DESC)`,
+		clusterId, since, []string{cronJobSinceSuccess, cronJobActive, cronJobSuspended})
+	query.Append(`
+UNION ALL
+SELECT metric_names.name, metric_labels.label,
+       CASE WHEN metric_names.name=? THEN avg(metrics.value) ELSE sum(metrics.value) END, max(metrics.ts)
+FROM metrics
+JOIN metric_names ON metric_names.id=metrics.name_id
+JOIN metric_labels ON metric_labels.id=metrics.label_id
+WHERE metrics.cluster_id=? AND metrics.ts >= ? AND metric_names.name IN (?)
+GROUP BY metric_names.name, metric_labels.label`,
+		jobDuration, clusterId, since, []string{jobSucceeded, jobFailed, jobDuration})
+
+	rows, err, queryTime := s.QueryRowsWithTime(query.Raw(s.requestDB(c)))
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	condition := s.config.BasicRule.CronJobSuccessHours * 3600
+	cronJobs := make(map[string]*CronJobItem)
+	for rows.Next() {
+		var name, label string
+		var value float64
+		var ts time.Time
+		if err := rows.Scan(&name, &label, &value, &ts); err != nil {
+			continue
+		}
+
+		cronJob := labelValue(label, "cronjob")
+		if cronJob == "" {
+			continue
+		}
+		item, found := cronJobs[label]
+		if !found {
+			item = &CronJobItem{Namespace: labelValue(label, "namespace"), Name: cronJob}
+			cronJobs[label] = item
+		}
+
+		switch name {
+		case cronJobSinceSuccess:
+			item.Ts = ts
+			lastSuccess := ts.Add(-time.Duration(value) * time.Second)
+			item.LastSuccessTs = &lastSuccess
+			item.Overdue = condition > 0 && value >= condition
+		case cronJobActive:
+			item.Active = int(value)
+		case cronJobSuspended:
+			item.Suspended = value > 0
+		case jobSucceeded:
+			item.Succeeded = int(value)
+		case jobFailed:
+			item.Failed = int(value)
+		case jobDuration:
+			average := value
+			item.AvgDuration = &average
+		}
+	}
+
+	items := make([]*CronJobItem, 0, len(cronJobs))
+	for _, item := range cronJobs {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Namespace != items[j].Namespace {
+			return items[i].Namespace < items[j].Namespace
+		}
+		return items[i].Name < items[j].Name
+	})
+
+	c.JSON(200, gin.H{
+		"status":        "ok",
+		"message":       "",
+		"data":          items,
+		"db_query_time": queryTime.String(),
+	})
+}
@@ -0,0 +1,247 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/json"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// The agent leading a cluster reports the instances of the custom
+// resources it is configured to watch, each kind as a complete list. An
+// instance missing from the list of its kind is gone. An instance is not
+// ready when one of its Ready, Available or Healthy conditions is False,
+// which raises an incident until it recovers or is deleted.
+
+const k8sResourceNotReady = "k8s_resource_not_ready"
+
+var readyConditionTypes = map[string]bool{
+	"Ready":     true,
+	"Available": true,
+	"Healthy":   true,
+}
+
+type k8sResourceCondition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason"`
+	Message            string `json:"message"`
+	LastTransitionTime string `json:"last_transition_time"`
+}
+
+type k8sResourceInstance struct {
+	Namespace  string                 `json:"namespace"`
+	Name       string                 `json:"name"`
+	Phase      string                 `json:"phase"`
+	Conditions []k8sResourceCondition `json:"conditions"`
+}
+
+type k8sResourceReport struct {
+	Group     string                `json:"group"`
+	Version   string                `json:"version"`
+	Kind      string                `json:"kind"`
+	Instances []k8sResourceInstance `json:"instances"`
+}
+
+func resourceReady(conditions []k8sResourceCondition) bool {
+	for _, condition := range conditions {
+		if readyConditionTypes[condition.Type] && condition.Status == "False" {
+			return false
+		}
+	}
+
+	return true
+}
+
+func resourceTarget(resource *K8sResource) string {
+	if resource.Namespace == "" {
+		return fmt.Sprintf("%s %s", resource.Kind, resource.Name)
+	}
+
+	return fmt.Sprintf("%s %s/%s", resource.Kind, resource.Namespace, resource.Name)
+}
+
+func (s *NexServer) updateResourceIncident(resource *K8sResource) {
+	item := &IncidentItem{
+		ClusterId:  resource.ClusterID,
+		TargetType: "RESOURCE",
+		Target:     resourceTarget(resource),
+		EventName:  k8sResourceNotReady,
+		ReportedTs: resource.LastSeenTs,
+		DetectedTs: time.Now(),
+	}
+
+	if resource.Present && !resource.Ready {
+		item.Value = 1
+		if !s.IsExistIncident(k8sResourceNotReady, item) {
+			s.AddIncident(k8sResourceNotReady, item)
+		}
+		return
+	}
+	if s.IsExistIncident(k8sResourceNotReady, item) {
+		s.ClearIncident(k8sResourceNotReady, item)
+	}
+}
+
+func (s *NexServer) saveK8sResources(agent *Agent, in *pb.CommandResult) (*pb.Response, error) {
+	node := s.findNodeByAgent(agent)
+	if node == nil {
+		return nil, status.Error(codes.NotFound, "unknown node")
+	}
+
+	var reports []k8sResourceReport
+	if err := json.Unmarshal(in.Data, &reports); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid resources")
+	}
+
+	now := time.Now()
+	for _, report := range reports {
+		var resources []K8sResource
+		result := s.db.Where("cluster_id=? AND \"group\"=? AND kind=?", node.ClusterID, report.Group, report.Kind).
+			Find(&resources)
+		if result.Error != nil {
+			return nil, status.Error(codes.Internal, "failed to get resources")
+		}
+
+		known := make(map[string]*K8sResource)
+		for idx := range resources {
+			known[resources[idx].Namespace+"/"+resources[idx].Name] = &resources[idx]
+		}
+
+		seen := make(map[string]bool)
+		for _, instance := range report.Instances {
+			key := instance.Namespace + "/" + instance.Name
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			resource, found := known[key]
+			if !found || !resource.Present {
+				if !found {
+					resource = &K8sResource{
+						Group:     report.Group,
+						Kind:      report.Kind,
+						Namespace: instance.Namespace,
+						Name:      instance.Name,
+						ClusterID: node.ClusterID,
+					}
+				}
+				resource.FirstSeenTs = now
+			}
+
+			conditions, err := json.Marshal(instance.Conditions)
+			if err != nil {
+				continue
+			}
+			resource.Version = report.Version
+			resource.Phase = instance.Phase
+			resource.Conditions = string(conditions)
+			resource.Ready = resourceReady(instance.Conditions)
+			resource.Present = true
+			resource.LastSeenTs = now
+
+			if result := s.db.Save(resource); result.Error != nil {
+				ingestLog.Errorf("K8sResources: failed to save %s: %v\n", resourceTarget(resource), result.Error)
+				continue
+			}
+			s.updateResourceIncident(resource)
+		}
+
+		for idx := range resources {
+			resource := &resources[idx]
+			if !resource.Present || seen[resource.Namespace+"/"+resource.Name] {
+				continue
+			}
+
+			resource.Present = false
+			s.db.Model(resource).Update("present", false)
+			s.updateResourceIncident(resource)
+		}
+	}
+
+	return s.response(true, 0, ""), nil
+}
+
+type K8sResourceItem struct {
+	Group       string                 `json:"group"`
+	Version     string                 `json:"version"`
+	Kind        string                 `json:"kind"`
+	Namespace   string                 `json:"namespace"`
+	Name        string                 `json:"name"`
+	Phase       string                 `json:"phase"`
+	Conditions  []k8sResourceCondition `json:"conditions"`
+	Ready       bool                   `json:"ready"`
+	Present     bool                   `json:"present"`
+	FirstSeenTs time.Time              `json:"first_seen_ts"`
+	LastSeenTs  time.Time              `json:"last_seen_ts"`
+}
+
+func (s *NexServer) ApiSnapshotK8sResources(c *gin.Context) {
+	clusterId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	db := s.requestDB(c).Where("cluster_id=?", clusterId)
+	if kind := c.Query("kind"); kind != "" {
+		db = db.Where("kind=?", kind)
+	}
+	if namespace := c.Query("namespace"); namespace != "" {
+		db = db.Where("namespace=?", namespace)
+	}
+	if c.Query("all") != "true" {
+		db = db.Where("present=?", true)
+	}
+
+	var resources []K8sResource
+	if result := db.Order("kind, namespace, name").Find(&resources); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	items := make([]K8sResourceItem, 0, len(resources))
+	for _, resource := range resources {
+		item := K8sResourceItem{
+			Group:       resource.Group,
+			Version:     resource.Version,
+			Kind:        resource.Kind,
+			Namespace:   resource.Namespace,
+			Name:        resource.Name,
+			Phase:       resource.Phase,
+			Conditions:  make([]k8sResourceCondition, 0),
+			Ready:       resource.Ready,
+			Present:     resource.Present,
+			FirstSeenTs: resource.FirstSeenTs,
+			LastSeenTs:  resource.LastSeenTs,
+		}
+		_ = json.Unmarshal([]byte(resource.Conditions), &item.Conditions)
+		items = append(items, item)
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
@@ -0,0 +1,283 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/json"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strings"
+	"time"
+)
+
+// Agents report the OOM kills, I/O errors and hardware faults of the
+// kernel log as they happen. Each one is kept in the events table, the
+// whole event as JSON in its value, and opens an incident on the node,
+// on the killed container when the agent could tell it from the cgroup.
+// Kernel messages have no recovery counterpart, so an incident is
+// cleared once its target stayed quiet for kernelIncidentQuiet.
+
+const (
+	kernelEventEndpoint = "/node/kernel"
+	kernelIncidentQuiet = 30 * time.Minute
+	defaultKernelSweep  = "@every 5m"
+
+	kernelOOMKill       = "kernel_oom_kill"
+	kernelIOError       = "kernel_io_error"
+	kernelHardwareError = "kernel_hardware_error"
+)
+
+var kernelEventNames = map[string]string{
+	"oom_kill":       kernelOOMKill,
+	"io_error":       kernelIOError,
+	"hardware_error": kernelHardwareError,
+}
+
+type kernelEventReport struct {
+	Kind      string `json:"kind"`
+	Message   string `json:"message"`
+	Process   string `json:"process,omitempty"`
+	Pid       int    `json:"pid,omitempty"`
+	Container string `json:"container,omitempty"`
+	Device    string `json:"device,omitempty"`
+	Ts        int64  `json:"ts"`
+}
+
+// findEventContainer resolves the container id of an OOM kill to the
+// container of the node and the Kubernetes pod running it.
+func (s *NexServer) findEventContainer(node *Node, containerId string) (*Container, uint) {
+	if containerId == "" {
+		return nil, 0
+	}
+
+	var container Container
+	result := s.db.Where("node_id=? AND container_id<>'' AND ? LIKE container_id || '%'",
+		node.ID, containerId).First(&container)
+	if result.Error != nil {
+		return nil, 0
+	}
+
+	var k8sContainer K8sContainer
+	result = s.db.Where("container_id LIKE ?", "%"+containerId).First(&k8sContainer)
+	if result.Error != nil {
+		return &container, 0
+	}
+
+	return &container, k8sContainer.K8sPodID
+}
+
+func (s *NexServer) raiseKernelIncident(eventName string, item *IncidentItem) {
+	for _, it := range s.incidentMap[eventName] {
+		if s.IsSameIncident(it, item) {
+			// repeated faults keep the incident open
+			it.ReportedTs = item.ReportedTs
+			it.Value++
+			return
+		}
+	}
+
+	item.Value = 1
+	s.AddIncident(eventName, item)
+}
+
+func (s *NexServer) saveKernelEvents(agent *Agent, in *pb.CommandResult) (*pb.Response, error) {
+	node := s.findNodeByAgent(agent)
+	if node == nil {
+		return nil, status.Error(codes.NotFound, "unknown node")
+	}
+
+	var reports []kernelEventReport
+	if err := json.Unmarshal(in.Data, &reports); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid kernel events")
+	}
+
+	endpoint := s.getMetricEndpoint(kernelEventEndpoint)
+	eventType := s.getMetricType("event")
+
+	for _, report := range reports {
+		eventName, found := kernelEventNames[report.Kind]
+		if !found {
+			continue
+		}
+
+		labels := []string{"host=" + node.Host}
+		if report.Process != "" {
+			labels = append(labels, "process="+report.Process)
+		}
+		if report.Device != "" {
+			labels = append(labels, "device="+report.Device)
+		}
+
+		value, err := json.Marshal(report)
+		if err != nil {
+			continue
+		}
+
+		ts := time.Unix(report.Ts, 0)
+		event := Event{
+			Ts:         ts,
+			Value:      string(value),
+			EndpointID: endpoint.ID,
+			TypeID:     eventType.ID,
+			NameID:     s.getMetricName(eventName, eventType).ID,
+			LabelID:    s.getMetricLabel(strings.Join(labels, ",")).ID,
+			ClusterID:  node.ClusterID,
+			AgentID:    agent.ID,
+			NodeID:     node.ID,
+		}
+
+		item := &IncidentItem{
+			ClusterId:  node.ClusterID,
+			NodeId:     node.ID,
+			TargetType: "NODE",
+			Target:     node.Host,
+			EventName:  eventName,
+			ReportedTs: ts,
+			DetectedTs: time.Now(),
+		}
+		switch eventName {
+		case kernelOOMKill:
+			item.TargetType = "PROCESS"
+			item.Target = fmt.Sprintf("%s on %s", report.Process, node.Host)
+			if container, podId := s.findEventContainer(node, report.Container); container != nil {
+				event.ContainerID = container.ID
+				event.PodID = podId
+				item.TargetType = "CONTAINER"
+				item.Target = container.Name
+				item.ContainerId = container.ID
+				item.PodId = podId
+			}
+		case kernelIOError:
+			item.TargetType = "DEVICE"
+			item.Target = fmt.Sprintf("%s on %s", report.Device, node.Host)
+		}
+
+		if result := s.db.Create(&event); result.Error != nil {
+			ingestLog.Errorf("KernelEvents: failed to save event of %s: %v\n", node.Host, result.Error)
+			continue
+		}
+		s.raiseKernelIncident(eventName, item)
+	}
+
+	return s.response(true, 0, ""), nil
+}
+
+// clearKernelIncidents clears the kernel incidents of quiet targets.
+func (s *NexServer) clearKernelIncidents() error {
+	for _, eventName := range kernelEventNames {
+		expired := make([]*IncidentItem, 0)
+		for _, it := range s.incidentMap[eventName] {
+			if time.Since(it.ReportedTs) > kernelIncidentQuiet {
+				expired = append(expired, it)
+			}
+		}
+
+		for _, it := range expired {
+			s.ClearIncident(eventName, it)
+		}
+	}
+
+	return nil
+}
+
+func (s *NexServer) ApiKernelEventList(c *gin.Context) {
+	clusterId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	page, err := s.parsePage(c)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	names := make([]string, 0, len(kernelEventNames))
+	if kind := c.Query("kind"); kind != "" {
+		eventName, found := kernelEventNames[kind]
+		if !found {
+			s.ApiResponseJson(c, 400, "bad", "kind must be oom_kill, io_error or hardware_error")
+			return
+		}
+		names = append(names, eventName)
+	} else {
+		for _, eventName := range kernelEventNames {
+			names = append(names, eventName)
+		}
+	}
+
+	nodeId := c.DefaultQuery("nodeId", "")
+
+	query, total, err := s.pagedRaw(c, NewSqlQuery(`
+SELECT events.ts, events.value, events.node_id, nodes.host, events.container_id, events.pod_id
+FROM events
+JOIN metric_names ON metric_names.id=events.name_id
+JOIN nodes ON nodes.id=events.node_id
+WHERE events.cluster_id=? AND metric_names.name IN (?)`, clusterId, names).
+		AppendIf(nodeId != "", " AND events.node_id=?", nodeId).
+		Append(" ORDER BY events.ts DESC"), page)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+
+	rows, err, queryTime := s.QueryRowsWithTime(query)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	type KernelEventItem struct {
+		Ts          time.Time `json:"ts"`
+		Kind        string    `json:"kind"`
+		Message     string    `json:"message"`
+		Process     string    `json:"process,omitempty"`
+		Pid         int       `json:"pid,omitempty"`
+		Device      string    `json:"device,omitempty"`
+		NodeId      uint      `json:"node_id"`
+		Node        string    `json:"node"`
+		ContainerId uint      `json:"container_id,omitempty"`
+		PodId       uint      `json:"pod_id,omitempty"`
+	}
+
+	items := make([]KernelEventItem, 0, 16)
+	for rows.Next() {
+		var item KernelEventItem
+		var value string
+		if err := rows.Scan(&item.Ts, &value, &item.NodeId, &item.Node, &item.ContainerId, &item.PodId); err != nil {
+			continue
+		}
+
+		var report kernelEventReport
+		if err := json.Unmarshal([]byte(value), &report); err != nil {
+			continue
+		}
+		item.Kind = report.Kind
+		item.Message = report.Message
+		item.Process = report.Process
+		item.Pid = report.Pid
+		item.Device = report.Device
+		items = append(items, item)
+	}
+
+	s.pageResponse(c, items, page, len(items), total, gin.H{"db_query_time": queryTime.String()})
+}
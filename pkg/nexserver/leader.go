@@ -0,0 +1,192 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jinzhu/gorm"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Periodic jobs working on the shared database run on one replica only.
+// Each job is guarded by a Postgres session advisory lock taken on a
+// dedicated connection: the replica holding the lock runs the job, the
+// others skip their ticks and take over once the connection of the
+// leader is gone. Rule checking and webhook delivery are not elected,
+// they work on the data ingested by each replica.
+
+const (
+	JobGarbageCollector = "gc"
+	JobClusterPurger    = "cluster_purger"
+	JobDigestNotifier   = "digest_notifier"
+	JobRolloutMonitor   = "rollout_monitor"
+	JobCMDBExporter     = "cmdb_exporter"
+	JobBundle           = "bundle"
+	JobChangePoint      = "changepoint"
+	JobCostBudget       = "cost_budget"
+	JobRuleEvaluator    = "rule_evaluator"
+	JobSynthetics       = "synthetics"
+	JobRetention        = "retention"
+	JobPortInventory    = "port_inventory"
+	JobImageScan        = "image_scan"
+	JobKernelIncidents  = "kernel_incidents"
+	JobMeshProbe        = "mesh_probe"
+)
+
+type LeaderJob struct {
+	Leader    bool       `json:"leader"`
+	LeaderTs  *time.Time `json:"leader_ts"`
+	LastRunTs *time.Time `json:"last_run_ts"`
+	Skipped   uint64     `json:"skipped"`
+}
+
+type LeaderElection struct {
+	sync.Mutex
+
+	conn *sql.Conn
+	jobs map[string]*LeaderJob
+}
+
+func leaderLockKey(job string) int64 {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte("nexclipper/" + job))
+
+	return int64(hash.Sum64())
+}
+
+// leaderConn returns the connection holding the advisory locks. A broken
+// connection has lost its locks, so leadership of every job is dropped.
+func (s *NexServer) leaderConn(ctx context.Context) (*sql.Conn, error) {
+	if s.leader.conn != nil {
+		if err := s.leader.conn.PingContext(ctx); err == nil {
+			return s.leader.conn, nil
+		}
+
+		clusterLog.Warnf("Leader: lock connection lost")
+		_ = s.leader.conn.Close()
+		s.leader.conn = nil
+
+		for _, job := range s.leader.jobs {
+			job.Leader = false
+			job.LeaderTs = nil
+		}
+	}
+
+	conn, err := s.db.DB().Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s.leader.conn = conn
+
+	return conn, nil
+}
+
+// isJobLeader is called on every tick of a job and tells whether this
+// replica runs it.
+func (s *NexServer) isJobLeader(name string) bool {
+	s.leader.Lock()
+	defer s.leader.Unlock()
+
+	if s.leader.jobs == nil {
+		s.leader.jobs = make(map[string]*LeaderJob)
+	}
+	job, found := s.leader.jobs[name]
+	if !found {
+		job = &LeaderJob{}
+		s.leader.jobs[name] = job
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := s.leaderConn(ctx)
+	if err != nil {
+		clusterLog.Errorf("Leader: failed to get lock connection: %v\n", err)
+		job.Skipped++
+		return false
+	}
+
+	if !job.Leader {
+		var acquired bool
+
+		err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", leaderLockKey(name)).Scan(&acquired)
+		if err != nil {
+			clusterLog.Errorf("Leader: failed to lock %s: %v\n", name, err)
+		}
+		if !acquired {
+			job.Skipped++
+			return false
+		}
+
+		now := time.Now()
+		job.Leader = true
+		job.LeaderTs = &now
+		clusterLog.Infof("Leader: %s runs %s\n", s.instanceName(), name)
+	}
+
+	now := time.Now()
+	job.LastRunTs = &now
+
+	return true
+}
+
+func (s *NexServer) leaderJob(name string) LeaderJob {
+	s.leader.Lock()
+	defer s.leader.Unlock()
+
+	if job, found := s.leader.jobs[name]; found {
+		return *job
+	}
+
+	return LeaderJob{}
+}
+
+// JobLockHolder is the database session of the replica holding a job lock.
+type JobLockHolder struct {
+	Pid     int    `json:"pid"`
+	Address string `json:"address"`
+}
+
+func (s *NexServer) jobLockHolders(db *gorm.DB) map[int64]JobLockHolder {
+	holders := make(map[int64]JobLockHolder)
+
+	rows, err := db.Raw(`
+SELECT (pg_locks.classid::bigint << 32) | pg_locks.objid::bigint, pg_locks.pid,
+       coalesce(host(pg_stat_activity.client_addr), '')
+FROM pg_locks
+JOIN pg_stat_activity ON pg_locks.pid=pg_stat_activity.pid
+WHERE pg_locks.locktype='advisory' AND pg_locks.objsubid=1 AND pg_locks.granted`).Rows()
+	if err != nil {
+		clusterLog.Errorf("Leader: failed to get lock holders: %v\n", err)
+		return holders
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key int64
+		var holder JobLockHolder
+		if err := rows.Scan(&key, &holder.Pid, &holder.Address); err != nil {
+			continue
+		}
+		holders[key] = holder
+	}
+
+	return holders
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"github.com/NexClipper/NexClipper/pkg/nexlog"
+	"github.com/gin-gonic/gin"
+)
+
+// The loggers of the components of the server. The api logger carries the
+// request id on the lines of a request, see requestLog.
+
+type LogConfig struct {
+	// Level is debug, info, warn or error
+	Level string
+	// Format is console or json
+	Format string
+}
+
+var (
+	apiLog       = nexlog.Named("api")
+	accessLog    = nexlog.Named("access")
+	ingestLog    = nexlog.Named("ingest")
+	incidentLog  = nexlog.Named("incident")
+	clusterLog   = nexlog.Named("cluster")
+	schedulerLog = nexlog.Named("scheduler")
+	serverLog    = nexlog.Named("server")
+)
+
+// InitLogging applies the log configuration, the recent lines are kept for
+// the diagnostics.
+func (s *NexServer) InitLogging() error {
+	if err := nexlog.Init(AppName, s.config.Log.Format, s.config.Log.Level); err != nil {
+		return err
+	}
+	nexlog.AddOutput(s.logBuffer)
+
+	return nil
+}
+
+func (s *NexServer) ApiAdminLogLevel(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    gin.H{"level": nexlog.Level()},
+	})
+}
+
+// ApiAdminSetLogLevel changes the level of every logger until the restart.
+func (s *NexServer) ApiAdminSetLogLevel(c *gin.Context) {
+	type LogLevelRequest struct {
+		Level string `json:"level" binding:"required"`
+	}
+	var req LogLevelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+	if err := nexlog.SetLevel(req.Level); err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+	requestLog(c).Infof("Log: level set to %s", nexlog.Level())
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    gin.H{"level": nexlog.Level()},
+	})
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/json"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/gin-gonic/gin"
+	"sort"
+	"strings"
+	"time"
+)
+
+// With the mesh probe enabled, every agent of a cluster is asked to
+// measure the round trip time and the bandwidth to a few peer nodes,
+// reaching the mesh listener the agents open with mesh_probe.enable. The
+// peers rotate on every run, so a large cluster is covered over several
+// runs without every node probing every other one. The results are node
+// metrics labeled with the peer; the mesh matrix of the topology API is
+// built from the latest of them.
+
+const (
+	defaultMeshProbe  = "@every 5m"
+	meshMatrixWindow  = 30 * time.Minute
+	defaultMeshPeers  = 3
+	defaultMeshPort   = 18004
+	meshLatencyMetric = "node_mesh_latency_ms"
+	meshBandwidth     = "node_mesh_bandwidth_mbps"
+	meshReachable     = "node_mesh_reachable"
+)
+
+type MeshProbeConfig struct {
+	Peers int
+	Port  int
+}
+
+type meshPeer struct {
+	Host    string `json:"host"`
+	Address string `json:"address"`
+}
+
+type meshMember struct {
+	agent *Agent
+	node  *Node
+}
+
+// meshPeers returns the peers of the member at idx for a run: the next
+// members after an offset advancing by peers on every run.
+func meshPeers(members []meshMember, idx, peers, round int) []meshMember {
+	others := len(members) - 1
+	if peers > others {
+		peers = others
+	}
+	if peers <= 0 {
+		return nil
+	}
+
+	offset := (round * peers) % others
+	selected := make([]meshMember, 0, peers)
+	for k := 0; k < peers; k++ {
+		selected = append(selected, members[(idx+1+(offset+k)%others)%len(members)])
+	}
+
+	return selected
+}
+
+func (s *NexServer) dispatchMeshProbes() error {
+	s.RLock()
+	agents := make([]*Agent, 0, len(s.agentMap))
+	for _, agent := range s.agentMap {
+		agents = append(agents, agent)
+	}
+	s.RUnlock()
+
+	clusters := make(map[uint][]meshMember)
+	for _, agent := range agents {
+		node := s.findNodeByAgent(agent)
+		if node == nil {
+			continue
+		}
+		if node.Ipv4 == "" {
+			node.Ipv4 = agent.Ipv4
+		}
+		clusters[node.ClusterID] = append(clusters[node.ClusterID], meshMember{agent: agent, node: node})
+	}
+
+	peers := s.config.MeshProbe.Peers
+	if peers <= 0 {
+		peers = defaultMeshPeers
+	}
+	port := s.config.MeshProbe.Port
+	if port <= 0 {
+		port = defaultMeshPort
+	}
+
+	for _, members := range clusters {
+		sort.Slice(members, func(i, j int) bool {
+			return members[i].node.ID < members[j].node.ID
+		})
+
+		for idx, member := range members {
+			targets := make([]meshPeer, 0, peers)
+			for _, peer := range meshPeers(members, idx, peers, s.meshRound) {
+				if peer.node.Ipv4 == "" {
+					continue
+				}
+				targets = append(targets, meshPeer{
+					Host:    peer.node.Host,
+					Address: fmt.Sprintf("%s:%d", peer.node.Ipv4, port),
+				})
+			}
+			if len(targets) == 0 {
+				continue
+			}
+
+			data, err := json.Marshal(targets)
+			if err != nil {
+				continue
+			}
+			if err := s.commands.send(member.agent.Uuid, newAgentCommand("mesh_probe", string(data))); err != nil {
+				ingestLog.Warnf("Mesh: %v\n", err)
+			}
+		}
+	}
+	s.meshRound++
+
+	return nil
+}
+
+func (s *NexServer) checkMeshProbeResult(agent *Agent, in *pb.CommandResult) (*pb.Response, error) {
+	if !in.Success {
+		ingestLog.Errorf("Mesh: probe of agent %s failed: %s\n", agent.Uuid, in.Error)
+	}
+
+	return s.response(true, 0, ""), nil
+}
+
+// labelValue returns the value of key in a "key=value,..." label.
+func labelValue(label, key string) string {
+	for _, pair := range strings.Split(label, ",") {
+		if strings.HasPrefix(pair, key+"=") {
+			return strings.TrimPrefix(pair, key+"=")
+		}
+	}
+
+	return ""
+}
+
+func (s *NexServer) ApiMeshMatrix(c *gin.Context) {
+	clusterId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	query := NewSqlQuery(`
+SELECT DISTINCT ON (metrics.node_id, metrics.name_id, metrics.label_id)
+       nodes.host, metric_names.name, metric_labels.label, metrics.value, metrics.ts
+FROM metrics
+JOIN nodes ON nodes.id=metrics.node_id
+JOIN metric_names ON metric_names.id=metrics.name_id
+JOIN metric_labels ON metric_labels.id=metrics.label_id
+WHERE metrics.cluster_id=? AND metrics.ts >= ? AND metric_names.name IN (?)
+ORDER BY metrics.node_id, metrics.name_id, metrics.label_id, metrics.ts DESC`,
+		clusterId, time.Now().Add(-meshMatrixWindow), []string{meshLatencyMetric, meshBandwidth, meshReachable})
+
+	rows, err, queryTime := s.QueryRowsWithTime(query.Raw(s.requestDB(c)))
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	type MeshLink struct {
+		Source        string    `json:"source"`
+		Target        string    `json:"target"`
+		LatencyMs     *float64  `json:"latency_ms"`
+		BandwidthMbps *float64  `json:"bandwidth_mbps"`
+		Reachable     bool      `json:"reachable"`
+		Ts            time.Time `json:"ts"`
+	}
+
+	links := make(map[string]*MeshLink)
+	hosts := make(map[string]bool)
+	for rows.Next() {
+		var host, name, label string
+		var value float64
+		var ts time.Time
+		if err := rows.Scan(&host, &name, &label, &value, &ts); err != nil {
+			continue
+		}
+
+		peer := labelValue(label, "peer")
+		if peer == "" {
+			continue
+		}
+		hosts[host] = true
+		hosts[peer] = true
+
+		key := host + "\x00" + peer
+		link, found := links[key]
+		if !found {
+			link = &MeshLink{Source: host, Target: peer}
+			links[key] = link
+		}
+		if ts.After(link.Ts) {
+			link.Ts = ts
+		}
+
+		measured := value
+		switch name {
+		case meshLatencyMetric:
+			link.LatencyMs = &measured
+		case meshBandwidth:
+			link.BandwidthMbps = &measured
+		case meshReachable:
+			link.Reachable = value > 0
+		}
+	}
+
+	items := make([]*MeshLink, 0, len(links))
+	for _, link := range links {
+		items = append(items, link)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Source != items[j].Source {
+			return items[i].Source < items[j].Source
+		}
+		return items[i].Target < items[j].Target
+	})
+
+	nodes := make([]string, 0, len(hosts))
+	for host := range hosts {
+		nodes = append(nodes, host)
+	}
+	sort.Strings(nodes)
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"nodes": nodes,
+			"links": items,
+		},
+		"db_query_time": queryTime.String(),
+	})
+}
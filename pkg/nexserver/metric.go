@@ -36,10 +36,20 @@ func (s *NexServer) addMetrics(in *pb.Metrics, clusterId uint, nodeId uint, sour
 	skippedCount := 0
 
 	for _, reportMetric := range in.Metrics {
+		name, err := s.normalizeMetricName(reportMetric.Name, reportMetric.Endpoint, clusterId)
+		if err != nil {
+			skippedCount += 1
+			continue
+		}
+		if !s.valueValidator.Accept(name, reportMetric.Value) {
+			skippedCount += 1
+			continue
+		}
+
 		sourceType = reportMetric.SourceType
 		metricEndpoint = s.getMetricEndpoint(reportMetric.Endpoint)
 		metricType = s.getMetricType(reportMetric.Type)
-		metricName = s.getMetricName(reportMetric.Name, metricType)
+		metricName = s.getMetricName(name, metricType)
 		metricLabel = s.getMetricLabel(reportMetric.Label)
 
 		switch sourceType {
@@ -88,9 +98,11 @@ func (s *NexServer) addMetrics(in *pb.Metrics, clusterId uint, nodeId uint, sour
 		metric.Ts = time.Unix(reportMetric.Ts, 0)
 		metric.Value = reportMetric.Value
 
-		s.db.Create(&metric)
+		s.saveMetric(metric)
 		savedCount += 1
 
+		s.checkCounterReset(&metric, metricType)
+
 		s.metricChannel <- metric
 	}
 
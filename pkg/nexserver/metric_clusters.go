@@ -0,0 +1,208 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"strings"
+)
+
+const maxMetricClusters = 100
+
+// parseClusterIds accepts a comma separated list of cluster ids or "all"
+// for every enabled cluster.
+func (s *NexServer) parseClusterIds(c *gin.Context, value string) ([]uint, error) {
+	if value == "all" {
+		var clusters []Cluster
+		if result := s.requestDB(c).Where("disabled=?", false).Order("id").Find(&clusters); result.Error != nil {
+			return nil, result.Error
+		}
+
+		ids := make([]uint, 0, len(clusters))
+		for _, cluster := range clusters {
+			ids = append(ids, cluster.ID)
+		}
+
+		return ids, nil
+	}
+
+	ids := make([]uint, 0, 8)
+	for _, part := range strings.Split(value, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(part), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster id: %s", part)
+		}
+		ids = append(ids, uint(id))
+	}
+
+	return ids, nil
+}
+
+func multiClusterMetricQuery(target string, truncateQuery *SqlQuery, from, to string,
+	clusterIds, metricNameIds []uint) *SqlQuery {
+	if target == "summary" {
+		return NewSqlQuery(`
+SELECT metrics_bucket.cluster_id, clusters.name, 0, '', ROUND(value, 2), bucket,
+       metric_names.name, '' FROM
+    (SELECT metrics.cluster_id as cluster_id, avg(value) as value, metrics.name_id, `).
+			AppendQuery(truncateQuery).
+			Append(`
+    FROM metrics
+    WHERE ts >= ? AND ts < ? AND metrics.cluster_id IN (?)
+      AND metrics.process_id=0
+      AND metrics.container_id=0 AND metrics.name_id IN (?)
+    GROUP BY bucket, metrics.cluster_id, metrics.name_id)
+        as metrics_bucket, clusters, metric_names
+WHERE
+    metrics_bucket.cluster_id=clusters.id AND
+    metrics_bucket.name_id=metric_names.id
+ORDER BY metrics_bucket.cluster_id, bucket`, from, to, clusterIds, metricNameIds)
+	}
+
+	return NewSqlQuery(`
+SELECT metrics_bucket.cluster_id, clusters.name, nodes.id, nodes.host, ROUND(value, 2), bucket,
+       metric_names.name, metric_labels.label FROM
+    (SELECT metrics.cluster_id as cluster_id, metrics.node_id as node_id, avg(value) as value,
+            metrics.name_id, metrics.label_id, `).
+		AppendQuery(truncateQuery).
+		Append(`
+    FROM metrics
+    WHERE ts >= ? AND ts < ? AND metrics.cluster_id IN (?)
+      AND metrics.process_id=0
+      AND metrics.container_id=0 AND metrics.name_id IN (?)
+    GROUP BY bucket, metrics.cluster_id, metrics.node_id, metrics.name_id, metrics.label_id)
+        as metrics_bucket, clusters, nodes, metric_names, metric_labels
+WHERE
+    metrics_bucket.cluster_id=clusters.id AND
+    metrics_bucket.node_id=nodes.id AND
+    metrics_bucket.name_id=metric_names.id AND
+    metrics_bucket.label_id=metric_labels.id
+ORDER BY metrics_bucket.cluster_id, bucket`, from, to, clusterIds, metricNameIds)
+}
+
+// ApiMetricsMultiCluster returns node metrics, or per-cluster averages with
+// target=summary, of several clusters grouped by cluster.
+func (s *NexServer) ApiMetricsMultiCluster(c *gin.Context) {
+	clusterIdsParam := s.RemoveSpecialChar(c.DefaultQuery("clusterIds", ""))
+	query := s.ParseQuery(c)
+	if s.mathUnsupported(c, query) {
+		return
+	}
+	if s.IsValidParams(clusterIdsParam, query, true, true) == false {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
+
+	target := c.DefaultQuery("target", "nodes")
+	if target != "nodes" && target != "summary" {
+		s.ApiResponseJson(c, 404, "bad", "invalid target")
+		return
+	}
+
+	clusterIds, err := s.parseClusterIds(c, clusterIdsParam)
+	if err != nil {
+		s.ApiResponseJson(c, 404, "bad", err.Error())
+		return
+	}
+	if len(clusterIds) > maxMetricClusters {
+		s.ApiResponseJsonf(c, 404, "bad", "at most %d clusters are allowed", maxMetricClusters)
+		return
+	}
+
+	type MetricItem struct {
+		Node        string  `json:"node,omitempty"`
+		NodeId      uint    `json:"node_id,omitempty"`
+		Value       float64 `json:"value"`
+		Bucket      string  `json:"bucket"`
+		MetricName  string  `json:"metric_name"`
+		MetricLabel string  `json:"metric_label,omitempty"`
+	}
+	type ClusterMetrics struct {
+		ClusterId uint         `json:"cluster_id"`
+		Cluster   string       `json:"cluster"`
+		Metrics   []MetricItem `json:"metrics"`
+	}
+	results := make([]*ClusterMetrics, 0, len(clusterIds))
+
+	if len(clusterIds) == 0 {
+		c.JSON(200, gin.H{
+			"status":  "ok",
+			"message": "",
+			"data":    results,
+			"count":   0,
+		})
+		return
+	}
+
+	metricNameIds := s.findMetricIdByNames(query.MetricNames)
+	if len(query.MetricNames) != len(metricNameIds) {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
+
+	truncateQuery := s.calculateGranularity(query.DateRange, query.Timezone, query.Granularity)
+	if truncateQuery == nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
+	metricQuery := multiClusterMetricQuery(target, truncateQuery, query.DateRange[0], query.DateRange[1],
+		clusterIds, metricNameIds)
+
+	rows, err, queryTime := s.QueryRowsWithTime(metricQuery.Raw(s.requestDB(c)))
+	if err != nil {
+		requestLog(c).Errorf("failed to get metric data: %v", err)
+		s.ApiResponseJsonf(c, 500, "bad", "unexpected error: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	clusters := make(map[uint]*ClusterMetrics)
+	count := 0
+
+	for rows.Next() {
+		var clusterId uint
+		var clusterName string
+		var item MetricItem
+
+		err := rows.Scan(&clusterId, &clusterName, &item.NodeId, &item.Node, &item.Value, &item.Bucket,
+			&item.MetricName, &item.MetricLabel)
+		if err != nil {
+			requestLog(c).Errorf("failed to get record: %v", err)
+			continue
+		}
+
+		cluster, found := clusters[clusterId]
+		if !found {
+			cluster = &ClusterMetrics{ClusterId: clusterId, Cluster: clusterName, Metrics: make([]MetricItem, 0, 16)}
+			clusters[clusterId] = cluster
+			results = append(results, cluster)
+		}
+
+		cluster.Metrics = append(cluster.Metrics, item)
+		count += 1
+	}
+
+	c.JSON(200, gin.H{
+		"status":        "ok",
+		"message":       "",
+		"data":          results,
+		"count":         count,
+		"db_query_time": queryTime.String(),
+	})
+}
@@ -106,6 +106,10 @@ func (s *NexServer) addK8sNodes(nodes []*pb.K8SObject, k8sCluster *K8sCluster) e
 			}
 
 			klog.Infof("Add new K8S node: %v @ %v\n", newNode.Name, k8sCluster.Name)
+			s.emitEvent(EventK8sNodeAdded, k8sCluster.AgentClusterID, map[string]interface{}{
+				"k8s_cluster_id": k8sCluster.ID,
+				"name":           newNode.Name,
+			})
 		}
 	}
 
@@ -475,6 +479,10 @@ func (s *NexServer) addNamespaces(namespaces []*pb.K8SNamespace, k8sCluster *K8s
 			}
 
 			klog.Infof("Add new K8S namespace: %v @ %v\n", k8sNS.Name, k8sCluster.Name)
+			s.emitEvent(EventK8sNamespaceAdded, k8sCluster.AgentClusterID, map[string]interface{}{
+				"k8s_cluster_id": k8sCluster.ID,
+				"name":           k8sNS.Name,
+			})
 		}
 
 		if err = s.addWorkloads(namespace.Workloads, k8sNS, k8sCluster); err != nil {
@@ -502,6 +510,11 @@ func (s *NexServer) addK8sMetrics(in *pb.K8SMetrics, clusterId uint) (int, int)
 
 	for _, k8sNodeMetric := range in.K8SNodeMetrics {
 		for _, reportMetric := range k8sNodeMetric.Metrics {
+			if !s.valueValidator.Accept(reportMetric.Name, reportMetric.Value) {
+				skippedCount += 1
+				continue
+			}
+
 			k8sNode := s.getK8sNode(k8sNodeMetric.NodeName, clusterId)
 			if k8sNode == nil {
 				skippedCount += 1
@@ -555,6 +568,11 @@ func (s *NexServer) addK8sMetrics(in *pb.K8SMetrics, clusterId uint) (int, int)
 			k8sMetric.K8sNodeID = 0
 
 			for _, reportMetric := range k8sContainerMetric.Metrics {
+				if !s.valueValidator.Accept(reportMetric.Name, reportMetric.Value) {
+					skippedCount += 1
+					continue
+				}
+
 				metricEndpoint = s.getMetricEndpoint(reportMetric.Endpoint)
 				metricType = s.getMetricType(reportMetric.Type)
 				metricName = s.getMetricName(reportMetric.Name, metricType)
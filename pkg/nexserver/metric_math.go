@@ -0,0 +1,118 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"github.com/gin-gonic/gin"
+	"regexp"
+)
+
+// A query can combine two metrics with one operator, such as
+// node_memory_used/node_memory_total, without a recording rule. Both
+// metrics are bucketed as usual, with their aggregation or counter
+// function, and the buckets of the same node and label are combined. The
+// labels of the two metrics must then match, which groupBy can ensure;
+// buckets missing on either side and divisions by zero are left out. Only
+// the node metrics combine metrics, the other queries reject math.
+
+var metricMathPattern = regexp.MustCompile(
+	`^\s*([a-zA-Z_:][a-zA-Z0-9_:]*)\s*([-+*/])\s*([a-zA-Z_:][a-zA-Z0-9_:]*)\s*$`)
+
+// metricMathOperators are the SQL of the operators between the values of
+// the left and right series.
+var metricMathOperators = map[string]string{
+	"+": "a.value + b.value",
+	"-": "a.value - b.value",
+	"*": "a.value * b.value",
+	"/": "a.value / NULLIF(b.value, 0)",
+}
+
+type metricMath struct {
+	left     string
+	operator string
+	right    string
+}
+
+func parseMetricMath(expr string) (*metricMath, bool) {
+	matches := metricMathPattern.FindStringSubmatch(expr)
+	if matches == nil {
+		return nil, false
+	}
+
+	return &metricMath{left: matches[1], operator: matches[2], right: matches[3]}, true
+}
+
+func (m *metricMath) String() string {
+	return m.left + m.operator + m.right
+}
+
+func (query *Query) isValidMath() bool {
+	if query.Math == "" {
+		return true
+	}
+	_, ok := parseMetricMath(query.Math)
+
+	return ok
+}
+
+// metricMath returns the operation of the query, nil if there is none.
+// The operands are added to the metric names so that they are selected.
+func (query *Query) metricMath() *metricMath {
+	if query == nil || query.Math == "" {
+		return nil
+	}
+	operation, ok := parseMetricMath(query.Math)
+	if !ok {
+		return nil
+	}
+
+	for _, name := range []string{operation.left, operation.right} {
+		if !stringInSlice(name, query.MetricNames) {
+			query.MetricNames = append(query.MetricNames, name)
+		}
+	}
+
+	return operation
+}
+
+// mathUnsupported answers 400 to a query with math on the handlers not
+// combining metrics.
+func (s *NexServer) mathUnsupported(c *gin.Context, query *Query) bool {
+	if query == nil || query.Math == "" {
+		return false
+	}
+
+	s.ApiResponseJson(c, 400, "bad", "math is only supported by the node metrics")
+	return true
+}
+
+// wrap combines the series of the metrics selected by the bucket query,
+// which has the columns node, node_id, value, bucket, name and group_label.
+func (m *metricMath) wrap(series *SqlQuery) *SqlQuery {
+	return NewSqlQuery("WITH series AS (").
+		AppendQuery(series).
+		Append(`)
+SELECT node, node_id, ROUND(value, 2), bucket, ?, group_label, samples, series FROM
+    (SELECT a.node, a.node_id, `+metricMathOperators[m.operator]+` as value,
+            a.bucket, a.group_label, LEAST(a.samples, b.samples) as samples,
+            GREATEST(a.series, b.series) as series
+    FROM series a JOIN series b
+        ON a.node_id=b.node_id AND a.bucket=b.bucket AND a.group_label=b.group_label
+    WHERE a.name=? AND b.name=?) as math
+WHERE value IS NOT NULL
+ORDER BY bucket, node_id, group_label`, m.String(), m.left, m.right)
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+var defaultReservedPrefixes = []string{"node_", "process_", "container_", "k8s_"}
+
+// builtinEndpoints are reported by NexAgent collectors and are trusted to
+// use the reserved namespaces.
+var builtinEndpoints = []string{"/node/", "/process/", "/container/", "/k8s/", "/synthetic/"}
+
+type MetricNamingConfig struct {
+	Enforce          bool
+	ReservedPrefixes []string
+	MaxLength        int
+}
+
+func isBuiltinEndpoint(endpoint string) bool {
+	for _, prefix := range builtinEndpoints {
+		if strings.HasPrefix(endpoint, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *NexServer) reservedPrefixes() []string {
+	if len(s.config.MetricNaming.ReservedPrefixes) > 0 {
+		return s.config.MetricNaming.ReservedPrefixes
+	}
+
+	return defaultReservedPrefixes
+}
+
+// ValidateMetricName checks a custom metric name against the naming rules.
+func (s *NexServer) ValidateMetricName(name string) error {
+	maxLength := s.config.MetricNaming.MaxLength
+	if maxLength == 0 {
+		maxLength = 256
+	}
+
+	if len(name) > maxLength {
+		return fmt.Errorf("metric name is longer than %d characters", maxLength)
+	}
+	if !metricNameRegexp.MatchString(name) {
+		return fmt.Errorf("metric name %q contains invalid characters", name)
+	}
+	for _, prefix := range s.reservedPrefixes() {
+		if strings.HasPrefix(name, prefix) {
+			return fmt.Errorf("metric name %q uses reserved namespace %q", name, prefix)
+		}
+	}
+
+	return nil
+}
+
+// normalizeMetricName applies the naming rules to a reported metric and
+// returns the name to be stored. Built-in collector metrics pass through.
+func (s *NexServer) normalizeMetricName(name, endpoint string, clusterId uint) (string, error) {
+	name, err := s.resolveMetricName(name, endpoint, clusterId)
+	if err != nil {
+		atomic.AddUint64(&s.rejectedMetricNames, 1)
+	}
+
+	return name, err
+}
+
+// resolveMetricName is normalizeMetricName without the accounting.
+func (s *NexServer) resolveMetricName(name, endpoint string, clusterId uint) (string, error) {
+	if isBuiltinEndpoint(endpoint) {
+		return name, nil
+	}
+
+	prefix := ""
+	if cluster := s.getClusterById(clusterId); cluster != nil && cluster.MetricPrefix != "" {
+		prefix = cluster.MetricPrefix
+		if !strings.HasSuffix(prefix, "_") {
+			prefix += "_"
+		}
+	}
+
+	if !s.config.MetricNaming.Enforce {
+		if prefix != "" && !strings.HasPrefix(name, prefix) {
+			name = prefix + name
+		}
+		return name, nil
+	}
+
+	if prefix != "" && strings.HasPrefix(name, prefix) {
+		name = strings.TrimPrefix(name, prefix)
+	}
+	if err := s.ValidateMetricName(name); err != nil {
+		return "", err
+	}
+
+	return prefix + name, nil
+}
+
+func (s *NexServer) ApiSetClusterMetricPrefix(c *gin.Context) {
+	cId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	type PrefixRequest struct {
+		Prefix string `json:"prefix"`
+	}
+	var req PrefixRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	if req.Prefix != "" && !metricNameRegexp.MatchString(req.Prefix) {
+		s.ApiResponseJson(c, 400, "bad", "prefix contains invalid characters")
+		return
+	}
+
+	var cluster Cluster
+	if result := s.requestDB(c).Where("id=?", cId).First(&cluster); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	result := s.requestDB(c).Model(&cluster).Update("metric_prefix", req.Prefix)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to update cluster: %v", result.Error)
+		return
+	}
+	s.cache.Del(fmt.Sprintf("CLUSTERBYID_%d", cluster.ID))
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+func (s *NexServer) ApiValidateMetricName(c *gin.Context) {
+	name := c.DefaultQuery("name", "")
+
+	if err := s.ValidateMetricName(name); err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
@@ -24,7 +24,6 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
-	"log"
 )
 
 func (s *NexServer) newNode(agent *Agent, publicIpv4 string, in *pb.Node) *Node {
@@ -51,23 +50,23 @@ func (s *NexServer) newNode(agent *Agent, publicIpv4 string, in *pb.Node) *Node
 func (s *NexServer) UpdateNode(ctx context.Context, in *pb.Node) (*pb.Response, error) {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
-		log.Println("UpdateNode: failed to get metadata")
+		ingestLog.Errorf("UpdateNode: failed to get metadata")
 		return nil, status.Error(codes.DataLoss, "UpdateNode: failed to get metadata")
 	}
 
 	agentUuid, ok := md["uuid"]
 	if !ok {
-		log.Println("UpdateNode: invalid agent")
+		ingestLog.Warnf("UpdateNode: invalid agent")
 		return nil, status.Error(codes.InvalidArgument, "UpdateNode: invalid Agent")
 	}
 
 	agent := s.findAgent(agentUuid[0])
 	if agent == nil {
-		log.Println("UpdateNode: invalid agent")
+		ingestLog.Warnf("UpdateNode: invalid agent")
 		return nil, status.Error(codes.PermissionDenied, "UpdateNode: invalid Agent")
 	}
 
-	log.Printf("Agent UUID: %s\n", agent.Uuid)
+	ingestLog.Debugf("Agent UUID: %s\n", agent.Uuid)
 
 	node := &Node{
 		Os:              in.Os,
@@ -0,0 +1,349 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"math"
+	"time"
+)
+
+// A policy with encoded_days keeps the hourly rows of retention past
+// downsample_days instead of deleting them, packed one block per series
+// and day. Timestamps and values are stored as delta-of-delta varints,
+// the values fixed point with the digits of their class (3 by default),
+// so a regular series costs a byte or two per hour instead of a row.
+// Packed rows leave the metrics table and are only served by the rollups
+// endpoint; progress is kept in the settings table like downsampling.
+
+const (
+	defaultRollupDigits    = 3
+	rollupProgressSetting  = "retention.encoded.%d"
+	maxRollupFixedPoint    = 1 << 62
+	maxRollupRangeDays     = 366
+	defaultRollupRangeDays = 30
+)
+
+type rollupSeries struct {
+	EndpointID, TypeID, NameID, LabelID       uint
+	ClusterID, NodeID, ProcessID, ContainerID uint
+	Day                                       time.Time
+}
+
+func putDeltaOfDelta(buf []byte, series []int64) []byte {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	var prev, prevDelta int64
+	for idx, value := range series {
+		encoded := value
+		if idx > 0 {
+			delta := value - prev
+			encoded = delta - prevDelta
+			prevDelta = delta
+		}
+		prev = value
+
+		n := binary.PutVarint(tmp, encoded)
+		buf = append(buf, tmp[:n]...)
+	}
+
+	return buf
+}
+
+func readDeltaOfDelta(data []byte, count int) ([]int64, []byte, error) {
+	series := make([]int64, 0, count)
+	var prev, prevDelta int64
+	for idx := 0; idx < count; idx++ {
+		encoded, n := binary.Varint(data)
+		if n <= 0 {
+			return nil, nil, fmt.Errorf("truncated rollup at sample %d", idx)
+		}
+		data = data[n:]
+
+		value := encoded
+		if idx > 0 {
+			prevDelta += encoded
+			value = prev + prevDelta
+		}
+		prev = value
+		series = append(series, value)
+	}
+
+	return series, data, nil
+}
+
+// encodeRollup packs the samples, lowering digits until every value fits
+// in fixed point. It returns the digits used.
+func encodeRollup(ts []time.Time, values []float64, digits int) ([]byte, int) {
+	maxAbs := 0.0
+	for _, value := range values {
+		maxAbs = math.Max(maxAbs, math.Abs(value))
+	}
+	for digits > 0 && maxAbs*math.Pow10(digits) >= maxRollupFixedPoint {
+		digits--
+	}
+	scale := math.Pow10(digits)
+
+	seconds := make([]int64, len(ts))
+	for idx := range ts {
+		seconds[idx] = ts[idx].Unix()
+	}
+	fixed := make([]int64, len(values))
+	for idx, value := range values {
+		fixed[idx] = int64(math.Max(-maxRollupFixedPoint, math.Min(maxRollupFixedPoint, math.Round(value*scale))))
+	}
+
+	buf := make([]byte, 0, 4*len(ts))
+	buf = putDeltaOfDelta(buf, seconds)
+	buf = putDeltaOfDelta(buf, fixed)
+
+	return buf, digits
+}
+
+func decodeRollup(data []byte, samples, digits int) ([]time.Time, []float64, error) {
+	seconds, data, err := readDeltaOfDelta(data, samples)
+	if err != nil {
+		return nil, nil, err
+	}
+	fixed, _, err := readDeltaOfDelta(data, samples)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scale := math.Pow10(digits)
+	ts := make([]time.Time, samples)
+	values := make([]float64, samples)
+	for idx := 0; idx < samples; idx++ {
+		ts[idx] = time.Unix(seconds[idx], 0).UTC()
+		values[idx] = float64(fixed[idx]) / scale
+	}
+
+	return ts, values, nil
+}
+
+func (s *NexServer) rollupDigits(typeId uint) int {
+	if precision := s.metricPrecision(typeId); precision != nil && precision.Digits != nil {
+		return *precision.Digits
+	}
+
+	return defaultRollupDigits
+}
+
+// encodeRollups packs the rows of the next batch before cutoff, returning
+// the number of rows packed and the time rows are packed up to.
+func (s *NexServer) encodeRollups(clusterId uint, notBefore, cutoff time.Time) (int64, time.Time, error) {
+	progressName := fmt.Sprintf(rollupProgressSetting, clusterId)
+
+	var progress Setting
+	from := notBefore
+	if result := s.db.Where("name=?", progressName).First(&progress); result.Error == nil {
+		if ts, err := time.Parse(time.RFC3339, progress.Value); err == nil && ts.After(from) {
+			from = ts
+		}
+	}
+	from = from.Truncate(time.Hour)
+	if !from.Before(cutoff) {
+		return 0, cutoff, nil
+	}
+
+	to := from.Add(retentionBatch)
+	if to.After(cutoff) {
+		to = cutoff
+	}
+
+	rows, err := s.db.Raw(`
+SELECT ts, value, endpoint_id, type_id, name_id, label_id, cluster_id, node_id, process_id, container_id
+FROM metrics
+WHERE cluster_id=? AND ts >= ? AND ts < ?
+ORDER BY node_id, process_id, container_id, name_id, label_id, endpoint_id, ts`, clusterId, from, to).Rows()
+	if err != nil {
+		return 0, from, err
+	}
+
+	order := make([]rollupSeries, 0)
+	ts := make(map[rollupSeries][]time.Time)
+	values := make(map[rollupSeries][]float64)
+	var packed int64
+	for rows.Next() {
+		var metric Metric
+		if err := rows.Scan(&metric.Ts, &metric.Value, &metric.EndpointID, &metric.TypeID, &metric.NameID,
+			&metric.LabelID, &metric.ClusterID, &metric.NodeID, &metric.ProcessID, &metric.ContainerID); err != nil {
+			rows.Close()
+			return 0, from, err
+		}
+		packed++
+		if math.IsNaN(metric.Value) || math.IsInf(metric.Value, 0) {
+			continue
+		}
+
+		key := rollupSeries{
+			EndpointID: metric.EndpointID, TypeID: metric.TypeID, NameID: metric.NameID, LabelID: metric.LabelID,
+			ClusterID: metric.ClusterID, NodeID: metric.NodeID, ProcessID: metric.ProcessID, ContainerID: metric.ContainerID,
+			Day: metric.Ts.UTC().Truncate(24 * time.Hour),
+		}
+		if _, found := ts[key]; !found {
+			order = append(order, key)
+		}
+		ts[key] = append(ts[key], metric.Ts)
+		values[key] = append(values[key], metric.Value)
+	}
+	rows.Close()
+
+	tx := s.db.Begin()
+	for _, key := range order {
+		data, digits := encodeRollup(ts[key], values[key], s.rollupDigits(key.TypeID))
+		rollup := MetricRollup{
+			Day:         key.Day,
+			ClusterID:   key.ClusterID,
+			NodeID:      key.NodeID,
+			ProcessID:   key.ProcessID,
+			ContainerID: key.ContainerID,
+			EndpointID:  key.EndpointID,
+			TypeID:      key.TypeID,
+			NameID:      key.NameID,
+			LabelID:     key.LabelID,
+			Samples:     len(ts[key]),
+			Digits:      digits,
+			Data:        data,
+		}
+		if result := tx.Create(&rollup); result.Error != nil {
+			tx.Rollback()
+			return 0, from, result.Error
+		}
+	}
+
+	progress.Name = progressName
+	progress.Value = to.Format(time.RFC3339)
+	if result := tx.Save(&progress); result.Error != nil {
+		tx.Rollback()
+		return 0, from, result.Error
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return 0, from, result.Error
+	}
+
+	return packed, to, nil
+}
+
+func (s *NexServer) deleteExpiredRollups(clusterId uint, cutoff time.Time) (int64, error) {
+	result := s.db.Exec("DELETE FROM metric_rollups WHERE cluster_id=? AND day < ?", clusterId, cutoff.Truncate(24*time.Hour))
+
+	return result.RowsAffected, result.Error
+}
+
+func (s *NexServer) ApiMetricRollups(c *gin.Context) {
+	clusterId, clusterOk := s.idParam(c, "clusterId", false)
+	if !clusterOk {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	name := c.Query("metricName")
+	metricNameIds := s.findMetricIdByNames([]string{name})
+	if name == "" || len(metricNameIds) != 1 {
+		s.ApiResponseJson(c, 404, "bad", "invalid metricName")
+		return
+	}
+
+	to := time.Now().UTC()
+	from := to.AddDate(0, 0, -defaultRollupRangeDays)
+	for _, param := range []struct {
+		name  string
+		value *time.Time
+	}{{"from", &from}, {"to", &to}} {
+		value := c.Query(param.name)
+		if value == "" {
+			continue
+		}
+		ts, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			s.ApiResponseJsonf(c, 400, "bad", "invalid %s, expected RFC3339", param.name)
+			return
+		}
+		*param.value = ts
+	}
+	if !from.Before(to) || to.Sub(from) > maxRollupRangeDays*24*time.Hour {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid range, expected at most %d days", maxRollupRangeDays)
+		return
+	}
+
+	db := s.requestDB(c).Table("metric_rollups").
+		Select("metric_rollups.*, coalesce(metric_labels.label, '') as label").
+		Joins("LEFT JOIN metric_labels ON metric_labels.id=metric_rollups.label_id").
+		Where("metric_rollups.cluster_id=? AND metric_rollups.name_id=?", clusterId, metricNameIds[0]).
+		Where("metric_rollups.day >= ? AND metric_rollups.day < ?", from.Truncate(24*time.Hour), to)
+	if value := c.Query("nodeId"); value != "" {
+		db = db.Where("metric_rollups.node_id=?", value)
+	}
+
+	type RollupRow struct {
+		MetricRollup
+		Label string
+	}
+	var rollups []RollupRow
+	if result := db.Order("node_id, process_id, container_id, label_id, day, metric_rollups.id").Find(&rollups); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	type RollupPoint struct {
+		Ts    time.Time `json:"ts"`
+		Value float64   `json:"value"`
+	}
+	type RollupItem struct {
+		NodeId      uint          `json:"node_id"`
+		ProcessId   uint          `json:"process_id"`
+		ContainerId uint          `json:"container_id"`
+		MetricLabel string        `json:"metric_label"`
+		Day         time.Time     `json:"day"`
+		Digits      int           `json:"digits"`
+		Points      []RollupPoint `json:"points"`
+	}
+
+	items := make([]RollupItem, 0, len(rollups))
+	for _, rollup := range rollups {
+		ts, values, err := decodeRollup(rollup.Data, rollup.Samples, rollup.Digits)
+		if err != nil {
+			requestLog(c).Errorf("failed to decode rollup %d: %v", rollup.ID, err)
+			continue
+		}
+
+		item := RollupItem{
+			NodeId:      rollup.NodeID,
+			ProcessId:   rollup.ProcessID,
+			ContainerId: rollup.ContainerID,
+			MetricLabel: rollup.Label,
+			Day:         rollup.Day,
+			Digits:      rollup.Digits,
+			Points:      make([]RollupPoint, 0, len(ts)),
+		}
+		for idx := range ts {
+			if ts[idx].Before(from) || !ts[idx].Before(to) {
+				continue
+			}
+			item.Points = append(item.Points, RollupPoint{Ts: ts[idx], Value: values[idx]})
+		}
+		items = append(items, item)
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	ValidationActionReject = "reject"
+	ValidationActionFlag   = "flag"
+
+	defaultMaxAbsValue = 1e18
+)
+
+// MetricBound is a sanity range for a metric. Name may end with '*' to
+// match a prefix, or start with '*' to match a suffix.
+type MetricBound struct {
+	Name string
+	Min  *float64
+	Max  *float64
+}
+
+type ValueValidationConfig struct {
+	Action      string
+	MaxAbsValue float64
+	Bounds      []MetricBound
+}
+
+type ValidationCounter struct {
+	Rejected uint64 `json:"rejected"`
+	Flagged  uint64 `json:"flagged"`
+	LastBad  string `json:"last_bad"`
+}
+
+type ValueValidator struct {
+	sync.RWMutex
+
+	config   ValueValidationConfig
+	counters map[string]*ValidationCounter
+}
+
+func float64Ptr(value float64) *float64 {
+	return &value
+}
+
+func NewValueValidator(config ValueValidationConfig) *ValueValidator {
+	if config.Action == "" {
+		config.Action = ValidationActionReject
+	}
+	if config.MaxAbsValue == 0 {
+		config.MaxAbsValue = defaultMaxAbsValue
+	}
+	if len(config.Bounds) == 0 {
+		config.Bounds = []MetricBound{
+			{Name: "*_percent", Min: float64Ptr(0), Max: float64Ptr(100)},
+		}
+	}
+
+	return &ValueValidator{
+		config:   config,
+		counters: make(map[string]*ValidationCounter),
+	}
+}
+
+func (b *MetricBound) matches(name string) bool {
+	if strings.HasSuffix(b.Name, "*") {
+		return strings.HasPrefix(name, strings.TrimSuffix(b.Name, "*"))
+	}
+	if strings.HasPrefix(b.Name, "*") {
+		return strings.HasSuffix(name, strings.TrimPrefix(b.Name, "*"))
+	}
+
+	return b.Name == name
+}
+
+func (v *ValueValidator) check(name string, value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("%s: non-finite value %v", name, value)
+	}
+	if math.Abs(value) > v.config.MaxAbsValue {
+		return fmt.Errorf("%s: value %g exceeds %g", name, value, v.config.MaxAbsValue)
+	}
+
+	for idx := range v.config.Bounds {
+		bound := &v.config.Bounds[idx]
+		if !bound.matches(name) {
+			continue
+		}
+		if bound.Min != nil && value < *bound.Min {
+			return fmt.Errorf("%s: value %g below %g", name, value, *bound.Min)
+		}
+		if bound.Max != nil && value > *bound.Max {
+			return fmt.Errorf("%s: value %g above %g", name, value, *bound.Max)
+		}
+	}
+
+	return nil
+}
+
+// Accept reports whether a sample should be stored. Non-finite values are
+// always rejected since they would poison aggregates; out-of-bound values
+// are rejected or only flagged depending on the configured action.
+func (v *ValueValidator) Accept(name string, value float64) bool {
+	err := v.check(name, value)
+	if err == nil {
+		return true
+	}
+
+	reject := v.config.Action == ValidationActionReject ||
+		math.IsNaN(value) || math.IsInf(value, 0)
+
+	v.Lock()
+	counter, found := v.counters[name]
+	if !found {
+		counter = &ValidationCounter{}
+		v.counters[name] = counter
+	}
+	if reject {
+		counter.Rejected += 1
+	} else {
+		counter.Flagged += 1
+	}
+	first := counter.Rejected+counter.Flagged == 1
+	counter.LastBad = err.Error()
+	v.Unlock()
+
+	if first {
+		ingestLog.Warnf("Ingest: invalid metric value: %v\n", err)
+	}
+
+	return !reject
+}
+
+func (v *ValueValidator) Counters() map[string]ValidationCounter {
+	v.RLock()
+	defer v.RUnlock()
+
+	counters := make(map[string]ValidationCounter, len(v.counters))
+	for name, counter := range v.counters {
+		counters[name] = *counter
+	}
+
+	return counters
+}
+
+func (s *NexServer) writeValidationPrometheus(builder *strings.Builder) {
+	counters := s.valueValidator.Counters()
+	names := make([]string, 0, len(counters))
+	for name := range counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	builder.WriteString("# HELP nexserver_ingest_invalid_values_total Number of invalid metric values seen at ingest.\n")
+	builder.WriteString("# TYPE nexserver_ingest_invalid_values_total counter\n")
+	for _, name := range names {
+		builder.WriteString(fmt.Sprintf("nexserver_ingest_invalid_values_total{metric=\"%s\",action=\"reject\"} %d\n",
+			escapeLabelValue(name), counters[name].Rejected))
+		builder.WriteString(fmt.Sprintf("nexserver_ingest_invalid_values_total{metric=\"%s\",action=\"flag\"} %d\n",
+			escapeLabelValue(name), counters[name].Flagged))
+	}
+}
+
+func (s *NexServer) ApiAdminIngestValidation(c *gin.Context) {
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"action":   s.valueValidator.config.Action,
+			"bounds":   s.valueValidator.config.Bounds,
+			"counters": s.valueValidator.Counters(),
+		},
+	})
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Saving every sample with its own INSERT bounds ingestion to one round
+// trip per metric. Samples are queued instead and written by a single
+// writer as multi-row INSERTs of up to BatchSize rows, flushed at the
+// latest after FlushMs. The queue is bounded: when the database falls
+// behind, reports wait for room in the queue rather than growing the
+// memory of the server. A BatchSize of 1 writes every sample as it
+// comes, as before. A batch failing is retried one sample at a time so
+// that a bad sample loses only itself. On shutdown the queue is drained
+// before the writer stops.
+
+const (
+	defaultIngestBatchSize = 500
+	defaultIngestFlushMs   = 1000
+	defaultIngestQueueSize = 50000
+
+	// a batch stays under the 65535 bind parameters of postgres
+	maxIngestBatchSize = 5000
+	metricColumns      = 10
+)
+
+type IngestConfig struct {
+	BatchSize int
+	FlushMs   int
+	QueueSize int
+}
+
+type MetricWriter struct {
+	queue     chan Metric
+	batchSize int
+	flush     time.Duration
+	stop      chan struct{}
+	done      chan struct{}
+
+	written uint64
+	failed  uint64
+}
+
+func NewMetricWriter(config IngestConfig) *MetricWriter {
+	batchSize := config.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultIngestBatchSize
+	}
+	if batchSize > maxIngestBatchSize {
+		batchSize = maxIngestBatchSize
+	}
+	flushMs := config.FlushMs
+	if flushMs <= 0 {
+		flushMs = defaultIngestFlushMs
+	}
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultIngestQueueSize
+	}
+
+	return &MetricWriter{
+		queue:     make(chan Metric, queueSize),
+		batchSize: batchSize,
+		flush:     time.Duration(flushMs) * time.Millisecond,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// saveMetric rounds the sample to the precision of its class and queues
+// it, or saves it when batching is disabled.
+func (s *NexServer) saveMetric(metric Metric) {
+	s.applyPrecision(&metric)
+	if s.metricWriter.batchSize <= 1 {
+		if result := s.db.Create(&metric); result.Error != nil {
+			atomic.AddUint64(&s.metricWriter.failed, 1)
+			return
+		}
+		atomic.AddUint64(&s.metricWriter.written, 1)
+		return
+	}
+
+	s.metricWriter.queue <- metric
+}
+
+func (s *NexServer) insertMetrics(batch []Metric) error {
+	rows := make([]string, 0, len(batch))
+	args := make([]interface{}, 0, metricColumns*len(batch))
+	for idx := range batch {
+		metric := &batch[idx]
+		rows = append(rows, "(?,?,?,?,?,?,?,?,?,?)")
+		args = append(args, metric.Ts, metric.Value, metric.EndpointID, metric.TypeID, metric.NameID,
+			metric.LabelID, metric.ClusterID, metric.NodeID, metric.ProcessID, metric.ContainerID)
+	}
+
+	return s.db.Exec(`
+INSERT INTO metrics (ts, value, endpoint_id, type_id, name_id, label_id,
+                     cluster_id, node_id, process_id, container_id)
+VALUES `+strings.Join(rows, ","), args...).Error
+}
+
+func (s *NexServer) flushMetrics(batch []Metric) {
+	if len(batch) == 0 {
+		return
+	}
+
+	err := s.insertMetrics(batch)
+	if err == nil {
+		atomic.AddUint64(&s.metricWriter.written, uint64(len(batch)))
+		return
+	}
+	if len(batch) == 1 {
+		s.logFailedMetric(&batch[0], err)
+		atomic.AddUint64(&s.metricWriter.failed, 1)
+		return
+	}
+
+	// one bad sample fails the whole INSERT, the others are saved one by one
+	ingestLog.Warnf("MetricWriter: failed to save %d metrics, retrying one by one: %v\n", len(batch), err)
+	for idx := range batch {
+		if err := s.insertMetrics(batch[idx : idx+1]); err != nil {
+			s.logFailedMetric(&batch[idx], err)
+			atomic.AddUint64(&s.metricWriter.failed, 1)
+			continue
+		}
+		atomic.AddUint64(&s.metricWriter.written, 1)
+	}
+}
+
+func (s *NexServer) logFailedMetric(metric *Metric, err error) {
+	ingestLog.Errorf("MetricWriter: failed to save metric (ts=%v, value=%v, name_id=%d, label_id=%d, "+
+		"cluster_id=%d, node_id=%d, process_id=%d, container_id=%d): %v\n",
+		metric.Ts, metric.Value, metric.NameID, metric.LabelID,
+		metric.ClusterID, metric.NodeID, metric.ProcessID, metric.ContainerID, err)
+}
+
+func (s *NexServer) InitMetricWriter() {
+	writer := s.metricWriter
+	if writer.batchSize <= 1 {
+		return
+	}
+
+	ticker := time.NewTicker(writer.flush)
+	defer ticker.Stop()
+
+	batch := make([]Metric, 0, writer.batchSize)
+	for {
+		select {
+		case metric := <-writer.queue:
+			batch = append(batch, metric)
+			if len(batch) >= writer.batchSize {
+				s.flushMetrics(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			s.flushMetrics(batch)
+			batch = batch[:0]
+		case <-writer.stop:
+			for {
+				select {
+				case metric := <-writer.queue:
+					batch = append(batch, metric)
+					if len(batch) < writer.batchSize {
+						continue
+					}
+				default:
+					s.flushMetrics(batch)
+					close(writer.done)
+					return
+				}
+				s.flushMetrics(batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// drainMetricWriter writes the queued samples and stops the writer.
+func (s *NexServer) drainMetricWriter(ctx context.Context) error {
+	writer := s.metricWriter
+	if writer == nil || writer.batchSize <= 1 {
+		return nil
+	}
+
+	close(writer.stop)
+	select {
+	case <-writer.done:
+		ingestLog.Infof("MetricWriter: queue drained\n")
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d queued metrics not written: %v", len(writer.queue), ctx.Err())
+	}
+}
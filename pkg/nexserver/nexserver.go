@@ -18,6 +18,7 @@ package nexserver
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	pb "github.com/NexClipper/NexClipper/api"
 	"github.com/dgraph-io/ristretto"
@@ -26,17 +27,19 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip"
 	"google.golang.org/grpc/keepalive"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"path/filepath"
 	"sigs.k8s.io/yaml"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -61,18 +64,26 @@ var kasp = keepalive.ServerParameters{
 }
 
 type ServerConfig struct {
-	BindAddress     string
-	AgentListenPort int
-	ApiPort         int
+	BindAddress      string
+	AgentListenPort  int
+	ApiPort          int
+	ApiUnixSocket    string
+	AdminBindAddress string
+	AdminPort        int
+	AdminToken       string `secret:"true"`
+	TrustedProxies   []string
+	ShutdownTimeout  int
 }
 
 type DatabaseConfig struct {
 	Host     string
 	Port     int
 	User     string
-	Password string
+	Password string `secret:"true"`
 	DbName   string
 	SslMode  string
+	// QueryTimeout caps the statements of read requests (seconds)
+	QueryTimeout int
 }
 
 type TLSConfig struct {
@@ -85,13 +96,54 @@ type Config struct {
 	Server    ServerConfig
 	Database  DatabaseConfig
 	TLS       TLSConfig
+	Crypto    CryptoConfig
 	BasicRule BasicRuleConfig
+	Tracing   TracingConfig
+	Siem      SiemConfig
+
+	MetricNaming    MetricNamingConfig
+	ValueValidation ValueValidationConfig
+	GC              GCConfig
+	Cluster         ClusterConfig
+	Webhook         WebhookConfig
+	Ingest          IngestConfig
+	CMDB            CMDBConfig
+	Bundle          BundleConfig
+	Shard           ShardConfig
+	Jobs            map[string]string
+	Features        map[string]bool
+	I18n            I18nConfig
+	ChangePoint     ChangePointConfig
+	RemoteWrite     RemoteWriteConfig
+	StatusPage      StatusPageConfig
+	Retention       RetentionConfig
+	Precision       PrecisionConfig
+	Auth            AuthConfig
+	ImageScan       ImageScanConfig
+	MeshProbe       MeshProbeConfig
+	Log             LogConfig
+	IngestQuota     IngestQuotaConfig
+	RateLimit       RateLimitConfig
+	Probe           ProbeConfig
+}
+
+type ClusterConfig struct {
+	RestoreHours       int
+	EnrollmentRequired bool
 }
 
 type BasicRuleConfig struct {
-	NodeCpuLoad1   float64
-	NodeMemoryFree float64
-	NodeDiskFree   float64
+	NodeCpuLoad1        float64
+	NodeMemoryFree      float64
+	NodeDiskFree        float64
+	NodeAuthFailures    float64
+	NodeZombies         float64
+	NodeUninterruptible float64
+	NodeDeletedBinaries float64
+	NodeEphemeral       float64
+	PodEphemeral        float64
+	CronJobSuccessHours float64
+	Severities          map[string]string
 }
 
 type NexServer struct {
@@ -109,9 +161,44 @@ type NexServer struct {
 	serverStartTs         time.Time
 	metricSaveCounter     uint64
 	metricSaveCounterLock sync.RWMutex
+	rejectedMetricNames   uint64
 
 	incidentMap   map[string][]*IncidentItem
 	metricChannel chan Metric
+
+	logBuffer *LogBuffer
+	tracer    *Tracer
+	siem      *SiemShipper
+	tlsConfig *tls.Config
+	grpcStats *GrpcStats
+
+	valueValidator *ValueValidator
+	counterTracker *CounterTracker
+	gc             GarbageCollector
+	webhooks       *WebhookDispatcher
+	metricWriter   *MetricWriter
+	digests        *DigestBuffer
+	cmdb           CMDBExporter
+	bundles        BundleExporter
+	shard          ShardState
+	scheduler      Scheduler
+	leader         LeaderElection
+	features       FeatureFlags
+	ruleStates     RuleStates
+	embed          EmbedKey
+	statusPage     StatusPageCache
+	retention      RetentionManager
+	auth           AuthState
+	apiUsage       ApiUsage
+	rateLimiter    RateLimiter
+	clusterTasks   ClusterTasks
+	precisions     MetricPrecisions
+	lifecycle      Lifecycle
+	openapi        OpenAPISpec
+	messages       MessageCatalogs
+	commands       *AgentCommands
+	tails          *TailHub
+	meshRound      int
 }
 
 func (s *NexServer) newAgent(in *pb.Agent, publicIpv4 string, cluster *Cluster) *Agent {
@@ -144,7 +231,7 @@ func (s *NexServer) addAgent(agentUuid string, agent *Agent) {
 
 	result := s.db.Model(&agent).Update("online", true)
 	if result.Error != nil {
-		log.Printf("failed to update agent: %v\n", result.Error)
+		ingestLog.Errorf("failed to update agent: %v\n", result.Error)
 	}
 }
 
@@ -162,11 +249,19 @@ func (s *NexServer) deleteAgent(agentUuid string) {
 
 		result := s.db.Model(&agent).Update("online", false)
 		if result.Error != nil {
-			log.Printf("failed to update agent: %v\n", result.Error)
+			ingestLog.Errorf("failed to update agent: %v\n", result.Error)
 		}
 	}
 }
 
+// disconnectAgent ends the ping stream of an agent and drops it from the
+// connected agents and the gRPC stats.
+func (s *NexServer) disconnectAgent(agentUuid string) {
+	s.commands.disconnect(agentUuid)
+	s.deleteAgent(agentUuid)
+	s.grpcStats.Forget(agentUuid)
+}
+
 func (s *NexServer) findAgent(agentUuid string) *Agent {
 	s.RLock()
 	defer s.RUnlock()
@@ -202,16 +297,39 @@ func (s *NexServer) getPublicIP(ctx context.Context) (string, error) {
 
 	publicIpv4 := strings.Split(p.Addr.String(), ":")[0]
 
+	// agents behind a nexproxy are reported with their own address
+	if s.isTrustedProxy(publicIpv4) {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if forwarded := md.Get("x-forwarded-for"); len(forwarded) > 0 && forwarded[0] != "" {
+				return forwarded[0], nil
+			}
+		}
+	}
+
 	return publicIpv4, nil
 }
 
-func (s *NexServer) updateAgentInfo(agent *Agent, publicIpv4 string, in *pb.Agent) error {
+func (s *NexServer) isTrustedProxy(address string) bool {
+	for _, proxy := range s.config.Server.TrustedProxies {
+		if proxy == address {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *NexServer) updateAgentInfo(agent *Agent, publicIpv4 string, in *pb.Agent, protocol int) error {
 	needToUpdate := false
 
 	if agent.Version != in.Version {
 		agent.Version = in.Version
 		needToUpdate = true
 	}
+	if agent.Protocol != protocol {
+		agent.Protocol = protocol
+		needToUpdate = true
+	}
 	if agent.PublicIpv4 != publicIpv4 {
 		agent.PublicIpv4 = publicIpv4
 		needToUpdate = true
@@ -227,10 +345,11 @@ func (s *NexServer) updateAgentInfo(agent *Agent, publicIpv4 string, in *pb.Agen
 
 	result := s.db.Model(agent).Updates(Agent{
 		Version:    agent.Version,
+		Protocol:   agent.Protocol,
 		PublicIpv4: agent.PublicIpv4,
 		Ipv4:       agent.Ipv4})
 	if result.Error != nil {
-		log.Printf("failed to update agent: %v", result.Error)
+		ingestLog.Errorf("failed to update agent: %v", result.Error)
 		return result.Error
 	}
 
@@ -238,25 +357,56 @@ func (s *NexServer) updateAgentInfo(agent *Agent, publicIpv4 string, in *pb.Agen
 }
 
 func (s *NexServer) UpdateAgent(ctx context.Context, in *pb.Agent) (*pb.Response, error) {
+	if err := s.redirectAgent(ctx, in.MachineId); err != nil {
+		return nil, err
+	}
+	protocol, err := s.negotiateProtocol(ctx, in.MachineId)
+	if err != nil {
+		return nil, err
+	}
+
+	remoteAgent := s.getRemoteAgent(in.MachineId)
+	enrollment, err := s.authenticateAgent(ctx, in.Cluster, remoteAgent)
+	if err != nil {
+		ingestLog.Warnf("Enrollment: refused agent %s of cluster %s: %v\n", in.MachineId, in.Cluster, err)
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
 	cluster := s.findCluster(in.Cluster)
+	if s.isClusterDeleted(cluster) {
+		return nil, status.Error(codes.PermissionDenied, "cluster is deleted")
+	}
 
 	publicIpv4, err := s.getPublicIP(ctx)
 	if err != nil {
 		return nil, status.Error(codes.Unknown, "failed to get public IP address")
 	}
 
-	remoteAgent := s.getRemoteAgent(in.MachineId)
+	if remoteAgent != nil && remoteAgent.Disabled {
+		return nil, status.Error(codes.PermissionDenied, "agent is disabled")
+	}
 	if remoteAgent == nil {
 		remoteAgent = s.newAgent(in, publicIpv4, cluster)
+		remoteAgent.Protocol = protocol
 		result := s.db.Create(remoteAgent)
 		if result.Error != nil {
-			log.Printf("failed to create a new agent: %s\n", result.Error)
+			ingestLog.Errorf("failed to create a new agent: %s\n", result.Error)
+		}
+	}
+	if enrollment != nil {
+		if err := s.issueAgentSecret(ctx, remoteAgent, enrollment); err != nil {
+			ingestLog.Errorf("Enrollment: failed to issue secret of agent %s: %v\n", remoteAgent.Uuid, err)
+			return nil, status.Error(codes.Internal, "failed to issue agent secret")
 		}
 	}
 
 	agent := s.findAgent(remoteAgent.Uuid)
 	if agent == nil {
 		s.addAgent(remoteAgent.Uuid, remoteAgent)
+		s.emitEvent(EventAgentOnline, cluster.ID, map[string]interface{}{
+			"agent_uuid": remoteAgent.Uuid,
+			"version":    remoteAgent.Version,
+		})
 
 		node := s.findNodeByAgent(remoteAgent)
 		if node != nil {
@@ -264,7 +414,7 @@ func (s *NexServer) UpdateAgent(ctx context.Context, in *pb.Agent) (*pb.Response
 		}
 	}
 
-	s.updateAgentInfo(remoteAgent, publicIpv4, in)
+	s.updateAgentInfo(remoteAgent, publicIpv4, in, protocol)
 	s.updateLastContact(remoteAgent.Uuid)
 
 	node := s.findNodeByAgent(remoteAgent)
@@ -272,6 +422,12 @@ func (s *NexServer) UpdateAgent(ctx context.Context, in *pb.Agent) (*pb.Response
 		node = s.newNode(remoteAgent, publicIpv4, in.Node)
 
 		s.db.Create(node)
+		s.emitEvent(EventNodeAdded, cluster.ID, map[string]interface{}{
+			"node_id":    node.ID,
+			"host":       node.Host,
+			"uuid":       node.Uuid,
+			"agent_uuid": remoteAgent.Uuid,
+		})
 	}
 
 	return &pb.Response{
@@ -296,6 +452,13 @@ func (s *NexServer) findAgentFromContext(ctx context.Context) *Agent {
 	if agent == nil {
 		return nil
 	}
+	s.RLock()
+	valid := validAgentSecret(ctx, agent)
+	s.RUnlock()
+	if !valid {
+		ingestLog.Warnf("Agent: invalid secret of agent %s\n", agent.Uuid)
+		return nil
+	}
 
 	return agent
 }
@@ -303,7 +466,7 @@ func (s *NexServer) findAgentFromContext(ctx context.Context) *Agent {
 func (s *NexServer) Ping(stream pb.Collector_PingServer) error {
 	agent := s.findAgentFromContext(stream.Context())
 	if agent == nil {
-		log.Printf("Ping: invalid agent")
+		ingestLog.Warnf("Ping: invalid agent")
 		return status.Error(codes.PermissionDenied, "invalid agent")
 	}
 
@@ -311,33 +474,70 @@ func (s *NexServer) Ping(stream pb.Collector_PingServer) error {
 		for {
 			in, err := stream.Recv()
 			if err == io.EOF {
-				log.Printf("Agent: error: %v\n", err)
+				ingestLog.Errorf("Agent: error: %v\n", err)
 			}
 			if err != nil {
-				log.Printf("Agent: %s disconnected: %v\n", agent.Uuid, err)
-
-				node := s.findNodeByAgent(agent)
-				s.FireAgentDisconnected(agent.ClusterID, node.ID, node.Host)
+				if s.releaseMovedAgent(agent.Uuid) || s.shuttingDown() {
+					return
+				}
+
+				ingestLog.Warnf("Agent: %s disconnected: %v\n", agent.Uuid, err)
+
+				// the node is gone once the agent is deregistered or its cluster purged
+				var nodeId uint
+				var host string
+				if node := s.findNodeByAgent(agent); node != nil {
+					nodeId = node.ID
+					host = node.Host
+				}
+				s.FireAgentDisconnected(agent.ClusterID, nodeId, host)
+				s.emitEvent(EventAgentOffline, agent.ClusterID, map[string]interface{}{
+					"agent_uuid": agent.Uuid,
+					"node_id":    nodeId,
+					"host":       host,
+				})
 
 				s.deleteAgent(agent.Uuid)
 
 				return
 			}
 			if in.Uuid != agent.Uuid {
-				log.Println("Ping: invalid uuid")
+				ingestLog.Warnf("Ping: invalid uuid")
 			}
 		}
 	}()
 
-	for range time.Tick(time.Second * 5) {
+	commands := s.commands.register(agent.Uuid, agentProtocolFromContext(stream.Context()))
+	defer s.commands.unregister(agent.Uuid, commands)
+
+	s.pushAgentConfig(agent)
+
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+
+	for {
 		agentStatus := &pb.Status{
-			Uuid:      agent.Uuid,
-			Timestamp: time.Now().Unix(),
+			Uuid: agent.Uuid,
 		}
 
+		select {
+		case <-ticker.C:
+		case command, ok := <-commands:
+			if !ok {
+				return status.Error(codes.Aborted, "agent is removed")
+			}
+			agentStatus.Command = command
+		case <-stream.Context().Done():
+			return nil
+		case <-s.lifecycle.shutdown:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		}
+
+		agentStatus.Timestamp = time.Now().Unix()
+
 		err := stream.Send(agentStatus)
 		if err != nil {
-			log.Printf("Agent: failed to send ping: %v\n", err)
+			ingestLog.Errorf("Agent: failed to send ping: %v\n", err)
 			break
 		}
 	}
@@ -348,16 +548,20 @@ func (s *NexServer) Ping(stream pb.Collector_PingServer) error {
 func (s *NexServer) ReportMetrics(ctx context.Context, in *pb.Metrics) (*pb.Response, error) {
 	agent := s.findAgentFromContext(ctx)
 	if agent == nil {
-		log.Println("ReportMetrics: invalid agent")
+		ingestLog.Warnf("ReportMetrics: invalid agent")
 		return nil, status.Error(codes.PermissionDenied, "invalid agent")
 	}
 
 	node := s.getNodeByAgent(agent)
 	if node == nil {
-		log.Println("ReportMetrics: invalid agent")
+		ingestLog.Warnf("ReportMetrics: invalid agent")
 		return nil, status.Error(codes.PermissionDenied, "invalid agent")
 	}
 
+	if s.isClusterDeleted(s.getClusterById(agent.ClusterID)) {
+		return nil, status.Error(codes.PermissionDenied, "cluster is deleted")
+	}
+
 	s.addMetrics(in, agent.ClusterID, node.ID, nil)
 
 	return s.response(true, 0, ""), nil
@@ -366,9 +570,12 @@ func (s *NexServer) ReportMetrics(ctx context.Context, in *pb.Metrics) (*pb.Resp
 func (s *NexServer) mustValidAgent(ctx context.Context) (*Agent, error) {
 	agent := s.findAgentFromContext(ctx)
 	if agent == nil {
-		log.Println("ValidAgent: invalid agent")
+		ingestLog.Warnf("ValidAgent: invalid agent")
 		return nil, status.Error(codes.PermissionDenied, "invalid agent")
 	}
+	if agent.Disabled {
+		return nil, status.Error(codes.PermissionDenied, "agent is disabled")
+	}
 
 	return agent, nil
 }
@@ -376,9 +583,12 @@ func (s *NexServer) mustValidAgent(ctx context.Context) (*Agent, error) {
 func (s *NexServer) mustValidCluster(clusterName string) (*Cluster, error) {
 	cluster := s.findCluster(clusterName)
 	if cluster == nil {
-		log.Println("ValidCluster: invalid cluster")
+		ingestLog.Warnf("ValidCluster: invalid cluster")
 		return nil, status.Error(codes.InvalidArgument, "invalid cluster")
 	}
+	if s.isClusterDeleted(cluster) {
+		return nil, status.Error(codes.PermissionDenied, "cluster is deleted")
+	}
 
 	return cluster, nil
 }
@@ -386,7 +596,7 @@ func (s *NexServer) mustValidCluster(clusterName string) (*Cluster, error) {
 func (s *NexServer) mustValidNode(nodeName string, clusterId uint) (*Node, error) {
 	node := s.findNode(nodeName, clusterId)
 	if node == nil {
-		log.Println("ValidNode: invalid node")
+		ingestLog.Warnf("ValidNode: invalid node")
 		return nil, status.Error(codes.InvalidArgument, "invalid node")
 	}
 
@@ -416,33 +626,33 @@ func (s *NexServer) ReportContainerMetrics(ctx context.Context, in *pb.Container
 func (s *NexServer) UpdateK8SCluster(ctx context.Context, in *pb.K8SCluster) (*pb.Response, error) {
 	_, err := s.mustValidAgent(ctx)
 	if err != nil {
-		log.Println("UpdateK8SCluster: invalid agent")
+		ingestLog.Warnf("UpdateK8SCluster: invalid agent")
 		return nil, status.Error(codes.PermissionDenied, "invalid agent")
 	}
 	cluster, err := s.mustValidCluster(in.AgentCluster)
 	if err != nil {
-		log.Println("UpdateK8SCluster: invalid agent")
+		ingestLog.Warnf("UpdateK8SCluster: invalid agent")
 		return nil, status.Error(codes.InvalidArgument, "invalid cluster")
 	}
 	k8sCluster, err := s.mustValidK8sCluster(in.Object.Name, cluster.ID)
 	if err != nil {
-		log.Println("UpdateK8SCluster: invalid kubernetes cluster")
+		ingestLog.Warnf("UpdateK8SCluster: invalid kubernetes cluster")
 		return nil, status.Error(codes.InvalidArgument, "invalid kubernetes cluster")
 	}
 
 	if in.K8SNodes == nil || in.K8SNamespaces == nil {
-		log.Println("UpdateK8SCluster: invalid kubernetes cluster")
+		ingestLog.Warnf("UpdateK8SCluster: invalid kubernetes cluster")
 		return nil, status.Error(codes.InvalidArgument, "invalid kubernetes cluster")
 	}
 
 	err = s.addK8sNodes(in.K8SNodes, k8sCluster)
 	if err != nil {
-		log.Println("UpdateK8SCluster: invalid arguments")
+		ingestLog.Warnf("UpdateK8SCluster: invalid arguments")
 		return nil, status.Error(codes.InvalidArgument, "invalid arguments")
 	}
 	err = s.addNamespaces(in.K8SNamespaces, k8sCluster)
 	if err != nil {
-		log.Println("UpdateK8SCluster: invalid arguments")
+		ingestLog.Warnf("UpdateK8SCluster: invalid arguments")
 		return nil, status.Error(codes.InvalidArgument, "invalid arguments")
 	}
 
@@ -452,17 +662,17 @@ func (s *NexServer) UpdateK8SCluster(ctx context.Context, in *pb.K8SCluster) (*p
 func (s *NexServer) ReportK8SMetrics(ctx context.Context, in *pb.K8SMetrics) (*pb.Response, error) {
 	_, err := s.mustValidAgent(ctx)
 	if err != nil {
-		log.Println("ReportK8SMetrics: invalid agent")
+		ingestLog.Warnf("ReportK8SMetrics: invalid agent")
 		return nil, status.Error(codes.PermissionDenied, "invalid agent")
 	}
 	cluster, err := s.mustValidCluster(in.AgentCluster)
 	if err != nil {
-		log.Println("ReportK8SMetrics: invalid agent")
+		ingestLog.Warnf("ReportK8SMetrics: invalid agent")
 		return nil, status.Error(codes.InvalidArgument, "invalid cluster")
 	}
 	k8sCluster, err := s.mustValidK8sCluster(in.K8SCluster, cluster.ID)
 	if err != nil {
-		log.Println("ReportK8SMetrics: invalid kubernetes cluster")
+		ingestLog.Warnf("ReportK8SMetrics: invalid kubernetes cluster")
 		return nil, status.Error(codes.InvalidArgument, "invalid kubernetes cluster")
 	}
 
@@ -503,10 +713,11 @@ func (s *NexServer) UpdateProcess(ctx context.Context, in *pb.ProcessAll) (*pb.R
 
 			result := s.db.Create(&processItem)
 			if result.Error != nil {
-				log.Printf("failed to create process record: %v\n", psInfo.Name)
+				ingestLog.Errorf("failed to create process record: %v\n", psInfo.Name)
 				continue
 			}
 			processPtr = &processItem
+			s.cacheProcess(processPtr)
 		}
 
 		s.addMetrics(psInfo.Metrics, cluster.ID, node.ID, *processPtr)
@@ -518,19 +729,19 @@ func (s *NexServer) UpdateProcess(ctx context.Context, in *pb.ProcessAll) (*pb.R
 func (s *NexServer) UpdateContainer(ctx context.Context, in *pb.ContainerAll) (*pb.Response, error) {
 	_, err := s.mustValidAgent(ctx)
 	if err != nil {
-		log.Printf("UpdateContainer: invalid agent: %s\n", in.Host)
+		ingestLog.Warnf("UpdateContainer: invalid agent: %s\n", in.Host)
 		return nil, err
 	}
 
 	cluster, err := s.mustValidCluster(in.Cluster)
 	if err != nil {
-		log.Printf("UpdateContainer: invalid cluster: %s\n", in.Host)
+		ingestLog.Warnf("UpdateContainer: invalid cluster: %s\n", in.Host)
 		return nil, err
 	}
 
 	node, err := s.mustValidNode(in.Host, cluster.ID)
 	if err != nil {
-		log.Printf("UpdateContainer: invalid node: %s\n", in.Host)
+		ingestLog.Warnf("UpdateContainer: invalid node: %s\n", in.Host)
 		return nil, err
 	}
 
@@ -551,10 +762,11 @@ func (s *NexServer) UpdateContainer(ctx context.Context, in *pb.ContainerAll) (*
 
 			result := s.db.Create(&containerItem)
 			if result.Error != nil {
-				log.Printf("Failed create new container: %v\n", containerItem.Name)
+				ingestLog.Errorf("Failed create new container: %v\n", containerItem.Name)
 				continue
 			}
 			containerPtr = &containerItem
+			s.cacheContainer(containerPtr)
 		}
 
 		s.addMetrics(containerInfo.Metrics, cluster.ID, node.ID, *containerPtr)
@@ -566,33 +778,76 @@ func (s *NexServer) UpdateContainer(ctx context.Context, in *pb.ContainerAll) (*
 func (s *NexServer) Start() error {
 	_, err := s.initCache()
 	if err != nil {
-		log.Fatalf("Server: failed to start: %v\n", err)
+		serverLog.Fatalf("Server: failed to start: %v\n", err)
+	}
+
+	if err := s.loadCatalogs(); err != nil {
+		serverLog.Errorf("I18n: failed to load message catalogs: %v\n", err)
 	}
 
+	if err := s.loadRetentionFile(); err != nil {
+		schedulerLog.Errorf("Retention: failed to load %s: %v\n", s.config.Retention.File, err)
+	}
+
+	if err := s.loadPrecisionFile(); err != nil {
+		ingestLog.Errorf("Precision: failed to load %s: %v\n", s.config.Precision.File, err)
+	}
+
+	if err := s.initCrypto(); err != nil {
+		return err
+	}
+
+	s.valueValidator = NewValueValidator(s.config.ValueValidation)
+	s.webhooks = NewWebhookDispatcher(s.config.Webhook)
+	s.metricWriter = NewMetricWriter(s.config.Ingest)
+
 	listenPort := fmt.Sprintf("%s:%d",
 		s.config.Server.BindAddress, s.config.Server.AgentListenPort)
 	listen, err := net.Listen("tcp", listenPort)
 	if err != nil {
 		return err
 	}
-	log.Println("Server: listen at", listenPort)
+	serverLog.Infof("Server: listen at %s", listenPort)
 
+	s.initTracer()
+	s.initSiem()
 	s.SetupApiHandler()
 
-	srv := grpc.NewServer(
+	options := []grpc.ServerOption{
 		grpc.KeepaliveEnforcementPolicy(kaep),
-		grpc.KeepaliveParams(kasp))
+		grpc.KeepaliveParams(kasp),
+		grpc.UnaryInterceptor(s.UnaryInterceptor),
+		grpc.StreamInterceptor(s.StreamInterceptor),
+	}
+	if s.tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(s.tlsConfig.Clone())))
+	}
+
+	srv := grpc.NewServer(options...)
 
 	pb.RegisterCollectorServer(srv, s)
 	s.serverStartTs = time.Now()
 
+	s.lifecycle.Lock()
+	s.lifecycle.grpc = srv
+	s.lifecycle.Unlock()
+	go s.handleSignals()
+
+	go s.InitShardMembership()
 	go s.InitBasicRuleChecker()
+	go s.InitWebhookDispatcher()
+	go s.InitMetricWriter()
+	go s.InitApiUsage()
+	go s.InitRateLimiter()
+	go s.InitCounterTracker()
+	go s.InitGCWatcher()
+	go s.InitScheduler()
 
 	if err := srv.Serve(listen); err != nil {
 		return err
 	}
 
-	return nil
+	return s.waitShutdown()
 }
 
 func (s *NexServer) LoadConfig(configPath string) error {
@@ -632,6 +887,13 @@ func NewNexServer() *NexServer {
 		metricSaveCounterLock: sync.RWMutex{},
 		incidentMap:           make(map[string][]*IncidentItem),
 		metricChannel:         make(chan Metric, 1024),
+		logBuffer:             NewLogBuffer(500),
+		grpcStats:             NewGrpcStats(),
+		counterTracker:        NewCounterTracker(),
+		digests:               NewDigestBuffer(),
+		commands:              NewAgentCommands(),
+		tails:                 NewTailHub(),
+		lifecycle:             newLifecycle(),
 	}
 
 	return server
@@ -643,6 +905,33 @@ func (s *NexServer) SetServerConfig(bindAddress string, agentPort, apiPort int)
 	s.config.Server.ApiPort = apiPort
 }
 
+func (s *NexServer) SetTrustedProxies(proxies []string) {
+	s.config.Server.TrustedProxies = proxies
+}
+
+func (s *NexServer) SetApiUnixSocket(socketPath string) {
+	s.config.Server.ApiUnixSocket = socketPath
+}
+
+func (s *NexServer) SetShutdownTimeout(seconds int) {
+	s.config.Server.ShutdownTimeout = seconds
+}
+
+func (s *NexServer) SetAdminServerConfig(bindAddress string, adminPort int, adminToken string) {
+	s.config.Server.AdminBindAddress = bindAddress
+	s.config.Server.AdminPort = adminPort
+	s.config.Server.AdminToken = adminToken
+}
+
+func (s *NexServer) SetLogConfig(level, format string) {
+	s.config.Log.Level = level
+	s.config.Log.Format = format
+}
+
+func (s *NexServer) SetQueryTimeout(seconds int) {
+	s.config.Database.QueryTimeout = seconds
+}
+
 func (s *NexServer) SetDatabaseConfig(dbHost string, dbPort int, dbUser, dbPass, dbName, dbSslMode string) {
 	dbConfig := DatabaseConfig{
 		Host:     dbHost,
@@ -653,11 +942,269 @@ func (s *NexServer) SetDatabaseConfig(dbHost string, dbPort int, dbUser, dbPass,
 		SslMode:  dbSslMode,
 	}
 
+	dbConfig.QueryTimeout = s.config.Database.QueryTimeout
 	s.config.Database = dbConfig
 }
 
-func (s *NexServer) SetBasicRule(nodeCpuLoad1, nodeDiskFree, nodeMemoryFree float64) {
+func (s *NexServer) SetTracingConfig(endpoint, serviceName string) {
+	s.config.Tracing.Use = endpoint != ""
+	s.config.Tracing.Endpoint = endpoint
+	s.config.Tracing.ServiceName = serviceName
+}
+
+func (s *NexServer) SetTLSConfig(use bool, certFile, keyFile string) {
+	s.config.TLS.Use = use
+	s.config.TLS.CertFile = certFile
+	s.config.TLS.KeyFile = keyFile
+}
+
+func (s *NexServer) SetAuthConfig(required bool, secret string, tokenHours int) {
+	s.config.Auth.Required = required
+	s.config.Auth.Secret = secret
+	s.config.Auth.TokenHours = tokenHours
+}
+
+func (s *NexServer) SetOIDCConfig(issuer, clientId, clientSecret, redirectUrl string, allowedDomains []string) {
+	domains := make([]string, 0, len(allowedDomains))
+	for _, domain := range allowedDomains {
+		domains = append(domains, strings.ToLower(domain))
+	}
+
+	s.config.Auth.OIDC = OIDCConfig{
+		Issuer:         issuer,
+		ClientId:       clientId,
+		ClientSecret:   clientSecret,
+		RedirectUrl:    redirectUrl,
+		AllowedDomains: domains,
+	}
+}
+
+func (s *NexServer) SetStrictCrypto(strict bool) {
+	s.config.Crypto.Strict = strict
+}
+
+func (s *NexServer) SetSiemConfig(siemType, url, token, source string) {
+	s.config.Siem.Type = siemType
+	s.config.Siem.Url = url
+	s.config.Siem.Token = token
+	s.config.Siem.Source = source
+}
+
+func (s *NexServer) SetRemoteWriteConfig(token string) {
+	s.config.RemoteWrite.Token = token
+}
+
+func (s *NexServer) SetRetentionConfig(file string) {
+	s.config.Retention.File = file
+}
+
+func (s *NexServer) SetPrecisionConfig(file string) {
+	s.config.Precision.File = file
+}
+
+func (s *NexServer) SetImageScanConfig(trivy, server string, intervalHours int) {
+	s.config.ImageScan.Trivy = trivy
+	s.config.ImageScan.Server = server
+	s.config.ImageScan.IntervalHours = intervalHours
+}
+
+func (s *NexServer) SetMeshProbeConfig(peers, port int) {
+	s.config.MeshProbe.Peers = peers
+	s.config.MeshProbe.Port = port
+}
+
+func (s *NexServer) SetStatusPageConfig(clusters []string, title, logoUrl, accentColor string,
+	uptimeTarget float64, windowDays int) {
+	if windowDays < 1 {
+		windowDays = 1
+	}
+
+	s.config.StatusPage.Clusters = clusters
+	s.config.StatusPage.Title = title
+	s.config.StatusPage.LogoUrl = logoUrl
+	s.config.StatusPage.AccentColor = accentColor
+	s.config.StatusPage.UptimeTarget = uptimeTarget
+	s.config.StatusPage.WindowDays = windowDays
+}
+
+func (s *NexServer) SetMetricNaming(enforce bool, reservedPrefixes []string) {
+	s.config.MetricNaming.Enforce = enforce
+	s.config.MetricNaming.ReservedPrefixes = reservedPrefixes
+}
+
+func (s *NexServer) SetValueValidation(action string, maxAbsValue float64) {
+	s.config.ValueValidation.Action = action
+	s.config.ValueValidation.MaxAbsValue = maxAbsValue
+}
+
+func (s *NexServer) SetIngestQuota(maxSeries int) {
+	s.config.IngestQuota.MaxSeries = maxSeries
+}
+
+func (s *NexServer) SetRateLimit(ipRate float64, ipBurst int, keyRate float64, keyBurst int) {
+	s.config.RateLimit = RateLimitConfig{
+		IpRate:   ipRate,
+		IpBurst:  ipBurst,
+		KeyRate:  keyRate,
+		KeyBurst: keyBurst,
+	}
+}
+
+func (s *NexServer) SetGCConfig(retentionDays, intervalMinutes int) {
+	s.config.GC.RetentionDays = retentionDays
+	s.config.GC.IntervalMinutes = intervalMinutes
+}
+
+func (s *NexServer) SetClusterRestoreHours(restoreHours int) {
+	s.config.Cluster.RestoreHours = restoreHours
+}
+
+func (s *NexServer) SetProbeConfig(knownHostsFile string, insecure bool) {
+	s.config.Probe.KnownHostsFile = knownHostsFile
+	s.config.Probe.Insecure = insecure
+}
+
+func (s *NexServer) SetEnrollmentRequired(required bool) {
+	s.config.Cluster.EnrollmentRequired = required
+}
+
+func (s *NexServer) SetIngestConfig(batchSize, flushMs, queueSize int) {
+	s.config.Ingest.BatchSize = batchSize
+	s.config.Ingest.FlushMs = flushMs
+	s.config.Ingest.QueueSize = queueSize
+}
+
+func (s *NexServer) SetWebhookConfig(maxRetries, timeoutSeconds int) {
+	s.config.Webhook.MaxRetries = maxRetries
+	s.config.Webhook.TimeoutSeconds = timeoutSeconds
+}
+
+func (s *NexServer) SetCMDBConfig(cmdbType, url, user, password, token, className string,
+	intervalMinutes int, fieldMap []string) {
+	s.config.CMDB.Type = cmdbType
+	s.config.CMDB.Url = url
+	s.config.CMDB.User = user
+	s.config.CMDB.Password = password
+	s.config.CMDB.Token = token
+	s.config.CMDB.ClassName = className
+	s.config.CMDB.IntervalMinutes = intervalMinutes
+
+	for _, field := range fieldMap {
+		pair := strings.SplitN(field, "=", 2)
+		if len(pair) != 2 {
+			ingestLog.Warnf("CMDB: invalid field mapping %s\n", field)
+			continue
+		}
+		if s.config.CMDB.FieldMap == nil {
+			s.config.CMDB.FieldMap = make(map[string]string)
+		}
+		s.config.CMDB.FieldMap[pair[0]] = pair[1]
+	}
+}
+
+// SetJobSchedules overrides job schedules given as "job=schedule".
+func (s *NexServer) SetJobSchedules(schedules []string) error {
+	jobs := make(map[string]string)
+	for _, schedule := range schedules {
+		parts := strings.SplitN(schedule, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("invalid job schedule %q", schedule)
+		}
+		jobs[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+
+	s.config.Jobs = jobs
+
+	return nil
+}
+
+// SetFeatures overrides the default state of features given as
+// "feature=true" or "feature=false".
+func (s *NexServer) SetFeatures(values []string) error {
+	flags := make(map[string]bool)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid feature %q", value)
+		}
+
+		name := strings.TrimSpace(parts[0])
+		if findFeature(name) == nil {
+			return fmt.Errorf("unknown feature %q", name)
+		}
+		enabled, err := strconv.ParseBool(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return fmt.Errorf("invalid feature %q: %v", value, err)
+		}
+		flags[name] = enabled
+	}
+
+	s.config.Features = flags
+
+	return nil
+}
+
+func (s *NexServer) SetI18nConfig(dir, locale string) {
+	s.config.I18n.Dir = dir
+	s.config.I18n.DefaultLocale = locale
+}
+
+func (s *NexServer) SetShardConfig(enabled bool, name, address string, virtualNodes int) {
+	s.config.Shard.Enabled = enabled
+	s.config.Shard.Name = name
+	s.config.Shard.Address = address
+	s.config.Shard.VirtualNodes = virtualNodes
+}
+
+func (s *NexServer) SetBundleConfig(site, exportDir, importDir string, intervalMinutes int, key string) {
+	s.config.Bundle.Site = site
+	s.config.Bundle.ExportDir = exportDir
+	s.config.Bundle.ImportDir = importDir
+	s.config.Bundle.IntervalMinutes = intervalMinutes
+	s.config.Bundle.Key = key
+}
+
+func (s *NexServer) SetChangePointConfig(metricNames []string, intervalMinutes, windowHours int,
+	threshold, minShiftPercent float64) {
+	s.config.ChangePoint.MetricNames = metricNames
+	s.config.ChangePoint.IntervalMinutes = intervalMinutes
+	s.config.ChangePoint.WindowHours = windowHours
+	s.config.ChangePoint.Threshold = threshold
+	s.config.ChangePoint.MinShiftPercent = minShiftPercent
+}
+
+func (s *NexServer) SetRuleSeverities(severities []string) {
+	for _, severity := range severities {
+		pair := strings.SplitN(severity, "=", 2)
+		if len(pair) != 2 || !isValidSeverity(pair[1]) {
+			incidentLog.Warnf("Rule: invalid severity %s\n", severity)
+			continue
+		}
+		if s.config.BasicRule.Severities == nil {
+			s.config.BasicRule.Severities = make(map[string]string)
+		}
+		s.config.BasicRule.Severities[pair[0]] = pair[1]
+	}
+}
+
+func (s *NexServer) SetBasicRule(nodeCpuLoad1, nodeDiskFree, nodeMemoryFree, nodeAuthFailures float64) {
 	s.config.BasicRule.NodeCpuLoad1 = nodeCpuLoad1
 	s.config.BasicRule.NodeDiskFree = nodeDiskFree
 	s.config.BasicRule.NodeMemoryFree = nodeMemoryFree
+	s.config.BasicRule.NodeAuthFailures = nodeAuthFailures
+}
+
+func (s *NexServer) SetProcessRule(zombies, uninterruptible, deletedBinaries float64) {
+	s.config.BasicRule.NodeZombies = zombies
+	s.config.BasicRule.NodeUninterruptible = uninterruptible
+	s.config.BasicRule.NodeDeletedBinaries = deletedBinaries
+}
+
+func (s *NexServer) SetCronJobRule(successHours float64) {
+	s.config.BasicRule.CronJobSuccessHours = successHours
+}
+
+func (s *NexServer) SetEphemeralStorageRule(node, pod float64) {
+	s.config.BasicRule.NodeEphemeral = node
+	s.config.BasicRule.PodEphemeral = pod
 }
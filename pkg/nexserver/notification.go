@@ -0,0 +1,191 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultDigestMinutes = 60
+
+type DigestItem struct {
+	Rule     string        `json:"rule"`
+	Severity string        `json:"severity"`
+	Message  string        `json:"message"`
+	Incident *IncidentItem `json:"incident"`
+	OnCall   *OnCallMember `json:"on_call,omitempty"`
+}
+
+// DigestBuffer holds incidents per subscription until the subscription's
+// digest interval elapses.
+type DigestBuffer struct {
+	sync.Mutex
+
+	pending   map[uint][]DigestItem
+	lastFlush map[uint]time.Time
+}
+
+func NewDigestBuffer() *DigestBuffer {
+	return &DigestBuffer{
+		pending:   make(map[uint][]DigestItem),
+		lastFlush: make(map[uint]time.Time),
+	}
+}
+
+func (d *DigestBuffer) Add(subscriptionId uint, item DigestItem) {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, found := d.lastFlush[subscriptionId]; !found {
+		d.lastFlush[subscriptionId] = time.Now()
+	}
+	d.pending[subscriptionId] = append(d.pending[subscriptionId], item)
+}
+
+// Take returns the pending items of the subscription if its interval has
+// elapsed, and resets the buffer.
+func (d *DigestBuffer) Take(subscriptionId uint, interval time.Duration) ([]DigestItem, time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	since := d.lastFlush[subscriptionId]
+	if len(d.pending[subscriptionId]) == 0 || time.Since(since) < interval {
+		return nil, since
+	}
+
+	items := d.pending[subscriptionId]
+	delete(d.pending, subscriptionId)
+	d.lastFlush[subscriptionId] = time.Now()
+
+	return items, since
+}
+
+func (s *Subscription) digests(severity string) bool {
+	if !s.Digest {
+		return false
+	}
+	if s.DigestSeverities == "" {
+		return severity != SeverityCritical
+	}
+
+	return stringInSlice(severity, strings.Split(s.DigestSeverities, ","))
+}
+
+func (s *Subscription) digestInterval() time.Duration {
+	if s.DigestMinutes > 0 {
+		return time.Duration(s.DigestMinutes) * time.Minute
+	}
+
+	return defaultDigestMinutes * time.Minute
+}
+
+// notifyIncident sends a new incident to every subscribed channel, either
+// right away or through the channel's digest.
+func (s *NexServer) notifyIncident(eventName string, item *IncidentItem) {
+	if s.webhooks == nil {
+		return
+	}
+
+	var subscriptions []Subscription
+	result := s.db.Where("disabled=?", false).Find(&subscriptions)
+	if result.Error != nil {
+		incidentLog.Errorf("Notification: failed to get subscriptions: %v\n", result.Error)
+		return
+	}
+
+	team := s.incidentTeam(item)
+	if team != nil {
+		s.addIncidentTimeline(item.Id, "routed", team.Name)
+	}
+
+	severity := item.Severity
+	digestItem := DigestItem{Rule: eventName, Severity: severity, Incident: item}
+
+	for _, subscription := range routedSubscriptions(subscriptions, team, item.ClusterId) {
+		if !subscription.matches(EventIncidentFired, item.ClusterId) {
+			continue
+		}
+
+		target := digestItem
+		target.Message = s.incidentDescription(s.matchLocale(subscription.Locale),
+			item.EventName, item.Target, item.Value, item.Condition)
+		if subscription.OnCallScheduleID != 0 {
+			onCall, err := s.currentOnCall(subscription.OnCallScheduleID, item.DetectedTs)
+			if err != nil {
+				incidentLog.Warnf("Notification: subscription %d: %v\n", subscription.ID, err)
+			}
+			target.OnCall = onCall
+		}
+
+		if subscription.digests(severity) {
+			s.digests.Add(subscription.ID, target)
+			s.addIncidentTimeline(item.Id, "digested", subscription.Url)
+			continue
+		}
+
+		if !subscription.pagesNow(severity, item.DetectedTs) {
+			// held until the channel's next digest, or dropped without one
+			if subscription.Digest {
+				s.digests.Add(subscription.ID, target)
+				s.addIncidentTimeline(item.Id, "digested", subscription.Url)
+			}
+			continue
+		}
+
+		event := newWebhookEvent(EventIncidentFired, item.ClusterId, target)
+		event.Message = target.Message
+		s.enqueueWebhook(subscription, event)
+		s.addIncidentTimeline(item.Id, "notified", subscription.Url)
+	}
+}
+
+func (s *NexServer) flushDigests() error {
+	var subscriptions []Subscription
+	result := s.db.Where("disabled=? AND digest=?", false, true).Find(&subscriptions)
+	if result.Error != nil {
+		return fmt.Errorf("failed to get subscriptions: %v", result.Error)
+	}
+
+	for _, subscription := range subscriptions {
+		items, since := s.digests.Take(subscription.ID, subscription.digestInterval())
+		if len(items) == 0 {
+			continue
+		}
+
+		counts := make(map[string]int)
+		for _, item := range items {
+			counts[item.Severity] += 1
+		}
+
+		event := newWebhookEvent(EventIncidentDigest, subscription.ClusterID,
+			map[string]interface{}{
+				"from":      since,
+				"to":        time.Now(),
+				"count":     len(items),
+				"severity":  counts,
+				"incidents": items,
+			})
+		event.Message = s.translate(s.matchLocale(subscription.Locale), "%[1]d incidents since %[2]s",
+			len(items), since.Format(time.RFC3339))
+		s.enqueueWebhook(subscription, event)
+	}
+
+	return nil
+}
@@ -0,0 +1,464 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/NexClipper/NexClipper/pkg/nexcrypto"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OIDC sign-in uses the authorization code flow: /auth/oidc/login
+// redirects to the provider with a random state, kept in a cookie and
+// used as the nonce, and /auth/oidc/callback exchanges the code for an ID
+// token. The ID token is verified (RS256) against the keys published by
+// the provider. The user is matched by subject and created on first
+// sign-in; AllowedDomains restricts sign-in to verified emails of these
+// domains.
+
+const (
+	oidcStateCookie     = "nexclipper_oidc_state"
+	oidcStateTTL        = 10 * time.Minute
+	oidcProviderRefresh = time.Hour
+	oidcKeysRefresh     = time.Minute
+	oidcTimeout         = 10 * time.Second
+	maxOIDCResponse     = 1024 * 1024
+)
+
+type OIDCConfig struct {
+	Issuer         string
+	ClientId       string
+	ClientSecret   string `secret:"true"`
+	RedirectUrl    string
+	AllowedDomains []string
+}
+
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+
+	keys         map[string]*rsa.PublicKey
+	loadedTs     time.Time
+	keysLoadedTs time.Time
+}
+
+type oidcClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	ExpiresAt         int64           `json:"exp"`
+	Nonce             string          `json:"nonce"`
+	Email             string          `json:"email"`
+	EmailVerified     bool            `json:"email_verified"`
+	Name              string          `json:"name"`
+	PreferredUsername string          `json:"preferred_username"`
+}
+
+func (s *NexServer) oidcEnabled() bool {
+	return s.config.Auth.OIDC.Issuer != "" && s.config.Auth.OIDC.ClientId != ""
+}
+
+func oidcGet(client *http.Client, target string, value interface{}) error {
+	resp, err := client.Get(target)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s: status %d", target, resp.StatusCode)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponse)).Decode(value)
+}
+
+func newOIDCClient() (*http.Client, error) {
+	tlsConfig, err := nexcrypto.ClientTLSConfig("")
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Timeout:   oidcTimeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+	}, nil
+}
+
+func parseJWK(n, e string) (*rsa.PublicKey, error) {
+	modulus, err := base64.RawURLEncoding.DecodeString(n)
+	if err != nil {
+		return nil, err
+	}
+	exponent, err := base64.RawURLEncoding.DecodeString(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(modulus),
+		E: int(new(big.Int).SetBytes(exponent).Int64()),
+	}, nil
+}
+
+func (provider *oidcProvider) loadKeys(client *http.Client) error {
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := oidcGet(client, provider.JwksUri, &jwks); err != nil {
+		return err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		key, err := parseJWK(jwk.N, jwk.E)
+		if err != nil {
+			apiLog.Warnf("OIDC: invalid key %s: %v\n", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	provider.keys = keys
+	provider.keysLoadedTs = time.Now()
+
+	return nil
+}
+
+// oidcProvider returns the discovered provider, with its keys reloaded if
+// kid is unknown (the provider rotated its keys).
+func (s *NexServer) oidcProvider(client *http.Client, kid string) (*oidcProvider, error) {
+	s.auth.Lock()
+	defer s.auth.Unlock()
+
+	provider := s.auth.provider
+	if provider == nil || time.Since(provider.loadedTs) > oidcProviderRefresh {
+		issuer := strings.TrimSuffix(s.config.Auth.OIDC.Issuer, "/")
+
+		var discovered oidcProvider
+		if err := oidcGet(client, issuer+"/.well-known/openid-configuration", &discovered); err != nil {
+			return nil, fmt.Errorf("failed to discover provider: %v", err)
+		}
+		if strings.TrimSuffix(discovered.Issuer, "/") != issuer {
+			return nil, fmt.Errorf("provider issuer %s does not match %s", discovered.Issuer, issuer)
+		}
+		if err := discovered.loadKeys(client); err != nil {
+			return nil, fmt.Errorf("failed to load provider keys: %v", err)
+		}
+
+		discovered.loadedTs = time.Now()
+		provider = &discovered
+		s.auth.provider = provider
+	}
+
+	if _, found := provider.keys[kid]; kid != "" && !found && time.Since(provider.keysLoadedTs) > oidcKeysRefresh {
+		if err := provider.loadKeys(client); err != nil {
+			return nil, fmt.Errorf("failed to load provider keys: %v", err)
+		}
+	}
+
+	return provider, nil
+}
+
+func (claims *oidcClaims) hasAudience(clientId string) bool {
+	var single string
+	if err := json.Unmarshal(claims.Audience, &single); err == nil {
+		return single == clientId
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(claims.Audience, &multiple); err == nil {
+		return stringInSlice(clientId, multiple)
+	}
+
+	return false
+}
+
+func (s *NexServer) verifyIDToken(client *http.Client, token, nonce string) (*oidcClaims, error) {
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var claims oidcClaims
+
+	signed, signature, err := decodeJWT(token, &header, &claims)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported algorithm %s", header.Alg)
+	}
+
+	provider, err := s.oidcProvider(client, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	s.auth.RLock()
+	key, found := provider.keys[header.Kid]
+	s.auth.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("unknown key %s", header.Kid)
+	}
+
+	hashed := sha256.Sum256([]byte(signed))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature); err != nil {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	if claims.Issuer != provider.Issuer {
+		return nil, fmt.Errorf("invalid issuer")
+	}
+	if !claims.hasAudience(s.config.Auth.OIDC.ClientId) {
+		return nil, fmt.Errorf("invalid audience")
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("token expired")
+	}
+	if subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("no subject")
+	}
+
+	return &claims, nil
+}
+
+func (s *NexServer) oidcAllowed(claims *oidcClaims) bool {
+	domains := s.config.Auth.OIDC.AllowedDomains
+	if len(domains) == 0 {
+		return true
+	}
+	if !claims.EmailVerified {
+		return false
+	}
+
+	at := strings.LastIndex(claims.Email, "@")
+	if at < 0 {
+		return false
+	}
+
+	return stringInSlice(strings.ToLower(claims.Email[at+1:]), domains)
+}
+
+func (s *NexServer) exchangeOIDCCode(client *http.Client, provider *oidcProvider, code string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {s.config.Auth.OIDC.RedirectUrl},
+		"client_id":     {s.config.Auth.OIDC.ClientId},
+		"client_secret": {s.config.Auth.OIDC.ClientSecret},
+	}
+
+	resp, err := client.PostForm(provider.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxOIDCResponse))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("token endpoint: status %d: %s", resp.StatusCode, body)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil || tokens.IDToken == "" {
+		return "", fmt.Errorf("token endpoint: no id_token")
+	}
+
+	return tokens.IDToken, nil
+}
+
+// findOIDCUser returns the user of the subject, created on first sign-in.
+func (s *NexServer) findOIDCUser(c *gin.Context, claims *oidcClaims) (*User, error) {
+	var user User
+	result := s.requestDB(c).Where("provider=? AND subject=?", UserProviderOIDC, claims.Subject).First(&user)
+	if result.Error == nil {
+		user.Email = claims.Email
+		user.DisplayName = claims.Name
+		s.requestDB(c).Model(&user).Updates(map[string]interface{}{
+			"email": claims.Email, "display_name": claims.Name})
+		return &user, nil
+	}
+
+	username := claims.PreferredUsername
+	if username == "" {
+		username = claims.Email
+	}
+	if username == "" {
+		username = claims.Subject
+	}
+
+	var count int
+	s.requestDB(c).Model(&User{}).Where("username=?", username).Count(&count)
+	if count > 0 {
+		return nil, fmt.Errorf("username %s already exists", username)
+	}
+
+	user = User{
+		Username:    username,
+		Email:       claims.Email,
+		DisplayName: claims.Name,
+		Provider:    UserProviderOIDC,
+		Subject:     claims.Subject,
+	}
+	if result := s.requestDB(c).Create(&user); result.Error != nil {
+		return nil, result.Error
+	}
+	requestLog(c).Infof("OIDC: user %s created\n", username)
+
+	return &user, nil
+}
+
+func (s *NexServer) ApiOIDCLogin(c *gin.Context) {
+	if !s.oidcEnabled() {
+		s.ApiResponseJson(c, 404, "bad", "oidc is not configured")
+		return
+	}
+
+	client, err := newOIDCClient()
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create client: %v", err)
+		return
+	}
+	provider, err := s.oidcProvider(client, "")
+	if err != nil {
+		s.ApiResponseJsonf(c, 502, "bad", "oidc provider unavailable: %v", err)
+		return
+	}
+
+	state, err := newEmbedKey()
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create state: %v", err)
+		return
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/v1/auth/oidc/",
+		Expires:  time.Now().Add(oidcStateTTL),
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {s.config.Auth.OIDC.ClientId},
+		"redirect_uri":  {s.config.Auth.OIDC.RedirectUrl},
+		"scope":         {"openid email profile"},
+		"state":         {state},
+		"nonce":         {state},
+	}
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	c.Redirect(302, provider.AuthorizationEndpoint+separator+query.Encode())
+}
+
+func (s *NexServer) ApiOIDCCallback(c *gin.Context) {
+	if !s.oidcEnabled() {
+		s.ApiResponseJson(c, 404, "bad", "oidc is not configured")
+		return
+	}
+	if providerError := c.Query("error"); providerError != "" {
+		s.ApiResponseJsonf(c, 401, "bad", "sign-in failed: %s", providerError)
+		return
+	}
+
+	state, err := c.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+		s.ApiResponseJson(c, 400, "bad", "invalid state")
+		return
+	}
+	http.SetCookie(c.Writer, &http.Cookie{Name: oidcStateCookie, Path: "/api/v1/auth/oidc/", MaxAge: -1})
+
+	client, err := newOIDCClient()
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create client: %v", err)
+		return
+	}
+	provider, err := s.oidcProvider(client, "")
+	if err != nil {
+		s.ApiResponseJsonf(c, 502, "bad", "oidc provider unavailable: %v", err)
+		return
+	}
+
+	idToken, err := s.exchangeOIDCCode(client, provider, c.Query("code"))
+	if err != nil {
+		s.ApiResponseJsonf(c, 502, "bad", "failed to exchange code: %v", err)
+		return
+	}
+
+	claims, err := s.verifyIDToken(client, idToken, state)
+	if err != nil {
+		s.ApiResponseJsonf(c, 401, "bad", "invalid id token: %v", err)
+		return
+	}
+	if !s.oidcAllowed(claims) {
+		s.ApiResponseJson(c, 403, "bad", "email domain is not allowed")
+		return
+	}
+
+	user, err := s.findOIDCUser(c, claims)
+	if err != nil {
+		s.ApiResponseJsonf(c, 409, "bad", "failed to sign in: %v", err)
+		return
+	}
+	if user.Disabled {
+		s.ApiResponseJson(c, 403, "bad", "user is disabled")
+		return
+	}
+
+	if _, _, err := s.signIn(c, user); err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to issue token: %v", err)
+		return
+	}
+
+	c.Redirect(302, "/")
+}
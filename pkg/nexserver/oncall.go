@@ -0,0 +1,301 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm/dialects/postgres"
+	"time"
+)
+
+// On-call schedules rotate through their members every RotationHours
+// starting at StartTs. An override replaces the rotation for its window.
+
+type OnCallMember struct {
+	Name  string `json:"name" binding:"required"`
+	Email string `json:"email"`
+	Phone string `json:"phone"`
+}
+
+func (schedule *OnCallSchedule) members() []OnCallMember {
+	var members []OnCallMember
+
+	if err := json.Unmarshal(schedule.Members.RawMessage, &members); err != nil {
+		return nil
+	}
+
+	return members
+}
+
+func (schedule *OnCallSchedule) findMember(name string) *OnCallMember {
+	for _, member := range schedule.members() {
+		if member.Name == name {
+			return &member
+		}
+	}
+
+	return nil
+}
+
+// rotationMember returns the member on duty at the given time without
+// considering overrides.
+func (schedule *OnCallSchedule) rotationMember(at time.Time) *OnCallMember {
+	members := schedule.members()
+	if len(members) == 0 || at.Before(schedule.StartTs) {
+		return nil
+	}
+
+	rotation := time.Duration(schedule.RotationHours) * time.Hour
+	if rotation <= 0 {
+		rotation = 7 * 24 * time.Hour
+	}
+
+	shift := int64(at.Sub(schedule.StartTs) / rotation)
+	return &members[shift%int64(len(members))]
+}
+
+func (s *NexServer) currentOnCall(scheduleId uint, at time.Time) (*OnCallMember, error) {
+	var schedule OnCallSchedule
+	if result := s.db.Where("id=?", scheduleId).First(&schedule); result.Error != nil {
+		return nil, fmt.Errorf("invalid schedule id")
+	}
+
+	var override OnCallOverride
+	result := s.db.Where("on_call_schedule_id=? AND start_ts <= ? AND end_ts > ?", scheduleId, at, at).
+		Order("created_at DESC").First(&override)
+	if result.Error == nil {
+		if member := schedule.findMember(override.Member); member != nil {
+			return member, nil
+		}
+
+		return &OnCallMember{Name: override.Member}, nil
+	}
+
+	return schedule.rotationMember(at), nil
+}
+
+func (s *NexServer) ApiOnCallScheduleList(c *gin.Context) {
+	var schedules []OnCallSchedule
+
+	if result := s.requestDB(c).Order("id").Find(&schedules); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	type ScheduleItem struct {
+		Id            uint           `json:"id"`
+		Name          string         `json:"name"`
+		Timezone      string         `json:"timezone"`
+		RotationHours int            `json:"rotation_hours"`
+		StartTs       time.Time      `json:"start_ts"`
+		Members       []OnCallMember `json:"members"`
+		Current       *OnCallMember  `json:"current"`
+	}
+	items := make([]ScheduleItem, 0, len(schedules))
+
+	for idx := range schedules {
+		schedule := &schedules[idx]
+		current, _ := s.currentOnCall(schedule.ID, time.Now())
+
+		items = append(items, ScheduleItem{
+			Id:            schedule.ID,
+			Name:          schedule.Name,
+			Timezone:      schedule.Timezone,
+			RotationHours: schedule.RotationHours,
+			StartTs:       schedule.StartTs,
+			Members:       schedule.members(),
+			Current:       current,
+		})
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+func (s *NexServer) ApiCreateOnCallSchedule(c *gin.Context) {
+	type ScheduleRequest struct {
+		Name          string         `json:"name" binding:"required"`
+		Timezone      string         `json:"timezone"`
+		RotationHours int            `json:"rotation_hours"`
+		StartTs       time.Time      `json:"start_ts"`
+		Members       []OnCallMember `json:"members" binding:"required"`
+	}
+	var req ScheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	if req.Timezone == "" {
+		req.Timezone = "UTC"
+	}
+	location, err := time.LoadLocation(req.Timezone)
+	if err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid timezone: %s", req.Timezone)
+		return
+	}
+	if req.RotationHours <= 0 {
+		req.RotationHours = 7 * 24
+	}
+	if req.StartTs.IsZero() {
+		// rotations start at midnight in the schedule's timezone by default
+		now := time.Now().In(location)
+		req.StartTs = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	}
+
+	members, _ := json.Marshal(req.Members)
+	schedule := OnCallSchedule{
+		Name:          req.Name,
+		Timezone:      req.Timezone,
+		RotationHours: req.RotationHours,
+		StartTs:       req.StartTs,
+		Members:       postgres.Jsonb{RawMessage: members},
+	}
+	if result := s.requestDB(c).Create(&schedule); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create schedule: %v", result.Error)
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    gin.H{"id": schedule.ID},
+	})
+}
+
+func (s *NexServer) ApiDeleteOnCallSchedule(c *gin.Context) {
+	scheduleId, ok := s.idParam(c, "scheduleId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid schedule id")
+		return
+	}
+
+	result := s.requestDB(c).Where("id=?", scheduleId).Delete(&OnCallSchedule{})
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to delete schedule: %v", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		s.ApiResponseJson(c, 404, "bad", "invalid schedule id")
+		return
+	}
+	s.requestDB(c).Where("on_call_schedule_id=?", scheduleId).Delete(&OnCallOverride{})
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+func (s *NexServer) ApiCurrentOnCall(c *gin.Context) {
+	scheduleId, ok := s.idParam(c, "scheduleId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid schedule id")
+		return
+	}
+
+	at := time.Now()
+	if value := c.DefaultQuery("at", ""); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			s.ApiResponseJson(c, 404, "bad", "invalid time")
+			return
+		}
+		at = parsed
+	}
+
+	member, err := s.currentOnCall(scheduleId, at)
+	if err != nil {
+		s.ApiResponseJson(c, 404, "bad", err.Error())
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    member,
+	})
+}
+
+func (s *NexServer) ApiCreateOnCallOverride(c *gin.Context) {
+	scheduleId, ok := s.idParam(c, "scheduleId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid schedule id")
+		return
+	}
+
+	var schedule OnCallSchedule
+	if result := s.requestDB(c).Where("id=?", scheduleId).First(&schedule); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid schedule id")
+		return
+	}
+
+	type OverrideRequest struct {
+		Member  string    `json:"member" binding:"required"`
+		StartTs time.Time `json:"start_ts" binding:"required"`
+		EndTs   time.Time `json:"end_ts" binding:"required"`
+	}
+	var req OverrideRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+	if !req.EndTs.After(req.StartTs) {
+		s.ApiResponseJson(c, 400, "bad", "end_ts must be after start_ts")
+		return
+	}
+
+	override := OnCallOverride{
+		Member:           req.Member,
+		StartTs:          req.StartTs,
+		EndTs:            req.EndTs,
+		OnCallScheduleID: schedule.ID,
+	}
+	if result := s.requestDB(c).Create(&override); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create override: %v", result.Error)
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    gin.H{"id": override.ID},
+	})
+}
+
+func (s *NexServer) ApiDeleteOnCallOverride(c *gin.Context) {
+	params, ok := s.CheckRequiredParams(c, []string{"scheduleId", "overrideId"})
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "missing parameters")
+		return
+	}
+
+	result := s.requestDB(c).Where("id=? AND on_call_schedule_id=?", params["overrideId"], params["scheduleId"]).
+		Delete(&OnCallOverride{})
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to delete override: %v", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		s.ApiResponseJson(c, 404, "bad", "invalid override id")
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
@@ -0,0 +1,370 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// The OpenAPI document is generated from the routes registered on the API
+// router, so a new route is documented without further work: path
+// parameters come from the route, the operation from the handler name,
+// and every response uses the status/message/data envelope. The query
+// parameters and summaries that cannot be derived are kept in
+// apiRouteDocs, keyed by handler name.
+
+const openAPIVersion = "3.0.3"
+
+var routeParamPattern = regexp.MustCompile(`[:*]([A-Za-z0-9_]+)`)
+
+type apiParam struct {
+	Name        string
+	Description string
+	Type        string
+	Array       bool
+}
+
+type apiRouteDoc struct {
+	Summary string
+	Params  []apiParam
+}
+
+var metricQueryParams = []apiParam{
+	{Name: "query", Description: "Whole query as JSON, overrides the other parameters", Type: "string"},
+	{Name: "timezone", Description: "Timezone of the date range, UTC by default", Type: "string"},
+	{Name: "granularity", Description: "Bucket of the series, such as 1m or 1h", Type: "string"},
+	{Name: "dateRange", Description: "Start and end of the range, or one of last_15m, last_24h, last_7d, today, yesterday, this_week or this_month", Type: "string", Array: true},
+	{Name: "metricNames", Description: "Metric names to return", Type: "string", Array: true},
+	{Name: "aggregation", Description: "Function applied per bucket: avg (default), min, max, sum, p50, p95, p99 or last", Type: "string"},
+	{Name: "functions[metric]", Description: "rate or delta of a counter metric instead of the aggregation", Type: "string"},
+	{Name: "groupBy", Description: "Label keys to aggregate the series by, or none to collapse the labels", Type: "string", Array: true},
+}
+
+var nodeMetricParams = []apiParam{
+	{Name: "math", Description: "Two metrics combined with +, -, * or /, such as used/total, returned instead of the metrics", Type: "string"},
+	{Name: "resolution", Description: "sparkline for a few points per series with the min and max they stand for", Type: "string"},
+}
+
+var pageParams = []apiParam{
+	{Name: "limit", Description: "Page size, every row if not set", Type: "integer"},
+	{Name: "offset", Description: "Rows to skip, requires limit", Type: "integer"},
+}
+
+func withParams(lists ...[]apiParam) []apiParam {
+	params := make([]apiParam, 0, 8)
+	for _, list := range lists {
+		params = append(params, list...)
+	}
+
+	return params
+}
+
+var apiRouteDocs = map[string]apiRouteDoc{
+	"ApiHealth":                {Summary: "Check the server and its database"},
+	"ApiVersion":               {Summary: "Server version, git commit, schema version and enabled features"},
+	"ApiClusterList":           {Params: pageParams},
+	"ApiAgentList":             {Params: pageParams},
+	"ApiAgentListAll":          {Params: pageParams},
+	"ApiAgentProtocols":        {Summary: "Agent protocol versions, their commands and the agents on deprecated versions"},
+	"ApiAgentCollectors":       {Summary: "Health of the collectors of an agent, failing ones make it degraded"},
+	"ApiNodeList":              {Params: pageParams},
+	"ApiNodeListAll":           {Params: pageParams},
+	"ApiMetricNameList":        {Params: pageParams},
+	"ApiMetricsNodes":          {Summary: "Node metrics, with the samples of each bucket and the samples the report interval expects", Params: withParams(metricQueryParams, nodeMetricParams, pageParams)},
+	"ApiMetricsProcesses":      {Params: withParams(metricQueryParams, pageParams)},
+	"ApiMetricsContainers":     {Params: withParams(metricQueryParams, pageParams)},
+	"ApiMetricsPods":           {Params: withParams(metricQueryParams, pageParams)},
+	"ApiMetricsClusterSummary": {Params: withParams(metricQueryParams, pageParams)},
+	"ApiMetricsMultiCluster":   {Summary: "Query metrics across clusters", Params: metricQueryParams},
+	"ApiMetricsHeatmap":        {Params: metricQueryParams},
+	"ApiCounterResets":         {Params: metricQueryParams},
+	"ApiChangePoints":          {Params: metricQueryParams},
+	"ApiSeriesList":            {Params: metricQueryParams},
+	"ApiSeriesCardinality":     {Params: metricQueryParams},
+	"ApiSnapshotNodes":         {Summary: "Latest metrics of nodes", Params: metricQueryParams},
+	"ApiSnapshotProcesses":     {Summary: "Latest metrics of processes", Params: metricQueryParams},
+	"ApiSnapshotContainers":    {Summary: "Latest metrics of containers", Params: metricQueryParams},
+	"ApiSnapshotPods":          {Summary: "Latest metrics of pods", Params: metricQueryParams},
+	"ApiSnapshotCronJobs":      {Summary: "CronJobs with their last success and the Jobs of the last day"},
+	"ApiSnapshotK8sResources": {Summary: "Instances of the watched custom resources", Params: []apiParam{
+		{Name: "kind", Description: "Kind of the resources"},
+		{Name: "namespace", Description: "Namespace of the resources"},
+		{Name: "all", Description: "Include the deleted instances", Type: "boolean"}}},
+	"ApiSnapshotPorts": {Summary: "Listening sockets of a node", Params: []apiParam{
+		{Name: "all", Description: "Include the closed listeners", Type: "boolean"}}},
+	"ApiAcceptPorts":           {Summary: "Add the open listeners of a node to its baseline"},
+	"ApiVariables":             {Summary: "Resolve the template variables of a dashboard"},
+	"ApiRemoteWrite":           {Summary: "Prometheus remote_write receiver"},
+	"ApiValidateCustomMetrics": {Summary: "Check custom metrics as remote write would ingest them, without storing anything"},
+	"ApiEmbed":                 {Summary: "Serve the query of an embed token"},
+	"ApiFederate":              {Summary: "Latest samples in the Prometheus text format"},
+	"ApiLogin":                 {Summary: "Sign in with a local user"},
+	"ApiOIDCLogin":             {Summary: "Sign in with the OIDC provider"},
+	"ApiOIDCCallback":          {Summary: "Redirect target of the OIDC provider"},
+	"ApiAuthMe":                {Summary: "Principal of the request"},
+	"ApiSpec":                  {Summary: "This document"},
+	"ApiSpecUI":                {Summary: "Swagger UI of this document"},
+	"ApiStatusPage":            {Summary: "Public status page"},
+	"ApiStatusPageJson":        {Summary: "Public status page as JSON"},
+	"ApiTailNodeMetric":        {Summary: "Stream a node metric at a high rate"},
+	"ApiRetentionList":         {Summary: "Retention policies and the last purge"},
+	"ApiSyntheticRunBody":      {Summary: "Response body of a failed synthetic run"},
+	"ApiIncidentRoute":         {Summary: "Recorded incident, or the incidents of the basic detector with the id basic"},
+	"ApiImageScanList": {Summary: "Scanned images with severity counts and workloads", Params: []apiParam{
+		{Name: "severity", Description: "Only images with findings of at least critical, high or medium", Type: "string"}}},
+	"ApiKernelEventList": {Summary: "OOM kills, I/O errors and hardware faults from the kernel log", Params: withParams([]apiParam{
+		{Name: "kind", Description: "oom_kill, io_error or hardware_error", Type: "string"},
+		{Name: "nodeId", Description: "Only the events of the node", Type: "integer"}}, pageParams)},
+	"ApiRescanImage": {Summary: "Scan an image on the next run"},
+	"ApiExportMetricsCsv": {Summary: "Node metrics as a CSV download", Params: withParams([]apiParam{
+		{Name: "nodeId", Description: "Only the metrics of the node", Type: "integer"}}, metricQueryParams, nodeMetricParams)},
+	"ApiGraphql": {Summary: "GraphQL query over clusters, nodes, containers, pods and their metrics", Params: []apiParam{
+		{Name: "query", Description: "GraphQL query, for GET", Type: "string"},
+		{Name: "variables", Description: "Variables of the query as JSON, for GET", Type: "string"}}},
+	"ApiMeshMatrix": {Summary: "Latest latency and bandwidth between the nodes of a cluster"},
+	"ApiDeleteCluster": {Summary: "Delete a cluster, restorable until it is purged", Params: []apiParam{
+		{Name: "purge", Description: "Purge a deleted cluster with its agents, nodes and metrics in the background", Type: "boolean"}}},
+	"ApiRenameCluster": {Summary: "Rename a cluster, agents reporting the previous name stay in it"},
+	"ApiMergeCluster":  {Summary: "Merge the cluster of cluster_id with its agents, nodes and metrics into the cluster, in the background"},
+	"ApiClusterTask":   {Summary: "Last purge or merge of a cluster"},
+	"ApiMetricRollups": {Summary: "Hourly rows of a metric packed by retention past downsample_days", Params: []apiParam{
+		{Name: "metricName", Description: "Metric name", Type: "string"},
+		{Name: "nodeId", Description: "Only the rollups of the node", Type: "integer"},
+		{Name: "from", Description: "Start of the range, RFC3339, 30 days ago by default", Type: "string"},
+		{Name: "to", Description: "End of the range, RFC3339, now by default", Type: "string"}}},
+	"ApiDeregisterAgent":       {Summary: "Remove an agent, its node and metrics are kept"},
+	"ApiDisableAgent":          {Summary: "Refuse the data of an agent until it is enabled"},
+	"ApiEnableAgent":           {Summary: "Accept the data of a disabled agent again"},
+	"ApiEnrollmentTokenList":   {Summary: "Enrollment tokens of a cluster, without their secret"},
+	"ApiCreateEnrollmentToken": {Summary: "Issue an enrollment token for new agents of a cluster, shown only once"},
+	"ApiRotateEnrollmentToken": {Summary: "Replace an enrollment token, the previous one expiring after grace_hours"},
+	"ApiRevokeEnrollmentToken": {Summary: "Revoke an enrollment token, enrolled agents keep reporting"},
+}
+
+type OpenAPISpec struct {
+	sync.Mutex
+
+	document []byte
+}
+
+// handlerName returns the method name of a handler, e.g. ApiHealth for
+// github.com/NexClipper/NexClipper/pkg/nexserver.(*NexServer).ApiHealth-fm.
+func handlerName(name string) string {
+	if idx := strings.LastIndex(name, ")."); idx >= 0 {
+		name = name[idx+2:]
+	} else if idx := strings.LastIndex(name, "/"); idx >= 0 {
+		name = name[idx+1:]
+	}
+	name = strings.TrimSuffix(name, "-fm")
+	if idx := strings.Index(name, ".func"); idx >= 0 {
+		name = name[:idx]
+	}
+
+	return name
+}
+
+// summaryOf turns ApiSnapshotPorts into "Snapshot ports".
+func summaryOf(name string) string {
+	name = strings.TrimPrefix(name, "Api")
+
+	var words []string
+	start := 0
+	runes := []rune(name)
+	for idx := 1; idx < len(runes); idx++ {
+		nextLower := idx+1 < len(runes) && unicode.IsLower(runes[idx+1])
+		if unicode.IsUpper(runes[idx]) && (unicode.IsLower(runes[idx-1]) || nextLower) {
+			words = append(words, string(runes[start:idx]))
+			start = idx
+		}
+	}
+	words = append(words, string(runes[start:]))
+
+	for idx := 1; idx < len(words); idx++ {
+		if strings.ToUpper(words[idx]) != words[idx] {
+			words[idx] = strings.ToLower(words[idx])
+		}
+	}
+
+	return strings.Join(words, " ")
+}
+
+func routeTag(path string) string {
+	parts := strings.Split(strings.TrimPrefix(path, "/api/v1/"), "/")
+	if !strings.HasPrefix(path, "/api/v1/") || parts[0] == "" {
+		return "general"
+	}
+
+	return parts[0]
+}
+
+func paramSchema(param apiParam) gin.H {
+	if param.Array {
+		return gin.H{"type": "array", "items": gin.H{"type": param.Type}}
+	}
+
+	return gin.H{"type": param.Type}
+}
+
+func buildOpenAPI(routes gin.RoutesInfo) ([]byte, error) {
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].Path != routes[j].Path {
+			return routes[i].Path < routes[j].Path
+		}
+		return routes[i].Method < routes[j].Method
+	})
+
+	envelope := gin.H{"$ref": "#/components/schemas/Response"}
+	paths := make(map[string]gin.H)
+	operationIds := make(map[string]int)
+	for _, route := range routes {
+		name := handlerName(route.Handler)
+		doc := apiRouteDocs[name]
+
+		parameters := make([]gin.H, 0, 4)
+		for _, match := range routeParamPattern.FindAllStringSubmatch(route.Path, -1) {
+			schema := gin.H{"type": "string"}
+			if strings.HasSuffix(match[1], "Id") {
+				schema = gin.H{"type": "integer", "minimum": 1}
+			}
+			parameters = append(parameters, gin.H{
+				"name": match[1], "in": "path", "required": true, "schema": schema,
+			})
+		}
+		for _, param := range doc.Params {
+			parameter := gin.H{"name": param.Name, "in": "query", "schema": paramSchema(param)}
+			if param.Description != "" {
+				parameter["description"] = param.Description
+			}
+			parameters = append(parameters, parameter)
+		}
+
+		summary := doc.Summary
+		if summary == "" {
+			summary = summaryOf(name)
+		}
+
+		operationId := strings.TrimPrefix(name, "Api")
+		operationIds[operationId]++
+		if count := operationIds[operationId]; count > 1 {
+			operationId = fmt.Sprintf("%s%d", operationId, count)
+		}
+
+		operation := gin.H{
+			"operationId": operationId,
+			"summary":     summary,
+			"tags":        []string{routeTag(route.Path)},
+			"parameters":  parameters,
+			"responses": gin.H{
+				"200":     gin.H{"description": "Success", "content": gin.H{"application/json": gin.H{"schema": envelope}}},
+				"default": gin.H{"description": "Error", "content": gin.H{"application/json": gin.H{"schema": envelope}}},
+			},
+		}
+		if route.Method == "POST" || route.Method == "PUT" {
+			operation["requestBody"] = gin.H{
+				"content": gin.H{"application/json": gin.H{"schema": gin.H{"type": "object"}}},
+			}
+		}
+		if isAuthExempt(route.Path) {
+			operation["security"] = []gin.H{}
+		}
+
+		path := routeParamPattern.ReplaceAllString(route.Path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = gin.H{}
+		}
+		paths[path][strings.ToLower(route.Method)] = operation
+	}
+
+	return json.Marshal(gin.H{
+		"openapi": openAPIVersion,
+		"info": gin.H{
+			"title":   "NexClipper API",
+			"version": NexServerVersion,
+		},
+		"servers": []gin.H{{"url": "/"}},
+		"paths":   paths,
+		"components": gin.H{
+			"schemas": gin.H{
+				"Response": gin.H{
+					"type": "object",
+					"properties": gin.H{
+						"status":  gin.H{"type": "string", "enum": []string{"ok", "bad"}},
+						"message": gin.H{"type": "string"},
+						"data":    gin.H{},
+					},
+				},
+			},
+			"securitySchemes": gin.H{
+				"bearerAuth": gin.H{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+				"cookieAuth": gin.H{"type": "apiKey", "in": "cookie", "name": authCookieName},
+			},
+		},
+		"security": []gin.H{{"bearerAuth": []string{}}, {"cookieAuth": []string{}}},
+	})
+}
+
+// ApiSpec serves the OpenAPI document, generated on the first request
+// once every route is registered.
+func (s *NexServer) ApiSpec(router *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s.openapi.Lock()
+		if s.openapi.document == nil {
+			document, err := buildOpenAPI(router.Routes())
+			if err != nil {
+				s.openapi.Unlock()
+				s.ApiResponseJsonf(c, 500, "bad", "failed to generate the specification: %v", err)
+				return
+			}
+			s.openapi.document = document
+		}
+		document := s.openapi.document
+		s.openapi.Unlock()
+
+		c.Data(200, "application/json; charset=utf-8", document)
+	}
+}
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>NexClipper API</title>
+<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@3/swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="https://unpkg.com/swagger-ui-dist@3/swagger-ui-bundle.js"></script>
+<script>
+window.onload = function () {
+  SwaggerUIBundle({url: "/api/v1/spec", dom_id: "#swagger-ui"});
+};
+</script>
+</body>
+</html>
+`
+
+// ApiSpecUI serves Swagger UI, loaded from unpkg, on top of /api/v1/spec.
+func (s *NexServer) ApiSpecUI(c *gin.Context) {
+	c.Data(200, "text/html; charset=utf-8", []byte(swaggerUIPage))
+}
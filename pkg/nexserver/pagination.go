@@ -0,0 +1,132 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"strconv"
+)
+
+// List endpoints return every row unless "limit" is given. Paged responses
+// carry the total number of rows next to the page so clients can tell how
+// many pages there are.
+
+const maxPageLimit = 10000
+
+type Page struct {
+	Limit  int
+	Offset int
+}
+
+// parsePage returns nil when the request is not paged.
+func (s *NexServer) parsePage(c *gin.Context) (*Page, error) {
+	limitParam := c.DefaultQuery("limit", "")
+	offsetParam := c.DefaultQuery("offset", "")
+	if limitParam == "" {
+		if offsetParam != "" {
+			return nil, fmt.Errorf("offset requires limit")
+		}
+		return nil, nil
+	}
+
+	limit, err := strconv.Atoi(limitParam)
+	if err != nil || limit <= 0 || limit > maxPageLimit {
+		return nil, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+	}
+
+	offset := 0
+	if offsetParam != "" {
+		offset, err = strconv.Atoi(offsetParam)
+		if err != nil || offset < 0 {
+			return nil, fmt.Errorf("invalid offset")
+		}
+	}
+
+	return &Page{Limit: limit, Offset: offset}, nil
+}
+
+func (p *Page) apply(db *gorm.DB) *gorm.DB {
+	if p == nil {
+		return db
+	}
+
+	return db.Limit(p.Limit).Offset(p.Offset)
+}
+
+// pagedRaw returns the paged query and the number of rows of the whole
+// result. Without a page the total is the number of rows returned, so it
+// is left to the caller (-1).
+func (s *NexServer) pagedRaw(c *gin.Context, q *SqlQuery, page *Page) (*gorm.DB, int, error) {
+	if err := q.Err(); err != nil {
+		return nil, 0, err
+	}
+	if page == nil {
+		return q.Raw(s.requestDB(c)), -1, nil
+	}
+
+	var total int
+	countQuery := NewSqlQuery("SELECT count(*) FROM (").AppendQuery(q).Append(") AS page_rows")
+	if err := countQuery.Raw(s.requestDB(c)).Row().Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	pagedQuery := NewSqlQuery("").AppendQuery(q).Append(" LIMIT ? OFFSET ?", page.Limit, page.Offset)
+
+	return pagedQuery.Raw(s.requestDB(c)), total, nil
+}
+
+// pagedModel counts the rows matched by db, which must name a model or a
+// table, and returns db limited to the page.
+func (s *NexServer) pagedModel(db *gorm.DB, page *Page) (*gorm.DB, int, error) {
+	if page == nil {
+		return db, -1, nil
+	}
+
+	var total int
+	if result := db.Count(&total); result.Error != nil {
+		return nil, 0, result.Error
+	}
+
+	return page.apply(db), total, nil
+}
+
+// pageResponse writes the list envelope. count is the number of items in
+// this response, total the number of rows of the whole result.
+func (s *NexServer) pageResponse(c *gin.Context, data interface{}, page *Page, count, total int, extra gin.H) {
+	if total < 0 {
+		total = count
+	}
+
+	response := gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    data,
+		"count":   count,
+		"total":   total,
+	}
+	if page != nil {
+		response["limit"] = page.Limit
+		response["offset"] = page.Offset
+	}
+	for key, value := range extra {
+		response[key] = value
+	}
+
+	c.JSON(200, response)
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/json"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// Connected agents are asked for their listening sockets every few
+// minutes. The listeners of the first inventory of a node are its
+// baseline; a listener appearing later is unexpected and raises an
+// incident until it closes or is accepted into the baseline. A listener
+// is identified by protocol, address and port, so a service restarted
+// under another pid is not reported.
+
+const (
+	defaultPortInventory = "@every 5m"
+	unexpectedListener   = "unexpected_listener"
+)
+
+type listenerReport struct {
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+	Pid      int    `json:"pid"`
+	Process  string `json:"process"`
+}
+
+func (s *NexServer) dispatchPortInventory() error {
+	s.RLock()
+	agents := make([]*Agent, 0, len(s.agentMap))
+	for _, agent := range s.agentMap {
+		agents = append(agents, agent)
+	}
+	s.RUnlock()
+
+	for _, agent := range agents {
+		if err := s.commands.send(agent.Uuid, newAgentCommand("ports")); err != nil {
+			ingestLog.Warnf("Ports: %v\n", err)
+		}
+	}
+
+	return nil
+}
+
+func listenerTarget(listener *ListeningSocket) string {
+	return fmt.Sprintf("%s %s:%d", listener.Protocol, listener.Address, listener.Port)
+}
+
+func (s *NexServer) updateListenerIncident(node *Node, listener *ListeningSocket) {
+	item := &IncidentItem{
+		ClusterId:  node.ClusterID,
+		NodeId:     node.ID,
+		TargetType: "PORT",
+		Target:     listenerTarget(listener),
+		Value:      float64(listener.Port),
+		EventName:  unexpectedListener,
+		ReportedTs: listener.LastSeenTs,
+		DetectedTs: time.Now(),
+	}
+	if listener.Process != "" {
+		item.Target = fmt.Sprintf("%s (%s)", item.Target, listener.Process)
+	}
+
+	if listener.Open && !listener.Expected {
+		if !s.IsExistIncident(unexpectedListener, item) {
+			s.AddIncident(unexpectedListener, item)
+		}
+		return
+	}
+	if s.IsExistIncident(unexpectedListener, item) {
+		s.ClearIncident(unexpectedListener, item)
+	}
+}
+
+func (s *NexServer) savePortInventory(agent *Agent, in *pb.CommandResult) (*pb.Response, error) {
+	if !in.Success {
+		ingestLog.Errorf("Ports: agent %s failed: %s\n", agent.Uuid, in.Error)
+		return s.response(true, 0, ""), nil
+	}
+
+	node := s.findNodeByAgent(agent)
+	if node == nil {
+		return nil, status.Error(codes.NotFound, "unknown node")
+	}
+
+	var reports []listenerReport
+	if err := json.Unmarshal(in.Data, &reports); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid port inventory")
+	}
+
+	var listeners []ListeningSocket
+	if result := s.db.Where("node_id=?", node.ID).Find(&listeners); result.Error != nil {
+		return nil, status.Error(codes.Internal, "failed to get listeners")
+	}
+
+	// the first inventory of the node is its baseline
+	baseline := len(listeners) == 0
+
+	known := make(map[string]*ListeningSocket)
+	for idx := range listeners {
+		known[listenerTarget(&listeners[idx])] = &listeners[idx]
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, report := range reports {
+		listener := &ListeningSocket{
+			Protocol:    report.Protocol,
+			Address:     report.Address,
+			Port:        report.Port,
+			Expected:    baseline,
+			FirstSeenTs: now,
+			ClusterID:   node.ClusterID,
+			NodeID:      node.ID,
+		}
+		target := listenerTarget(listener)
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+
+		if existing, found := known[target]; found {
+			listener = existing
+		}
+		listener.Pid = report.Pid
+		listener.Process = report.Process
+		listener.Open = true
+		listener.LastSeenTs = now
+
+		if result := s.db.Save(listener); result.Error != nil {
+			ingestLog.Errorf("Ports: failed to save listener %s of %s: %v\n", target, node.Host, result.Error)
+			continue
+		}
+		s.updateListenerIncident(node, listener)
+	}
+
+	for idx := range listeners {
+		listener := &listeners[idx]
+		if !listener.Open || seen[listenerTarget(listener)] {
+			continue
+		}
+
+		listener.Open = false
+		s.db.Model(listener).Update("open", false)
+		s.updateListenerIncident(node, listener)
+	}
+
+	return s.response(true, 0, ""), nil
+}
+
+type ListeningSocketItem struct {
+	Protocol    string    `json:"protocol"`
+	Address     string    `json:"address"`
+	Port        int       `json:"port"`
+	Pid         int       `json:"pid"`
+	Process     string    `json:"process"`
+	Open        bool      `json:"open"`
+	Expected    bool      `json:"expected"`
+	FirstSeenTs time.Time `json:"first_seen_ts"`
+	LastSeenTs  time.Time `json:"last_seen_ts"`
+}
+
+func (s *NexServer) ApiSnapshotPorts(c *gin.Context) {
+	clusterId, clusterOk := s.idParam(c, "clusterId", false)
+	nodeId, nodeOk := s.idParam(c, "nodeId", false)
+	if !clusterOk || !nodeOk {
+		s.ApiResponseJson(c, 404, "bad", "missing parameters")
+		return
+	}
+
+	db := s.requestDB(c).Where("cluster_id=? AND node_id=?", clusterId, nodeId)
+	if c.Query("all") != "true" {
+		db = db.Where("open=?", true)
+	}
+
+	var listeners []ListeningSocket
+	if result := db.Order("port, protocol, address").Find(&listeners); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	items := make([]ListeningSocketItem, 0, len(listeners))
+	for _, listener := range listeners {
+		items = append(items, ListeningSocketItem{
+			Protocol:    listener.Protocol,
+			Address:     listener.Address,
+			Port:        listener.Port,
+			Pid:         listener.Pid,
+			Process:     listener.Process,
+			Open:        listener.Open,
+			Expected:    listener.Expected,
+			FirstSeenTs: listener.FirstSeenTs,
+			LastSeenTs:  listener.LastSeenTs,
+		})
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+// ApiAcceptPorts adds the open listeners of the node to its baseline.
+func (s *NexServer) ApiAcceptPorts(c *gin.Context) {
+	clusterId, clusterOk := s.idParam(c, "clusterId", false)
+	nodeId, nodeOk := s.idParam(c, "nodeId", false)
+	if !clusterOk || !nodeOk {
+		s.ApiResponseJson(c, 404, "bad", "missing parameters")
+		return
+	}
+
+	node := s.findNodeById(nodeId, clusterId)
+	if node == nil {
+		s.ApiResponseJson(c, 404, "bad", "node not found")
+		return
+	}
+
+	var listeners []ListeningSocket
+	result := s.requestDB(c).Where("node_id=? AND open=? AND expected=?", node.ID, true, false).Find(&listeners)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	for idx := range listeners {
+		listener := &listeners[idx]
+		listener.Expected = true
+		if result := s.requestDB(c).Model(listener).Update("expected", true); result.Error != nil {
+			s.ApiResponseJsonf(c, 500, "bad", "failed to update listener: %v", result.Error)
+			return
+		}
+		s.updateListenerIncident(node, listener)
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    gin.H{"accepted": len(listeners)},
+	})
+}
@@ -0,0 +1,262 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultProfileSeconds = 30
+	maxProfileSeconds     = 60
+)
+
+var profileNames = map[string]bool{
+	"profile":      true,
+	"trace":        true,
+	"heap":         true,
+	"allocs":       true,
+	"goroutine":    true,
+	"block":        true,
+	"mutex":        true,
+	"threadcreate": true,
+}
+
+type ProfileCaptureItem struct {
+	Id          uint       `json:"id"`
+	NodeId      uint       `json:"node_id"`
+	Endpoint    string     `json:"endpoint"`
+	Profile     string     `json:"profile"`
+	Seconds     int        `json:"seconds"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error"`
+	Size        int        `json:"size"`
+	CreatedTs   time.Time  `json:"created_ts"`
+	CompletedTs *time.Time `json:"completed_ts"`
+}
+
+func newProfileCaptureItem(capture *ProfileCapture) ProfileCaptureItem {
+	item := ProfileCaptureItem{
+		Id:          capture.ID,
+		NodeId:      capture.NodeID,
+		Endpoint:    capture.Endpoint,
+		Profile:     capture.Profile,
+		Seconds:     capture.Seconds,
+		Status:      capture.Status,
+		Error:       capture.Error,
+		Size:        capture.Size,
+		CreatedTs:   capture.CreatedAt,
+		CompletedTs: capture.CompletedTs,
+	}
+
+	timeout := diagnosticCaptureTimeout + time.Duration(capture.Seconds)*time.Second
+	if item.Status == CaptureStatusPending && time.Since(capture.CreatedAt) > timeout {
+		item.Status = CaptureStatusFailed
+		item.Error = "agent did not respond"
+	}
+
+	return item
+}
+
+func (s *NexServer) saveProfileCapture(agent *Agent, in *pb.CommandResult) (*pb.Response, error) {
+	var capture ProfileCapture
+
+	result := s.db.Where("command_id=? AND agent_id=?", in.CommandId, agent.ID).First(&capture)
+	if result.Error != nil {
+		return nil, status.Error(codes.NotFound, "unknown profile capture")
+	}
+
+	now := time.Now()
+	capture.CompletedTs = &now
+	if in.Success {
+		capture.Status = CaptureStatusCompleted
+		capture.Data = in.Data
+		capture.Size = len(in.Data)
+	} else {
+		capture.Status = CaptureStatusFailed
+		capture.Error = in.Error
+	}
+
+	if result := s.db.Save(&capture); result.Error != nil {
+		ingestLog.Errorf("Profile: failed to save capture %d: %v\n", capture.ID, result.Error)
+		return nil, status.Error(codes.Internal, "failed to save profile capture")
+	}
+
+	return s.response(true, 0, ""), nil
+}
+
+func (s *NexServer) ApiCreateProfileCapture(c *gin.Context) {
+	params, ok := s.CheckRequiredParams(c, []string{"clusterId", "nodeId"})
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid parameters")
+		return
+	}
+
+	clusterId, err := strconv.ParseUint(params["clusterId"], 10, 32)
+	if err != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+	nodeId, err := strconv.ParseUint(params["nodeId"], 10, 32)
+	if err != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid node id")
+		return
+	}
+
+	type ProfileRequest struct {
+		Endpoint string `json:"endpoint" binding:"required"`
+		Profile  string `json:"profile" binding:"required"`
+		Seconds  int    `json:"seconds"`
+	}
+	var req ProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	if !profileNames[req.Profile] {
+		s.ApiResponseJsonf(c, 400, "bad", "unknown profile: %s", req.Profile)
+		return
+	}
+	if req.Seconds == 0 {
+		req.Seconds = defaultProfileSeconds
+	}
+	if req.Seconds < 0 || req.Seconds > maxProfileSeconds {
+		s.ApiResponseJsonf(c, 400, "bad", "seconds must be between 1 and %d", maxProfileSeconds)
+		return
+	}
+
+	node := s.findNodeById(uint(nodeId), uint(clusterId))
+	if node == nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid node id")
+		return
+	}
+
+	agent := s.findAgentByNode(node)
+	if agent == nil {
+		s.ApiResponseJson(c, 404, "bad", "agent is not connected")
+		return
+	}
+
+	command := newAgentCommand("pprof", req.Endpoint, req.Profile, strconv.Itoa(req.Seconds))
+	capture := ProfileCapture{
+		CommandID: command.Id,
+		Endpoint:  req.Endpoint,
+		Profile:   req.Profile,
+		Seconds:   req.Seconds,
+		Status:    CaptureStatusPending,
+		ClusterID: node.ClusterID,
+		NodeID:    node.ID,
+		AgentID:   agent.ID,
+	}
+
+	if result := s.db.Create(&capture); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create capture: %v", result.Error)
+		return
+	}
+
+	if err := s.commands.send(agent.Uuid, command); err != nil {
+		s.db.Model(&capture).Updates(ProfileCapture{Status: CaptureStatusFailed, Error: err.Error()})
+		s.ApiResponseJson(c, 500, "bad", err.Error())
+		return
+	}
+
+	c.JSON(202, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    newProfileCaptureItem(&capture),
+	})
+}
+
+func (s *NexServer) ApiProfileCaptureList(c *gin.Context) {
+	cId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	var captures []ProfileCapture
+
+	queryStart := time.Now()
+	result := s.requestDB(c).
+		Select("id, created_at, endpoint, profile, seconds, status, error, size, completed_ts, cluster_id, node_id").
+		Where("cluster_id=?", cId).
+		Order("created_at DESC").
+		Find(&captures)
+	queryTime := time.Since(queryStart)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	items := make([]ProfileCaptureItem, 0, len(captures))
+	for idx := range captures {
+		items = append(items, newProfileCaptureItem(&captures[idx]))
+	}
+
+	c.JSON(200, gin.H{
+		"status":        "ok",
+		"message":       "",
+		"data":          items,
+		"db_query_time": queryTime.String(),
+	})
+}
+
+func (s *NexServer) ApiDownloadProfileCapture(c *gin.Context) {
+	cId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+	captureId, ok := s.idParam(c, "captureId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid capture id")
+		return
+	}
+
+	var capture ProfileCapture
+
+	result := s.requestDB(c).
+		Where("id=? AND cluster_id=?", captureId, cId).
+		First(&capture)
+	if result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid capture id")
+		return
+	}
+
+	if capture.Status != CaptureStatusCompleted {
+		item := newProfileCaptureItem(&capture)
+		s.ApiResponseJsonf(c, 404, "bad", "capture is %s", item.Status)
+		return
+	}
+
+	extension := "pb.gz"
+	if capture.Profile == "trace" {
+		extension = "trace"
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(
+		"attachment; filename=\"%s-%s-%s.%s\"",
+		capture.Endpoint, capture.Profile, capture.CreatedAt.Format("20060102-150405"), extension))
+	c.Data(200, "application/octet-stream", capture.Data)
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Samples are stored as float8 with every digit the agent sent. The
+// precision file trades some of it for storage per metric class (the
+// metric type, gauge or counter): values are kept at float4 precision
+// and/or rounded to a number of decimal digits, once when they are saved
+// and again when retention averages them into hourly rows. Values with
+// fewer significant bits also pack much smaller in the encoded rollups.
+//
+//   classes:
+//     gauge: {storage: float4, digits: 2, rounding: nearest}
+//     counter: {storage: float8}
+
+const (
+	PrecisionFloat8 = "float8"
+	PrecisionFloat4 = "float4"
+
+	RoundingNearest = "nearest"
+	RoundingDown    = "down"
+	RoundingUp      = "up"
+
+	maxPrecisionDigits = 9
+)
+
+var metricClassPattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+type PrecisionConfig struct {
+	File string
+}
+
+type MetricPrecision struct {
+	Storage  string `json:"storage"`
+	Digits   *int   `json:"digits"`
+	Rounding string `json:"rounding"`
+}
+
+type PrecisionFile struct {
+	Classes map[string]MetricPrecision `json:"classes"`
+}
+
+type MetricPrecisions struct {
+	sync.RWMutex
+
+	classes map[string]MetricPrecision
+	types   map[uint]string
+}
+
+func (p *MetricPrecision) validate() error {
+	switch p.Storage {
+	case "":
+		p.Storage = PrecisionFloat8
+	case PrecisionFloat8, PrecisionFloat4:
+	default:
+		return fmt.Errorf("storage must be %s or %s", PrecisionFloat8, PrecisionFloat4)
+	}
+
+	switch p.Rounding {
+	case "":
+		p.Rounding = RoundingNearest
+	case RoundingNearest, RoundingDown, RoundingUp:
+	default:
+		return fmt.Errorf("rounding must be %s, %s or %s", RoundingNearest, RoundingDown, RoundingUp)
+	}
+
+	if p.Digits != nil && (*p.Digits < 0 || *p.Digits > maxPrecisionDigits) {
+		return fmt.Errorf("digits must be 0 to %d", maxPrecisionDigits)
+	}
+
+	return nil
+}
+
+// lossless tells whether the precision keeps values as they are.
+func (p *MetricPrecision) lossless() bool {
+	return p.Storage != PrecisionFloat4 && p.Digits == nil
+}
+
+func (p *MetricPrecision) apply(value float64) float64 {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return value
+	}
+
+	if p.Digits != nil {
+		scale := math.Pow10(*p.Digits)
+		switch p.Rounding {
+		case RoundingDown:
+			value = math.Floor(value*scale) / scale
+		case RoundingUp:
+			value = math.Ceil(value*scale) / scale
+		default:
+			value = math.Round(value*scale) / scale
+		}
+	}
+	if p.Storage == PrecisionFloat4 {
+		value = float64(float32(value))
+	}
+
+	return value
+}
+
+// sqlExpr applies the precision to a value expression of a statement.
+func (p *MetricPrecision) sqlExpr(expr string) string {
+	if p.Digits != nil {
+		scale := fmt.Sprintf("%.0f", math.Pow10(*p.Digits))
+		switch p.Rounding {
+		case RoundingDown:
+			expr = fmt.Sprintf("FLOOR((%s) * %s) / %s", expr, scale, scale)
+		case RoundingUp:
+			expr = fmt.Sprintf("CEIL((%s) * %s) / %s", expr, scale, scale)
+		default:
+			expr = fmt.Sprintf("ROUND((%s)::numeric, %d)::double precision", expr, *p.Digits)
+		}
+	}
+	if p.Storage == PrecisionFloat4 {
+		expr = fmt.Sprintf("(%s)::real::double precision", expr)
+	}
+
+	return expr
+}
+
+func (s *NexServer) loadPrecisionFile() error {
+	if s.config.Precision.File == "" {
+		return nil
+	}
+
+	raw, err := ioutil.ReadFile(s.config.Precision.File)
+	if err != nil {
+		return err
+	}
+
+	var file PrecisionFile
+	if err := yaml.UnmarshalStrict(raw, &file); err != nil {
+		return err
+	}
+
+	classes := make(map[string]MetricPrecision)
+	for class, precision := range file.Classes {
+		// class names go into the downsampling statement
+		if !metricClassPattern.MatchString(class) {
+			return fmt.Errorf("invalid metric class: %s", class)
+		}
+		if err := precision.validate(); err != nil {
+			return fmt.Errorf("%s: %v", class, err)
+		}
+		if precision.lossless() {
+			continue
+		}
+		classes[class] = precision
+	}
+
+	s.precisions.Lock()
+	s.precisions.classes = classes
+	s.precisions.types = make(map[uint]string)
+	s.precisions.Unlock()
+
+	ingestLog.Infof("Precision: loaded %d metric classes from %s\n", len(classes), s.config.Precision.File)
+
+	return nil
+}
+
+// metricPrecision returns the precision of the metric type, nil if its
+// values are kept as they are.
+func (s *NexServer) metricPrecision(typeId uint) *MetricPrecision {
+	s.precisions.RLock()
+	if len(s.precisions.classes) == 0 {
+		s.precisions.RUnlock()
+		return nil
+	}
+	class, found := s.precisions.types[typeId]
+	s.precisions.RUnlock()
+
+	if !found {
+		var metricType MetricType
+		if result := s.db.Where("id=?", typeId).First(&metricType); result.Error != nil {
+			return nil
+		}
+		class = metricType.Name
+
+		s.precisions.Lock()
+		s.precisions.types[typeId] = class
+		s.precisions.Unlock()
+	}
+
+	s.precisions.RLock()
+	defer s.precisions.RUnlock()
+
+	precision, found := s.precisions.classes[class]
+	if !found {
+		return nil
+	}
+
+	return &precision
+}
+
+// applyPrecision rounds the value of a sample to the precision of its class.
+func (s *NexServer) applyPrecision(metric *Metric) {
+	if precision := s.metricPrecision(metric.TypeID); precision != nil {
+		metric.Value = precision.apply(metric.Value)
+	}
+}
+
+// rollupValueExpr returns the value of an hourly row of the downsampling,
+// aggregate being the expression for metric classes kept as they are.
+func (s *NexServer) rollupValueExpr(aggregate string) string {
+	s.precisions.RLock()
+	defer s.precisions.RUnlock()
+
+	if len(s.precisions.classes) == 0 {
+		return aggregate
+	}
+
+	classes := make([]string, 0, len(s.precisions.classes))
+	for class := range s.precisions.classes {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+
+	var expr strings.Builder
+	expr.WriteString("CASE metric_types.name")
+	for _, class := range classes {
+		precision := s.precisions.classes[class]
+		fmt.Fprintf(&expr, " WHEN '%s' THEN %s", class, precision.sqlExpr(aggregate))
+	}
+	fmt.Fprintf(&expr, " ELSE %s END", aggregate)
+
+	return expr.String()
+}
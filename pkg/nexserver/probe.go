@@ -0,0 +1,242 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/json"
+	"github.com/NexClipper/NexClipper/pkg/nexprobe"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm/dialects/postgres"
+	"sync"
+	"time"
+)
+
+// Agentless snapshots are collected over SSH, either by nexctl and uploaded
+// here or by the server itself for a batch of hosts.
+
+const maxConcurrentProbes = 8
+
+// ProbeConfig is how the server checks the host keys of the hosts it
+// probes; callers of the API cannot change it.
+type ProbeConfig struct {
+	KnownHostsFile string
+	Insecure       bool
+}
+
+func (s *NexServer) saveProbeSnapshot(clusterId uint, host string, snapshot *nexprobe.Snapshot, probeErr error) (*ProbeSnapshot, error) {
+	probe := ProbeSnapshot{
+		ClusterID: clusterId,
+		Host:      host,
+		Source:    nexprobe.SourceSSH,
+		Data:      postgres.Jsonb{RawMessage: json.RawMessage("{}")},
+	}
+
+	if snapshot != nil {
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			return nil, err
+		}
+		probe.Data = postgres.Jsonb{RawMessage: data}
+		if snapshot.Source != "" {
+			probe.Source = snapshot.Source
+		}
+	}
+	if probeErr != nil {
+		probe.Error = probeErr.Error()
+	}
+
+	if result := s.db.Create(&probe); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &probe, nil
+}
+
+func (s *NexServer) validProbeCluster(c *gin.Context) (*Cluster, bool) {
+	clusterId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return nil, false
+	}
+
+	var cluster Cluster
+
+	result := s.requestDB(c).Where("id=?", clusterId).First(&cluster)
+	if result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return nil, false
+	}
+
+	return &cluster, true
+}
+
+func (s *NexServer) ApiUploadProbe(c *gin.Context) {
+	cluster, ok := s.validProbeCluster(c)
+	if !ok {
+		return
+	}
+
+	var snapshot nexprobe.Snapshot
+	if err := c.ShouldBindJSON(&snapshot); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+	if snapshot.Host == "" {
+		s.ApiResponseJson(c, 400, "bad", "missing host")
+		return
+	}
+
+	probe, err := s.saveProbeSnapshot(cluster.ID, snapshot.Host, &snapshot, nil)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to save snapshot: %v", err)
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    gin.H{"id": probe.ID},
+	})
+}
+
+// ApiProbeSSH probes hosts with the credentials of the request. It is
+// served by the admin listener only, since the server connects to any
+// host the caller names.
+func (s *NexServer) ApiProbeSSH(c *gin.Context) {
+	cluster, ok := s.validProbeCluster(c)
+	if !ok {
+		return
+	}
+
+	type ProbeRequest struct {
+		Hosts          []string `json:"hosts" binding:"required"`
+		User           string   `json:"user" binding:"required"`
+		Port           int      `json:"port"`
+		Password       string   `json:"password"`
+		PrivateKey     string   `json:"private_key"`
+		TimeoutSeconds int      `json:"timeout"`
+	}
+	var req ProbeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	config := nexprobe.SSHConfig{
+		User:           req.User,
+		Port:           req.Port,
+		Password:       req.Password,
+		PrivateKey:     []byte(req.PrivateKey),
+		KnownHostsFile: s.config.Probe.KnownHostsFile,
+		Insecure:       s.config.Probe.Insecure,
+		Timeout:        time.Duration(req.TimeoutSeconds) * time.Second,
+	}
+
+	type ProbeItem struct {
+		Host  string `json:"host"`
+		Id    uint   `json:"id"`
+		Error string `json:"error"`
+	}
+	items := make([]ProbeItem, len(req.Hosts))
+
+	var wg sync.WaitGroup
+	limiter := make(chan struct{}, maxConcurrentProbes)
+
+	for idx, host := range req.Hosts {
+		wg.Add(1)
+		go func(idx int, host string) {
+			defer wg.Done()
+
+			limiter <- struct{}{}
+			defer func() { <-limiter }()
+
+			item := ProbeItem{Host: host}
+			snapshot, probeErr := nexprobe.ProbeSSH(host, config)
+			if probeErr != nil {
+				item.Error = probeErr.Error()
+				requestLog(c).Errorf("Probe: failed to probe %s: %v\n", host, probeErr)
+			}
+
+			probe, err := s.saveProbeSnapshot(cluster.ID, host, snapshot, probeErr)
+			if err != nil {
+				item.Error = err.Error()
+			} else {
+				item.Id = probe.ID
+			}
+
+			items[idx] = item
+		}(idx, host)
+	}
+	wg.Wait()
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+func (s *NexServer) ApiProbeList(c *gin.Context) {
+	cId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	query := s.requestDB(c).Raw(`
+SELECT DISTINCT ON (host) id, host, source, data, error, created_at
+FROM probe_snapshots
+WHERE cluster_id=? AND deleted_at IS NULL
+ORDER BY host, created_at DESC`, cId)
+	rows, err, queryTime := s.QueryRowsWithTime(query)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	type ProbeItem struct {
+		Id        uint            `json:"id"`
+		Host      string          `json:"host"`
+		Source    string          `json:"source"`
+		Snapshot  json.RawMessage `json:"snapshot"`
+		Error     string          `json:"error"`
+		CreatedTs time.Time       `json:"created_ts"`
+	}
+	items := make([]ProbeItem, 0, 16)
+
+	for rows.Next() {
+		var item ProbeItem
+		var data []byte
+
+		err := rows.Scan(&item.Id, &item.Host, &item.Source, &data, &item.Error, &item.CreatedTs)
+		if err != nil {
+			requestLog(c).Errorf("failed to get record: %v", err)
+			continue
+		}
+		item.Snapshot = data
+
+		items = append(items, item)
+	}
+
+	c.JSON(200, gin.H{
+		"status":        "ok",
+		"message":       "",
+		"data":          items,
+		"db_query_time": queryTime.String(),
+	})
+}
@@ -0,0 +1,211 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"sort"
+	"strconv"
+)
+
+// Agents announce the protocol version they speak in the metadata of
+// their calls; agents older than the negotiation send none and speak
+// protocol 1. The server answers UpdateAgent with the version both sides
+// speak, the lower of the two, and refuses the versions it no longer
+// supports. An agent on a deprecated version keeps reporting, but is not
+// sent the commands introduced after its version.
+
+const (
+	agentProtocolKey       = "x-nexclipper-protocol"
+	agentProtocolStatusKey = "x-nexclipper-protocol-status"
+
+	currentAgentProtocol = 3
+	minAgentProtocol     = 1
+
+	ProtocolCurrent    = "current"
+	ProtocolDeprecated = "deprecated"
+	ProtocolSupported  = "supported"
+)
+
+type AgentProtocol struct {
+	Version     int    `json:"version"`
+	Status      string `json:"status"`
+	Description string `json:"description"`
+}
+
+var agentProtocols = []AgentProtocol{
+	{1, ProtocolDeprecated, "Metrics, ping and tail, agents without protocol negotiation"},
+	{2, ProtocolSupported, "Negotiated protocol with captures, remote config, probes and inventories"},
+	{3, ProtocolCurrent, "Health of the collectors"},
+}
+
+// commandProtocols are the protocol versions introducing the commands,
+// the commands not listed are part of protocol 1.
+var commandProtocols = map[string]int{
+	"diagnostic": 2,
+	"pprof":      2,
+	"config":     2,
+	"journey":    2,
+	"dns":        2,
+	"ports":      2,
+	"mesh_probe": 2,
+}
+
+func findAgentProtocol(version int) *AgentProtocol {
+	for idx := range agentProtocols {
+		if agentProtocols[idx].Version == version {
+			return &agentProtocols[idx]
+		}
+	}
+
+	return nil
+}
+
+func protocolStatus(version int) string {
+	if protocol := findAgentProtocol(version); protocol != nil {
+		return protocol.Status
+	}
+	if version > currentAgentProtocol {
+		return ProtocolSupported
+	}
+
+	return ""
+}
+
+// agentProtocolFromContext returns the protocol version announced by the
+// agent, 1 if none.
+func agentProtocolFromContext(ctx context.Context) int {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return minAgentProtocol
+	}
+	values := md.Get(agentProtocolKey)
+	if len(values) == 0 {
+		return minAgentProtocol
+	}
+	version, err := strconv.Atoi(values[0])
+	if err != nil || version < 1 {
+		return minAgentProtocol
+	}
+
+	return version
+}
+
+// negotiateProtocol returns the protocol version of the agent calling
+// UpdateAgent and tells the agent the version to speak.
+func (s *NexServer) negotiateProtocol(ctx context.Context, machineId string) (int, error) {
+	version := agentProtocolFromContext(ctx)
+	if version < minAgentProtocol {
+		return 0, status.Error(codes.FailedPrecondition,
+			fmt.Sprintf("agent protocol %d is not supported, upgrade to protocol %d or later",
+				version, minAgentProtocol))
+	}
+
+	negotiated := version
+	if negotiated > currentAgentProtocol {
+		negotiated = currentAgentProtocol
+	}
+	if protocolStatus(negotiated) == ProtocolDeprecated {
+		ingestLog.Warnf("Protocol: agent %s speaks deprecated protocol %d", machineId, version)
+	}
+
+	header := metadata.Pairs(agentProtocolKey, strconv.Itoa(negotiated),
+		agentProtocolStatusKey, protocolStatus(negotiated))
+	if err := grpc.SetHeader(ctx, header); err != nil {
+		ingestLog.Errorf("Protocol: failed to set header: %v", err)
+	}
+
+	return version, nil
+}
+
+// commandSupported returns an error if the protocol of the agent is older
+// than the command.
+func commandSupported(command string, version int) error {
+	required, found := commandProtocols[command]
+	if !found || version >= required {
+		return nil
+	}
+
+	return fmt.Errorf("agent protocol %d does not support %s, protocol %d required", version, command, required)
+}
+
+func (s *NexServer) ApiAgentProtocols(c *gin.Context) {
+	type DeprecatedAgent struct {
+		Id       uint   `json:"id"`
+		Uuid     string `json:"uuid"`
+		Version  string `json:"version"`
+		Protocol int    `json:"protocol"`
+		Cluster  string `json:"cluster"`
+		Online   bool   `json:"online"`
+	}
+
+	deprecated := make([]int, 0)
+	for _, protocol := range agentProtocols {
+		if protocol.Status == ProtocolDeprecated {
+			deprecated = append(deprecated, protocol.Version)
+		}
+	}
+
+	agents := make([]DeprecatedAgent, 0)
+	if len(deprecated) > 0 {
+		rows, err := s.requestDB(c).Table("agents").
+			Select("agents.id, agents.uuid, agents.version, agents.protocol, clusters.name, agents.online").
+			Joins("left join clusters on agents.cluster_id=clusters.id").
+			Where("agents.deleted_at IS NULL AND agents.protocol IN (?)", deprecated).
+			Order("agents.id").Rows()
+		if err != nil {
+			s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var agent DeprecatedAgent
+			if err := rows.Scan(&agent.Id, &agent.Uuid, &agent.Version, &agent.Protocol,
+				&agent.Cluster, &agent.Online); err != nil {
+				continue
+			}
+			agents = append(agents, agent)
+		}
+	}
+
+	commands := make(map[int][]string)
+	for command, version := range commandProtocols {
+		commands[version] = append(commands[version], command)
+	}
+	for _, names := range commands {
+		sort.Strings(names)
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"current":           currentAgentProtocol,
+			"minimum":           minAgentProtocol,
+			"protocols":         agentProtocols,
+			"commands":          commands,
+			"deprecated_agents": agents,
+		},
+	})
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+	"time"
+)
+
+// gorm v1 takes no context, but a transaction does: the queries of a read
+// request run in a transaction begun with the request context, which the
+// driver cancels on the server once the client goes away, and which caps
+// every statement at the query timeout with SET LOCAL statement_timeout.
+// The timeout bounds each statement rather than the request, so a long
+// export streaming rows is not cut off. Writes keep running on the shared
+// handle: a failed statement would abort the rest of the transaction.
+
+const (
+	defaultQueryTimeout = 60
+
+	requestTxKey = "request_tx"
+
+	// queryCanceled is the SQLSTATE of a canceled statement
+	queryCanceled = "57014"
+)
+
+func isReadRequest(c *gin.Context) bool {
+	return c.Request.Method == "GET" || c.Request.Method == "HEAD"
+}
+
+func (s *NexServer) queryTimeout() time.Duration {
+	if s.config.Database.QueryTimeout < 0 {
+		return 0
+	}
+	if s.config.Database.QueryTimeout == 0 {
+		return defaultQueryTimeout * time.Second
+	}
+
+	return time.Duration(s.config.Database.QueryTimeout) * time.Second
+}
+
+// requestTx returns the transaction of the read request, begun on first use.
+func (s *NexServer) requestTx(c *gin.Context) *gorm.DB {
+	if value, found := c.Get(requestTxKey); found {
+		return value.(*gorm.DB)
+	}
+
+	ctx := c.Request.Context()
+	tx := s.dbFromContext(ctx).BeginTx(ctx, &sql.TxOptions{})
+	if tx.Error != nil {
+		requestLog(c).Errorf("QueryTimeout: failed to begin: %v\n", tx.Error)
+		return s.dbFromContext(ctx)
+	}
+	if timeout := s.queryTimeout(); timeout > 0 {
+		if result := tx.Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d", int64(timeout/time.Millisecond))); result.Error != nil {
+			requestLog(c).Errorf("QueryTimeout: failed to set the timeout: %v\n", result.Error)
+		}
+	}
+	c.Set(requestTxKey, tx)
+
+	return tx
+}
+
+// QueryTimeoutMiddleware ends the transaction of a read request.
+func (s *NexServer) QueryTimeoutMiddleware(c *gin.Context) {
+	defer func() {
+		if value, found := c.Get(requestTxKey); found {
+			// a read request has nothing to keep, an aborted one fails
+			// to commit and is rolled back
+			value.(*gorm.DB).Commit()
+		}
+	}()
+
+	c.Next()
+}
+
+// queryTimedOut returns whether one of the errors is a canceled statement.
+func queryTimedOut(values ...interface{}) bool {
+	for _, value := range values {
+		switch err := value.(type) {
+		case *pq.Error:
+			if err.Code == queryCanceled {
+				return true
+			}
+		case pq.Error:
+			if err.Code == queryCanceled {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (s *NexServer) apiQueryTimeout(c *gin.Context) {
+	c.JSON(504, gin.H{
+		"status": "bad",
+		"message": s.translate(s.requestLocale(c), "query did not finish within %s, narrow the date range",
+			s.queryTimeout().String()),
+	})
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Each client of the API gets a token bucket: the requests made with an
+// API key share the bucket of the key, the others the bucket of their
+// address. A bucket holds up to burst tokens and refills at rate tokens a
+// second; a request takes one token or is answered 429 with the seconds
+// until the next token in Retry-After. The buckets are kept per replica,
+// so behind a balancer a client gets the rate of every replica it reaches.
+// Buckets idle long enough to be full again are dropped.
+
+const (
+	rateLimitPrune   = time.Minute
+	rateLimitIdleTtl = 10 * time.Minute
+)
+
+type RateLimitConfig struct {
+	// IpRate and KeyRate are requests per second, 0 disables the limit
+	IpRate   float64
+	IpBurst  int
+	KeyRate  float64
+	KeyBurst int
+}
+
+type rateBucket struct {
+	rate     float64
+	burst    float64
+	tokens   float64
+	updated  time.Time
+	allowed  int64
+	rejected int64
+}
+
+type RateLimiter struct {
+	sync.Mutex
+
+	buckets map[string]*rateBucket
+}
+
+// take refills the bucket up to now and takes a token, or returns how long
+// until a token is available.
+func (b *rateBucket) take(now time.Time) (bool, time.Duration) {
+	elapsed := now.Sub(b.updated).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.updated = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens -= 1
+		b.allowed += 1
+		return true, 0
+	}
+
+	b.rejected += 1
+	wait := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+
+	return false, wait
+}
+
+func (l *RateLimiter) take(client string, rate float64, burst int, now time.Time) (bool, time.Duration, int) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.buckets == nil {
+		l.buckets = make(map[string]*rateBucket)
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	bucket, found := l.buckets[client]
+	if !found || bucket.rate != rate || bucket.burst != float64(burst) {
+		bucket = &rateBucket{rate: rate, burst: float64(burst), tokens: float64(burst), updated: now}
+		l.buckets[client] = bucket
+	}
+
+	allowed, wait := bucket.take(now)
+
+	return allowed, wait, int(bucket.tokens)
+}
+
+func (l *RateLimiter) prune(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+
+	for client, bucket := range l.buckets {
+		if now.Sub(bucket.updated) > rateLimitIdleTtl {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// rateLimitClient returns the bucket of the request and its limits.
+func (s *NexServer) rateLimitClient(c *gin.Context) (string, float64, int) {
+	if principal := s.requestPrincipal(c); principal != nil && principal.ApiKeyId != 0 {
+		return fmt.Sprintf("key:%d", principal.ApiKeyId), s.config.RateLimit.KeyRate, s.config.RateLimit.KeyBurst
+	}
+
+	return "ip:" + s.requestClientIp(c), s.config.RateLimit.IpRate, s.config.RateLimit.IpBurst
+}
+
+// RateLimitMiddleware answers 429 to the clients over their rate.
+func (s *NexServer) RateLimitMiddleware(c *gin.Context) {
+	if c.Request.URL.Path == "/api/v1/health" {
+		c.Next()
+		return
+	}
+
+	client, rate, burst := s.rateLimitClient(c)
+	if rate <= 0 {
+		c.Next()
+		return
+	}
+
+	allowed, wait, remaining := s.rateLimiter.take(client, rate, burst, time.Now())
+	c.Header("X-RateLimit-Limit", strconv.FormatFloat(rate, 'f', -1, 64))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	if !allowed {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		s.ApiResponseJson(c, 429, "bad", "too many requests")
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
+
+func (s *NexServer) InitRateLimiter() {
+	ticker := time.NewTicker(rateLimitPrune)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.rateLimiter.prune(now)
+	}
+}
+
+func (s *NexServer) ApiAdminRateLimits(c *gin.Context) {
+	type RateLimitItem struct {
+		Client    string    `json:"client"`
+		Rate      float64   `json:"rate"`
+		Burst     int       `json:"burst"`
+		Tokens    float64   `json:"tokens"`
+		Allowed   int64     `json:"allowed"`
+		Rejected  int64     `json:"rejected"`
+		UpdatedTs time.Time `json:"updated_ts"`
+	}
+
+	now := time.Now()
+	s.rateLimiter.Lock()
+	items := make([]RateLimitItem, 0, len(s.rateLimiter.buckets))
+	for client, bucket := range s.rateLimiter.buckets {
+		items = append(items, RateLimitItem{
+			Client:    client,
+			Rate:      bucket.rate,
+			Burst:     int(bucket.burst),
+			Tokens:    math.Min(bucket.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*bucket.rate),
+			Allowed:   bucket.allowed,
+			Rejected:  bucket.rejected,
+			UpdatedTs: bucket.updated,
+		})
+	}
+	s.rateLimiter.Unlock()
+
+	// the clients most limited first
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Rejected != items[j].Rejected {
+			return items[i].Rejected > items[j].Rejected
+		}
+		return items[i].Allowed > items[j].Allowed
+	})
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"ip_rate":   s.config.RateLimit.IpRate,
+			"ip_burst":  s.config.RateLimit.IpBurst,
+			"key_rate":  s.config.RateLimit.KeyRate,
+			"key_burst": s.config.RateLimit.KeyBurst,
+			"clients":   items,
+		},
+	})
+}
@@ -0,0 +1,265 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Prometheus servers can feed their series to NexServer with remote_write
+// at /api/v1/write. The cluster of a series is its cluster label, or the
+// cluster parameter of the write URL, and its node is the host of its
+// instance label. Nodes unknown to the cluster are created as manual nodes.
+// The remaining labels are stored as the metric label. Counters are
+// recognized by their _total suffix, every other series is a gauge.
+
+const (
+	remoteWriteEndpoint       = "/prometheus/remote_write"
+	remoteWriteDefaultCluster = "prometheus"
+	remoteWriteMaxSize        = 32 << 20
+)
+
+type RemoteWriteConfig struct {
+	Token string `secret:"true"`
+}
+
+// Messages of the remote_write protocol (prometheus/prompb), declared for
+// the reflection based unmarshaler of golang/protobuf.
+
+type promWriteRequest struct {
+	Timeseries []*promTimeSeries `protobuf:"bytes,1,rep,name=timeseries,proto3"`
+}
+
+func (m *promWriteRequest) Reset()         { *m = promWriteRequest{} }
+func (m *promWriteRequest) String() string { return proto.CompactTextString(m) }
+func (*promWriteRequest) ProtoMessage()    {}
+
+type promTimeSeries struct {
+	Labels  []*promLabel  `protobuf:"bytes,1,rep,name=labels,proto3"`
+	Samples []*promSample `protobuf:"bytes,2,rep,name=samples,proto3"`
+}
+
+func (m *promTimeSeries) Reset()         { *m = promTimeSeries{} }
+func (m *promTimeSeries) String() string { return proto.CompactTextString(m) }
+func (*promTimeSeries) ProtoMessage()    {}
+
+type promLabel struct {
+	Name  string `protobuf:"bytes,1,opt,name=name,proto3"`
+	Value string `protobuf:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *promLabel) Reset()         { *m = promLabel{} }
+func (m *promLabel) String() string { return proto.CompactTextString(m) }
+func (*promLabel) ProtoMessage()    {}
+
+type promSample struct {
+	Value     float64 `protobuf:"fixed64,1,opt,name=value,proto3"`
+	Timestamp int64   `protobuf:"varint,2,opt,name=timestamp,proto3"`
+}
+
+func (m *promSample) Reset()         { *m = promSample{} }
+func (m *promSample) String() string { return proto.CompactTextString(m) }
+func (*promSample) ProtoMessage()    {}
+
+type remoteWriteSeries struct {
+	Name    string
+	Cluster string
+	Host    string
+	Label   string
+}
+
+func newRemoteWriteSeries(labels []*promLabel, defaultCluster string) *remoteWriteSeries {
+	series := &remoteWriteSeries{Cluster: defaultCluster}
+	pairs := make([]string, 0, len(labels))
+
+	for _, label := range labels {
+		switch label.Name {
+		case "__name__":
+			series.Name = label.Value
+			continue
+		case "cluster":
+			if label.Value != "" {
+				series.Cluster = label.Value
+			}
+			continue
+		case "instance":
+			series.Host = label.Value
+			if host, _, err := net.SplitHostPort(label.Value); err == nil {
+				series.Host = host
+			}
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%s", label.Name, label.Value))
+	}
+
+	sort.Strings(pairs)
+	series.Label = strings.Join(pairs, ",")
+
+	return series
+}
+
+func (series *remoteWriteSeries) typeName() string {
+	if strings.HasSuffix(series.Name, "_total") {
+		return "counter"
+	}
+
+	return "gauge"
+}
+
+// addRemoteWrite stores the samples of the request, returning the saved and
+// skipped counts.
+func (s *NexServer) addRemoteWrite(req *promWriteRequest, defaultCluster string) (int, int, error) {
+	clusters := make(map[string]*Cluster)
+	nodes := make(map[string]*Node)
+	endpoint := s.getMetricEndpoint(remoteWriteEndpoint)
+
+	savedCount := 0
+	skippedCount := 0
+
+	for _, timeSeries := range req.Timeseries {
+		series := newRemoteWriteSeries(timeSeries.Labels, defaultCluster)
+		if series.Host == "" {
+			skippedCount += len(timeSeries.Samples)
+			continue
+		}
+
+		cluster, found := clusters[series.Cluster]
+		if !found {
+			cluster = s.findCluster(series.Cluster)
+			clusters[series.Cluster] = cluster
+		}
+		if s.isClusterDeleted(cluster) {
+			skippedCount += len(timeSeries.Samples)
+			continue
+		}
+
+		name, err := s.normalizeMetricName(series.Name, remoteWriteEndpoint, cluster.ID)
+		if err != nil {
+			skippedCount += len(timeSeries.Samples)
+			continue
+		}
+
+		nodeKey := fmt.Sprintf("%d/%s", cluster.ID, series.Host)
+		node, found := nodes[nodeKey]
+		if !found {
+			if node, err = s.bundleNode(series.Host, cluster.ID); err != nil {
+				return savedCount, skippedCount, err
+			}
+			nodes[nodeKey] = node
+		}
+
+		metricType := s.getMetricType(series.typeName())
+		metricName := s.getMetricName(name, metricType)
+		metricLabel := s.getMetricLabel(series.Label)
+
+		for _, sample := range timeSeries.Samples {
+			// NaN carries the staleness markers, which are not stored
+			if math.IsNaN(sample.Value) || !s.valueValidator.Accept(name, sample.Value) {
+				skippedCount += 1
+				continue
+			}
+
+			metric := Metric{
+				Ts:         time.Unix(0, sample.Timestamp*int64(time.Millisecond)),
+				Value:      sample.Value,
+				EndpointID: endpoint.ID,
+				TypeID:     metricType.ID,
+				NameID:     metricName.ID,
+				LabelID:    metricLabel.ID,
+				ClusterID:  cluster.ID,
+				NodeID:     node.ID,
+			}
+			s.applyPrecision(&metric)
+			if result := s.db.Create(&metric); result.Error != nil {
+				return savedCount, skippedCount, result.Error
+			}
+			savedCount += 1
+
+			s.checkCounterReset(&metric, metricType)
+		}
+	}
+
+	s.metricSaveCounterLock.Lock()
+	s.metricSaveCounter += uint64(savedCount)
+	s.metricSaveCounterLock.Unlock()
+
+	return savedCount, skippedCount, nil
+}
+
+// ApiRemoteWrite receives Prometheus remote_write requests. Prometheus
+// retries on 5xx only, so malformed payloads are answered with 400.
+func (s *NexServer) ApiRemoteWrite(c *gin.Context) {
+	token := s.config.RemoteWrite.Token
+	if token == "" {
+		s.ApiResponseJson(c, 404, "bad", "remote write is not enabled")
+		return
+	}
+	bearer := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+		s.ApiResponseJson(c, 401, "bad", "invalid token")
+		return
+	}
+
+	if encoding := c.GetHeader("Content-Encoding"); encoding != "" && encoding != "snappy" {
+		s.ApiResponseJsonf(c, 415, "bad", "unsupported content encoding: %s", encoding)
+		return
+	}
+
+	compressed, err := ioutil.ReadAll(io.LimitReader(c.Request.Body, remoteWriteMaxSize+1))
+	if err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "failed to read request: %v", err)
+		return
+	}
+	if len(compressed) > remoteWriteMaxSize {
+		s.ApiResponseJson(c, 413, "bad", "request is too large")
+		return
+	}
+
+	data, err := decodeSnappy(compressed, remoteWriteMaxSize)
+	if err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "failed to decompress request: %v", err)
+		return
+	}
+
+	var req promWriteRequest
+	if err := proto.Unmarshal(data, &req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "failed to decode request: %v", err)
+		return
+	}
+
+	defaultCluster := c.DefaultQuery("cluster", remoteWriteDefaultCluster)
+	savedCount, skippedCount, err := s.addRemoteWrite(&req, defaultCluster)
+	if err != nil {
+		requestLog(c).Errorf("RemoteWrite: failed to save metrics: %v\n", err)
+		s.ApiResponseJsonf(c, 500, "bad", "failed to save metrics: %v", err)
+		return
+	}
+	if skippedCount > 0 {
+		requestLog(c).Warnf("RemoteWrite: saved %d samples, skipped %d\n", savedCount, skippedCount)
+	}
+
+	c.Status(204)
+}
@@ -0,0 +1,483 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"sigs.k8s.io/yaml"
+	"sync"
+	"time"
+)
+
+// Retention policies expire old samples of metrics and k8s_metrics. A
+// cluster uses its own policy, or the default one (cluster 0); without
+// either its samples are kept forever. Samples older than RawDays are
+// replaced in place by hourly rows, the average of gauges and the maximum
+// of counters, and deleted once older than DownsampleDays, or packed into
+// metric_rollups until EncodedDays. Without downsampling they are deleted
+// after RawDays. Downsampling catches up at most retentionBatch per cluster
+// and run, and its progress is kept in the settings table.
+
+const (
+	retentionBatch           = 24 * time.Hour
+	retentionProgressSetting = "retention.downsampled.%d"
+)
+
+type RetentionConfig struct {
+	File string
+}
+
+type RetentionPolicySpec struct {
+	RawDays        int `json:"raw_days"`
+	DownsampleDays int `json:"downsample_days"`
+	EncodedDays    int `json:"encoded_days"`
+}
+
+type RetentionFile struct {
+	Default  *RetentionPolicySpec           `json:"default"`
+	Clusters map[string]RetentionPolicySpec `json:"clusters"`
+}
+
+type RetentionClusterResult struct {
+	ClusterId   uint   `json:"cluster_id"`
+	Downsampled int64  `json:"downsampled"`
+	Encoded     int64  `json:"encoded"`
+	Deleted     int64  `json:"deleted"`
+	Error       string `json:"error,omitempty"`
+}
+
+type RetentionResult struct {
+	StartedTs time.Time                `json:"started_ts"`
+	Duration  string                   `json:"duration"`
+	Clusters  []RetentionClusterResult `json:"clusters"`
+}
+
+type RetentionManager struct {
+	sync.Mutex
+
+	running bool
+	last    *RetentionResult
+}
+
+func (spec *RetentionPolicySpec) validate() error {
+	if spec.RawDays < 1 {
+		return fmt.Errorf("raw_days must be at least 1")
+	}
+	if spec.DownsampleDays != 0 && spec.DownsampleDays <= spec.RawDays {
+		return fmt.Errorf("downsample_days must be 0 or more than raw_days")
+	}
+	if spec.EncodedDays != 0 && (spec.DownsampleDays == 0 || spec.EncodedDays <= spec.DownsampleDays) {
+		return fmt.Errorf("encoded_days must be 0 or more than downsample_days")
+	}
+
+	return nil
+}
+
+func (s *NexServer) saveRetentionPolicy(clusterId uint, spec *RetentionPolicySpec) (*RetentionPolicy, error) {
+	var policy RetentionPolicy
+
+	s.db.Where("cluster_id=?", clusterId).First(&policy)
+	policy.ClusterID = clusterId
+	policy.RawDays = spec.RawDays
+	policy.DownsampleDays = spec.DownsampleDays
+	policy.EncodedDays = spec.EncodedDays
+
+	if result := s.db.Save(&policy); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &policy, nil
+}
+
+// loadRetentionFile applies the policies of the configuration file, which
+// take precedence over the ones set through the API at every start.
+func (s *NexServer) loadRetentionFile() error {
+	if s.config.Retention.File == "" {
+		return nil
+	}
+
+	raw, err := ioutil.ReadFile(s.config.Retention.File)
+	if err != nil {
+		return err
+	}
+
+	var file RetentionFile
+	if err := yaml.UnmarshalStrict(raw, &file); err != nil {
+		return err
+	}
+
+	if file.Default != nil {
+		if err := file.Default.validate(); err != nil {
+			return fmt.Errorf("default: %v", err)
+		}
+		if _, err := s.saveRetentionPolicy(0, file.Default); err != nil {
+			return err
+		}
+	}
+
+	for name, spec := range file.Clusters {
+		var cluster Cluster
+		if result := s.db.Where("name=?", name).First(&cluster); result.Error != nil {
+			schedulerLog.Warnf("Retention: unknown cluster %s\n", name)
+			continue
+		}
+		if err := spec.validate(); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if _, err := s.saveRetentionPolicy(cluster.ID, &spec); err != nil {
+			return err
+		}
+	}
+
+	schedulerLog.Infof("Retention: loaded policies from %s\n", s.config.Retention.File)
+
+	return nil
+}
+
+// downsampleValue is the value of an hourly row, rounded to the precision
+// of the metric class by rollupValueExpr.
+const downsampleValue = "CASE WHEN metric_types.name='counter' THEN max(expired.value) ELSE avg(expired.value) END"
+
+const downsampleMetricsQuery = `
+WITH expired AS (
+  DELETE FROM metrics WHERE cluster_id=? AND ts >= ? AND ts < ? RETURNING *
+)
+INSERT INTO metrics (ts, value, endpoint_id, type_id, name_id, label_id,
+                     cluster_id, node_id, process_id, container_id)
+SELECT date_trunc('hour', expired.ts), %s,
+       expired.endpoint_id, expired.type_id, expired.name_id, expired.label_id,
+       expired.cluster_id, expired.node_id, expired.process_id, expired.container_id
+FROM expired
+LEFT JOIN metric_types ON metric_types.id=expired.type_id
+GROUP BY date_trunc('hour', expired.ts), metric_types.name,
+         expired.endpoint_id, expired.type_id, expired.name_id, expired.label_id,
+         expired.cluster_id, expired.node_id, expired.process_id, expired.container_id`
+
+const downsampleK8sMetricsQuery = `
+WITH expired AS (
+  DELETE FROM k8s_metrics
+  USING k8s_clusters
+  WHERE k8s_metrics.k8s_cluster_id=k8s_clusters.id AND k8s_clusters.agent_cluster_id=?
+    AND k8s_metrics.ts >= ? AND k8s_metrics.ts < ?
+  RETURNING k8s_metrics.*
+)
+INSERT INTO k8s_metrics (ts, value, endpoint_id, type_id, name_id, label_id, k8s_cluster_id,
+                         k8s_node_id, k8s_namespace_id, k8s_pod_id, k8s_container_id)
+SELECT date_trunc('hour', expired.ts), %s,
+       expired.endpoint_id, expired.type_id, expired.name_id, expired.label_id, expired.k8s_cluster_id,
+       expired.k8s_node_id, expired.k8s_namespace_id, expired.k8s_pod_id, expired.k8s_container_id
+FROM expired
+LEFT JOIN metric_types ON metric_types.id=expired.type_id
+GROUP BY date_trunc('hour', expired.ts), metric_types.name,
+         expired.endpoint_id, expired.type_id, expired.name_id, expired.label_id, expired.k8s_cluster_id,
+         expired.k8s_node_id, expired.k8s_namespace_id, expired.k8s_pod_id, expired.k8s_container_id`
+
+// downsampleCluster replaces the raw samples of the next batch before
+// cutoff, returning the number of raw samples replaced.
+func (s *NexServer) downsampleCluster(clusterId uint, notBefore, cutoff time.Time) (int64, error) {
+	progressName := fmt.Sprintf(retentionProgressSetting, clusterId)
+
+	var progress Setting
+	from := notBefore
+	if result := s.db.Where("name=?", progressName).First(&progress); result.Error == nil {
+		if ts, err := time.Parse(time.RFC3339, progress.Value); err == nil && ts.After(from) {
+			from = ts
+		}
+	}
+	from = from.Truncate(time.Hour)
+	if !from.Before(cutoff) {
+		return 0, nil
+	}
+
+	to := from.Add(retentionBatch)
+	if to.After(cutoff) {
+		to = cutoff
+	}
+
+	value := s.rollupValueExpr(downsampleValue)
+
+	tx := s.db.Begin()
+	var replaced int64
+	for _, query := range []string{downsampleMetricsQuery, downsampleK8sMetricsQuery} {
+		result := tx.Exec(fmt.Sprintf(query, value), clusterId, from, to)
+		if result.Error != nil {
+			tx.Rollback()
+			return 0, result.Error
+		}
+		replaced += result.RowsAffected
+	}
+
+	progress.Name = progressName
+	progress.Value = to.Format(time.RFC3339)
+	if result := tx.Save(&progress); result.Error != nil {
+		tx.Rollback()
+		return 0, result.Error
+	}
+
+	if result := tx.Commit(); result.Error != nil {
+		return 0, result.Error
+	}
+
+	return replaced, nil
+}
+
+func (s *NexServer) deleteExpiredSamples(clusterId uint, cutoff time.Time) (int64, error) {
+	result := s.db.Exec("DELETE FROM metrics WHERE cluster_id=? AND ts < ?", clusterId, cutoff)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	deleted := result.RowsAffected
+
+	result = s.db.Exec(`
+DELETE FROM k8s_metrics
+USING k8s_clusters
+WHERE k8s_metrics.k8s_cluster_id=k8s_clusters.id AND k8s_clusters.agent_cluster_id=?
+  AND k8s_metrics.ts < ?`, clusterId, cutoff)
+	if result.Error != nil {
+		return deleted, result.Error
+	}
+
+	return deleted + result.RowsAffected, nil
+}
+
+func (s *NexServer) applyRetention(cluster *Cluster, policy *RetentionPolicy, now time.Time) RetentionClusterResult {
+	result := RetentionClusterResult{ClusterId: cluster.ID}
+
+	rawCutoff := now.Add(-time.Duration(policy.RawDays) * 24 * time.Hour).Truncate(time.Hour)
+	deleteCutoff := rawCutoff
+	if policy.DownsampleDays > policy.RawDays {
+		deleteCutoff = now.Add(-time.Duration(policy.DownsampleDays) * 24 * time.Hour).Truncate(time.Hour)
+
+		downsampled, err := s.downsampleCluster(cluster.ID, deleteCutoff, rawCutoff)
+		if err != nil {
+			result.Error = fmt.Sprintf("failed to downsample: %v", err)
+			return result
+		}
+		result.Downsampled = downsampled
+	}
+
+	// hourly rows are deleted once packed
+	if policy.EncodedDays > policy.DownsampleDays && policy.DownsampleDays > 0 {
+		encodeCutoff := now.Add(-time.Duration(policy.EncodedDays) * 24 * time.Hour).Truncate(time.Hour)
+
+		encoded, encodedTo, err := s.encodeRollups(cluster.ID, encodeCutoff, deleteCutoff)
+		if err != nil {
+			result.Error = fmt.Sprintf("failed to encode: %v", err)
+			return result
+		}
+		result.Encoded = encoded
+		deleteCutoff = encodedTo
+
+		if _, err := s.deleteExpiredRollups(cluster.ID, encodeCutoff); err != nil {
+			result.Error = fmt.Sprintf("failed to delete rollups: %v", err)
+			return result
+		}
+	}
+
+	deleted, err := s.deleteExpiredSamples(cluster.ID, deleteCutoff)
+	result.Deleted = deleted
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to delete: %v", err)
+	}
+
+	return result
+}
+
+func (s *NexServer) runRetention() error {
+	s.retention.Lock()
+	if s.retention.running {
+		s.retention.Unlock()
+		return fmt.Errorf("retention is already running")
+	}
+	s.retention.running = true
+	s.retention.Unlock()
+
+	defer func() {
+		s.retention.Lock()
+		s.retention.running = false
+		s.retention.Unlock()
+	}()
+
+	var policies []RetentionPolicy
+	if result := s.db.Find(&policies); result.Error != nil {
+		return fmt.Errorf("failed to get policies: %v", result.Error)
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+
+	policyMap := make(map[uint]*RetentionPolicy)
+	for idx := range policies {
+		policyMap[policies[idx].ClusterID] = &policies[idx]
+	}
+
+	var clusters []Cluster
+	if result := s.db.Find(&clusters); result.Error != nil {
+		return fmt.Errorf("failed to get clusters: %v", result.Error)
+	}
+
+	now := time.Now()
+	run := &RetentionResult{
+		StartedTs: now,
+		Clusters:  make([]RetentionClusterResult, 0, len(clusters)),
+	}
+
+	failed := 0
+	for idx := range clusters {
+		cluster := &clusters[idx]
+
+		policy, found := policyMap[cluster.ID]
+		if !found {
+			if policy, found = policyMap[0]; !found {
+				continue
+			}
+		}
+
+		result := s.applyRetention(cluster, policy, now)
+		if result.Error != "" {
+			schedulerLog.Errorf("Retention: cluster %s: %s\n", cluster.Name, result.Error)
+			failed++
+		}
+		run.Clusters = append(run.Clusters, result)
+	}
+	run.Duration = time.Since(now).String()
+
+	s.retention.Lock()
+	s.retention.last = run
+	s.retention.Unlock()
+
+	if failed > 0 {
+		return fmt.Errorf("retention failed for %d of %d clusters", failed, len(run.Clusters))
+	}
+
+	return nil
+}
+
+type RetentionPolicyItem struct {
+	ClusterId      uint      `json:"cluster_id"`
+	RawDays        int       `json:"raw_days"`
+	DownsampleDays int       `json:"downsample_days"`
+	EncodedDays    int       `json:"encoded_days"`
+	UpdatedTs      time.Time `json:"updated_ts"`
+}
+
+func newRetentionPolicyItem(policy *RetentionPolicy) RetentionPolicyItem {
+	return RetentionPolicyItem{
+		ClusterId:      policy.ClusterID,
+		RawDays:        policy.RawDays,
+		DownsampleDays: policy.DownsampleDays,
+		EncodedDays:    policy.EncodedDays,
+		UpdatedTs:      policy.UpdatedAt,
+	}
+}
+
+func (s *NexServer) ApiRetentionList(c *gin.Context) {
+	var policies []RetentionPolicy
+
+	if result := s.requestDB(c).Order("cluster_id").Find(&policies); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	items := make([]RetentionPolicyItem, 0, len(policies))
+	for idx := range policies {
+		items = append(items, newRetentionPolicyItem(&policies[idx]))
+	}
+
+	s.retention.Lock()
+	last := s.retention.last
+	running := s.retention.running
+	s.retention.Unlock()
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"policies": items,
+			"running":  running,
+			"last_run": last,
+		},
+	})
+}
+
+func (s *NexServer) setRetentionPolicy(c *gin.Context, clusterId uint) {
+	var spec RetentionPolicySpec
+	if err := c.ShouldBindJSON(&spec); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+	if err := spec.validate(); err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	policy, err := s.saveRetentionPolicy(clusterId, &spec)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to save policy: %v", err)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    newRetentionPolicyItem(policy),
+	})
+}
+
+func (s *NexServer) ApiSetDefaultRetention(c *gin.Context) {
+	s.setRetentionPolicy(c, 0)
+}
+
+func (s *NexServer) ApiSetClusterRetention(c *gin.Context) {
+	clusterId, ok := s.idParam(c, "clusterId", false)
+	if !ok || s.getClusterById(clusterId) == nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	s.setRetentionPolicy(c, clusterId)
+}
+
+func (s *NexServer) deleteRetentionPolicy(c *gin.Context, clusterId uint) {
+	result := s.requestDB(c).Unscoped().Where("cluster_id=?", clusterId).Delete(&RetentionPolicy{})
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to delete policy: %v", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		s.ApiResponseJson(c, 404, "bad", "no retention policy")
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+func (s *NexServer) ApiDeleteDefaultRetention(c *gin.Context) {
+	s.deleteRetentionPolicy(c, 0)
+}
+
+func (s *NexServer) ApiDeleteClusterRetention(c *gin.Context) {
+	clusterId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	s.deleteRetentionPolicy(c, clusterId)
+}
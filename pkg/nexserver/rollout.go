@@ -0,0 +1,380 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/json"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/gin-gonic/gin"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A rollout stages a new global or group configuration on the canary agents
+// of its scope. It is promoted to the layer once the soak time passes, and
+// halted as soon as a canary rejects the configuration or goes offline.
+
+const (
+	RolloutStatusCanary   = "canary"
+	RolloutStatusPromoted = "promoted"
+	RolloutStatusHalted   = "halted"
+
+	defaultRolloutSoakMinutes = 30
+	rolloutCheckInterval      = 30 * time.Second
+)
+
+func (rollout *AgentRollout) canaryAgentIds() []uint {
+	agentIds := make([]uint, 0, 8)
+
+	for _, value := range strings.Split(rollout.CanaryAgents, ",") {
+		if id, err := strconv.ParseUint(value, 10, 32); err == nil {
+			agentIds = append(agentIds, uint(id))
+		}
+	}
+
+	return agentIds
+}
+
+func (rollout *AgentRollout) hasCanary(agentId uint) bool {
+	for _, id := range rollout.canaryAgentIds() {
+		if id == agentId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canaryRollout returns the rollout in canary state for the layer of the
+// given group, if the agent is one of its canaries.
+func (s *NexServer) canaryRollout(agentConfig *AgentConfig, groupId uint) *AgentRollout {
+	if !agentConfig.Canary {
+		return nil
+	}
+
+	var rollout AgentRollout
+	result := s.db.Where("status=? AND agent_group_id=?", RolloutStatusCanary, groupId).First(&rollout)
+	if result.Error != nil || !rollout.hasCanary(agentConfig.AgentID) {
+		return nil
+	}
+
+	return &rollout
+}
+
+func (s *NexServer) isAgentConnected(agentId uint) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, agent := range s.agentMap {
+		if agent.ID == agentId {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *NexServer) finishRollout(rollout *AgentRollout, status, reason string) error {
+	now := time.Now()
+
+	result := s.db.Model(rollout).Updates(map[string]interface{}{
+		"status":      status,
+		"reason":      reason,
+		"finished_ts": now,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	rollout.Status = status
+	rollout.Reason = reason
+	rollout.FinishedTs = &now
+
+	return nil
+}
+
+func (s *NexServer) haltRollout(rollout *AgentRollout, reason string) {
+	if err := s.finishRollout(rollout, RolloutStatusHalted, reason); err != nil {
+		ingestLog.Errorf("Rollout: failed to halt %d: %v\n", rollout.ID, err)
+		return
+	}
+	ingestLog.Infof("Rollout: halted %d: %s\n", rollout.ID, reason)
+
+	// canaries go back to the configuration they had before the rollout
+	s.pushAgentConfigs(rollout.hasCanary)
+}
+
+func (s *NexServer) promoteRollout(rollout *AgentRollout) error {
+	if rollout.AgentGroupID == 0 {
+		var setting Setting
+		result := s.db.Where(Setting{Name: agentConfigSetting}).
+			Assign(Setting{Value: string(rollout.Config.RawMessage)}).FirstOrCreate(&setting)
+		if result.Error != nil {
+			return result.Error
+		}
+	} else {
+		result := s.db.Model(&AgentGroup{}).Where("id=?", rollout.AgentGroupID).Update("config", rollout.Config)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+
+	if err := s.finishRollout(rollout, RolloutStatusPromoted, ""); err != nil {
+		return err
+	}
+	ingestLog.Infof("Rollout: promoted %d\n", rollout.ID)
+
+	if rollout.AgentGroupID == 0 {
+		s.pushAgentConfigs(nil)
+	} else {
+		agentIds := s.groupAgentIds(rollout.AgentGroupID)
+		s.pushAgentConfigs(func(agentId uint) bool { return agentIds[agentId] })
+	}
+
+	return nil
+}
+
+// checkConfigResult halts the rollouts whose canary could not apply the
+// configuration it was sent.
+func (s *NexServer) checkConfigResult(agent *Agent, in *pb.CommandResult) (*pb.Response, error) {
+	if in.Success {
+		return s.response(true, 0, ""), nil
+	}
+
+	ingestLog.Errorf("AgentConfig: agent %s rejected configuration: %s\n", agent.Uuid, in.Error)
+
+	var rollouts []AgentRollout
+	if result := s.db.Where("status=?", RolloutStatusCanary).Find(&rollouts); result.Error != nil {
+		return s.response(true, 0, ""), nil
+	}
+
+	for idx := range rollouts {
+		if rollouts[idx].hasCanary(agent.ID) {
+			s.haltRollout(&rollouts[idx], fmt.Sprintf("agent %d rejected configuration: %s", agent.ID, in.Error))
+		}
+	}
+
+	return s.response(true, 0, ""), nil
+}
+
+func (s *NexServer) checkRollouts() error {
+	var rollouts []AgentRollout
+	if result := s.db.Where("status=?", RolloutStatusCanary).Find(&rollouts); result.Error != nil {
+		return fmt.Errorf("failed to get rollouts: %v", result.Error)
+	}
+
+	for idx := range rollouts {
+		rollout := &rollouts[idx]
+
+		halted := false
+		for _, agentId := range rollout.canaryAgentIds() {
+			if !s.isAgentConnected(agentId) {
+				s.haltRollout(rollout, fmt.Sprintf("canary agent %d went offline", agentId))
+				halted = true
+				break
+			}
+		}
+		if halted {
+			continue
+		}
+
+		if time.Since(rollout.CreatedAt) >= time.Duration(rollout.SoakMinutes)*time.Minute {
+			if err := s.promoteRollout(rollout); err != nil {
+				ingestLog.Errorf("Rollout: failed to promote %d: %v\n", rollout.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+type AgentRolloutItem struct {
+	Id           uint              `json:"id"`
+	GroupId      uint              `json:"group_id"`
+	Config       AgentConfigValues `json:"config"`
+	Status       string            `json:"status"`
+	Reason       string            `json:"reason"`
+	SoakMinutes  int               `json:"soak_minutes"`
+	CanaryAgents []uint            `json:"canary_agents"`
+	CreatedTs    time.Time         `json:"created_ts"`
+	FinishedTs   *time.Time        `json:"finished_ts"`
+}
+
+func newAgentRolloutItem(rollout *AgentRollout) AgentRolloutItem {
+	return AgentRolloutItem{
+		Id:           rollout.ID,
+		GroupId:      rollout.AgentGroupID,
+		Config:       agentConfigValues(rollout.Config),
+		Status:       rollout.Status,
+		Reason:       rollout.Reason,
+		SoakMinutes:  rollout.SoakMinutes,
+		CanaryAgents: rollout.canaryAgentIds(),
+		CreatedTs:    rollout.CreatedAt,
+		FinishedTs:   rollout.FinishedTs,
+	}
+}
+
+func (s *NexServer) ApiAgentRolloutList(c *gin.Context) {
+	var rollouts []AgentRollout
+
+	if result := s.requestDB(c).Order("id DESC").Find(&rollouts); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	items := make([]AgentRolloutItem, 0, len(rollouts))
+	for idx := range rollouts {
+		items = append(items, newAgentRolloutItem(&rollouts[idx]))
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+func (s *NexServer) ApiCreateAgentRollout(c *gin.Context) {
+	type RolloutRequest struct {
+		GroupId     uint              `json:"group_id"`
+		Config      AgentConfigValues `json:"config" binding:"required"`
+		SoakMinutes int               `json:"soak_minutes"`
+	}
+	var req RolloutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+	if err := req.Config.validate(); err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+	if req.SoakMinutes <= 0 {
+		req.SoakMinutes = defaultRolloutSoakMinutes
+	}
+
+	if req.GroupId != 0 {
+		var group AgentGroup
+		if result := s.requestDB(c).Where("id=?", req.GroupId).First(&group); result.Error != nil {
+			s.ApiResponseJson(c, 400, "bad", "invalid agent group id")
+			return
+		}
+	}
+
+	var active AgentRollout
+	result := s.requestDB(c).Where("status=? AND agent_group_id=?", RolloutStatusCanary, req.GroupId).First(&active)
+	if result.Error == nil {
+		s.ApiResponseJsonf(c, 409, "bad", "rollout %d is in progress", active.ID)
+		return
+	}
+
+	// only canaries connected now take part; the rest would halt it at once
+	var configs []AgentConfig
+	query := s.requestDB(c).Where("canary=?", true)
+	if req.GroupId != 0 {
+		query = query.Where("agent_group_id=?", req.GroupId)
+	}
+	if result := query.Find(&configs); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	canaries := make([]string, 0, len(configs))
+	for _, config := range configs {
+		if s.isAgentConnected(config.AgentID) {
+			canaries = append(canaries, strconv.FormatUint(uint64(config.AgentID), 10))
+		}
+	}
+	if len(canaries) == 0 {
+		s.ApiResponseJson(c, 400, "bad", "no connected canary agents in scope")
+		return
+	}
+
+	raw, _ := json.Marshal(req.Config)
+	rollout := AgentRollout{
+		AgentGroupID: req.GroupId,
+		Status:       RolloutStatusCanary,
+		SoakMinutes:  req.SoakMinutes,
+		CanaryAgents: strings.Join(canaries, ","),
+	}
+	rollout.Config.RawMessage = raw
+	if result := s.requestDB(c).Create(&rollout); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create rollout: %v", result.Error)
+		return
+	}
+
+	go s.pushAgentConfigs(rollout.hasCanary)
+
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    newAgentRolloutItem(&rollout),
+	})
+}
+
+func (s *NexServer) findActiveRollout(c *gin.Context) *AgentRollout {
+	rolloutId, ok := s.idParam(c, "rolloutId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid rollout id")
+		return nil
+	}
+
+	var rollout AgentRollout
+
+	result := s.requestDB(c).Where("id=?", rolloutId).First(&rollout)
+	if result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid rollout id")
+		return nil
+	}
+	if rollout.Status != RolloutStatusCanary {
+		s.ApiResponseJsonf(c, 409, "bad", "rollout is %s", rollout.Status)
+		return nil
+	}
+
+	return &rollout
+}
+
+func (s *NexServer) ApiPromoteAgentRollout(c *gin.Context) {
+	rollout := s.findActiveRollout(c)
+	if rollout == nil {
+		return
+	}
+
+	if err := s.promoteRollout(rollout); err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to promote rollout: %v", err)
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+func (s *NexServer) ApiHaltAgentRollout(c *gin.Context) {
+	rollout := s.findActiveRollout(c)
+	if rollout == nil {
+		return
+	}
+
+	s.haltRollout(rollout, "halted manually")
+	if rollout.Status != RolloutStatusHalted {
+		s.ApiResponseJson(c, 500, "bad", "failed to halt rollout")
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
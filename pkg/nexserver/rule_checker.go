@@ -21,6 +21,7 @@ import (
 )
 
 type IncidentItem struct {
+	Id          uint
 	ClusterId   uint
 	NodeId      uint
 	ProcessId   uint
@@ -31,6 +32,8 @@ type IncidentItem struct {
 	Value       float64
 	Condition   float64
 	EventName   string
+	Severity    string
+	Priority    int
 	ReportedTs  time.Time
 	DetectedTs  time.Time
 }
@@ -82,11 +85,48 @@ func (s *NexServer) ClearAgentConnected(clusterId, nodeId uint, hostName string)
 	}
 }
 
+func (s *NexServer) FireAgentDegraded(clusterId, nodeId uint, hostName string) {
+	item := &IncidentItem{
+		ClusterId:  clusterId,
+		NodeId:     nodeId,
+		TargetType: "AGENT",
+		Target:     hostName,
+		EventName:  "agent_degraded",
+		ReportedTs: time.Now(),
+		DetectedTs: time.Now(),
+	}
+
+	s.AddIncident("agent_degraded", item)
+}
+
+func (s *NexServer) ClearAgentDegraded(clusterId, nodeId uint, hostName string) {
+	item := &IncidentItem{
+		ClusterId:  clusterId,
+		NodeId:     nodeId,
+		TargetType: "AGENT",
+		Target:     hostName,
+		EventName:  "agent_degraded",
+		ReportedTs: time.Now(),
+		DetectedTs: time.Now(),
+	}
+
+	if s.IsExistIncident("agent_degraded", item) == true {
+		s.ClearIncident("agent_degraded", item)
+	}
+}
+
 func (s *NexServer) CheckNodeBasicIncident(nodeMetricChan chan Metric) {
 	gaugeType := s.getMetricType("gauge")
 	nodeCpuLoad1 := s.getMetricName("node_cpu_load_avg_1", gaugeType)
 	nodeDiskFree := s.getMetricName("node_disk_free", gaugeType)
 	nodeMemoryUsedPercent := s.getMetricName("node_memory_used_percent", gaugeType)
+	nodeAuthFailures := s.getMetricName("node_auth_failures_per_minute", gaugeType)
+	nodeZombies := s.getMetricName("node_processes_zombie", gaugeType)
+	nodeUninterruptible := s.getMetricName("node_processes_uninterruptible", gaugeType)
+	nodeDeletedBinaries := s.getMetricName("node_processes_deleted_binary", gaugeType)
+	nodeEphemeral := s.getMetricName("node_ephemeral_storage_eviction_percent", gaugeType)
+	podEphemeral := s.getMetricName("pod_ephemeral_storage_eviction_percent", gaugeType)
+	cronJobSinceSuccess := s.getMetricName("k8s_cronjob_since_success_seconds", gaugeType)
 
 	for metric := range nodeMetricChan {
 		if metric.NameID == nodeCpuLoad1.ID {
@@ -140,7 +180,119 @@ func (s *NexServer) CheckNodeBasicIncident(nodeMetricChan chan Metric) {
 				}
 				s.AddIncident("node_memory_free", incidentItem)
 			}
+		} else if metric.NameID == nodeAuthFailures.ID {
+			// a brute-force attempt is over once the failures stop
+			s.checkNodeThreshold("node_auth_failures", &metric, s.config.BasicRule.NodeAuthFailures)
+		} else if metric.NameID == nodeZombies.ID {
+			s.checkNodeThreshold("node_zombie_processes", &metric, s.config.BasicRule.NodeZombies)
+		} else if metric.NameID == nodeUninterruptible.ID {
+			s.checkNodeThreshold("node_uninterruptible_processes", &metric, s.config.BasicRule.NodeUninterruptible)
+		} else if metric.NameID == nodeDeletedBinaries.ID {
+			s.checkNodeThreshold("node_deleted_binaries", &metric, s.config.BasicRule.NodeDeletedBinaries)
+		} else if metric.NameID == nodeEphemeral.ID {
+			s.checkNodeThreshold("node_ephemeral_storage", &metric, s.config.BasicRule.NodeEphemeral)
+		} else if metric.NameID == podEphemeral.ID {
+			s.checkPodThreshold("pod_ephemeral_storage", &metric, s.config.BasicRule.PodEphemeral)
+		} else if metric.NameID == cronJobSinceSuccess.ID {
+			s.checkCronJobThreshold("cronjob_not_succeeded", &metric, s.config.BasicRule.CronJobSuccessHours*3600)
+		}
+	}
+}
+
+// checkNodeThreshold keeps an incident open while the node metric is at or
+// above the condition, a condition of 0 disabling the rule.
+func (s *NexServer) checkNodeThreshold(eventName string, metric *Metric, condition float64) {
+	if condition <= 0 {
+		return
+	}
+
+	node := s.getNodeById(metric.NodeID, metric.ClusterID)
+	if node == nil {
+		return
+	}
+
+	incidentItem := &IncidentItem{
+		ClusterId:  metric.ClusterID,
+		NodeId:     metric.NodeID,
+		TargetType: "NODE",
+		Target:     node.Host,
+		Value:      metric.Value,
+		Condition:  condition,
+		EventName:  eventName,
+		ReportedTs: metric.Ts,
+		DetectedTs: time.Now(),
+	}
+	s.updateThresholdIncident(eventName, incidentItem)
+}
+
+// checkPodThreshold is checkNodeThreshold for a pod metric, reported on a
+// container of the pod.
+func (s *NexServer) checkPodThreshold(eventName string, metric *Metric, condition float64) {
+	if condition <= 0 || metric.ContainerID == 0 {
+		return
+	}
+	if metric.Value < condition && len(s.incidentMap[eventName]) == 0 {
+		return
+	}
+
+	label := s.getMetricLabelById(metric.LabelID)
+	if label == nil {
+		return
+	}
+
+	incidentItem := &IncidentItem{
+		ClusterId:   metric.ClusterID,
+		NodeId:      metric.NodeID,
+		ContainerId: metric.ContainerID,
+		TargetType:  "POD",
+		Target:      labelValue(label.Label, "namespace") + "/" + labelValue(label.Label, "pod"),
+		Value:       metric.Value,
+		Condition:   condition,
+		EventName:   eventName,
+		ReportedTs:  metric.Ts,
+		DetectedTs:  time.Now(),
+	}
+	s.updateThresholdIncident(eventName, incidentItem)
+}
+
+// checkCronJobThreshold keeps an incident open while the time since the
+// last success of a CronJob is at or above the condition. The incident
+// belongs to the cluster, the agent reporting the CronJobs may change.
+func (s *NexServer) checkCronJobThreshold(eventName string, metric *Metric, condition float64) {
+	if condition <= 0 {
+		return
+	}
+	if metric.Value < condition && len(s.incidentMap[eventName]) == 0 {
+		return
+	}
+
+	label := s.getMetricLabelById(metric.LabelID)
+	if label == nil || labelValue(label.Label, "cronjob") == "" {
+		return
+	}
+
+	incidentItem := &IncidentItem{
+		ClusterId:  metric.ClusterID,
+		TargetType: "CRONJOB",
+		Target:     labelValue(label.Label, "namespace") + "/" + labelValue(label.Label, "cronjob"),
+		Value:      metric.Value,
+		Condition:  condition,
+		EventName:  eventName,
+		ReportedTs: metric.Ts,
+		DetectedTs: time.Now(),
+	}
+	s.updateThresholdIncident(eventName, incidentItem)
+}
+
+// updateThresholdIncident opens the incident of a value at or above its
+// condition, and clears it once the value is below.
+func (s *NexServer) updateThresholdIncident(eventName string, item *IncidentItem) {
+	if item.Value >= item.Condition {
+		if !s.IsExistIncident(eventName, item) {
+			s.AddIncident(eventName, item)
 		}
+	} else if s.IsExistIncident(eventName, item) {
+		s.ClearIncident(eventName, item)
 	}
 }
 
@@ -162,6 +314,18 @@ func (s *NexServer) IsSameIncident(left, right *IncidentItem) bool {
 }
 
 func (s *NexServer) AddIncident(eventName string, item *IncidentItem) bool {
+	if item.Severity == "" {
+		item.Severity = s.incidentSeverity(eventName)
+	}
+	item.Priority = severityPriority[item.Severity]
+
+	if s.IsExistIncident(eventName, item) == false {
+		s.recordIncident(eventName, item)
+		go s.attachIncidentContext(item)
+
+		s.notifyIncident(eventName, item)
+	}
+
 	itemList, found := s.incidentMap[eventName]
 	if found == false {
 		itemList = make([]*IncidentItem, 0, 10)
@@ -185,7 +349,8 @@ func (s *NexServer) ClearIncident(eventName string, item *IncidentItem) bool {
 
 	for idx, it := range itemList {
 		if s.IsSameIncident(it, item) {
-			itemList = append(itemList[:idx], itemList[idx+1:]...)
+			s.addIncidentTimeline(it.Id, "cleared", "")
+			s.incidentMap[eventName] = append(itemList[:idx], itemList[idx+1:]...)
 			break
 		}
 	}
@@ -0,0 +1,357 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"sync"
+	"time"
+)
+
+// Alert rules compare the latest node-level sample of a metric with a
+// threshold. A rule fires once its condition has held on every evaluation
+// for its duration, and its incident is cleared on the first evaluation
+// where the condition no longer holds. Rules can be narrowed to a cluster
+// and to a node of that cluster.
+
+const (
+	defaultRuleEvaluation = "@every 30s"
+
+	// samples older than this are not evaluated
+	ruleStaleness = 5 * time.Minute
+)
+
+var ruleOperators = map[string]func(value, threshold float64) bool{
+	">":  func(value, threshold float64) bool { return value > threshold },
+	">=": func(value, threshold float64) bool { return value >= threshold },
+	"<":  func(value, threshold float64) bool { return value < threshold },
+	"<=": func(value, threshold float64) bool { return value <= threshold },
+	"==": func(value, threshold float64) bool { return value == threshold },
+	"!=": func(value, threshold float64) bool { return value != threshold },
+}
+
+type ruleSeriesKey struct {
+	RuleId    uint
+	ClusterId uint
+	NodeId    uint
+}
+
+// RuleStates keeps when the condition of each series started to hold.
+type RuleStates struct {
+	sync.Mutex
+
+	pending map[ruleSeriesKey]time.Time
+}
+
+func (rule *AlertRule) eventName() string {
+	return "rule:" + rule.Name
+}
+
+func (rule *AlertRule) holds(value float64) bool {
+	compare, found := ruleOperators[rule.Operator]
+	if !found {
+		return false
+	}
+
+	return compare(value, rule.Threshold)
+}
+
+type ruleSample struct {
+	ClusterId uint
+	NodeId    uint
+	Value     float64
+	Ts        time.Time
+}
+
+// ruleSamples returns the latest sample of the rule's metric for every node
+// in its scope.
+func (s *NexServer) ruleSamples(rule *AlertRule, now time.Time) ([]ruleSample, error) {
+	q := NewSqlQuery(`
+SELECT DISTINCT ON (metrics.cluster_id, metrics.node_id)
+       metrics.cluster_id, metrics.node_id, metrics.value, metrics.ts
+FROM metrics
+JOIN metric_names ON metric_names.id=metrics.name_id
+WHERE metric_names.name=? AND metrics.ts >= ?
+  AND metrics.process_id=0 AND metrics.container_id=0`, rule.MetricName, now.Add(-ruleStaleness))
+	q.AppendIf(rule.ClusterID != 0, " AND metrics.cluster_id=?", rule.ClusterID)
+	q.AppendIf(rule.NodeID != 0, " AND metrics.node_id=?", rule.NodeID)
+	q.Append(" ORDER BY metrics.cluster_id, metrics.node_id, metrics.ts DESC")
+
+	rows, err := q.Rows(s.db)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	samples := make([]ruleSample, 0, 16)
+	for rows.Next() {
+		var sample ruleSample
+		if err := rows.Scan(&sample.ClusterId, &sample.NodeId, &sample.Value, &sample.Ts); err != nil {
+			incidentLog.Errorf("failed to get record: %v", err)
+			continue
+		}
+		samples = append(samples, sample)
+	}
+
+	return samples, nil
+}
+
+func (s *NexServer) evaluateRules() error {
+	var rules []AlertRule
+	if result := s.db.Where("disabled=?", false).Find(&rules); result.Error != nil {
+		return fmt.Errorf("failed to get rules: %v", result.Error)
+	}
+
+	now := time.Now()
+
+	s.ruleStates.Lock()
+	previous := s.ruleStates.pending
+	s.ruleStates.Unlock()
+
+	pending := make(map[ruleSeriesKey]time.Time)
+	for idx := range rules {
+		rule := &rules[idx]
+
+		samples, err := s.ruleSamples(rule, now)
+		if err != nil {
+			incidentLog.Warnf("Rule: %s: %v\n", rule.Name, err)
+			continue
+		}
+
+		for _, sample := range samples {
+			target := fmt.Sprintf("node %d", sample.NodeId)
+			if node := s.getNodeById(sample.NodeId, sample.ClusterId); node != nil {
+				target = node.Host
+			}
+
+			eventName := rule.eventName()
+			item := &IncidentItem{
+				ClusterId:  sample.ClusterId,
+				NodeId:     sample.NodeId,
+				TargetType: "NODE",
+				Target:     target,
+				Value:      sample.Value,
+				Condition:  rule.Threshold,
+				EventName:  eventName,
+				Severity:   rule.Severity,
+				ReportedTs: sample.Ts,
+				DetectedTs: now,
+			}
+
+			if !rule.holds(sample.Value) {
+				if s.IsExistIncident(eventName, item) {
+					s.ClearIncident(eventName, item)
+				}
+				continue
+			}
+
+			key := ruleSeriesKey{RuleId: rule.ID, ClusterId: sample.ClusterId, NodeId: sample.NodeId}
+			since, found := previous[key]
+			if !found {
+				since = now
+			}
+			pending[key] = since
+
+			duration := time.Duration(rule.DurationSeconds) * time.Second
+			if now.Sub(since) >= duration && !s.IsExistIncident(eventName, item) {
+				s.AddIncident(eventName, item)
+			}
+		}
+	}
+
+	s.ruleStates.Lock()
+	s.ruleStates.pending = pending
+	s.ruleStates.Unlock()
+
+	return nil
+}
+
+type AlertRuleItem struct {
+	Id              uint    `json:"id"`
+	Name            string  `json:"name"`
+	MetricName      string  `json:"metric_name"`
+	ClusterId       uint    `json:"cluster_id"`
+	NodeId          uint    `json:"node_id"`
+	Operator        string  `json:"operator"`
+	Threshold       float64 `json:"threshold"`
+	DurationSeconds int     `json:"duration_seconds"`
+	Severity        string  `json:"severity"`
+	Disabled        bool    `json:"disabled"`
+}
+
+func newAlertRuleItem(rule *AlertRule) AlertRuleItem {
+	return AlertRuleItem{
+		Id:              rule.ID,
+		Name:            rule.Name,
+		MetricName:      rule.MetricName,
+		ClusterId:       rule.ClusterID,
+		NodeId:          rule.NodeID,
+		Operator:        rule.Operator,
+		Threshold:       rule.Threshold,
+		DurationSeconds: rule.DurationSeconds,
+		Severity:        rule.Severity,
+		Disabled:        rule.Disabled,
+	}
+}
+
+type AlertRuleRequest struct {
+	Name            string   `json:"name" binding:"required"`
+	MetricName      string   `json:"metric_name" binding:"required"`
+	ClusterId       uint     `json:"cluster_id"`
+	NodeId          uint     `json:"node_id"`
+	Operator        string   `json:"operator" binding:"required"`
+	Threshold       *float64 `json:"threshold" binding:"required"`
+	DurationSeconds int      `json:"duration_seconds"`
+	Severity        string   `json:"severity"`
+	Disabled        bool     `json:"disabled"`
+}
+
+// bindAlertRule validates the request into the rule, responding on error.
+func (s *NexServer) bindAlertRule(c *gin.Context, rule *AlertRule) bool {
+	var req AlertRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return false
+	}
+
+	if _, found := ruleOperators[req.Operator]; !found {
+		s.ApiResponseJsonf(c, 400, "bad", "unknown operator: %s", req.Operator)
+		return false
+	}
+	if req.DurationSeconds < 0 {
+		s.ApiResponseJson(c, 400, "bad", "duration must not be negative")
+		return false
+	}
+	if req.NodeId != 0 && req.ClusterId == 0 {
+		s.ApiResponseJson(c, 400, "bad", "cluster_id is required with node_id")
+		return false
+	}
+	if req.Severity == "" {
+		req.Severity = SeverityWarning
+	}
+	if !isValidSeverity(req.Severity) {
+		s.ApiResponseJsonf(c, 400, "bad", "unknown severity: %s", req.Severity)
+		return false
+	}
+
+	var existing AlertRule
+	result := s.requestDB(c).Where("name=? AND id<>?", req.Name, rule.ID).First(&existing)
+	if result.Error == nil {
+		s.ApiResponseJsonf(c, 409, "bad", "rule %s already exists", req.Name)
+		return false
+	}
+
+	rule.Name = req.Name
+	rule.MetricName = req.MetricName
+	rule.ClusterID = req.ClusterId
+	rule.NodeID = req.NodeId
+	rule.Operator = req.Operator
+	rule.Threshold = *req.Threshold
+	rule.DurationSeconds = req.DurationSeconds
+	rule.Severity = req.Severity
+	rule.Disabled = req.Disabled
+
+	return true
+}
+
+func (s *NexServer) ApiAlertRuleList(c *gin.Context) {
+	var rules []AlertRule
+
+	if result := s.requestDB(c).Order("id").Find(&rules); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	items := make([]AlertRuleItem, 0, len(rules))
+	for idx := range rules {
+		items = append(items, newAlertRuleItem(&rules[idx]))
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+func (s *NexServer) ApiCreateAlertRule(c *gin.Context) {
+	var rule AlertRule
+	if !s.bindAlertRule(c, &rule) {
+		return
+	}
+
+	if result := s.requestDB(c).Create(&rule); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create rule: %v", result.Error)
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    newAlertRuleItem(&rule),
+	})
+}
+
+func (s *NexServer) ApiUpdateAlertRule(c *gin.Context) {
+	ruleId, ok := s.idParam(c, "ruleId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid rule id")
+		return
+	}
+
+	var rule AlertRule
+	if result := s.requestDB(c).Where("id=?", ruleId).First(&rule); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid rule id")
+		return
+	}
+
+	if !s.bindAlertRule(c, &rule) {
+		return
+	}
+
+	if result := s.requestDB(c).Save(&rule); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to update rule: %v", result.Error)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    newAlertRuleItem(&rule),
+	})
+}
+
+func (s *NexServer) ApiDeleteAlertRule(c *gin.Context) {
+	ruleId, ok := s.idParam(c, "ruleId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid rule id")
+		return
+	}
+
+	result := s.requestDB(c).Where("id=?", ruleId).Delete(&AlertRule{})
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to delete rule: %v", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		s.ApiResponseJson(c, 404, "bad", "invalid rule id")
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
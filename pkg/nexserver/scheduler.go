@@ -0,0 +1,420 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The scheduler runs the periodic jobs of the server. Every job has a
+// default schedule derived from its own settings, which can be replaced
+// per job with a cron expression ("-" disables the job). Scheduled runs
+// only happen on the replica elected for the job; manual triggers run on
+// the replica receiving the request.
+
+const (
+	JobTriggerSchedule = "schedule"
+	JobTriggerManual   = "manual"
+
+	JobRunOk      = "ok"
+	JobRunFailed  = "failed"
+	JobRunSkipped = "skipped"
+
+	jobRunHistory = 100
+)
+
+type ScheduledJob struct {
+	Name     string
+	Expr     string
+	Feature  string
+	schedule Schedule
+	run      func() error
+
+	NextTs     time.Time
+	Running    bool
+	SkipNext   bool
+	LastRunTs  *time.Time
+	LastStatus string
+	LastError  string
+}
+
+type Scheduler struct {
+	sync.Mutex
+
+	jobs map[string]*ScheduledJob
+}
+
+func everyMinutes(minutes int) string {
+	if minutes <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("@every %dm", minutes)
+}
+
+// registerJob adds a job with its default schedule, an empty schedule
+// leaves the job disabled unless it is configured explicitly.
+func (s *NexServer) registerJob(name, defaultExpr string, run func() error) {
+	expr := defaultExpr
+	if configured, found := s.config.Jobs[name]; found {
+		expr = configured
+	}
+	if expr == "" || expr == "-" {
+		schedulerLog.Infof("Scheduler: %s disabled\n", name)
+		return
+	}
+
+	schedule, err := parseSchedule(expr)
+	if err != nil {
+		schedulerLog.Warnf("Scheduler: %s disabled: %v\n", name, err)
+		return
+	}
+
+	s.scheduler.Lock()
+	defer s.scheduler.Unlock()
+
+	if s.scheduler.jobs == nil {
+		s.scheduler.jobs = make(map[string]*ScheduledJob)
+	}
+	s.scheduler.jobs[name] = &ScheduledJob{
+		Name:     name,
+		Expr:     expr,
+		schedule: schedule,
+		run:      run,
+		NextTs:   schedule.Next(time.Now()),
+	}
+
+	schedulerLog.Infof("Scheduler: %s scheduled with %q\n", name, expr)
+}
+
+// gateJob makes a registered job run only while the feature is enabled.
+func (s *NexServer) gateJob(name, feature string) {
+	s.scheduler.Lock()
+	defer s.scheduler.Unlock()
+
+	if job, found := s.scheduler.jobs[name]; found {
+		job.Feature = feature
+	}
+}
+
+func (s *NexServer) findJob(name string) *ScheduledJob {
+	s.scheduler.Lock()
+	defer s.scheduler.Unlock()
+
+	return s.scheduler.jobs[name]
+}
+
+func (s *NexServer) recordJobRun(name, trigger, status, errMsg string, startedTs time.Time) {
+	finishedTs := time.Now()
+
+	run := JobRun{
+		Job:        name,
+		Trigger:    trigger,
+		Status:     status,
+		Error:      errMsg,
+		StartedTs:  startedTs,
+		FinishedTs: finishedTs,
+	}
+	if result := s.db.Create(&run); result.Error != nil {
+		schedulerLog.Errorf("Scheduler: failed to record run of %s: %v\n", name, result.Error)
+		return
+	}
+
+	s.db.Exec(`
+DELETE FROM job_runs
+WHERE job=? AND id NOT IN (SELECT id FROM job_runs WHERE job=? ORDER BY id DESC LIMIT ?)`,
+		name, name, jobRunHistory)
+}
+
+// runJob runs a job once unless it is already running.
+func (s *NexServer) runJob(job *ScheduledJob, trigger string) error {
+	s.scheduler.Lock()
+	if job.Running {
+		s.scheduler.Unlock()
+		return fmt.Errorf("job %s is already running", job.Name)
+	}
+	job.Running = true
+	s.scheduler.Unlock()
+
+	startedTs := time.Now()
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+
+		return job.run()
+	}()
+
+	status := JobRunOk
+	errMsg := ""
+	if err != nil {
+		status = JobRunFailed
+		errMsg = err.Error()
+		schedulerLog.Errorf("Scheduler: %s failed: %v\n", job.Name, err)
+	}
+
+	s.scheduler.Lock()
+	job.Running = false
+	job.LastRunTs = &startedTs
+	job.LastStatus = status
+	job.LastError = errMsg
+	s.scheduler.Unlock()
+
+	s.recordJobRun(job.Name, trigger, status, errMsg, startedTs)
+
+	return nil
+}
+
+func (s *NexServer) dueJobs(now time.Time) []*ScheduledJob {
+	s.scheduler.Lock()
+	defer s.scheduler.Unlock()
+
+	due := make([]*ScheduledJob, 0)
+	for _, job := range s.scheduler.jobs {
+		// impossible cron expressions never come due
+		if job.NextTs.IsZero() || now.Before(job.NextTs) {
+			continue
+		}
+
+		job.NextTs = job.schedule.Next(now)
+		due = append(due, job)
+	}
+
+	return due
+}
+
+func (s *NexServer) runScheduledJob(job *ScheduledJob) {
+	if !s.isJobLeader(job.Name) {
+		return
+	}
+
+	s.scheduler.Lock()
+	skip := job.SkipNext
+	job.SkipNext = false
+	s.scheduler.Unlock()
+
+	if skip {
+		schedulerLog.Warnf("Scheduler: %s skipped\n", job.Name)
+		s.recordJobRun(job.Name, JobTriggerSchedule, JobRunSkipped, "", time.Now())
+		return
+	}
+	if job.Feature != "" && !s.featureEnabled(job.Feature) {
+		s.recordJobRun(job.Name, JobTriggerSchedule, JobRunSkipped,
+			fmt.Sprintf("feature %s is disabled", job.Feature), time.Now())
+		return
+	}
+
+	if err := s.runJob(job, JobTriggerSchedule); err != nil {
+		schedulerLog.Warnf("Scheduler: %v\n", err)
+	}
+}
+
+func (s *NexServer) InitScheduler() {
+	s.registerJob(JobGarbageCollector, everyMinutes(s.config.GC.IntervalMinutes), s.runGarbageCollectionJob)
+	s.registerJob(JobClusterPurger, "@hourly", s.purgeExpiredClusters)
+	s.registerJob(JobRetention, "@hourly", s.runRetention)
+	s.registerJob(JobDigestNotifier, "* * * * *", s.flushDigests)
+	s.registerJob(JobRuleEvaluator, defaultRuleEvaluation, s.evaluateRules)
+	s.registerJob(JobSynthetics, defaultSyntheticDispatch, s.dispatchJourneys)
+	s.registerJob(JobPortInventory, defaultPortInventory, s.dispatchPortInventory)
+	s.registerJob(JobKernelIncidents, defaultKernelSweep, s.clearKernelIncidents)
+	s.registerJob(JobRolloutMonitor, fmt.Sprintf("@every %s", rolloutCheckInterval), s.checkRollouts)
+	s.registerJob(JobCMDBExporter, s.cmdbSchedule(), s.runCMDBJob)
+	s.registerJob(JobBundle, s.bundleSchedule(), s.runBundleJob)
+	s.registerJob(JobChangePoint, everyMinutes(s.config.ChangePoint.IntervalMinutes), s.runChangePointJob)
+	s.gateJob(JobChangePoint, FeatureChangePoints)
+	s.registerJob(JobCostBudget, "@hourly", s.checkCostBudgets)
+	s.gateJob(JobCostBudget, FeatureCostReporting)
+	s.registerJob(JobImageScan, defaultImageScan, s.runImageScans)
+	s.gateJob(JobImageScan, FeatureImageScan)
+	s.registerJob(JobMeshProbe, defaultMeshProbe, s.dispatchMeshProbes)
+	s.gateJob(JobMeshProbe, FeatureMeshProbe)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, job := range s.dueJobs(now) {
+			go s.runScheduledJob(job)
+		}
+	}
+}
+
+type ScheduledJobItem struct {
+	Name       string         `json:"name"`
+	Schedule   string         `json:"schedule"`
+	Feature    string         `json:"feature,omitempty"`
+	NextTs     *time.Time     `json:"next_ts"`
+	Running    bool           `json:"running"`
+	SkipNext   bool           `json:"skip_next"`
+	LastRunTs  *time.Time     `json:"last_run_ts"`
+	LastStatus string         `json:"last_status"`
+	LastError  string         `json:"last_error"`
+	Leader     LeaderJob      `json:"leader"`
+	Holder     *JobLockHolder `json:"holder"`
+}
+
+func (s *NexServer) scheduledJobItem(job *ScheduledJob, holders map[int64]JobLockHolder) ScheduledJobItem {
+	item := ScheduledJobItem{
+		Name:       job.Name,
+		Schedule:   job.Expr,
+		Feature:    job.Feature,
+		Running:    job.Running,
+		SkipNext:   job.SkipNext,
+		LastRunTs:  job.LastRunTs,
+		LastStatus: job.LastStatus,
+		LastError:  job.LastError,
+		Leader:     s.leaderJob(job.Name),
+	}
+	if !job.NextTs.IsZero() {
+		nextTs := job.NextTs
+		item.NextTs = &nextTs
+	}
+	if holder, found := holders[leaderLockKey(job.Name)]; found {
+		item.Holder = &holder
+	}
+
+	return item
+}
+
+func (s *NexServer) ApiAdminJobs(c *gin.Context) {
+	holders := s.jobLockHolders(s.requestDB(c))
+
+	s.scheduler.Lock()
+	jobs := make([]ScheduledJob, 0, len(s.scheduler.jobs))
+	for _, job := range s.scheduler.jobs {
+		jobs = append(jobs, *job)
+	}
+	s.scheduler.Unlock()
+
+	items := make([]ScheduledJobItem, 0, len(jobs))
+	for idx := range jobs {
+		items = append(items, s.scheduledJobItem(&jobs[idx], holders))
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"instance": s.instanceName(),
+			"jobs":     items,
+		},
+	})
+}
+
+func (s *NexServer) ApiAdminJobRuns(c *gin.Context) {
+	name := s.Param(c, "job")
+	if s.findJob(name) == nil {
+		s.ApiResponseJson(c, 404, "bad", "job not found")
+		return
+	}
+
+	page, err := s.parsePage(c)
+	if err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return
+	}
+
+	query, total, err := s.pagedModel(s.requestDB(c).Model(&JobRun{}).Where("job=?", name), page)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+
+	var runs []JobRun
+	if result := query.Order("id DESC").Find(&runs); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	type JobRunItem struct {
+		Trigger    string    `json:"trigger"`
+		Status     string    `json:"status"`
+		Error      string    `json:"error"`
+		StartedTs  time.Time `json:"started_ts"`
+		FinishedTs time.Time `json:"finished_ts"`
+		Duration   string    `json:"duration"`
+	}
+	items := make([]JobRunItem, 0, len(runs))
+	for _, run := range runs {
+		items = append(items, JobRunItem{
+			Trigger:    run.Trigger,
+			Status:     run.Status,
+			Error:      run.Error,
+			StartedTs:  run.StartedTs,
+			FinishedTs: run.FinishedTs,
+			Duration:   run.FinishedTs.Sub(run.StartedTs).String(),
+		})
+	}
+
+	s.pageResponse(c, items, page, len(items), total, nil)
+}
+
+func (s *NexServer) ApiAdminRunJob(c *gin.Context) {
+	job := s.findJob(s.Param(c, "job"))
+	if job == nil {
+		s.ApiResponseJson(c, 404, "bad", "job not found")
+		return
+	}
+
+	s.scheduler.Lock()
+	running := job.Running
+	s.scheduler.Unlock()
+	if running {
+		s.ApiResponseJsonf(c, 409, "bad", "job %s is already running", job.Name)
+		return
+	}
+	if job.Feature != "" && !s.featureEnabled(job.Feature) {
+		s.ApiResponseJsonf(c, 409, "bad", "feature %s is disabled", job.Feature)
+		return
+	}
+
+	go func() {
+		if err := s.runJob(job, JobTriggerManual); err != nil {
+			requestLog(c).Warnf("Scheduler: %v\n", err)
+		}
+	}()
+
+	s.ApiResponseJson(c, 202, "ok", "")
+}
+
+// ApiAdminSkipJob skips the next scheduled run of a job, "skip=false"
+// takes the skip back.
+func (s *NexServer) ApiAdminSkipJob(c *gin.Context) {
+	job := s.findJob(s.Param(c, "job"))
+	if job == nil {
+		s.ApiResponseJson(c, 404, "bad", "job not found")
+		return
+	}
+
+	skip := strings.ToLower(c.DefaultQuery("skip", "true")) != "false"
+
+	s.scheduler.Lock()
+	job.SkipNext = skip
+	s.scheduler.Unlock()
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"reflect"
+	"strings"
+)
+
+// The schema endpoint describes the tables of schemaModels for reports
+// reading the database directly. Column types come from the live database,
+// so columns a migration has not added yet (or no longer has) show up.
+// The models declare no foreign keys: a column <model>_id references the
+// table of that model, and schemaReferences covers the columns named
+// otherwise.
+
+const dotContentType = "text/vnd.graphviz; charset=utf-8"
+
+// schemaReferences maps "table.column" or "column" to the referenced table.
+var schemaReferences = map[string]string{
+	"endpoint_id":             "metric_endpoints",
+	"type_id":                 "metric_types",
+	"name_id":                 "metric_names",
+	"label_id":                "metric_labels",
+	"agent_cluster_id":        "clusters",
+	"k8s_events.cluster_id":   "k8s_clusters",
+	"k8s_events.namespace_id": "k8s_namespaces",
+}
+
+type SchemaColumn struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	GoType     string `json:"go_type"`
+	Nullable   bool   `json:"nullable"`
+	PrimaryKey bool   `json:"primary_key"`
+	References string `json:"references,omitempty"`
+	Missing    bool   `json:"missing,omitempty"`
+}
+
+type SchemaTable struct {
+	Name    string         `json:"name"`
+	Model   string         `json:"model"`
+	Columns []SchemaColumn `json:"columns"`
+}
+
+type liveColumn struct {
+	dataType string
+	nullable bool
+}
+
+func (s *NexServer) liveColumns() (map[string]map[string]liveColumn, map[string][]string, error) {
+	rows, err := s.db.Raw(`
+SELECT table_name, column_name, data_type, is_nullable FROM information_schema.columns
+WHERE table_schema=current_schema()
+ORDER BY table_name, ordinal_position`).Rows()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]map[string]liveColumn)
+	order := make(map[string][]string)
+	for rows.Next() {
+		var table, column, dataType, nullable string
+		if err := rows.Scan(&table, &column, &dataType, &nullable); err != nil {
+			return nil, nil, err
+		}
+		if columns[table] == nil {
+			columns[table] = make(map[string]liveColumn)
+		}
+		columns[table][column] = liveColumn{dataType: dataType, nullable: nullable == "YES"}
+		order[table] = append(order[table], column)
+	}
+
+	return columns, order, rows.Err()
+}
+
+// schemaTables describes the tables of the models with their live columns.
+func (s *NexServer) schemaTables() ([]SchemaTable, error) {
+	live, liveOrder, err := s.liveColumns()
+	if err != nil {
+		return nil, err
+	}
+
+	// tables by the column prefix referencing them
+	modelTables := make(map[string]string)
+	for _, model := range schemaModels {
+		modelType := reflect.Indirect(reflect.ValueOf(model)).Type()
+		modelTables[gorm.ToColumnName(modelType.Name())] = s.db.NewScope(model).TableName()
+	}
+	references := func(table, column string) string {
+		if referenced, found := schemaReferences[table+"."+column]; found {
+			return referenced
+		}
+		if referenced, found := schemaReferences[column]; found {
+			return referenced
+		}
+		if strings.HasSuffix(column, "_id") {
+			return modelTables[strings.TrimSuffix(column, "_id")]
+		}
+
+		return ""
+	}
+
+	tables := make([]SchemaTable, 0, len(schemaModels))
+	for _, model := range schemaModels {
+		scope := s.db.NewScope(model)
+		table := SchemaTable{
+			Name:    scope.TableName(),
+			Model:   reflect.Indirect(reflect.ValueOf(model)).Type().Name(),
+			Columns: make([]SchemaColumn, 0),
+		}
+		liveTable := live[table.Name]
+
+		seen := make(map[string]bool)
+		for _, field := range scope.GetModelStruct().StructFields {
+			if !field.IsNormal || field.IsIgnored {
+				continue
+			}
+			column := SchemaColumn{
+				Name:       field.DBName,
+				GoType:     field.Struct.Type.String(),
+				PrimaryKey: field.IsPrimaryKey,
+				References: references(table.Name, field.DBName),
+			}
+			if liveColumn, found := liveTable[field.DBName]; found {
+				column.Type = liveColumn.dataType
+				column.Nullable = liveColumn.nullable
+			} else {
+				column.Missing = true
+			}
+			seen[field.DBName] = true
+			table.Columns = append(table.Columns, column)
+		}
+
+		// columns of the database the model no longer has
+		for _, name := range liveOrder[table.Name] {
+			if seen[name] {
+				continue
+			}
+			table.Columns = append(table.Columns, SchemaColumn{
+				Name:       name,
+				Type:       liveTable[name].dataType,
+				Nullable:   liveTable[name].nullable,
+				References: references(table.Name, name),
+			})
+		}
+
+		tables = append(tables, table)
+	}
+
+	return tables, nil
+}
+
+func dotLabel(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "{", `\{`, "}", `\}`, "|", `\|`, "<", `\<`, ">", `\>`)
+	return replacer.Replace(value)
+}
+
+// schemaDot renders the tables as a Graphviz entity relationship diagram.
+func schemaDot(tables []SchemaTable) string {
+	var dot strings.Builder
+	dot.WriteString("digraph schema {\n")
+	dot.WriteString("  rankdir=LR;\n")
+	dot.WriteString("  node [shape=record, fontname=\"Helvetica\", fontsize=10];\n")
+
+	for _, table := range tables {
+		fields := make([]string, 0, len(table.Columns))
+		for _, column := range table.Columns {
+			name := column.Name
+			if column.PrimaryKey {
+				name += " (pk)"
+			}
+			fields = append(fields, fmt.Sprintf("<%s> %s : %s\\l", dotLabel(column.Name), dotLabel(name), dotLabel(column.Type)))
+		}
+		fmt.Fprintf(&dot, "  %q [label=\"{%s|%s}\"];\n", table.Name, dotLabel(table.Name), strings.Join(fields, ""))
+	}
+	for _, table := range tables {
+		for _, column := range table.Columns {
+			if column.References == "" {
+				continue
+			}
+			fmt.Fprintf(&dot, "  %q:%q -> %q;\n", table.Name, column.Name, column.References)
+		}
+	}
+	dot.WriteString("}\n")
+
+	return dot.String()
+}
+
+func (s *NexServer) ApiAdminSchema(c *gin.Context) {
+	tables, err := s.schemaTables()
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get schema: %v", err)
+		return
+	}
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.JSON(200, gin.H{
+			"status":  "ok",
+			"message": "",
+			"data": gin.H{
+				"schema_version": SchemaVersion(),
+				"tables":         tables,
+			},
+		})
+	case "dot":
+		c.Header("Content-Disposition", "attachment; filename=nexclipper-schema.dot")
+		c.Data(200, dotContentType, []byte(schemaDot(tables)))
+	default:
+		s.ApiResponseJson(c, 400, "bad", "invalid format, expected json or dot")
+	}
+}
@@ -0,0 +1,190 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"time"
+)
+
+// seriesTimeRange returns the requested date range, defaulting to the last
+// day so that exploring series never scans the whole hypertable by accident.
+func (s *NexServer) seriesTimeRange(query *Query) (string, string) {
+	if query != nil && len(query.DateRange) == 2 {
+		return query.DateRange[0], query.DateRange[1]
+	}
+
+	now := time.Now().UTC()
+	return now.Add(-24 * time.Hour).Format(time.RFC3339), now.Format(time.RFC3339)
+}
+
+func (s *NexServer) seriesQuery(c *gin.Context, clusterId uint, query *Query) *gorm.DB {
+	start, end := s.seriesTimeRange(query)
+
+	db := s.requestDB(c).Table("metrics").
+		Joins("JOIN metric_names ON metrics.name_id=metric_names.id").
+		Where("metrics.cluster_id=? AND metrics.ts >= ? AND metrics.ts < ?", clusterId, start, end)
+
+	if query != nil && len(query.MetricNames) > 0 {
+		db = db.Where("metric_names.name IN (?)", query.MetricNames)
+	}
+	if nodeId := s.RemoveSpecialChar(c.DefaultQuery("nodeId", "")); nodeId != "" {
+		db = db.Where("metrics.node_id=?", nodeId)
+	}
+
+	return db
+}
+
+func (s *NexServer) ApiSeriesList(c *gin.Context) {
+	cId, clusterOk := s.idParam(c, "clusterId", false)
+	query := s.ParseQuery(c)
+	if s.mathUnsupported(c, query) {
+		return
+	}
+	if !clusterOk || s.IsValidParams(c.Param("clusterId"), query, false, false) == false {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
+
+	db := s.seriesQuery(c, cId, query).
+		Select("metric_names.name, metric_labels.label, metric_types.name, " +
+			"metrics.node_id, coalesce(nodes.host, ''), " +
+			"metrics.process_id, coalesce(processes.name, ''), " +
+			"metrics.container_id, coalesce(containers.name, ''), " +
+			"MIN(metrics.ts), MAX(metrics.ts), COUNT(*)").
+		Joins("JOIN metric_labels ON metrics.label_id=metric_labels.id").
+		Joins("JOIN metric_types ON metrics.type_id=metric_types.id").
+		Joins("LEFT JOIN nodes ON metrics.node_id=nodes.id").
+		Joins("LEFT JOIN processes ON metrics.process_id=processes.id").
+		Joins("LEFT JOIN containers ON metrics.container_id=containers.id").
+		Group("metric_names.name, metric_labels.label, metric_types.name, " +
+			"metrics.node_id, nodes.host, metrics.process_id, processes.name, " +
+			"metrics.container_id, containers.name").
+		Order("metric_names.name")
+
+	rows, err, queryTime := s.QueryRowsWithTime(db)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	type SeriesItem struct {
+		MetricName  string    `json:"metric_name"`
+		MetricLabel string    `json:"metric_label"`
+		MetricType  string    `json:"metric_type"`
+		EntityType  string    `json:"entity_type"`
+		Entity      string    `json:"entity"`
+		NodeId      uint      `json:"node_id"`
+		Node        string    `json:"node"`
+		ProcessId   uint      `json:"process_id"`
+		ContainerId uint      `json:"container_id"`
+		FirstTs     time.Time `json:"first_ts"`
+		LastTs      time.Time `json:"last_ts"`
+		Samples     uint64    `json:"samples"`
+	}
+	results := make([]SeriesItem, 0, 64)
+
+	for rows.Next() {
+		var item SeriesItem
+		var processName, containerName string
+
+		err := rows.Scan(&item.MetricName, &item.MetricLabel, &item.MetricType,
+			&item.NodeId, &item.Node, &item.ProcessId, &processName, &item.ContainerId, &containerName,
+			&item.FirstTs, &item.LastTs, &item.Samples)
+		if err != nil {
+			requestLog(c).Errorf("failed to get record: %v", err)
+			continue
+		}
+
+		switch {
+		case item.ProcessId != 0:
+			item.EntityType = "process"
+			item.Entity = processName
+		case item.ContainerId != 0:
+			item.EntityType = "container"
+			item.Entity = containerName
+		default:
+			item.EntityType = "node"
+			item.Entity = item.Node
+		}
+
+		results = append(results, item)
+	}
+
+	c.JSON(200, gin.H{
+		"status":        "ok",
+		"message":       "",
+		"data":          results,
+		"count":         len(results),
+		"db_query_time": queryTime.String(),
+	})
+}
+
+func (s *NexServer) ApiSeriesCardinality(c *gin.Context) {
+	cId, clusterOk := s.idParam(c, "clusterId", false)
+	query := s.ParseQuery(c)
+	if s.mathUnsupported(c, query) {
+		return
+	}
+	if !clusterOk || s.IsValidParams(c.Param("clusterId"), query, false, false) == false {
+		s.ApiResponseJson(c, 404, "bad", "invalid query parameters")
+		return
+	}
+
+	db := s.seriesQuery(c, cId, query).
+		Select("metric_names.name, COUNT(DISTINCT (metrics.label_id, metrics.node_id, " +
+			"metrics.process_id, metrics.container_id)), COUNT(*)").
+		Group("metric_names.name").
+		Order("2 DESC")
+
+	rows, err, queryTime := s.QueryRowsWithTime(db)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	type CardinalityItem struct {
+		MetricName string `json:"metric_name"`
+		Series     uint64 `json:"series"`
+		Samples    uint64 `json:"samples"`
+	}
+	results := make([]CardinalityItem, 0, 64)
+	var totalSeries uint64
+
+	for rows.Next() {
+		var item CardinalityItem
+
+		if err := rows.Scan(&item.MetricName, &item.Series, &item.Samples); err != nil {
+			requestLog(c).Errorf("failed to get record: %v", err)
+			continue
+		}
+
+		totalSeries += item.Series
+		results = append(results, item)
+	}
+
+	c.JSON(200, gin.H{
+		"status":        "ok",
+		"message":       "",
+		"data":          results,
+		"total_series":  totalSeries,
+		"db_query_time": queryTime.String(),
+	})
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// severityPriority orders severities; 1 is the most urgent.
+var severityPriority = map[string]int{
+	SeverityCritical: 1,
+	SeverityWarning:  2,
+	SeverityInfo:     3,
+}
+
+// severityWeight is the health score penalty of an open incident.
+var severityWeight = map[string]float64{
+	SeverityCritical: 25,
+	SeverityWarning:  10,
+	SeverityInfo:     2,
+}
+
+var defaultIncidentSeverity = map[string]string{
+	"agent_disconnected":             SeverityCritical,
+	"agent_connected":                SeverityInfo,
+	"agent_degraded":                 SeverityWarning,
+	"node_disk_free":                 SeverityCritical,
+	"node_cpu_load_avg_1":            SeverityWarning,
+	"node_memory_free":               SeverityWarning,
+	"node_auth_failures":             SeverityCritical,
+	"node_zombie_processes":          SeverityWarning,
+	"node_uninterruptible_processes": SeverityCritical,
+	"node_deleted_binaries":          SeverityInfo,
+	"node_ephemeral_storage":         SeverityCritical,
+	"pod_ephemeral_storage":          SeverityWarning,
+	"cronjob_not_succeeded":          SeverityWarning,
+	"change_point":                   SeverityInfo,
+	unexpectedListener:               SeverityWarning,
+	k8sResourceNotReady:              SeverityWarning,
+	kernelOOMKill:                    SeverityWarning,
+	kernelIOError:                    SeverityCritical,
+	kernelHardwareError:              SeverityCritical,
+}
+
+func isValidSeverity(severity string) bool {
+	_, found := severityPriority[severity]
+	return found
+}
+
+// incidentSeverity resolves the severity of a rule from the configuration,
+// then from the stored rule, then from the built-in defaults.
+func (s *NexServer) incidentSeverity(eventName string) string {
+	if severity, found := s.config.BasicRule.Severities[eventName]; found {
+		return severity
+	}
+
+	var rule IncidentBasicRule
+	result := s.db.Where("name=?", eventName).First(&rule)
+	if result.Error == nil && isValidSeverity(rule.Severity) {
+		return rule.Severity
+	}
+
+	if severity, found := defaultIncidentSeverity[eventName]; found {
+		return severity
+	}
+
+	return SeverityWarning
+}
+
+// clusterHealthScores returns 100 minus the weighted open incidents of each
+// cluster, floored at zero.
+func (s *NexServer) clusterHealthScores() map[uint]float64 {
+	scores := make(map[uint]float64)
+
+	for _, incidents := range s.incidentMap {
+		for _, incident := range incidents {
+			if _, found := scores[incident.ClusterId]; !found {
+				scores[incident.ClusterId] = 100
+			}
+			scores[incident.ClusterId] -= severityWeight[incident.Severity]
+		}
+	}
+
+	for clusterId, score := range scores {
+		if score < 0 {
+			scores[clusterId] = 0
+		}
+	}
+
+	return scores
+}
@@ -0,0 +1,355 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"hash/crc32"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In shard mode several servers share one database and split the agents
+// among themselves. Every server announces itself in server_members with
+// a heartbeat; agents are mapped to the live members with a consistent
+// hash of their machine id, so a member joining or leaving only moves
+// the agents of its own ring segments. Agents connecting to the wrong
+// member are redirected to the owner.
+
+const (
+	shardHeartbeatInterval = 5 * time.Second
+	shardMemberTimeout     = 3 * shardHeartbeatInterval
+	shardRedirectKey       = "x-nexserver-redirect"
+)
+
+type ShardConfig struct {
+	Enabled      bool
+	Name         string
+	Address      string
+	VirtualNodes int
+}
+
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+func newHashRing(members []string, virtualNodes int) *hashRing {
+	ring := &hashRing{
+		points: make([]uint32, 0, len(members)*virtualNodes),
+		owners: make(map[uint32]string),
+	}
+
+	for _, member := range members {
+		for idx := 0; idx < virtualNodes; idx++ {
+			point := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", member, idx)))
+			if _, found := ring.owners[point]; found {
+				continue
+			}
+			ring.owners[point] = member
+			ring.points = append(ring.points, point)
+		}
+	}
+
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+
+	return ring
+}
+
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	idx := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= hash })
+	if idx == len(r.points) {
+		idx = 0
+	}
+
+	return r.owners[r.points[idx]]
+}
+
+type ShardState struct {
+	sync.RWMutex
+
+	ring    *hashRing
+	members map[string]ServerMember
+	moved   map[string]bool
+}
+
+func (s *NexServer) instanceName() string {
+	if s.config.Shard.Name != "" {
+		return s.config.Shard.Name
+	}
+
+	hostName, _ := os.Hostname()
+	return hostName
+}
+
+func (s *NexServer) shardVirtualNodes() int {
+	if s.config.Shard.VirtualNodes > 0 {
+		return s.config.Shard.VirtualNodes
+	}
+
+	return 64
+}
+
+func (s *NexServer) shardHeartbeat() error {
+	var member ServerMember
+
+	result := s.db.Where(ServerMember{Name: s.instanceName()}).
+		Assign(ServerMember{Address: s.config.Shard.Address, HeartbeatTs: time.Now()}).
+		FirstOrCreate(&member)
+
+	return result.Error
+}
+
+func (s *NexServer) liveShardMembers() (map[string]ServerMember, error) {
+	var members []ServerMember
+
+	result := s.db.Where("heartbeat_ts > ?", time.Now().Add(-shardMemberTimeout)).Find(&members)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	live := make(map[string]ServerMember, len(members))
+	for _, member := range members {
+		live[member.Name] = member
+	}
+
+	return live, nil
+}
+
+func sameShardMembers(left, right map[string]ServerMember) bool {
+	if len(left) != len(right) {
+		return false
+	}
+	for name, member := range left {
+		if other, found := right[name]; !found || other.Address != member.Address {
+			return false
+		}
+	}
+
+	return true
+}
+
+// shardOwner returns the member serving the agent. Without a ring yet
+// every agent is accepted locally.
+func (s *NexServer) shardOwner(machineId string) (ServerMember, bool) {
+	s.shard.RLock()
+	defer s.shard.RUnlock()
+
+	if s.shard.ring == nil {
+		return ServerMember{}, true
+	}
+
+	owner := s.shard.ring.owner(machineId)
+	if owner == "" || owner == s.instanceName() {
+		return ServerMember{}, true
+	}
+
+	member, found := s.shard.members[owner]
+	if !found {
+		return ServerMember{}, true
+	}
+
+	return member, false
+}
+
+// rebalanceAgents hands the connected agents that moved to another member
+// over to their new owner.
+func (s *NexServer) rebalanceAgents() {
+	s.RLock()
+	agents := make([]*Agent, 0, len(s.agentMap))
+	for _, agent := range s.agentMap {
+		agents = append(agents, agent)
+	}
+	s.RUnlock()
+
+	moved := 0
+	for _, agent := range agents {
+		owner, local := s.shardOwner(agent.MachineID)
+		if local {
+			continue
+		}
+
+		err := s.commands.send(agent.Uuid, newAgentCommand("reconnect", owner.Address))
+		if err != nil {
+			clusterLog.Errorf("Shard: failed to move agent %s: %v\n", agent.Uuid, err)
+			continue
+		}
+
+		s.shard.Lock()
+		if s.shard.moved == nil {
+			s.shard.moved = make(map[string]bool)
+		}
+		s.shard.moved[agent.Uuid] = true
+		s.shard.Unlock()
+
+		moved++
+	}
+
+	if moved > 0 {
+		clusterLog.Infof("Shard: %d agents moved to other members\n", moved)
+	}
+}
+
+// releaseMovedAgent forgets an agent that disconnected to join its new
+// owner. It is neither reported as disconnected nor marked offline, the
+// new owner has taken it over already.
+func (s *NexServer) releaseMovedAgent(agentUuid string) bool {
+	s.shard.Lock()
+	moved := s.shard.moved[agentUuid]
+	delete(s.shard.moved, agentUuid)
+	s.shard.Unlock()
+
+	if !moved {
+		return false
+	}
+
+	s.Lock()
+	delete(s.agentMap, agentUuid)
+	s.Unlock()
+
+	clusterLog.Infof("Shard: agent %s moved\n", agentUuid)
+
+	return true
+}
+
+func (s *NexServer) updateShardMembers() {
+	if err := s.shardHeartbeat(); err != nil {
+		clusterLog.Errorf("Shard: failed to send heartbeat: %v\n", err)
+		return
+	}
+
+	members, err := s.liveShardMembers()
+	if err != nil {
+		clusterLog.Errorf("Shard: failed to get members: %v\n", err)
+		return
+	}
+
+	s.shard.Lock()
+	changed := s.shard.ring == nil || !sameShardMembers(s.shard.members, members)
+	if changed {
+		names := make([]string, 0, len(members))
+		for name := range members {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		s.shard.members = members
+		s.shard.ring = newHashRing(names, s.shardVirtualNodes())
+
+		clusterLog.Infof("Shard: members changed: %s\n", strings.Join(names, ", "))
+	}
+	s.shard.Unlock()
+
+	if changed {
+		s.rebalanceAgents()
+	}
+}
+
+func (s *NexServer) InitShardMembership() {
+	if !s.config.Shard.Enabled {
+		return
+	}
+	if s.config.Shard.Address == "" {
+		clusterLog.Warnf("Shard: missing advertised address, shard mode disabled")
+		s.config.Shard.Enabled = false
+		return
+	}
+
+	clusterLog.Infof("Shard: joining as %s (%s)\n", s.instanceName(), s.config.Shard.Address)
+
+	s.updateShardMembers()
+	for range time.Tick(shardHeartbeatInterval) {
+		s.updateShardMembers()
+	}
+}
+
+// redirectAgent refuses an agent owned by another member and tells it
+// where to connect instead.
+func (s *NexServer) redirectAgent(ctx context.Context, machineId string) error {
+	if !s.config.Shard.Enabled {
+		return nil
+	}
+
+	owner, local := s.shardOwner(machineId)
+	if local {
+		return nil
+	}
+
+	if err := grpc.SetTrailer(ctx, metadata.Pairs(shardRedirectKey, owner.Address)); err != nil {
+		clusterLog.Errorf("Shard: failed to set redirect: %v\n", err)
+	}
+
+	return status.Errorf(codes.FailedPrecondition, "agent is served by %s", owner.Name)
+}
+
+func (s *NexServer) ApiAdminShards(c *gin.Context) {
+	s.shard.RLock()
+	members := s.shard.members
+	ring := s.shard.ring
+	s.shard.RUnlock()
+
+	var agents []Agent
+	s.requestDB(c).Select("machine_id").Where("online=?", true).Find(&agents)
+
+	owned := make(map[string]int)
+	if ring != nil {
+		for _, agent := range agents {
+			owned[ring.owner(agent.MachineID)]++
+		}
+	}
+
+	type MemberItem struct {
+		Name        string    `json:"name"`
+		Address     string    `json:"address"`
+		HeartbeatTs time.Time `json:"heartbeat_ts"`
+		Agents      int       `json:"agents"`
+	}
+	items := make([]MemberItem, 0, len(members))
+	for _, member := range members {
+		items = append(items, MemberItem{
+			Name:        member.Name,
+			Address:     member.Address,
+			HeartbeatTs: member.HeartbeatTs,
+			Agents:      owned[member.Name],
+		})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Name < items[j].Name })
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"enabled": s.config.Shard.Enabled,
+			"name":    s.instanceName(),
+			"members": items,
+		},
+	})
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// On SIGINT or SIGTERM the server stops in order: the ping streams end
+// with Unavailable so that the agents reconnect, to another replica
+// behind a balancer, without being reported offline; the HTTP listeners
+// and the gRPC server stop accepting and wait for the requests in flight;
+// the samples queued by the ingestion are written and the usage of the
+// API keys is saved; the database is closed last. Whatever is not done
+// when the shutdown timeout expires is abandoned and the server exits
+// with an error.
+
+const defaultShutdownTimeout = 30 * time.Second
+
+type Lifecycle struct {
+	sync.Mutex
+
+	servers  []*http.Server
+	grpc     *grpc.Server
+	shutdown chan struct{}
+	stopped  chan struct{}
+	err      error
+}
+
+func newLifecycle() Lifecycle {
+	return Lifecycle{
+		shutdown: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// shuttingDown returns whether the server is shutting down.
+func (s *NexServer) shuttingDown() bool {
+	select {
+	case <-s.lifecycle.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *NexServer) addHttpServer(server *http.Server) {
+	s.lifecycle.Lock()
+	defer s.lifecycle.Unlock()
+
+	s.lifecycle.servers = append(s.lifecycle.servers, server)
+}
+
+// serveUnix runs the router on a unix socket, replacing a stale socket
+// file the way gin does.
+func (s *NexServer) serveUnix(router *gin.Engine, path string) error {
+	_ = os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	server := &http.Server{Handler: router}
+	s.addHttpServer(server)
+
+	if err := server.Serve(listener); err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
+
+func (s *NexServer) shutdownTimeout() time.Duration {
+	if s.config.Server.ShutdownTimeout <= 0 {
+		return defaultShutdownTimeout
+	}
+
+	return time.Duration(s.config.Server.ShutdownTimeout) * time.Second
+}
+
+func (s *NexServer) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+	serverLog.Infof("Server: received %s, shutting down\n", sig)
+	signal.Stop(signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout())
+	defer cancel()
+
+	s.lifecycle.err = s.Shutdown(ctx)
+	close(s.lifecycle.stopped)
+}
+
+// Shutdown stops the server, giving up when the context is done.
+func (s *NexServer) Shutdown(ctx context.Context) error {
+	close(s.lifecycle.shutdown)
+
+	s.lifecycle.Lock()
+	servers := s.lifecycle.servers
+	grpcServer := s.lifecycle.grpc
+	s.lifecycle.Unlock()
+
+	var wait sync.WaitGroup
+	for _, server := range servers {
+		wait.Add(1)
+		go func(server *http.Server) {
+			defer wait.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				apiLog.Warnf("Server: failed to drain %s: %v\n", server.Addr, err)
+			}
+		}(server)
+	}
+
+	if grpcServer != nil {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			stopped := make(chan struct{})
+			go func() {
+				grpcServer.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-ctx.Done():
+				serverLog.Warnf("Server: gRPC calls still running, closing them\n")
+				grpcServer.Stop()
+			}
+		}()
+	}
+	wait.Wait()
+
+	if err := s.drainMetricWriter(ctx); err != nil {
+		return err
+	}
+	s.flushApiUsage()
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("shutdown timed out: %v", ctx.Err())
+	}
+	if s.db != nil {
+		if err := s.db.Close(); err != nil {
+			serverLog.Warnf("Server: failed to close the database: %v\n", err)
+		}
+	}
+	serverLog.Infof("Server: stopped\n")
+
+	return nil
+}
+
+// waitShutdown waits for the end of the shutdown started by a signal.
+func (s *NexServer) waitShutdown() error {
+	<-s.lifecycle.stopped
+
+	return s.lifecycle.err
+}
@@ -0,0 +1,354 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access logs of the API and admin listeners are shipped to a SIEM, either
+// as CEF lines over syslog or as events to a Splunk HTTP Event Collector.
+// Requests changing state (anything but GET, HEAD and OPTIONS) are audit
+// events, the others are access events. Events are batched for at most
+// siemFlushPeriod and dropped, never blocking, when the queue is full.
+
+const (
+	SiemTypeSyslog = "syslog"
+	SiemTypeHEC    = "hec"
+
+	SiemKindAccess = "access"
+	SiemKindAudit  = "audit"
+
+	siemBatchSize   = 256
+	siemFlushPeriod = time.Second
+	siemQueueSize   = 4096
+
+	// local4 facility with info and notice severities
+	syslogPriorityAccess = 20*8 + 6
+	syslogPriorityAudit  = 20*8 + 5
+)
+
+type SiemConfig struct {
+	Type   string
+	Url    string
+	Token  string `secret:"true"`
+	Source string
+}
+
+type SiemEvent struct {
+	Ts        time.Time `json:"ts"`
+	Kind      string    `json:"kind"`
+	Listener  string    `json:"listener"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Query     string    `json:"query,omitempty"`
+	Status    int       `json:"status"`
+	ClientIp  string    `json:"client_ip"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	LatencyMs float64   `json:"latency_ms"`
+	TraceId   string    `json:"trace_id,omitempty"`
+}
+
+type SiemShipper struct {
+	config   SiemConfig
+	hostname string
+	client   *http.Client
+	queue    chan *SiemEvent
+	once     sync.Once
+
+	conn net.Conn
+}
+
+func NewSiemShipper(config SiemConfig) (*SiemShipper, error) {
+	switch config.Type {
+	case SiemTypeSyslog:
+		target, err := url.Parse(config.Url)
+		if err != nil || (target.Scheme != "udp" && target.Scheme != "tcp") || target.Host == "" {
+			return nil, fmt.Errorf("syslog url must be udp://host:port or tcp://host:port")
+		}
+	case SiemTypeHEC:
+		target, err := url.Parse(config.Url)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("invalid HEC url: %s", config.Url)
+		}
+		if config.Token == "" {
+			return nil, fmt.Errorf("HEC token is required")
+		}
+	default:
+		return nil, fmt.Errorf("unknown SIEM type: %s", config.Type)
+	}
+
+	if config.Source == "" {
+		config.Source = "nexserver"
+	}
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+
+	return &SiemShipper{
+		config:   config,
+		hostname: hostname,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *SiemEvent, siemQueueSize),
+	}, nil
+}
+
+func (t *SiemShipper) Send(event *SiemEvent) {
+	t.once.Do(func() {
+		go t.run()
+	})
+
+	select {
+	case t.queue <- event:
+	default:
+		// drop events rather than blocking request handling
+	}
+}
+
+func (t *SiemShipper) run() {
+	batch := make([]*SiemEvent, 0, siemBatchSize)
+	ticker := time.NewTicker(siemFlushPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-t.queue:
+			batch = append(batch, event)
+			if len(batch) < siemBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := t.flush(batch); err != nil {
+			incidentLog.Errorf("SIEM: failed to ship %d events: %v\n", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+}
+
+func (t *SiemShipper) flush(batch []*SiemEvent) error {
+	if t.config.Type == SiemTypeHEC {
+		return t.flushHEC(batch)
+	}
+
+	return t.flushSyslog(batch)
+}
+
+// cefHeader escapes a CEF header field.
+func cefHeader(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ").Replace(value)
+}
+
+// cefValue escapes a CEF extension value.
+func cefValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`).Replace(value)
+}
+
+func (event *SiemEvent) cef() string {
+	severity := 3
+	if event.Kind == SiemKindAudit {
+		severity = 5
+	}
+	if event.Status >= 400 {
+		severity += 2
+	}
+
+	outcome := "success"
+	if event.Status >= 400 {
+		outcome = "failure"
+	}
+
+	request := event.Path
+	if event.Query != "" {
+		request += "?" + event.Query
+	}
+
+	extensions := []string{
+		fmt.Sprintf("rt=%d", event.Ts.UnixNano()/int64(time.Millisecond)),
+		"src=" + cefValue(event.ClientIp),
+		"requestMethod=" + cefValue(event.Method),
+		"request=" + cefValue(request),
+		"outcome=" + outcome,
+		fmt.Sprintf("cn1=%d cn1Label=status", event.Status),
+		fmt.Sprintf("cfp1=%.3f cfp1Label=latencyMs", event.LatencyMs),
+		"cs1=" + cefValue(event.Listener) + " cs1Label=listener",
+	}
+	if event.UserAgent != "" {
+		extensions = append(extensions, "requestClientApplication="+cefValue(event.UserAgent))
+	}
+	if event.TraceId != "" {
+		extensions = append(extensions, "cs2="+cefValue(event.TraceId)+" cs2Label=traceId")
+	}
+
+	return fmt.Sprintf("CEF:0|NexClipper|NexServer|%s|%s|%s|%d|%s",
+		cefHeader(NexServerVersion), cefHeader("api."+event.Kind),
+		cefHeader(event.Method+" "+event.Path), severity, strings.Join(extensions, " "))
+}
+
+// flushSyslog writes one RFC 5424 message per event, newline framed on
+// TCP. The connection is dialed again after a write error.
+func (t *SiemShipper) flushSyslog(batch []*SiemEvent) error {
+	if t.conn == nil {
+		target, _ := url.Parse(t.config.Url)
+		conn, err := net.DialTimeout(target.Scheme, target.Host, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		t.conn = conn
+	}
+
+	for _, event := range batch {
+		priority := syslogPriorityAccess
+		if event.Kind == SiemKindAudit {
+			priority = syslogPriorityAudit
+		}
+
+		message := fmt.Sprintf("<%d>1 %s %s %s - %s - %s\n", priority,
+			event.Ts.UTC().Format(time.RFC3339Nano), t.hostname, t.config.Source, event.Kind, event.cef())
+
+		if _, err := t.conn.Write([]byte(message)); err != nil {
+			t.conn.Close()
+			t.conn = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+// flushHEC posts the batch as concatenated HEC events.
+func (t *SiemShipper) flushHEC(batch []*SiemEvent) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+
+	for _, event := range batch {
+		err := encoder.Encode(map[string]interface{}{
+			"time":       float64(event.Ts.UnixNano()) / float64(time.Second),
+			"host":       t.hostname,
+			"source":     t.config.Source,
+			"sourcetype": "nexclipper:" + event.Kind,
+			"event":      event,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("POST", t.config.Url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Splunk "+t.config.Token)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *NexServer) initSiem() {
+	if s.config.Siem.Type == "" {
+		return
+	}
+
+	shipper, err := NewSiemShipper(s.config.Siem)
+	if err != nil {
+		incidentLog.Warnf("SIEM: disabled: %v\n", err)
+		return
+	}
+
+	s.siem = shipper
+	incidentLog.Infof("SIEM: shipping access logs to %s over %s\n", s.config.Siem.Url, s.config.Siem.Type)
+}
+
+// requestClientIp returns the peer address of the request, or the
+// forwarded one when the peer is a trusted proxy.
+func (s *NexServer) requestClientIp(c *gin.Context) string {
+	address, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		address = c.Request.RemoteAddr
+	}
+
+	if s.isTrustedProxy(address) {
+		if forwarded := c.GetHeader("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+
+	return address
+}
+
+// SiemMiddleware ships an event for every request of the listener.
+func (s *NexServer) SiemMiddleware(listener string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.siem == nil {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		c.Next()
+
+		kind := SiemKindAudit
+		switch c.Request.Method {
+		case "GET", "HEAD", "OPTIONS":
+			kind = SiemKindAccess
+		}
+
+		event := &SiemEvent{
+			Ts:        start,
+			Kind:      kind,
+			Listener:  listener,
+			Method:    c.Request.Method,
+			Path:      c.Request.URL.Path,
+			Query:     c.Request.URL.RawQuery,
+			Status:    c.Writer.Status(),
+			ClientIp:  s.requestClientIp(c),
+			UserAgent: c.Request.UserAgent(),
+			LatencyMs: float64(time.Since(start)) / float64(time.Millisecond),
+		}
+		if span := SpanFromContext(c.Request.Context()); span != nil {
+			event.TraceId = span.TraceId
+		}
+
+		s.siem.Send(event)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Decoder of the snappy block format used by Prometheus remote_write. Only
+// decoding is needed, which is small enough to not pull in a dependency.
+
+const (
+	snappyTagLiteral = 0
+	snappyTagCopy1   = 1
+	snappyTagCopy2   = 2
+	snappyTagCopy4   = 3
+)
+
+var errSnappyCorrupt = fmt.Errorf("snappy: corrupt input")
+
+// decodeSnappy decodes a snappy block whose decoded length must not exceed
+// maxLength.
+func decodeSnappy(src []byte, maxLength int) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, errSnappyCorrupt
+	}
+	if length > uint64(maxLength) {
+		return nil, fmt.Errorf("snappy: decoded length %d exceeds %d", length, maxLength)
+	}
+
+	dst := make([]byte, 0, length)
+	src = src[n:]
+
+	for len(src) > 0 {
+		tag := src[0]
+
+		var offset, size int
+		switch tag & 0x03 {
+		case snappyTagLiteral:
+			size = int(tag >> 2)
+			src = src[1:]
+			if size >= 60 {
+				extra := size - 59
+				if len(src) < extra {
+					return nil, errSnappyCorrupt
+				}
+				size = 0
+				for i := extra - 1; i >= 0; i-- {
+					size = size<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			size += 1
+
+			if size <= 0 || size > len(src) || len(dst)+size > int(length) {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[:size]...)
+			src = src[size:]
+			continue
+		case snappyTagCopy1:
+			if len(src) < 2 {
+				return nil, errSnappyCorrupt
+			}
+			size = 4 + int(tag>>2)&0x07
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case snappyTagCopy2:
+			if len(src) < 3 {
+				return nil, errSnappyCorrupt
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:3]))
+			src = src[3:]
+		case snappyTagCopy4:
+			if len(src) < 5 {
+				return nil, errSnappyCorrupt
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:5]))
+			src = src[5:]
+		}
+
+		if offset <= 0 || offset > len(dst) || len(dst)+size > int(length) {
+			return nil, errSnappyCorrupt
+		}
+		// copies may overlap their own output
+		start := len(dst) - offset
+		for i := 0; i < size; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if len(dst) != int(length) {
+		return nil, errSnappyCorrupt
+	}
+
+	return dst, nil
+}
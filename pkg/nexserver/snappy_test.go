@@ -0,0 +1,125 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDecodeSnappy(t *testing.T) {
+	long := strings.Repeat("0123456789", 10)
+
+	tests := []struct {
+		name      string
+		src       []byte
+		maxLength int
+		want      string
+	}{
+		{
+			name:      "empty",
+			src:       []byte{0x00},
+			maxLength: 16,
+			want:      "",
+		},
+		{
+			name:      "literal",
+			src:       []byte{0x05, 0x10, 'h', 'e', 'l', 'l', 'o'},
+			maxLength: 16,
+			want:      "hello",
+		},
+		{
+			name:      "literal with one length byte",
+			src:       append([]byte{0x64, 0xf0, 0x63}, long...),
+			maxLength: 128,
+			want:      long,
+		},
+		{
+			name:      "copy with 1-byte offset",
+			src:       []byte{0x0c, 0x0c, 'a', 'b', 'c', 'd', 0x11, 0x04},
+			maxLength: 16,
+			want:      "abcdabcdabcd",
+		},
+		{
+			name:      "copy with 2-byte offset",
+			src:       []byte{0x0b, 0x00, 'a', 0x26, 0x01, 0x00},
+			maxLength: 16,
+			want:      "aaaaaaaaaaa",
+		},
+		{
+			name:      "copy with 4-byte offset",
+			src:       []byte{0x0b, 0x00, 'a', 0x27, 0x01, 0x00, 0x00, 0x00},
+			maxLength: 16,
+			want:      "aaaaaaaaaaa",
+		},
+		{
+			name:      "length at the limit",
+			src:       []byte{0x05, 0x10, 'h', 'e', 'l', 'l', 'o'},
+			maxLength: 5,
+			want:      "hello",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeSnappy(test.src, test.maxLength)
+			if err != nil {
+				t.Fatalf("decodeSnappy: %v", err)
+			}
+			if !bytes.Equal(got, []byte(test.want)) {
+				t.Errorf("decodeSnappy = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeSnappyCorrupt(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       []byte
+		maxLength int
+	}{
+		{name: "no length", src: []byte{}},
+		{name: "truncated length", src: []byte{0x80}},
+		{name: "length over the limit", src: []byte{0x05, 0x10, 'h', 'e', 'l', 'l', 'o'}, maxLength: 4},
+		{name: "huge length", src: []byte{0xff, 0xff, 0xff, 0xff, 0x0f}, maxLength: 1 << 20},
+		{name: "truncated literal", src: []byte{0x05, 0x10, 'h', 'e', 'l'}},
+		{name: "truncated literal length", src: []byte{0x64, 0xf0}},
+		{name: "literal over the length", src: []byte{0x02, 0x10, 'h', 'e', 'l', 'l', 'o'}},
+		{name: "truncated 1-byte offset copy", src: []byte{0x08, 0x0c, 'a', 'b', 'c', 'd', 0x01}},
+		{name: "truncated 2-byte offset copy", src: []byte{0x08, 0x00, 'a', 0x0e, 0x01}},
+		{name: "truncated 4-byte offset copy", src: []byte{0x08, 0x00, 'a', 0x0f, 0x01, 0x00, 0x00}},
+		{name: "zero offset", src: []byte{0x08, 0x0c, 'a', 'b', 'c', 'd', 0x01, 0x00}},
+		{name: "offset before the output", src: []byte{0x08, 0x0c, 'a', 'b', 'c', 'd', 0x01, 0x05}},
+		{name: "copy before any literal", src: []byte{0x04, 0x01, 0x01}},
+		{name: "copy over the length", src: []byte{0x06, 0x0c, 'a', 'b', 'c', 'd', 0x01, 0x04}},
+		{name: "short output", src: []byte{0x08, 0x0c, 'a', 'b', 'c', 'd'}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			maxLength := test.maxLength
+			if maxLength == 0 {
+				maxLength = 16
+			}
+			if got, err := decodeSnappy(test.src, maxLength); err == nil {
+				t.Errorf("decodeSnappy = %q, want an error", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"math"
+	"time"
+)
+
+// The tiny charts of the list views ask for resolution=sparkline and get
+// sparklinePoints points per series rather than every bucket. The range is
+// cut into sparklineBuckets buckets by the database, with the aggregation
+// of the query, and the buckets are thinned with Largest-Triangle-Three-
+// Buckets, which keeps the peaks and dips that shape the line. Each point
+// carries the min and max of the buckets it stands for, so a spike hidden
+// by the thinning still shows in the band.
+
+const (
+	resolutionSparkline = "sparkline"
+	sparklinePoints     = 30
+	sparklineBuckets    = sparklinePoints * 4
+)
+
+type SparklinePoint struct {
+	Ts    time.Time `json:"ts"`
+	Value float64   `json:"value"`
+	Min   float64   `json:"min"`
+	Max   float64   `json:"max"`
+}
+
+type SparklineSeries struct {
+	Node        string           `json:"node"`
+	NodeId      uint             `json:"node_id"`
+	MetricName  string           `json:"metric_name"`
+	MetricLabel string           `json:"metric_label"`
+	Points      []SparklinePoint `json:"points"`
+}
+
+// sparklineBucket returns the bucket of the range cut into
+// sparklineBuckets, nil if the range is invalid.
+func sparklineBucket(dateRange []string) *SqlQuery {
+	if len(dateRange) != 2 {
+		return nil
+	}
+	start, err := parseRangeTime(dateRange[0])
+	if err != nil {
+		return nil
+	}
+	end, err := parseRangeTime(dateRange[1])
+	if err != nil || !end.After(start) {
+		return nil
+	}
+
+	width := int64(math.Ceil(end.Sub(start).Seconds() / sparklineBuckets))
+	if width < 1 {
+		width = 1
+	}
+
+	// the width is computed here, so it can go into the statement text
+	return NewSqlQuery(fmt.Sprintf(
+		"to_timestamp(floor(extract(epoch from ts) / %d) * %d) as bucket", width, width))
+}
+
+func spanPoint(ts []time.Time, values []float64, from, to, pick int) SparklinePoint {
+	point := SparklinePoint{Ts: ts[pick], Value: values[pick], Min: values[from], Max: values[from]}
+	for idx := from + 1; idx < to; idx++ {
+		point.Min = math.Min(point.Min, values[idx])
+		point.Max = math.Max(point.Max, values[idx])
+	}
+
+	return point
+}
+
+// downsampleLTTB keeps threshold points of the series: the first, the last
+// and, from each of the buckets between them, the one forming the largest
+// triangle with the point kept before and the average of the next bucket.
+func downsampleLTTB(ts []time.Time, values []float64, threshold int) []SparklinePoint {
+	count := len(values)
+	points := make([]SparklinePoint, 0, threshold)
+	if count <= threshold || threshold < 3 {
+		for idx := range values {
+			points = append(points, spanPoint(ts, values, idx, idx+1, idx))
+		}
+		return points
+	}
+
+	x := func(idx int) float64 {
+		return float64(ts[idx].Unix())
+	}
+	every := float64(count-2) / float64(threshold-2)
+	bounds := func(bucket int) (int, int) {
+		from := int(math.Floor(float64(bucket)*every)) + 1
+		to := int(math.Floor(float64(bucket+1)*every)) + 1
+		if to > count-1 {
+			to = count - 1
+		}
+		return from, to
+	}
+
+	points = append(points, spanPoint(ts, values, 0, 1, 0))
+	kept := 0
+	for bucket := 0; bucket < threshold-2; bucket++ {
+		from, to := bounds(bucket)
+
+		// the average of the next bucket, the last point for the last one
+		nextFrom, nextTo := count-1, count
+		if bucket < threshold-3 {
+			nextFrom, nextTo = bounds(bucket + 1)
+		}
+		var avgX, avgY float64
+		for idx := nextFrom; idx < nextTo; idx++ {
+			avgX += x(idx)
+			avgY += values[idx]
+		}
+		avgX /= float64(nextTo - nextFrom)
+		avgY /= float64(nextTo - nextFrom)
+
+		pick, maxArea := from, -1.0
+		for idx := from; idx < to; idx++ {
+			area := math.Abs((x(kept)-avgX)*(values[idx]-values[kept]) - (x(kept)-x(idx))*(avgY-values[kept]))
+			if area > maxArea {
+				pick, maxArea = idx, area
+			}
+		}
+
+		points = append(points, spanPoint(ts, values, from, to, pick))
+		kept = pick
+	}
+
+	return append(points, spanPoint(ts, values, count-1, count, count-1))
+}
+
+// writeSparklines thins the buckets of the series read from rows, with the
+// columns node, node_id, value, bucket, metric name and label ordered by
+// bucket, and replies them.
+func (s *NexServer) writeSparklines(c *gin.Context, rows *sql.Rows, queryTime time.Duration) {
+	type seriesKey struct {
+		nodeId uint
+		name   string
+		label  string
+	}
+	type seriesData struct {
+		series SparklineSeries
+		ts     []time.Time
+		values []float64
+	}
+
+	order := make([]seriesKey, 0)
+	byKey := make(map[seriesKey]*seriesData)
+	for rows.Next() {
+		var item SparklineSeries
+		var value float64
+		var bucket time.Time
+		var samples, series int64
+
+		err := rows.Scan(&item.Node, &item.NodeId, &value, &bucket, &item.MetricName, &item.MetricLabel,
+			&samples, &series)
+		if err != nil {
+			requestLog(c).Errorf("failed to get record: %v", err)
+			continue
+		}
+
+		key := seriesKey{item.NodeId, item.MetricName, item.MetricLabel}
+		data, found := byKey[key]
+		if !found {
+			data = &seriesData{series: item}
+			byKey[key] = data
+			order = append(order, key)
+		}
+		data.ts = append(data.ts, bucket)
+		data.values = append(data.values, value)
+	}
+
+	results := make([]SparklineSeries, 0, len(order))
+	for _, key := range order {
+		data := byKey[key]
+		data.series.Points = downsampleLTTB(data.ts, data.values, sparklinePoints)
+		results = append(results, data.series)
+	}
+
+	c.JSON(200, gin.H{
+		"status":        "ok",
+		"message":       "",
+		"data":          results,
+		"db_query_time": queryTime.String(),
+	})
+}
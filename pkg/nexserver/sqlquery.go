@@ -0,0 +1,107 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jinzhu/gorm"
+	"strings"
+)
+
+// SqlQuery is a raw statement built from fragments. Values coming from a
+// request are always bound to "?" placeholders and never formatted into
+// the statement text; only identifiers and keywords the server picks
+// itself go into the text.
+type SqlQuery struct {
+	text strings.Builder
+	args []interface{}
+	err  error
+}
+
+func NewSqlQuery(text string, args ...interface{}) *SqlQuery {
+	q := &SqlQuery{}
+
+	return q.Append(text, args...)
+}
+
+// Append adds a fragment with one argument per placeholder. A mismatch,
+// such as a literal question mark in the text, fails the query instead of
+// sending a broken statement; such values must be bound as arguments.
+func (q *SqlQuery) Append(text string, args ...interface{}) *SqlQuery {
+	if placeholders := strings.Count(text, "?"); placeholders != len(args) {
+		if q.err == nil {
+			q.err = fmt.Errorf("sql: %d placeholders for %d arguments: %s", placeholders, len(args), text)
+		}
+		return q
+	}
+
+	q.text.WriteString(text)
+	q.args = append(q.args, args...)
+
+	return q
+}
+
+func (q *SqlQuery) AppendIf(cond bool, text string, args ...interface{}) *SqlQuery {
+	if !cond {
+		return q
+	}
+
+	return q.Append(text, args...)
+}
+
+func (q *SqlQuery) AppendQuery(other *SqlQuery) *SqlQuery {
+	if q.err == nil {
+		q.err = other.err
+	}
+	q.text.WriteString(other.text.String())
+	q.args = append(q.args, other.args...)
+
+	return q
+}
+
+func (q *SqlQuery) String() string {
+	return q.text.String()
+}
+
+func (q *SqlQuery) Args() []interface{} {
+	return q.args
+}
+
+// Err returns the error of the first fragment failing to append.
+func (q *SqlQuery) Err() error {
+	return q.err
+}
+
+// Raw returns the statement on db, carrying the error of the query in its
+// Error; Rows ignores it, use the Rows of the query instead.
+func (q *SqlQuery) Raw(db *gorm.DB) *gorm.DB {
+	raw := db.Raw(q.String(), q.args...)
+	if q.err != nil {
+		raw.AddError(q.err)
+	}
+
+	return raw
+}
+
+func (q *SqlQuery) Rows(db *gorm.DB) (*sql.Rows, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+
+	return db.Raw(q.String(), q.args...).Rows()
+}
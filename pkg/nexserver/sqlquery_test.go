@@ -0,0 +1,156 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSqlQueryAppend(t *testing.T) {
+	payload := "1; DROP TABLE metrics; --"
+
+	tests := []struct {
+		name  string
+		query func() *SqlQuery
+		text  string
+		args  []interface{}
+		err   string
+	}{
+		{
+			name: "append",
+			query: func() *SqlQuery {
+				return NewSqlQuery("SELECT id FROM nodes WHERE cluster_id=?", 1).Append(" AND host=?", "node1")
+			},
+			text: "SELECT id FROM nodes WHERE cluster_id=? AND host=?",
+			args: []interface{}{1, "node1"},
+		},
+		{
+			name: "append if false",
+			query: func() *SqlQuery {
+				return NewSqlQuery("SELECT id FROM nodes").AppendIf(false, " WHERE id=?", 2)
+			},
+			text: "SELECT id FROM nodes",
+		},
+		{
+			name: "append if true",
+			query: func() *SqlQuery {
+				return NewSqlQuery("SELECT id FROM nodes").AppendIf(true, " WHERE id=?", 2)
+			},
+			text: "SELECT id FROM nodes WHERE id=?",
+			args: []interface{}{2},
+		},
+		{
+			name: "append query",
+			query: func() *SqlQuery {
+				where := NewSqlQuery(" WHERE id IN (?)", []uint{1, 2})
+				return NewSqlQuery("SELECT id FROM nodes").AppendQuery(where).Append(" LIMIT ?", 10)
+			},
+			text: "SELECT id FROM nodes WHERE id IN (?) LIMIT ?",
+			args: []interface{}{[]uint{1, 2}, 10},
+		},
+		{
+			name: "bound payload",
+			query: func() *SqlQuery {
+				return NewSqlQuery("SELECT id FROM metric_names WHERE name=?", payload)
+			},
+			text: "SELECT id FROM metric_names WHERE name=?",
+			args: []interface{}{payload},
+		},
+		{
+			name: "too few arguments",
+			query: func() *SqlQuery {
+				return NewSqlQuery("SELECT id FROM nodes").Append(" WHERE id=? AND host=?", 1)
+			},
+			text: "SELECT id FROM nodes",
+			err:  "sql: 2 placeholders for 1 arguments:  WHERE id=? AND host=?",
+		},
+		{
+			name: "too many arguments",
+			query: func() *SqlQuery {
+				return NewSqlQuery("SELECT id FROM nodes").Append(" WHERE id=?", 1, 2)
+			},
+			text: "SELECT id FROM nodes",
+			err:  "sql: 1 placeholders for 2 arguments:  WHERE id=?",
+		},
+		{
+			name: "literal question mark",
+			query: func() *SqlQuery {
+				return NewSqlQuery("SELECT id FROM nodes WHERE host='?'")
+			},
+			err: "sql: 1 placeholders for 0 arguments: SELECT id FROM nodes WHERE host='?'",
+		},
+		{
+			name: "first error kept",
+			query: func() *SqlQuery {
+				return NewSqlQuery("SELECT id FROM nodes").Append(" WHERE id=?").Append(" LIMIT ?")
+			},
+			text: "SELECT id FROM nodes",
+			err:  "sql: 1 placeholders for 0 arguments:  WHERE id=?",
+		},
+		{
+			name: "error of appended query",
+			query: func() *SqlQuery {
+				where := NewSqlQuery(" WHERE id=?")
+				return NewSqlQuery("SELECT id FROM nodes").AppendQuery(where)
+			},
+			text: "SELECT id FROM nodes",
+			err:  "sql: 1 placeholders for 0 arguments:  WHERE id=?",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := test.query()
+
+			if query.String() != test.text {
+				t.Errorf("text = %q, want %q", query.String(), test.text)
+			}
+			if len(query.Args()) != 0 || len(test.args) != 0 {
+				if !reflect.DeepEqual(query.Args(), test.args) {
+					t.Errorf("args = %v, want %v", query.Args(), test.args)
+				}
+			}
+			err := ""
+			if query.Err() != nil {
+				err = query.Err().Error()
+			}
+			if err != test.err {
+				t.Errorf("err = %q, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestSqlQueryMismatchNotExecuted(t *testing.T) {
+	s, recorder := newRecordingServer(t)
+
+	query := NewSqlQuery("SELECT id FROM nodes WHERE id=?")
+
+	if err := query.Raw(s.db).Scan(&[]Node{}).Error; err == nil || !strings.Contains(err.Error(), "placeholders") {
+		t.Errorf("Raw error = %v, want the placeholder mismatch", err)
+	}
+	if _, err := query.Rows(s.db); err == nil {
+		t.Errorf("Rows executed a broken query")
+	}
+	for _, statement := range recorder.statements {
+		if strings.Contains(statement, "FROM nodes") {
+			t.Errorf("broken query was sent: %s", statement)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"html/template"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The status page publishes the state of the configured clusters without
+// authentication, at /status as HTML and at /status.json. Uptime is the
+// share of minutes of the window in which the nodes of a cluster reported
+// metrics, compared with the configured objective. Active incidents are
+// listed by event and severity only; targets are internal names and are
+// never published. The page is rendered at most once per
+// statusPageCacheTTL and served with an ETag.
+
+const (
+	statusPageCacheTTL = time.Minute
+
+	StatusOperational = "operational"
+	StatusDegraded    = "degraded"
+	StatusOutage      = "outage"
+)
+
+type StatusPageConfig struct {
+	Clusters     []string
+	Title        string
+	LogoUrl      string
+	AccentColor  string
+	UptimeTarget float64
+	WindowDays   int
+}
+
+type StatusIncident struct {
+	EventName  string    `json:"event_name"`
+	Severity   string    `json:"severity"`
+	DetectedTs time.Time `json:"detected_ts"`
+}
+
+type StatusCluster struct {
+	Name      string           `json:"name"`
+	Status    string           `json:"status"`
+	Uptime    float64          `json:"uptime"`
+	TargetMet bool             `json:"target_met"`
+	Incidents []StatusIncident `json:"incidents"`
+}
+
+type StatusPage struct {
+	Title        string          `json:"title"`
+	LogoUrl      string          `json:"logo_url,omitempty"`
+	AccentColor  string          `json:"accent_color"`
+	UptimeTarget float64         `json:"uptime_target"`
+	WindowDays   int             `json:"window_days"`
+	Status       string          `json:"status"`
+	Clusters     []StatusCluster `json:"clusters"`
+	GeneratedTs  time.Time       `json:"generated_ts"`
+}
+
+type renderedStatusPage struct {
+	body        []byte
+	contentType string
+	etag        string
+}
+
+type StatusPageCache struct {
+	sync.Mutex
+
+	renderedTs time.Time
+	json       *renderedStatusPage
+	html       *renderedStatusPage
+}
+
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"percent": func(value float64) string { return fmt.Sprintf("%.3f%%", value) },
+	"time":    func(ts time.Time) string { return ts.UTC().Format("2006-01-02 15:04 UTC") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 720px; margin: 2em auto; color: #222; }
+header { border-bottom: 4px solid {{.AccentColor}}; padding-bottom: 1em; }
+header img { max-height: 48px; vertical-align: middle; }
+.cluster { border: 1px solid #ddd; border-radius: 4px; margin: 1em 0; padding: 1em; }
+.operational { color: #2e7d32; }
+.degraded { color: #ef6c00; }
+.outage { color: #c62828; }
+footer { color: #888; font-size: 0.8em; }
+</style>
+</head>
+<body>
+<header>{{if .LogoUrl}}<img src="{{.LogoUrl}}" alt=""> {{end}}<h1>{{.Title}}</h1>
+<p class="{{.Status}}">{{.Status}}</p></header>
+{{range .Clusters}}<div class="cluster">
+<h2>{{.Name}} <span class="{{.Status}}">{{.Status}}</span></h2>
+<p>Uptime {{percent .Uptime}} over {{$.WindowDays}} days{{if $.UptimeTarget}} (objective {{percent $.UptimeTarget}}){{end}}</p>
+{{if .Incidents}}<ul>{{range .Incidents}}<li class="{{.Severity}}">{{.EventName}} ({{.Severity}}) since {{time .DetectedTs}}</li>{{end}}</ul>{{end}}
+</div>
+{{end}}<footer>Updated {{time .GeneratedTs}}</footer>
+</body>
+</html>
+`))
+
+func worseStatus(a, b string) string {
+	rank := map[string]int{StatusOperational: 0, StatusDegraded: 1, StatusOutage: 2}
+	if rank[b] > rank[a] {
+		return b
+	}
+
+	return a
+}
+
+// clusterUptime returns the percentage of minutes since the start of the
+// window in which every node of the cluster reported, averaged over nodes.
+func (s *NexServer) clusterUptime(clusterId uint, since, now time.Time) (float64, error) {
+	q := NewSqlQuery(`
+SELECT nodes.id, count(DISTINCT date_trunc('minute', metrics.ts))
+FROM nodes
+LEFT JOIN metrics ON metrics.node_id=nodes.id AND metrics.cluster_id=nodes.cluster_id AND metrics.ts >= ?
+WHERE nodes.cluster_id=? AND nodes.deleted_at IS NULL AND nodes.disabled=false AND nodes.created_at < ?
+GROUP BY nodes.id`, since, clusterId, now)
+
+	rows, err := q.Rows(s.db)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	windowMinutes := now.Sub(since).Minutes()
+	total := 0.0
+	nodes := 0
+	for rows.Next() {
+		var nodeId uint
+		var minutes float64
+		if err := rows.Scan(&nodeId, &minutes); err != nil {
+			apiLog.Errorf("failed to get record: %v", err)
+			continue
+		}
+
+		uptime := minutes / windowMinutes * 100
+		if uptime > 100 {
+			uptime = 100
+		}
+		total += uptime
+		nodes += 1
+	}
+
+	if nodes == 0 {
+		return 100, nil
+	}
+
+	return total / float64(nodes), nil
+}
+
+func (s *NexServer) buildStatusPage() (*StatusPage, error) {
+	config := s.config.StatusPage
+	now := time.Now()
+	since := now.Add(-time.Duration(config.WindowDays) * 24 * time.Hour)
+
+	var clusters []Cluster
+	if result := s.db.Where("name IN (?)", config.Clusters).Order("name").Find(&clusters); result.Error != nil {
+		return nil, result.Error
+	}
+
+	incidents := make(map[uint][]StatusIncident)
+	for _, items := range s.incidentMap {
+		for _, item := range items {
+			incidents[item.ClusterId] = append(incidents[item.ClusterId], StatusIncident{
+				EventName:  item.EventName,
+				Severity:   item.Severity,
+				DetectedTs: item.DetectedTs,
+			})
+		}
+	}
+
+	page := &StatusPage{
+		Title:        config.Title,
+		LogoUrl:      config.LogoUrl,
+		AccentColor:  config.AccentColor,
+		UptimeTarget: config.UptimeTarget,
+		WindowDays:   config.WindowDays,
+		Status:       StatusOperational,
+		Clusters:     make([]StatusCluster, 0, len(clusters)),
+		GeneratedTs:  now,
+	}
+
+	for _, cluster := range clusters {
+		uptime, err := s.clusterUptime(cluster.ID, since, now)
+		if err != nil {
+			return nil, err
+		}
+
+		item := StatusCluster{
+			Name:      cluster.Name,
+			Status:    StatusOperational,
+			Uptime:    uptime,
+			TargetMet: uptime >= config.UptimeTarget,
+			Incidents: make([]StatusIncident, 0),
+		}
+
+		for _, incident := range incidents[cluster.ID] {
+			// info events do not affect the service
+			if incident.Severity == SeverityInfo {
+				continue
+			}
+			item.Incidents = append(item.Incidents, incident)
+
+			if incident.Severity == SeverityCritical {
+				item.Status = worseStatus(item.Status, StatusOutage)
+			} else {
+				item.Status = worseStatus(item.Status, StatusDegraded)
+			}
+		}
+		sort.Slice(item.Incidents, func(i, j int) bool {
+			return item.Incidents[i].DetectedTs.After(item.Incidents[j].DetectedTs)
+		})
+
+		page.Status = worseStatus(page.Status, item.Status)
+		page.Clusters = append(page.Clusters, item)
+	}
+
+	return page, nil
+}
+
+func newRenderedStatusPage(body []byte, contentType string) *renderedStatusPage {
+	checksum := sha256.Sum256(body)
+
+	return &renderedStatusPage{
+		body:        body,
+		contentType: contentType,
+		etag:        `"` + hex.EncodeToString(checksum[:16]) + `"`,
+	}
+}
+
+// renderStatusPage returns the cached renderings, rendering them again once
+// they are older than statusPageCacheTTL.
+func (s *NexServer) renderStatusPage() (*renderedStatusPage, *renderedStatusPage, error) {
+	s.statusPage.Lock()
+	defer s.statusPage.Unlock()
+
+	if s.statusPage.json != nil && time.Since(s.statusPage.renderedTs) < statusPageCacheTTL {
+		return s.statusPage.json, s.statusPage.html, nil
+	}
+
+	page, err := s.buildStatusPage()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := json.Marshal(gin.H{"status": "ok", "message": "", "data": page})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var html bytes.Buffer
+	if err := statusPageTemplate.Execute(&html, page); err != nil {
+		return nil, nil, err
+	}
+
+	s.statusPage.json = newRenderedStatusPage(data, "application/json; charset=utf-8")
+	s.statusPage.html = newRenderedStatusPage(html.Bytes(), "text/html; charset=utf-8")
+	s.statusPage.renderedTs = time.Now()
+
+	return s.statusPage.json, s.statusPage.html, nil
+}
+
+func (s *NexServer) serveStatusPage(c *gin.Context, asJson bool) {
+	if len(s.config.StatusPage.Clusters) == 0 {
+		s.ApiResponseJson(c, 404, "bad", "status page is not enabled")
+		return
+	}
+
+	jsonPage, htmlPage, err := s.renderStatusPage()
+	if err != nil {
+		requestLog(c).Errorf("StatusPage: failed to render: %v\n", err)
+		s.ApiResponseJson(c, 503, "bad", "status page is unavailable")
+		return
+	}
+
+	page := htmlPage
+	if asJson {
+		page = jsonPage
+	}
+
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(statusPageCacheTTL.Seconds())))
+	c.Header("ETag", page.etag)
+	if c.GetHeader("If-None-Match") == page.etag {
+		c.Status(304)
+		return
+	}
+
+	c.Data(200, page.contentType, page.body)
+}
+
+func (s *NexServer) ApiStatusPage(c *gin.Context) {
+	s.serveStatusPage(c, false)
+}
+
+func (s *NexServer) ApiStatusPageJson(c *gin.Context) {
+	s.serveStatusPage(c, true)
+}
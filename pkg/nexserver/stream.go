@@ -0,0 +1,188 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A month of metrics does not fit in a buffered response, so range
+// queries stream their rows as NDJSON, one JSON object per line, to
+// clients accepting application/x-ndjson. Rows are written as they are
+// scanned from the database; a slow client blocks the write and so the
+// scan, which holds the reading of the result back instead of queueing
+// it in memory. The envelope is left out: the query time and the total
+// of a paged request are sent as headers, and an error after the first
+// row can only end the stream. CSV exports are streamed the same way,
+// with the JSON names of the row fields as header.
+
+const (
+	ndjsonContentType = "application/x-ndjson"
+	csvContentType    = "text/csv; charset=utf-8"
+	streamFlushRows   = 256
+
+	// csvExportKey holds the file name of a CSV export in the context
+	csvExportKey = "csv_export"
+)
+
+func wantsNDJSON(c *gin.Context) bool {
+	return strings.Contains(c.GetHeader("Accept"), ndjsonContentType)
+}
+
+// RowWriter collects the rows of a list response, or streams them.
+type RowWriter struct {
+	s         *NexServer
+	c         *gin.Context
+	page      *Page
+	total     int
+	queryTime time.Duration
+
+	stream  bool
+	encoder *json.Encoder
+	csv     *csv.Writer
+	items   []interface{}
+	count   int
+	failed  bool
+}
+
+func (s *NexServer) newRowWriter(c *gin.Context, page *Page, total int, queryTime time.Duration) *RowWriter {
+	w := &RowWriter{
+		s:         s,
+		c:         c,
+		page:      page,
+		total:     total,
+		queryTime: queryTime,
+	}
+
+	header := c.Writer.Header()
+	if fileName := c.GetString(csvExportKey); fileName != "" {
+		header.Set("Content-Type", csvContentType)
+		header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+		w.csv = csv.NewWriter(c.Writer)
+	} else if wantsNDJSON(c) {
+		header.Set("Content-Type", ndjsonContentType)
+		w.encoder = json.NewEncoder(c.Writer)
+	} else {
+		w.items = make([]interface{}, 0, 16)
+		return w
+	}
+
+	w.stream = true
+	header.Set("X-Db-Query-Time", queryTime.String())
+	if total >= 0 {
+		header.Set("X-Total-Count", strconv.Itoa(total))
+	}
+	c.Status(200)
+
+	return w
+}
+
+// csvRecord returns the header or the values of a row struct.
+func csvRecord(item interface{}, header bool) []string {
+	value := reflect.Indirect(reflect.ValueOf(item))
+	if value.Kind() != reflect.Struct {
+		if header {
+			return []string{"value"}
+		}
+		return []string{fmt.Sprint(item)}
+	}
+
+	record := make([]string, 0, value.NumField())
+	for idx := 0; idx < value.NumField(); idx++ {
+		field := value.Type().Field(idx)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if header {
+			if name == "" {
+				name = field.Name
+			}
+			record = append(record, name)
+		} else {
+			record = append(record, fmt.Sprint(value.Field(idx).Interface()))
+		}
+	}
+
+	return record
+}
+
+func (w *RowWriter) write(item interface{}) error {
+	if w.encoder != nil {
+		return w.encoder.Encode(item)
+	}
+
+	if w.count == 1 {
+		if err := w.csv.Write(csvRecord(item, true)); err != nil {
+			return err
+		}
+	}
+	if err := w.csv.Write(csvRecord(item, false)); err != nil {
+		return err
+	}
+	if w.count%streamFlushRows == 0 {
+		w.csv.Flush()
+		return w.csv.Error()
+	}
+
+	return nil
+}
+
+// add writes or keeps the row. It returns false once the client is gone,
+// so the caller stops scanning.
+func (w *RowWriter) add(item interface{}) bool {
+	w.count++
+	if !w.stream {
+		w.items = append(w.items, item)
+		return true
+	}
+
+	if err := w.write(item); err != nil {
+		if !w.failed {
+			apiLog.Warnf("Stream: %s: %v\n", w.c.Request.URL.Path, err)
+		}
+		w.failed = true
+		return false
+	}
+	if w.count%streamFlushRows == 0 {
+		w.c.Writer.Flush()
+	}
+
+	return true
+}
+
+// finish ends the stream or writes the list envelope.
+func (w *RowWriter) finish() {
+	if w.stream {
+		if w.csv != nil {
+			w.csv.Flush()
+		}
+		if !w.failed {
+			w.c.Writer.Flush()
+		}
+		return
+	}
+
+	w.s.pageResponse(w.c, w.items, w.page, w.count, w.total, gin.H{"db_query_time": w.queryTime.String()})
+}
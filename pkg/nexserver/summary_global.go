@@ -0,0 +1,183 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"github.com/gin-gonic/gin"
+	"math"
+)
+
+type GlobalSummary struct {
+	Clusters      int            `json:"clusters"`
+	Nodes         int            `json:"nodes"`
+	Agents        int            `json:"agents"`
+	AgentsOnline  int            `json:"agents_online"`
+	Cores         float64        `json:"cores"`
+	MemoryBytes   float64        `json:"memory_bytes"`
+	CpuUsage      float64        `json:"cpu_usage"`
+	MemoryUsage   float64        `json:"memory_usage"`
+	Health        float64        `json:"health"`
+	OpenIncidents int            `json:"open_incidents"`
+	Severity      map[string]int `json:"severity"`
+}
+
+// globalNodeUsage sums the newest node-level samples of every enabled
+// cluster. CPU usage is the 1-minute load relative to the reported cores.
+func (s *NexServer) globalNodeUsage(c *gin.Context, summary *GlobalSummary) error {
+	q := `
+SELECT metric_names.name, SUM(m1.value), COUNT(m1.value)
+FROM metric_names, clusters, metrics m1
+JOIN (
+    SELECT m2.node_id, MAX(ts) ts
+    FROM metrics m2
+    WHERE m2.ts >= NOW() - interval '60 seconds'
+      AND m2.process_id=0
+      AND m2.container_id=0
+    GROUP BY m2.node_id) newest
+ON newest.node_id=m1.node_id AND newest.ts=m1.ts
+WHERE m1.name_id=metric_names.id
+  AND m1.cluster_id=clusters.id
+  AND clusters.disabled=false
+  AND clusters.deleted_at IS NULL
+  AND m1.process_id=0
+  AND m1.container_id=0
+  AND metric_names.name IN ('node_cpu_cores', 'node_cpu_load_avg_1', 'node_memory_total', 'node_memory_used_percent')
+GROUP BY metric_names.name`
+
+	rows, err := s.requestDB(c).Raw(q).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var load float64
+	for rows.Next() {
+		var name string
+		var sum float64
+		var count int
+
+		if err := rows.Scan(&name, &sum, &count); err != nil {
+			requestLog(c).Errorf("failed to get data: %v", err)
+			continue
+		}
+
+		switch name {
+		case "node_cpu_cores":
+			summary.Cores = sum
+		case "node_cpu_load_avg_1":
+			load = sum
+		case "node_memory_total":
+			summary.MemoryBytes = sum
+		case "node_memory_used_percent":
+			if count > 0 {
+				summary.MemoryUsage = math.Round(sum/float64(count)*100) / 100
+			}
+		}
+	}
+
+	if summary.Cores > 0 {
+		summary.CpuUsage = math.Round(load/summary.Cores*10000) / 100
+	}
+
+	return nil
+}
+
+func (s *NexServer) ApiSummaryGlobal(c *gin.Context) {
+	var clusters []Cluster
+
+	if result := s.requestDB(c).Where("disabled=?", false).Find(&clusters); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	summary := GlobalSummary{
+		Clusters: len(clusters),
+		Health:   100,
+		Severity: make(map[string]int),
+	}
+	if len(clusters) == 0 {
+		c.JSON(200, gin.H{
+			"status":  "ok",
+			"message": "",
+			"data":    summary,
+		})
+		return
+	}
+
+	clusterIds := make([]uint, 0, len(clusters))
+	enabled := make(map[uint]bool)
+	for _, cluster := range clusters {
+		clusterIds = append(clusterIds, cluster.ID)
+		enabled[cluster.ID] = true
+	}
+
+	result := s.requestDB(c).Model(&Node{}).
+		Where("disabled=? AND cluster_id IN (?)", false, clusterIds).Count(&summary.Nodes)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+	result = s.requestDB(c).Model(&Agent{}).
+		Where("disabled=? AND cluster_id IN (?)", false, clusterIds).Count(&summary.Agents)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	s.RLock()
+	for _, agent := range s.agentMap {
+		if enabled[agent.ClusterID] {
+			summary.AgentsOnline += 1
+		}
+	}
+	s.RUnlock()
+
+	if err := s.globalNodeUsage(c, &summary); err != nil {
+		requestLog(c).Errorf("failed to get data: %v", err)
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+
+	for _, incidents := range s.incidentMap {
+		for _, incident := range incidents {
+			if !enabled[incident.ClusterId] {
+				continue
+			}
+
+			summary.OpenIncidents += 1
+			summary.Severity[incident.Severity] += 1
+		}
+	}
+
+	// health is the mean of the cluster scores; clusters without incidents score 100
+	scores := s.clusterHealthScores()
+	total := 0.0
+	for _, clusterId := range clusterIds {
+		if score, found := scores[clusterId]; found {
+			total += score
+		} else {
+			total += 100
+		}
+	}
+	summary.Health = math.Round(total/float64(len(clusterIds))*100) / 100
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    summary,
+	})
+}
@@ -0,0 +1,505 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/json"
+	"fmt"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/NexClipper/NexClipper/pkg/nexprobe"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm/dialects/postgres"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"time"
+)
+
+// Synthetic checks are run by the agent of a chosen node: scripted HTTP
+// journeys (see nexprobe.Journey) and DNS resolutions (nexprobe.DNSCheck).
+// The scheduler dispatches every due check as a command; the agent reports
+// latencies as metrics and the result of the run, with the response body
+// of the failed step or the DNS answers, as the command result. A failed
+// run opens an incident which the next successful run clears.
+
+const (
+	SyntheticTypeHTTP = "http"
+	SyntheticTypeDNS  = "dns"
+
+	defaultSyntheticDispatch = "@every 15s"
+	defaultJourneyInterval   = 300
+	minJourneyInterval       = 30
+	journeyRunTimeout        = 5 * time.Minute
+	maxJourneyRuns           = 100
+)
+
+func journeyEventName(name string) string {
+	return "synthetic:" + name
+}
+
+// dispatchJourney sends the journey to the agent of its node.
+func (s *NexServer) dispatchJourney(journey *SyntheticJourney) (*SyntheticRun, error) {
+	node := s.findNodeById(journey.NodeID, journey.ClusterID)
+	if node == nil {
+		return nil, fmt.Errorf("node %d not found", journey.NodeID)
+	}
+	agent := s.findAgentByNode(node)
+	if agent == nil {
+		return nil, fmt.Errorf("agent of node %s is not connected", node.Host)
+	}
+
+	commandName := "journey"
+	if journey.Type == SyntheticTypeDNS {
+		commandName = "dns"
+	}
+
+	command := newAgentCommand(commandName, journey.Script)
+	run := SyntheticRun{
+		CommandID: command.Id,
+		Status:    CaptureStatusPending,
+		Steps:     postgres.Jsonb{RawMessage: json.RawMessage("[]")},
+		JourneyID: journey.ID,
+		ClusterID: journey.ClusterID,
+		NodeID:    journey.NodeID,
+		AgentID:   agent.ID,
+	}
+	if result := s.db.Create(&run); result.Error != nil {
+		return nil, result.Error
+	}
+
+	if err := s.commands.send(agent.Uuid, command); err != nil {
+		s.db.Model(&run).Updates(SyntheticRun{Status: CaptureStatusFailed, Error: err.Error()})
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+func (s *NexServer) dispatchJourneys() error {
+	var journeys []SyntheticJourney
+	if result := s.db.Where("disabled=?", false).Find(&journeys); result.Error != nil {
+		return fmt.Errorf("failed to get journeys: %v", result.Error)
+	}
+
+	now := time.Now()
+	for idx := range journeys {
+		journey := &journeys[idx]
+
+		interval := time.Duration(journey.IntervalSeconds) * time.Second
+		if journey.LastDispatchTs != nil && now.Sub(*journey.LastDispatchTs) < interval {
+			continue
+		}
+
+		// dispatch is recorded even on failure so a missing agent is not
+		// retried on every tick
+		s.db.Model(journey).Update("last_dispatch_ts", now)
+		if _, err := s.dispatchJourney(journey); err != nil {
+			schedulerLog.Warnf("Synthetic: %s: %v\n", journey.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *NexServer) updateJourneyIncident(journey *SyntheticJourney, run *SyntheticRun) {
+	target := journey.Name
+	if node := s.getNodeById(journey.NodeID, journey.ClusterID); node != nil {
+		target = fmt.Sprintf("%s from %s", journey.Name, node.Host)
+	}
+
+	eventName := journeyEventName(journey.Name)
+	now := time.Now()
+	item := &IncidentItem{
+		ClusterId:  journey.ClusterID,
+		NodeId:     journey.NodeID,
+		TargetType: "JOURNEY",
+		Target:     target,
+		Value:      run.DurationMs,
+		EventName:  eventName,
+		Severity:   journey.Severity,
+		ReportedTs: run.CreatedAt,
+		DetectedTs: now,
+	}
+
+	if run.Success {
+		if s.IsExistIncident(eventName, item) {
+			s.ClearIncident(eventName, item)
+		}
+		return
+	}
+	if !s.IsExistIncident(eventName, item) {
+		s.AddIncident(eventName, item)
+	}
+}
+
+func (s *NexServer) saveJourneyRun(agent *Agent, in *pb.CommandResult) (*pb.Response, error) {
+	var run SyntheticRun
+
+	result := s.db.Where("command_id=? AND agent_id=?", in.CommandId, agent.ID).First(&run)
+	if result.Error != nil {
+		return nil, status.Error(codes.NotFound, "unknown journey run")
+	}
+
+	now := time.Now()
+	run.CompletedTs = &now
+	run.Status = CaptureStatusCompleted
+
+	var journeyResult nexprobe.JourneyResult
+	if !in.Success {
+		run.Status = CaptureStatusFailed
+		run.Error = in.Error
+	} else if err := json.Unmarshal(in.Data, &journeyResult); err != nil {
+		run.Status = CaptureStatusFailed
+		run.Error = fmt.Sprintf("invalid result: %v", err)
+	} else {
+		steps, _ := json.Marshal(journeyResult.Steps)
+		run.Success = journeyResult.Success
+		run.Error = journeyResult.Error
+		run.FailedStep = journeyResult.FailedStep
+		run.DurationMs = journeyResult.DurationMs
+		run.Steps = postgres.Jsonb{RawMessage: steps}
+		run.Body = journeyResult.Body
+		run.ContentType = journeyResult.ContentType
+	}
+
+	if result := s.db.Save(&run); result.Error != nil {
+		schedulerLog.Errorf("Synthetic: failed to save run %d: %v\n", run.ID, result.Error)
+		return nil, status.Error(codes.Internal, "failed to save journey run")
+	}
+
+	var journey SyntheticJourney
+	if result := s.db.Where("id=?", run.JourneyID).First(&journey); result.Error == nil {
+		s.updateJourneyIncident(&journey, &run)
+	}
+
+	return s.response(true, 0, ""), nil
+}
+
+type SyntheticJourneyItem struct {
+	Id              uint       `json:"id"`
+	Name            string     `json:"name"`
+	Type            string     `json:"type"`
+	ClusterId       uint       `json:"cluster_id"`
+	NodeId          uint       `json:"node_id"`
+	IntervalSeconds int        `json:"interval_seconds"`
+	Severity        string     `json:"severity"`
+	Disabled        bool       `json:"disabled"`
+	Script          string     `json:"script"`
+	LastDispatchTs  *time.Time `json:"last_dispatch_ts"`
+}
+
+func newSyntheticJourneyItem(journey *SyntheticJourney) SyntheticJourneyItem {
+	return SyntheticJourneyItem{
+		Id:              journey.ID,
+		Name:            journey.Name,
+		Type:            journey.Type,
+		ClusterId:       journey.ClusterID,
+		NodeId:          journey.NodeID,
+		IntervalSeconds: journey.IntervalSeconds,
+		Severity:        journey.Severity,
+		Disabled:        journey.Disabled,
+		Script:          journey.Script,
+		LastDispatchTs:  journey.LastDispatchTs,
+	}
+}
+
+type SyntheticRunItem struct {
+	Id          uint            `json:"id"`
+	Status      string          `json:"status"`
+	Success     bool            `json:"success"`
+	Error       string          `json:"error"`
+	FailedStep  string          `json:"failed_step"`
+	DurationMs  float64         `json:"duration_ms"`
+	Steps       json.RawMessage `json:"steps"`
+	HasBody     bool            `json:"has_body"`
+	NodeId      uint            `json:"node_id"`
+	CreatedTs   time.Time       `json:"created_ts"`
+	CompletedTs *time.Time      `json:"completed_ts"`
+}
+
+func newSyntheticRunItem(run *SyntheticRun) SyntheticRunItem {
+	item := SyntheticRunItem{
+		Id:          run.ID,
+		Status:      run.Status,
+		Success:     run.Success,
+		Error:       run.Error,
+		FailedStep:  run.FailedStep,
+		DurationMs:  run.DurationMs,
+		Steps:       run.Steps.RawMessage,
+		HasBody:     run.Body != "",
+		NodeId:      run.NodeID,
+		CreatedTs:   run.CreatedAt,
+		CompletedTs: run.CompletedTs,
+	}
+
+	if item.Status == CaptureStatusPending && time.Since(run.CreatedAt) > journeyRunTimeout {
+		item.Status = CaptureStatusFailed
+		item.Error = "agent did not respond"
+	}
+
+	return item
+}
+
+type SyntheticJourneyRequest struct {
+	Type            string `json:"type"`
+	Script          string `json:"script" binding:"required"`
+	ClusterId       uint   `json:"cluster_id" binding:"required"`
+	NodeId          uint   `json:"node_id" binding:"required"`
+	IntervalSeconds int    `json:"interval_seconds"`
+	Severity        string `json:"severity"`
+	Disabled        bool   `json:"disabled"`
+}
+
+// bindSyntheticJourney validates the request into the journey, responding
+// on error.
+func (s *NexServer) bindSyntheticJourney(c *gin.Context, journey *SyntheticJourney) bool {
+	var req SyntheticJourneyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return false
+	}
+
+	var name string
+	switch req.Type {
+	case "", SyntheticTypeHTTP:
+		req.Type = SyntheticTypeHTTP
+		script, err := nexprobe.ParseJourney([]byte(req.Script))
+		if err != nil {
+			s.ApiResponseJson(c, 400, "bad", err.Error())
+			return false
+		}
+		name = script.Name
+	case SyntheticTypeDNS:
+		check, err := nexprobe.ParseDNSCheck([]byte(req.Script))
+		if err != nil {
+			s.ApiResponseJson(c, 400, "bad", err.Error())
+			return false
+		}
+		name = check.Name
+	default:
+		s.ApiResponseJsonf(c, 400, "bad", "unknown type: %s", req.Type)
+		return false
+	}
+
+	if req.IntervalSeconds == 0 {
+		req.IntervalSeconds = defaultJourneyInterval
+	}
+	if req.IntervalSeconds < minJourneyInterval {
+		s.ApiResponseJsonf(c, 400, "bad", "interval must be at least %d seconds", minJourneyInterval)
+		return false
+	}
+	if req.Severity == "" {
+		req.Severity = SeverityWarning
+	}
+	if !isValidSeverity(req.Severity) {
+		s.ApiResponseJsonf(c, 400, "bad", "unknown severity: %s", req.Severity)
+		return false
+	}
+	if s.findNodeById(req.NodeId, req.ClusterId) == nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid node id")
+		return false
+	}
+
+	var existing SyntheticJourney
+	result := s.requestDB(c).Where("name=? AND id<>?", name, journey.ID).First(&existing)
+	if result.Error == nil {
+		s.ApiResponseJsonf(c, 409, "bad", "journey %s already exists", name)
+		return false
+	}
+
+	journey.Name = name
+	journey.Type = req.Type
+	journey.Script = req.Script
+	journey.ClusterID = req.ClusterId
+	journey.NodeID = req.NodeId
+	journey.IntervalSeconds = req.IntervalSeconds
+	journey.Severity = req.Severity
+	journey.Disabled = req.Disabled
+
+	return true
+}
+
+func (s *NexServer) validJourney(c *gin.Context) (*SyntheticJourney, bool) {
+	journeyId, ok := s.idParam(c, "journeyId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid journey id")
+		return nil, false
+	}
+
+	var journey SyntheticJourney
+	if result := s.requestDB(c).Where("id=?", journeyId).First(&journey); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid journey id")
+		return nil, false
+	}
+
+	return &journey, true
+}
+
+func (s *NexServer) ApiSyntheticJourneyList(c *gin.Context) {
+	var journeys []SyntheticJourney
+
+	if result := s.requestDB(c).Order("id").Find(&journeys); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	items := make([]SyntheticJourneyItem, 0, len(journeys))
+	for idx := range journeys {
+		items = append(items, newSyntheticJourneyItem(&journeys[idx]))
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+func (s *NexServer) ApiCreateSyntheticJourney(c *gin.Context) {
+	var journey SyntheticJourney
+	if !s.bindSyntheticJourney(c, &journey) {
+		return
+	}
+
+	if result := s.requestDB(c).Create(&journey); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create journey: %v", result.Error)
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    newSyntheticJourneyItem(&journey),
+	})
+}
+
+func (s *NexServer) ApiUpdateSyntheticJourney(c *gin.Context) {
+	journey, ok := s.validJourney(c)
+	if !ok {
+		return
+	}
+
+	if !s.bindSyntheticJourney(c, journey) {
+		return
+	}
+
+	if result := s.requestDB(c).Save(journey); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to update journey: %v", result.Error)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    newSyntheticJourneyItem(journey),
+	})
+}
+
+func (s *NexServer) ApiDeleteSyntheticJourney(c *gin.Context) {
+	journey, ok := s.validJourney(c)
+	if !ok {
+		return
+	}
+
+	if result := s.requestDB(c).Delete(journey); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to delete journey: %v", result.Error)
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+func (s *NexServer) ApiRunSyntheticJourney(c *gin.Context) {
+	journey, ok := s.validJourney(c)
+	if !ok {
+		return
+	}
+
+	run, err := s.dispatchJourney(journey)
+	if err != nil {
+		s.ApiResponseJson(c, 500, "bad", err.Error())
+		return
+	}
+
+	c.JSON(202, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    newSyntheticRunItem(run),
+	})
+}
+
+func (s *NexServer) ApiSyntheticRunList(c *gin.Context) {
+	journey, ok := s.validJourney(c)
+	if !ok {
+		return
+	}
+
+	var runs []SyntheticRun
+	result := s.requestDB(c).
+		Where("journey_id=?", journey.ID).
+		Order("created_at DESC").
+		Limit(maxJourneyRuns).
+		Find(&runs)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	items := make([]SyntheticRunItem, 0, len(runs))
+	for idx := range runs {
+		items = append(items, newSyntheticRunItem(&runs[idx]))
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+// ApiSyntheticRunBody returns the response body captured when the run
+// failed, with its original content type.
+func (s *NexServer) ApiSyntheticRunBody(c *gin.Context) {
+	journey, ok := s.validJourney(c)
+	if !ok {
+		return
+	}
+
+	runId, ok := s.idParam(c, "runId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid run id")
+		return
+	}
+
+	var run SyntheticRun
+	result := s.requestDB(c).
+		Where("id=? AND journey_id=?", runId, journey.ID).
+		First(&run)
+	if result.Error != nil || run.Body == "" {
+		s.ApiResponseJson(c, 404, "bad", "invalid run id")
+		return
+	}
+
+	contentType := run.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	// the body comes from a third party, never render it on this origin
+	c.Header("Content-Security-Policy", "sandbox")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Data(200, contentType, []byte(run.Body))
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"context"
+	pb "github.com/NexClipper/NexClipper/api"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTailInterval = 500
+	minTailInterval     = 100
+	maxTailInterval     = 5000
+	defaultTailDuration = time.Minute
+	maxTailDuration     = 5 * time.Minute
+	tailGracePeriod     = 5 * time.Second
+)
+
+type TailPoint struct {
+	Ts    time.Time `json:"ts"`
+	Name  string    `json:"name"`
+	Label string    `json:"label"`
+	Value float64   `json:"value"`
+}
+
+// TailHub routes live tail values reported by agents to the websocket
+// session which requested them.
+type TailHub struct {
+	sync.RWMutex
+
+	sessions map[string]chan *TailPoint
+}
+
+func NewTailHub() *TailHub {
+	return &TailHub{
+		sessions: make(map[string]chan *TailPoint),
+	}
+}
+
+func (t *TailHub) open(commandId string) chan *TailPoint {
+	t.Lock()
+	defer t.Unlock()
+
+	points := make(chan *TailPoint, 256)
+	t.sessions[commandId] = points
+
+	return points
+}
+
+func (t *TailHub) close(commandId string) {
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.sessions, commandId)
+}
+
+func (t *TailHub) publish(commandId string, point *TailPoint) bool {
+	t.RLock()
+	defer t.RUnlock()
+
+	points, found := t.sessions[commandId]
+	if !found {
+		return false
+	}
+
+	select {
+	case points <- point:
+	default:
+		apiLog.Warnf("Tail: session %s is too slow, dropping value\n", commandId)
+	}
+
+	return true
+}
+
+func (s *NexServer) ReportTailMetrics(ctx context.Context, in *pb.TailMetrics) (*pb.Response, error) {
+	agent := s.findAgentFromContext(ctx)
+	if agent == nil {
+		apiLog.Warnf("ReportTailMetrics: invalid agent")
+		return nil, status.Error(codes.PermissionDenied, "invalid agent")
+	}
+
+	ts := time.Unix(0, in.TsMs*int64(time.Millisecond))
+
+	for _, metric := range in.Metrics {
+		point := &TailPoint{
+			Ts:    ts,
+			Name:  metric.Name,
+			Label: metric.Label,
+			Value: metric.Value,
+		}
+
+		if !s.tails.publish(in.CommandId, point) {
+			return nil, status.Error(codes.NotFound, "tail session is closed")
+		}
+	}
+
+	return s.response(true, 0, ""), nil
+}
+
+func (s *NexServer) streamTail(ws *websocket.Conn, agent *Agent, metricName string,
+	interval int, duration time.Duration) {
+	defer ws.Close()
+
+	command := newAgentCommand("tail", metricName, strconv.Itoa(interval), duration.String())
+
+	points := s.tails.open(command.Id)
+	defer s.tails.close(command.Id)
+
+	if err := s.commands.send(agent.Uuid, command); err != nil {
+		_ = websocket.JSON.Send(ws, gin.H{"status": "bad", "message": err.Error()})
+		return
+	}
+
+	stopTail := func() {
+		if err := s.commands.send(agent.Uuid, newAgentCommand("tail_stop", command.Id)); err != nil {
+			apiLog.Errorf("Tail: failed to stop tail %s: %v\n", command.Id, err)
+		}
+	}
+
+	// clients stop tailing early by closing the connection
+	closed := make(chan struct{})
+	go func() {
+		var message string
+		for websocket.Message.Receive(ws, &message) == nil {
+		}
+		close(closed)
+	}()
+
+	timeout := time.NewTimer(duration + tailGracePeriod)
+	defer timeout.Stop()
+
+	for {
+		select {
+		case point := <-points:
+			if err := websocket.JSON.Send(ws, point); err != nil {
+				stopTail()
+				return
+			}
+		case <-closed:
+			stopTail()
+			return
+		case <-timeout.C:
+			return
+		}
+	}
+}
+
+func (s *NexServer) ApiTailNodeMetric(c *gin.Context) {
+	params, ok := s.CheckRequiredParams(c, []string{"clusterId", "nodeId"})
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid parameters")
+		return
+	}
+
+	clusterId, err := strconv.ParseUint(params["clusterId"], 10, 32)
+	if err != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+	nodeId, err := strconv.ParseUint(params["nodeId"], 10, 32)
+	if err != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid node id")
+		return
+	}
+
+	metricName := s.RemoveSpecialChar(c.Query("metric"))
+	if metricName == "" {
+		s.ApiResponseJson(c, 404, "bad", "metric is required")
+		return
+	}
+
+	interval, err := strconv.Atoi(c.DefaultQuery("interval_ms", strconv.Itoa(defaultTailInterval)))
+	if err != nil || interval < minTailInterval || interval > maxTailInterval {
+		s.ApiResponseJsonf(c, 404, "bad",
+			"interval_ms must be between %d and %d", minTailInterval, maxTailInterval)
+		return
+	}
+
+	duration, err := time.ParseDuration(c.DefaultQuery("duration", defaultTailDuration.String()))
+	if err != nil || duration <= 0 || duration > maxTailDuration {
+		s.ApiResponseJsonf(c, 404, "bad",
+			"duration must be positive and at most %s", maxTailDuration)
+		return
+	}
+
+	node := s.findNodeById(uint(nodeId), uint(clusterId))
+	if node == nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid node id")
+		return
+	}
+
+	agent := s.findAgentByNode(node)
+	if agent == nil {
+		s.ApiResponseJson(c, 404, "bad", "agent is not connected")
+		return
+	}
+
+	server := websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error {
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			s.streamTail(ws, agent, metricName, interval, duration)
+		},
+	}
+	server.ServeHTTP(c.Writer, c.Request)
+}
@@ -0,0 +1,303 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"github.com/gin-gonic/gin"
+	"strings"
+)
+
+// A team owns Kubernetes namespaces or labels through its routes. Incidents
+// on pods it owns go to the team's subscriptions instead of the global ones.
+
+type TeamRouteItem struct {
+	Id        uint   `json:"id"`
+	ClusterId uint   `json:"cluster_id"`
+	Namespace string `json:"namespace"`
+	Label     string `json:"label"`
+}
+
+type TeamItem struct {
+	Id     uint            `json:"id"`
+	Name   string          `json:"name"`
+	Routes []TeamRouteItem `json:"routes"`
+}
+
+func (route *TeamRoute) matches(clusterId uint, namespace string, labels []string) bool {
+	if route.ClusterID != 0 && route.ClusterID != clusterId {
+		return false
+	}
+	if route.Namespace != "" && route.Namespace != namespace {
+		return false
+	}
+	if route.Label != "" && !stringInSlice(route.Label, labels) {
+		return false
+	}
+
+	return true
+}
+
+func (s *NexServer) k8sObjectLabels(objectIds ...uint) []string {
+	var labels []K8sLabel
+
+	if result := s.db.Where("k8s_object_id IN (?)", objectIds).Find(&labels); result.Error != nil {
+		return nil
+	}
+
+	values := make([]string, 0, len(labels))
+	for _, label := range labels {
+		values = append(values, label.Label)
+	}
+
+	return values
+}
+
+// incidentTeam returns the team owning the incident's pod. Namespace routes
+// take precedence over label routes; ties go to the oldest route.
+func (s *NexServer) incidentTeam(item *IncidentItem) *Team {
+	if item.PodId == 0 {
+		return nil
+	}
+
+	var pod K8sPod
+	if result := s.db.Where("id=?", item.PodId).First(&pod); result.Error != nil {
+		return nil
+	}
+	var namespace K8sNamespace
+	if result := s.db.Where("id=?", pod.K8sNamespaceID).First(&namespace); result.Error != nil {
+		return nil
+	}
+	labels := s.k8sObjectLabels(pod.K8sObjectID, namespace.K8sObjectID)
+
+	var routes []TeamRoute
+	if result := s.db.Order("namespace = '', id").Find(&routes); result.Error != nil {
+		return nil
+	}
+
+	for _, route := range routes {
+		if !route.matches(item.ClusterId, namespace.Name, labels) {
+			continue
+		}
+
+		var team Team
+		if result := s.db.Where("id=?", route.TeamID).First(&team); result.Error != nil {
+			continue
+		}
+
+		return &team
+	}
+
+	return nil
+}
+
+// routedSubscriptions narrows the subscriptions to the owning team's, or to
+// the global ones when the incident has no owner or the team has no channel.
+func routedSubscriptions(subscriptions []Subscription, team *Team, clusterId uint) []Subscription {
+	routed := make([]Subscription, 0, len(subscriptions))
+
+	if team != nil {
+		for _, subscription := range subscriptions {
+			if subscription.TeamID == team.ID && subscription.matches(EventIncidentFired, clusterId) {
+				routed = append(routed, subscription)
+			}
+		}
+		if len(routed) > 0 {
+			return routed
+		}
+	}
+
+	for _, subscription := range subscriptions {
+		if subscription.TeamID == 0 {
+			routed = append(routed, subscription)
+		}
+	}
+
+	return routed
+}
+
+func newTeamItem(team *Team, routes []TeamRoute) TeamItem {
+	item := TeamItem{
+		Id:     team.ID,
+		Name:   team.Name,
+		Routes: make([]TeamRouteItem, 0, len(routes)),
+	}
+
+	for _, route := range routes {
+		item.Routes = append(item.Routes, TeamRouteItem{
+			Id:        route.ID,
+			ClusterId: route.ClusterID,
+			Namespace: route.Namespace,
+			Label:     route.Label,
+		})
+	}
+
+	return item
+}
+
+func (s *NexServer) ApiTeamList(c *gin.Context) {
+	var teams []Team
+	var routes []TeamRoute
+
+	if result := s.requestDB(c).Order("id").Find(&teams); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+	if result := s.requestDB(c).Order("id").Find(&routes); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	teamRoutes := make(map[uint][]TeamRoute)
+	for _, route := range routes {
+		teamRoutes[route.TeamID] = append(teamRoutes[route.TeamID], route)
+	}
+
+	items := make([]TeamItem, 0, len(teams))
+	for idx := range teams {
+		items = append(items, newTeamItem(&teams[idx], teamRoutes[teams[idx].ID]))
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+func (s *NexServer) ApiCreateTeam(c *gin.Context) {
+	type TeamRequest struct {
+		Name string `json:"name" binding:"required"`
+	}
+	var req TeamRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	var existing Team
+	if result := s.requestDB(c).Where("name=?", req.Name).First(&existing); result.Error == nil {
+		s.ApiResponseJsonf(c, 409, "bad", "team %s already exists", req.Name)
+		return
+	}
+
+	team := Team{Name: req.Name}
+	if result := s.requestDB(c).Create(&team); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create team: %v", result.Error)
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    newTeamItem(&team, nil),
+	})
+}
+
+func (s *NexServer) ApiDeleteTeam(c *gin.Context) {
+	teamId, ok := s.idParam(c, "teamId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid team id")
+		return
+	}
+
+	result := s.requestDB(c).Where("id=?", teamId).Delete(&Team{})
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to delete team: %v", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		s.ApiResponseJson(c, 404, "bad", "invalid team id")
+		return
+	}
+	s.requestDB(c).Where("team_id=?", teamId).Delete(&TeamRoute{})
+	// without routes the team's channels would never fire again
+	s.requestDB(c).Model(&Subscription{}).Where("team_id=?", teamId).Update("disabled", true)
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+func (s *NexServer) ApiCreateTeamRoute(c *gin.Context) {
+	teamId, ok := s.idParam(c, "teamId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid team id")
+		return
+	}
+
+	var team Team
+	if result := s.requestDB(c).Where("id=?", teamId).First(&team); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid team id")
+		return
+	}
+
+	type RouteRequest struct {
+		ClusterId uint   `json:"cluster_id"`
+		Namespace string `json:"namespace"`
+		Label     string `json:"label"`
+	}
+	var req RouteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	if req.Namespace == "" && req.Label == "" {
+		s.ApiResponseJson(c, 400, "bad", "namespace or label is required")
+		return
+	}
+	if req.Label != "" && !strings.Contains(req.Label, "=") {
+		s.ApiResponseJson(c, 400, "bad", "label must be key=value")
+		return
+	}
+
+	route := TeamRoute{
+		TeamID:    team.ID,
+		ClusterID: req.ClusterId,
+		Namespace: req.Namespace,
+		Label:     req.Label,
+	}
+	if result := s.requestDB(c).Create(&route); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create route: %v", result.Error)
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    gin.H{"id": route.ID},
+	})
+}
+
+func (s *NexServer) ApiDeleteTeamRoute(c *gin.Context) {
+	params, ok := s.CheckRequiredParams(c, []string{"teamId", "routeId"})
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "missing parameters")
+		return
+	}
+
+	result := s.requestDB(c).Where("id=? AND team_id=?", params["routeId"], params["teamId"]).
+		Delete(&TeamRoute{})
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to delete route: %v", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		s.ApiResponseJson(c, 404, "bad", "invalid route id")
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"fmt"
+	"github.com/NexClipper/NexClipper/pkg/nexcrypto"
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+type CryptoConfig struct {
+	Strict bool
+}
+
+// initCrypto applies the crypto mode and loads the certificate shared by
+// the gRPC, API and admin listeners.
+func (s *NexServer) initCrypto() error {
+	nexcrypto.SetStrict(s.config.Crypto.Strict)
+	serverLog.Infof("Server: crypto mode %s\n", nexcrypto.Mode())
+
+	if !s.config.TLS.Use {
+		if nexcrypto.Strict() {
+			return fmt.Errorf("strict crypto mode requires TLS")
+		}
+		return nil
+	}
+
+	config, err := nexcrypto.ServerTLSConfig(s.config.TLS.CertFile, s.config.TLS.KeyFile)
+	if err != nil {
+		return err
+	}
+	s.tlsConfig = config
+
+	return nil
+}
+
+// serveHttp runs the router on the address, over TLS when it is enabled,
+// until the server shuts down.
+func (s *NexServer) serveHttp(router *gin.Engine, address string) error {
+	server := &http.Server{
+		Addr:    address,
+		Handler: router,
+	}
+	s.addHttpServer(server)
+
+	var err error
+	if s.tlsConfig == nil {
+		err = server.ListenAndServe()
+	} else {
+		server.TLSConfig = s.tlsConfig.Clone()
+		err = server.ListenAndServeTLS("", "")
+	}
+	if err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
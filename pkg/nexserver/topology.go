@@ -0,0 +1,343 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Manual topology corrections for when auto-correlation between agents,
+// containers and Kubernetes objects fails (e.g. custom container runtimes).
+
+func (s *NexServer) ApiCreateNode(c *gin.Context) {
+	cId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	var cluster Cluster
+	if result := s.requestDB(c).Where("id=?", cId).First(&cluster); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	type NodeRequest struct {
+		Host        string `json:"host" binding:"required"`
+		Ipv4        string `json:"ipv4"`
+		Description string `json:"description"`
+	}
+	var req NodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	if node := s.findNode(req.Host, cluster.ID); node != nil {
+		s.ApiResponseJson(c, 409, "bad", "node already exists")
+		return
+	}
+
+	nodeUuid, _ := uuid.NewUUID()
+	node := Node{
+		Host:        req.Host,
+		Ipv4:        req.Ipv4,
+		Description: req.Description,
+		Uuid:        nodeUuid.String(),
+		ClusterID:   cluster.ID,
+		Manual:      true,
+	}
+	if result := s.requestDB(c).Create(&node); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create node: %v", result.Error)
+		return
+	}
+
+	requestLog(c).Infof("Topology: created node %s @ cluster %d\n", node.Host, cluster.ID)
+
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"id":   node.ID,
+			"host": node.Host,
+			"uuid": node.Uuid,
+		},
+	})
+}
+
+func (s *NexServer) ApiRenameNode(c *gin.Context) {
+	params, ok := s.CheckRequiredParams(c, []string{"clusterId", "nodeId"})
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "missing parameters")
+		return
+	}
+
+	type RenameRequest struct {
+		Host string `json:"host" binding:"required"`
+	}
+	var req RenameRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	var node Node
+	result := s.requestDB(c).Where("id=? AND cluster_id=?", params["nodeId"], params["clusterId"]).First(&node)
+	if result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid node id")
+		return
+	}
+
+	if other := s.findNode(req.Host, node.ClusterID); other != nil && other.ID != node.ID {
+		s.ApiResponseJson(c, 409, "bad", "node name already in use")
+		return
+	}
+
+	oldHost := node.Host
+	result = s.requestDB(c).Model(&node).Update("host", req.Host)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to rename node: %v", result.Error)
+		return
+	}
+
+	s.purgeAll()
+	requestLog(c).Infof("Topology: renamed node %s to %s @ cluster %d\n", oldHost, req.Host, node.ClusterID)
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+func (s *NexServer) ApiCreateK8sNode(c *gin.Context) {
+	k8sClusterId := s.Param(c, "k8sClusterId")
+
+	var k8sCluster K8sCluster
+	if result := s.requestDB(c).Where("id=?", k8sClusterId).First(&k8sCluster); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid kubernetes cluster id")
+		return
+	}
+
+	type K8sNodeRequest struct {
+		Name string `json:"name" binding:"required"`
+	}
+	var req K8sNodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	if k8sNode := s.findK8sNode(req.Name, k8sCluster.ID); k8sNode != nil {
+		s.ApiResponseJson(c, 409, "bad", "kubernetes node already exists")
+		return
+	}
+
+	k8sObject := K8sObject{
+		K8sClusterID: k8sCluster.ID,
+		ApiVersion:   "v1",
+		Kind:         "Node",
+		Name:         req.Name,
+	}
+	if result := s.requestDB(c).Create(&k8sObject); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create node: %v", result.Error)
+		return
+	}
+
+	k8sNode := K8sNode{
+		Name:         req.Name,
+		K8sClusterID: k8sCluster.ID,
+		K8sObjectID:  k8sObject.ID,
+		Manual:       true,
+	}
+	if result := s.requestDB(c).Create(&k8sNode); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create node: %v", result.Error)
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"id":   k8sNode.ID,
+			"name": k8sNode.Name,
+		},
+	})
+}
+
+func (s *NexServer) ApiRenameK8sNode(c *gin.Context) {
+	params, ok := s.CheckRequiredParams(c, []string{"k8sClusterId", "k8sNodeId"})
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "missing parameters")
+		return
+	}
+
+	type RenameRequest struct {
+		Name string `json:"name" binding:"required"`
+	}
+	var req RenameRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	var k8sNode K8sNode
+	result := s.requestDB(c).Where("id=? AND k8s_cluster_id=?",
+		params["k8sNodeId"], params["k8sClusterId"]).First(&k8sNode)
+	if result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid kubernetes node id")
+		return
+	}
+
+	result = s.requestDB(c).Model(&k8sNode).Update("name", req.Name)
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to rename node: %v", result.Error)
+		return
+	}
+	s.requestDB(c).Model(&K8sObject{}).Where("id=?", k8sNode.K8sObjectID).Update("name", req.Name)
+
+	s.purgeAll()
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+func (s *NexServer) ApiOrphanedContainers(c *gin.Context) {
+	cId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	query := s.requestDB(c).Raw(`
+SELECT containers.id, containers.name, containers.container_id, containers.image, nodes.host
+FROM containers
+LEFT JOIN nodes ON containers.node_id=nodes.id
+LEFT JOIN k8s_containers ON containers.container_id=k8s_containers.container_id
+WHERE containers.cluster_id=? AND k8s_containers.id IS NULL
+ORDER BY containers.id`, cId)
+	rows, err, queryTime := s.QueryRowsWithTime(query)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	type ContainerItem struct {
+		Id          uint   `json:"id"`
+		Name        string `json:"name"`
+		ContainerId string `json:"container_id"`
+		Image       string `json:"image"`
+		Node        string `json:"node"`
+	}
+	items := make([]ContainerItem, 0, 16)
+
+	for rows.Next() {
+		var item ContainerItem
+
+		err := rows.Scan(&item.Id, &item.Name, &item.ContainerId, &item.Image, &item.Node)
+		if err != nil {
+			requestLog(c).Errorf("failed to get record: %v", err)
+			continue
+		}
+
+		items = append(items, item)
+	}
+
+	c.JSON(200, gin.H{
+		"status":        "ok",
+		"message":       "",
+		"data":          items,
+		"db_query_time": queryTime.String(),
+	})
+}
+
+// ApiMapContainerToPod links an agent-reported container to a Kubernetes pod
+// by registering it as one of the pod's containers.
+func (s *NexServer) ApiMapContainerToPod(c *gin.Context) {
+	params, ok := s.CheckRequiredParams(c, []string{"k8sClusterId", "podId"})
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "missing parameters")
+		return
+	}
+
+	type MapRequest struct {
+		ContainerId uint   `json:"container_id" binding:"required"`
+		Name        string `json:"name"`
+	}
+	var req MapRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	var pod K8sPod
+	result := s.requestDB(c).Where("id=? AND k8s_cluster_id=?", params["podId"], params["k8sClusterId"]).First(&pod)
+	if result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid pod id")
+		return
+	}
+
+	var container Container
+	if result := s.requestDB(c).Where("id=?", req.ContainerId).First(&container); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid container id")
+		return
+	}
+
+	var k8sCluster K8sCluster
+	if result := s.requestDB(c).Where("id=?", pod.K8sClusterID).First(&k8sCluster); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid k8s cluster id")
+		return
+	}
+	if k8sCluster.AgentClusterID != container.ClusterID {
+		s.ApiResponseJson(c, 400, "bad", "container and pod belong to different clusters")
+		return
+	}
+
+	name := req.Name
+	if name == "" {
+		name = container.Name
+	}
+
+	var k8sContainer K8sContainer
+	result = s.requestDB(c).Where("container_id=?", container.ContainerID).First(&k8sContainer)
+	if result.Error == nil {
+		result = s.requestDB(c).Model(&k8sContainer).Updates(map[string]interface{}{
+			"name":             name,
+			"k8s_pod_id":       pod.ID,
+			"k8s_namespace_id": pod.K8sNamespaceID,
+			"k8s_cluster_id":   pod.K8sClusterID,
+			"manual":           true,
+		})
+	} else {
+		k8sContainer = K8sContainer{
+			Name:           name,
+			Image:          container.Image,
+			ContainerType:  container.Type,
+			ContainerId:    container.ContainerID,
+			K8sClusterID:   pod.K8sClusterID,
+			K8sNamespaceID: pod.K8sNamespaceID,
+			K8sPodID:       pod.ID,
+			Manual:         true,
+		}
+		result = s.requestDB(c).Create(&k8sContainer)
+	}
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to map container: %v", result.Error)
+		return
+	}
+
+	requestLog(c).Infof("Topology: mapped container %s to pod %s\n", container.Name, pod.Name)
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
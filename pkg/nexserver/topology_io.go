@@ -0,0 +1,495 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
+	"github.com/jinzhu/gorm/dialects/postgres"
+	"time"
+)
+
+// Topology documents are portable: database ids are not exported and
+// relationships are expressed by name, so a document can be imported into
+// a different server.
+
+const topologyVersion = 1
+
+type TopologyProcess struct {
+	Name string          `json:"name"`
+	PID  int32           `json:"pid"`
+	Cmd  string          `json:"cmd"`
+	Info json.RawMessage `json:"info,omitempty"`
+}
+
+type TopologyContainer struct {
+	Type        string            `json:"type"`
+	ContainerID string            `json:"container_id"`
+	Name        string            `json:"name"`
+	Image       string            `json:"image"`
+	Info        json.RawMessage   `json:"info,omitempty"`
+	Processes   []TopologyProcess `json:"processes"`
+}
+
+type TopologyNode struct {
+	Host            string              `json:"host"`
+	Ipv4            string              `json:"ipv4"`
+	Ipv6            string              `json:"ipv6"`
+	PublicIpv4      string              `json:"public_ipv4"`
+	PublicIpv6      string              `json:"public_ipv6"`
+	Os              string              `json:"os"`
+	Platform        string              `json:"platform"`
+	PlatformFamily  string              `json:"platform_family"`
+	PlatformVersion string              `json:"platform_version"`
+	Description     string              `json:"description"`
+	Info            json.RawMessage     `json:"info,omitempty"`
+	Containers      []TopologyContainer `json:"containers"`
+	Processes       []TopologyProcess   `json:"processes"`
+}
+
+type TopologyK8sContainer struct {
+	Name          string `json:"name"`
+	Image         string `json:"image"`
+	ContainerType string `json:"container_type"`
+	ContainerId   string `json:"container_id"`
+}
+
+type TopologyK8sPod struct {
+	Name       string                 `json:"name"`
+	Qos        string                 `json:"qos"`
+	Containers []TopologyK8sContainer `json:"containers"`
+}
+
+type TopologyK8sNamespace struct {
+	Name string           `json:"name"`
+	Pods []TopologyK8sPod `json:"pods"`
+}
+
+type TopologyK8sCluster struct {
+	Name       string                 `json:"name"`
+	Nodes      []string               `json:"nodes"`
+	Namespaces []TopologyK8sNamespace `json:"namespaces"`
+}
+
+type Topology struct {
+	Version    int                 `json:"version"`
+	ExportedTs time.Time           `json:"exported_ts"`
+	Cluster    string              `json:"cluster"`
+	Nodes      []TopologyNode      `json:"nodes"`
+	K8s        *TopologyK8sCluster `json:"k8s,omitempty"`
+}
+
+func jsonbToRaw(value postgres.Jsonb) json.RawMessage {
+	if len(value.RawMessage) == 0 {
+		return nil
+	}
+
+	return value.RawMessage
+}
+
+func rawToJsonb(value json.RawMessage) postgres.Jsonb {
+	if len(value) == 0 {
+		return postgres.Jsonb{RawMessage: json.RawMessage("{}")}
+	}
+
+	return postgres.Jsonb{RawMessage: value}
+}
+
+func (s *NexServer) exportTopology(db *gorm.DB, cluster *Cluster) (*Topology, error) {
+	topology := &Topology{
+		Version:    topologyVersion,
+		ExportedTs: time.Now(),
+		Cluster:    cluster.Name,
+		Nodes:      make([]TopologyNode, 0, 16),
+	}
+
+	var nodes []Node
+	if result := db.Where("cluster_id=?", cluster.ID).Order("id").Find(&nodes); result.Error != nil {
+		return nil, result.Error
+	}
+
+	var containers []Container
+	if result := db.Where("cluster_id=?", cluster.ID).Order("id").Find(&containers); result.Error != nil {
+		return nil, result.Error
+	}
+
+	var processes []Process
+	if result := db.Where("cluster_id=?", cluster.ID).Order("id").Find(&processes); result.Error != nil {
+		return nil, result.Error
+	}
+
+	containerProcesses := make(map[uint][]TopologyProcess)
+	nodeProcesses := make(map[uint][]TopologyProcess)
+	for _, process := range processes {
+		item := TopologyProcess{
+			Name: process.Name,
+			PID:  process.PID,
+			Cmd:  process.Cmd,
+			Info: jsonbToRaw(process.Info),
+		}
+		if process.ContainerID != 0 {
+			containerProcesses[process.ContainerID] = append(containerProcesses[process.ContainerID], item)
+		} else {
+			nodeProcesses[process.NodeID] = append(nodeProcesses[process.NodeID], item)
+		}
+	}
+
+	nodeContainers := make(map[uint][]TopologyContainer)
+	for _, container := range containers {
+		nodeContainers[container.NodeID] = append(nodeContainers[container.NodeID], TopologyContainer{
+			Type:        container.Type,
+			ContainerID: container.ContainerID,
+			Name:        container.Name,
+			Image:       container.Image,
+			Info:        jsonbToRaw(container.Info),
+			Processes:   containerProcesses[container.ID],
+		})
+	}
+
+	for _, node := range nodes {
+		topology.Nodes = append(topology.Nodes, TopologyNode{
+			Host:            node.Host,
+			Ipv4:            node.Ipv4,
+			Ipv6:            node.Ipv6,
+			PublicIpv4:      node.PublicIpv4,
+			PublicIpv6:      node.PublicIpv6,
+			Os:              node.Os,
+			Platform:        node.Platform,
+			PlatformFamily:  node.PlatformFamily,
+			PlatformVersion: node.PlatformVersion,
+			Description:     node.Description,
+			Info:            jsonbToRaw(node.Info),
+			Containers:      nodeContainers[node.ID],
+			Processes:       nodeProcesses[node.ID],
+		})
+	}
+
+	var k8sCluster K8sCluster
+	if result := db.Where("agent_cluster_id=?", cluster.ID).First(&k8sCluster); result.Error != nil {
+		return topology, nil
+	}
+
+	k8sTopology, err := s.exportK8sTopology(db, &k8sCluster)
+	if err != nil {
+		return nil, err
+	}
+	topology.K8s = k8sTopology
+
+	return topology, nil
+}
+
+func (s *NexServer) exportK8sTopology(db *gorm.DB, k8sCluster *K8sCluster) (*TopologyK8sCluster, error) {
+	k8sTopology := &TopologyK8sCluster{
+		Name:       k8sCluster.Name,
+		Nodes:      make([]string, 0, 16),
+		Namespaces: make([]TopologyK8sNamespace, 0, 16),
+	}
+
+	var k8sNodes []K8sNode
+	if result := db.Where("k8s_cluster_id=?", k8sCluster.ID).Order("id").Find(&k8sNodes); result.Error != nil {
+		return nil, result.Error
+	}
+	for _, k8sNode := range k8sNodes {
+		k8sTopology.Nodes = append(k8sTopology.Nodes, k8sNode.Name)
+	}
+
+	var namespaces []K8sNamespace
+	if result := db.Where("k8s_cluster_id=?", k8sCluster.ID).Order("id").Find(&namespaces); result.Error != nil {
+		return nil, result.Error
+	}
+
+	var pods []K8sPod
+	if result := db.Where("k8s_cluster_id=?", k8sCluster.ID).Order("id").Find(&pods); result.Error != nil {
+		return nil, result.Error
+	}
+
+	var k8sContainers []K8sContainer
+	if result := db.Where("k8s_cluster_id=?", k8sCluster.ID).Order("id").Find(&k8sContainers); result.Error != nil {
+		return nil, result.Error
+	}
+
+	podContainers := make(map[uint][]TopologyK8sContainer)
+	for _, k8sContainer := range k8sContainers {
+		podContainers[k8sContainer.K8sPodID] = append(podContainers[k8sContainer.K8sPodID], TopologyK8sContainer{
+			Name:          k8sContainer.Name,
+			Image:         k8sContainer.Image,
+			ContainerType: k8sContainer.ContainerType,
+			ContainerId:   k8sContainer.ContainerId,
+		})
+	}
+
+	namespacePods := make(map[uint][]TopologyK8sPod)
+	for _, pod := range pods {
+		namespacePods[pod.K8sNamespaceID] = append(namespacePods[pod.K8sNamespaceID], TopologyK8sPod{
+			Name:       pod.Name,
+			Qos:        pod.Qos,
+			Containers: podContainers[pod.ID],
+		})
+	}
+
+	for _, namespace := range namespaces {
+		k8sTopology.Namespaces = append(k8sTopology.Namespaces, TopologyK8sNamespace{
+			Name: namespace.Name,
+			Pods: namespacePods[namespace.ID],
+		})
+	}
+
+	return k8sTopology, nil
+}
+
+func importTopologyProcesses(tx *gorm.DB, processes []TopologyProcess, clusterId, nodeId, containerId uint) error {
+	for _, item := range processes {
+		process := Process{
+			Name:        item.Name,
+			PID:         item.PID,
+			Cmd:         item.Cmd,
+			Info:        rawToJsonb(item.Info),
+			ClusterID:   clusterId,
+			NodeID:      nodeId,
+			ContainerID: containerId,
+		}
+		if result := tx.Create(&process); result.Error != nil {
+			return result.Error
+		}
+	}
+
+	return nil
+}
+
+// importTopology creates a new cluster from the given document. Imported
+// nodes have no agent and are flagged as manual.
+func (s *NexServer) importTopology(tx *gorm.DB, topology *Topology) (*Cluster, error) {
+	var existing Cluster
+	if result := tx.Unscoped().Where("name=?", topology.Cluster).First(&existing); result.Error == nil {
+		return nil, fmt.Errorf("cluster %s already exists", topology.Cluster)
+	}
+
+	cluster := Cluster{Name: topology.Cluster}
+	if result := tx.Create(&cluster); result.Error != nil {
+		return nil, result.Error
+	}
+
+	for _, item := range topology.Nodes {
+		nodeUuid, _ := uuid.NewUUID()
+		node := Node{
+			Host:            item.Host,
+			Ipv4:            item.Ipv4,
+			Ipv6:            item.Ipv6,
+			PublicIpv4:      item.PublicIpv4,
+			PublicIpv6:      item.PublicIpv6,
+			Os:              item.Os,
+			Platform:        item.Platform,
+			PlatformFamily:  item.PlatformFamily,
+			PlatformVersion: item.PlatformVersion,
+			Description:     item.Description,
+			Info:            rawToJsonb(item.Info),
+			Uuid:            nodeUuid.String(),
+			Manual:          true,
+			ClusterID:       cluster.ID,
+		}
+		if result := tx.Create(&node); result.Error != nil {
+			return nil, result.Error
+		}
+
+		for _, containerItem := range item.Containers {
+			container := Container{
+				Type:        containerItem.Type,
+				ContainerID: containerItem.ContainerID,
+				Name:        containerItem.Name,
+				Image:       containerItem.Image,
+				Info:        rawToJsonb(containerItem.Info),
+				ClusterID:   cluster.ID,
+				NodeID:      node.ID,
+			}
+			if result := tx.Create(&container); result.Error != nil {
+				return nil, result.Error
+			}
+
+			err := importTopologyProcesses(tx, containerItem.Processes, cluster.ID, node.ID, container.ID)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if err := importTopologyProcesses(tx, item.Processes, cluster.ID, node.ID, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	if topology.K8s == nil {
+		return &cluster, nil
+	}
+
+	if err := s.importK8sTopology(tx, topology.K8s, cluster.ID); err != nil {
+		return nil, err
+	}
+
+	return &cluster, nil
+}
+
+func (s *NexServer) importK8sTopology(tx *gorm.DB, k8sTopology *TopologyK8sCluster, clusterId uint) error {
+	k8sCluster := K8sCluster{Name: k8sTopology.Name, AgentClusterID: clusterId}
+	if result := tx.Create(&k8sCluster); result.Error != nil {
+		return result.Error
+	}
+
+	createObject := func(apiVersion, kind, name string) (uint, error) {
+		k8sObject := K8sObject{
+			K8sClusterID: k8sCluster.ID,
+			ApiVersion:   apiVersion,
+			Kind:         kind,
+			Name:         name,
+		}
+		result := tx.Create(&k8sObject)
+
+		return k8sObject.ID, result.Error
+	}
+
+	for _, name := range k8sTopology.Nodes {
+		objectId, err := createObject("v1", "Node", name)
+		if err != nil {
+			return err
+		}
+
+		k8sNode := K8sNode{Name: name, Manual: true, K8sClusterID: k8sCluster.ID, K8sObjectID: objectId}
+		if result := tx.Create(&k8sNode); result.Error != nil {
+			return result.Error
+		}
+	}
+
+	for _, namespaceItem := range k8sTopology.Namespaces {
+		objectId, err := createObject("v1", "Namespace", namespaceItem.Name)
+		if err != nil {
+			return err
+		}
+
+		namespace := K8sNamespace{Name: namespaceItem.Name, K8sClusterID: k8sCluster.ID, K8sObjectID: objectId}
+		if result := tx.Create(&namespace); result.Error != nil {
+			return result.Error
+		}
+
+		for _, podItem := range namespaceItem.Pods {
+			objectId, err := createObject("v1", "Pod", podItem.Name)
+			if err != nil {
+				return err
+			}
+
+			pod := K8sPod{
+				Name:           podItem.Name,
+				Qos:            podItem.Qos,
+				K8sClusterID:   k8sCluster.ID,
+				K8sNamespaceID: namespace.ID,
+				K8sObjectID:    objectId,
+			}
+			if result := tx.Create(&pod); result.Error != nil {
+				return result.Error
+			}
+
+			for _, containerItem := range podItem.Containers {
+				k8sContainer := K8sContainer{
+					Name:           containerItem.Name,
+					Image:          containerItem.Image,
+					ContainerType:  containerItem.ContainerType,
+					ContainerId:    containerItem.ContainerId,
+					K8sClusterID:   k8sCluster.ID,
+					K8sNamespaceID: namespace.ID,
+					K8sPodID:       pod.ID,
+				}
+				if result := tx.Create(&k8sContainer); result.Error != nil {
+					return result.Error
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *NexServer) ApiExportTopology(c *gin.Context) {
+	cId, ok := s.idParam(c, "clusterId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	var cluster Cluster
+	if result := s.requestDB(c).Where("id=?", cId).First(&cluster); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid cluster id")
+		return
+	}
+
+	topology, err := s.exportTopology(s.requestDB(c), &cluster)
+	if err != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to export topology: %v", err)
+		return
+	}
+
+	if c.DefaultQuery("download", "") == "true" {
+		c.Header("Content-Disposition",
+			fmt.Sprintf("attachment; filename=\"topology-%s.json\"", cluster.Name))
+	}
+
+	c.JSON(200, topology)
+}
+
+func (s *NexServer) ApiImportTopology(c *gin.Context) {
+	var topology Topology
+	if err := c.ShouldBindJSON(&topology); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+
+	if topology.Version != topologyVersion {
+		s.ApiResponseJsonf(c, 400, "bad", "unsupported topology version %d", topology.Version)
+		return
+	}
+
+	if name := c.DefaultQuery("cluster", ""); name != "" {
+		topology.Cluster = name
+	}
+	if topology.Cluster == "" {
+		s.ApiResponseJson(c, 400, "bad", "missing cluster name")
+		return
+	}
+
+	tx := s.requestDB(c).Begin()
+	cluster, err := s.importTopology(tx, &topology)
+	if err != nil {
+		tx.Rollback()
+		s.ApiResponseJsonf(c, 409, "bad", "failed to import topology: %v", err)
+		return
+	}
+	if result := tx.Commit(); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to import topology: %v", result.Error)
+		return
+	}
+
+	s.purgeAll()
+	requestLog(c).Infof("Topology: imported cluster %s with %d nodes\n", cluster.Name, len(topology.Nodes))
+
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data": gin.H{
+			"cluster_id": cluster.ID,
+			"name":       cluster.Name,
+		},
+	})
+}
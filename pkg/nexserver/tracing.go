@@ -0,0 +1,451 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds and status codes as defined by the OTLP trace protocol.
+const (
+	SpanKindServer = 2
+	SpanKindClient = 3
+
+	SpanStatusOk    = 1
+	SpanStatusError = 2
+
+	traceSpanKey      = "nexclipper:trace_span"
+	traceBatchSize    = 512
+	traceFlushPeriod  = 5 * time.Second
+	traceQueueSize    = 4096
+	traceparentHeader = "traceparent"
+)
+
+type TracingConfig struct {
+	Use         bool
+	Endpoint    string
+	ServiceName string
+}
+
+type spanContextKey struct{}
+
+type Span struct {
+	tracer *Tracer
+
+	TraceId      string
+	SpanId       string
+	ParentSpanId string
+	Name         string
+	Kind         int
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{}
+	StatusCode   int
+	StatusText   string
+}
+
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+
+	span.Attributes[key] = value
+}
+
+func (span *Span) SetError(err error) {
+	if span == nil || err == nil {
+		return
+	}
+
+	span.StatusCode = SpanStatusError
+	span.StatusText = err.Error()
+}
+
+func (span *Span) Finish() {
+	if span == nil {
+		return
+	}
+
+	span.End = time.Now()
+	if span.StatusCode == 0 {
+		span.StatusCode = SpanStatusOk
+	}
+
+	span.tracer.export(span)
+}
+
+func (span *Span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", span.TraceId, span.SpanId)
+}
+
+// Tracer batches finished spans and ships them to an OTLP/HTTP collector.
+type Tracer struct {
+	config TracingConfig
+	client *http.Client
+	queue  chan *Span
+	once   sync.Once
+}
+
+func NewTracer(config TracingConfig) *Tracer {
+	if config.ServiceName == "" {
+		config.ServiceName = "nexserver"
+	}
+
+	return &Tracer{
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan *Span, traceQueueSize),
+	}
+}
+
+func randomHex(size int) string {
+	buf := make([]byte, size)
+	_, _ = rand.Read(buf)
+
+	return hex.EncodeToString(buf)
+}
+
+// StartSpan starts a span as a child of the span carried by ctx, if any.
+// A nil tracer returns a nil span, and every span method is nil-safe.
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer:     t,
+		SpanId:     randomHex(8),
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]interface{}),
+	}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.TraceId = parent.TraceId
+		span.ParentSpanId = parent.SpanId
+	} else {
+		span.TraceId = randomHex(16)
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// StartRemoteSpan starts a span continuing a W3C traceparent from a remote caller.
+func (t *Tracer) StartRemoteSpan(ctx context.Context, traceparent, name string, kind int) (context.Context, *Span) {
+	ctx, span := t.StartSpan(ctx, name, kind)
+	if span == nil {
+		return ctx, nil
+	}
+
+	parts := strings.Split(traceparent, "-")
+	if len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		span.TraceId = parts[1]
+		span.ParentSpanId = parts[2]
+	}
+
+	return ctx, span
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+
+	return span
+}
+
+func (t *Tracer) export(span *Span) {
+	t.once.Do(func() {
+		go t.run()
+	})
+
+	select {
+	case t.queue <- span:
+	default:
+		// drop spans rather than blocking request handling
+	}
+}
+
+func (t *Tracer) run() {
+	batch := make([]*Span, 0, traceBatchSize)
+	ticker := time.NewTicker(traceFlushPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := t.flush(batch); err != nil {
+			serverLog.Errorf("Tracing: failed to export %d spans: %v\n", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []map[string]interface{} {
+	results := make([]map[string]interface{}, 0, len(attributes))
+
+	for key, value := range attributes {
+		var otlpValue map[string]interface{}
+
+		switch v := value.(type) {
+		case int:
+			otlpValue = map[string]interface{}{"intValue": fmt.Sprintf("%d", v)}
+		case int64:
+			otlpValue = map[string]interface{}{"intValue": fmt.Sprintf("%d", v)}
+		case float64:
+			otlpValue = map[string]interface{}{"doubleValue": v}
+		case bool:
+			otlpValue = map[string]interface{}{"boolValue": v}
+		default:
+			otlpValue = map[string]interface{}{"stringValue": fmt.Sprintf("%v", v)}
+		}
+
+		results = append(results, map[string]interface{}{"key": key, "value": otlpValue})
+	}
+
+	return results
+}
+
+func (t *Tracer) flush(batch []*Span) error {
+	spans := make([]map[string]interface{}, 0, len(batch))
+
+	for _, span := range batch {
+		spans = append(spans, map[string]interface{}{
+			"traceId":           span.TraceId,
+			"spanId":            span.SpanId,
+			"parentSpanId":      span.ParentSpanId,
+			"name":              span.Name,
+			"kind":              span.Kind,
+			"startTimeUnixNano": fmt.Sprintf("%d", span.Start.UnixNano()),
+			"endTimeUnixNano":   fmt.Sprintf("%d", span.End.UnixNano()),
+			"attributes":        otlpAttributes(span.Attributes),
+			"status": map[string]interface{}{
+				"code":    span.StatusCode,
+				"message": span.StatusText,
+			},
+		})
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{
+						"service.name":    t.config.ServiceName,
+						"service.version": NexServerVersion,
+					}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": AppName},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.config.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (s *NexServer) initTracer() {
+	if !s.config.Tracing.Use || s.config.Tracing.Endpoint == "" {
+		return
+	}
+
+	s.tracer = NewTracer(s.config.Tracing)
+	s.registerDBTraceCallbacks()
+
+	serverLog.Infof("Tracing: exporting spans to %s\n", s.config.Tracing.Endpoint)
+}
+
+// TraceMiddleware starts a server span for every API request.
+func (s *NexServer) TraceMiddleware(c *gin.Context) {
+	if s.tracer == nil {
+		c.Next()
+		return
+	}
+
+	ctx, span := s.tracer.StartRemoteSpan(c.Request.Context(), c.GetHeader(traceparentHeader),
+		fmt.Sprintf("%s %s", c.Request.Method, c.Request.URL.Path), SpanKindServer)
+	c.Request = c.Request.WithContext(ctx)
+	c.Header(traceparentHeader, span.traceparent())
+
+	c.Next()
+
+	span.SetAttribute("http.method", c.Request.Method)
+	span.SetAttribute("http.target", c.Request.URL.Path)
+	span.SetAttribute("http.status_code", c.Writer.Status())
+	if c.Writer.Status() >= 500 {
+		span.StatusCode = SpanStatusError
+	}
+	span.Finish()
+}
+
+func (s *NexServer) grpcSpan(ctx context.Context, method string) (context.Context, *Span) {
+	traceparent := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(traceparentHeader); len(values) > 0 {
+			traceparent = values[0]
+		}
+	}
+
+	ctx, span := s.tracer.StartRemoteSpan(ctx, traceparent, method, SpanKindServer)
+	span.SetAttribute("rpc.system", "grpc")
+	span.SetAttribute("rpc.method", method)
+
+	return ctx, span
+}
+
+func (s *NexServer) TraceUnaryInterceptor(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if s.tracer == nil {
+		return handler(ctx, req)
+	}
+
+	ctx, span := s.grpcSpan(ctx, info.FullMethod)
+	resp, err := handler(ctx, req)
+	span.SetError(err)
+	span.Finish()
+
+	return resp, err
+}
+
+type tracedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (ss *tracedServerStream) Context() context.Context {
+	return ss.ctx
+}
+
+func (s *NexServer) TraceStreamInterceptor(srv interface{}, ss grpc.ServerStream,
+	info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if s.tracer == nil {
+		return handler(srv, ss)
+	}
+
+	ctx, span := s.grpcSpan(ss.Context(), info.FullMethod)
+	err := handler(srv, &tracedServerStream{ServerStream: ss, ctx: ctx})
+	span.SetError(err)
+	span.Finish()
+
+	return err
+}
+
+// dbFromContext returns a DB handle whose statements are traced as children
+// of the span carried by ctx.
+func (s *NexServer) dbFromContext(ctx context.Context) *gorm.DB {
+	span := SpanFromContext(ctx)
+	if span == nil {
+		return s.db
+	}
+
+	return s.db.Set(traceSpanKey, span)
+}
+
+func (s *NexServer) requestDB(c *gin.Context) *gorm.DB {
+	if isReadRequest(c) {
+		return withRequestStats(c, s.requestTx(c))
+	}
+
+	return withRequestStats(c, s.dbFromContext(c.Request.Context()))
+}
+
+func (s *NexServer) registerDBTraceCallbacks() {
+	before := func(scope *gorm.Scope) {
+		value, ok := scope.Get(traceSpanKey)
+		if !ok {
+			return
+		}
+		parent, ok := value.(*Span)
+		if !ok {
+			return
+		}
+
+		ctx := context.WithValue(context.Background(), spanContextKey{}, parent)
+		_, span := s.tracer.StartSpan(ctx, "db "+scope.TableName(), SpanKindClient)
+		scope.InstanceSet(traceSpanKey, span)
+	}
+	after := func(scope *gorm.Scope) {
+		value, ok := scope.InstanceGet(traceSpanKey)
+		if !ok {
+			return
+		}
+		span := value.(*Span)
+
+		span.SetAttribute("db.system", "postgresql")
+		span.SetAttribute("db.statement", scope.SQL)
+		span.SetAttribute("db.rows_affected", scope.DB().RowsAffected)
+		span.SetError(scope.DB().Error)
+		span.Finish()
+	}
+
+	callback := s.db.Callback()
+	callback.Query().Before("gorm:query").Register("trace:before_query", before)
+	callback.Query().After("gorm:query").Register("trace:after_query", after)
+	callback.RowQuery().Before("gorm:row_query").Register("trace:before_row_query", before)
+	callback.RowQuery().After("gorm:row_query").Register("trace:after_row_query", after)
+	callback.Create().Before("gorm:create").Register("trace:before_create", before)
+	callback.Create().After("gorm:create").Register("trace:after_create", after)
+	callback.Update().Before("gorm:update").Register("trace:before_update", before)
+	callback.Update().After("gorm:update").Register("trace:after_update", after)
+	callback.Delete().Before("gorm:delete").Register("trace:before_delete", before)
+	callback.Delete().After("gorm:delete").Register("trace:after_delete", after)
+}
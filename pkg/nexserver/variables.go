@@ -0,0 +1,334 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Dashboards declare template variables the way Grafana does, each with a
+// query such as nodes($cluster, role=db), and resolve all of them in one
+// call. The variables are resolved in order, so a query can refer to the
+// variables declared before it as $name or ${name}, which take their
+// current value: the one given in the request if it is an option, the
+// first option otherwise. The queries are:
+//
+//	clusters()
+//	nodes(cluster[, key=value])        nodes, with the Kubernetes node label
+//	namespaces(cluster)
+//	label_values(metric, label[, cluster])  values seen within the last day
+//
+// A cluster is given by id or by name. The options can be filtered with
+// the regex of the variable.
+
+const maxVariables = 32
+
+var (
+	variableQueryPattern = regexp.MustCompile(`^\s*([a-z_]+)\s*\((.*)\)\s*$`)
+	variableRefPattern   = regexp.MustCompile(`\$\{([A-Za-z0-9_]+)\}|\$([A-Za-z0-9_]+)`)
+	variableNamePattern  = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+)
+
+type VariableOption struct {
+	Text  string `json:"text"`
+	Value string `json:"value"`
+}
+
+type VariableItem struct {
+	Name    string           `json:"name"`
+	Query   string           `json:"query"`
+	Options []VariableOption `json:"options"`
+	Current *VariableOption  `json:"current"`
+	Error   string           `json:"error,omitempty"`
+}
+
+type variableFunction struct {
+	minArgs int
+	maxArgs int
+	resolve func(s *NexServer, c *gin.Context, args []string) ([]VariableOption, error)
+}
+
+var variableFunctions = map[string]variableFunction{
+	"clusters":     {0, 0, (*NexServer).variableClusters},
+	"nodes":        {1, 2, (*NexServer).variableNodes},
+	"namespaces":   {1, 1, (*NexServer).variableNamespaces},
+	"label_values": {2, 3, (*NexServer).variableLabelValues},
+}
+
+// substituteVariables replaces the references to the resolved variables.
+func substituteVariables(query string, current map[string]string) (string, error) {
+	var missing string
+	result := variableRefPattern.ReplaceAllStringFunc(query, func(ref string) string {
+		name := strings.Trim(ref, "${}")
+		value, found := current[name]
+		if !found {
+			missing = name
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("unknown variable $%s", missing)
+	}
+
+	return result, nil
+}
+
+func parseVariableQuery(query string) (string, []string, error) {
+	matches := variableQueryPattern.FindStringSubmatch(query)
+	if matches == nil {
+		return "", nil, fmt.Errorf("invalid query, expected function(arguments)")
+	}
+
+	args := make([]string, 0)
+	if strings.TrimSpace(matches[2]) != "" {
+		for _, arg := range strings.Split(matches[2], ",") {
+			args = append(args, strings.TrimSpace(arg))
+		}
+	}
+
+	return matches[1], args, nil
+}
+
+// variableCluster returns the id of a cluster given by id or by name.
+func (s *NexServer) variableCluster(c *gin.Context, value string) (uint, error) {
+	if id, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return uint(id), nil
+	}
+
+	var cluster Cluster
+	if result := s.requestDB(c).Where("name=?", value).First(&cluster); result.Error != nil {
+		return 0, fmt.Errorf("unknown cluster %s", value)
+	}
+
+	return cluster.ID, nil
+}
+
+func scanVariableOptions(rows *sql.Rows) []VariableOption {
+	defer rows.Close()
+
+	options := make([]VariableOption, 0)
+	for rows.Next() {
+		var option VariableOption
+		if err := rows.Scan(&option.Text, &option.Value); err != nil {
+			continue
+		}
+		options = append(options, option)
+	}
+
+	return options
+}
+
+func (s *NexServer) variableClusters(c *gin.Context, args []string) ([]VariableOption, error) {
+	rows, err := s.requestDB(c).Table("clusters").
+		Select("name, id::text").
+		Where("deleted_at IS NULL").
+		Order("name").Rows()
+	if err != nil {
+		return nil, err
+	}
+
+	return scanVariableOptions(rows), nil
+}
+
+func (s *NexServer) variableNodes(c *gin.Context, args []string) ([]VariableOption, error) {
+	clusterId, err := s.variableCluster(c, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	db := s.requestDB(c).Table("nodes").
+		Select("nodes.host, nodes.id::text").
+		Where("nodes.cluster_id=? AND nodes.deleted_at IS NULL", clusterId)
+	if len(args) > 1 {
+		if !strings.Contains(args[1], "=") {
+			return nil, fmt.Errorf("invalid tag %s, expected key=value", args[1])
+		}
+		db = db.Where(`EXISTS (SELECT 1 FROM k8s_nodes, k8s_clusters, k8s_labels
+WHERE k8s_nodes.name=nodes.host AND k8s_nodes.k8s_cluster_id=k8s_clusters.id
+AND k8s_clusters.agent_cluster_id=nodes.cluster_id
+AND k8s_labels.k8s_object_id=k8s_nodes.k8s_object_id AND k8s_labels.label=?
+AND k8s_nodes.deleted_at IS NULL AND k8s_labels.deleted_at IS NULL)`, args[1])
+	}
+
+	rows, err := db.Order("nodes.host").Rows()
+	if err != nil {
+		return nil, err
+	}
+
+	return scanVariableOptions(rows), nil
+}
+
+func (s *NexServer) variableNamespaces(c *gin.Context, args []string) ([]VariableOption, error) {
+	clusterId, err := s.variableCluster(c, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.requestDB(c).Table("k8s_namespaces").
+		Select("DISTINCT k8s_namespaces.name, k8s_namespaces.name").
+		Joins("JOIN k8s_clusters ON k8s_namespaces.k8s_cluster_id=k8s_clusters.id").
+		Where("k8s_clusters.agent_cluster_id=? AND k8s_namespaces.deleted_at IS NULL", clusterId).
+		Order("k8s_namespaces.name").Rows()
+	if err != nil {
+		return nil, err
+	}
+
+	return scanVariableOptions(rows), nil
+}
+
+func (s *NexServer) variableLabelValues(c *gin.Context, args []string) ([]VariableOption, error) {
+	if !labelKeyPattern.MatchString(args[1]) {
+		return nil, fmt.Errorf("invalid label %s", args[1])
+	}
+
+	start, end := s.seriesTimeRange(nil)
+	series := s.requestDB(c).Table("metrics").
+		Select("DISTINCT metrics.label_id").
+		Joins("JOIN metric_names ON metrics.name_id=metric_names.id").
+		Where("metric_names.name=? AND metrics.ts >= ? AND metrics.ts < ?", args[0], start, end)
+	if len(args) > 2 {
+		clusterId, err := s.variableCluster(c, args[2])
+		if err != nil {
+			return nil, err
+		}
+		series = series.Where("metrics.cluster_id=?", clusterId)
+	}
+
+	// the label key is validated and so can go into the statement text
+	value := fmt.Sprintf("substring(',' || metric_labels.label from ',%s=([^,]*)')", args[1])
+	rows, err := s.requestDB(c).Table("metric_labels").
+		Select(fmt.Sprintf("DISTINCT %s, %s", value, value)).
+		Where("metric_labels.id IN (?)", series.QueryExpr()).
+		Where(value + " IS NOT NULL").
+		Order("1").Rows()
+	if err != nil {
+		return nil, err
+	}
+
+	return scanVariableOptions(rows), nil
+}
+
+// resolveVariable runs the query of a variable and applies its regex.
+func (s *NexServer) resolveVariable(c *gin.Context, query, filter string) ([]VariableOption, error) {
+	name, args, err := parseVariableQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	function, found := variableFunctions[name]
+	if !found {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+	if len(args) < function.minArgs || len(args) > function.maxArgs {
+		return nil, fmt.Errorf("%s takes %d to %d arguments", name, function.minArgs, function.maxArgs)
+	}
+	for _, arg := range args {
+		if arg == "" {
+			return nil, fmt.Errorf("%s: empty argument", name)
+		}
+	}
+
+	options, err := function.resolve(s, c, args)
+	if err != nil || filter == "" {
+		return options, err
+	}
+
+	pattern, err := regexp.Compile(filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex: %v", err)
+	}
+	filtered := make([]VariableOption, 0, len(options))
+	for _, option := range options {
+		if pattern.MatchString(option.Text) {
+			filtered = append(filtered, option)
+		}
+	}
+
+	return filtered, nil
+}
+
+func (s *NexServer) ApiVariables(c *gin.Context) {
+	type VariableRequest struct {
+		Name  string `json:"name" binding:"required"`
+		Query string `json:"query" binding:"required"`
+		Regex string `json:"regex"`
+	}
+	type VariablesRequest struct {
+		Variables []VariableRequest `json:"variables" binding:"required"`
+		Current   map[string]string `json:"current"`
+	}
+	var req VariablesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return
+	}
+	if len(req.Variables) > maxVariables {
+		s.ApiResponseJsonf(c, 400, "bad", "at most %d variables are resolved at once", maxVariables)
+		return
+	}
+
+	current := make(map[string]string)
+	items := make([]VariableItem, 0, len(req.Variables))
+	for _, variable := range req.Variables {
+		if !variableNamePattern.MatchString(variable.Name) {
+			s.ApiResponseJsonf(c, 400, "bad", "invalid variable name: %s", variable.Name)
+			return
+		}
+
+		item := VariableItem{Name: variable.Name, Options: make([]VariableOption, 0)}
+		query, err := substituteVariables(variable.Query, current)
+		item.Query = query
+		if err == nil {
+			var options []VariableOption
+			if options, err = s.resolveVariable(c, query, variable.Regex); err == nil {
+				item.Options = options
+			}
+		}
+		if err != nil {
+			if queryTimedOut(err) {
+				s.apiQueryTimeout(c)
+				return
+			}
+			item.Error = err.Error()
+		}
+
+		if len(item.Options) > 0 {
+			item.Current = &item.Options[0]
+			for idx := range item.Options {
+				if item.Options[idx].Value == req.Current[variable.Name] {
+					item.Current = &item.Options[idx]
+					break
+				}
+			}
+		}
+		if item.Current != nil {
+			current[variable.Name] = item.Current.Value
+		}
+
+		items = append(items, item)
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"reflect"
+	"runtime"
+	"sync"
+)
+
+// GitCommit and BuildDate are set by the Makefile with
+// -ldflags "-X github.com/NexClipper/NexClipper/pkg/nexserver.GitCommit=...".
+// The schema version is a fingerprint of the models rather than a number
+// kept by hand: two servers report the same one exactly when AutoMigrate
+// brings their databases to the same tables and columns.
+
+var (
+	GitCommit = "unknown"
+	BuildDate = "unknown"
+
+	schemaVersionOnce  sync.Once
+	schemaVersionValue string
+)
+
+// SchemaVersion returns the fingerprint of the database schema.
+func SchemaVersion() string {
+	schemaVersionOnce.Do(func() {
+		hash := sha256.New()
+		for _, model := range schemaModels {
+			modelType := reflect.Indirect(reflect.ValueOf(model)).Type()
+			writeSchemaType(hash, modelType)
+		}
+		schemaVersionValue = hex.EncodeToString(hash.Sum(nil))[:12]
+	})
+
+	return schemaVersionValue
+}
+
+func writeSchemaType(w interface{ Write([]byte) (int, error) }, modelType reflect.Type) {
+	_, _ = fmt.Fprintf(w, "%s{", modelType.Name())
+	for idx := 0; idx < modelType.NumField(); idx++ {
+		field := modelType.Field(idx)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			writeSchemaType(w, field.Type)
+			continue
+		}
+		if field.PkgPath != "" || field.Tag.Get("gorm") == "-" {
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "%s %s `%s`;", field.Name, field.Type.String(), field.Tag.Get("gorm"))
+	}
+	_, _ = fmt.Fprint(w, "}")
+}
+
+type VersionInfo struct {
+	Version       string   `json:"version"`
+	GitCommit     string   `json:"git_commit"`
+	BuildDate     string   `json:"build_date"`
+	SchemaVersion string   `json:"schema_version"`
+	GoVersion     string   `json:"go_version"`
+	Os            string   `json:"os"`
+	Arch          string   `json:"arch"`
+	Features      []string `json:"features"`
+}
+
+func (s *NexServer) ApiVersion(c *gin.Context) {
+	info := &VersionInfo{
+		Version:       NexServerVersion,
+		GitCommit:     GitCommit,
+		BuildDate:     BuildDate,
+		SchemaVersion: SchemaVersion(),
+		GoVersion:     runtime.Version(),
+		Os:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+		Features:      make([]string, 0, len(features)),
+	}
+	for idx := range features {
+		if enabled, _ := s.featureState(&features[idx]); enabled {
+			info.Features = append(info.Features, features[idx].Name)
+		}
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    info,
+	})
+}
@@ -0,0 +1,563 @@
+/*
+Copyright 2019 NexClipper.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nexserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// A subscription is a notification channel: a generic webhook receives the
+// event as JSON, a Slack incoming webhook receives its message as text.
+const (
+	ChannelTypeWebhook = "webhook"
+	ChannelTypeSlack   = "slack"
+)
+
+const (
+	EventNodeAdded         = "node.added"
+	EventAgentOnline       = "agent.online"
+	EventAgentOffline      = "agent.offline"
+	EventK8sNodeAdded      = "k8s_node.added"
+	EventK8sNamespaceAdded = "k8s_namespace.added"
+	EventClusterDeleted    = "cluster.deleted"
+	EventClusterRestored   = "cluster.restored"
+	EventClusterRenamed    = "cluster.renamed"
+	EventClusterMerged     = "cluster.merged"
+	EventIncidentFired     = "incident.fired"
+	EventIncidentDigest    = "incident.digest"
+	EventWebhookTest       = "webhook.test"
+)
+
+var webhookEvents = []string{
+	EventNodeAdded, EventAgentOnline, EventAgentOffline,
+	EventK8sNodeAdded, EventK8sNamespaceAdded,
+	EventClusterDeleted, EventClusterRestored, EventClusterRenamed, EventClusterMerged,
+	EventIncidentFired, EventCostBudgetExceeded, EventApiKeyQuotaExceeded,
+	EventAgentDegraded, EventAgentRecovered, EventAgentDisabled, EventAgentDeregistered,
+}
+
+type WebhookConfig struct {
+	MaxRetries     int
+	TimeoutSeconds int
+}
+
+type WebhookEvent struct {
+	Id        string      `json:"id"`
+	Event     string      `json:"event"`
+	Ts        time.Time   `json:"ts"`
+	ClusterId uint        `json:"cluster_id"`
+	Message   string      `json:"message,omitempty"`
+	Data      interface{} `json:"data"`
+}
+
+type webhookDelivery struct {
+	subscription Subscription
+	event        WebhookEvent
+}
+
+// WebhookDispatcher delivers inventory change events to subscribed
+// endpoints. Deliveries are signed with HMAC-SHA256 over the request body
+// and retried with exponential backoff.
+type WebhookDispatcher struct {
+	queue  chan webhookDelivery
+	client *http.Client
+}
+
+func NewWebhookDispatcher(config WebhookConfig) *WebhookDispatcher {
+	timeout := time.Duration(config.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	return &WebhookDispatcher{
+		queue:  make(chan webhookDelivery, 256),
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Subscription) matches(event string, clusterId uint) bool {
+	if s.Disabled {
+		return false
+	}
+	if s.ClusterID != 0 && s.ClusterID != clusterId {
+		return false
+	}
+	if event == EventIncidentDigest {
+		event = EventIncidentFired
+	}
+	if event == EventWebhookTest || s.Events == "" || s.Events == "*" {
+		return true
+	}
+
+	return stringInSlice(event, strings.Split(s.Events, ","))
+}
+
+func newWebhookEvent(event string, clusterId uint, data interface{}) WebhookEvent {
+	eventId, _ := uuid.NewRandom()
+
+	return WebhookEvent{
+		Id:        eventId.String(),
+		Event:     event,
+		Ts:        time.Now(),
+		ClusterId: clusterId,
+		Data:      data,
+	}
+}
+
+// emitEvent queues the event for every matching subscription. It never
+// blocks ingestion: if the queue is full the delivery is dropped.
+func (s *NexServer) emitEvent(event string, clusterId uint, data interface{}) {
+	if s.webhooks == nil {
+		return
+	}
+
+	var subscriptions []Subscription
+	result := s.db.Where("disabled=?", false).Find(&subscriptions)
+	if result.Error != nil {
+		incidentLog.Errorf("Webhook: failed to get subscriptions: %v\n", result.Error)
+		return
+	}
+
+	webhookEvent := newWebhookEvent(event, clusterId, data)
+
+	for _, subscription := range subscriptions {
+		// team channels only receive the incidents routed to them
+		if subscription.TeamID != 0 || !subscription.matches(event, clusterId) {
+			continue
+		}
+
+		s.enqueueWebhook(subscription, webhookEvent)
+	}
+}
+
+func (s *NexServer) enqueueWebhook(subscription Subscription, event WebhookEvent) {
+	select {
+	case s.webhooks.queue <- webhookDelivery{subscription: subscription, event: event}:
+	default:
+		incidentLog.Warnf("Webhook: queue is full, dropped %s for subscription %d\n", event.Event, subscription.ID)
+	}
+}
+
+func slackPayload(event WebhookEvent) map[string]interface{} {
+	text := event.Message
+	if text == "" {
+		text = event.Event
+	}
+
+	if item, ok := event.Data.(DigestItem); ok {
+		text = fmt.Sprintf("*[%s]* %s", strings.ToUpper(item.Severity), text)
+		if item.OnCall != nil {
+			text += fmt.Sprintf("\nOn call: %s", item.OnCall.Name)
+		}
+	}
+
+	return map[string]interface{}{"text": text}
+}
+
+func (s *NexServer) deliverWebhook(delivery webhookDelivery) error {
+	var payload interface{} = delivery.event
+	if delivery.subscription.Type == ChannelTypeSlack {
+		payload = slackPayload(delivery.event)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", delivery.subscription.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "NexServer-Webhook")
+	req.Header.Set("X-NexClipper-Event", delivery.event.Event)
+	req.Header.Set("X-NexClipper-Delivery", delivery.event.Id)
+	if delivery.subscription.Secret != "" {
+		req.Header.Set("X-NexClipper-Signature", webhookSignature(delivery.subscription.Secret, body))
+	}
+
+	resp, err := s.webhooks.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *NexServer) runWebhookDelivery(delivery webhookDelivery) {
+	maxRetries := s.config.Webhook.MaxRetries
+	backoff := time.Second
+
+	var err error
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		err = s.deliverWebhook(delivery)
+		if err == nil {
+			break
+		}
+
+		incidentLog.Errorf("Webhook: delivery %s to subscription %d failed (attempt %d): %v\n",
+			delivery.event.Id, delivery.subscription.ID, attempt+1, err)
+	}
+
+	lastError := ""
+	if err != nil {
+		lastError = err.Error()
+	}
+
+	s.db.Model(&Subscription{}).Where("id=?", delivery.subscription.ID).Updates(map[string]interface{}{
+		"last_delivery_ts": time.Now(),
+		"last_error":       lastError,
+	})
+}
+
+func (s *NexServer) InitWebhookDispatcher() {
+	for delivery := range s.webhooks.queue {
+		go s.runWebhookDelivery(delivery)
+	}
+}
+
+type SubscriptionItem struct {
+	Id             uint       `json:"id"`
+	Type           string     `json:"type"`
+	Url            string     `json:"url"`
+	HasUrl         bool       `json:"has_url"`
+	Events         []string   `json:"events"`
+	ClusterId      uint       `json:"cluster_id"`
+	Disabled       bool       `json:"disabled"`
+	HasSecret      bool       `json:"has_secret"`
+	Digest         bool       `json:"digest"`
+	DigestMinutes  int        `json:"digest_minutes"`
+	DigestSeverity []string   `json:"digest_severities"`
+	OnCallSchedule uint       `json:"on_call_schedule_id"`
+	TeamId         uint       `json:"team_id"`
+	ActiveHours    string     `json:"active_hours"`
+	ActiveDays     string     `json:"active_days"`
+	Timezone       string     `json:"timezone"`
+	OffHours       string     `json:"off_hours_severity"`
+	Locale         string     `json:"locale"`
+	LastDeliveryTs *time.Time `json:"last_delivery_ts"`
+	LastError      string     `json:"last_error"`
+}
+
+// subscriptionUrl returns the url shown for the subscription. The path of
+// a Slack webhook is its credential, so only its scheme and host are shown.
+func subscriptionUrl(channelType string, subscriptionUrl string) string {
+	if channelType != ChannelTypeSlack {
+		return subscriptionUrl
+	}
+
+	target, err := url.Parse(subscriptionUrl)
+	if err != nil {
+		return ""
+	}
+
+	return target.Scheme + "://" + target.Host
+}
+
+func newSubscriptionItem(subscription *Subscription) SubscriptionItem {
+	events := make([]string, 0, 8)
+	if subscription.Events != "" {
+		events = strings.Split(subscription.Events, ",")
+	}
+
+	digestSeverities := make([]string, 0, 3)
+	if subscription.DigestSeverities != "" {
+		digestSeverities = strings.Split(subscription.DigestSeverities, ",")
+	}
+
+	channelType := subscription.Type
+	if channelType == "" {
+		channelType = ChannelTypeWebhook
+	}
+
+	return SubscriptionItem{
+		Id:             subscription.ID,
+		Type:           channelType,
+		Url:            subscriptionUrl(channelType, subscription.Url),
+		HasUrl:         subscription.Url != "",
+		Events:         events,
+		ClusterId:      subscription.ClusterID,
+		Disabled:       subscription.Disabled,
+		HasSecret:      subscription.Secret != "",
+		Digest:         subscription.Digest,
+		DigestMinutes:  subscription.DigestMinutes,
+		DigestSeverity: digestSeverities,
+		OnCallSchedule: subscription.OnCallScheduleID,
+		TeamId:         subscription.TeamID,
+		ActiveHours:    subscription.ActiveHours,
+		ActiveDays:     subscription.ActiveDays,
+		Timezone:       subscription.Timezone,
+		OffHours:       subscription.OffHoursSeverity,
+		Locale:         subscription.Locale,
+		LastDeliveryTs: subscription.LastDeliveryTs,
+		LastError:      subscription.LastError,
+	}
+}
+
+func (s *NexServer) ApiSubscriptionList(c *gin.Context) {
+	var subscriptions []Subscription
+
+	if result := s.requestDB(c).Order("id").Find(&subscriptions); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to get data: %v", result.Error)
+		return
+	}
+
+	items := make([]SubscriptionItem, 0, len(subscriptions))
+	for idx := range subscriptions {
+		items = append(items, newSubscriptionItem(&subscriptions[idx]))
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    items,
+	})
+}
+
+type SubscriptionRequest struct {
+	Type      string   `json:"type"`
+	Url       string   `json:"url"`
+	Secret    string   `json:"secret"`
+	Events    []string `json:"events"`
+	ClusterId uint     `json:"cluster_id"`
+	Disabled  bool     `json:"disabled"`
+
+	Digest           bool     `json:"digest"`
+	DigestMinutes    int      `json:"digest_minutes"`
+	DigestSeverities []string `json:"digest_severities"`
+	OnCallScheduleId uint     `json:"on_call_schedule_id"`
+	TeamId           uint     `json:"team_id"`
+
+	ActiveHours      string `json:"active_hours"`
+	ActiveDays       string `json:"active_days"`
+	Timezone         string `json:"timezone"`
+	OffHoursSeverity string `json:"off_hours_severity"`
+
+	Locale string `json:"locale"`
+}
+
+// bindSubscription validates the request into the subscription, responding
+// on error.
+func (s *NexServer) bindSubscription(c *gin.Context, subscription *Subscription) bool {
+	var req SubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		s.ApiResponseJsonf(c, 400, "bad", "invalid request: %v", err)
+		return false
+	}
+
+	if req.Type == "" {
+		req.Type = ChannelTypeWebhook
+	}
+	if req.Type != ChannelTypeWebhook && req.Type != ChannelTypeSlack {
+		s.ApiResponseJsonf(c, 400, "bad", "unknown channel type: %s", req.Type)
+		return false
+	}
+
+	// the url of a Slack subscription is not shown, updates may omit it
+	if req.Url == "" {
+		req.Url = subscription.Url
+	}
+	target, err := url.Parse(req.Url)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		s.ApiResponseJson(c, 400, "bad", "invalid webhook url")
+		return false
+	}
+	if req.Type == ChannelTypeSlack && target.Scheme != "https" {
+		s.ApiResponseJson(c, 400, "bad", "slack webhook url must use https")
+		return false
+	}
+
+	for _, event := range req.Events {
+		if !stringInSlice(event, webhookEvents) {
+			s.ApiResponseJsonf(c, 400, "bad", "unknown event: %s", event)
+			return false
+		}
+	}
+
+	for _, severity := range req.DigestSeverities {
+		if !isValidSeverity(severity) {
+			s.ApiResponseJsonf(c, 400, "bad", "unknown severity: %s", severity)
+			return false
+		}
+	}
+
+	if _, err := parseActiveWindow(req.ActiveHours, req.ActiveDays, req.Timezone); err != nil {
+		s.ApiResponseJson(c, 400, "bad", err.Error())
+		return false
+	}
+	if req.OffHoursSeverity != "" && !isValidSeverity(req.OffHoursSeverity) {
+		s.ApiResponseJsonf(c, 400, "bad", "unknown severity: %s", req.OffHoursSeverity)
+		return false
+	}
+
+	if req.OnCallScheduleId != 0 {
+		var schedule OnCallSchedule
+		if result := s.requestDB(c).Where("id=?", req.OnCallScheduleId).First(&schedule); result.Error != nil {
+			s.ApiResponseJson(c, 400, "bad", "invalid on-call schedule id")
+			return false
+		}
+	}
+
+	if req.TeamId != 0 {
+		var team Team
+		if result := s.requestDB(c).Where("id=?", req.TeamId).First(&team); result.Error != nil {
+			s.ApiResponseJson(c, 400, "bad", "invalid team id")
+			return false
+		}
+	}
+
+	subscription.Type = req.Type
+	subscription.Url = req.Url
+	subscription.Secret = req.Secret
+	subscription.Events = strings.Join(req.Events, ",")
+	subscription.ClusterID = req.ClusterId
+	subscription.Disabled = req.Disabled
+	subscription.Digest = req.Digest
+	subscription.DigestMinutes = req.DigestMinutes
+	subscription.DigestSeverities = strings.Join(req.DigestSeverities, ",")
+	subscription.OnCallScheduleID = req.OnCallScheduleId
+	subscription.TeamID = req.TeamId
+	subscription.ActiveHours = req.ActiveHours
+	subscription.ActiveDays = req.ActiveDays
+	subscription.Timezone = req.Timezone
+	subscription.OffHoursSeverity = req.OffHoursSeverity
+	subscription.Locale = req.Locale
+
+	return true
+}
+
+func (s *NexServer) ApiCreateSubscription(c *gin.Context) {
+	var subscription Subscription
+	if !s.bindSubscription(c, &subscription) {
+		return
+	}
+
+	if result := s.requestDB(c).Create(&subscription); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to create subscription: %v", result.Error)
+		return
+	}
+
+	c.JSON(201, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    newSubscriptionItem(&subscription),
+	})
+}
+
+func (s *NexServer) ApiUpdateSubscription(c *gin.Context) {
+	subscriptionId, ok := s.idParam(c, "subscriptionId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid subscription id")
+		return
+	}
+
+	var subscription Subscription
+	result := s.requestDB(c).Where("id=?", subscriptionId).First(&subscription)
+	if result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid subscription id")
+		return
+	}
+
+	if !s.bindSubscription(c, &subscription) {
+		return
+	}
+
+	if result := s.requestDB(c).Save(&subscription); result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to update subscription: %v", result.Error)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"status":  "ok",
+		"message": "",
+		"data":    newSubscriptionItem(&subscription),
+	})
+}
+
+func (s *NexServer) ApiDeleteSubscription(c *gin.Context) {
+	subscriptionId, ok := s.idParam(c, "subscriptionId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid subscription id")
+		return
+	}
+
+	result := s.requestDB(c).Where("id=?", subscriptionId).Delete(&Subscription{})
+	if result.Error != nil {
+		s.ApiResponseJsonf(c, 500, "bad", "failed to delete subscription: %v", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		s.ApiResponseJson(c, 404, "bad", "invalid subscription id")
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}
+
+func (s *NexServer) ApiTestSubscription(c *gin.Context) {
+	subscriptionId, ok := s.idParam(c, "subscriptionId", false)
+	if !ok {
+		s.ApiResponseJson(c, 404, "bad", "invalid subscription id")
+		return
+	}
+
+	var subscription Subscription
+	if result := s.requestDB(c).Where("id=?", subscriptionId).First(&subscription); result.Error != nil {
+		s.ApiResponseJson(c, 404, "bad", "invalid subscription id")
+		return
+	}
+
+	err := s.deliverWebhook(webhookDelivery{
+		subscription: subscription,
+		event:        newWebhookEvent(EventWebhookTest, subscription.ClusterID, nil),
+	})
+	if err != nil {
+		s.ApiResponseJsonf(c, 502, "bad", "delivery failed: %v", err)
+		return
+	}
+
+	s.ApiResponseJson(c, 200, "ok", "")
+}